@@ -2,8 +2,13 @@ package debos
 
 import (
 	"bytes"
+	gocontext "context"
+	"fmt"
 	"github.com/go-debos/fakemachine"
 	"log"
+	"os"
+	"path"
+	"time"
 )
 
 type DebosState int
@@ -19,24 +24,49 @@ const (
 type Partition struct {
 	Name       string
 	DevicePath string
+	Number     int
+	FS         string
+	Offset     int64  // Offset from the beginning of the image in bytes
+	Size       int64  // Size in bytes
+	PartUUID   string // UUID of the partition in the partition table
+	Label      string // Name of the partition in a GPT partition table
 }
 
 type CommonContext struct {
-	Scratchdir      string
-	Rootdir         string
-	Artifactdir     string
-	Downloaddir     string
-	Image           string
-	ImagePartitions []Partition
-	ImageMntDir     string
-	ImageFSTab      bytes.Buffer // Fstab as per partitioning
-	ImageKernelRoot string       // Kernel cmdline root= snippet for the / of the image
-	DebugShell      string
-	Origins         map[string]string
-	State           DebosState
-	EnvironVars     map[string]string
-	PrintRecipe     bool
-	Verbose         bool
+	Scratchdir              string
+	Rootdir                 string
+	Artifactdir             string
+	Downloaddir             string
+	Image                   string
+	ImagePartitions         []Partition
+	ImageMntDir             string
+	ImageFSTab              bytes.Buffer // Fstab as per partitioning
+	ImageKernelRoot         string       // Kernel cmdline root= snippet for the / of the image
+	DebugShell              string
+	Origins                 map[string]string
+	State                   DebosState
+	EnvironVars             map[string]string
+	Variables               map[string]string // Template variables set by actions at build time
+	AptProxy                string            // HTTP proxy used by apt in the target rootfs
+	AptCache                string            // Host directory holding the downloaded packages
+	AptCacheClean           bool              // Whether apt-get clean empties AptCache
+	AptSnapshot             string            // Timestamp of snapshot.debian.org the apt sources point to, if any
+	CcacheDir               string            // Host directory holding the ccache of run actions
+	ChrootPath              []string          // Directories prepended to the PATH of the commands run in the target rootfs
+	ChrootEnv               map[string]string // Environment variables of the commands run in the target rootfs
+	DebootstrapCache        string            // Host directory holding the base systems of debootstrap actions
+	DebootstrapCacheRefresh bool              // Whether debootstrap actions replace their cached base system
+	GpgHomedir              string            // GnuPG home directory of the ephemeral signing key
+	MaxParallel             int               // Maximum number of actions run at once by parallel actions, 0 for the CPUs
+	Netrc                   string            // File with the credentials of the servers of download actions, if any
+	KeepOnFailure           bool              // Whether the teardown is skipped once the build failed
+	ShellOnFailure          string            // Shell started in the target rootfs once the build failed, if any
+	Interactive             bool              // Whether debug-shell actions start a shell
+	Shell                   string            // Shell started by debug-shell actions by default
+	Ctx                     gocontext.Context // Cancelled when the running action times out, may be nil
+	CommandOutput           CommandOutput     // How the running action logs the output of its commands
+	PrintRecipe             bool
+	Verbose                 bool
 }
 
 type DebosContext struct {
@@ -50,6 +80,9 @@ type Action interface {
 	Verify(context *DebosContext) error
 	PreMachine(context *DebosContext, m *fakemachine.Machine, args *[]string) error
 	PreNoMachine(context *DebosContext) error
+	// DryRun() method gets called in order instead of Run with --dry-run, so
+	// actions can check what they need is provided by the previous ones
+	DryRun(context *DebosContext) error
 	Run(context *DebosContext) error
 	// Cleanup() method gets called only if the Run for an action
 	// was started and in the same machine (host or fake) as Run has run
@@ -64,10 +97,44 @@ type Action interface {
 type BaseAction struct {
 	Action      string
 	Description string
+	Timeout     time.Duration
+	Quiet       bool          // Only log the output of the commands which fail
+	Verbose     bool          // Log the commands along with their output
+	Retries     int           // Times the main stage is run again after failing
+	RetryDelay  time.Duration `yaml:"retry-delay"`
+}
+
+// Implemented by actions embedding BaseAction
+type timeoutAction interface {
+	timeout() time.Duration
+}
+
+func (b *BaseAction) timeout() time.Duration { return b.Timeout }
+
+// Implemented by actions embedding BaseAction
+type retryAction interface {
+	retry() (int, time.Duration)
+}
+
+func (b *BaseAction) retry() (int, time.Duration) { return b.Retries, b.RetryDelay }
+
+// Implemented by actions embedding BaseAction
+type outputAction interface {
+	commandOutput() CommandOutput
+}
+
+func (b *BaseAction) commandOutput() CommandOutput {
+	switch {
+	case b.Quiet:
+		return OUTPUT_QUIET
+	case b.Verbose:
+		return OUTPUT_VERBOSE
+	}
+	return OUTPUT_DEFAULT
 }
 
 func (b *BaseAction) LogStart() {
-	log.Printf("==== %s ====\n", b)
+	logActionStart(b.String())
 }
 
 func (b *BaseAction) Verify(context *DebosContext) error { return nil }
@@ -77,6 +144,7 @@ func (b *BaseAction) PreMachine(context *DebosContext,
 	return nil
 }
 func (b *BaseAction) PreNoMachine(context *DebosContext) error       { return nil }
+func (b *BaseAction) DryRun(context *DebosContext) error             { return nil }
 func (b *BaseAction) Run(context *DebosContext) error                { return nil }
 func (b *BaseAction) Cleanup(context *DebosContext) error            { return nil }
 func (b *BaseAction) PostMachine(context *DebosContext) error        { return nil }
@@ -87,3 +155,124 @@ func (b *BaseAction) String() string {
 	}
 	return b.Description
 }
+
+/* Origins defined for every build, the downloads add their own ones later on.
+ * The rootfs, recipe, artifact and scratch directories must be set */
+func DefaultOrigins(context *DebosContext) map[string]string {
+	return map[string]string{
+		"artifacts":  context.Artifactdir,
+		"filesystem": context.Rootdir,
+		"recipe":     context.RecipeDir,
+		"scratch":    path.Join(context.Scratchdir, "tmp"),
+	}
+}
+
+/* Directory of the 'scratch' origin, for the intermediate files of the actions
+ * which are removed at the end of the build */
+func ScratchDir(context *DebosContext) string {
+	if dir, found := context.Origins["scratch"]; found {
+		return dir
+	}
+	return context.Scratchdir
+}
+
+/* Check the origin is defined at this point of the recipe. The files of the
+ * 'recipe' origin exist before the build starts, so source is checked too */
+func CheckOrigin(context *DebosContext, origin, source string) error {
+	dir, found := context.Origins[origin]
+	if !found {
+		return fmt.Errorf("Origin not found '%s'", origin)
+	}
+	if origin != "recipe" || source == "" {
+		return nil
+	}
+
+	file, err := RestrictedPath(dir, source)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(file); err != nil {
+		return fmt.Errorf("'%s' not found in origin '%s'", source, origin)
+	}
+
+	return nil
+}
+
+/* Run the action, cancelling the commands it runs once its timeout, if any,
+ * expires. Actions are expected to return shortly after their commands are
+ * cancelled, so their Cleanup method can release the resources they hold */
+func RunAction(context *DebosContext, a Action) error {
+	parent := setLogAction(a.String())
+	defer setLogAction(parent)
+
+	start := time.Now()
+	err := runAction(context, a)
+	logActionEnd(a.String(), time.Since(start), err)
+
+	return err
+}
+
+/* Run an action at the same time as others, without tagging the log records
+ * with it as the ones of the other actions would be tagged too */
+func RunConcurrentAction(context *DebosContext, a Action) error {
+	return runAction(context, a)
+}
+
+func runAction(context *DebosContext, a Action) error {
+	if o, ok := a.(outputAction); ok {
+		saved := context.CommandOutput
+		context.CommandOutput = o.commandOutput()
+		defer func() { context.CommandOutput = saved }()
+	}
+
+	retries, delay := 0, time.Duration(0)
+	if r, ok := a.(retryAction); ok {
+		retries, delay = r.retry()
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := runAttempt(context, a)
+		// Don't hold an interrupted build
+		if err == nil || attempt > retries || (context.Ctx != nil && context.Ctx.Err() != nil) {
+			return err
+		}
+
+		log.Printf("Action '%s' failed: %v, running it again in %s (%d of %d retries)", a, err, delay, attempt, retries)
+		if context.Ctx == nil {
+			time.Sleep(delay)
+			continue
+		}
+		select {
+		case <-time.After(delay):
+		case <-context.Ctx.Done():
+			return err
+		}
+	}
+}
+
+// Run the action once, within its timeout if any
+func runAttempt(context *DebosContext, a Action) error {
+	t, ok := a.(timeoutAction)
+	if !ok || t.timeout() == 0 {
+		return a.Run(context)
+	}
+
+	parent := context.Ctx
+	if parent == nil {
+		parent = gocontext.Background()
+	}
+	ctx, cancel := gocontext.WithTimeout(parent, t.timeout())
+	defer cancel()
+
+	saved := context.Ctx
+	context.Ctx = ctx
+	defer func() { context.Ctx = saved }()
+
+	err := a.Run(context)
+	// Let the enclosing action report its own timeout
+	if ctx.Err() == gocontext.DeadlineExceeded && parent.Err() == nil {
+		return fmt.Errorf("Action '%s' timed out after %s", a, t.timeout())
+	}
+
+	return err
+}
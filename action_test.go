@@ -0,0 +1,112 @@
+package debos
+
+import (
+	gocontext "context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type sleepAction struct {
+	BaseAction
+	Duration string
+	ran      bool
+}
+
+func (s *sleepAction) Run(context *DebosContext) error {
+	s.ran = true
+	return NewCommandForContext(*context).Run("sleep", "sleep", s.Duration)
+}
+
+func TestRunActionTimeout(t *testing.T) {
+	context := DebosContext{&CommonContext{}, "", ""}
+
+	a := &sleepAction{BaseAction: BaseAction{Action: "sleep", Timeout: 100 * time.Millisecond}, Duration: "60"}
+	assert.EqualError(t, RunAction(&context, a), "Action 'sleep' timed out after 100ms")
+	assert.Nil(t, context.Ctx)
+
+	a = &sleepAction{BaseAction: BaseAction{Action: "sleep", Timeout: time.Minute}, Duration: "0"}
+	assert.Empty(t, RunAction(&context, a))
+
+	// No timeout by default
+	a = &sleepAction{BaseAction: BaseAction{Action: "sleep"}, Duration: "0"}
+	assert.Empty(t, RunAction(&context, a))
+	assert.True(t, a.ran)
+}
+
+type unpackAction struct {
+	BaseAction
+	File        string
+	Destination string
+}
+
+func (u *unpackAction) Run(context *DebosContext) error {
+	archive, err := NewArchive(u.File)
+	if err != nil {
+		return err
+	}
+	archive.SetContext(context)
+	return archive.Unpack(u.Destination)
+}
+
+// The unpacking tools are terminated with the action
+func TestUnpackTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	// tar waits forever for a writer to open the FIFO
+	file := path.Join(dir, "stuck.tar")
+	assert.Empty(t, syscall.Mkfifo(file, 0644))
+
+	context := DebosContext{&CommonContext{}, "", ""}
+	a := &unpackAction{BaseAction: BaseAction{Action: "unpack", Timeout: 100 * time.Millisecond},
+		File: file, Destination: path.Join(dir, "root")}
+	start := time.Now()
+	assert.EqualError(t, RunAction(&context, a), "Action 'unpack' timed out after 100ms")
+	assert.True(t, time.Since(start) < 10*time.Second)
+}
+
+type flakyAction struct {
+	BaseAction
+	failures int
+	attempts int
+}
+
+func (f *flakyAction) Run(context *DebosContext) error {
+	f.attempts++
+	if f.attempts <= f.failures {
+		return fmt.Errorf("attempt %d failed", f.attempts)
+	}
+	return nil
+}
+
+func TestRunActionRetries(t *testing.T) {
+	context := DebosContext{&CommonContext{}, "", ""}
+
+	a := &flakyAction{BaseAction: BaseAction{Action: "flaky", Retries: 2, RetryDelay: time.Millisecond}, failures: 2}
+	assert.Empty(t, RunAction(&context, a))
+	assert.Equal(t, 3, a.attempts)
+
+	a = &flakyAction{BaseAction: BaseAction{Action: "flaky", Retries: 1}, failures: 2}
+	assert.EqualError(t, RunAction(&context, a), "attempt 2 failed")
+	assert.Equal(t, 2, a.attempts)
+
+	// Not retried by default, nor once interrupted
+	a = &flakyAction{BaseAction: BaseAction{Action: "flaky"}, failures: 1}
+	assert.Error(t, RunAction(&context, a))
+	assert.Equal(t, 1, a.attempts)
+
+	ctx, cancel := gocontext.WithCancel(gocontext.Background())
+	cancel()
+	context.Ctx = ctx
+	a = &flakyAction{BaseAction: BaseAction{Action: "flaky", Retries: 3}, failures: 1}
+	assert.Error(t, RunAction(&context, a))
+	assert.Equal(t, 1, a.attempts)
+}
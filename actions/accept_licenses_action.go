@@ -0,0 +1,196 @@
+/*
+AcceptLicenses Action
+
+Preseed the debconf questions asking to accept the license of some non-free
+packages, then install those packages with 'apt'. Without it the installation
+of packages such as 'ttf-mscorefonts-installer' blocks on an interactive
+license prompt, or fails as no answer can be given.
+
+The license questions of the following packages are known: 'firmware-ipw2x00',
+'firmware-ivtv', 'ttf-mscorefonts-installer' and 'virtualbox-ext-pack'. The
+questions of other packages have to be given with the 'questions' property.
+
+Yaml syntax:
+ - action: accept-licenses
+   packages:
+     - ttf-mscorefonts-installer
+     - package1
+   questions:
+     - package: package1
+       question: package1/license-accepted
+       type: boolean
+       value: true
+
+Mandatory properties:
+
+- packages -- list of packages to accept the license of and install.
+
+Optional properties:
+
+- questions -- list of license questions for packages which are not known,
+or to override the known ones. Each question has the following properties:
+
+  - package -- package owning the question, it must be in 'packages'.
+
+  - question -- name of the debconf question, such as 'package/accepted'.
+
+  - type -- debconf type of the question, either 'boolean', 'select' or
+  'string'. By default is 'boolean'.
+
+  - value -- answer accepting the license. By default is 'true'.
+*/
+package actions
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/go-debos/debos"
+)
+
+type LicenseQuestion struct {
+	Package  string
+	Question string
+	Type     string
+	Value    string
+}
+
+type AcceptLicensesAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Packages         []string
+	Questions        []LicenseQuestion
+}
+
+// License questions of well known non-free packages
+var knownLicenseQuestions = map[string][]LicenseQuestion{
+	"firmware-ipw2x00": {
+		{Question: "firmware-ipw2x00/license/accepted", Type: "boolean", Value: "true"},
+	},
+	"firmware-ivtv": {
+		{Question: "firmware-ivtv/license/accepted", Type: "boolean", Value: "true"},
+	},
+	"ttf-mscorefonts-installer": {
+		{Question: "msttcorefonts/accepted-mscorefonts-eula", Type: "boolean", Value: "true"},
+	},
+	"virtualbox-ext-pack": {
+		{Question: "virtualbox-ext-pack/license", Type: "boolean", Value: "true"},
+	},
+}
+
+var debconfQuestion = regexp.MustCompile(`^[a-z0-9][a-z0-9+.-]*/[A-Za-z0-9/_.+-]+$`)
+
+func (l *LicenseQuestion) verify() error {
+	if l.Type == "" {
+		l.Type = "boolean"
+	}
+	if l.Value == "" {
+		l.Value = "true"
+	}
+
+	if !debconfQuestion.MatchString(l.Question) {
+		return fmt.Errorf("Invalid question '%s' for package %s", l.Question, l.Package)
+	}
+
+	switch l.Type {
+	case "boolean":
+		if l.Value != "true" && l.Value != "false" {
+			return fmt.Errorf("Invalid value '%s' for boolean question %s", l.Value, l.Question)
+		}
+	case "select", "string":
+		if strings.Contains(l.Value, "\n") {
+			return fmt.Errorf("Invalid value for question %s", l.Question)
+		}
+	default:
+		return fmt.Errorf("Unsupported type '%s' for question %s", l.Type, l.Question)
+	}
+
+	return nil
+}
+
+func (a *AcceptLicensesAction) Verify(context *debos.DebosContext) error {
+	if len(a.Packages) == 0 {
+		return errors.New("'packages' property can't be empty")
+	}
+
+	packages := map[string]bool{}
+	for _, p := range a.Packages {
+		packages[p] = true
+	}
+
+	given := map[string]bool{}
+	for idx := range a.Questions {
+		q := &a.Questions[idx]
+		if !packages[q.Package] {
+			return fmt.Errorf("Question %s is for package '%s' which is not in packages", q.Question, q.Package)
+		}
+		if err := q.verify(); err != nil {
+			return err
+		}
+		given[q.Package] = true
+	}
+
+	for _, p := range a.Packages {
+		if _, ok := knownLicenseQuestions[p]; !ok && !given[p] {
+			return fmt.Errorf("No license question known for package '%s'", p)
+		}
+	}
+
+	return nil
+}
+
+// Returns the answers in the debconf-set-selections format
+func (a *AcceptLicensesAction) selections() string {
+	var lines []string
+
+	given := map[string]bool{}
+	for _, q := range a.Questions {
+		lines = append(lines, fmt.Sprintf("%s %s %s %s", q.Package, q.Question, q.Type, q.Value))
+		given[q.Package] = true
+	}
+
+	var known []string
+	for _, p := range a.Packages {
+		if given[p] {
+			continue
+		}
+		for _, q := range knownLicenseQuestions[p] {
+			known = append(known, fmt.Sprintf("%s %s %s %s", p, q.Question, q.Type, q.Value))
+		}
+	}
+	sort.Strings(known)
+
+	return strings.Join(append(lines, known...), "\n") + "\n"
+}
+
+func (a *AcceptLicensesAction) preseed(context *debos.DebosContext) error {
+	f, err := ioutil.TempFile(path.Join(context.Rootdir, "tmp"), "debos-licenses")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString(a.selections())
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	c := debos.NewChrootCommandForContext(*context)
+	return c.Run("accept-licenses", "debconf-set-selections", path.Join("/tmp", path.Base(f.Name())))
+}
+
+func (a *AcceptLicensesAction) Run(context *debos.DebosContext) error {
+	a.LogStart()
+
+	if err := a.preseed(context); err != nil {
+		return fmt.Errorf("Couldn't preseed the license questions: %v", err)
+	}
+
+	return installPackages(context, a.Packages...)
+}
@@ -0,0 +1,68 @@
+package actions
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+
+	"github.com/go-debos/debos"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAcceptLicenses(t *testing.T) {
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+
+	a := AcceptLicensesAction{
+		Packages: []string{"ttf-mscorefonts-installer", "firmware-ipw2x00", "steam"},
+		Questions: []LicenseQuestion{
+			{Package: "steam", Question: "steam/question", Type: "select", Value: "I AGREE"},
+			{Package: "steam", Question: "steam/license", Type: "string", Value: "accepted"},
+		},
+	}
+	assert.Empty(t, a.Verify(&context))
+
+	selections := a.selections()
+	assert.Equal(t, `steam steam/question select I AGREE
+steam steam/license string accepted
+firmware-ipw2x00 firmware-ipw2x00/license/accepted boolean true
+ttf-mscorefonts-installer msttcorefonts/accepted-mscorefonts-eula boolean true
+`, selections)
+
+	// The answers must be understood by debconf for the install not to prompt
+	if _, err := exec.LookPath("debconf-set-selections"); err == nil {
+		dir, err := ioutil.TempDir("", "go-debos")
+		assert.Empty(t, err)
+		defer os.RemoveAll(dir)
+
+		file := path.Join(dir, "selections")
+		assert.Empty(t, ioutil.WriteFile(file, []byte(selections), 0644))
+		assert.Empty(t, exec.Command("debconf-set-selections", "--checkonly", file).Run())
+	}
+
+	// Questions given for a known package replace the known ones
+	a = AcceptLicensesAction{
+		Packages:  []string{"firmware-ivtv"},
+		Questions: []LicenseQuestion{{Package: "firmware-ivtv", Question: "firmware-ivtv/accepted"}},
+	}
+	assert.Empty(t, a.Verify(&context))
+	assert.Equal(t, "firmware-ivtv firmware-ivtv/accepted boolean true\n", a.selections())
+
+	for q, msg := range map[*LicenseQuestion]string{
+		{Package: "other", Question: "other/license"}:                                "Question other/license is for package 'other' which is not in packages",
+		{Package: "steam", Question: "license"}:                                      "Invalid question 'license' for package steam",
+		{Package: "steam", Question: "steam/license", Value: "yes"}:                  "Invalid value 'yes' for boolean question steam/license",
+		{Package: "steam", Question: "steam/license", Type: "note"}:                  "Unsupported type 'note' for question steam/license",
+		{Package: "steam", Question: "steam/license", Type: "select", Value: "a\nb"}: "Invalid value for question steam/license",
+	} {
+		a = AcceptLicensesAction{Packages: []string{"steam"}, Questions: []LicenseQuestion{*q}}
+		assert.EqualError(t, a.Verify(&context), msg)
+	}
+
+	a = AcceptLicensesAction{Packages: []string{"steam"}}
+	assert.EqualError(t, a.Verify(&context), "No license question known for package 'steam'")
+
+	a = AcceptLicensesAction{}
+	assert.EqualError(t, a.Verify(&context), "'packages' property can't be empty")
+}
@@ -7,35 +7,316 @@ Yaml syntax:
  - action: apt
    recommends: bool
    unauthenticated: bool
+   clean: bool
+   autoremove: bool
    packages:
      - package1
      - package2
+   hold:
+     - package1
+   unhold:
+     - package3
 
 Mandatory properties:
 
-- packages -- list of packages to install
+- packages -- list of packages to install, optional when 'hold' or 'unhold' is
+set
 
 Optional properties:
 
+- hold -- list of packages to hold with 'apt-mark hold' once the packages are
+installed, so they aren't upgraded. They must be installed in the target
+rootfs.
+
+- unhold -- list of packages to release with 'apt-mark unhold' once the
+packages are installed.
+
+The held packages are logged once the holds are set.
+
 - recommends -- boolean indicating if suggested packages will be installed
 
 - unauthenticated -- boolean indicating if unauthenticated packages can be installed
+
+- clean -- boolean indicating if the downloaded packages are removed with
+'apt-get clean' once installed. By default is 'true', set it to 'false' to
+keep them, for example while debugging a recipe.
+
+- autoremove -- boolean indicating if the packages which are no longer needed
+are removed with 'apt-get autoremove --purge' once the packages are
+installed. By default is 'false'.
+
+The 'apt-proxy', 'apt-cache', 'apt-cache-clean' and 'apt-snapshot' recipe
+properties apply to this action.
 */
 package actions
 
 import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
 	"github.com/go-debos/debos"
 )
 
+const aptProxyConf = "/etc/apt/apt.conf.d/90debos-proxy"
+const aptSnapshotConf = "/etc/apt/apt.conf.d/90debos-snapshot"
+
+// Archives of snapshot.debian.org, by their path on the Debian mirrors
+var snapshotArchive = regexp.MustCompile(`^/(debian|debian-security|debian-ports|debian-debug)/?$`)
+
+var sourceURL = regexp.MustCompile(`https?://[^\s\]]+`)
+
 type AptAction struct {
 	debos.BaseAction `yaml:",inline"`
 	Recommends       bool
 	Unauthenticated  bool
+	Clean            bool
+	Autoremove       bool
 	Packages         []string
+	Hold             []string
+	Unhold           []string
+}
+
+func NewAptAction() *AptAction {
+	return &AptAction{Clean: true}
+}
+
+// installPackages installs packages needed by other actions in the target rootfs
+func installPackages(context *debos.DebosContext, packages ...string) error {
+	apt := AptAction{Packages: packages, Clean: true}
+	return apt.install(context)
+}
+
+/* Configure apt in the target rootfs to use the proxy of the recipe, if any,
+ * returns the function removing the configuration */
+func setupAptProxy(context *debos.DebosContext) (func(), error) {
+	if context.AptProxy == "" {
+		return func() {}, nil
+	}
+
+	proxy := path.Join(context.Rootdir, aptProxyConf)
+	conf := fmt.Sprintf("Acquire::http::Proxy \"%s\";\n", context.AptProxy)
+	if err := ioutil.WriteFile(proxy, []byte(conf), 0644); err != nil {
+		return nil, fmt.Errorf("Couldn't configure apt proxy: %v", err)
+	}
+
+	return func() { os.Remove(proxy) }, nil
+}
+
+/* Returns the URL of the archive of the Debian mirror at the snapshot
+ * timestamp, or the URL unchanged if it isn't a Debian mirror. The snapshot is
+ * fetched with http so it goes through the apt proxy like the mirrors */
+func snapshotURL(mirror, timestamp string) string {
+	u, err := url.Parse(mirror)
+	if err != nil {
+		return mirror
+	}
+	host := u.Hostname()
+	if (host != "debian.org" && !strings.HasSuffix(host, ".debian.org")) || host == "snapshot.debian.org" {
+		return mirror
+	}
+	m := snapshotArchive.FindStringSubmatch(u.Path)
+	if m == nil {
+		return mirror
+	}
+	return fmt.Sprintf("http://snapshot.debian.org/archive/%s/%s/", m[1], timestamp)
+}
+
+// Rewrite the URLs of the Debian mirrors of a sources.list or deb822 file
+func snapshotSources(content, timestamp string) string {
+	return sourceURL.ReplaceAllStringFunc(content, func(u string) string {
+		return snapshotURL(u, timestamp)
+	})
+}
+
+/* Point the apt sources of the target rootfs to the snapshot of the recipe,
+ * if any, without checking how old the archive is. Returns the function
+ * restoring the sources */
+func setupAptSnapshot(context *debos.DebosContext) (func(), error) {
+	if context.AptSnapshot == "" {
+		return func() {}, nil
+	}
+
+	conf := path.Join(context.Rootdir, aptSnapshotConf)
+	originals := map[string][]byte{}
+	restore := func() {
+		for f, content := range originals {
+			if err := ioutil.WriteFile(f, content, 0644); err != nil {
+				log.Printf("Couldn't restore %s: %v", f, err)
+			}
+		}
+		os.Remove(conf)
+	}
+
+	files, err := filepath.Glob(path.Join(context.Rootdir, "etc/apt/sources.list.d/*"))
+	if err != nil {
+		return nil, err
+	}
+	files = append([]string{path.Join(context.Rootdir, "etc/apt/sources.list")}, files...)
+	for _, f := range files {
+		if !strings.HasSuffix(f, ".list") && !strings.HasSuffix(f, ".sources") {
+			continue
+		}
+		// Links could lead out of the target rootfs
+		if info, err := os.Lstat(f); err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		content, err := ioutil.ReadFile(f)
+		if err != nil {
+			restore()
+			return nil, err
+		}
+		rewritten := snapshotSources(string(content), context.AptSnapshot)
+		if rewritten == string(content) {
+			continue
+		}
+		if err := ioutil.WriteFile(f, []byte(rewritten), 0644); err != nil {
+			restore()
+			return nil, fmt.Errorf("Couldn't configure apt snapshot: %v", err)
+		}
+		originals[f] = content
+	}
+
+	if err := ioutil.WriteFile(conf, []byte("Acquire::Check-Valid-Until \"false\";\n"), 0644); err != nil {
+		restore()
+		return nil, fmt.Errorf("Couldn't configure apt snapshot: %v", err)
+	}
+
+	return restore, nil
+}
+
+/* Configure apt in the target rootfs for the proxy and the snapshot of the
+ * recipe, returns the function removing the configuration */
+func setupAptConfig(context *debos.DebosContext) (func(), error) {
+	removeProxy, err := setupAptProxy(context)
+	if err != nil {
+		return nil, err
+	}
+	removeSnapshot, err := setupAptSnapshot(context)
+	if err != nil {
+		removeProxy()
+		return nil, err
+	}
+
+	return func() {
+		removeSnapshot()
+		removeProxy()
+	}, nil
+}
+
+func (apt *AptAction) Verify(context *debos.DebosContext) error {
+	if len(apt.Packages) == 0 && len(apt.Hold) == 0 && len(apt.Unhold) == 0 {
+		return fmt.Errorf("'packages' property can't be empty")
+	}
+
+	for _, h := range apt.Hold {
+		for _, u := range apt.Unhold {
+			if h == u {
+				return fmt.Errorf("Package %s can't be both held and unheld", h)
+			}
+		}
+	}
+
+	return nil
 }
 
 func (apt *AptAction) Run(context *debos.DebosContext) error {
 	apt.LogStart()
+
+	if len(apt.Packages) > 0 {
+		if err := apt.install(context); err != nil {
+			return err
+		}
+	}
+
+	if len(apt.Hold) > 0 || len(apt.Unhold) > 0 {
+		return apt.markHolds(context)
+	}
+
+	return nil
+}
+
+// Whether the package, optionally with ':<arch>', is one of the packages
+func matchPackage(p dpkgPackage, name string) bool {
+	return p.name == name || p.name+":"+p.arch == name
+}
+
+/* Hold and unhold the packages, then check the holds of the dpkg database and
+ * log them */
+func (apt *AptAction) markHolds(context *debos.DebosContext) error {
+	status := path.Join(context.Rootdir, "var/lib/dpkg/status")
+	packages, err := readDpkgStatus(status)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range apt.Hold {
+		installed := false
+		for _, p := range packages {
+			if matchPackage(p, name) && strings.HasSuffix(p.status, " installed") {
+				installed = true
+			}
+		}
+		if !installed {
+			return fmt.Errorf("Can't hold %s, it isn't installed", name)
+		}
+	}
+
+	c := debos.NewChrootCommandForContext(*context)
+	if len(apt.Hold) > 0 {
+		if err := c.Run("apt-mark", append([]string{"apt-mark", "hold"}, apt.Hold...)...); err != nil {
+			return err
+		}
+	}
+	if len(apt.Unhold) > 0 {
+		if err := c.Run("apt-mark", append([]string{"apt-mark", "unhold"}, apt.Unhold...)...); err != nil {
+			return err
+		}
+	}
+
+	if packages, err = readDpkgStatus(status); err != nil {
+		return err
+	}
+
+	var held []string
+	for _, p := range packages {
+		if strings.HasPrefix(p.status, "hold ") {
+			held = append(held, p.name+":"+p.arch)
+		}
+	}
+	for _, name := range apt.Hold {
+		found := false
+		for _, p := range packages {
+			found = found || (matchPackage(p, name) && strings.HasPrefix(p.status, "hold "))
+		}
+		if !found {
+			return fmt.Errorf("Package %s isn't held", name)
+		}
+	}
+	for _, name := range apt.Unhold {
+		for _, p := range packages {
+			if matchPackage(p, name) && strings.HasPrefix(p.status, "hold ") {
+				return fmt.Errorf("Package %s is still held", name)
+			}
+		}
+	}
+
+	if len(held) == 0 {
+		log.Printf("No held packages")
+	} else {
+		log.Printf("Held packages: %s", strings.Join(held, " "))
+	}
+
+	return nil
+}
+
+func (apt *AptAction) install(context *debos.DebosContext) error {
 	aptOptions := []string{"apt-get", "-y"}
 
 	if !apt.Recommends {
@@ -49,10 +330,19 @@ func (apt *AptAction) Run(context *debos.DebosContext) error {
 	aptOptions = append(aptOptions, "install")
 	aptOptions = append(aptOptions, apt.Packages...)
 
+	removeConfig, err := setupAptConfig(context)
+	if err != nil {
+		return err
+	}
+	defer removeConfig()
+
 	c := debos.NewChrootCommandForContext(*context)
 	c.AddEnv("DEBIAN_FRONTEND=noninteractive")
+	if context.AptCache != "" {
+		c.AddBindMount(context.AptCache, "/var/cache/apt/archives")
+	}
 
-	err := c.Run("apt", "apt-get", "update")
+	err = c.Run("apt", "apt-get", "update")
 	if err != nil {
 		return err
 	}
@@ -60,6 +350,23 @@ func (apt *AptAction) Run(context *debos.DebosContext) error {
 	if err != nil {
 		return err
 	}
+
+	if apt.Autoremove {
+		err = c.Run("apt", "apt-get", "-y", "autoremove", "--purge")
+		if err != nil {
+			return err
+		}
+	}
+
+	if !apt.Clean {
+		return nil
+	}
+
+	/* Unless asked to, clean without the cache mounted so the packages
+	 * kept on the host are not removed */
+	if context.AptCache != "" && !context.AptCacheClean {
+		c = debos.NewChrootCommandForContext(*context)
+	}
 	err = c.Run("apt", "apt-get", "clean")
 	if err != nil {
 		return err
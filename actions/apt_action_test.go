@@ -0,0 +1,30 @@
+package actions_test
+
+import (
+	"testing"
+
+	"github.com/go-debos/debos"
+	"github.com/go-debos/debos/actions"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAptVerify(t *testing.T) {
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+
+	apt := actions.NewAptAction()
+	assert.EqualError(t, apt.Verify(&context), "'packages' property can't be empty")
+
+	// Holding installed packages doesn't require installing any
+	apt.Hold = []string{"linux-image-arm64", "u-boot-rpi:arm64"}
+	assert.Empty(t, apt.Verify(&context))
+
+	apt.Packages = []string{"linux-image-arm64"}
+	apt.Unhold = []string{"linux-image-arm64"}
+	assert.EqualError(t, apt.Verify(&context), "Package linux-image-arm64 can't be both held and unheld")
+}
+
+func TestAptDefaults(t *testing.T) {
+	apt := actions.NewAptAction()
+	assert.True(t, apt.Clean)
+	assert.False(t, apt.Autoremove)
+}
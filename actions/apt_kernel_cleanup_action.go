@@ -0,0 +1,113 @@
+/*
+AptKernelCleanup Action
+
+Install 'unattended-upgrades' in the target rootfs and configure it to remove
+the kernels which are no longer used, so devices updated in the field don't
+fill '/boot' with old kernels. Apt always keeps the running kernel and the
+most recent ones. The configuration is written to
+'/etc/apt/apt.conf.d/52debos-kernel-cleanup', overriding the defaults of the
+package.
+
+Yaml syntax:
+ - action: apt-kernel-cleanup
+   interval: 1
+   remove-unused-kernels: true
+   remove-unused-dependencies: false
+
+Optional properties:
+
+- interval -- number of days between the runs of 'unattended-upgrades', which
+update the package lists, upgrade the packages and remove the old kernels.
+'0' disables the periodic runs, for systems running 'unattended-upgrades' by
+other means. By default is '1'.
+
+- remove-unused-kernels -- remove the kernel packages which are no longer
+needed. By default is 'true'.
+
+- remove-unused-dependencies -- also remove all the packages which are no
+longer needed, like 'apt-get autoremove'. By default is 'false'.
+*/
+package actions
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/go-debos/debos"
+)
+
+const aptKernelCleanupConf = "/etc/apt/apt.conf.d/52debos-kernel-cleanup"
+
+type AptKernelCleanupAction struct {
+	debos.BaseAction         `yaml:",inline"`
+	Interval                 int
+	RemoveUnusedKernels      bool `yaml:"remove-unused-kernels"`
+	RemoveUnusedDependencies bool `yaml:"remove-unused-dependencies"`
+}
+
+func NewAptKernelCleanupAction() *AptKernelCleanupAction {
+	a := AptKernelCleanupAction{}
+	a.Interval = 1
+	a.RemoveUnusedKernels = true
+
+	return &a
+}
+
+func (a *AptKernelCleanupAction) Verify(context *debos.DebosContext) error {
+	if a.Interval < 0 {
+		return fmt.Errorf("Invalid interval %d", a.Interval)
+	}
+
+	if !a.RemoveUnusedKernels && !a.RemoveUnusedDependencies {
+		return errors.New("Nothing to remove, 'remove-unused-kernels' or 'remove-unused-dependencies' must be enabled")
+	}
+
+	return nil
+}
+
+func aptConfBool(value bool) string {
+	if value {
+		return "true"
+	}
+	return "false"
+}
+
+func (a *AptKernelCleanupAction) config() string {
+	lines := []string{
+		"// Generated by debos",
+		fmt.Sprintf("APT::Periodic::Update-Package-Lists \"%d\";", a.Interval),
+		fmt.Sprintf("APT::Periodic::Unattended-Upgrade \"%d\";", a.Interval),
+		fmt.Sprintf("Unattended-Upgrade::Remove-Unused-Kernel-Packages \"%s\";",
+			aptConfBool(a.RemoveUnusedKernels)),
+		fmt.Sprintf("Unattended-Upgrade::Remove-Unused-Dependencies \"%s\";",
+			aptConfBool(a.RemoveUnusedDependencies)),
+	}
+
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func (a *AptKernelCleanupAction) configure(context *debos.DebosContext) error {
+	conf := path.Join(context.Rootdir, aptKernelCleanupConf)
+	if err := os.MkdirAll(path.Dir(conf), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(conf, []byte(a.config()), 0644); err != nil {
+		return fmt.Errorf("Couldn't write %s: %v", aptKernelCleanupConf, err)
+	}
+
+	return nil
+}
+
+func (a *AptKernelCleanupAction) Run(context *debos.DebosContext) error {
+	a.LogStart()
+
+	if err := installPackages(context, "unattended-upgrades"); err != nil {
+		return err
+	}
+
+	return a.configure(context)
+}
@@ -0,0 +1,53 @@
+package actions
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/go-debos/debos"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAptKernelCleanup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+	context.Rootdir = dir
+
+	a := NewAptKernelCleanupAction()
+	assert.Empty(t, a.Verify(&context))
+	assert.Empty(t, a.configure(&context))
+
+	conf, err := ioutil.ReadFile(path.Join(dir, "etc/apt/apt.conf.d/52debos-kernel-cleanup"))
+	assert.Empty(t, err)
+	assert.Equal(t, `// Generated by debos
+APT::Periodic::Update-Package-Lists "1";
+APT::Periodic::Unattended-Upgrade "1";
+Unattended-Upgrade::Remove-Unused-Kernel-Packages "true";
+Unattended-Upgrade::Remove-Unused-Dependencies "false";
+`, string(conf))
+
+	a.Interval = 0
+	a.RemoveUnusedKernels = false
+	a.RemoveUnusedDependencies = true
+	assert.Empty(t, a.Verify(&context))
+	assert.Empty(t, a.configure(&context))
+
+	conf, err = ioutil.ReadFile(path.Join(dir, "etc/apt/apt.conf.d/52debos-kernel-cleanup"))
+	assert.Empty(t, err)
+	assert.Contains(t, string(conf), "APT::Periodic::Unattended-Upgrade \"0\";\n")
+	assert.Contains(t, string(conf), "Remove-Unused-Kernel-Packages \"false\";\n")
+	assert.Contains(t, string(conf), "Remove-Unused-Dependencies \"true\";\n")
+
+	a.RemoveUnusedDependencies = false
+	assert.EqualError(t, a.Verify(&context),
+		"Nothing to remove, 'remove-unused-kernels' or 'remove-unused-dependencies' must be enabled")
+
+	a = NewAptKernelCleanupAction()
+	a.Interval = -1
+	assert.EqualError(t, a.Verify(&context), "Invalid interval -1")
+}
@@ -0,0 +1,351 @@
+/*
+AptRepository Action
+
+Create a signed apt repository in the artifact directory from Debian packages
+available to the recipe, for example device specific packages built by
+earlier actions, so they can be published along with the image. The
+repository is not added to the target rootfs.
+
+The packages are copied to the 'pool' directory of the repository, the
+indexes are generated with 'apt-ftparchive' and the 'Release' file is signed
+with GnuPG, both as 'InRelease' and 'Release.gpg'. The signature is verified
+before the action completes.
+
+Yaml syntax:
+ - action: apt-repository
+   directory: repository
+   suite: stable
+   component: main
+   origin: Example
+   label: Example device packages
+   packages:
+     - origin: name
+       files: "*.deb"
+   gpg-sign: key id
+   gpg-homedir: path to GnuPG home directory
+
+Mandatory properties:
+
+- directory -- directory of the repository, relative to the artifact
+directory. Existing indexes are replaced.
+
+- packages -- list of packages to add to the repository. Each entry has an
+optional 'origin', reference to a named file or directory which defaults to
+the 'artifacts' directory, and 'files', a shell glob pattern relative to the
+origin. Each pattern must match at least one '.deb' file. Indexes are
+generated for the architectures of the packages, or the recipe architecture
+if all packages are architecture independent.
+
+- gpg-sign -- GPG key ID used to sign the repository.
+
+Optional properties:
+
+- suite -- name of the suite, or distribution, of the repository. By default
+is 'stable'.
+
+- component -- name of the component the packages are added to. By default is
+'main'.
+
+- origin -- value of the 'Origin' field of the 'Release' file.
+
+- label -- value of the 'Label' field of the 'Release' file.
+
+- gpg-homedir -- GnuPG home directory containing the signing key, relative to
+the recipe directory. If unset, the one of the key generated by a previous
+'gpg-ephemeral-key' action is used, or else the default GnuPG home directory.
+
+The repository can then be used with a line like:
+
+ deb [signed-by=/path/to/key.gpg] https://example.com/repository stable main
+*/
+package actions
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-debos/debos"
+	"github.com/go-debos/fakemachine"
+)
+
+type AptRepositoryPackages struct {
+	Origin string
+	Files  string
+}
+
+type AptRepositoryAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Directory        string
+	Suite            string
+	Component        string
+	Origin           string
+	Label            string
+	Packages         []AptRepositoryPackages
+	GpgSign          string `yaml:"gpg-sign"`
+	GpgHomedir       string `yaml:"gpg-homedir"`
+}
+
+func NewAptRepositoryAction() *AptRepositoryAction {
+	ar := AptRepositoryAction{}
+	ar.Suite = "stable"
+	ar.Component = "main"
+
+	return &ar
+}
+
+func (ar *AptRepositoryAction) Verify(context *debos.DebosContext) error {
+	if len(ar.Directory) == 0 {
+		return errors.New("'directory' property can't be empty")
+	}
+	if path.IsAbs(ar.Directory) {
+		return fmt.Errorf("Repository '%s' must be relative to the artifact directory", ar.Directory)
+	}
+	if _, err := debos.RestrictedPath(context.Artifactdir, ar.Directory); err != nil {
+		return err
+	}
+
+	if len(ar.Packages) == 0 {
+		return errors.New("'packages' property can't be empty")
+	}
+	for _, p := range ar.Packages {
+		if len(p.Files) == 0 {
+			return errors.New("'files' property of packages can't be empty")
+		}
+		if _, err := filepath.Match(p.Files, ""); err != nil {
+			return fmt.Errorf("Invalid pattern '%s': %v", p.Files, err)
+		}
+	}
+
+	for _, name := range []string{ar.Suite, ar.Component} {
+		if name == "" || strings.ContainsAny(name, " /\t\n") {
+			return fmt.Errorf("Invalid suite or component name '%s'", name)
+		}
+	}
+
+	if ar.GpgSign == "" {
+		return errors.New("'gpg-sign' property can't be empty")
+	}
+	if ar.GpgHomedir != "" {
+		ar.GpgHomedir = debos.CleanPathAt(ar.GpgHomedir, context.RecipeDir)
+	}
+
+	return nil
+}
+
+func (ar *AptRepositoryAction) PreMachine(context *debos.DebosContext, m *fakemachine.Machine,
+	args *[]string) error {
+	if ar.GpgHomedir != "" {
+		m.AddVolume(ar.GpgHomedir)
+	}
+	return nil
+}
+
+// Copy the packages to the pool, returning the architectures found
+func (ar *AptRepositoryAction) fillPool(context *debos.DebosContext, repo string) ([]string, error) {
+	arches := map[string]bool{}
+	pool := path.Join(repo, "pool", ar.Component)
+
+	if err := os.MkdirAll(pool, 0755); err != nil {
+		return nil, err
+	}
+
+	for _, p := range ar.Packages {
+		origin := p.Origin
+		if origin == "" {
+			origin = "artifacts"
+		}
+		originPath, found := context.Origins[origin]
+		if !found {
+			return nil, fmt.Errorf("Origin not found '%s'", origin)
+		}
+
+		pattern, err := debos.RestrictedPath(originPath, p.Files)
+		if err != nil {
+			return nil, err
+		}
+		debs, _ := filepath.Glob(pattern)
+		if len(debs) == 0 {
+			return nil, fmt.Errorf("No packages found matching '%s'", p.Files)
+		}
+
+		for _, deb := range debs {
+			if !strings.HasSuffix(deb, ".deb") {
+				return nil, fmt.Errorf("'%s' is not a Debian package", deb)
+			}
+
+			out, err := exec.Command("dpkg-deb", "--field", deb, "Architecture").Output()
+			if err != nil {
+				return nil, fmt.Errorf("Couldn't read package '%s': %v", deb, err)
+			}
+			arches[strings.TrimSpace(string(out))] = true
+
+			if err = debos.CopyFile(deb, path.Join(pool, path.Base(deb)), 0644); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	/* Architecture independent packages are listed with every architecture,
+	 * use the recipe architecture if there are only such packages */
+	delete(arches, "all")
+	if len(arches) == 0 {
+		arches[context.Architecture] = true
+	}
+
+	var list []string
+	for a := range arches {
+		list = append(list, a)
+	}
+	sort.Strings(list)
+
+	return list, nil
+}
+
+func (ar *AptRepositoryAction) writeIndexes(repo string, arches []string) error {
+	for _, arch := range arches {
+		dir := path.Join(repo, "dists", ar.Suite, ar.Component, "binary-"+arch)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+
+		cmd := exec.Command("apt-ftparchive", "--arch", arch, "packages", path.Join("pool", ar.Component))
+		cmd.Dir = repo
+		packages, err := cmd.Output()
+		if err != nil {
+			return fmt.Errorf("apt-ftparchive packages failed: %v", err)
+		}
+
+		if err = ioutil.WriteFile(path.Join(dir, "Packages"), packages, 0644); err != nil {
+			return err
+		}
+
+		var gz bytes.Buffer
+		w := gzip.NewWriter(&gz)
+		w.Write(packages)
+		w.Close()
+		if err = ioutil.WriteFile(path.Join(dir, "Packages.gz"), gz.Bytes(), 0644); err != nil {
+			return err
+		}
+	}
+
+	dists := path.Join(repo, "dists", ar.Suite)
+	options := []string{
+		"-o", "APT::FTPArchive::Release::Suite=" + ar.Suite,
+		"-o", "APT::FTPArchive::Release::Codename=" + ar.Suite,
+		"-o", "APT::FTPArchive::Release::Components=" + ar.Component,
+		"-o", "APT::FTPArchive::Release::Architectures=" + strings.Join(arches, " "),
+	}
+	if ar.Origin != "" {
+		options = append(options, "-o", "APT::FTPArchive::Release::Origin="+ar.Origin)
+	}
+	if ar.Label != "" {
+		options = append(options, "-o", "APT::FTPArchive::Release::Label="+ar.Label)
+	}
+	options = append(options, "release", ".")
+
+	for _, f := range []string{"Release", "Release.gpg", "InRelease"} {
+		os.Remove(path.Join(dists, f))
+	}
+
+	cmd := exec.Command("apt-ftparchive", options...)
+	cmd.Dir = dists
+	release, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("apt-ftparchive release failed: %v", err)
+	}
+
+	return ioutil.WriteFile(path.Join(dists, "Release"), release, 0644)
+}
+
+func (ar *AptRepositoryAction) gpg(args ...string) error {
+	cmdline := []string{"--batch", "--yes"}
+	if ar.GpgHomedir != "" {
+		cmdline = append(cmdline, "--homedir", ar.GpgHomedir)
+	}
+	cmdline = append(cmdline, args...)
+
+	if out, err := exec.Command("gpg", cmdline...).CombinedOutput(); err != nil {
+		return fmt.Errorf("gpg failed: %v\n%s", err, out)
+	}
+
+	return nil
+}
+
+func (ar *AptRepositoryAction) sign(repo string) error {
+	release := path.Join(repo, "dists", ar.Suite, "Release")
+
+	err := ar.gpg("--local-user", ar.GpgSign, "--armor", "--detach-sign",
+		"--output", release+".gpg", release)
+	if err != nil {
+		return err
+	}
+
+	inrelease := path.Join(repo, "dists", ar.Suite, "InRelease")
+	err = ar.gpg("--local-user", ar.GpgSign, "--clearsign", "--output", inrelease, release)
+	if err != nil {
+		return err
+	}
+
+	// Make sure apt will be able to check the signatures
+	if err = ar.gpg("--verify", inrelease); err != nil {
+		return fmt.Errorf("Couldn't verify InRelease: %v", err)
+	}
+
+	return ar.gpg("--verify", release+".gpg", release)
+}
+
+func (ar *AptRepositoryAction) DryRun(context *debos.DebosContext) error {
+	for _, p := range ar.Packages {
+		origin := p.Origin
+		if origin == "" {
+			origin = "artifacts"
+		}
+		if err := debos.CheckOrigin(context, origin, ""); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (ar *AptRepositoryAction) Run(context *debos.DebosContext) error {
+	ar.LogStart()
+
+	if ar.GpgHomedir == "" {
+		ar.GpgHomedir = context.GpgHomedir
+	}
+	if err := checkGpgKey(ar.GpgHomedir, ar.GpgSign); err != nil {
+		return err
+	}
+
+	repo, err := debos.RestrictedPath(context.Artifactdir, ar.Directory)
+	if err != nil {
+		return err
+	}
+
+	arches, err := ar.fillPool(context, repo)
+	if err != nil {
+		return err
+	}
+
+	if err = ar.writeIndexes(repo, arches); err != nil {
+		return err
+	}
+
+	if err = ar.sign(repo); err != nil {
+		return err
+	}
+
+	log.Printf("Created apt repository %s for %s\n", ar.Directory, strings.Join(arches, ", "))
+	return nil
+}
@@ -0,0 +1,131 @@
+package actions_test
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/go-debos/debos"
+	"github.com/go-debos/debos/actions"
+	"github.com/stretchr/testify/assert"
+)
+
+func runTool(t *testing.T, name string, args ...string) string {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	assert.Empty(t, err, string(out))
+	return string(out)
+}
+
+func TestAptRepository(t *testing.T) {
+	for _, tool := range []string{"apt-ftparchive", "apt-get", "dpkg-deb", "gpg"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s not available", tool)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+	context.Architecture = "amd64"
+	context.Artifactdir = path.Join(dir, "artifacts")
+	context.RecipeDir = dir
+	context.Origins = map[string]string{"artifacts": context.Artifactdir}
+
+	// Signing key
+	gnupg := path.Join(dir, "gnupg")
+	assert.Empty(t, os.Mkdir(gnupg, 0700))
+	runTool(t, "gpg", "--batch", "--homedir", gnupg, "--passphrase", "",
+		"--quick-generate-key", "debos@example.com", "default", "default", "never")
+	runTool(t, "gpg", "--batch", "--homedir", gnupg, "--output", path.Join(dir, "key.gpg"),
+		"--export", "debos@example.com")
+
+	// Package to publish
+	pkg := path.Join(dir, "pkg")
+	writeRootfsFile(t, pkg, "usr/share/doc/debos-test/README", "test")
+	writeRootfsFile(t, pkg, "DEBIAN/control", `Package: debos-test
+Version: 1.0
+Architecture: all
+Maintainer: Debos <debos@example.com>
+Description: debos test package
+`)
+	assert.Empty(t, os.MkdirAll(context.Artifactdir, 0755))
+	runTool(t, "dpkg-deb", "--build", "--root-owner-group", pkg,
+		path.Join(context.Artifactdir, "debos-test_1.0_all.deb"))
+
+	ar := actions.NewAptRepositoryAction()
+	ar.Directory = "repo"
+	ar.Label = "debos"
+	ar.Packages = []actions.AptRepositoryPackages{{Files: "*.deb"}}
+	ar.GpgSign = "debos@example.com"
+	ar.GpgHomedir = "gnupg"
+	assert.Empty(t, ar.Verify(&context))
+	assert.Empty(t, ar.Run(&context))
+
+	repo := path.Join(context.Artifactdir, "repo")
+	for _, f := range []string{
+		"pool/main/debos-test_1.0_all.deb",
+		"dists/stable/main/binary-amd64/Packages.gz",
+		"dists/stable/Release.gpg",
+		"dists/stable/InRelease",
+	} {
+		_, err = os.Stat(path.Join(repo, f))
+		assert.Empty(t, err)
+	}
+
+	release, err := ioutil.ReadFile(path.Join(repo, "dists/stable/Release"))
+	assert.Empty(t, err)
+	assert.Contains(t, string(release), "Label: debos\n")
+	assert.Contains(t, string(release), "Suite: stable\n")
+	assert.Contains(t, string(release), "Components: main\n")
+
+	// apt accepts the repository and can install the package from it
+	apt := path.Join(dir, "apt")
+	for _, d := range []string{"lists/partial", "archives/partial", "etc/preferences.d", "etc/apt.conf.d"} {
+		assert.Empty(t, os.MkdirAll(path.Join(apt, d), 0755))
+	}
+	sources := "deb [signed-by=" + path.Join(dir, "key.gpg") + "] file://" + repo + " stable main\n"
+	assert.Empty(t, ioutil.WriteFile(path.Join(apt, "sources.list"), []byte(sources), 0644))
+	assert.Empty(t, ioutil.WriteFile(path.Join(apt, "status"), []byte{}, 0644))
+
+	current, err := user.Current()
+	assert.Empty(t, err)
+	options := []string{
+		"-o", "Dir::Etc::SourceList=" + path.Join(apt, "sources.list"),
+		"-o", "Dir::Etc::SourceParts=/nonexistent",
+		"-o", "Dir::Etc::Parts=" + path.Join(apt, "etc/apt.conf.d"),
+		"-o", "Dir::Etc::PreferencesParts=" + path.Join(apt, "etc/preferences.d"),
+		"-o", "Dir::State::Lists=" + path.Join(apt, "lists"),
+		"-o", "Dir::State::status=" + path.Join(apt, "status"),
+		"-o", "Dir::Cache=" + apt,
+		"-o", "Debug::NoLocking=1",
+		"-o", "APT::Architecture=amd64",
+		"-o", "APT::Sandbox::User=" + current.Username,
+	}
+	out := runTool(t, "apt-get", append(options, "update")...)
+	assert.False(t, strings.Contains(out, "NO_PUBKEY"), out)
+	out = runTool(t, "apt-get", append(options, "--simulate", "install", "debos-test")...)
+	assert.Contains(t, out, "Inst debos-test (1.0 ")
+
+	// Nothing to publish
+	ar = actions.NewAptRepositoryAction()
+	ar.Directory = "empty"
+	ar.Packages = []actions.AptRepositoryPackages{{Files: "*.udeb"}}
+	ar.GpgSign = "debos@example.com"
+	ar.GpgHomedir = "gnupg"
+	assert.Empty(t, ar.Verify(&context))
+	assert.EqualError(t, ar.Run(&context), "No packages found matching '*.udeb'")
+
+	ar.GpgSign = "missing@example.com"
+	assert.Contains(t, ar.Run(&context).Error(), "GPG key 'missing@example.com' not found")
+
+	ar.Packages = nil
+	assert.EqualError(t, ar.Verify(&context), "'packages' property can't be empty")
+	ar.Directory = "/srv/repo"
+	assert.EqualError(t, ar.Verify(&context), "Repository '/srv/repo' must be relative to the artifact directory")
+}
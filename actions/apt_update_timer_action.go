@@ -0,0 +1,226 @@
+/*
+AptUpdateTimer Action
+
+Install and enable a systemd timer in the target rootfs which periodically
+refreshes the apt package lists with 'apt-get update', and optionally
+upgrades the installed packages afterwards. The units are written and enabled
+offline, so the timer is active from the first boot.
+
+Yaml syntax:
+ - action: apt-update-timer
+   schedule: daily
+   window: 2h
+   upgrade: false
+
+Optional properties:
+
+- schedule -- when to run the update, as a systemd calendar event: either one
+of the 'minutely', 'hourly', 'daily', 'weekly', 'monthly', 'quarterly',
+'semiannually' or 'yearly' shorthands, or an expression such as
+'Mon..Fri *-*-* 03:00'. By default is 'daily'.
+
+- window -- length of the maintenance window starting at the scheduled time,
+for example '30m' or '2h'. The update starts at a random time within the
+window, which avoids a whole fleet hitting the mirrors at once. By default
+the update starts at the scheduled time.
+
+- upgrade -- also upgrade the installed packages with 'apt-get upgrade' after
+updating the package lists. By default is 'false'.
+*/
+package actions
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-debos/debos"
+)
+
+const aptUpdateUnit = "debos-apt-update"
+
+var calendarShorthands = []string{
+	"minutely", "hourly", "daily", "weekly", "monthly",
+	"quarterly", "semiannually", "yearly", "annually",
+}
+
+var calendarWeekday = regexp.MustCompile(`^(?i)(mon|tue|wed|thu|fri|sat|sun)[a-z]*$`)
+var calendarValue = regexp.MustCompile(`^(\*|[0-9]+(\.\.[0-9]+)?)(/[0-9]+)?$`)
+
+type AptUpdateTimerAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Schedule         string
+	Window           string
+	Upgrade          bool
+	window           time.Duration
+}
+
+func NewAptUpdateTimerAction() *AptUpdateTimerAction {
+	a := AptUpdateTimerAction{}
+	a.Schedule = "daily"
+
+	return &a
+}
+
+// Check each comma separated value of a calendar component is in [min, max]
+func verifyCalendarComponent(component string, min, max int) error {
+	for _, v := range strings.Split(component, ",") {
+		m := calendarValue.FindStringSubmatch(v)
+		if m == nil {
+			return fmt.Errorf("Invalid value '%s'", v)
+		}
+		if m[1] == "*" {
+			continue
+		}
+		for _, n := range strings.Split(m[1], "..") {
+			i, _ := strconv.Atoi(n)
+			if i < min || i > max {
+				return fmt.Errorf("Value %d out of range %d-%d", i, min, max)
+			}
+		}
+	}
+
+	return nil
+}
+
+func verifyCalendarWeekdays(days string) bool {
+	for _, d := range strings.Split(days, ",") {
+		for _, day := range strings.Split(d, "..") {
+			if !calendarWeekday.MatchString(day) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+/* Validate a systemd calendar event, supporting the shorthands and the
+ * '[weekdays] [year-]month-day [hour:minute[:second]]' form */
+func verifyCalendar(spec string) error {
+	for _, s := range calendarShorthands {
+		if spec == s {
+			return nil
+		}
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) == 0 {
+		return fmt.Errorf("Empty schedule")
+	}
+
+	if verifyCalendarWeekdays(fields[0]) {
+		fields = fields[1:]
+	}
+	if len(fields) > 0 && fields[len(fields)-1] == "UTC" {
+		fields = fields[:len(fields)-1]
+	}
+	if len(fields) > 2 {
+		return fmt.Errorf("Invalid schedule '%s'", spec)
+	}
+
+	for _, f := range fields {
+		var limits [][2]int
+		var parts []string
+
+		if strings.Contains(f, ":") {
+			parts = strings.Split(f, ":")
+			limits = [][2]int{{0, 23}, {0, 59}, {0, 59}}
+		} else {
+			parts = strings.Split(f, "-")
+			limits = [][2]int{{1, 12}, {1, 31}}
+			if len(parts) == 3 {
+				limits = append([][2]int{{1970, 2199}}, limits...)
+			}
+		}
+		if len(parts) < 2 || len(parts) > len(limits) {
+			return fmt.Errorf("Invalid schedule '%s'", spec)
+		}
+
+		for i, p := range parts {
+			if err := verifyCalendarComponent(p, limits[i][0], limits[i][1]); err != nil {
+				return fmt.Errorf("Invalid schedule '%s': %v", spec, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (a *AptUpdateTimerAction) Verify(context *debos.DebosContext) error {
+	if err := verifyCalendar(a.Schedule); err != nil {
+		return err
+	}
+
+	if a.Window != "" {
+		window, err := time.ParseDuration(a.Window)
+		if err != nil || window <= 0 {
+			return fmt.Errorf("Invalid maintenance window '%s'", a.Window)
+		}
+		a.window = window
+	}
+
+	return nil
+}
+
+func (a *AptUpdateTimerAction) units() (string, string) {
+	service := []string{
+		"[Unit]",
+		"Description=Update the apt package lists",
+		"Wants=network-online.target",
+		"After=network-online.target",
+		"",
+		"[Service]",
+		"Type=oneshot",
+		"Environment=DEBIAN_FRONTEND=noninteractive",
+		"ExecStart=/usr/bin/apt-get update",
+	}
+	if a.Upgrade {
+		service = append(service,
+			"ExecStart=/usr/bin/apt-get -y -o Dpkg::Options::=--force-confold upgrade")
+	}
+
+	timer := []string{
+		"[Unit]",
+		"Description=Periodic update of the apt package lists",
+		"",
+		"[Timer]",
+		fmt.Sprintf("OnCalendar=%s", a.Schedule),
+		"Persistent=true",
+	}
+	if a.window > 0 {
+		timer = append(timer, fmt.Sprintf("RandomizedDelaySec=%d", int64(a.window.Seconds())))
+	}
+	timer = append(timer, "", "[Install]", "WantedBy=timers.target")
+
+	return strings.Join(service, "\n") + "\n", strings.Join(timer, "\n") + "\n"
+}
+
+func (a *AptUpdateTimerAction) Run(context *debos.DebosContext) error {
+	a.LogStart()
+
+	service, timer := a.units()
+
+	dir := path.Join(context.Rootdir, "etc/systemd/system")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	units := map[string]string{
+		aptUpdateUnit + ".service": service,
+		aptUpdateUnit + ".timer":   timer,
+	}
+	for name, content := range units {
+		if err := ioutil.WriteFile(path.Join(dir, name), []byte(content), 0644); err != nil {
+			return fmt.Errorf("Couldn't write %s: %v", name, err)
+		}
+	}
+
+	services := debos.SystemdHelper{Rootdir: context.Rootdir}
+	return services.Enable(aptUpdateUnit + ".timer")
+}
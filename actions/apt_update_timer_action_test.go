@@ -0,0 +1,79 @@
+package actions_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/go-debos/debos"
+	"github.com/go-debos/debos/actions"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAptUpdateTimer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+	context.Rootdir = dir
+
+	a := actions.NewAptUpdateTimerAction()
+	a.Schedule = "Mon..Fri *-*-* 03:00"
+	a.Window = "2h"
+	a.Upgrade = true
+	assert.Empty(t, a.Verify(&context))
+	assert.Empty(t, a.Run(&context))
+
+	timer, err := ioutil.ReadFile(path.Join(dir, "etc/systemd/system/debos-apt-update.timer"))
+	assert.Empty(t, err)
+	assert.Equal(t, `[Unit]
+Description=Periodic update of the apt package lists
+
+[Timer]
+OnCalendar=Mon..Fri *-*-* 03:00
+Persistent=true
+RandomizedDelaySec=7200
+
+[Install]
+WantedBy=timers.target
+`, string(timer))
+
+	service, err := ioutil.ReadFile(path.Join(dir, "etc/systemd/system/debos-apt-update.service"))
+	assert.Empty(t, err)
+	assert.Contains(t, string(service), "ExecStart=/usr/bin/apt-get update\n")
+	assert.Contains(t, string(service), "upgrade\n")
+
+	link, err := os.Readlink(path.Join(dir, "etc/systemd/system/timers.target.wants/debos-apt-update.timer"))
+	assert.Empty(t, err)
+	assert.Equal(t, "/etc/systemd/system/debos-apt-update.timer", link)
+
+	// Defaults to a daily update only
+	a = actions.NewAptUpdateTimerAction()
+	assert.Empty(t, a.Verify(&context))
+	assert.Empty(t, a.Run(&context))
+	timer, err = ioutil.ReadFile(path.Join(dir, "etc/systemd/system/debos-apt-update.timer"))
+	assert.Empty(t, err)
+	assert.Contains(t, string(timer), "OnCalendar=daily\n")
+	assert.NotContains(t, string(timer), "RandomizedDelaySec")
+	service, err = ioutil.ReadFile(path.Join(dir, "etc/systemd/system/debos-apt-update.service"))
+	assert.Empty(t, err)
+	assert.NotContains(t, string(service), "upgrade")
+
+	for _, schedule := range []string{"weekly", "*-*-* 04:30:00", "Sat 02:00", "*-*-01 00:00 UTC", "2025-01..06-15", "*:0/15"} {
+		a.Schedule = schedule
+		assert.Empty(t, a.Verify(&context), schedule)
+	}
+
+	a.Schedule = "every day"
+	assert.EqualError(t, a.Verify(&context), "Invalid schedule 'every day'")
+	a.Schedule = "*-*-* 25:00"
+	assert.EqualError(t, a.Verify(&context), "Invalid schedule '*-*-* 25:00': Value 25 out of range 0-23")
+	a.Schedule = "*-13-* 01:00"
+	assert.EqualError(t, a.Verify(&context), "Invalid schedule '*-13-* 01:00': Value 13 out of range 1-12")
+
+	a.Schedule = "daily"
+	a.Window = "two hours"
+	assert.EqualError(t, a.Verify(&context), "Invalid maintenance window 'two hours'")
+}
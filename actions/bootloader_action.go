@@ -0,0 +1,258 @@
+/*
+Bootloader Action
+
+Install a bootloader to the image created by an 'image-partition' action.
+
+Yaml syntax for u-boot:
+ - action: bootloader
+   type: u-boot
+   origin: name
+   source: filename
+   offset: bytes
+   partition: name
+
+Yaml syntax for extlinux:
+ - action: bootloader
+   type: extlinux
+   directory: path
+   install: bool
+   label: name
+   kernel: path
+   initrd: path
+   fdtdir: path
+   append: arguments
+   root-partition: name
+
+Mandatory properties:
+
+- type -- type of the bootloader, 'u-boot' or 'extlinux'.
+
+The 'u-boot' type writes a SPL or u-boot blob to the image like the 'raw'
+action, with the following properties:
+
+- origin -- reference to named file or directory. Mandatory.
+
+- source -- the name of file located in 'origin' to be written. Mandatory.
+
+- offset -- offset in bytes, or with binary units like '8KiB', relative to the
+start of the partition if 'partition' is set, otherwise to the start of the
+image. The default value is zero.
+
+- partition -- name of a partition created by an 'image-partition' action to
+write to, rather than the whole image. Its offset is resolved from the
+partition layout of the image.
+
+The 'extlinux' type installs extlinux into the file system holding 'directory'
+and writes its 'extlinux.conf' configuration there, with the following
+optional properties:
+
+- directory -- absolute path in the target rootfs of the directory of
+extlinux. By default '/boot/extlinux'.
+
+- install -- whether extlinux itself is installed, 'true' by default. Set it
+to 'false' to only write the configuration, for example for the generic
+distro boot of u-boot which reads it. 'extlinux' has to be installed in the
+build environment otherwise.
+
+- label -- label of the boot entry. By default 'debos'.
+
+- kernel -- path of the kernel, relative to the file system of 'directory'. By
+default '/vmlinuz'.
+
+- initrd -- path of the initramfs, relative to the file system of 'directory'.
+By default '/initrd.img'. Set it to an empty value for none.
+
+- fdtdir -- path of the directory of the device trees, relative to the file
+system of 'directory', if any.
+
+- append -- additional arguments of the kernel command line.
+
+- root-partition -- name of the partition created by an 'image-partition'
+action holding the root file system, passed to the kernel as
+'root=PARTUUID=<uuid>' which doesn't need an initramfs to be resolved. By
+default the root file system of the 'image-partition' action is passed by the
+UUID of its file system.
+
+Example:
+
+ - action: bootloader
+   type: extlinux
+   install: false
+   fdtdir: /usr/lib/linux-image-6.1.0-18-arm64
+   append: console=ttyS2,1500000n8 rw
+   root-partition: root
+*/
+package actions
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"text/template"
+
+	"github.com/go-debos/debos"
+)
+
+var extlinuxConf = template.Must(template.New("extlinux.conf").Parse(
+	`default {{ .Label }}
+menu title debos
+timeout 1
+
+label {{ .Label }}
+	kernel {{ .Kernel }}
+{{- if .Initrd }}
+	initrd {{ .Initrd }}
+{{- end }}
+{{- if .Fdtdir }}
+	fdtdir {{ .Fdtdir }}
+{{- end }}
+	append {{ .Root }}{{ if .Append }} {{ .Append }}{{ end }}
+`))
+
+type BootloaderAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Type             string
+
+	// u-boot
+	Origin    string
+	Source    string
+	Offset    string
+	Partition string
+
+	// extlinux
+	Directory     string
+	Install       bool
+	Label         string
+	Kernel        string
+	Initrd        string
+	Fdtdir        string
+	Append        string
+	RootPartition string `yaml:"root-partition"`
+}
+
+func NewBootloaderAction() *BootloaderAction {
+	return &BootloaderAction{
+		Directory: "/boot/extlinux",
+		Install:   true,
+		Label:     "debos",
+		Kernel:    "/vmlinuz",
+		Initrd:    "/initrd.img",
+	}
+}
+
+func (b *BootloaderAction) raw() *RawAction {
+	return &RawAction{
+		BaseAction: b.BaseAction,
+		Origin:     b.Origin,
+		Source:     b.Source,
+		Offset:     b.Offset,
+		Partition:  b.Partition,
+	}
+}
+
+func (b *BootloaderAction) Verify(context *debos.DebosContext) error {
+	switch b.Type {
+	case "u-boot":
+		return b.raw().Verify(context)
+	case "extlinux":
+		if !path.IsAbs(b.Directory) {
+			return errors.New("'directory' property must be an absolute path")
+		}
+		if b.Label == "" || b.Kernel == "" {
+			return errors.New("'label' and 'kernel' properties can't be empty")
+		}
+		return nil
+	case "":
+		return errors.New("'type' property is mandatory")
+	}
+
+	return fmt.Errorf("Unknown bootloader type '%s'", b.Type)
+}
+
+func (b *BootloaderAction) DryRun(context *debos.DebosContext) error {
+	if b.Type == "u-boot" {
+		return b.raw().DryRun(context)
+	}
+	return nil
+}
+
+// Root argument of the kernel command line
+func (b *BootloaderAction) kernelRoot(context *debos.DebosContext) (string, error) {
+	if b.RootPartition == "" {
+		if context.ImageKernelRoot == "" {
+			return "", errors.New("No root file system known, set 'root-partition'")
+		}
+		return context.ImageKernelRoot, nil
+	}
+
+	for _, p := range context.ImagePartitions {
+		if p.Name != b.RootPartition {
+			continue
+		}
+		if p.PartUUID == "" {
+			return "", fmt.Errorf("No partition uuid for partition %s", p.Name)
+		}
+		return "root=PARTUUID=" + p.PartUUID, nil
+	}
+
+	return "", fmt.Errorf("Failed to find partition named %s", b.RootPartition)
+}
+
+// Configuration of extlinux
+func (b *BootloaderAction) extlinuxConf(root string) ([]byte, error) {
+	var out bytes.Buffer
+	err := extlinuxConf.Execute(&out, struct {
+		*BootloaderAction
+		Root string
+	}{b, root})
+	return out.Bytes(), err
+}
+
+func (b *BootloaderAction) runExtlinux(context *debos.DebosContext) error {
+	root, err := b.kernelRoot(context)
+	if err != nil {
+		return err
+	}
+	conf, err := b.extlinuxConf(root)
+	if err != nil {
+		return err
+	}
+
+	directory, err := debos.RestrictedPath(context.Rootdir, b.Directory)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return err
+	}
+
+	if b.Install {
+		cmd := debos.NewCommandForContext(*context)
+		if err := cmd.Run("extlinux", "extlinux", "--install", directory); err != nil {
+			return err
+		}
+	}
+
+	return ioutil.WriteFile(path.Join(directory, "extlinux.conf"), conf, 0644)
+}
+
+func (b *BootloaderAction) Run(context *debos.DebosContext) error {
+	if context.Image == "" {
+		return errors.New("No image to install the bootloader to, run an 'image-partition' action first")
+	}
+
+	if b.Type == "u-boot" {
+		// Logs the start of the action as well
+		raw := b.raw()
+		if err := raw.Verify(context); err != nil {
+			return err
+		}
+		return raw.Run(context)
+	}
+
+	b.LogStart()
+	return b.runExtlinux(context)
+}
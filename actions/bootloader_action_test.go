@@ -0,0 +1,88 @@
+package actions
+
+import (
+	"testing"
+
+	"github.com/go-debos/debos"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBootloaderVerify(t *testing.T) {
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+
+	b := NewBootloaderAction()
+	assert.EqualError(t, b.Verify(&context), "'type' property is mandatory")
+
+	b.Type = "grub"
+	assert.EqualError(t, b.Verify(&context), "Unknown bootloader type 'grub'")
+
+	b.Type = "u-boot"
+	assert.EqualError(t, b.Verify(&context), "'origin' and 'source' properties can't be empty")
+	b.Origin = "recipe"
+	b.Source = "u-boot-sunxi-with-spl.bin"
+	b.Offset = "8KiB"
+	assert.Empty(t, b.Verify(&context))
+
+	b.Type = "extlinux"
+	assert.Empty(t, b.Verify(&context))
+	b.Directory = "boot/extlinux"
+	assert.EqualError(t, b.Verify(&context), "'directory' property must be an absolute path")
+}
+
+func TestBootloaderExtlinuxConf(t *testing.T) {
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+	context.ImagePartitions = []debos.Partition{
+		{Name: "root", PartUUID: "0c2d9b64-02"},
+		{Name: "data"},
+	}
+
+	b := NewBootloaderAction()
+	_, err := b.kernelRoot(&context)
+	assert.EqualError(t, err, "No root file system known, set 'root-partition'")
+
+	context.ImageKernelRoot = "root=UUID=4b1ef3ee-8b6b-4e2a-a8b0-3ad5e7c1f1a9"
+	root, err := b.kernelRoot(&context)
+	assert.Empty(t, err)
+	assert.Equal(t, context.ImageKernelRoot, root)
+
+	b.RootPartition = "data"
+	_, err = b.kernelRoot(&context)
+	assert.EqualError(t, err, "No partition uuid for partition data")
+	b.RootPartition = "rootfs"
+	_, err = b.kernelRoot(&context)
+	assert.EqualError(t, err, "Failed to find partition named rootfs")
+
+	b.RootPartition = "root"
+	root, err = b.kernelRoot(&context)
+	assert.Empty(t, err)
+	assert.Equal(t, "root=PARTUUID=0c2d9b64-02", root)
+
+	b.Fdtdir = "/usr/lib/linux-image-arm64"
+	b.Append = "console=ttyS2,1500000n8 rw"
+	conf, err := b.extlinuxConf(root)
+	assert.Empty(t, err)
+	assert.Equal(t, `default debos
+menu title debos
+timeout 1
+
+label debos
+	kernel /vmlinuz
+	initrd /initrd.img
+	fdtdir /usr/lib/linux-image-arm64
+	append root=PARTUUID=0c2d9b64-02 console=ttyS2,1500000n8 rw
+`, string(conf))
+
+	b.Initrd = ""
+	b.Fdtdir = ""
+	b.Append = ""
+	conf, err = b.extlinuxConf(root)
+	assert.Empty(t, err)
+	assert.Equal(t, `default debos
+menu title debos
+timeout 1
+
+label debos
+	kernel /vmlinuz
+	append root=PARTUUID=0c2d9b64-02
+`, string(conf))
+}
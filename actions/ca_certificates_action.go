@@ -0,0 +1,166 @@
+/*
+CaCertificates Action
+
+Install 'ca-certificates' in the target rootfs, add custom CA certificates to
+the certificates trusted by the system and optionally distrust some of the
+default ones, then regenerate '/etc/ssl/certs' and its bundle with
+'update-ca-certificates'.
+
+The custom certificates are installed to '/usr/local/share/ca-certificates',
+the default ones are distrusted in '/etc/ca-certificates.conf'.
+
+Yaml syntax:
+ - action: ca-certificates
+   certificates:
+     - certs/corporate-root.crt
+   disable:
+     - mozilla/DigiCert_Global_Root_CA.crt
+
+Optional properties:
+
+- certificates -- list of PEM encoded CA certificates to trust, relative to
+the recipe directory. Each file may hold several certificates, but nothing
+else, and is installed with the '.crt' extension.
+
+- disable -- list of default CA certificates to distrust, named by their path
+relative to '/usr/share/ca-certificates', as listed in
+'/etc/ca-certificates.conf'.
+*/
+package actions
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/go-debos/debos"
+)
+
+const caCertificatesConf = "/etc/ca-certificates.conf"
+const localCertificates = "/usr/local/share/ca-certificates"
+
+type CaCertificatesAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Certificates     []string
+	Disable          []string
+}
+
+// Check the file only holds valid certificates
+func verifyCertificates(file string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	count := 0
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			return fmt.Errorf("Unexpected %s in %s", block.Type, path.Base(file))
+		}
+		if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+			return fmt.Errorf("Invalid certificate in %s: %v", path.Base(file), err)
+		}
+		count++
+	}
+
+	if count == 0 || len(strings.TrimSpace(string(data))) > 0 {
+		return fmt.Errorf("%s is not a PEM encoded certificate", path.Base(file))
+	}
+
+	return nil
+}
+
+// Name of the certificate once installed, update-ca-certificates only looks for .crt files
+func certificateName(file string) string {
+	name := path.Base(file)
+	return strings.TrimSuffix(name, path.Ext(name)) + ".crt"
+}
+
+func (c *CaCertificatesAction) Verify(context *debos.DebosContext) error {
+	if len(c.Certificates) == 0 && len(c.Disable) == 0 {
+		return errors.New("Either 'certificates' or 'disable' property must be set")
+	}
+
+	names := map[string]bool{}
+	for _, cert := range c.Certificates {
+		if err := verifyCertificates(debos.CleanPathAt(cert, context.RecipeDir)); err != nil {
+			return err
+		}
+		name := certificateName(cert)
+		if names[name] {
+			return fmt.Errorf("Certificate %s already exists", name)
+		}
+		names[name] = true
+	}
+
+	for _, d := range c.Disable {
+		if path.IsAbs(d) || strings.Contains(d, "..") || path.Ext(d) != ".crt" {
+			return fmt.Errorf("Invalid CA certificate '%s' to disable", d)
+		}
+	}
+
+	return nil
+}
+
+func (c *CaCertificatesAction) configure(context *debos.DebosContext) error {
+	dir := path.Join(context.Rootdir, localCertificates)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for _, cert := range c.Certificates {
+		err := debos.CopyFile(debos.CleanPathAt(cert, context.RecipeDir), path.Join(dir, certificateName(cert)), 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(c.Disable) == 0 {
+		return nil
+	}
+
+	conf := path.Join(context.Rootdir, caCertificatesConf)
+	current, err := ioutil.ReadFile(conf)
+	if err != nil {
+		return err
+	}
+	lines := strings.Split(strings.TrimSuffix(string(current), "\n"), "\n")
+
+	for _, d := range c.Disable {
+		found := false
+		for i, l := range lines {
+			if l == d || l == "!"+d {
+				lines[i] = "!" + d
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("CA certificate %s not found in %s", d, caCertificatesConf)
+		}
+	}
+
+	return ioutil.WriteFile(conf, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
+
+func (c *CaCertificatesAction) Run(context *debos.DebosContext) error {
+	c.LogStart()
+
+	if err := installPackages(context, "ca-certificates"); err != nil {
+		return err
+	}
+	if err := c.configure(context); err != nil {
+		return err
+	}
+
+	cmd := debos.NewChrootCommandForContext(*context)
+	return cmd.Run("ca-certificates", "update-ca-certificates")
+}
@@ -0,0 +1,137 @@
+package actions
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-debos/debos"
+	"github.com/stretchr/testify/assert"
+)
+
+// Write a self-signed CA certificate
+func writeCA(t *testing.T, file, name string) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Empty(t, err)
+
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	assert.Empty(t, err)
+
+	cert := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	assert.Empty(t, os.MkdirAll(path.Dir(file), 0755))
+	assert.Empty(t, ioutil.WriteFile(file, []byte(cert), 0644))
+
+	return cert
+}
+
+func TestCaCertificates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	context := debos.DebosContext{&debos.CommonContext{}, path.Join(dir, "recipe"), ""}
+	context.Rootdir = path.Join(dir, "root")
+
+	custom := writeCA(t, path.Join(context.RecipeDir, "certs/corporate.pem"), "Corporate Root CA")
+	other := writeCA(t, path.Join(context.RecipeDir, "certs/other.crt"), "Other Root CA")
+	mozilla := writeCA(t, path.Join(context.Rootdir, "usr/share/ca-certificates/mozilla/Test_Root.crt"), "Test Root")
+	kept := writeCA(t, path.Join(context.Rootdir, "usr/share/ca-certificates/mozilla/Kept_Root.crt"), "Kept Root")
+	assert.Empty(t, os.MkdirAll(path.Join(context.Rootdir, "etc"), 0755))
+	assert.Empty(t, ioutil.WriteFile(path.Join(context.Rootdir, "etc/ca-certificates.conf"),
+		[]byte("# Default CAs\nmozilla/Kept_Root.crt\nmozilla/Test_Root.crt\n"), 0644))
+
+	c := CaCertificatesAction{
+		Certificates: []string{"certs/corporate.pem", "certs/other.crt"},
+		Disable:      []string{"mozilla/Test_Root.crt"},
+	}
+	assert.Empty(t, c.Verify(&context))
+	assert.Empty(t, c.configure(&context))
+
+	installed, err := ioutil.ReadFile(path.Join(context.Rootdir, "usr/local/share/ca-certificates/corporate.crt"))
+	assert.Empty(t, err)
+	assert.Equal(t, custom, string(installed))
+	installed, err = ioutil.ReadFile(path.Join(context.Rootdir, "usr/local/share/ca-certificates/other.crt"))
+	assert.Empty(t, err)
+	assert.Equal(t, other, string(installed))
+
+	conf, err := ioutil.ReadFile(path.Join(context.Rootdir, "etc/ca-certificates.conf"))
+	assert.Empty(t, err)
+	assert.Equal(t, "# Default CAs\nmozilla/Kept_Root.crt\n!mozilla/Test_Root.crt\n", string(conf))
+
+	// Run on the rootfs by the one of the host, when available
+	update, err := exec.LookPath("update-ca-certificates")
+	if err != nil {
+		t.Log("update-ca-certificates not installed, skipping the bundle check")
+	} else {
+		assert.Empty(t, os.MkdirAll(path.Join(context.Rootdir, "etc/ssl/certs"), 0755))
+		assert.Empty(t, os.MkdirAll(path.Join(context.Rootdir, "etc/ca-certificates/update.d"), 0755))
+		out, err := exec.Command(update,
+			"--certsconf", path.Join(context.Rootdir, "etc/ca-certificates.conf"),
+			"--certsdir", path.Join(context.Rootdir, "usr/share/ca-certificates"),
+			"--localcertsdir", path.Join(context.Rootdir, "usr/local/share/ca-certificates"),
+			"--etccertsdir", path.Join(context.Rootdir, "etc/ssl/certs"),
+			"--certbundle", "ca-certificates.crt",
+			"--hooksdir", path.Join(context.Rootdir, "etc/ca-certificates/update.d")).CombinedOutput()
+		assert.Empty(t, err, string(out))
+
+		bundle, err := ioutil.ReadFile(path.Join(context.Rootdir, "etc/ssl/certs/ca-certificates.crt"))
+		assert.Empty(t, err)
+		assert.Contains(t, string(bundle), strings.TrimSpace(custom))
+		assert.Contains(t, string(bundle), strings.TrimSpace(other))
+		assert.Contains(t, string(bundle), strings.TrimSpace(kept))
+		assert.NotContains(t, string(bundle), strings.TrimSpace(mozilla))
+	}
+
+	// Disabling twice is fine, unknown CAs aren't
+	assert.Empty(t, c.configure(&context))
+	c = CaCertificatesAction{Disable: []string{"mozilla/Missing_Root.crt"}}
+	assert.Empty(t, c.Verify(&context))
+	assert.EqualError(t, c.configure(&context), "CA certificate mozilla/Missing_Root.crt not found in /etc/ca-certificates.conf")
+
+	c = CaCertificatesAction{Disable: []string{"../../etc/passwd"}}
+	assert.EqualError(t, c.Verify(&context), "Invalid CA certificate '../../etc/passwd' to disable")
+
+	c = CaCertificatesAction{}
+	assert.EqualError(t, c.Verify(&context), "Either 'certificates' or 'disable' property must be set")
+
+	c = CaCertificatesAction{Certificates: []string{"certs/corporate.pem", "certs/corporate.crt"}}
+	assert.Empty(t, ioutil.WriteFile(path.Join(context.RecipeDir, "certs/corporate.crt"), []byte(custom), 0644))
+	assert.EqualError(t, c.Verify(&context), "Certificate corporate.crt already exists")
+
+	// Only certificates are accepted
+	assert.Empty(t, ioutil.WriteFile(path.Join(context.RecipeDir, "certs/text.crt"), []byte("not a certificate\n"), 0644))
+	c = CaCertificatesAction{Certificates: []string{"certs/text.crt"}}
+	assert.EqualError(t, c.Verify(&context), "text.crt is not a PEM encoded certificate")
+
+	key := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte("secret")})
+	assert.Empty(t, ioutil.WriteFile(path.Join(context.RecipeDir, "certs/key.crt"), append([]byte(custom), key...), 0644))
+	c = CaCertificatesAction{Certificates: []string{"certs/key.crt"}}
+	assert.EqualError(t, c.Verify(&context), "Unexpected PRIVATE KEY in key.crt")
+
+	broken := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("garbage")})
+	assert.Empty(t, ioutil.WriteFile(path.Join(context.RecipeDir, "certs/broken.crt"), broken, 0644))
+	c = CaCertificatesAction{Certificates: []string{"certs/broken.crt"}}
+	err = c.Verify(&context)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "Invalid certificate in broken.crt")
+}
@@ -0,0 +1,185 @@
+/*
+Cgroup Action
+
+Configure the cgroup hierarchy the target system boots with and the default
+resource accounting of systemd, for example to force cgroup v2 on container
+hosts.
+
+The kernel arguments are added to '/etc/kernel/cmdline' in the target rootfs,
+which is independent from the bootloader and is extended by the
+'filesystem-deploy' action. Arguments set previously for the same options are
+replaced. The systemd defaults are written to a drop-in in
+'/etc/systemd/system.conf.d'.
+
+Yaml syntax:
+ - action: cgroup
+   hierarchy: unified
+   accounting:
+     - cpu
+     - memory
+   default-tasks-max: 15%
+   enable-memory-controller: true
+
+Optional properties:
+
+- hierarchy -- cgroup hierarchy to boot with: 'unified' for cgroup v2 only,
+'hybrid' for cgroup v1 with the v2 hierarchy mounted for systemd, or 'legacy'
+for cgroup v1 only. By default is 'unified'.
+
+- accounting -- list of resources to enable accounting for by default on all
+units, from 'cpu', 'memory', 'io' and 'tasks'.
+
+- default-tasks-max -- default limit of tasks for all units, either a number,
+a percentage of the system limit or 'infinity'.
+
+- enable-memory-controller -- explicitly enable the memory controller on the
+kernel command line, for kernels which disable it by default. By default is
+'false'.
+*/
+package actions
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/go-debos/debos"
+)
+
+var cgroupHierarchies = map[string][]string{
+	"unified": {"systemd.unified_cgroup_hierarchy=1"},
+	"hybrid":  {"systemd.unified_cgroup_hierarchy=0"},
+	"legacy":  {"systemd.unified_cgroup_hierarchy=0", "systemd.legacy_systemd_cgroup_controller=1"},
+}
+
+var cgroupAccounting = map[string]string{
+	"cpu":    "DefaultCPUAccounting",
+	"memory": "DefaultMemoryAccounting",
+	"io":     "DefaultIOAccounting",
+	"tasks":  "DefaultTasksAccounting",
+}
+
+// Kernel arguments managed by this action, replaced when already set
+var cgroupKernelArgs = []string{
+	"systemd.unified_cgroup_hierarchy",
+	"systemd.legacy_systemd_cgroup_controller",
+	"cgroup_enable",
+	"cgroup_memory",
+}
+
+var tasksMax = regexp.MustCompile(`^([0-9]+%?|infinity)$`)
+
+type CgroupAction struct {
+	debos.BaseAction       `yaml:",inline"`
+	Hierarchy              string
+	Accounting             []string
+	DefaultTasksMax        string `yaml:"default-tasks-max"`
+	EnableMemoryController bool   `yaml:"enable-memory-controller"`
+}
+
+func NewCgroupAction() *CgroupAction {
+	c := CgroupAction{}
+	c.Hierarchy = "unified"
+
+	return &c
+}
+
+func (c *CgroupAction) Verify(context *debos.DebosContext) error {
+	if _, ok := cgroupHierarchies[c.Hierarchy]; !ok {
+		return fmt.Errorf("Unsupported cgroup hierarchy '%s', expected unified, hybrid or legacy", c.Hierarchy)
+	}
+
+	for _, a := range c.Accounting {
+		if _, ok := cgroupAccounting[a]; !ok {
+			return fmt.Errorf("Unsupported accounting '%s', expected cpu, memory, io or tasks", a)
+		}
+	}
+
+	if c.DefaultTasksMax != "" && !tasksMax.MatchString(c.DefaultTasksMax) {
+		return fmt.Errorf("Invalid default-tasks-max '%s'", c.DefaultTasksMax)
+	}
+
+	return nil
+}
+
+func (c *CgroupAction) kernelArgs() []string {
+	args := append([]string{}, cgroupHierarchies[c.Hierarchy]...)
+	if c.EnableMemoryController {
+		args = append(args, "cgroup_enable=memory", "cgroup_memory=1")
+	}
+
+	return args
+}
+
+/* Append args to '/etc/kernel/cmdline' in the rootfs, replacing the arguments
+ * previously set for the managed keys */
+func setKernelCmdlineArgs(rootdir string, managed []string, args []string) error {
+	var cmdline []string
+
+	file := path.Join(rootdir, "etc/kernel/cmdline")
+	current, _ := ioutil.ReadFile(file)
+
+	for _, arg := range strings.Fields(string(current)) {
+		found := false
+		key := strings.SplitN(arg, "=", 2)[0]
+		for _, k := range managed {
+			if key == k {
+				found = true
+				break
+			}
+		}
+		if !found {
+			cmdline = append(cmdline, arg)
+		}
+	}
+	cmdline = append(cmdline, args...)
+
+	if err := os.MkdirAll(path.Dir(file), 0755); err != nil {
+		return err
+	}
+	err := ioutil.WriteFile(file, []byte(strings.Join(cmdline, " ")+"\n"), 0644)
+	if err != nil {
+		return fmt.Errorf("Couldn't write kernel/cmdline: %v", err)
+	}
+
+	return nil
+}
+
+func (c *CgroupAction) setupSystemd(context *debos.DebosContext) error {
+	if len(c.Accounting) == 0 && c.DefaultTasksMax == "" {
+		return nil
+	}
+
+	lines := []string{"[Manager]"}
+	for _, a := range c.Accounting {
+		lines = append(lines, fmt.Sprintf("%s=yes", cgroupAccounting[a]))
+	}
+	if c.DefaultTasksMax != "" {
+		lines = append(lines, fmt.Sprintf("DefaultTasksMax=%s", c.DefaultTasksMax))
+	}
+
+	dir := path.Join(context.Rootdir, "etc/systemd/system.conf.d")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	err := ioutil.WriteFile(path.Join(dir, "90-debos-cgroup.conf"),
+		[]byte(strings.Join(lines, "\n")+"\n"), 0644)
+	if err != nil {
+		return fmt.Errorf("Couldn't write systemd configuration: %v", err)
+	}
+
+	return nil
+}
+
+func (c *CgroupAction) Run(context *debos.DebosContext) error {
+	c.LogStart()
+
+	if err := setKernelCmdlineArgs(context.Rootdir, cgroupKernelArgs, c.kernelArgs()); err != nil {
+		return err
+	}
+
+	return c.setupSystemd(context)
+}
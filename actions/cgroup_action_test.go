@@ -0,0 +1,62 @@
+package actions_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/go-debos/debos"
+	"github.com/go-debos/debos/actions"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCgroup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+	context.Rootdir = dir
+
+	writeRootfsFile(t, dir, "etc/kernel/cmdline", "console=ttyS0 systemd.unified_cgroup_hierarchy=0 quiet\n")
+
+	c := actions.NewCgroupAction()
+	c.Accounting = []string{"cpu", "memory"}
+	c.DefaultTasksMax = "15%"
+	c.EnableMemoryController = true
+	assert.Empty(t, c.Verify(&context))
+	assert.Empty(t, c.Run(&context))
+
+	cmdline, err := ioutil.ReadFile(path.Join(dir, "etc/kernel/cmdline"))
+	assert.Empty(t, err)
+	assert.Equal(t, "console=ttyS0 quiet systemd.unified_cgroup_hierarchy=1 cgroup_enable=memory cgroup_memory=1\n",
+		string(cmdline))
+
+	conf, err := ioutil.ReadFile(path.Join(dir, "etc/systemd/system.conf.d/90-debos-cgroup.conf"))
+	assert.Empty(t, err)
+	assert.Equal(t, "[Manager]\nDefaultCPUAccounting=yes\nDefaultMemoryAccounting=yes\nDefaultTasksMax=15%\n",
+		string(conf))
+
+	// Running again replaces the previous settings
+	c = actions.NewCgroupAction()
+	c.Hierarchy = "legacy"
+	assert.Empty(t, c.Verify(&context))
+	assert.Empty(t, c.Run(&context))
+
+	cmdline, err = ioutil.ReadFile(path.Join(dir, "etc/kernel/cmdline"))
+	assert.Empty(t, err)
+	assert.Equal(t, "console=ttyS0 quiet systemd.unified_cgroup_hierarchy=0 systemd.legacy_systemd_cgroup_controller=1\n",
+		string(cmdline))
+
+	c.Hierarchy = "v2"
+	assert.EqualError(t, c.Verify(&context), "Unsupported cgroup hierarchy 'v2', expected unified, hybrid or legacy")
+
+	c.Hierarchy = "unified"
+	c.Accounting = []string{"blockio"}
+	assert.EqualError(t, c.Verify(&context), "Unsupported accounting 'blockio', expected cpu, memory, io or tasks")
+
+	c.Accounting = nil
+	c.DefaultTasksMax = "lots"
+	assert.EqualError(t, c.Verify(&context), "Invalid default-tasks-max 'lots'")
+}
@@ -0,0 +1,154 @@
+/*
+CheckBootSize Action
+
+Check the content of '/boot' in the target rootfs fits in the boot partition,
+failing early with the amount of the overflow otherwise. Without this check
+the build only fails when the content is deployed, or worse the kernel update
+fails on the device.
+
+The size of the content is estimated with each file rounded up to a whole
+filesystem block, and a part of the partition is kept for the metadata of the
+filesystem.
+
+Yaml syntax:
+ - action: check-boot-size
+   partition: boot
+   size: 256MB
+   directory: /boot
+   overhead: 10
+
+Optional properties:
+
+- partition -- name of the partition, created by an 'image-partition' action
+run before this one, where the content is deployed. Either 'partition' or
+'size' is mandatory.
+
+- size -- size of the boot partition in human-readable form, examples: 256MB,
+1GB, etc. It allows the check to run before the partitions are created.
+
+- directory -- absolute path of the content of the boot partition in the
+target rootfs. By default is '/boot'.
+
+- overhead -- percentage of the partition used by the metadata of the
+filesystem, which the content can't use. By default is 10.
+*/
+package actions
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/docker/go-units"
+	"github.com/go-debos/debos"
+)
+
+// Allocation unit of the content, the block size of most filesystems
+const bootBlockSize = 4096
+
+type CheckBootSizeAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Partition        string
+	Size             string
+	Directory        string
+	Overhead         int
+	size             int64
+}
+
+func NewCheckBootSizeAction() *CheckBootSizeAction {
+	c := CheckBootSizeAction{}
+	c.Directory = "/boot"
+	c.Overhead = 10
+
+	return &c
+}
+
+func (c *CheckBootSizeAction) Verify(context *debos.DebosContext) error {
+	if c.Partition == "" && c.Size == "" {
+		return errors.New("Either 'partition' or 'size' property must be set")
+	}
+	if c.Partition != "" && c.Size != "" {
+		return errors.New("Only one of 'partition' and 'size' properties can be set")
+	}
+
+	if c.Size != "" {
+		size, err := units.FromHumanSize(c.Size)
+		if err != nil || size <= 0 {
+			return fmt.Errorf("Failed to parse boot partition size: %s", c.Size)
+		}
+		c.size = size
+	}
+
+	if !path.IsAbs(c.Directory) {
+		return fmt.Errorf("'directory' must be an absolute path")
+	}
+	if c.Overhead < 0 || c.Overhead >= 100 {
+		return fmt.Errorf("Invalid overhead %d%%", c.Overhead)
+	}
+
+	return nil
+}
+
+// Estimate the space used by the content of dir once copied to a filesystem
+func bootContentSize(dir string) (int64, error) {
+	var size int64
+
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		blocks := (info.Size() + bootBlockSize - 1) / bootBlockSize
+		if info.IsDir() || info.Mode()&os.ModeSymlink != 0 {
+			// Directories and symlinks take at least a block
+			blocks = 1
+		}
+		size += blocks * bootBlockSize
+
+		return nil
+	})
+
+	return size, err
+}
+
+func (c *CheckBootSizeAction) Run(context *debos.DebosContext) error {
+	c.LogStart()
+
+	partition := c.size
+	name := c.Size
+	if c.Partition != "" {
+		partition = 0
+		for _, p := range context.ImagePartitions {
+			if p.Name == c.Partition {
+				partition = p.Size
+			}
+		}
+		if partition == 0 {
+			return fmt.Errorf("Partition %s not found", c.Partition)
+		}
+		name = c.Partition
+	}
+
+	dir, err := debos.RestrictedPath(context.Rootdir, c.Directory)
+	if err != nil {
+		return err
+	}
+	content, err := bootContentSize(dir)
+	if err != nil {
+		return fmt.Errorf("Couldn't estimate the size of %s: %v", c.Directory, err)
+	}
+
+	usable := partition * int64(100-c.Overhead) / 100
+	if content > usable {
+		return fmt.Errorf("%s needs %s but boot partition %s only has %s usable, overflowing by %s",
+			c.Directory, units.BytesSize(float64(content)), name,
+			units.BytesSize(float64(usable)), units.BytesSize(float64(content-usable)))
+	}
+
+	log.Printf("%s uses %s of the %s usable in boot partition %s", c.Directory,
+		units.BytesSize(float64(content)), units.BytesSize(float64(usable)), name)
+	return nil
+}
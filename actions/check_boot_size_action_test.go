@@ -0,0 +1,61 @@
+package actions_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/go-debos/debos"
+	"github.com/go-debos/debos/actions"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckBootSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+	context.Rootdir = dir
+	context.ImagePartitions = []debos.Partition{
+		{Name: "boot", Size: 30000},
+		{Name: "root", Size: 1000000},
+	}
+
+	// 3 blocks each, plus a block for the directory
+	assert.Empty(t, os.MkdirAll(path.Join(dir, "boot"), 0755))
+	for _, f := range []string{"vmlinuz", "initrd.img"} {
+		assert.Empty(t, ioutil.WriteFile(path.Join(dir, "boot", f), make([]byte, 10000), 0644))
+	}
+
+	c := actions.NewCheckBootSizeAction()
+	c.Size = "1MB"
+	assert.Empty(t, c.Verify(&context))
+	assert.Empty(t, c.Run(&context))
+
+	// Fits without the overhead, but not with it
+	c = actions.NewCheckBootSizeAction()
+	c.Partition = "boot"
+	assert.Empty(t, c.Verify(&context))
+	assert.EqualError(t, c.Run(&context),
+		"/boot needs 28KiB but boot partition boot only has 26.37KiB usable, overflowing by 1.633KiB")
+
+	c.Overhead = 0
+	assert.Empty(t, c.Run(&context))
+
+	c.Partition = "efi"
+	assert.EqualError(t, c.Run(&context), "Partition efi not found")
+
+	c = actions.NewCheckBootSizeAction()
+	assert.EqualError(t, c.Verify(&context), "Either 'partition' or 'size' property must be set")
+	c.Partition = "boot"
+	c.Size = "256MB"
+	assert.EqualError(t, c.Verify(&context), "Only one of 'partition' and 'size' properties can be set")
+	c.Partition = ""
+	c.Overhead = 100
+	assert.EqualError(t, c.Verify(&context), "Invalid overhead 100%")
+	c.Overhead = 10
+	c.Directory = "boot"
+	assert.EqualError(t, c.Verify(&context), "'directory' must be an absolute path")
+}
@@ -0,0 +1,208 @@
+/*
+CheckEfi Action
+
+Check the EFI system partition (ESP) can boot the image on any UEFI firmware,
+which doesn't need a boot entry to start the fallback bootloader found at the
+removable media path, '\EFI\BOOT\BOOTX64.EFI' for amd64. The fallback
+bootloader must be a PE image for the architecture of the recipe. The action
+fails with the list of the problems found otherwise.
+
+Yaml syntax:
+ - action: check-efi
+   partition: efi
+   directory: /boot/efi
+   grub-cfg: true
+   boot-csv: false
+
+Optional properties:
+
+- partition -- name of the ESP, created by an 'image-partition' action run
+before this one. It is mounted read-only for the check. Either 'partition' or
+'directory' is mandatory.
+
+- directory -- absolute path in the target rootfs of the content of the ESP,
+allowing to check it before it is deployed.
+
+- grub-cfg -- also require a 'grub.cfg' in '\EFI\BOOT' or in the directory of
+a vendor in '\EFI'. False by default.
+
+- boot-csv -- also require the 'BOOT.CSV' or 'BOOT<ARCH>.CSV' file used by the
+shim fallback to create the boot entries, in the directory of a vendor in
+'\EFI'. False by default.
+
+The names are looked up without case, as FAT does.
+*/
+package actions
+
+import (
+	"debug/pe"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+
+	"github.com/go-debos/debos"
+)
+
+// Suffix of the fallback bootloader and machine of its PE header per architecture
+var efiArchitectures = map[string]struct {
+	suffix  string
+	machine uint16
+}{
+	"amd64":   {"X64", pe.IMAGE_FILE_MACHINE_AMD64},
+	"i386":    {"IA32", pe.IMAGE_FILE_MACHINE_I386},
+	"arm64":   {"AA64", pe.IMAGE_FILE_MACHINE_ARM64},
+	"armhf":   {"ARM", pe.IMAGE_FILE_MACHINE_ARMNT},
+	"riscv64": {"RISCV64", pe.IMAGE_FILE_MACHINE_RISCV64},
+	"loong64": {"LOONGARCH64", pe.IMAGE_FILE_MACHINE_LOONGARCH64},
+}
+
+type CheckEfiAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Partition        string
+	Directory        string
+	GrubCfg          bool `yaml:"grub-cfg"`
+	BootCsv          bool `yaml:"boot-csv"`
+}
+
+func (c *CheckEfiAction) Verify(context *debos.DebosContext) error {
+	if len(c.Partition) == 0 && len(c.Directory) == 0 {
+		return errors.New("Either 'partition' or 'directory' property must be set")
+	}
+	if len(c.Partition) > 0 && len(c.Directory) > 0 {
+		return errors.New("Only one of 'partition' and 'directory' properties can be set")
+	}
+	if len(c.Directory) > 0 && !path.IsAbs(c.Directory) {
+		return fmt.Errorf("'directory' must be an absolute path")
+	}
+	if _, found := efiArchitectures[context.Architecture]; !found {
+		return fmt.Errorf("UEFI isn't supported on architecture '%s'", context.Architecture)
+	}
+	return nil
+}
+
+// Look up the path in dir, ignoring the case of the names
+func lookupEfiPath(dir string, names ...string) (string, bool) {
+	for _, name := range names {
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return "", false
+		}
+		found := false
+		for _, e := range entries {
+			if strings.EqualFold(e.Name(), name) {
+				dir = path.Join(dir, e.Name())
+				found = true
+				break
+			}
+		}
+		if !found {
+			return "", false
+		}
+	}
+	return dir, true
+}
+
+// Whether a file in one of the vendor directories of \EFI has one of the names
+func hasEfiVendorFile(esp string, names ...string) bool {
+	efi, found := lookupEfiPath(esp, "EFI")
+	if !found {
+		return false
+	}
+	vendors, err := ioutil.ReadDir(efi)
+	if err != nil {
+		return false
+	}
+	for _, v := range vendors {
+		if !v.IsDir() || strings.EqualFold(v.Name(), "BOOT") {
+			continue
+		}
+		for _, name := range names {
+			if _, found := lookupEfiPath(path.Join(efi, v.Name()), name); found {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returns the problems found in the content of the ESP
+func (c *CheckEfiAction) check(esp, architecture string) []string {
+	var problems []string
+	arch := efiArchitectures[architecture]
+
+	loader := fmt.Sprintf("BOOT%s.EFI", arch.suffix)
+	file, found := lookupEfiPath(esp, "EFI", "BOOT", loader)
+	if !found {
+		problems = append(problems, fmt.Sprintf("Fallback bootloader \\EFI\\BOOT\\%s is missing", loader))
+	} else if f, err := pe.Open(file); err != nil {
+		problems = append(problems, fmt.Sprintf("Fallback bootloader \\EFI\\BOOT\\%s isn't a PE image: %v", loader, err))
+	} else {
+		if f.Machine != arch.machine {
+			problems = append(problems, fmt.Sprintf("Fallback bootloader \\EFI\\BOOT\\%s is built for machine 0x%x instead of 0x%x (%s)",
+				loader, f.Machine, arch.machine, architecture))
+		}
+		f.Close()
+	}
+
+	if c.GrubCfg {
+		_, found := lookupEfiPath(esp, "EFI", "BOOT", "grub.cfg")
+		if !found && !hasEfiVendorFile(esp, "grub.cfg") {
+			problems = append(problems, "grub.cfg is missing from \\EFI\\BOOT and the vendor directories")
+		}
+	}
+
+	if c.BootCsv {
+		csv := fmt.Sprintf("BOOT%s.CSV", arch.suffix)
+		if !hasEfiVendorFile(esp, "BOOT.CSV", csv) {
+			problems = append(problems, fmt.Sprintf("BOOT.CSV or %s is missing from the vendor directories", csv))
+		}
+	}
+
+	return problems
+}
+
+func (c *CheckEfiAction) Run(context *debos.DebosContext) error {
+	c.LogStart()
+
+	var esp string
+	if len(c.Partition) > 0 {
+		var partition *debos.Partition
+		for i, p := range context.ImagePartitions {
+			if p.Name == c.Partition {
+				partition = &context.ImagePartitions[i]
+				break
+			}
+		}
+		if partition == nil {
+			return fmt.Errorf("Partition %s not found", c.Partition)
+		}
+
+		esp = path.Join(context.Scratchdir, "check-efi")
+		if err := os.MkdirAll(esp, 0755); err != nil {
+			return err
+		}
+		defer os.Remove(esp)
+		if err := syscall.Mount(partition.DevicePath, esp, partition.FS, syscall.MS_RDONLY, ""); err != nil {
+			return fmt.Errorf("%s mount failed: %v", partition.Name, err)
+		}
+		defer syscall.Unmount(esp, 0)
+	} else {
+		var err error
+		if esp, err = debos.RestrictedPath(context.Rootdir, c.Directory); err != nil {
+			return err
+		}
+	}
+
+	problems := c.check(esp, context.Architecture)
+	if len(problems) > 0 {
+		return fmt.Errorf("Found %d problems in the ESP:\n  %s", len(problems), strings.Join(problems, "\n  "))
+	}
+
+	log.Printf("The ESP is bootable by %s UEFI firmwares", context.Architecture)
+	return nil
+}
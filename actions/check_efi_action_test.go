@@ -0,0 +1,85 @@
+package actions
+
+import (
+	"bytes"
+	"debug/pe"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/go-debos/debos"
+	"github.com/stretchr/testify/assert"
+)
+
+// Write a PE image without sections for the machine
+func writeEfiImage(t *testing.T, file string, machine uint16) {
+	var image bytes.Buffer
+	dos := make([]byte, 0x40)
+	copy(dos, "MZ")
+	binary.LittleEndian.PutUint32(dos[0x3c:], uint32(len(dos)))
+	image.Write(dos)
+	image.WriteString("PE\x00\x00")
+	assert.Empty(t, binary.Write(&image, binary.LittleEndian, pe.FileHeader{Machine: machine}))
+	image.Write(make([]byte, 512))
+
+	assert.Empty(t, os.MkdirAll(path.Dir(file), 0755))
+	assert.Empty(t, ioutil.WriteFile(file, image.Bytes(), 0644))
+}
+
+func TestCheckEfi(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	context := debos.DebosContext{&debos.CommonContext{}, "", "amd64"}
+	context.Rootdir = dir
+
+	c := CheckEfiAction{Directory: "/boot/efi", GrubCfg: true, BootCsv: true}
+	assert.Empty(t, c.Verify(&context))
+
+	// Missing everything
+	assert.Empty(t, os.MkdirAll(path.Join(dir, "boot/efi/EFI/debian"), 0755))
+	assert.EqualError(t, c.Run(&context), "Found 3 problems in the ESP:\n"+
+		"  Fallback bootloader \\EFI\\BOOT\\BOOTX64.EFI is missing\n"+
+		"  grub.cfg is missing from \\EFI\\BOOT and the vendor directories\n"+
+		"  BOOT.CSV or BOOTX64.CSV is missing from the vendor directories")
+
+	// Valid, whatever the case of the names
+	writeEfiImage(t, path.Join(dir, "boot/efi/EFI/boot/bootx64.efi"), pe.IMAGE_FILE_MACHINE_AMD64)
+	assert.Empty(t, ioutil.WriteFile(path.Join(dir, "boot/efi/EFI/debian/grub.cfg"), []byte{}, 0644))
+	assert.Empty(t, ioutil.WriteFile(path.Join(dir, "boot/efi/EFI/debian/BOOTX64.CSV"), []byte{}, 0644))
+	assert.Empty(t, c.Run(&context))
+
+	// A loader for another architecture
+	writeEfiImage(t, path.Join(dir, "boot/efi/EFI/boot/bootx64.efi"), pe.IMAGE_FILE_MACHINE_ARM64)
+	assert.EqualError(t, c.Run(&context), "Found 1 problems in the ESP:\n"+
+		"  Fallback bootloader \\EFI\\BOOT\\BOOTX64.EFI is built for machine 0xaa64 instead of 0x8664 (amd64)")
+
+	context.Architecture = "arm64"
+	assert.EqualError(t, c.Run(&context), "Found 2 problems in the ESP:\n"+
+		"  Fallback bootloader \\EFI\\BOOT\\BOOTAA64.EFI is missing\n"+
+		"  BOOT.CSV or BOOTAA64.CSV is missing from the vendor directories")
+
+	context.Architecture = "amd64"
+	assert.Empty(t, ioutil.WriteFile(path.Join(dir, "boot/efi/EFI/boot/bootx64.efi"), []byte("#!/bin/sh\n"), 0644))
+	err = c.Run(&context)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "Fallback bootloader \\EFI\\BOOT\\BOOTX64.EFI isn't a PE image")
+
+	// The optional files aren't required by default
+	writeEfiImage(t, path.Join(dir, "boot/efi/EFI/boot/bootx64.efi"), pe.IMAGE_FILE_MACHINE_AMD64)
+	assert.Empty(t, os.RemoveAll(path.Join(dir, "boot/efi/EFI/debian")))
+	c = CheckEfiAction{Directory: "/boot/efi"}
+	assert.Empty(t, c.Run(&context))
+
+	c = CheckEfiAction{}
+	assert.EqualError(t, c.Verify(&context), "Either 'partition' or 'directory' property must be set")
+	c = CheckEfiAction{Partition: "efi", Directory: "/boot/efi"}
+	assert.EqualError(t, c.Verify(&context), "Only one of 'partition' and 'directory' properties can be set")
+	c = CheckEfiAction{Partition: "efi"}
+	assert.EqualError(t, c.Run(&context), "Partition efi not found")
+	context.Architecture = "s390x"
+	assert.EqualError(t, c.Verify(&context), "UEFI isn't supported on architecture 's390x'")
+}
@@ -0,0 +1,220 @@
+/*
+CheckSymlinks Action
+
+Scan the target rootfs for symlinks which would fail at runtime: dangling
+symlinks, whose target doesn't exist, and symlinks escaping the rootfs, whose
+relative target goes above its root directory. Targets are resolved inside
+the rootfs, as they would be on the running system. Targets in directories
+only populated at runtime ('/dev', '/proc', '/run', '/sys' and '/tmp') are not
+reported as dangling.
+
+Optionally, absolute symlinks can be rewritten as relative ones, so they
+resolve to the same file when the rootfs is inspected from another system,
+for example when mounted on the host.
+
+Yaml syntax:
+ - action: check-symlinks
+   fix-absolute: false
+   strict: false
+
+Optional properties:
+
+- fix-absolute -- rewrite absolute symlinks as relative ones. By default is
+'false'.
+
+- strict -- fail if dangling or escaping symlinks are found, instead of only
+reporting them. By default is 'false'.
+*/
+package actions
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-debos/debos"
+)
+
+// Symlinks are followed at most this many times, like the kernel does
+const maxSymlinks = 40
+
+var runtimeDirs = []string{"/dev", "/proc", "/run", "/sys", "/tmp"}
+
+type CheckSymlinksAction struct {
+	debos.BaseAction `yaml:",inline"`
+	FixAbsolute      bool `yaml:"fix-absolute"`
+	Strict           bool
+}
+
+/* Resolve name inside the rootfs, following symlinks with rootdir as '/'.
+ * Returns the resolved rootfs path and whether it exists */
+func resolveInRoot(rootdir, name string) (string, bool, error) {
+	remaining := strings.Split(strings.Trim(name, "/"), "/")
+	current := "/"
+	followed := 0
+
+	for len(remaining) > 0 {
+		c := remaining[0]
+		remaining = remaining[1:]
+
+		switch c {
+		case "", ".":
+			continue
+		case "..":
+			current = path.Dir(current)
+			continue
+		}
+
+		next := path.Join(current, c)
+		info, err := os.Lstat(path.Join(rootdir, next))
+		if os.IsNotExist(err) {
+			return path.Join(append([]string{next}, remaining...)...), false, nil
+		}
+		if err != nil {
+			return "", false, err
+		}
+
+		if info.Mode()&os.ModeSymlink == 0 {
+			current = next
+			continue
+		}
+
+		followed++
+		if followed > maxSymlinks {
+			return "", false, fmt.Errorf("Too many levels of symbolic links in %s", name)
+		}
+		target, err := os.Readlink(path.Join(rootdir, next))
+		if err != nil {
+			return "", false, err
+		}
+		if path.IsAbs(target) {
+			current = "/"
+		}
+		remaining = append(strings.Split(target, "/"), remaining...)
+	}
+
+	return current, true, nil
+}
+
+// Check whether the relative target of the symlink goes above the root
+func escapesRoot(link, target string) bool {
+	if path.IsAbs(target) {
+		return false
+	}
+
+	depth := len(strings.Split(strings.Trim(path.Dir(link), "/"), "/"))
+	if path.Dir(link) == "/" {
+		depth = 0
+	}
+	for _, c := range strings.Split(target, "/") {
+		switch c {
+		case "", ".":
+		case "..":
+			depth--
+			if depth < 0 {
+				return true
+			}
+		default:
+			depth++
+		}
+	}
+
+	return false
+}
+
+func inRuntimeDir(name string) bool {
+	for _, d := range runtimeDirs {
+		if name == d || strings.HasPrefix(name, d+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Check a single symlink, returning the problem found if any
+func (cs *CheckSymlinksAction) check(rootdir, link string) (string, error) {
+	target, err := os.Readlink(path.Join(rootdir, link))
+	if err != nil {
+		return "", err
+	}
+
+	if escapesRoot(link, target) {
+		return fmt.Sprintf("%s -> %s escapes the root", link, target), nil
+	}
+
+	if cs.FixAbsolute && path.IsAbs(target) {
+		relative, err := filepath.Rel(path.Dir(link), target)
+		if err != nil {
+			return "", err
+		}
+		if err = os.Remove(path.Join(rootdir, link)); err != nil {
+			return "", err
+		}
+		if err = os.Symlink(relative, path.Join(rootdir, link)); err != nil {
+			return "", err
+		}
+		log.Printf("Rewrote %s -> %s as %s\n", link, target, relative)
+	}
+
+	resolved, exists, err := resolveInRoot(rootdir, link)
+	if err != nil {
+		return fmt.Sprintf("%s -> %s: %v", link, target, err), nil
+	}
+	if !exists && !inRuntimeDir(resolved) {
+		return fmt.Sprintf("%s -> %s is dangling", link, target), nil
+	}
+
+	return "", nil
+}
+
+func (cs *CheckSymlinksAction) Run(context *debos.DebosContext) error {
+	cs.LogStart()
+	var problems []string
+
+	err := filepath.Walk(context.Rootdir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(context.Rootdir, p)
+		if err != nil {
+			return err
+		}
+		name := path.Join("/", rel)
+
+		if info.IsDir() && name != "/" && inRuntimeDir(name) {
+			return filepath.SkipDir
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			return nil
+		}
+
+		problem, err := cs.check(context.Rootdir, name)
+		if err != nil {
+			return err
+		}
+		if problem != "" {
+			problems = append(problems, problem)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+
+	log.Printf("Found %d broken symlinks:\n  %s\n", len(problems), strings.Join(problems, "\n  "))
+	if cs.Strict {
+		return fmt.Errorf("Found %d broken symlinks", len(problems))
+	}
+
+	return nil
+}
@@ -0,0 +1,63 @@
+package actions_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/go-debos/debos"
+	"github.com/go-debos/debos/actions"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckSymlinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+	context.Rootdir = dir
+
+	writeRootfsFile(t, dir, "usr/bin/python3.9", "python")
+	assert.Empty(t, os.MkdirAll(path.Join(dir, "etc/alternatives"), 0755))
+	assert.Empty(t, os.Symlink("python3.9", path.Join(dir, "usr/bin/python3")))
+	assert.Empty(t, os.Symlink("/usr/bin/python3", path.Join(dir, "etc/alternatives/python")))
+	assert.Empty(t, os.Symlink("/etc/alternatives/python", path.Join(dir, "usr/bin/python")))
+	assert.Empty(t, os.Symlink("../run/systemd/resolve/stub-resolv.conf", path.Join(dir, "etc/resolv.conf")))
+
+	cs := actions.CheckSymlinksAction{Strict: true}
+	assert.Empty(t, cs.Run(&context))
+
+	// Dangling link
+	assert.Empty(t, os.Symlink("/usr/bin/missing", path.Join(dir, "usr/bin/tool")))
+	assert.EqualError(t, cs.Run(&context), "Found 1 broken symlinks")
+
+	// Link escaping the root, even though it resolves inside the rootfs
+	assert.Empty(t, os.Remove(path.Join(dir, "usr/bin/tool")))
+	assert.Empty(t, os.Symlink("../../../usr/bin/python3.9", path.Join(dir, "usr/bin/tool")))
+	assert.EqualError(t, cs.Run(&context), "Found 1 broken symlinks")
+
+	cs.Strict = false
+	assert.Empty(t, cs.Run(&context))
+	assert.Empty(t, os.Remove(path.Join(dir, "usr/bin/tool")))
+
+	// Absolute links are rewritten relative to their directory
+	cs = actions.CheckSymlinksAction{FixAbsolute: true, Strict: true}
+	assert.Empty(t, cs.Run(&context))
+
+	for link, target := range map[string]string{
+		"etc/alternatives/python": "../../usr/bin/python3",
+		"usr/bin/python":          "../../etc/alternatives/python",
+		"usr/bin/python3":         "python3.9",
+	} {
+		current, err := os.Readlink(path.Join(dir, link))
+		assert.Empty(t, err)
+		assert.Equal(t, target, current)
+	}
+
+	// The rewritten links resolve from outside the rootfs too
+	content, err := ioutil.ReadFile(path.Join(dir, "usr/bin/python"))
+	assert.Empty(t, err)
+	assert.Equal(t, "python", string(content))
+}
@@ -0,0 +1,194 @@
+/*
+Checksum Action
+
+Write the checksums of artifacts of the build, in the '<hash>  <name>' format
+checked by 'sha256sum -c' and 'sha512sum -c'.
+
+Like the 'run' actions with 'postprocess' set, the checksums are computed on
+the host once all the other actions have run, so the images are complete and
+the ones compressed by a 'compress' action before this one are found.
+
+Yaml syntax:
+ - action: checksum
+   files:
+     - image.img.gz
+     - "*.tar.gz"
+   algorithm: sha256
+   combined: true
+   file: SHA256SUMS
+
+Mandatory properties:
+
+- files -- list of names of the artifacts to checksum, relative to the
+artifact directory. Shell glob patterns are supported, each one must match at
+least a file. The checksum files are never matched.
+
+Optional properties:
+
+- algorithm -- hash algorithm to use, either 'sha256' or 'sha512'. The default
+value is 'sha256'.
+
+- combined -- write the checksums of all the artifacts to a single file rather
+than a '<name>.<algorithm>' file next to each artifact. By default is 'false'.
+
+- file -- name of the combined checksum file, relative to the artifact
+directory. By default is 'SHA256SUMS' or 'SHA512SUMS' following the algorithm.
+The names of the artifacts are written relative to the artifact directory.
+*/
+package actions
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-debos/debos"
+)
+
+type ChecksumAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Files            []string
+	Algorithm        string
+	Combined         bool
+	File             string
+}
+
+func NewChecksumAction() *ChecksumAction {
+	return &ChecksumAction{Algorithm: "sha256"}
+}
+
+func (c *ChecksumAction) Verify(context *debos.DebosContext) error {
+	if len(c.Files) == 0 {
+		return errors.New("'files' property can't be empty")
+	}
+	for _, f := range c.Files {
+		if _, err := filepath.Match(f, ""); err != nil {
+			return fmt.Errorf("Invalid pattern '%s': %v", f, err)
+		}
+	}
+
+	if _, err := newHashAlgorithm(c.Algorithm); err != nil {
+		return err
+	}
+
+	if len(c.File) > 0 && !c.Combined {
+		return errors.New("'file' property requires 'combined'")
+	}
+	if len(c.File) == 0 {
+		c.File = strings.ToUpper(c.Algorithm) + "SUMS"
+	}
+
+	return nil
+}
+
+/* Returns the regular files of the artifact directory matched by the patterns,
+ * relative to it, except the skipped ones. Each pattern must match a file. */
+func matchArtifacts(artifactdir string, patterns []string, skip func(name string) bool) ([]string, error) {
+	var artifacts []string
+	found := map[string]bool{}
+
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(path.Join(artifactdir, pattern))
+		if err != nil {
+			return nil, err
+		}
+
+		matched := false
+		for _, m := range matches {
+			name, _ := filepath.Rel(artifactdir, m)
+			if skip(name) {
+				continue
+			}
+			if info, err := os.Stat(m); err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+			matched = true
+			if !found[name] {
+				found[name] = true
+				artifacts = append(artifacts, name)
+			}
+		}
+		if !matched {
+			return nil, fmt.Errorf("No artifact matches '%s'", pattern)
+		}
+	}
+	sort.Strings(artifacts)
+
+	return artifacts, nil
+}
+
+// Returns the checksum line of the file, in the format of sha256sum
+func (c *ChecksumAction) checksum(file, name string) (string, error) {
+	h, _ := newHashAlgorithm(c.Algorithm)
+
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("Couldn't read %s: %v", name, err)
+	}
+
+	return fmt.Sprintf("%s  %s\n", hex.EncodeToString(h.Sum(nil)), name), nil
+}
+
+func (c *ChecksumAction) doChecksum(context *debos.DebosContext) error {
+	artifacts, err := matchArtifacts(context.Artifactdir, c.Files, func(name string) bool {
+		return (c.Combined && name == c.File) || strings.HasSuffix(name, "."+c.Algorithm)
+	})
+	if err != nil {
+		return err
+	}
+
+	var sums []string
+	for _, a := range artifacts {
+		file := path.Join(context.Artifactdir, a)
+		if !c.Combined {
+			sum, err := c.checksum(file, path.Base(a))
+			if err != nil {
+				return err
+			}
+			if err := ioutil.WriteFile(file+"."+c.Algorithm, []byte(sum), 0644); err != nil {
+				return err
+			}
+			log.Printf("Wrote %s.%s\n", a, c.Algorithm)
+			continue
+		}
+
+		sum, err := c.checksum(file, a)
+		if err != nil {
+			return err
+		}
+		sums = append(sums, sum)
+	}
+
+	if c.Combined {
+		sumsfile := path.Join(context.Artifactdir, c.File)
+		if err := ioutil.WriteFile(sumsfile, []byte(strings.Join(sums, "")), 0644); err != nil {
+			return err
+		}
+		log.Printf("Wrote the checksums of %d artifacts to %s\n", len(artifacts), c.File)
+	}
+
+	return nil
+}
+
+func (c *ChecksumAction) Run(context *debos.DebosContext) error {
+	c.LogStart()
+	/* The checksums are computed in postprocessing, once the artifacts are complete */
+	return nil
+}
+
+func (c *ChecksumAction) PostMachine(context *debos.DebosContext) error {
+	return c.doChecksum(context)
+}
@@ -0,0 +1,81 @@
+package actions_test
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+
+	"github.com/go-debos/debos"
+	"github.com/go-debos/debos/actions"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChecksum(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+	context.Artifactdir = dir
+
+	assert.Empty(t, os.MkdirAll(path.Join(dir, "boot"), 0755))
+	for _, f := range []string{"image.img", "rootfs.tar.gz", "boot/vmlinuz"} {
+		assert.Empty(t, ioutil.WriteFile(path.Join(dir, f), []byte(f+"\n"), 0644))
+	}
+
+	c := actions.NewChecksumAction()
+	c.Files = []string{"*", "boot/*", "image.img"}
+	c.Combined = true
+	assert.Empty(t, c.Verify(&context))
+
+	// Nothing is done until the artifacts are complete
+	assert.Empty(t, c.Run(&context))
+	_, err = os.Stat(path.Join(dir, "SHA256SUMS"))
+	assert.True(t, os.IsNotExist(err))
+
+	assert.Empty(t, c.PostMachine(&context))
+	sums, err := ioutil.ReadFile(path.Join(dir, "SHA256SUMS"))
+	assert.Empty(t, err)
+	assert.Equal(t,
+		"a5ac3549c26f0807d4055d9d383871f486ae03d9e0901b052ff31ee61e1d40ad  boot/vmlinuz\n"+
+			"865508c37265ea346374efe02dd9d2ae6ca5cdb4bde6d0e75fe133b628a12253  image.img\n"+
+			"68d030e9a7dcae3a6aed0056a77f04f5d89ef6bae2ab68d069218049d1d1ccb9  rootfs.tar.gz\n",
+		string(sums))
+
+	// The checksum file itself isn't matched on the next run
+	assert.Empty(t, c.PostMachine(&context))
+	sums2, err := ioutil.ReadFile(path.Join(dir, "SHA256SUMS"))
+	assert.Empty(t, err)
+	assert.Equal(t, sums, sums2)
+
+	// One file per artifact
+	c = actions.NewChecksumAction()
+	c.Files = []string{"boot/vmlinuz", "image.img"}
+	c.Algorithm = "sha512"
+	assert.Empty(t, c.Verify(&context))
+	assert.Empty(t, c.PostMachine(&context))
+	if _, err := exec.LookPath("sha512sum"); err == nil {
+		for _, f := range []string{"boot/vmlinuz.sha512", "image.img.sha512"} {
+			check := exec.Command("sha512sum", "-c", path.Base(f))
+			check.Dir = path.Join(dir, path.Dir(f))
+			out, err := check.CombinedOutput()
+			assert.Empty(t, err, string(out))
+		}
+	}
+
+	c = actions.NewChecksumAction()
+	c.Files = []string{"*.iso"}
+	assert.Empty(t, c.Verify(&context))
+	assert.EqualError(t, c.PostMachine(&context), "No artifact matches '*.iso'")
+
+	c = actions.NewChecksumAction()
+	assert.EqualError(t, c.Verify(&context), "'files' property can't be empty")
+	c.Files = []string{"image.img"}
+	c.Algorithm = "md5"
+	assert.EqualError(t, c.Verify(&context), "Unsupported hash algorithm 'md5'")
+	c.Algorithm = "sha256"
+	c.File = "SUMS"
+	assert.EqualError(t, c.Verify(&context), "'file' property requires 'combined'")
+}
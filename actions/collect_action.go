@@ -0,0 +1,198 @@
+/*
+Collect Action
+
+Copy named outputs of the build into the artifact directory under explicit
+names, for example to gather the kernel, device trees or manifests for CI
+without resorting to 'run' and 'cp'.
+
+Yaml syntax:
+ - action: collect
+   files:
+     - origin: filesystem
+       source: /boot/vmlinuz
+       dest: kernel/vmlinuz.gz
+       compression: gz
+
+Mandatory properties:
+
+- files -- list of files to collect, each with the properties below.
+
+Properties of the files:
+
+- source -- path of the file or directory to collect, relative to 'origin'.
+Mandatory.
+
+- dest -- destination path, relative to the artifact directory. Parent
+directories are created as needed. Mandatory.
+
+- origin -- reference to named file or directory. The default value is
+'filesystem', the target rootfs.
+
+- compression -- compress the file while copying it, either 'gz' or 'xz'. The
+destination name is used as is, no extension is added. Directories can't be
+compressed.
+
+The permissions of the collected files are preserved.
+*/
+package actions
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+
+	"github.com/go-debos/debos"
+)
+
+type CollectFile struct {
+	Origin      string
+	Source      string
+	Dest        string
+	Compression string
+}
+
+type CollectAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Files            []CollectFile
+}
+
+func (c *CollectAction) Verify(context *debos.DebosContext) error {
+	if len(c.Files) == 0 {
+		return errors.New("'files' property can't be empty")
+	}
+
+	for _, f := range c.Files {
+		if len(f.Source) == 0 {
+			return errors.New("'source' property can't be empty")
+		}
+		if len(f.Dest) == 0 {
+			return errors.New("'dest' property can't be empty")
+		}
+		if path.IsAbs(f.Dest) {
+			return fmt.Errorf("Destination '%s' must be relative to the artifact directory", f.Dest)
+		}
+		if _, err := debos.RestrictedPath(context.Artifactdir, f.Dest); err != nil {
+			return err
+		}
+
+		switch f.Compression {
+		case "", "gz", "xz":
+		default:
+			return fmt.Errorf("Unsupported compression '%s'", f.Compression)
+		}
+	}
+
+	return nil
+}
+
+func compressFile(src, dst, compression string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	switch compression {
+	case "gz":
+		gz := gzip.NewWriter(out)
+		if _, err = io.Copy(gz, in); err != nil {
+			return err
+		}
+		err = gz.Close()
+	case "xz":
+		var stderr bytes.Buffer
+		xz := exec.Command("xz", "-c")
+		xz.Stdin = in
+		xz.Stdout = out
+		xz.Stderr = &stderr
+		if cerr := xz.Run(); cerr != nil {
+			err = fmt.Errorf("xz failed: %v: %s", cerr, stderr.String())
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	// The mode of an existing file is not changed by OpenFile
+	return out.Chmod(mode)
+}
+
+func (c *CollectAction) collect(context *debos.DebosContext, f CollectFile) error {
+	origin := f.Origin
+	if origin == "" {
+		origin = "filesystem"
+	}
+	originPath, found := context.Origins[origin]
+	if !found {
+		return fmt.Errorf("Origin not found '%s'", origin)
+	}
+
+	src, err := debos.RestrictedPath(originPath, f.Source)
+	if err != nil {
+		return err
+	}
+	dst, err := debos.RestrictedPath(context.Artifactdir, f.Dest)
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(path.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	log.Printf("Collecting %s as %s\n", f.Source, f.Dest)
+	switch {
+	case info.IsDir():
+		if f.Compression != "" {
+			return fmt.Errorf("Can't compress directory '%s'", f.Source)
+		}
+		return debos.CopyTree(src, dst)
+	case f.Compression != "":
+		return compressFile(src, dst, f.Compression, info.Mode())
+	default:
+		return debos.CopyFile(src, dst, info.Mode())
+	}
+}
+
+func (c *CollectAction) DryRun(context *debos.DebosContext) error {
+	for _, f := range c.Files {
+		origin := f.Origin
+		if origin == "" {
+			origin = "filesystem"
+		}
+		if err := debos.CheckOrigin(context, origin, f.Source); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *CollectAction) Run(context *debos.DebosContext) error {
+	c.LogStart()
+
+	for _, f := range c.Files {
+		if err := c.collect(context, f); err != nil {
+			return fmt.Errorf("Failed to collect %s: %v", f.Source, err)
+		}
+	}
+
+	return nil
+}
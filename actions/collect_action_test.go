@@ -0,0 +1,92 @@
+package actions_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/go-debos/debos"
+	"github.com/go-debos/debos/actions"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCollect(t *testing.T) {
+	rootdir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(rootdir)
+	artifactdir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(artifactdir)
+
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+	context.Rootdir = rootdir
+	context.Artifactdir = artifactdir
+	context.Origins = map[string]string{
+		"filesystem": rootdir,
+		"artifacts":  artifactdir,
+	}
+
+	assert.Empty(t, os.MkdirAll(path.Join(rootdir, "boot/dtbs"), 0755))
+	assert.Empty(t, ioutil.WriteFile(path.Join(rootdir, "boot/vmlinuz"), []byte("kernel"), 0600))
+	assert.Empty(t, ioutil.WriteFile(path.Join(rootdir, "boot/dtbs/board.dtb"), []byte("dtb"), 0644))
+	assert.Empty(t, ioutil.WriteFile(path.Join(rootdir, "usr-bin-tool"), []byte("tool"), 0755))
+
+	c := actions.CollectAction{
+		Files: []actions.CollectFile{
+			{Source: "/boot/vmlinuz", Dest: "out/kernel/vmlinuz"},
+			{Source: "/boot/vmlinuz", Dest: "out/vmlinuz.gz", Compression: "gz"},
+			{Source: "/boot/vmlinuz", Dest: "out/vmlinuz.xz", Compression: "xz"},
+			{Source: "/boot/dtbs", Dest: "out/dtbs"},
+			{Origin: "filesystem", Source: "usr-bin-tool", Dest: "tool"},
+		},
+	}
+	assert.Empty(t, c.Verify(&context))
+	assert.Empty(t, c.Run(&context))
+
+	content, err := ioutil.ReadFile(path.Join(artifactdir, "out/kernel/vmlinuz"))
+	assert.Empty(t, err)
+	assert.Equal(t, "kernel", string(content))
+	info, err := os.Stat(path.Join(artifactdir, "out/kernel/vmlinuz"))
+	assert.Empty(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode())
+
+	compressed, err := ioutil.ReadFile(path.Join(artifactdir, "out/vmlinuz.gz"))
+	assert.Empty(t, err)
+	gz, err := gzip.NewReader(bytes.NewReader(compressed))
+	assert.Empty(t, err)
+	content, err = ioutil.ReadAll(gz)
+	assert.Empty(t, err)
+	assert.Equal(t, "kernel", string(content))
+
+	compressed, err = ioutil.ReadFile(path.Join(artifactdir, "out/vmlinuz.xz"))
+	assert.Empty(t, err)
+	assert.True(t, bytes.HasPrefix(compressed, []byte("\xfd7zXZ\x00")))
+
+	content, err = ioutil.ReadFile(path.Join(artifactdir, "out/dtbs/board.dtb"))
+	assert.Empty(t, err)
+	assert.Equal(t, "dtb", string(content))
+
+	info, err = os.Stat(path.Join(artifactdir, "tool"))
+	assert.Empty(t, err)
+	assert.Equal(t, os.FileMode(0755), info.Mode())
+
+	// Collected files stay in the artifact directory
+	c = actions.CollectAction{
+		Files: []actions.CollectFile{{Source: "/boot/vmlinuz", Dest: "../vmlinuz"}},
+	}
+	assert.Error(t, c.Verify(&context))
+
+	c = actions.CollectAction{
+		Files: []actions.CollectFile{{Source: "/boot/vmlinuz", Dest: "vmlinuz", Compression: "bz2"}},
+	}
+	assert.EqualError(t, c.Verify(&context), "Unsupported compression 'bz2'")
+
+	c = actions.CollectAction{
+		Files: []actions.CollectFile{{Origin: "firmware", Source: "fw.bin", Dest: "fw.bin"}},
+	}
+	assert.Empty(t, c.Verify(&context))
+	assert.EqualError(t, c.Run(&context), "Failed to collect fw.bin: Origin not found 'firmware'")
+}
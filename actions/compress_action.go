@@ -0,0 +1,142 @@
+/*
+Compress Action
+
+Compress an artifact of the build, typically the raw image created by an
+'image-partition' action, to '<file>.<compression>' in the artifact directory.
+
+The compression is done on the host once all the other actions have run and
+the image is no longer used by the build, like the 'run' actions with
+'postprocess' set. So the compressors have to be installed on the host.
+
+Yaml syntax:
+ - action: compress
+   file: image.img
+   compression: xz
+   threads: 4
+   keep: true
+
+Mandatory properties:
+
+- file -- name of the artifact to compress, relative to the artifact directory.
+
+Optional properties:
+
+- compression -- compression type to use, either 'gz', 'xz' or 'zstd'. It is
+also the extension of the compressed file, with 'zst' for 'zstd'. By default
+is 'gz'.
+
+- threads -- number of threads used for the compression. By default the
+number of CPUs. The 'gz' compression uses 'pigz' when it is installed, and
+falls back to a single threaded 'gzip' otherwise.
+
+- keep -- keep the uncompressed artifact. By default is 'true', set it to
+'false' to only keep the compressed one.
+*/
+package actions
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"runtime"
+	"strings"
+
+	"github.com/go-debos/debos"
+)
+
+// Extension of the compressed file per compression type
+var compressExtensions = map[string]string{
+	"gz":   "gz",
+	"xz":   "xz",
+	"zstd": "zst",
+}
+
+type CompressAction struct {
+	debos.BaseAction `yaml:",inline"`
+	File             string
+	Compression      string
+	Threads          int
+	Keep             bool
+}
+
+func NewCompressAction() *CompressAction {
+	return &CompressAction{Compression: "gz", Keep: true}
+}
+
+func (c *CompressAction) Verify(context *debos.DebosContext) error {
+	if len(c.File) == 0 {
+		return fmt.Errorf("'file' property can't be empty")
+	}
+	if _, found := compressExtensions[c.Compression]; !found {
+		return fmt.Errorf("Unsupported compression '%s'", c.Compression)
+	}
+	if c.Threads < 0 {
+		return fmt.Errorf("Invalid number of threads %d", c.Threads)
+	}
+	return nil
+}
+
+// Compress src to dst, only replacing dst once the compression succeeded
+func (c *CompressAction) compress(src, dst string, threads int) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	partial := dst + ".partial"
+	out, err := os.Create(partial)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(partial)
+	defer out.Close()
+
+	var stderr bytes.Buffer
+	command := strings.Fields(compressorCommand(c.Compression, threads))
+	cmd := exec.Command(command[0], append(command[1:], "-c")...)
+	cmd.Stdin = in
+	cmd.Stdout = out
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s failed: %v: %s", command[0], err, stderr.String())
+	}
+
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(partial, dst)
+}
+
+func (c *CompressAction) doCompress(context *debos.DebosContext) error {
+	src := path.Join(context.Artifactdir, c.File)
+	dst := src + "." + compressExtensions[c.Compression]
+
+	threads := c.Threads
+	if threads == 0 {
+		threads = runtime.NumCPU()
+	}
+
+	log.Printf("Compressing %s to %s\n", c.File, path.Base(dst))
+	if err := c.compress(src, dst, threads); err != nil {
+		return err
+	}
+
+	if !c.Keep {
+		return os.Remove(src)
+	}
+	return nil
+}
+
+func (c *CompressAction) Run(context *debos.DebosContext) error {
+	c.LogStart()
+	/* The artifact is compressed in postprocessing, once it is released */
+	return nil
+}
+
+func (c *CompressAction) PostMachine(context *debos.DebosContext) error {
+	return c.doCompress(context)
+}
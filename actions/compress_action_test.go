@@ -0,0 +1,74 @@
+package actions_test
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+
+	"github.com/go-debos/debos"
+	"github.com/go-debos/debos/actions"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+	context.Artifactdir = dir
+
+	image := []byte("debos image content\n")
+	decompressors := map[string][]string{
+		"gz":   {"gzip", "-dc"},
+		"xz":   {"xz", "-dc"},
+		"zstd": {"zstd", "-dc"},
+	}
+	extensions := map[string]string{"gz": "gz", "xz": "xz", "zstd": "zst"}
+
+	for compression, decompress := range decompressors {
+		if _, err := exec.LookPath(decompress[0]); err != nil {
+			t.Logf("%s not found, skipping %s", decompress[0], compression)
+			continue
+		}
+		assert.Empty(t, ioutil.WriteFile(path.Join(dir, "image.img"), image, 0644))
+
+		c := actions.NewCompressAction()
+		c.File = "image.img"
+		c.Compression = compression
+		assert.Empty(t, c.Verify(&context))
+
+		// Nothing is done until the image is released
+		assert.Empty(t, c.Run(&context))
+		compressed := path.Join(dir, "image.img."+extensions[compression])
+		_, err := os.Stat(compressed)
+		assert.True(t, os.IsNotExist(err))
+
+		assert.Empty(t, c.PostMachine(&context))
+		out, err := exec.Command(decompress[0], decompress[1], compressed).Output()
+		assert.Empty(t, err)
+		assert.Equal(t, image, out)
+		_, err = os.Stat(path.Join(dir, "image.img"))
+		assert.Empty(t, err)
+		_, err = os.Stat(compressed + ".partial")
+		assert.True(t, os.IsNotExist(err))
+
+		c.Keep = false
+		assert.Empty(t, c.PostMachine(&context))
+		_, err = os.Stat(path.Join(dir, "image.img"))
+		assert.True(t, os.IsNotExist(err))
+	}
+
+	c := actions.NewCompressAction()
+	c.File = "missing.img"
+	assert.Error(t, c.PostMachine(&context))
+	_, err = os.Stat(path.Join(dir, "missing.img.gz"))
+	assert.True(t, os.IsNotExist(err))
+
+	c.Compression = "bz2"
+	assert.EqualError(t, c.Verify(&context), "Unsupported compression 'bz2'")
+	c = actions.NewCompressAction()
+	assert.EqualError(t, c.Verify(&context), "'file' property can't be empty")
+}
@@ -0,0 +1,251 @@
+/*
+ContentDigest Action
+
+Compute a digest tree of the target rootfs and write it to the artifact
+directory, so the output of two builds of the same recipe can be compared to
+check whether they are reproducible.
+
+The digest tree has one line per filesystem entry, sorted by path, holding the
+entry type, permissions, ownership and either the sha256 of the content for
+regular files, the target for symlinks or the device numbers for device
+nodes. Timestamps are never part of the digest, so builds done at a different
+time produce the same tree as long as the content is the same. Files which
+differ between every build, like logs and caches, can be excluded.
+
+The sha256 of the whole digest tree is logged at the end of the action and
+can be used to quickly compare builds; the tree itself shows which files
+differ.
+
+Yaml syntax:
+ - action: content-digest
+   file: content-digest.txt
+   default-excludes: true
+   exclude:
+     - /var/lib/dpkg/*-old
+
+Optional properties:
+
+- file -- name of the digest tree file, relative to the artifact directory. By
+default is 'content-digest.txt'.
+
+- default-excludes -- exclude paths which are known to change between builds,
+such as logs, caches, apt lists and the machine id. By default is 'true'.
+
+- exclude -- list of additional paths to exclude, as absolute paths in the
+target rootfs. Shell glob patterns are supported; if a pattern matches a
+directory everything below it is excluded too.
+*/
+package actions
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/go-debos/debos"
+)
+
+var contentDigestDefaultExcludes = []string{
+	"/dev/*",
+	"/proc/*",
+	"/run/*",
+	"/sys/*",
+	"/tmp/*",
+	"/var/tmp/*",
+	"/var/log/*",
+	"/var/cache/*",
+	"/var/lib/apt/lists/*",
+	"/var/cache/ldconfig/aux-cache",
+	"/etc/machine-id",
+	"/var/lib/dbus/machine-id",
+	"/etc/ssh/ssh_host_*",
+}
+
+type ContentDigestAction struct {
+	debos.BaseAction `yaml:",inline"`
+	File             string
+	DefaultExcludes  bool `yaml:"default-excludes"`
+	Exclude          []string
+}
+
+func NewContentDigestAction() *ContentDigestAction {
+	cd := ContentDigestAction{}
+	cd.File = "content-digest.txt"
+	cd.DefaultExcludes = true
+
+	return &cd
+}
+
+func (cd *ContentDigestAction) Verify(context *debos.DebosContext) error {
+	if path.IsAbs(cd.File) {
+		return fmt.Errorf("Digest file '%s' must be relative to the artifact directory", cd.File)
+	}
+	if _, err := debos.RestrictedPath(context.Artifactdir, cd.File); err != nil {
+		return err
+	}
+
+	for _, e := range cd.Exclude {
+		if !path.IsAbs(e) {
+			return fmt.Errorf("Exclude pattern '%s' must be an absolute path", e)
+		}
+		if _, err := path.Match(e, ""); err != nil {
+			return fmt.Errorf("Invalid exclude pattern '%s': %v", e, err)
+		}
+	}
+
+	return nil
+}
+
+func (cd *ContentDigestAction) excluded(name string) bool {
+	var patterns []string
+	if cd.DefaultExcludes {
+		patterns = append(patterns, contentDigestDefaultExcludes...)
+	}
+	patterns = append(patterns, cd.Exclude...)
+
+	for _, p := range patterns {
+		if matched, _ := path.Match(p, name); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+func fileDigest(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Build the digest tree of root, one line per entry in lexical order
+func (cd *ContentDigestAction) digestTree(root string) (string, error) {
+	var tree strings.Builder
+
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		name := path.Join("/", filepath.ToSlash(rel))
+
+		if name != "/" && cd.excluded(name) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		var uid, gid uint32
+		var rdev uint64
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			uid, gid = st.Uid, st.Gid
+			rdev = uint64(st.Rdev)
+		}
+
+		mode := info.Mode()
+		var kind, content string
+		switch {
+		case mode.IsRegular():
+			kind = "f"
+			content, err = fileDigest(p)
+			if err != nil {
+				return err
+			}
+		case mode.IsDir():
+			kind = "d"
+			content = "-"
+		case mode&os.ModeSymlink != 0:
+			kind = "l"
+			content, err = os.Readlink(p)
+			if err != nil {
+				return err
+			}
+		case mode&os.ModeDevice != 0:
+			kind = "b"
+			if mode&os.ModeCharDevice != 0 {
+				kind = "c"
+			}
+			content = fmt.Sprintf("%d,%d", devMajor(rdev), devMinor(rdev))
+		case mode&os.ModeNamedPipe != 0:
+			kind = "p"
+			content = "-"
+		case mode&os.ModeSocket != 0:
+			kind = "s"
+			content = "-"
+		default:
+			return fmt.Errorf("Unknown file type for %s", name)
+		}
+
+		perm := uint32(mode.Perm())
+		if mode&os.ModeSetuid != 0 {
+			perm |= syscall.S_ISUID
+		}
+		if mode&os.ModeSetgid != 0 {
+			perm |= syscall.S_ISGID
+		}
+		if mode&os.ModeSticky != 0 {
+			perm |= syscall.S_ISVTX
+		}
+
+		tree.WriteString(fmt.Sprintf("%s %04o %d:%d %s %s\n", kind, perm, uid, gid, content, name))
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return tree.String(), nil
+}
+
+// Device number helpers following the glibc encoding
+func devMajor(dev uint64) uint64 {
+	return ((dev >> 8) & 0xfff) | ((dev >> 32) & 0xfffff000)
+}
+
+func devMinor(dev uint64) uint64 {
+	return (dev & 0xff) | ((dev >> 12) & 0xffffff00)
+}
+
+func (cd *ContentDigestAction) Run(context *debos.DebosContext) error {
+	cd.LogStart()
+
+	tree, err := cd.digestTree(context.Rootdir)
+	if err != nil {
+		return fmt.Errorf("Couldn't compute content digest: %v", err)
+	}
+
+	file, err := debos.RestrictedPath(context.Artifactdir, cd.File)
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(file, []byte(tree), 0644); err != nil {
+		return fmt.Errorf("Couldn't write content digest: %v", err)
+	}
+
+	sum := sha256.Sum256([]byte(tree))
+	log.Printf("Content digest: %s", hex.EncodeToString(sum[:]))
+
+	return nil
+}
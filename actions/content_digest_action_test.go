@@ -0,0 +1,95 @@
+package actions_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/go-debos/debos"
+	"github.com/go-debos/debos/actions"
+	"github.com/stretchr/testify/assert"
+)
+
+// Populate a rootfs the same way every time, apart from the timestamps and
+// the volatile files
+func buildRootfs(t *testing.T, rootdir string, mtime time.Time) {
+	files := map[string]string{
+		"etc/hostname":     "debian\n",
+		"usr/bin/tool":     "#!/bin/sh\necho tool\n",
+		"var/log/dpkg.log": mtime.String(),
+		"etc/machine-id":   mtime.String(),
+	}
+	for name, content := range files {
+		file := path.Join(rootdir, name)
+		assert.Empty(t, os.MkdirAll(path.Dir(file), 0755))
+		assert.Empty(t, ioutil.WriteFile(file, []byte(content), 0644))
+		assert.Empty(t, os.Chtimes(file, mtime, mtime))
+	}
+	assert.Empty(t, os.Chmod(path.Join(rootdir, "usr/bin/tool"), 0755))
+	assert.Empty(t, os.Symlink("tool", path.Join(rootdir, "usr/bin/alias")))
+}
+
+func contentDigest(t *testing.T, cd *actions.ContentDigestAction, rootdir string) string {
+	artifactdir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(artifactdir)
+
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+	context.Rootdir = rootdir
+	context.Artifactdir = artifactdir
+
+	assert.Empty(t, cd.Verify(&context))
+	assert.Empty(t, cd.Run(&context))
+
+	digest, err := ioutil.ReadFile(path.Join(artifactdir, cd.File))
+	assert.Empty(t, err)
+
+	return string(digest)
+}
+
+func TestContentDigest(t *testing.T) {
+	first, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(first)
+	second, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(second)
+
+	buildRootfs(t, first, time.Unix(1600000000, 0))
+	buildRootfs(t, second, time.Unix(1700000000, 0))
+
+	cd := actions.NewContentDigestAction()
+	digest := contentDigest(t, cd, first)
+	assert.Contains(t, digest, "l 0777 ")
+	assert.Contains(t, digest, " tool /usr/bin/alias\n")
+	assert.NotContains(t, digest, "/var/log/dpkg.log")
+	assert.NotContains(t, digest, "/etc/machine-id")
+
+	// Identical content built at another time gives an identical digest
+	assert.Equal(t, digest, contentDigest(t, cd, second))
+
+	// A content change is detected
+	err = ioutil.WriteFile(path.Join(second, "etc/hostname"), []byte("other\n"), 0644)
+	assert.Empty(t, err)
+	changed := contentDigest(t, cd, second)
+	assert.NotEqual(t, digest, changed)
+
+	// Unless it is excluded
+	cd.Exclude = []string{"/etc/host*"}
+	assert.Equal(t, contentDigest(t, cd, first), contentDigest(t, cd, second))
+
+	// A permission change is detected
+	cd.Exclude = nil
+	assert.Empty(t, os.Chmod(path.Join(second, "usr/bin/tool"), 0700))
+	assert.NotEqual(t, changed, contentDigest(t, cd, second))
+
+	// Volatile files are part of the digest without the default excludes
+	cd.DefaultExcludes = false
+	assert.Contains(t, contentDigest(t, cd, first), "/var/log/dpkg.log")
+
+	cd.Exclude = []string{"var/log"}
+	assert.EqualError(t, cd.Verify(&debos.DebosContext{&debos.CommonContext{}, "", ""}),
+		"Exclude pattern 'var/log' must be an absolute path")
+}
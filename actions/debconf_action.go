@@ -0,0 +1,181 @@
+/*
+Debconf Action
+
+Pre-seed the debconf database of the target rootfs with
+'debconf-set-selections', so the packages installed by the following 'apt'
+actions don't ask the questions which have no usable default.
+
+Yaml syntax:
+ - action: debconf
+   selections:
+     - tzdata tzdata/Areas select Europe
+     - keyboard-configuration keyboard-configuration/layoutcode string us
+   origin: name
+   file: path
+
+Mandatory properties:
+
+- selections -- list of selections, with the owner of the question, usually
+the package, the question, its type and the value separated by white space,
+the value being the rest of the line. Mandatory unless 'file' is set.
+
+- file -- path to a file of selections in the same format, one per line,
+relative to 'origin'. Empty lines and the ones starting with '#' are ignored.
+Mandatory unless 'selections' is set.
+
+Optional properties:
+
+- origin -- reference to named file or directory. The default value is the
+'recipe' directory.
+
+When both 'selections' and 'file' are set, the selections of the file are
+loaded first.
+*/
+package actions
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/go-debos/debos"
+)
+
+type DebconfAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Selections       []string
+	Origin           string
+	File             string
+}
+
+func NewDebconfAction() *DebconfAction {
+	return &DebconfAction{Origin: "recipe"}
+}
+
+type debconfSelection struct {
+	Owner    string
+	Question string
+	Type     string
+	Value    string
+}
+
+// Parse a selection of debconf-set-selections
+func parseDebconfSelection(line string) (debconfSelection, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 3 {
+		return debconfSelection{}, fmt.Errorf("Invalid selection '%s', expected the owner, question, type and value", line)
+	}
+
+	s := debconfSelection{Owner: fields[0], Question: fields[1], Type: fields[2]}
+	if len(fields) > 3 {
+		// The value is the rest of the line, spaces included
+		rest := strings.TrimSpace(line)
+		for _, f := range fields[:3] {
+			rest = strings.TrimSpace(strings.TrimPrefix(rest, f))
+		}
+		s.Value = rest
+	}
+	return s, nil
+}
+
+// Parse the selections of a seed file, skipping the empty lines and comments
+func parseDebconfSelections(content string) ([]debconfSelection, error) {
+	var selections []debconfSelection
+	for idx, line := range strings.Split(content, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		s, err := parseDebconfSelection(trimmed)
+		if err != nil {
+			return nil, fmt.Errorf("Line %d: %v", idx+1, err)
+		}
+		selections = append(selections, s)
+	}
+	return selections, nil
+}
+
+func (d *DebconfAction) Verify(context *debos.DebosContext) error {
+	if len(d.Selections) == 0 && len(d.File) == 0 {
+		return errors.New("'selections' or 'file' property is mandatory")
+	}
+	for _, line := range d.Selections {
+		if _, err := parseDebconfSelection(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *DebconfAction) DryRun(context *debos.DebosContext) error {
+	if len(d.File) > 0 {
+		return debos.CheckOrigin(context, d.Origin, d.File)
+	}
+	return nil
+}
+
+// The selections of the file, then of the property
+func (d *DebconfAction) selections(context *debos.DebosContext) ([]debconfSelection, error) {
+	var selections []debconfSelection
+	if len(d.File) > 0 {
+		if err := debos.CheckOrigin(context, d.Origin, d.File); err != nil {
+			return nil, err
+		}
+		file, err := debos.RestrictedPath(context.Origins[d.Origin], d.File)
+		if err != nil {
+			return nil, err
+		}
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		selections, err = parseDebconfSelections(string(content))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", d.File, err)
+		}
+	}
+
+	for _, line := range d.Selections {
+		s, err := parseDebconfSelection(line)
+		if err != nil {
+			return nil, err
+		}
+		selections = append(selections, s)
+	}
+	return selections, nil
+}
+
+func (d *DebconfAction) Run(context *debos.DebosContext) error {
+	d.LogStart()
+
+	selections, err := d.selections(context)
+	if err != nil {
+		return err
+	}
+
+	var seed strings.Builder
+	for _, s := range selections {
+		log.Printf("Pre-seeding %s of %s", s.Question, s.Owner)
+		fmt.Fprintf(&seed, "%s %s %s %s\n", s.Owner, s.Question, s.Type, s.Value)
+	}
+
+	tmp, err := ioutil.TempFile(path.Join(context.Rootdir, "tmp"), "debconf-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(seed.String()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	c := debos.NewChrootCommandForContext(*context)
+	return c.Run("debconf", "debconf-set-selections", path.Join("/tmp", path.Base(tmp.Name())))
+}
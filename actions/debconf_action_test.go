@@ -0,0 +1,39 @@
+package actions
+
+import (
+	"testing"
+
+	"github.com/go-debos/debos"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDebconfVerify(t *testing.T) {
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+
+	d := NewDebconfAction()
+	assert.EqualError(t, d.Verify(&context), "'selections' or 'file' property is mandatory")
+
+	d.Selections = []string{"tzdata tzdata/Areas select Europe"}
+	assert.Empty(t, d.Verify(&context))
+
+	d.Selections = append(d.Selections, "tzdata tzdata/Zones/Europe")
+	assert.EqualError(t, d.Verify(&context),
+		"Invalid selection 'tzdata tzdata/Zones/Europe', expected the owner, question, type and value")
+}
+
+func TestParseDebconfSelections(t *testing.T) {
+	selections, err := parseDebconfSelections(`# Keyboard
+keyboard-configuration	keyboard-configuration/variant	select	English (US) - English (intl., with AltGr dead keys)
+
+locales locales/default_environment_locale select
+`)
+	assert.Empty(t, err)
+	assert.Equal(t, []debconfSelection{
+		{"keyboard-configuration", "keyboard-configuration/variant", "select",
+			"English (US) - English (intl., with AltGr dead keys)"},
+		{"locales", "locales/default_environment_locale", "select", ""},
+	}, selections)
+
+	_, err = parseDebconfSelections("locales locales/default_environment_locale select C.UTF-8\nlocales\n")
+	assert.EqualError(t, err, "Line 2: Invalid selection 'locales', expected the owner, question, type and value")
+}
@@ -15,6 +15,8 @@ Yaml syntax:
    variant: "name"
    keyring-package:
    keyring-file:
+   include: <list of packages>
+   exclude: <list of packages>
 
 Mandatory properties:
 
@@ -26,8 +28,12 @@ Optional properties:
 
 - mirror -- URL with Debian-compatible repository
  If no mirror is specified debos will use http://deb.debian.org/debian as default.
+ With the 'apt-snapshot' recipe property, the base system is downloaded from
+ the snapshot of a Debian mirror, the sources of the target filesystem keep
+ the mirror.
 
-- variant -- name of the bootstrap script variant to use
+- variant -- name of the bootstrap script variant to use, for example
+ 'minbase' or 'buildd'.
 
 - components -- list of components to use for packages selection.
  If no components are specified debos will use main as default.
@@ -37,15 +43,36 @@ Example:
 
 - keyring-package -- keyring for package validation.
 
-- keyring-file -- keyring file for repository validation.
+- keyring-file -- keyring file for repository validation, relative to the
+ recipe directory. The action fails before running debootstrap if it doesn't
+ exist.
+
+- include -- list of additional packages to install.
+
+- exclude -- list of packages to leave out, even if they are required by the
+ variant.
 
 - merged-usr -- use merged '/usr' filesystem, true by default.
+
+With '--debootstrap-cache <dir>' the base system is saved to a tarball of the
+directory once bootstrapped, keyed by the suite, architecture, variant, mirror,
+components, included and excluded packages and merged '/usr' setting. The next
+builds with the same ones extract it rather than running debootstrap again.
+The size and the SHA256 checksum of the tarball are recorded along with it and
+checked before it is used, a tarball which doesn't match them is discarded.
+'--debootstrap-cache-refresh' runs debootstrap anyway and replaces the cached
+base system, for example to pick up the updates of the suite.
 */
 package actions
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"log"
 	"os"
 	"path"
 	"strings"
@@ -61,6 +88,8 @@ type DebootstrapAction struct {
 	KeyringPackage   string `yaml:"keyring-package"`
 	KeyringFile      string `yaml:"keyring-file"`
 	Components       []string
+	Include          []string
+	Exclude          []string
 	MergedUsr        bool `yaml:"merged-usr"`
 	CheckGpg         bool `yaml:"check-gpg"`
 }
@@ -79,6 +108,182 @@ func NewDebootstrapAction() *DebootstrapAction {
 	return &d
 }
 
+func (d *DebootstrapAction) Verify(context *debos.DebosContext) error {
+	if d.Suite == "" {
+		return fmt.Errorf("'suite' property can't be empty")
+	}
+
+	for _, p := range append(append([]string{}, d.Include...), d.Exclude...) {
+		if p == "" || strings.ContainsAny(p, ", \t") {
+			return fmt.Errorf("Invalid package name '%s'", p)
+		}
+	}
+
+	if d.KeyringFile != "" && d.CheckGpg {
+		keyring := debos.CleanPathAt(d.KeyringFile, context.RecipeDir)
+		if _, err := os.Stat(keyring); err != nil {
+			return fmt.Errorf("Keyring file %s can't be used: %v", d.KeyringFile, err)
+		}
+	}
+
+	return nil
+}
+
+// Log the log of debootstrap, which has the details of its failures
+func logDebootstrapLog(rootdir string) {
+	content, err := ioutil.ReadFile(path.Join(rootdir, "debootstrap/debootstrap.log"))
+	if err != nil {
+		log.Printf("No debootstrap.log: %v", err)
+		return
+	}
+	for _, line := range strings.Split(strings.TrimRight(string(content), "\n"), "\n") {
+		log.Printf("debootstrap.log | %s", line)
+	}
+}
+
+// Size and checksum of a cached base system, checked before it is used
+type debootstrapCacheEntry struct {
+	Size   int64
+	Sha256 string
+}
+
+/* The mirror the base system is downloaded from, its snapshot when the recipe
+ * sets one */
+func (d *DebootstrapAction) mirror(context *debos.DebosContext) string {
+	if context.AptSnapshot == "" {
+		return d.Mirror
+	}
+	return snapshotURL(d.Mirror, context.AptSnapshot)
+}
+
+// Returns the key of the cached base system, derived from what changes it
+func (d *DebootstrapAction) cacheKey(context *debos.DebosContext) string {
+	include := d.Include
+	if d.KeyringPackage != "" {
+		include = append([]string{d.KeyringPackage}, include...)
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "suite %s\narch %s\nvariant %s\nmirror %s\n",
+		d.Suite, context.Architecture, d.Variant, d.mirror(context))
+	fmt.Fprintf(h, "components %s\ninclude %s\nexclude %s\nmerged-usr %t\n",
+		strings.Join(d.Components, ","), strings.Join(include, ","),
+		strings.Join(d.Exclude, ","), d.MergedUsr)
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func hashFile(file string) (debootstrapCacheEntry, error) {
+	entry := debootstrapCacheEntry{}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return entry, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if entry.Size, err = io.Copy(h, f); err != nil {
+		return entry, err
+	}
+	entry.Sha256 = hex.EncodeToString(h.Sum(nil))
+
+	return entry, nil
+}
+
+/* Returns whether the cached base system of the key is complete, discarding
+ * it when its size or checksum doesn't match the recorded ones */
+func checkDebootstrapCache(dir, key string) bool {
+	tarball := path.Join(dir, key+".tar")
+
+	data, err := ioutil.ReadFile(path.Join(dir, key+".json"))
+	if err != nil {
+		return false
+	}
+	recorded := debootstrapCacheEntry{}
+	if err := json.Unmarshal(data, &recorded); err != nil {
+		log.Printf("Discarding debootstrap cache %s: %v", key, err)
+		os.Remove(path.Join(dir, key+".json"))
+		os.Remove(tarball)
+		return false
+	}
+
+	actual, err := hashFile(tarball)
+	if err == nil && actual == recorded {
+		return true
+	}
+	if err != nil {
+		log.Printf("Discarding debootstrap cache %s: %v", key, err)
+	} else {
+		log.Printf("Discarding debootstrap cache %s: size or checksum mismatch", key)
+	}
+	os.Remove(path.Join(dir, key+".json"))
+	os.Remove(tarball)
+
+	return false
+}
+
+/* Save the rootfs as the cached base system of the key. The tarball is written
+ * to a temporary file and only renamed once complete and recorded, so an
+ * interrupted save is never used */
+func saveDebootstrapCache(context *debos.DebosContext, dir, key string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, key+".tar.")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	err = debos.NewCommandForContext(*context).Run("Debootstrap cache", "tar", "cf", tmp.Name(),
+		"--xattrs", "--xattrs-include=*.*", "--numeric-owner",
+		"-C", context.Rootdir, ".")
+	if err != nil {
+		return err
+	}
+
+	entry, err := hashFile(tmp.Name())
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	/* Drop the previous entry first, a tarball without its record is
+	 * ignored */
+	os.Remove(path.Join(dir, key+".json"))
+	if err := os.Rename(tmp.Name(), path.Join(dir, key+".tar")); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path.Join(dir, key+".json.tmp"), data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(path.Join(dir, key+".json.tmp"), path.Join(dir, key+".json")); err != nil {
+		return err
+	}
+
+	log.Printf("Saved debootstrap cache %s", key)
+	return nil
+}
+
+// Extract the cached base system of the key to the rootfs
+func restoreDebootstrapCache(context *debos.DebosContext, dir, key string) error {
+	err := debos.NewCommandForContext(*context).Run("Debootstrap cache", "tar", "xf", path.Join(dir, key+".tar"),
+		"--xattrs", "--xattrs-include=*.*", "--numeric-owner",
+		"-C", context.Rootdir)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Restored debootstrap cache %s", key)
+	return nil
+}
+
 func (d *DebootstrapAction) RunSecondStage(context debos.DebosContext) error {
 	cmdline := []string{
 		"/debootstrap/debootstrap",
@@ -97,8 +302,7 @@ func (d *DebootstrapAction) RunSecondStage(context debos.DebosContext) error {
 	err := c.Run("Debootstrap (stage 2)", cmdline...)
 
 	if (err != nil) {
-		log := path.Join(context.Rootdir, "debootstrap/debootstrap.log")
-		_ = debos.Command{}.Run("debootstrap.log", "cat", log)
+		logDebootstrapLog(context.Rootdir)
 	}
 
 	return err
@@ -106,6 +310,13 @@ func (d *DebootstrapAction) RunSecondStage(context debos.DebosContext) error {
 
 func (d *DebootstrapAction) Run(context *debos.DebosContext) error {
 	d.LogStart()
+
+	cache := context.DebootstrapCache
+	key := d.cacheKey(context)
+	if cache != "" && !context.DebootstrapCacheRefresh && checkDebootstrapCache(cache, key) {
+		return restoreDebootstrapCache(context, cache, key)
+	}
+
 	cmdline := []string{"debootstrap"}
 
 	if d.MergedUsr {
@@ -121,8 +332,16 @@ func (d *DebootstrapAction) Run(context *debos.DebosContext) error {
 		cmdline = append(cmdline, fmt.Sprintf("--keyring=%s", path))
 	}
 
+	include := d.Include
 	if d.KeyringPackage != "" {
-		cmdline = append(cmdline, fmt.Sprintf("--include=%s", d.KeyringPackage))
+		include = append([]string{d.KeyringPackage}, include...)
+	}
+	if len(include) > 0 {
+		cmdline = append(cmdline, fmt.Sprintf("--include=%s", strings.Join(include, ",")))
+	}
+
+	if len(d.Exclude) > 0 {
+		cmdline = append(cmdline, fmt.Sprintf("--exclude=%s", strings.Join(d.Exclude, ",")))
 	}
 
 	if d.Components != nil {
@@ -145,24 +364,35 @@ func (d *DebootstrapAction) Run(context *debos.DebosContext) error {
 
 	cmdline = append(cmdline, d.Suite)
 	cmdline = append(cmdline, context.Rootdir)
-	cmdline = append(cmdline, d.Mirror)
+	cmdline = append(cmdline, d.mirror(context))
 	cmdline = append(cmdline, "/usr/share/debootstrap/scripts/unstable")
 
-	err := debos.Command{}.Run("Debootstrap", cmdline...)
+	/* First stage, second stage when foreign, then the cleanup of the
+	 * rootfs */
+	stages := 2
+	if foreign {
+		stages = 3
+	}
+	progress := debos.NewProgress("Debootstrap", stages)
+
+	progress.Update(0, "first stage")
+	err := debos.NewCommandForContext(*context).Run("Debootstrap", cmdline...)
 
 	if err != nil {
-		log := path.Join(context.Rootdir, "debootstrap/debootstrap.log")
-		_ = debos.Command{}.Run("debootstrap.log", "cat", log)
+		logDebootstrapLog(context.Rootdir)
 		return err
 	}
 
 	if foreign {
+		progress.Update(1, "second stage")
 		err = d.RunSecondStage(*context)
 		if err != nil {
 			return err
 		}
 	}
 
+	progress.Update(stages-1, "cleanup")
+
 	/* HACK */
 	srclist, err := os.OpenFile(path.Join(context.Rootdir, "etc/apt/sources.list"),
 		os.O_RDWR|os.O_CREATE, 0755)
@@ -187,6 +417,17 @@ func (d *DebootstrapAction) Run(context *debos.DebosContext) error {
 	}
 
 	c := debos.NewChrootCommandForContext(*context)
+	if err = c.Run("apt clean", "/usr/bin/apt-get", "clean"); err != nil {
+		return err
+	}
+
+	/* The cache is only a speedup, the build goes on without it */
+	if cache != "" {
+		if err = saveDebootstrapCache(context, cache, key); err != nil {
+			log.Printf("Couldn't save debootstrap cache: %v", err)
+		}
+	}
 
-	return c.Run("apt clean", "/usr/bin/apt-get", "clean")
+	progress.Update(stages, "done")
+	return nil
 }
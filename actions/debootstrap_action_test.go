@@ -0,0 +1,105 @@
+package actions
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/go-debos/debos"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDebootstrapVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+	context.RecipeDir = dir
+
+	d := NewDebootstrapAction()
+	assert.EqualError(t, d.Verify(&context), "'suite' property can't be empty")
+
+	d.Suite = "bookworm"
+	d.Variant = "minbase"
+	d.Include = []string{"ca-certificates", "systemd-sysv"}
+	d.Exclude = []string{"nano"}
+	assert.Empty(t, d.Verify(&context))
+
+	d.Exclude = []string{"nano,vim"}
+	assert.EqualError(t, d.Verify(&context), "Invalid package name 'nano,vim'")
+	d.Exclude = nil
+
+	// The keyring is checked before running debootstrap
+	d.KeyringFile = "keyring.gpg"
+	err = d.Verify(&context)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "Keyring file keyring.gpg can't be used")
+
+	assert.Empty(t, ioutil.WriteFile(path.Join(dir, "keyring.gpg"), []byte{}, 0644))
+	assert.Empty(t, d.Verify(&context))
+}
+
+func TestDebootstrapCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	context := debos.DebosContext{&debos.CommonContext{}, "", "amd64"}
+	context.Rootdir = path.Join(dir, "rootfs")
+	cache := path.Join(dir, "cache")
+
+	d := NewDebootstrapAction()
+	d.Suite = "bookworm"
+	key := d.cacheKey(&context)
+	d.Variant = "minbase"
+	assert.NotEqual(t, key, d.cacheKey(&context))
+	key = d.cacheKey(&context)
+
+	assert.False(t, checkDebootstrapCache(cache, key))
+
+	assert.Empty(t, os.MkdirAll(path.Join(context.Rootdir, "etc"), 0755))
+	assert.Empty(t, ioutil.WriteFile(path.Join(context.Rootdir, "etc/hostname"), []byte("debian\n"), 0644))
+	assert.Empty(t, saveDebootstrapCache(&context, cache, key))
+	assert.True(t, checkDebootstrapCache(cache, key))
+
+	// No temporary files are left behind
+	files, err := ioutil.ReadDir(cache)
+	assert.Empty(t, err)
+	assert.Equal(t, 2, len(files))
+
+	assert.Empty(t, os.RemoveAll(context.Rootdir))
+	assert.Empty(t, os.MkdirAll(context.Rootdir, 0755))
+	assert.Empty(t, restoreDebootstrapCache(&context, cache, key))
+	content, err := ioutil.ReadFile(path.Join(context.Rootdir, "etc/hostname"))
+	assert.Empty(t, err)
+	assert.Equal(t, "debian\n", string(content))
+
+	// A truncated tarball is discarded
+	tarball := path.Join(cache, key+".tar")
+	info, err := os.Stat(tarball)
+	assert.Empty(t, err)
+	assert.Empty(t, os.Truncate(tarball, info.Size()/2))
+	assert.False(t, checkDebootstrapCache(cache, key))
+	_, err = os.Stat(tarball)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestDebootstrapSnapshotMirror(t *testing.T) {
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+
+	d := NewDebootstrapAction()
+	assert.Equal(t, "http://deb.debian.org/debian", d.mirror(&context))
+
+	context.AptSnapshot = "20240131T120000Z"
+	assert.Equal(t, "http://snapshot.debian.org/archive/debian/20240131T120000Z/", d.mirror(&context))
+	d.Mirror = "https://deb.debian.org/debian-ports/"
+	assert.Equal(t, "http://snapshot.debian.org/archive/debian-ports/20240131T120000Z/", d.mirror(&context))
+
+	// Not Debian archives
+	d.Mirror = "http://archive.ubuntu.com/ubuntu"
+	assert.Equal(t, "http://archive.ubuntu.com/ubuntu", d.mirror(&context))
+	d.Mirror = "http://snapshot.debian.org/archive/debian/20230101T000000Z/"
+	assert.Equal(t, d.Mirror, d.mirror(&context))
+}
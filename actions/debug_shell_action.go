@@ -0,0 +1,48 @@
+/*
+DebugShell Action
+
+Pause the build with an interactive shell in the target rootfs, to look around
+while developing a recipe. The build carries on once the shell exits.
+
+The shell is only started when debos runs with '--interactive', otherwise the
+action only logs that it is skipped, so the same recipe can be built
+unattended, for example by a CI system.
+
+Yaml syntax:
+ - action: debug-shell
+   shell: /bin/bash
+
+Optional properties:
+
+- shell -- the shell to start, '/bin/sh' is used when it isn't installed in the
+target rootfs. By default the one of the '--shell' option.
+*/
+package actions
+
+import (
+	"log"
+
+	"github.com/go-debos/debos"
+)
+
+type DebugShellAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Shell            string
+}
+
+func (d *DebugShellAction) Run(context *debos.DebosContext) error {
+	d.LogStart()
+
+	if !context.Interactive {
+		log.Printf("Not interactive, skipping the debug shell")
+		return nil
+	}
+
+	shell := d.Shell
+	if shell == "" {
+		shell = context.Shell
+	}
+	debos.ChrootShell(*context, shell)
+
+	return nil
+}
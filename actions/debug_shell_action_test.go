@@ -0,0 +1,18 @@
+package actions_test
+
+import (
+	"testing"
+
+	"github.com/go-debos/debos"
+	"github.com/go-debos/debos/actions"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDebugShellNotInteractive(t *testing.T) {
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+
+	// A no-op without --interactive, so unattended builds carry on
+	d := actions.DebugShellAction{}
+	assert.Empty(t, d.Verify(&context))
+	assert.Empty(t, d.Run(&context))
+}
@@ -0,0 +1,176 @@
+/*
+Defragment Action
+
+Defragment the filesystems of the target before the image is finalized, which
+improves the first boot performance and the compressibility of the image.
+The filesystem of the target and the ones mounted below it, typically the
+partitions of the image after a 'filesystem-deploy' action, are detected and
+the optimize pass of their type is run:
+
+- btrfs -- 'btrfs filesystem defragment -r'
+
+- ext4 -- 'e4defrag'
+
+Other filesystems are skipped.
+
+Yaml syntax:
+ - action: defragment
+   path: /
+
+Optional properties:
+
+- path -- absolute path in the target rootfs to defragment. By default is '/'.
+*/
+package actions
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/go-debos/debos"
+)
+
+type DefragmentAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Path             string
+}
+
+// Mounts of the host, where the filesystem types are found
+var mountinfoFile = "/proc/self/mountinfo"
+
+func NewDefragmentAction() *DefragmentAction {
+	return &DefragmentAction{Path: "/"}
+}
+
+type mountEntry struct {
+	Mountpoint string
+	FS         string
+}
+
+// Parse the mount points and filesystem types of /proc/self/mountinfo
+func readMounts(r io.Reader) ([]mountEntry, error) {
+	var mounts []mountEntry
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+
+		// Optional fields end with a separator, the filesystem type follows
+		separator := -1
+		for i := 6; i < len(fields); i++ {
+			if fields[i] == "-" {
+				separator = i
+				break
+			}
+		}
+		if len(fields) < 5 || separator < 0 || separator+1 >= len(fields) {
+			return nil, fmt.Errorf("Invalid mountinfo line: %s", scanner.Text())
+		}
+
+		mountpoint, err := strconv.Unquote(`"` + strings.Replace(fields[4], `"`, `\"`, -1) + `"`)
+		if err != nil {
+			mountpoint = fields[4]
+		}
+		mounts = append(mounts, mountEntry{mountpoint, fields[separator+1]})
+	}
+
+	return mounts, scanner.Err()
+}
+
+// Returns the mount containing dir followed by the ones below it
+func targetMounts(mounts []mountEntry, dir string) []mountEntry {
+	var targets []mountEntry
+	var top *mountEntry
+
+	for i, m := range mounts {
+		rel, err := filepath.Rel(m.Mountpoint, dir)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			continue
+		}
+		// Later mounts hide the earlier ones
+		if top == nil || len(m.Mountpoint) >= len(top.Mountpoint) {
+			top = &mounts[i]
+		}
+	}
+	if top == nil {
+		return nil
+	}
+	targets = append(targets, mountEntry{dir, top.FS})
+
+	below := map[string]int{}
+	for _, m := range mounts {
+		rel, err := filepath.Rel(dir, m.Mountpoint)
+		if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+			continue
+		}
+		if i, found := below[m.Mountpoint]; found {
+			targets[i] = m
+			continue
+		}
+		below[m.Mountpoint] = len(targets)
+		targets = append(targets, m)
+	}
+
+	return targets
+}
+
+// Command optimizing the filesystem mounted at dir, nil if unsupported
+func defragmentCommand(fs, dir string) []string {
+	switch fs {
+	case "btrfs":
+		return []string{"btrfs", "filesystem", "defragment", "-r", dir}
+	case "ext4":
+		return []string{"e4defrag", dir}
+	}
+	return nil
+}
+
+func (d *DefragmentAction) Verify(context *debos.DebosContext) error {
+	if !path.IsAbs(d.Path) {
+		return fmt.Errorf("'path' property must be an absolute path, got '%s'", d.Path)
+	}
+	return nil
+}
+
+func (d *DefragmentAction) Run(context *debos.DebosContext) error {
+	d.LogStart()
+
+	dir, err := debos.RestrictedPath(context.Rootdir, d.Path)
+	if err != nil {
+		return err
+	}
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		return err
+	}
+
+	mountinfo, err := os.Open(mountinfoFile)
+	if err != nil {
+		return err
+	}
+	defer mountinfo.Close()
+	mounts, err := readMounts(mountinfo)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range targetMounts(mounts, dir) {
+		command := defragmentCommand(m.FS, m.Mountpoint)
+		if command == nil {
+			log.Printf("Skipping %s, defragmenting %s isn't supported", m.Mountpoint, m.FS)
+			continue
+		}
+		err := debos.NewCommandForContext(*context).Run("defragment", command...)
+		if err != nil {
+			return fmt.Errorf("Couldn't defragment %s: %v", m.Mountpoint, err)
+		}
+	}
+
+	return nil
+}
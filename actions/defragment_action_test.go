@@ -0,0 +1,101 @@
+package actions
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/go-debos/debos"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadMounts(t *testing.T) {
+	mountinfo := `22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw
+35 22 0:30 / /tmp rw,nosuid shared:15 - tmpfs tmpfs rw
+40 35 7:0 / /tmp/my\040image rw master:3 shared:20 - btrfs /dev/loop0 rw
+`
+	mounts, err := readMounts(strings.NewReader(mountinfo))
+	assert.Empty(t, err)
+	assert.Equal(t, []mountEntry{{"/", "ext4"}, {"/tmp", "tmpfs"}, {"/tmp/my image", "btrfs"}}, mounts)
+
+	_, err = readMounts(strings.NewReader("22 1 8:1 / / rw\n"))
+	assert.EqualError(t, err, "Invalid mountinfo line: 22 1 8:1 / / rw")
+}
+
+func TestTargetMounts(t *testing.T) {
+	mounts := []mountEntry{
+		{"/", "ext4"},
+		{"/scratch", "tmpfs"},
+		{"/scratch/mnt", "vfat"},
+		{"/scratch/mnt", "btrfs"},
+		{"/scratch/mnt/boot", "ext4"},
+		{"/scratch/other", "ext4"},
+	}
+
+	assert.Equal(t, []mountEntry{{"/scratch/mnt", "btrfs"}, {"/scratch/mnt/boot", "ext4"}},
+		targetMounts(mounts, "/scratch/mnt"))
+	assert.Equal(t, []mountEntry{{"/scratch/mnt/usr", "btrfs"}},
+		targetMounts(mounts, "/scratch/mnt/usr"))
+	assert.Equal(t, []mountEntry{{"/srv", "ext4"}}, targetMounts(mounts, "/srv"))
+}
+
+func TestDefragment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	// Record the runs of the tools
+	bin := path.Join(dir, "bin")
+	runs := path.Join(dir, "runs")
+	assert.Empty(t, os.MkdirAll(bin, 0755))
+	for _, tool := range []string{"btrfs", "e4defrag"} {
+		script := fmt.Sprintf("#!/bin/sh\necho %s \"$@\" >> %s\n", tool, runs)
+		assert.Empty(t, ioutil.WriteFile(path.Join(bin, tool), []byte(script), 0755))
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", bin+":"+os.Getenv("PATH"))
+
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+	context.Rootdir = path.Join(dir, "root")
+	for _, d := range []string{"boot/efi", "boot/firmware", "usr"} {
+		assert.Empty(t, os.MkdirAll(path.Join(context.Rootdir, d), 0755))
+	}
+
+	mountinfo := fmt.Sprintf(`22 1 8:1 / / rw - ext4 /dev/sda1 rw
+30 22 7:0 / %[1]s rw - btrfs /dev/loop0p2 rw
+31 30 7:1 / %[1]s/boot rw - ext4 /dev/loop0p1 rw
+32 31 7:2 / %[1]s/boot/efi rw - vfat /dev/loop0p3 rw
+`, context.Rootdir)
+	defer func(file string) { mountinfoFile = file }(mountinfoFile)
+	mountinfoFile = path.Join(dir, "mountinfo")
+	assert.Empty(t, ioutil.WriteFile(mountinfoFile, []byte(mountinfo), 0644))
+
+	d := NewDefragmentAction()
+	assert.Empty(t, d.Verify(&context))
+	assert.Empty(t, d.Run(&context))
+
+	out, err := ioutil.ReadFile(runs)
+	assert.Empty(t, err)
+	assert.Equal(t, "btrfs filesystem defragment -r "+context.Rootdir+"\n"+
+		"e4defrag "+context.Rootdir+"/boot\n", string(out))
+
+	// Only the filesystems below the path
+	os.Remove(runs)
+	d.Path = "/boot"
+	assert.Empty(t, d.Run(&context))
+	out, err = ioutil.ReadFile(runs)
+	assert.Empty(t, err)
+	assert.Equal(t, "e4defrag "+context.Rootdir+"/boot\n", string(out))
+
+	os.Remove(runs)
+	d.Path = "/boot/efi"
+	assert.Empty(t, d.Run(&context))
+	_, err = os.Stat(runs)
+	assert.True(t, os.IsNotExist(err))
+
+	d.Path = "usr"
+	assert.EqualError(t, d.Verify(&context), "'path' property must be an absolute path, got 'usr'")
+}
@@ -1,7 +1,8 @@
 /*
 Download Action
 
-Download a single file from Internet and unpack it in place if needed.
+Download a single file from Internet and unpack it in place if needed, or
+clone a git repository.
 
 Yaml syntax:
  - action: download
@@ -10,33 +11,77 @@ Yaml syntax:
    filename: output_name
    unpack: bool
    compression: gz
+   submodules: bool
+   commit: sha
+   sha256: checksum
+   headers:
+     header: value
+   basic-auth:
+     user: name
+     password: secret
 
 Mandatory properties:
 
-- url -- URL to an object for download
+- url -- URL to an object for download. URLs of git repositories are prefixed
+with 'git+', like 'git+https://example.domain/project.git#v1.0', and end with the
+branch, tag or commit to check out after a '#'. The remote HEAD is checked out
+by default. The repository is cloned without its history.
 
 - name -- string which allow to use downloaded object in other actions
 via 'origin' property. If 'unpack' property is set to 'true' name will
-refer to temporary directory with extracted content.
+refer to temporary directory with extracted content, or to the checkout of a
+git repository.
 
 Optional properties:
 
 - filename -- use this property as the name for saved file. Useful if URL does not
 contain file name in path, for example it is possible to download files from URLs without path part.
+The file is saved in the 'scratch' origin.
 
 - unpack -- hint for action to extract all files from downloaded archive.
 See the 'Unpack' action for more information.
 
 - compression -- optional hint for unpack allowing to use proper compression method.
 See the 'Unpack' action for more information.
+
+- submodules -- also check out the submodules of a git repository.
+
+- commit -- full hash of the commit a git repository must have checked out,
+the action fails otherwise. It is fetched when the URL doesn't name a branch,
+tag or commit.
+
+- sha256 -- SHA256 checksum the downloaded file must have, the action fails
+otherwise. Not supported for git repositories.
+
+- headers -- map of HTTP headers sent with the requests, like a token in an
+'Authorization' header.
+
+- basic-auth -- user and password of the HTTP basic authentication.
+
+The values of 'headers' and of 'basic-auth' can refer to environment variables,
+passed with --environ-var, as $NAME or ${NAME} to keep credentials out of the
+recipe. They are never logged.
+
+Without 'basic-auth' nor an 'Authorization' header, the credentials of the
+server in the netrc file are used, see --netrc.
+
+Downloads interrupted by network errors are resumed with range requests when
+the server supports them, or restarted otherwise. A resumed download which
+doesn't match 'sha256' is downloaded again from the start.
 */
 package actions
 
 import (
+	"encoding/base64"
 	"fmt"
 	"github.com/go-debos/debos"
+	"log"
 	"net/url"
+	"os"
+	"os/exec"
 	"path"
+	"regexp"
+	"strings"
 )
 
 type DownloadAction struct {
@@ -46,6 +91,44 @@ type DownloadAction struct {
 	Unpack           bool   // Unpack downloaded file to directory dedicated for download
 	Compression      string // compression type
 	Name             string // exporting path to file or directory(in case of unpack)
+	Submodules       bool   // Check out the submodules of a git repository
+	Commit           string // Expected commit of a git repository
+	Sha256           string // Expected checksum of the downloaded file
+
+	// Credentials, which are never logged
+	Headers   map[string]secretValue // HTTP headers of the requests
+	BasicAuth downloadBasicAuth      `yaml:"basic-auth"`
+}
+
+// Credentials of the HTTP basic authentication
+type downloadBasicAuth struct {
+	User     string
+	Password secretValue
+}
+
+// Value of a property which is never logged, like credentials
+type secretValue string
+
+func (s secretValue) String() string {
+	return "<redacted>"
+}
+
+// Expands the references to environment variables of the value
+func expandEnviron(context *debos.DebosContext, value secretValue) string {
+	return os.Expand(string(value), func(name string) string {
+		if v, ok := context.EnvironVars[name]; ok {
+			return v
+		}
+		return os.Getenv(name)
+	})
+}
+
+var commitPattern = regexp.MustCompile("^([0-9a-f]{40}|[0-9a-f]{64})$")
+
+var sha256Pattern = regexp.MustCompile("^[0-9a-f]{64}$")
+
+func isGitUrl(url *url.URL) bool {
+	return strings.HasPrefix(url.Scheme, "git+")
 }
 
 // validateUrl checks if supported URL is passed from recipe
@@ -62,6 +145,8 @@ func (d *DownloadAction) validateUrl() (*url.URL, error) {
 	switch url.Scheme {
 	case "http", "https":
 		// Supported scheme
+	case "git+http", "git+https", "git+ssh", "git+file":
+		// Supported scheme
 	default:
 		return url, fmt.Errorf("Unsupported URL is provided: '%s'", url.String())
 	}
@@ -73,13 +158,16 @@ func (d *DownloadAction) validateFilename(context *debos.DebosContext, url *url.
 	if len(d.Filename) == 0 {
 		// Trying to guess the name from URL Path
 		filename = path.Base(url.Path)
+		if isGitUrl(url) {
+			filename = strings.TrimSuffix(filename, ".git")
+		}
 	} else {
 		filename = path.Base(d.Filename)
 	}
 	if len(filename) == 0 {
 		return "", fmt.Errorf("Incorrect filename is provided for '%s'", d.Url)
 	}
-	filename = path.Join(context.Scratchdir, filename)
+	filename = path.Join(debos.ScratchDir(context), filename)
 	return filename, nil
 }
 
@@ -115,6 +203,33 @@ func (d *DownloadAction) Verify(context *debos.DebosContext) error {
 	if err != nil {
 		return err
 	}
+	if isGitUrl(url) {
+		if d.Unpack {
+			return fmt.Errorf("Property 'unpack' can't be used with git repositories")
+		}
+		if len(d.Commit) > 0 && !commitPattern.MatchString(d.Commit) {
+			return fmt.Errorf("Property 'commit' must be a full commit hash, got '%s'", d.Commit)
+		}
+		if len(d.Sha256) > 0 {
+			return fmt.Errorf("Property 'sha256' can't be used with git repositories")
+		}
+		if len(d.Headers) > 0 || len(d.BasicAuth.User) > 0 || len(d.BasicAuth.Password) > 0 {
+			return fmt.Errorf("Properties 'headers' and 'basic-auth' can't be used with git repositories")
+		}
+	} else if d.Submodules || len(d.Commit) > 0 {
+		return fmt.Errorf("Properties 'submodules' and 'commit' are only supported for git repositories")
+	}
+	if len(d.BasicAuth.Password) > 0 && len(d.BasicAuth.User) == 0 {
+		return fmt.Errorf("Property 'basic-auth' needs a user")
+	}
+	for k := range d.Headers {
+		if len(d.BasicAuth.User) > 0 && strings.EqualFold(k, "Authorization") {
+			return fmt.Errorf("Property 'basic-auth' can't be used with an 'Authorization' header")
+		}
+	}
+	if len(d.Sha256) > 0 && !sha256Pattern.MatchString(d.Sha256) {
+		return fmt.Errorf("Property 'sha256' must be a SHA256 checksum, got '%s'", d.Sha256)
+	}
 	if d.Unpack == true {
 		if _, err := d.archive(filename); err != nil {
 			return err
@@ -123,6 +238,87 @@ func (d *DownloadAction) Verify(context *debos.DebosContext) error {
 	return nil
 }
 
+// Shallow clone of the git repository at the reference of the URL
+func (d *DownloadAction) clone(context *debos.DebosContext, url *url.URL, dir string) error {
+	ref := url.Fragment
+	if len(ref) == 0 {
+		ref = "HEAD"
+		if len(d.Commit) > 0 {
+			ref = d.Commit
+		}
+	}
+	repository := *url
+	repository.Scheme = strings.TrimPrefix(url.Scheme, "git+")
+	repository.Fragment = ""
+	log.Printf("Cloning '%s' at %s -> '%s'\n", repository.String(), ref, dir)
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	cmd := debos.NewCommandForContext(*context)
+	commands := [][]string{
+		{"init", "-q"},
+		{"remote", "add", "origin", repository.String()},
+		{"fetch", "-q", "--depth", "1", "origin", ref},
+		{"checkout", "-q", "FETCH_HEAD"},
+	}
+	if d.Submodules {
+		commands = append(commands, []string{"submodule", "update", "-q", "--init", "--recursive", "--depth", "1"})
+	}
+	for _, c := range commands {
+		if err := cmd.Run("git", append([]string{"git", "-C", dir}, c...)...); err != nil {
+			return fmt.Errorf("Failed to clone '%s': %v", repository.String(), err)
+		}
+	}
+
+	out, err := exec.Command("git", "-C", dir, "rev-parse", "HEAD").Output()
+	if err != nil {
+		return err
+	}
+	commit := strings.TrimSpace(string(out))
+	if len(d.Commit) > 0 && commit != d.Commit {
+		return fmt.Errorf("'%s' is at commit %s instead of %s", d.Url, commit, d.Commit)
+	}
+	log.Printf("Checked out commit %s\n", commit)
+
+	return nil
+}
+
+// Let the following actions refer to the download
+func (d *DownloadAction) DryRun(context *debos.DebosContext) error {
+	url, err := d.validateUrl()
+	if err != nil {
+		return err
+	}
+	filename, err := d.validateFilename(context, url)
+	if err != nil {
+		return err
+	}
+
+	context.Origins[d.Name] = filename
+	return nil
+}
+
+func (d *DownloadAction) options(context *debos.DebosContext) debos.DownloadOptions {
+	options := debos.DownloadOptions{
+		Sha256:  d.Sha256,
+		Headers: map[string]string{},
+		Netrc:   context.Netrc,
+	}
+	for k, v := range d.Headers {
+		options.Headers[k] = expandEnviron(context, v)
+	}
+	if len(d.BasicAuth.User) > 0 {
+		user := expandEnviron(context, secretValue(d.BasicAuth.User))
+		password := expandEnviron(context, d.BasicAuth.Password)
+		auth := base64.StdEncoding.EncodeToString([]byte(user + ":" + password))
+		options.Headers["Authorization"] = "Basic " + auth
+	}
+
+	return options
+}
+
 func (d *DownloadAction) Run(context *debos.DebosContext) error {
 	var filename string
 	d.LogStart()
@@ -140,10 +336,14 @@ func (d *DownloadAction) Run(context *debos.DebosContext) error {
 
 	switch url.Scheme {
 	case "http", "https":
-		err := debos.DownloadHttpUrl(url.String(), filename)
+		err := debos.DownloadHttpUrlWithOptions(context.Ctx, url.String(), filename, d.options(context))
 		if err != nil {
 			return err
 		}
+	case "git+http", "git+https", "git+ssh", "git+file":
+		if err := d.clone(context, url, filename); err != nil {
+			return err
+		}
 	default:
 		return fmt.Errorf("Unsupported URL is provided: '%s'", url.String())
 	}
@@ -155,6 +355,7 @@ func (d *DownloadAction) Run(context *debos.DebosContext) error {
 		}
 
 		targetdir := filename + ".d"
+		archive.SetContext(context)
 		err = archive.RelaxedUnpack(targetdir)
 		if err != nil {
 			return err
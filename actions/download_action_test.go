@@ -0,0 +1,157 @@
+package actions_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/go-debos/debos"
+	"github.com/go-debos/debos/actions"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+// Run git in dir, returning its output
+func runGit(t *testing.T, dir string, args ...string) string {
+	args = append([]string{"-C", dir, "-c", "user.name=debos", "-c", "user.email=debos@example.com"}, args...)
+	out, err := exec.Command("git", args...).CombinedOutput()
+	assert.Empty(t, err, string(out))
+	return strings.TrimSpace(string(out))
+}
+
+// Create a repository with a commit of the file
+func commitFile(t *testing.T, dir, file, content string) string {
+	assert.Empty(t, ioutil.WriteFile(path.Join(dir, file), []byte(content), 0644))
+	runGit(t, dir, "add", file)
+	runGit(t, dir, "commit", "-q", "-m", "Update "+file)
+	return runGit(t, dir, "rev-parse", "HEAD")
+}
+
+func TestDownloadGit(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	// Submodules of local repositories are only cloned when allowed
+	for key, value := range map[string]string{"GIT_CONFIG_COUNT": "1", "GIT_CONFIG_KEY_0": "protocol.file.allow", "GIT_CONFIG_VALUE_0": "always"} {
+		os.Setenv(key, value)
+		defer os.Unsetenv(key)
+	}
+
+	module := path.Join(dir, "module")
+	assert.Empty(t, os.MkdirAll(module, 0755))
+	runGit(t, module, "init", "-q")
+	commitFile(t, module, "module", "module\n")
+
+	upstream := path.Join(dir, "upstream.git")
+	assert.Empty(t, os.MkdirAll(upstream, 0755))
+	runGit(t, upstream, "init", "-q", "-b", "main")
+	first := commitFile(t, upstream, "version", "1\n")
+	runGit(t, upstream, "tag", "v1")
+	runGit(t, upstream, "submodule", "add", "-q", "file://"+module, "module")
+	runGit(t, upstream, "commit", "-q", "-m", "Add module")
+	second := commitFile(t, upstream, "version", "2\n")
+
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+	context.Scratchdir = path.Join(dir, "scratch")
+	context.Origins = map[string]string{}
+
+	for ref, expected := range map[string]string{"": "2\n", "#main": "2\n", "#v1": "1\n", "#" + first: "1\n"} {
+		assert.Empty(t, os.RemoveAll(context.Scratchdir))
+		d := actions.DownloadAction{Url: "git+file://" + upstream + ref, Name: "source"}
+		assert.Empty(t, d.Verify(&context))
+		assert.Empty(t, d.Run(&context))
+
+		assert.Equal(t, path.Join(context.Scratchdir, "upstream"), context.Origins["source"])
+		version, err := ioutil.ReadFile(path.Join(context.Origins["source"], "version"))
+		assert.Empty(t, err)
+		assert.Equal(t, expected, string(version), ref)
+
+		// Without history
+		assert.Equal(t, "1", runGit(t, context.Origins["source"], "rev-list", "--count", "HEAD"))
+	}
+
+	// Pinned commits
+	assert.Empty(t, os.RemoveAll(context.Scratchdir))
+	d := actions.DownloadAction{Url: "git+file://" + upstream + "#main", Name: "source", Commit: second, Submodules: true}
+	assert.Empty(t, d.Verify(&context))
+	assert.Empty(t, d.Run(&context))
+	submodule, err := ioutil.ReadFile(path.Join(context.Origins["source"], "module/module"))
+	assert.Empty(t, err)
+	assert.Equal(t, "module\n", string(submodule))
+
+	assert.Empty(t, os.RemoveAll(context.Scratchdir))
+	d = actions.DownloadAction{Url: "git+file://" + upstream, Name: "source", Commit: first, Filename: "pinned"}
+	assert.Empty(t, d.Run(&context))
+	version, err := ioutil.ReadFile(path.Join(context.Scratchdir, "pinned/version"))
+	assert.Empty(t, err)
+	assert.Equal(t, "1\n", string(version))
+
+	assert.Empty(t, os.RemoveAll(context.Scratchdir))
+	d = actions.DownloadAction{Url: "git+file://" + upstream + "#v1", Name: "source", Commit: second}
+	assert.EqualError(t, d.Run(&context), "'git+file://"+upstream+"#v1' is at commit "+first+" instead of "+second)
+
+	d = actions.DownloadAction{Url: "git+file://" + upstream, Name: "source", Commit: "v1"}
+	assert.EqualError(t, d.Verify(&context), "Property 'commit' must be a full commit hash, got 'v1'")
+	d = actions.DownloadAction{Url: "git+file://" + upstream, Name: "source", Unpack: true}
+	assert.EqualError(t, d.Verify(&context), "Property 'unpack' can't be used with git repositories")
+	d = actions.DownloadAction{Url: "https://example.com/file.tar.gz", Name: "source", Submodules: true}
+	assert.EqualError(t, d.Verify(&context), "Properties 'submodules' and 'commit' are only supported for git repositories")
+}
+
+func TestDownloadCredentials(t *testing.T) {
+	var auth []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = append(auth, r.Header.Get("Authorization"), r.Header.Get("X-Token"))
+		w.Write([]byte("debos"))
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+	context.Scratchdir = dir
+	context.Origins = map[string]string{"scratch": path.Join(dir, "tmp")}
+	assert.Empty(t, os.Mkdir(context.Origins["scratch"], 0755))
+	context.EnvironVars = map[string]string{"TOKEN": "secret", "PASSWORD": "password"}
+
+	var d actions.DownloadAction
+	assert.Empty(t, yaml.Unmarshal([]byte(`
+url: `+server.URL+`/file
+name: file
+headers:
+  X-Token: ${TOKEN}
+basic-auth:
+  user: debos
+  password: $PASSWORD
+`), &d))
+	assert.Empty(t, d.Verify(&context))
+	assert.Empty(t, d.Run(&context))
+	assert.Equal(t, []string{"Basic ZGVib3M6cGFzc3dvcmQ=", "secret"}, auth)
+	// Saved in the scratch origin
+	assert.Equal(t, path.Join(dir, "tmp/file"), context.Origins["file"])
+
+	// The credentials aren't printed
+	printed := fmt.Sprintf("%v %v", d.Headers, d.BasicAuth)
+	assert.NotContains(t, printed, "TOKEN")
+	assert.NotContains(t, printed, "PASSWORD")
+
+	d.Headers = nil
+	d.BasicAuth.User = ""
+	assert.Error(t, d.Verify(&context))
+	d.Url = "git+" + server.URL
+	d.BasicAuth.User = "debos"
+	assert.Error(t, d.Verify(&context))
+}
@@ -0,0 +1,121 @@
+/*
+DpkgTriggers Action
+
+Finish the configuration of the packages in the target rootfs by running
+'dpkg --configure -a' and processing the pending dpkg triggers, then check
+that no package is left half-configured or waiting for a trigger.
+
+Depending on the order of the actions of a recipe, for example when files are
+overlaid after the packages were installed, triggers can be left pending and
+produce an image in a half-configured state. Running this action at the end of
+the recipe makes sure it does not happen.
+
+Yaml syntax:
+ - action: dpkg-triggers
+
+The action has no properties. It fails if some packages are still not fully
+configured after processing the triggers, listing them along with their state.
+*/
+package actions
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/go-debos/debos"
+)
+
+type DpkgTriggersAction struct {
+	debos.BaseAction `yaml:",inline"`
+}
+
+// Package states which mean the package is not fully configured
+var dpkgUnconfiguredStates = []string{
+	"half-installed",
+	"unpacked",
+	"half-configured",
+	"triggers-awaited",
+	"triggers-pending",
+}
+
+/* Returns the packages of the rootfs which are not fully configured, as
+ * 'package (state)', and the triggers which were not processed yet */
+func dpkgPending(rootdir string) ([]string, []string, error) {
+	var packages, triggers []string
+
+	f, err := os.Open(path.Join(rootdir, "var/lib/dpkg/status"))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	var pkg string
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "Package:"):
+			pkg = strings.TrimSpace(strings.TrimPrefix(line, "Package:"))
+		case strings.HasPrefix(line, "Status:"):
+			// Status: <want> <flag> <state>
+			fields := strings.Fields(strings.TrimPrefix(line, "Status:"))
+			if len(fields) != 3 {
+				continue
+			}
+			for _, s := range dpkgUnconfiguredStates {
+				if fields[2] == s {
+					packages = append(packages, fmt.Sprintf("%s (%s)", pkg, s))
+				}
+			}
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	unincorp, err := ioutil.ReadFile(path.Join(rootdir, "var/lib/dpkg/triggers/Unincorp"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	for _, line := range strings.Split(string(unincorp), "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 {
+			triggers = append(triggers, fields[0])
+		}
+	}
+
+	return packages, triggers, nil
+}
+
+func (dt *DpkgTriggersAction) Run(context *debos.DebosContext) error {
+	dt.LogStart()
+
+	c := debos.NewChrootCommandForContext(*context)
+	c.AddEnv("DEBIAN_FRONTEND=noninteractive")
+
+	err := c.Run("dpkg-triggers", "dpkg", "--configure", "-a")
+	if err != nil {
+		return err
+	}
+	err = c.Run("dpkg-triggers", "dpkg", "--triggers-only", "--pending")
+	if err != nil {
+		return err
+	}
+
+	packages, triggers, err := dpkgPending(context.Rootdir)
+	if err != nil {
+		return err
+	}
+	if len(packages) > 0 {
+		return fmt.Errorf("Packages not fully configured: %s", strings.Join(packages, ", "))
+	}
+	if len(triggers) > 0 {
+		return fmt.Errorf("Unprocessed dpkg triggers: %s", strings.Join(triggers, ", "))
+	}
+
+	return nil
+}
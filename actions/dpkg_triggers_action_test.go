@@ -0,0 +1,72 @@
+package actions
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeDpkgStatus(t *testing.T, rootdir, status, unincorp string) {
+	dir := path.Join(rootdir, "var/lib/dpkg/triggers")
+	assert.Empty(t, os.MkdirAll(dir, 0755))
+	assert.Empty(t, ioutil.WriteFile(path.Join(rootdir, "var/lib/dpkg/status"), []byte(status), 0644))
+	assert.Empty(t, ioutil.WriteFile(path.Join(dir, "Unincorp"), []byte(unincorp), 0644))
+}
+
+func TestDpkgPending(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	// State left behind when triggers were not run
+	writeDpkgStatus(t, dir, `Package: libc-bin
+Status: install ok triggers-pending
+Triggers-Pending: ldconfig
+
+Package: man-db
+Status: install ok triggers-awaited
+Triggers-Awaited: libc-bin
+
+Package: hello
+Status: install ok installed
+Description: example package
+ with a continuation line
+
+Package: foo
+Status: install ok half-configured
+`, "/usr/share/man man-db\n")
+
+	packages, triggers, err := dpkgPending(dir)
+	assert.Empty(t, err)
+	assert.Equal(t, []string{
+		"libc-bin (triggers-pending)",
+		"man-db (triggers-awaited)",
+		"foo (half-configured)",
+	}, packages)
+	assert.Equal(t, []string{"/usr/share/man"}, triggers)
+
+	// Same packages once the triggers have been processed
+	writeDpkgStatus(t, dir, `Package: libc-bin
+Status: install ok installed
+
+Package: man-db
+Status: install ok installed
+
+Package: hello
+Status: install ok installed
+
+Package: foo
+Status: install ok installed
+
+Package: removed
+Status: deinstall ok config-files
+`, "")
+
+	packages, triggers, err = dpkgPending(dir)
+	assert.Empty(t, err)
+	assert.Empty(t, packages)
+	assert.Empty(t, triggers)
+}
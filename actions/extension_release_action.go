@@ -0,0 +1,137 @@
+/*
+ExtensionRelease Action
+
+Write a release file in the os-release format describing a layer of the
+product, for the tooling of the vendors building on top of the distribution.
+By default the file is the extension-release file of a system extension,
+'/usr/lib/extension-release.d/extension-release.<name>', as read by
+systemd-sysext to check the extension matches the base image.
+
+Yaml syntax:
+ - action: extension-release
+   name: vendor-tools
+   path: /etc/vendor-release
+   fields:
+     ID: debian
+     SYSEXT_LEVEL: "1.0"
+     VENDOR_NAME: "Example Inc."
+
+Mandatory properties:
+
+- fields -- keys and values of the file. The keys are made of upper case
+letters, digits and underscores, starting with a letter, and the values can't
+span multiple lines. The values are quoted, and like all the recipe they can
+use the templating of debos, for example '{{ $version }}'. The keys are
+written sorted.
+
+Optional properties:
+
+- name -- name of the extension, mandatory without 'path'. Its
+extension-release file must set 'ID', to the one of the base image or '_any',
+and either 'SYSEXT_LEVEL' or 'VERSION_ID'.
+
+- path -- absolute path in the target rootfs of the file to write instead of
+an extension-release file, for example '/etc/vendor-release'.
+*/
+package actions
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/go-debos/debos"
+)
+
+const extensionReleaseDir = "/usr/lib/extension-release.d"
+
+var releaseKey = regexp.MustCompile(`^[A-Z][A-Z0-9_]*$`)
+
+type ExtensionReleaseAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Name             string
+	Path             string
+	Fields           map[string]string
+}
+
+func (e *ExtensionReleaseAction) Verify(context *debos.DebosContext) error {
+	if len(e.Fields) == 0 {
+		return errors.New("'fields' property can't be empty")
+	}
+	for k, v := range e.Fields {
+		if !releaseKey.MatchString(k) {
+			return fmt.Errorf("Invalid key '%s', expected upper case letters, digits and underscores", k)
+		}
+		if strings.ContainsAny(v, "\n\r") {
+			return fmt.Errorf("Value of '%s' can't span multiple lines", k)
+		}
+	}
+
+	if len(e.Path) > 0 {
+		if !path.IsAbs(e.Path) {
+			return fmt.Errorf("'path' must be an absolute path")
+		}
+		return nil
+	}
+
+	if len(e.Name) == 0 {
+		return errors.New("Either 'name' or 'path' property must be set")
+	}
+	if strings.Contains(e.Name, "/") {
+		return fmt.Errorf("Invalid extension name '%s'", e.Name)
+	}
+	if _, found := e.Fields["ID"]; !found {
+		return fmt.Errorf("Extension release of '%s' must set 'ID'", e.Name)
+	}
+	_, level := e.Fields["SYSEXT_LEVEL"]
+	_, version := e.Fields["VERSION_ID"]
+	if !level && !version {
+		return fmt.Errorf("Extension release of '%s' must set 'SYSEXT_LEVEL' or 'VERSION_ID'", e.Name)
+	}
+
+	return nil
+}
+
+func (e *ExtensionReleaseAction) file() string {
+	if len(e.Path) > 0 {
+		return e.Path
+	}
+	return path.Join(extensionReleaseDir, "extension-release."+e.Name)
+}
+
+func (e *ExtensionReleaseAction) content() string {
+	var keys []string
+	for k := range e.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var lines []string
+	for _, k := range keys {
+		lines = append(lines, fmt.Sprintf("%s=%s", k, quoteEnvValue(e.Fields[k])))
+	}
+
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func (e *ExtensionReleaseAction) Run(context *debos.DebosContext) error {
+	e.LogStart()
+
+	file, err := debos.RestrictedPath(context.Rootdir, e.file())
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path.Dir(file), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(file, []byte(e.content()), 0644); err != nil {
+		return fmt.Errorf("Couldn't write %s: %v", e.file(), err)
+	}
+
+	return nil
+}
@@ -0,0 +1,63 @@
+package actions_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/go-debos/debos"
+	"github.com/go-debos/debos/actions"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtensionRelease(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+	context.Rootdir = dir
+
+	e := actions.ExtensionReleaseAction{
+		Name: "vendor-tools",
+		Fields: map[string]string{
+			"SYSEXT_LEVEL": "1.0",
+			"ID":           "debian",
+			"VENDOR_NAME":  `Example "Tools" Inc.`,
+		},
+	}
+	assert.Empty(t, e.Verify(&context))
+	assert.Empty(t, e.Run(&context))
+
+	content, err := ioutil.ReadFile(path.Join(dir, "usr/lib/extension-release.d/extension-release.vendor-tools"))
+	assert.Empty(t, err)
+	assert.Equal(t, "ID=\"debian\"\nSYSEXT_LEVEL=\"1.0\"\nVENDOR_NAME=\"Example \\\"Tools\\\" Inc.\"\n", string(content))
+
+	// Any file, without the extension requirements
+	e = actions.ExtensionReleaseAction{
+		Path:   "/etc/vendor-release",
+		Fields: map[string]string{"VENDOR_VERSION": "2024.1"},
+	}
+	assert.Empty(t, e.Verify(&context))
+	assert.Empty(t, e.Run(&context))
+
+	content, err = ioutil.ReadFile(path.Join(dir, "etc/vendor-release"))
+	assert.Empty(t, err)
+	assert.Equal(t, "VENDOR_VERSION=\"2024.1\"\n", string(content))
+
+	e = actions.ExtensionReleaseAction{Name: "tools", Fields: map[string]string{"ID": "debian"}}
+	assert.EqualError(t, e.Verify(&context), "Extension release of 'tools' must set 'SYSEXT_LEVEL' or 'VERSION_ID'")
+	e = actions.ExtensionReleaseAction{Name: "tools", Fields: map[string]string{"VERSION_ID": "12"}}
+	assert.EqualError(t, e.Verify(&context), "Extension release of 'tools' must set 'ID'")
+	e = actions.ExtensionReleaseAction{Fields: map[string]string{"ID": "debian"}}
+	assert.EqualError(t, e.Verify(&context), "Either 'name' or 'path' property must be set")
+	e = actions.ExtensionReleaseAction{Path: "/etc/vendor-release", Fields: map[string]string{"vendor": "x"}}
+	assert.EqualError(t, e.Verify(&context), "Invalid key 'vendor', expected upper case letters, digits and underscores")
+	e = actions.ExtensionReleaseAction{Path: "/etc/vendor-release", Fields: map[string]string{"VENDOR": "a\nb"}}
+	assert.EqualError(t, e.Verify(&context), "Value of 'VENDOR' can't span multiple lines")
+	e = actions.ExtensionReleaseAction{Path: "etc/vendor-release", Fields: map[string]string{"VENDOR": "x"}}
+	assert.EqualError(t, e.Verify(&context), "'path' must be an absolute path")
+	e = actions.ExtensionReleaseAction{Path: "/etc/vendor-release"}
+	assert.EqualError(t, e.Verify(&context), "'fields' property can't be empty")
+}
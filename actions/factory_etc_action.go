@@ -0,0 +1,202 @@
+/*
+FactoryEtc Action
+
+Ship a factory copy of '/etc' in '/usr/share/factory/etc' and set up
+systemd-tmpfiles to populate '/etc' from it at boot. Files missing from '/etc'
+are restored from the factory copy, so emptying '/etc' resets the
+configuration to its factory state. This is the pattern used by immutable
+images, where '/usr' is read-only and '/etc' is writable.
+
+The rules are written to '/usr/lib/tmpfiles.d/debos-factory-etc.conf'.
+
+Yaml syntax:
+ - action: factory-etc
+   paths:
+     - hostname
+     - ssh
+   method: copy
+   move: false
+
+Optional properties:
+
+- paths -- list of files or directories, relative to '/etc', to put in the
+factory copy. By default the whole content of '/etc' is used.
+
+- method -- how '/etc' is populated: 'copy' copies the missing files from the
+factory copy, so they can be modified on the device; 'symlink' links them to
+the factory copy, making them read-only. By default is 'copy'.
+
+- move -- remove the paths from '/etc' in the image once they are in the
+factory copy, so they are only created at boot. Files needed before
+systemd-tmpfiles runs, like '/etc/fstab' or '/etc/machine-id', must not be
+moved. By default is 'false'.
+*/
+package actions
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/go-debos/debos"
+)
+
+const (
+	factoryDir   = "/usr/share/factory"
+	factoryRules = "/usr/lib/tmpfiles.d/debos-factory-etc.conf"
+)
+
+var tmpfilesType = regexp.MustCompile(`^[fFwdDevqQpLcbCxXrRzZtThHaAl][-+!=~^]*$`)
+var tmpfilesMode = regexp.MustCompile(`^(-|[~:]*[0-7]{3,4})$`)
+
+type FactoryEtcAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Paths            []string
+	Method           string
+	Move             bool
+}
+
+func NewFactoryEtcAction() *FactoryEtcAction {
+	f := FactoryEtcAction{}
+	f.Method = "copy"
+
+	return &f
+}
+
+// Check a tmpfiles.d line has a valid type, path and mode
+func verifyTmpfilesLine(line string) error {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return fmt.Errorf("Invalid tmpfiles rule '%s': missing path", line)
+	}
+	if !tmpfilesType.MatchString(fields[0]) {
+		return fmt.Errorf("Invalid tmpfiles rule '%s': unknown type '%s'", line, fields[0])
+	}
+	if !path.IsAbs(fields[1]) {
+		return fmt.Errorf("Invalid tmpfiles rule '%s': path must be absolute", line)
+	}
+	if len(fields) > 2 && !tmpfilesMode.MatchString(fields[2]) {
+		return fmt.Errorf("Invalid tmpfiles rule '%s': invalid mode '%s'", line, fields[2])
+	}
+	if len(fields) > 7 {
+		return fmt.Errorf("Invalid tmpfiles rule '%s': too many fields", line)
+	}
+
+	return nil
+}
+
+func (f *FactoryEtcAction) Verify(context *debos.DebosContext) error {
+	if f.Method != "copy" && f.Method != "symlink" {
+		return fmt.Errorf("Unsupported method '%s', expected copy or symlink", f.Method)
+	}
+
+	for _, p := range f.Paths {
+		clean := path.Clean(p)
+		if path.IsAbs(p) || clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+			return fmt.Errorf("Path '%s' must be relative to /etc", p)
+		}
+		if strings.ContainsAny(p, " \t\n\\") {
+			return fmt.Errorf("Path '%s' can't contain whitespace or backslashes", p)
+		}
+	}
+
+	return nil
+}
+
+// Returns the paths to handle, relative to /etc
+func (f *FactoryEtcAction) paths(context *debos.DebosContext) ([]string, error) {
+	if len(f.Paths) > 0 {
+		var paths []string
+		for _, p := range f.Paths {
+			paths = append(paths, path.Clean(p))
+		}
+		return paths, nil
+	}
+
+	entries, err := ioutil.ReadDir(path.Join(context.Rootdir, "etc"))
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for _, e := range entries {
+		if strings.ContainsAny(e.Name(), " \t\n\\") {
+			return nil, fmt.Errorf("Can't handle /etc/%s: contains whitespace or backslashes", e.Name())
+		}
+		paths = append(paths, e.Name())
+	}
+
+	return paths, nil
+}
+
+func (f *FactoryEtcAction) rules(paths []string) ([]string, error) {
+	rules := []string{"# Populate /etc from the factory copy, generated by debos"}
+
+	for _, p := range paths {
+		var rule string
+		etc := path.Join("/etc", p)
+		if f.Method == "symlink" {
+			rule = fmt.Sprintf("L %s - - - - %s", etc, path.Join(factoryDir, etc))
+		} else {
+			rule = fmt.Sprintf("C %s - - - - -", etc)
+		}
+		if err := verifyTmpfilesLine(rule); err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+func (f *FactoryEtcAction) Run(context *debos.DebosContext) error {
+	f.LogStart()
+
+	paths, err := f.paths(context)
+	if err != nil {
+		return err
+	}
+
+	rules, err := f.rules(paths)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range paths {
+		src := path.Join(context.Rootdir, "etc", p)
+		dst := path.Join(context.Rootdir, factoryDir, "etc", p)
+
+		if _, err := os.Lstat(src); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(path.Dir(dst), 0755); err != nil {
+			return err
+		}
+		os.RemoveAll(dst)
+
+		err := debos.NewCommandForContext(*context).Run("factory-etc", "cp", "-a", src, dst)
+		if err != nil {
+			return err
+		}
+
+		if f.Move {
+			if err := os.RemoveAll(src); err != nil {
+				return err
+			}
+		}
+	}
+
+	file := path.Join(context.Rootdir, factoryRules)
+	if err := os.MkdirAll(path.Dir(file), 0755); err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(file, []byte(strings.Join(rules, "\n")+"\n"), 0644)
+	if err != nil {
+		return fmt.Errorf("Couldn't write tmpfiles rules: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,81 @@
+package actions
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/go-debos/debos"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFactoryEtc(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+	context.Rootdir = dir
+
+	assert.Empty(t, os.MkdirAll(path.Join(dir, "etc/ssh"), 0755))
+	assert.Empty(t, ioutil.WriteFile(path.Join(dir, "etc/hostname"), []byte("debian\n"), 0644))
+	assert.Empty(t, ioutil.WriteFile(path.Join(dir, "etc/ssh/sshd_config"), []byte("PermitRootLogin no\n"), 0600))
+
+	f := NewFactoryEtcAction()
+	assert.Empty(t, f.Verify(&context))
+	assert.Empty(t, f.Run(&context))
+
+	content, err := ioutil.ReadFile(path.Join(dir, "usr/share/factory/etc/ssh/sshd_config"))
+	assert.Empty(t, err)
+	assert.Equal(t, "PermitRootLogin no\n", string(content))
+	info, err := os.Stat(path.Join(dir, "usr/share/factory/etc/ssh/sshd_config"))
+	assert.Empty(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode())
+	_, err = os.Stat(path.Join(dir, "etc/hostname"))
+	assert.Empty(t, err)
+
+	rules, err := ioutil.ReadFile(path.Join(dir, "usr/lib/tmpfiles.d/debos-factory-etc.conf"))
+	assert.Empty(t, err)
+	assert.Equal(t, `# Populate /etc from the factory copy, generated by debos
+C /etc/hostname - - - - -
+C /etc/ssh - - - - -
+`, string(rules))
+
+	// Symlinks to the factory copy, only in the factory copy
+	f = NewFactoryEtcAction()
+	f.Paths = []string{"hostname"}
+	f.Method = "symlink"
+	f.Move = true
+	assert.Empty(t, f.Verify(&context))
+	assert.Empty(t, f.Run(&context))
+
+	rules, err = ioutil.ReadFile(path.Join(dir, "usr/lib/tmpfiles.d/debos-factory-etc.conf"))
+	assert.Empty(t, err)
+	assert.Equal(t, `# Populate /etc from the factory copy, generated by debos
+L /etc/hostname - - - - /usr/share/factory/etc/hostname
+`, string(rules))
+	_, err = os.Stat(path.Join(dir, "etc/hostname"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(path.Join(dir, "usr/share/factory/etc/hostname"))
+	assert.Empty(t, err)
+
+	f.Paths = []string{"../usr"}
+	assert.EqualError(t, f.Verify(&context), "Path '../usr' must be relative to /etc")
+	f.Paths = []string{"my file"}
+	assert.EqualError(t, f.Verify(&context), "Path 'my file' can't contain whitespace or backslashes")
+	f.Paths = nil
+	f.Method = "bind"
+	assert.EqualError(t, f.Verify(&context), "Unsupported method 'bind', expected copy or symlink")
+}
+
+func TestVerifyTmpfilesLine(t *testing.T) {
+	assert.Empty(t, verifyTmpfilesLine("C /etc/hostname - - - - -"))
+	assert.Empty(t, verifyTmpfilesLine("d /var/lib/app 0755 root root -"))
+	assert.Empty(t, verifyTmpfilesLine("L+ /etc/resolv.conf - - - - ../run/resolv.conf"))
+
+	assert.EqualError(t, verifyTmpfilesLine("C"), "Invalid tmpfiles rule 'C': missing path")
+	assert.EqualError(t, verifyTmpfilesLine("Y /etc/hostname"), "Invalid tmpfiles rule 'Y /etc/hostname': unknown type 'Y'")
+	assert.EqualError(t, verifyTmpfilesLine("C etc/hostname"), "Invalid tmpfiles rule 'C etc/hostname': path must be absolute")
+	assert.EqualError(t, verifyTmpfilesLine("d /var/lib/app rwx"), "Invalid tmpfiles rule 'd /var/lib/app rwx': invalid mode 'rwx'")
+}
@@ -0,0 +1,290 @@
+/*
+Fail2ban Action
+
+Install fail2ban in the target rootfs, configure its jails and enable the
+service, so hosts repeatedly failing to authenticate are banned from the first
+boot. The configuration is written to '/etc/fail2ban/jail.local'.
+
+Yaml syntax:
+ - action: fail2ban
+   backend: systemd
+   ban-time: 1h
+   find-time: 10m
+   max-retry: 5
+   ignore-ip:
+     - 192.168.0.0/16
+   jails:
+     - name: sshd
+       port: ssh
+     - name: nginx-http-auth
+       port: http,https
+       log-path: /var/log/nginx/error.log
+       max-retry: 3
+
+Optional properties:
+
+- backend -- how fail2ban reads the logs: 'systemd' to read the journal,
+'auto', 'pyinotify' or 'polling' to read log files. By default is 'systemd'.
+
+- ban-time -- how long a host is banned, either a number of seconds or a
+duration such as '10m', '1h' or '1d'. '-1' bans hosts permanently. By default
+the fail2ban default is used.
+
+- find-time -- window in which 'max-retry' failures cause a ban, in the same
+format as 'ban-time'. By default the fail2ban default is used.
+
+- max-retry -- number of failures within 'find-time' which cause a ban. By
+default the fail2ban default is used.
+
+- ignore-ip -- list of IP addresses or networks, in CIDR notation, which are
+never banned. The local host is always ignored.
+
+- jails -- list of jails to enable. By default only the 'sshd' jail is
+enabled. Each jail has the following properties:
+
+  - name -- name of the jail, mandatory. Unless 'filter' is set, a filter of
+  the same name must exist in '/etc/fail2ban/filter.d'.
+
+  - port -- comma separated list of ports or service names to ban the hosts
+  from, for example 'ssh' or 'http,https,8080'. Ranges are written as
+  '1000:2000'. By default the ports of the fail2ban jail definition are used.
+
+  - filter -- name of the filter in '/etc/fail2ban/filter.d' used to detect
+  failures. Custom filters can be added with an 'overlay' action before this
+  one.
+
+  - log-path -- absolute path of the log file to watch. The jail then reads
+  this file, whatever the 'backend' is.
+
+  - ban-time, find-time, max-retry -- override the global values for this
+  jail.
+*/
+package actions
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/go-debos/debos"
+)
+
+const fail2banJails = "/etc/fail2ban/jail.local"
+
+var fail2banName = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+var fail2banTime = regexp.MustCompile(`^([0-9]+(s|m|h|d|w)?)+$`)
+var fail2banService = regexp.MustCompile(`^[a-z][a-z0-9-]*$`)
+
+type Fail2banJail struct {
+	Name     string
+	Port     string
+	Filter   string
+	LogPath  string `yaml:"log-path"`
+	BanTime  string `yaml:"ban-time"`
+	FindTime string `yaml:"find-time"`
+	MaxRetry int    `yaml:"max-retry"`
+}
+
+type Fail2banAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Backend          string
+	BanTime          string   `yaml:"ban-time"`
+	FindTime         string   `yaml:"find-time"`
+	MaxRetry         int      `yaml:"max-retry"`
+	IgnoreIP         []string `yaml:"ignore-ip"`
+	Jails            []Fail2banJail
+}
+
+func NewFail2banAction() *Fail2banAction {
+	f := Fail2banAction{}
+	f.Backend = "systemd"
+
+	return &f
+}
+
+func verifyFail2banTime(property, value string, permanent bool) error {
+	if value == "" || fail2banTime.MatchString(value) || (permanent && value == "-1") {
+		return nil
+	}
+
+	return fmt.Errorf("Invalid %s '%s'", property, value)
+}
+
+func verifyFail2banPort(port string) error {
+	for _, p := range strings.Split(port, ",") {
+		for _, n := range strings.Split(strings.TrimSpace(p), ":") {
+			if fail2banService.MatchString(n) {
+				continue
+			}
+			if i, err := strconv.Atoi(n); err != nil || i < 1 || i > 65535 {
+				return fmt.Errorf("Invalid port '%s'", port)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Check the common properties of the action and the jails
+func verifyFail2banLimits(banTime, findTime string, maxRetry int) error {
+	if err := verifyFail2banTime("ban-time", banTime, true); err != nil {
+		return err
+	}
+	if err := verifyFail2banTime("find-time", findTime, false); err != nil {
+		return err
+	}
+	if maxRetry < 0 {
+		return fmt.Errorf("Invalid max-retry %d", maxRetry)
+	}
+
+	return nil
+}
+
+func (f *Fail2banAction) Verify(context *debos.DebosContext) error {
+	switch f.Backend {
+	case "systemd", "auto", "pyinotify", "polling":
+	default:
+		return fmt.Errorf("Unsupported backend '%s'", f.Backend)
+	}
+
+	if err := verifyFail2banLimits(f.BanTime, f.FindTime, f.MaxRetry); err != nil {
+		return err
+	}
+
+	for _, ip := range f.IgnoreIP {
+		if _, _, err := net.ParseCIDR(ip); err != nil && net.ParseIP(ip) == nil {
+			return fmt.Errorf("Invalid address '%s' in ignore-ip", ip)
+		}
+	}
+
+	if len(f.Jails) == 0 {
+		f.Jails = []Fail2banJail{{Name: "sshd"}}
+	}
+
+	names := map[string]bool{}
+	for _, j := range f.Jails {
+		if j.Name == "" {
+			return errors.New("Jail without a name")
+		}
+		if !fail2banName.MatchString(j.Name) || j.Name == "DEFAULT" || j.Name == "INCLUDES" {
+			return fmt.Errorf("Invalid jail name '%s'", j.Name)
+		}
+		if names[j.Name] {
+			return fmt.Errorf("Jail %s already exists", j.Name)
+		}
+		names[j.Name] = true
+
+		if j.Port != "" {
+			if err := verifyFail2banPort(j.Port); err != nil {
+				return fmt.Errorf("Jail %s: %v", j.Name, err)
+			}
+		}
+		if j.Filter != "" && !fail2banName.MatchString(j.Filter) {
+			return fmt.Errorf("Jail %s: invalid filter '%s'", j.Name, j.Filter)
+		}
+		if j.LogPath != "" && !path.IsAbs(j.LogPath) {
+			return fmt.Errorf("Jail %s: log-path '%s' must be absolute", j.Name, j.LogPath)
+		}
+		if err := verifyFail2banLimits(j.BanTime, j.FindTime, j.MaxRetry); err != nil {
+			return fmt.Errorf("Jail %s: %v", j.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// Append the ban settings which are set
+func fail2banLimits(lines []string, banTime, findTime string, maxRetry int) []string {
+	if banTime != "" {
+		lines = append(lines, "bantime = "+banTime)
+	}
+	if findTime != "" {
+		lines = append(lines, "findtime = "+findTime)
+	}
+	if maxRetry > 0 {
+		lines = append(lines, fmt.Sprintf("maxretry = %d", maxRetry))
+	}
+
+	return lines
+}
+
+func (f *Fail2banAction) jails() string {
+	lines := []string{
+		"# Generated by debos",
+		"[DEFAULT]",
+		"backend = " + f.Backend,
+	}
+	lines = fail2banLimits(lines, f.BanTime, f.FindTime, f.MaxRetry)
+	if len(f.IgnoreIP) > 0 {
+		ignore := append([]string{"127.0.0.1/8", "::1"}, f.IgnoreIP...)
+		lines = append(lines, "ignoreip = "+strings.Join(ignore, " "))
+	}
+
+	for _, j := range f.Jails {
+		lines = append(lines, "", "["+j.Name+"]", "enabled = true")
+		if j.Port != "" {
+			lines = append(lines, "port = "+j.Port)
+		}
+		if j.Filter != "" {
+			lines = append(lines, "filter = "+j.Filter)
+		}
+		if j.LogPath != "" {
+			lines = append(lines, "backend = auto", "logpath = "+j.LogPath)
+		}
+		lines = fail2banLimits(lines, j.BanTime, j.FindTime, j.MaxRetry)
+	}
+
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func (f *Fail2banAction) configure(context *debos.DebosContext) error {
+	// Catch typos in jail names before the first boot
+	for _, j := range f.Jails {
+		filter := j.Filter
+		if filter == "" {
+			filter = j.Name
+		}
+		found := false
+		for _, ext := range []string{".conf", ".local"} {
+			p := path.Join(context.Rootdir, "etc/fail2ban/filter.d", filter+ext)
+			if _, err := os.Stat(p); err == nil {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("Jail %s: filter '%s' not found", j.Name, filter)
+		}
+	}
+
+	file := path.Join(context.Rootdir, fail2banJails)
+	if err := os.MkdirAll(path.Dir(file), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(file, []byte(f.jails()), 0644); err != nil {
+		return fmt.Errorf("Couldn't write %s: %v", fail2banJails, err)
+	}
+
+	services := debos.SystemdHelper{Rootdir: context.Rootdir}
+	return services.Enable("fail2ban.service")
+}
+
+func (f *Fail2banAction) Run(context *debos.DebosContext) error {
+	f.LogStart()
+
+	packages := []string{"fail2ban"}
+	if f.Backend == "systemd" {
+		// Needed to read the journal
+		packages = append(packages, "python3-systemd")
+	}
+	if err := installPackages(context, packages...); err != nil {
+		return err
+	}
+
+	return f.configure(context)
+}
@@ -0,0 +1,118 @@
+package actions
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/go-debos/debos"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFail2ban(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+	context.Rootdir = dir
+	fakeUnit(t, dir, "fail2ban.service", "WantedBy=multi-user.target")
+
+	filters := path.Join(dir, "etc/fail2ban/filter.d")
+	assert.Empty(t, os.MkdirAll(filters, 0755))
+	for _, f := range []string{"sshd.conf", "nginx-http-auth.conf", "custom.local"} {
+		assert.Empty(t, ioutil.WriteFile(path.Join(filters, f), []byte("[Definition]\n"), 0644))
+	}
+
+	// Only sshd by default
+	f := NewFail2banAction()
+	assert.Empty(t, f.Verify(&context))
+	assert.Empty(t, f.configure(&context))
+
+	jails, err := ioutil.ReadFile(path.Join(dir, "etc/fail2ban/jail.local"))
+	assert.Empty(t, err)
+	assert.Equal(t, `# Generated by debos
+[DEFAULT]
+backend = systemd
+
+[sshd]
+enabled = true
+`, string(jails))
+
+	link, err := os.Readlink(path.Join(dir, "etc/systemd/system/multi-user.target.wants/fail2ban.service"))
+	assert.Empty(t, err)
+	assert.Equal(t, "/lib/systemd/system/fail2ban.service", link)
+
+	f = NewFail2banAction()
+	f.BanTime = "1h"
+	f.FindTime = "10m"
+	f.MaxRetry = 5
+	f.IgnoreIP = []string{"192.168.0.0/16", "10.0.0.1"}
+	f.Jails = []Fail2banJail{
+		{Name: "sshd", Port: "ssh,2222"},
+		{Name: "nginx-http-auth", Port: "http,https", LogPath: "/var/log/nginx/error.log", MaxRetry: 3},
+		{Name: "api", Filter: "custom", Port: "8000:8080", BanTime: "-1"},
+	}
+	assert.Empty(t, f.Verify(&context))
+	assert.Empty(t, f.configure(&context))
+
+	jails, err = ioutil.ReadFile(path.Join(dir, "etc/fail2ban/jail.local"))
+	assert.Empty(t, err)
+	assert.Equal(t, `# Generated by debos
+[DEFAULT]
+backend = systemd
+bantime = 1h
+findtime = 10m
+maxretry = 5
+ignoreip = 127.0.0.1/8 ::1 192.168.0.0/16 10.0.0.1
+
+[sshd]
+enabled = true
+port = ssh,2222
+
+[nginx-http-auth]
+enabled = true
+port = http,https
+backend = auto
+logpath = /var/log/nginx/error.log
+maxretry = 3
+
+[api]
+enabled = true
+port = 8000:8080
+filter = custom
+bantime = -1
+`, string(jails))
+
+	// Filters are looked up in the rootfs
+	f.Jails = []Fail2banJail{{Name: "sshd-typo"}}
+	assert.Empty(t, f.Verify(&context))
+	assert.EqualError(t, f.configure(&context), "Jail sshd-typo: filter 'sshd-typo' not found")
+
+	for jail, msg := range map[*Fail2banJail]string{
+		{Name: ""}:                          "Jail without a name",
+		{Name: "DEFAULT"}:                   "Invalid jail name 'DEFAULT'",
+		{Name: "my jail"}:                   "Invalid jail name 'my jail'",
+		{Name: "sshd", Port: "ssh,99999"}:   "Jail sshd: Invalid port 'ssh,99999'",
+		{Name: "sshd", Filter: "../x"}:      "Jail sshd: invalid filter '../x'",
+		{Name: "sshd", LogPath: "auth.log"}: "Jail sshd: log-path 'auth.log' must be absolute",
+		{Name: "sshd", FindTime: "-1"}:      "Jail sshd: Invalid find-time '-1'",
+		{Name: "sshd", BanTime: "one hour"}: "Jail sshd: Invalid ban-time 'one hour'",
+		{Name: "sshd", MaxRetry: -2}:        "Jail sshd: Invalid max-retry -2",
+	} {
+		f.Jails = []Fail2banJail{*jail}
+		assert.EqualError(t, f.Verify(&context), msg)
+	}
+
+	f.Jails = []Fail2banJail{{Name: "sshd"}, {Name: "sshd"}}
+	assert.EqualError(t, f.Verify(&context), "Jail sshd already exists")
+
+	f.Jails = nil
+	f.IgnoreIP = []string{"example.com"}
+	assert.EqualError(t, f.Verify(&context), "Invalid address 'example.com' in ignore-ip")
+
+	f.IgnoreIP = nil
+	f.Backend = "gamin"
+	assert.EqualError(t, f.Verify(&context), "Unsupported backend 'gamin'")
+}
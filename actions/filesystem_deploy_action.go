@@ -6,6 +6,10 @@ temporary scratch directory to the mounted image and optionally creates various
 configuration files for the image: '/etc/fstab' and '/etc/kernel/cmdline'. This
 action requires 'image-partition' action to be executed before it.
 
+The files are copied to the partitions as mounted by the 'image-partition'
+action, parents before their children, so the content of each mountpoint
+lands on its partition.
+
 After this action has ran, subsequent actions are executed on the mounted output
 image.
 
@@ -121,7 +125,7 @@ func (fd *FilesystemDeployAction) Run(context *debos.DebosContext) error {
 	/* Copying files is actually silly hafd, one has to keep permissions, ACL's
 	 * extended attribute, misc, other. Leave it to cp...
 	 */
-	err := debos.Command{}.Run("Deploy to image", "cp", "-a", context.Rootdir+"/.", context.ImageMntDir)
+	err := debos.NewCommandForContext(*context).Run("Deploy to image", "cp", "-a", context.Rootdir+"/.", context.ImageMntDir)
 	if err != nil {
 		return fmt.Errorf("rootfs deploy failed: %v", err)
 	}
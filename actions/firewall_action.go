@@ -0,0 +1,311 @@
+/*
+Firewall Action
+
+Install a baseline firewall in the target rootfs from a list of allowed and
+denied ports, and enable it so the rules are loaded at boot. Incoming traffic
+for established connections, on the loopback interface and ICMP, which IPv6
+can't work without, is always accepted.
+
+With the 'nftables' backend the ruleset is written to '/etc/nftables.conf' and
+'nftables.service' is enabled. With the 'iptables' backend the rules are
+written in the 'iptables-save' format to '/etc/iptables/rules.v4' and
+'/etc/iptables/rules.v6', and loaded by 'netfilter-persistent.service'. The
+packages needed by the backend are installed with 'apt'.
+
+Yaml syntax:
+ - action: firewall
+   backend: nftables
+   policy: drop
+   allow:
+     - port: 22
+     - port: 60000-61000
+       protocol: udp
+     - protocol: all
+       source: 192.168.1.0/24
+   deny:
+     - port: 22
+       source: 192.168.1.100
+
+Optional properties:
+
+- backend -- either 'nftables' or 'iptables'. By default is 'nftables'.
+
+- policy -- what happens to incoming and forwarded traffic matching no rule,
+either 'drop' or 'accept'. By default is 'drop'. Outgoing traffic is always
+accepted.
+
+- allow -- list of rules for the incoming traffic to accept.
+
+- deny -- list of rules for the incoming traffic to drop. They take precedence
+over the 'allow' rules, so a port can be opened except for some hosts.
+
+Each rule has the following properties:
+
+- port -- destination port, or range of ports such as '8000-8080'. Mandatory
+unless the protocol is 'all'.
+
+- protocol -- 'tcp', 'udp' or 'all' to match any traffic. By default is 'tcp'.
+
+- source -- only match traffic from this IPv4 or IPv6 address or network, in
+CIDR notation. By default traffic from any source is matched.
+*/
+package actions
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/go-debos/debos"
+)
+
+type FirewallRule struct {
+	Port     string
+	Protocol string
+	Source   string
+}
+
+type FirewallAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Backend          string
+	Policy           string
+	Allow            []FirewallRule
+	Deny             []FirewallRule
+}
+
+func NewFirewallAction() *FirewallAction {
+	f := FirewallAction{}
+	f.Backend = "nftables"
+	f.Policy = "drop"
+
+	return &f
+}
+
+// Check the port is a port number or a range of port numbers
+func verifyPortRange(port string) error {
+	var ports []int
+	for _, b := range strings.SplitN(port, "-", 2) {
+		p, err := strconv.Atoi(b)
+		if err != nil || p < 1 || p > 65535 {
+			return fmt.Errorf("Invalid port '%s'", port)
+		}
+		ports = append(ports, p)
+	}
+
+	if len(ports) == 2 && ports[0] >= ports[1] {
+		return fmt.Errorf("Invalid port range '%s'", port)
+	}
+
+	return nil
+}
+
+func (r *FirewallRule) verify() error {
+	if r.Protocol == "" {
+		r.Protocol = "tcp"
+	}
+
+	switch r.Protocol {
+	case "tcp", "udp":
+		if r.Port == "" {
+			return fmt.Errorf("Port is mandatory for protocol '%s'", r.Protocol)
+		}
+		if err := verifyPortRange(r.Port); err != nil {
+			return err
+		}
+	case "all":
+		if r.Port != "" {
+			return fmt.Errorf("Port '%s' can't be used with protocol 'all'", r.Port)
+		}
+	default:
+		return fmt.Errorf("Unsupported protocol '%s'", r.Protocol)
+	}
+
+	if r.Source != "" && r.family() == "" {
+		return fmt.Errorf("Invalid source '%s'", r.Source)
+	}
+
+	return nil
+}
+
+// Returns 'ip' or 'ip6' for the family of the source, empty if invalid
+func (r *FirewallRule) family() string {
+	ip := net.ParseIP(r.Source)
+	if ip == nil {
+		var err error
+		if ip, _, err = net.ParseCIDR(r.Source); err != nil {
+			return ""
+		}
+	}
+
+	if ip.To4() != nil {
+		return "ip"
+	}
+	return "ip6"
+}
+
+func (r *FirewallRule) nftables(verdict string) string {
+	var match []string
+
+	if r.Source != "" {
+		match = append(match, r.family(), "saddr", r.Source)
+	}
+	if r.Protocol == "all" {
+		match = append(match, verdict)
+	} else {
+		match = append(match, r.Protocol, "dport", r.Port, verdict)
+	}
+
+	return strings.Join(match, " ")
+}
+
+// Returns the iptables rule for the family, empty if it doesn't apply
+func (r *FirewallRule) iptables(family, target string) string {
+	match := []string{"-A INPUT"}
+
+	if r.Source != "" {
+		if r.family() != family {
+			return ""
+		}
+		match = append(match, "-s", r.Source)
+	}
+	if r.Protocol != "all" {
+		port := strings.Replace(r.Port, "-", ":", 1)
+		match = append(match, "-p", r.Protocol, "-m", r.Protocol, "--dport", port)
+	}
+	match = append(match, "-j", target)
+
+	return strings.Join(match, " ")
+}
+
+func (f *FirewallAction) Verify(context *debos.DebosContext) error {
+	if f.Backend != "nftables" && f.Backend != "iptables" {
+		return fmt.Errorf("Unsupported backend '%s', expected nftables or iptables", f.Backend)
+	}
+	if f.Policy != "drop" && f.Policy != "accept" {
+		return fmt.Errorf("Unsupported policy '%s', expected drop or accept", f.Policy)
+	}
+
+	for _, rules := range [][]FirewallRule{f.Allow, f.Deny} {
+		for idx := range rules {
+			if err := rules[idx].verify(); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (f *FirewallAction) nftablesRuleset() string {
+	lines := []string{
+		"#!/usr/sbin/nft -f",
+		"# Generated by debos",
+		"flush ruleset",
+		"",
+		"table inet filter {",
+		"\tchain input {",
+		fmt.Sprintf("\t\ttype filter hook input priority 0; policy %s;", f.Policy),
+		"\t\tct state established,related accept",
+		"\t\tct state invalid drop",
+		"\t\tiif lo accept",
+		"\t\tmeta l4proto { icmp, ipv6-icmp } accept",
+	}
+	for _, r := range f.Deny {
+		lines = append(lines, "\t\t"+r.nftables("drop"))
+	}
+	for _, r := range f.Allow {
+		lines = append(lines, "\t\t"+r.nftables("accept"))
+	}
+	lines = append(lines,
+		"\t}",
+		"\tchain forward {",
+		fmt.Sprintf("\t\ttype filter hook forward priority 0; policy %s;", f.Policy),
+		"\t}",
+		"\tchain output {",
+		"\t\ttype filter hook output priority 0; policy accept;",
+		"\t}",
+		"}")
+
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func (f *FirewallAction) iptablesRules(family string) string {
+	policy := strings.ToUpper(f.Policy)
+	icmp := "icmp"
+	if family == "ip6" {
+		icmp = "ipv6-icmp"
+	}
+
+	lines := []string{
+		"# Generated by debos",
+		"*filter",
+		fmt.Sprintf(":INPUT %s [0:0]", policy),
+		fmt.Sprintf(":FORWARD %s [0:0]", policy),
+		":OUTPUT ACCEPT [0:0]",
+		"-A INPUT -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT",
+		"-A INPUT -m conntrack --ctstate INVALID -j DROP",
+		"-A INPUT -i lo -j ACCEPT",
+		fmt.Sprintf("-A INPUT -p %s -j ACCEPT", icmp),
+	}
+	for _, r := range f.Deny {
+		if rule := r.iptables(family, "DROP"); rule != "" {
+			lines = append(lines, rule)
+		}
+	}
+	for _, r := range f.Allow {
+		if rule := r.iptables(family, "ACCEPT"); rule != "" {
+			lines = append(lines, rule)
+		}
+	}
+	lines = append(lines, "COMMIT")
+
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func (f *FirewallAction) configure(context *debos.DebosContext) error {
+	var service string
+	files := map[string]string{}
+	mode := os.FileMode(0640)
+
+	if f.Backend == "nftables" {
+		// Run as a script by nft
+		files["/etc/nftables.conf"] = f.nftablesRuleset()
+		service = "nftables.service"
+		mode = 0755
+	} else {
+		files["/etc/iptables/rules.v4"] = f.iptablesRules("ip")
+		files["/etc/iptables/rules.v6"] = f.iptablesRules("ip6")
+		service = "netfilter-persistent.service"
+	}
+
+	for file, content := range files {
+		target := path.Join(context.Rootdir, file)
+		if err := os.MkdirAll(path.Dir(target), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(target, []byte(content), mode); err != nil {
+			return fmt.Errorf("Couldn't write %s: %v", file, err)
+		}
+	}
+
+	services := debos.SystemdHelper{Rootdir: context.Rootdir}
+	return services.Enable(service)
+}
+
+func (f *FirewallAction) Run(context *debos.DebosContext) error {
+	f.LogStart()
+
+	packages := []string{"nftables"}
+	if f.Backend == "iptables" {
+		packages = []string{"iptables", "iptables-persistent"}
+	}
+	if err := installPackages(context, packages...); err != nil {
+		return err
+	}
+
+	return f.configure(context)
+}
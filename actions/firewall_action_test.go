@@ -0,0 +1,113 @@
+package actions
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/go-debos/debos"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFirewall(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+	context.Rootdir = dir
+	fakeUnit(t, dir, "nftables.service", "WantedBy=sysinit.target")
+	fakeUnit(t, dir, "netfilter-persistent.service", "WantedBy=multi-user.target")
+
+	f := NewFirewallAction()
+	f.Allow = []FirewallRule{
+		{Port: "22"},
+		{Port: "60000-61000", Protocol: "udp"},
+		{Protocol: "all", Source: "192.168.1.0/24"},
+	}
+	f.Deny = []FirewallRule{{Port: "22", Source: "fd00::/8"}}
+	assert.Empty(t, f.Verify(&context))
+	assert.Empty(t, f.configure(&context))
+
+	ruleset, err := ioutil.ReadFile(path.Join(dir, "etc/nftables.conf"))
+	assert.Empty(t, err)
+	assert.Equal(t, `#!/usr/sbin/nft -f
+# Generated by debos
+flush ruleset
+
+table inet filter {
+	chain input {
+		type filter hook input priority 0; policy drop;
+		ct state established,related accept
+		ct state invalid drop
+		iif lo accept
+		meta l4proto { icmp, ipv6-icmp } accept
+		ip6 saddr fd00::/8 tcp dport 22 drop
+		tcp dport 22 accept
+		udp dport 60000-61000 accept
+		ip saddr 192.168.1.0/24 accept
+	}
+	chain forward {
+		type filter hook forward priority 0; policy drop;
+	}
+	chain output {
+		type filter hook output priority 0; policy accept;
+	}
+}
+`, string(ruleset))
+
+	link, err := os.Readlink(path.Join(dir, "etc/systemd/system/sysinit.target.wants/nftables.service"))
+	assert.Empty(t, err)
+	assert.Equal(t, "/lib/systemd/system/nftables.service", link)
+
+	f.Backend = "iptables"
+	f.Policy = "accept"
+	assert.Empty(t, f.Verify(&context))
+	assert.Empty(t, f.configure(&context))
+
+	rules, err := ioutil.ReadFile(path.Join(dir, "etc/iptables/rules.v4"))
+	assert.Empty(t, err)
+	assert.Equal(t, `# Generated by debos
+*filter
+:INPUT ACCEPT [0:0]
+:FORWARD ACCEPT [0:0]
+:OUTPUT ACCEPT [0:0]
+-A INPUT -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT
+-A INPUT -m conntrack --ctstate INVALID -j DROP
+-A INPUT -i lo -j ACCEPT
+-A INPUT -p icmp -j ACCEPT
+-A INPUT -p tcp -m tcp --dport 22 -j ACCEPT
+-A INPUT -p udp -m udp --dport 60000:61000 -j ACCEPT
+-A INPUT -s 192.168.1.0/24 -j ACCEPT
+COMMIT
+`, string(rules))
+
+	rules, err = ioutil.ReadFile(path.Join(dir, "etc/iptables/rules.v6"))
+	assert.Empty(t, err)
+	assert.Contains(t, string(rules), "-A INPUT -p ipv6-icmp -j ACCEPT\n")
+	assert.Contains(t, string(rules), "-A INPUT -s fd00::/8 -p tcp -m tcp --dport 22 -j DROP\n")
+	assert.NotContains(t, string(rules), "192.168.1.0/24")
+
+	_, err = os.Lstat(path.Join(dir, "etc/systemd/system/multi-user.target.wants/netfilter-persistent.service"))
+	assert.Empty(t, err)
+
+	for rule, msg := range map[FirewallRule]string{
+		{}:                                  "Port is mandatory for protocol 'tcp'",
+		{Port: "http"}:                      "Invalid port 'http'",
+		{Port: "70000"}:                     "Invalid port '70000'",
+		{Port: "2000-1000"}:                 "Invalid port range '2000-1000'",
+		{Port: "53", Protocol: "sctp"}:      "Unsupported protocol 'sctp'",
+		{Port: "53", Protocol: "all"}:       "Port '53' can't be used with protocol 'all'",
+		{Port: "22", Source: "example.com"}: "Invalid source 'example.com'",
+	} {
+		f.Allow = []FirewallRule{rule}
+		assert.EqualError(t, f.Verify(&context), msg)
+	}
+
+	f.Allow = nil
+	f.Policy = "reject"
+	assert.EqualError(t, f.Verify(&context), "Unsupported policy 'reject', expected drop or accept")
+	f.Backend = "ufw"
+	assert.EqualError(t, f.Verify(&context), "Unsupported backend 'ufw', expected nftables or iptables")
+}
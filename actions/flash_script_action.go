@@ -0,0 +1,202 @@
+/*
+FlashScript Action
+
+Generate a shell script in the artifact directory which writes the image, or
+only some of its partitions, to a block device. The script knows about the
+partition layout created by the 'image-partition' action, so this action must
+run after it.
+
+Before writing anything the script checks the target is a block device that
+is not mounted and large enough, shows the layout and asks for confirmation.
+The confirmation can be skipped by passing '--yes' as first argument:
+
+ ./flash.sh [--yes] /dev/sdX
+
+Yaml syntax:
+ - action: flash-script
+   image: image_name
+   file: flash.sh
+   partitions:
+     - partition name
+
+Mandatory properties:
+
+- image -- name of the image file in the artifact directory, as given to the
+'image-partition' action. The script expects the image next to it.
+
+Optional properties:
+
+- file -- name of the generated script, relative to the artifact directory.
+By default is 'flash.sh'.
+
+- partitions -- list of partitions to write at their offset on the device,
+for example to update a device already flashed with the same layout. If
+unset, the whole image including the partition table is written.
+*/
+package actions
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/go-debos/debos"
+)
+
+type FlashScriptAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Image            string
+	File             string
+	Partitions       []string
+}
+
+func NewFlashScriptAction() *FlashScriptAction {
+	fs := FlashScriptAction{}
+	fs.File = "flash.sh"
+
+	return &fs
+}
+
+func (fs *FlashScriptAction) Verify(context *debos.DebosContext) error {
+	if len(fs.Image) == 0 {
+		return errors.New("'image' property can't be empty")
+	}
+
+	if path.IsAbs(fs.File) {
+		return fmt.Errorf("Script '%s' must be relative to the artifact directory", fs.File)
+	}
+	if _, err := debos.RestrictedPath(context.Artifactdir, fs.File); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (fs *FlashScriptAction) script(context *debos.DebosContext) (string, error) {
+	var selected []debos.Partition
+
+	if len(context.ImagePartitions) == 0 {
+		return "", errors.New("No partitions found, missing image-partition action?")
+	}
+
+	for _, name := range fs.Partitions {
+		found := false
+		for _, p := range context.ImagePartitions {
+			if p.Name == name {
+				selected = append(selected, p)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return "", fmt.Errorf("Failed to find partition named %s", name)
+		}
+	}
+
+	var s strings.Builder
+	s.WriteString("#!/bin/sh\n")
+	s.WriteString(fmt.Sprintf("# Generated by debos: write %s to a block device\n", fs.Image))
+	s.WriteString("set -e\n\n")
+	s.WriteString(fmt.Sprintf("IMAGE=\"$(dirname \"$0\")/%s\"\n", path.Base(fs.Image)))
+	s.WriteString(`
+YES=0
+if [ "$1" = "--yes" ]; then
+	YES=1
+	shift
+fi
+DEVICE="$1"
+
+if [ -z "$DEVICE" ]; then
+	echo "Usage: $0 [--yes] <device>" >&2
+	exit 1
+fi
+if [ ! -f "$IMAGE" ]; then
+	echo "Image $IMAGE not found" >&2
+	exit 1
+fi
+if [ ! -b "$DEVICE" ]; then
+	echo "$DEVICE is not a block device" >&2
+	exit 1
+fi
+if grep -q "^$DEVICE" /proc/mounts; then
+	echo "$DEVICE or one of its partitions is mounted" >&2
+	exit 1
+fi
+
+`)
+
+	var required int64
+	if len(selected) == 0 {
+		s.WriteString("REQUIRED=$(stat -c %s \"$IMAGE\")\n")
+	} else {
+		for _, p := range selected {
+			if end := p.Offset + p.Size; end > required {
+				required = end
+			}
+		}
+		s.WriteString(fmt.Sprintf("REQUIRED=%d\n", required))
+	}
+	s.WriteString(`if [ "$(blockdev --getsize64 "$DEVICE")" -lt "$REQUIRED" ]; then
+	echo "$DEVICE is too small, at least $REQUIRED bytes are needed" >&2
+	exit 1
+fi
+
+`)
+
+	s.WriteString("echo \"Partition layout of $IMAGE:\"\n")
+	for _, p := range context.ImagePartitions {
+		s.WriteString(fmt.Sprintf("echo \"  %d %s (%s) offset %d size %d\"\n",
+			p.Number, p.Name, p.FS, p.Offset, p.Size))
+	}
+
+	target := "all data on $DEVICE"
+	if len(selected) > 0 {
+		target = fmt.Sprintf("partitions %s on $DEVICE", strings.Join(fs.Partitions, ", "))
+	}
+	s.WriteString(fmt.Sprintf(`
+if [ "$YES" != 1 ]; then
+	printf "%%s will be overwritten, type YES to continue: " "%s"
+	read answer
+	if [ "$answer" != "YES" ]; then
+		echo "Aborted" >&2
+		exit 1
+	fi
+fi
+
+`, strings.ToUpper(target[:1])+target[1:]))
+
+	if len(selected) == 0 {
+		s.WriteString("echo \"Writing $IMAGE to $DEVICE\"\n")
+		s.WriteString("dd if=\"$IMAGE\" of=\"$DEVICE\" bs=4M conv=fsync\n")
+	}
+	for _, p := range selected {
+		s.WriteString(fmt.Sprintf("echo \"Writing partition %s\"\n", p.Name))
+		s.WriteString(fmt.Sprintf("dd if=\"$IMAGE\" of=\"$DEVICE\" bs=4M iflag=skip_bytes,count_bytes oflag=seek_bytes skip=%d seek=%d count=%d conv=notrunc,fsync\n",
+			p.Offset, p.Offset, p.Size))
+	}
+	s.WriteString("sync\n")
+
+	return s.String(), nil
+}
+
+func (fs *FlashScriptAction) Run(context *debos.DebosContext) error {
+	fs.LogStart()
+
+	script, err := fs.script(context)
+	if err != nil {
+		return err
+	}
+
+	file, err := debos.RestrictedPath(context.Artifactdir, fs.File)
+	if err != nil {
+		return err
+	}
+
+	if err = ioutil.WriteFile(file, []byte(script), 0755); err != nil {
+		return fmt.Errorf("Couldn't write flash script: %v", err)
+	}
+
+	return nil
+}
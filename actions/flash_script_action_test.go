@@ -0,0 +1,61 @@
+package actions_test
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+
+	"github.com/go-debos/debos"
+	"github.com/go-debos/debos/actions"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlashScript(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+	context.Artifactdir = dir
+
+	fs := actions.NewFlashScriptAction()
+	fs.Image = "debian.img"
+	assert.Empty(t, fs.Verify(&context))
+	assert.EqualError(t, fs.Run(&context), "No partitions found, missing image-partition action?")
+
+	context.ImagePartitions = []debos.Partition{
+		{Name: "firmware", Number: 1, FS: "vfat", Offset: 1048576, Size: 66060288},
+		{Name: "root", Number: 2, FS: "ext4", Offset: 67108864, Size: 1006632960},
+	}
+
+	// Whole image
+	assert.Empty(t, fs.Run(&context))
+	script, err := ioutil.ReadFile(path.Join(dir, "flash.sh"))
+	assert.Empty(t, err)
+	assert.Contains(t, string(script), `IMAGE="$(dirname "$0")/debian.img"`)
+	assert.Contains(t, string(script), `dd if="$IMAGE" of="$DEVICE" bs=4M conv=fsync`)
+	assert.Contains(t, string(script), `echo "  1 firmware (vfat) offset 1048576 size 66060288"`)
+	assert.Contains(t, string(script), `echo "  2 root (ext4) offset 67108864 size 1006632960"`)
+	assert.Empty(t, exec.Command("sh", "-n", path.Join(dir, "flash.sh")).Run())
+
+	// Single partition at its offset
+	fs.File = "flash-root.sh"
+	fs.Partitions = []string{"root"}
+	assert.Empty(t, fs.Run(&context))
+	script, err = ioutil.ReadFile(path.Join(dir, "flash-root.sh"))
+	assert.Empty(t, err)
+	assert.Contains(t, string(script), "REQUIRED=1073741824\n")
+	assert.Contains(t, string(script),
+		`dd if="$IMAGE" of="$DEVICE" bs=4M iflag=skip_bytes,count_bytes oflag=seek_bytes skip=67108864 seek=67108864 count=1006632960 conv=notrunc,fsync`)
+	assert.NotContains(t, string(script), "skip=1048576")
+	assert.Empty(t, exec.Command("sh", "-n", path.Join(dir, "flash-root.sh")).Run())
+
+	fs.Partitions = []string{"boot"}
+	assert.EqualError(t, fs.Run(&context), "Failed to find partition named boot")
+
+	// Scripts can't be written outside of the artifact directory
+	fs.File = "../flash.sh"
+	assert.Error(t, fs.Verify(&context))
+}
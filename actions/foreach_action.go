@@ -0,0 +1,273 @@
+/*
+Foreach Action
+
+Run an action once per item of a list, for example to install the packages
+of several origins or to run a script per user, rather than repeating the
+action in the recipe.
+
+Yaml syntax:
+ - action: foreach
+   items:
+     - alice
+     - bob
+   items-variable: name
+   variable: item
+   do:
+     action: run
+     chroot: true
+     command: adduser --disabled-password {{`{{ .item }}`}}
+
+Mandatory properties:
+
+- do -- the action to run for each item. Its text properties are Go templates
+rendered with the item as '{{ .item }}', its position in the list from 0 as
+'{{ .index }}' and the template variables of the recipe. As the recipe is a
+template too, the actions of these templates have to be quoted to be left to
+this action, like '{{`{{ .item }}`}}'.
+
+- items -- list of items. Mandatory unless 'items-variable' is set.
+
+- items-variable -- name of a variable set by a previous action, like the
+'capture' of a 'run' action, holding the white space separated items, instead
+of 'items'. As the items are only known while the build runs, the actions are
+then created, checked and run one after the other by the main stage of the
+action: actions with work to do on the host before or after the fake machine,
+like the 'postprocess' of a 'run' action, aren't supported.
+
+Optional properties:
+
+- variable -- name of the variable holding the item. By default 'item'.
+
+The action fails at the first failing item, with the item it failed for.
+*/
+package actions
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/go-debos/debos"
+	"github.com/go-debos/fakemachine"
+	"gopkg.in/yaml.v2"
+)
+
+type ForeachAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Items            []string
+	ItemsVariable    string `yaml:"items-variable"`
+	Variable         string
+	Do               yaml.MapSlice
+	items            []string // Items of the actions, once resolved
+	actions          []YamlAction
+	templateVars     map[string]string
+}
+
+func NewForeachAction() *ForeachAction {
+	return &ForeachAction{Variable: "item"}
+}
+
+// Render the text of the property with the variables
+func renderForeachValue(value interface{}, funcs template.FuncMap, data map[string]string) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		t, err := template.New("foreach").Funcs(funcs).Option("missingkey=error").Parse(v)
+		if err != nil {
+			return nil, err
+		}
+		var out bytes.Buffer
+		if err := t.Execute(&out, data); err != nil {
+			return nil, err
+		}
+		return out.String(), nil
+	case yaml.MapSlice:
+		rendered := yaml.MapSlice{}
+		for _, item := range v {
+			r, err := renderForeachValue(item.Value, funcs, data)
+			if err != nil {
+				return nil, err
+			}
+			rendered = append(rendered, yaml.MapItem{Key: item.Key, Value: r})
+		}
+		return rendered, nil
+	case []interface{}:
+		var rendered []interface{}
+		for _, item := range v {
+			r, err := renderForeachValue(item, funcs, data)
+			if err != nil {
+				return nil, err
+			}
+			rendered = append(rendered, r)
+		}
+		return rendered, nil
+	}
+
+	return value, nil
+}
+
+// Create the action of the item
+func (f *ForeachAction) instantiate(index int, item string) (YamlAction, error) {
+	var a YamlAction
+
+	data := map[string]string{}
+	for k, v := range f.templateVars {
+		data[k] = v
+	}
+	data["index"] = fmt.Sprint(index)
+	data[f.Variable] = item
+
+	rendered, err := renderForeachValue(f.Do, template.FuncMap{"sector": sector}, data)
+	if err != nil {
+		return a, err
+	}
+	out, err := yaml.Marshal(rendered)
+	if err != nil {
+		return a, err
+	}
+	if err := yaml.Unmarshal(out, &a); err != nil {
+		return a, err
+	}
+
+	switch action := a.Action.(type) {
+	case *IncludeAction:
+		return a, errors.New("'include' actions can't be repeated, use a 'recipe' action")
+	case *RecipeAction:
+		action.parentVars = f.templateVars
+	case *TemplateFileAction:
+		action.templateVars = f.templateVars
+	case *ForeachAction:
+		action.templateVars = f.templateVars
+	}
+
+	return a, nil
+}
+
+// Create and check the actions of the items
+func (f *ForeachAction) instantiateAll(context *debos.DebosContext, items []string) error {
+	f.items = items
+	f.actions = nil
+	for idx, item := range items {
+		a, err := f.instantiate(idx, item)
+		if err == nil {
+			err = a.Verify(context)
+		}
+		if err != nil {
+			return fmt.Errorf("Item %d '%s': %v", idx, item, err)
+		}
+		f.actions = append(f.actions, a)
+	}
+
+	return nil
+}
+
+func (f *ForeachAction) Verify(context *debos.DebosContext) error {
+	if len(f.Do) == 0 {
+		return errors.New("'do' property can't be empty")
+	}
+	if len(f.Items) > 0 && len(f.ItemsVariable) > 0 {
+		return errors.New("'items' and 'items-variable' properties can't be used together")
+	}
+	if len(f.Items) == 0 && len(f.ItemsVariable) == 0 {
+		return errors.New("'items' or 'items-variable' property is mandatory")
+	}
+	for _, v := range []string{f.Variable, f.ItemsVariable} {
+		if v != "" && !variableName.MatchString(v) {
+			return fmt.Errorf("Invalid variable name '%s'", v)
+		}
+	}
+	if f.Variable == "" || f.Variable == "index" {
+		return fmt.Errorf("Invalid variable name '%s'", f.Variable)
+	}
+
+	if len(f.Items) > 0 {
+		return f.instantiateAll(context, f.Items)
+	}
+
+	// Catch the errors of the template before the build
+	_, err := f.instantiate(0, "")
+	return err
+}
+
+func (f *ForeachAction) PreMachine(context *debos.DebosContext, m *fakemachine.Machine, args *[]string) error {
+	for _, a := range f.actions {
+		if err := a.PreMachine(context, m, args); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (f *ForeachAction) PreNoMachine(context *debos.DebosContext) error {
+	for _, a := range f.actions {
+		if err := a.PreNoMachine(context); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (f *ForeachAction) DryRun(context *debos.DebosContext) error {
+	for _, a := range f.actions {
+		if err := a.DryRun(context); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (f *ForeachAction) Run(context *debos.DebosContext) error {
+	f.LogStart()
+
+	if len(f.ItemsVariable) > 0 {
+		value, found := context.Variables[f.ItemsVariable]
+		if !found {
+			return fmt.Errorf("Variable '%s' isn't set", f.ItemsVariable)
+		}
+		if err := f.instantiateAll(context, strings.Fields(value)); err != nil {
+			return err
+		}
+	}
+
+	for idx, a := range f.actions {
+		if err := debos.RunAction(context, a.Action); err != nil {
+			return fmt.Errorf("Item %d '%s': %v", idx, f.items[idx], err)
+		}
+	}
+
+	return nil
+}
+
+func (f *ForeachAction) Cleanup(context *debos.DebosContext) error {
+	for _, a := range f.actions {
+		if err := a.Cleanup(context); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (f *ForeachAction) PostMachine(context *debos.DebosContext) error {
+	for idx, a := range f.actions {
+		if err := a.PostMachine(context); err != nil {
+			return fmt.Errorf("Item %d '%s': %v", idx, f.items[idx], err)
+		}
+	}
+
+	return nil
+}
+
+func (f *ForeachAction) PostMachineCleanup(context *debos.DebosContext) error {
+	for _, a := range f.actions {
+		if err := a.PostMachineCleanup(context); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
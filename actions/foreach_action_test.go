@@ -0,0 +1,77 @@
+package actions
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/go-debos/debos"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+func TestForeach(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	context := debos.DebosContext{&debos.CommonContext{}, dir, "arm64"}
+	context.Artifactdir = dir
+	context.Variables = map[string]string{}
+
+	f := NewForeachAction()
+	assert.Empty(t, yaml.Unmarshal([]byte(`
+items: [ alice, bob ]
+do:
+  action: run
+  command: echo '{{ .index }} {{ .user }} {{ .suite }}' >> "$ARTIFACTDIR/users"
+  env:
+    NAME: "{{ .user }}"
+`), f))
+	f.Variable = "user"
+	f.templateVars = map[string]string{"suite": "trixie"}
+	assert.Empty(t, f.Verify(&context))
+	assert.Empty(t, f.Run(&context))
+
+	users, err := ioutil.ReadFile(path.Join(dir, "users"))
+	assert.Empty(t, err)
+	assert.Equal(t, "0 alice trixie\n1 bob trixie\n", string(users))
+	assert.Equal(t, "bob", f.actions[1].Action.(*RunAction).Env["NAME"])
+
+	// The items of a variable, the failing item is reported
+	f = NewForeachAction()
+	assert.Empty(t, yaml.Unmarshal([]byte(`
+items-variable: files
+do:
+  action: run
+  command: test -e "$ARTIFACTDIR/{{ .item }}"
+`), f))
+	assert.Empty(t, f.Verify(&context))
+	context.Variables["files"] = "users\nmissing"
+	assert.EqualError(t, f.Run(&context), "Item 1 'missing': exit status 1")
+
+	// Same for the postprocessing, run in the same process without fakemachine
+	f = NewForeachAction()
+	assert.Empty(t, yaml.Unmarshal([]byte(`
+items-variable: files
+do:
+  action: run
+  postprocess: true
+  command: test -e "`+dir+`/{{ .item }}"
+`), f))
+	assert.Empty(t, f.Verify(&context))
+	assert.Empty(t, f.Run(&context))
+	assert.EqualError(t, f.PostMachine(&context), "Item 1 'missing': exit status 1")
+
+	// Undefined variables
+	f = NewForeachAction()
+	f.Items = []string{"a"}
+	assert.Empty(t, yaml.Unmarshal([]byte("{action: run, command: '{{ .unknown }}'}"), &f.Do))
+	err = f.Verify(&context)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "Item 0 'a'")
+
+	f.Do = nil
+	assert.EqualError(t, f.Verify(&context), "'do' property can't be empty")
+}
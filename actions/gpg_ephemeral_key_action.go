@@ -0,0 +1,168 @@
+/*
+GpgEphemeralKey Action
+
+Generate a throwaway GPG key pair to sign the artifacts of a single build,
+without keeping a signing key around. The key pair is generated in a GnuPG
+home directory of the scratch space, which is removed at the end of the build,
+and only the public key is exported to the artifact directory, so the
+artifacts can be verified with it.
+
+The following 'apt-repository' and 'ostree-commit' actions without
+'gpg-homedir' use the home directory of the key, naming it by its user id in
+'gpg-sign'. The fingerprint of the key and its home directory are also stored
+in variables, available to the following 'run' actions as environment
+variables.
+
+Yaml syntax:
+ - action: gpg-ephemeral-key
+   uid: debos ephemeral key <debos@localhost>
+   algorithm: ed25519
+   public-key: ephemeral-key.asc
+   key-variable: gpg_key
+   homedir-variable: gpg_homedir
+
+Optional properties:
+
+- uid -- user id of the key. By default is 'debos ephemeral key <debos@localhost>'.
+
+- algorithm -- algorithm of the key, as accepted by 'gpg --quick-generate-key'.
+By default is 'ed25519'.
+
+- public-key -- name of the armored public key exported to the artifact
+directory. By default is 'ephemeral-key.asc'.
+
+- key-variable -- name of the variable the fingerprint of the key is stored in.
+By default is 'gpg_key'.
+
+- homedir-variable -- name of the variable the GnuPG home directory of the key
+is stored in. By default is 'gpg_homedir'.
+*/
+package actions
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	"github.com/go-debos/debos"
+)
+
+type GpgEphemeralKeyAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Uid              string
+	Algorithm        string
+	PublicKey        string `yaml:"public-key"`
+	KeyVariable      string `yaml:"key-variable"`
+	HomedirVariable  string `yaml:"homedir-variable"`
+	homedir          string
+}
+
+func NewGpgEphemeralKeyAction() *GpgEphemeralKeyAction {
+	return &GpgEphemeralKeyAction{
+		Uid:             "debos ephemeral key <debos@localhost>",
+		Algorithm:       "ed25519",
+		PublicKey:       "ephemeral-key.asc",
+		KeyVariable:     "gpg_key",
+		HomedirVariable: "gpg_homedir",
+	}
+}
+
+func (g *GpgEphemeralKeyAction) Verify(context *debos.DebosContext) error {
+	if len(g.Uid) == 0 {
+		return fmt.Errorf("'uid' property can't be empty")
+	}
+	if len(g.PublicKey) == 0 || path.Base(g.PublicKey) != g.PublicKey {
+		return fmt.Errorf("Invalid public-key name '%s'", g.PublicKey)
+	}
+	for _, v := range []string{g.KeyVariable, g.HomedirVariable} {
+		if !variableName.MatchString(v) {
+			return fmt.Errorf("Invalid variable name '%s'", v)
+		}
+	}
+	return nil
+}
+
+// Run gpg on the home directory of the key, its output is only shown on errors
+func (g *GpgEphemeralKeyAction) gpg(args ...string) ([]byte, error) {
+	cmdline := append([]string{"--batch", "--homedir", g.homedir}, args...)
+	out, err := exec.Command("gpg", cmdline...).Output()
+	if err != nil {
+		if exit, ok := err.(*exec.ExitError); ok {
+			return nil, fmt.Errorf("gpg failed: %v\n%s", err, exit.Stderr)
+		}
+		return nil, err
+	}
+	return out, nil
+}
+
+// Fingerprint of the primary key from the 'gpg --with-colons' output
+func keyFingerprint(listing string) (string, error) {
+	primary := false
+	for _, line := range strings.Split(listing, "\n") {
+		fields := strings.Split(line, ":")
+		switch {
+		case fields[0] == "sec":
+			primary = true
+		case fields[0] == "fpr" && primary && len(fields) > 9:
+			return fields[9], nil
+		case fields[0] == "ssb":
+			primary = false
+		}
+	}
+	return "", fmt.Errorf("No fingerprint found for the generated key")
+}
+
+func (g *GpgEphemeralKeyAction) Run(context *debos.DebosContext) error {
+	g.LogStart()
+
+	var err error
+	g.homedir, err = ioutil.TempDir(context.Scratchdir, "gnupg-")
+	if err != nil {
+		return err
+	}
+
+	_, err = g.gpg("--passphrase", "", "--quick-generate-key", g.Uid, g.Algorithm, "sign", "never")
+	if err != nil {
+		return err
+	}
+
+	listing, err := g.gpg("--with-colons", "--list-secret-keys", g.Uid)
+	if err != nil {
+		return err
+	}
+	fingerprint, err := keyFingerprint(string(listing))
+	if err != nil {
+		return err
+	}
+
+	public, err := g.gpg("--armor", "--export", fingerprint)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path.Join(context.Artifactdir, g.PublicKey), public, 0644); err != nil {
+		return err
+	}
+
+	context.GpgHomedir = g.homedir
+	context.Variables[g.KeyVariable] = fingerprint
+	context.Variables[g.HomedirVariable] = g.homedir
+	log.Printf("Generated ephemeral key %s, public key exported to %s", fingerprint, g.PublicKey)
+
+	return nil
+}
+
+// Stop the agent and forget the secret key at the end of the build
+func (g *GpgEphemeralKeyAction) Cleanup(context *debos.DebosContext) error {
+	if g.homedir == "" {
+		return nil
+	}
+	exec.Command("gpgconf", "--homedir", g.homedir, "--kill", "all").Run()
+	if context.GpgHomedir == g.homedir {
+		context.GpgHomedir = ""
+	}
+	return os.RemoveAll(g.homedir)
+}
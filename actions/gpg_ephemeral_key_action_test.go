@@ -0,0 +1,79 @@
+package actions_test
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/go-debos/debos"
+	"github.com/go-debos/debos/actions"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGpgEphemeralKey(t *testing.T) {
+	if _, err := exec.LookPath("gpg"); err != nil {
+		t.Skip("gpg not available")
+	}
+
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+	context.Scratchdir = path.Join(dir, "scratch")
+	context.Artifactdir = path.Join(dir, "artifacts")
+	context.Rootdir = path.Join(dir, "root")
+	context.Variables = map[string]string{}
+	for _, d := range []string{context.Scratchdir, context.Artifactdir, context.Rootdir} {
+		assert.Empty(t, os.MkdirAll(d, 0755))
+	}
+
+	g := actions.NewGpgEphemeralKeyAction()
+	assert.Empty(t, g.Verify(&context))
+	assert.Empty(t, g.Run(&context))
+
+	fingerprint := context.Variables["gpg_key"]
+	assert.Equal(t, 40, len(fingerprint))
+	assert.Equal(t, context.GpgHomedir, context.Variables["gpg_homedir"])
+	assert.True(t, strings.HasPrefix(context.GpgHomedir, context.Scratchdir+"/"))
+
+	// Only the public key is exported
+	public, err := ioutil.ReadFile(path.Join(context.Artifactdir, "ephemeral-key.asc"))
+	assert.Empty(t, err)
+	assert.Contains(t, string(public), "BEGIN PGP PUBLIC KEY BLOCK")
+	assert.NotContains(t, string(public), "PRIVATE")
+
+	// Signed with the ephemeral key, verified with the exported public key
+	artifact := path.Join(context.Artifactdir, "image.img")
+	assert.Empty(t, ioutil.WriteFile(artifact, []byte("image"), 0644))
+	runTool(t, "gpg", "--batch", "--homedir", context.GpgHomedir, "--local-user", "debos ephemeral key",
+		"--detach-sign", "--output", artifact+".sig", artifact)
+
+	verifier := path.Join(dir, "verifier")
+	assert.Empty(t, os.Mkdir(verifier, 0700))
+	defer exec.Command("gpgconf", "--homedir", verifier, "--kill", "all").Run()
+	runTool(t, "gpg", "--batch", "--homedir", verifier, "--import", path.Join(context.Artifactdir, "ephemeral-key.asc"))
+	runTool(t, "gpg", "--batch", "--homedir", verifier, "--verify", artifact+".sig", artifact)
+	out, _ := exec.Command("gpg", "--batch", "--homedir", verifier, "--list-secret-keys").Output()
+	assert.Empty(t, strings.TrimSpace(string(out)))
+
+	// Nothing lands in the rootfs, and the key is gone after the build
+	entries, err := ioutil.ReadDir(context.Rootdir)
+	assert.Empty(t, err)
+	assert.Len(t, entries, 0)
+	homedir := context.GpgHomedir
+	assert.Empty(t, g.Cleanup(&context))
+	_, err = os.Stat(homedir)
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, "", context.GpgHomedir)
+
+	g = actions.NewGpgEphemeralKeyAction()
+	g.PublicKey = "../key.asc"
+	assert.EqualError(t, g.Verify(&context), "Invalid public-key name '../key.asc'")
+	g = actions.NewGpgEphemeralKeyAction()
+	g.KeyVariable = "gpg-key"
+	assert.EqualError(t, g.Verify(&context), "Invalid variable name 'gpg-key'")
+}
@@ -0,0 +1,183 @@
+/*
+Grub Action
+
+Install grub to the image and generate its configuration, from the target
+rootfs once the partitions of the image are mounted by the 'image-partition'
+action and the rootfs deployed by the 'filesystem-deploy' action. The grub
+packages of the target, like 'grub-efi-amd64' or 'grub-pc', have to be
+installed.
+
+Yaml syntax:
+ - action: grub
+   target: efi
+   efi-directory: /boot/efi
+   removable: bool
+   cmdline: arguments
+
+Optional properties:
+
+- target -- 'efi' to install grub to the EFI system partition mounted on
+'efi-directory', or 'bios' to install it to the boot sector of the image. By
+default 'efi'.
+
+- efi-directory -- mount point of the EFI system partition in the target
+rootfs. By default '/boot/efi'.
+
+- removable -- install grub to the fallback path of the EFI system partition,
+like '/EFI/BOOT/BOOTX64.EFI', which the firmware boots without an entry of its
+own, 'true' by default. The entries of the firmware of the build machine are
+never modified.
+
+- cmdline -- additional arguments of the kernel command line, set as
+'GRUB_CMDLINE_LINUX' in '/etc/default/grub' of the target rootfs.
+
+The 'efi' target is supported for the 'amd64', 'arm64' and 'i386'
+architectures, the 'bios' one for the 'amd64' and 'i386' architectures.
+Once installed, the configuration of grub is generated with 'update-grub'.
+*/
+package actions
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/go-debos/debos"
+)
+
+// Targets of grub-install per architecture of the recipe
+var grubEfiTargets = map[string]string{
+	"amd64": "x86_64-efi",
+	"arm64": "arm64-efi",
+	"i386":  "i386-efi",
+}
+
+var grubBiosTargets = map[string]string{
+	"amd64": "i386-pc",
+	"i386":  "i386-pc",
+}
+
+const grubDefault = "/etc/default/grub"
+
+var grubCmdlineLinux = regexp.MustCompile(`(?m)^GRUB_CMDLINE_LINUX=.*$`)
+
+type GrubAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Target           string
+	EfiDirectory     string `yaml:"efi-directory"`
+	Removable        bool
+	Cmdline          string
+}
+
+func NewGrubAction() *GrubAction {
+	return &GrubAction{Target: "efi", EfiDirectory: "/boot/efi", Removable: true}
+}
+
+func (g *GrubAction) grubTarget(architecture string) (string, bool) {
+	if g.Target == "bios" {
+		t, found := grubBiosTargets[architecture]
+		return t, found
+	}
+	t, found := grubEfiTargets[architecture]
+	return t, found
+}
+
+func (g *GrubAction) Verify(context *debos.DebosContext) error {
+	if g.Target != "efi" && g.Target != "bios" {
+		return fmt.Errorf("Unknown grub target '%s'", g.Target)
+	}
+	if g.Target == "efi" && !path.IsAbs(g.EfiDirectory) {
+		return errors.New("'efi-directory' property must be an absolute path")
+	}
+	if strings.ContainsAny(g.Cmdline, "\"\n") {
+		return errors.New("'cmdline' property can't contain quotes or new lines")
+	}
+	if _, found := g.grubTarget(context.Architecture); !found {
+		return fmt.Errorf("Grub target '%s' isn't supported for architecture %s", g.Target, context.Architecture)
+	}
+
+	return nil
+}
+
+// Whether the directory is the mount point of a file system
+func isMountpoint(dir string) (bool, error) {
+	var st, parent syscall.Stat_t
+	if err := syscall.Stat(dir, &st); err != nil {
+		return false, err
+	}
+	if err := syscall.Stat(path.Join(dir, ".."), &parent); err != nil {
+		return false, err
+	}
+	return st.Dev != parent.Dev || st.Ino == parent.Ino, nil
+}
+
+// Set the arguments of the kernel command line in the defaults of grub
+func setGrubCmdline(content, cmdline string) string {
+	line := "GRUB_CMDLINE_LINUX=" + strconv.Quote(cmdline)
+	if grubCmdlineLinux.MatchString(content) {
+		return grubCmdlineLinux.ReplaceAllLiteralString(content, line)
+	}
+	if len(content) > 0 && !strings.HasSuffix(content, "\n") {
+		content += "\n"
+	}
+	return content + line + "\n"
+}
+
+func (g *GrubAction) setCmdline(context *debos.DebosContext) error {
+	file := path.Join(context.Rootdir, grubDefault)
+	content, err := ioutil.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.MkdirAll(path.Dir(file), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, []byte(setGrubCmdline(string(content), g.Cmdline)), 0644)
+}
+
+func (g *GrubAction) Run(context *debos.DebosContext) error {
+	g.LogStart()
+
+	if context.Image == "" {
+		return errors.New("No image to install grub to, run an 'image-partition' action first")
+	}
+
+	target, _ := g.grubTarget(context.Architecture)
+	cmdline := []string{"grub-install", "--target=" + target}
+
+	if g.Target == "efi" {
+		mounted, err := isMountpoint(path.Join(context.Rootdir, g.EfiDirectory))
+		if err != nil || !mounted {
+			return fmt.Errorf("The EFI system partition isn't mounted on %s", g.EfiDirectory)
+		}
+		cmdline = append(cmdline, "--efi-directory="+g.EfiDirectory, "--no-nvram")
+		if g.Removable {
+			cmdline = append(cmdline, "--removable")
+		}
+	} else {
+		device, err := debos.RealPath(context.Image)
+		if err != nil {
+			return err
+		}
+		cmdline = append(cmdline, device)
+	}
+
+	if g.Cmdline != "" {
+		if err := g.setCmdline(context); err != nil {
+			return err
+		}
+	}
+
+	c := debos.NewChrootCommandForContext(*context)
+	if err := c.Run("grub-install", cmdline...); err != nil {
+		return err
+	}
+
+	return c.Run("update-grub", "update-grub")
+}
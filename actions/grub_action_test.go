@@ -0,0 +1,57 @@
+package actions
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/go-debos/debos"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGrubVerify(t *testing.T) {
+	context := debos.DebosContext{&debos.CommonContext{}, "", "amd64"}
+
+	g := NewGrubAction()
+	assert.Empty(t, g.Verify(&context))
+	g.Target = "bios"
+	assert.Empty(t, g.Verify(&context))
+
+	context.Architecture = "arm64"
+	assert.EqualError(t, g.Verify(&context), "Grub target 'bios' isn't supported for architecture arm64")
+	g.Target = "efi"
+	assert.Empty(t, g.Verify(&context))
+
+	g.Target = "uefi"
+	assert.EqualError(t, g.Verify(&context), "Unknown grub target 'uefi'")
+
+	g.Target = "efi"
+	g.Cmdline = "quiet init=\"/bin/sh\""
+	assert.EqualError(t, g.Verify(&context), "'cmdline' property can't contain quotes or new lines")
+}
+
+func TestSetGrubCmdline(t *testing.T) {
+	assert.Equal(t, "GRUB_CMDLINE_LINUX=\"quiet\"\n", setGrubCmdline("", "quiet"))
+	assert.Equal(t, "GRUB_TIMEOUT=5\nGRUB_CMDLINE_LINUX=\"quiet\"\n",
+		setGrubCmdline("GRUB_TIMEOUT=5", "quiet"))
+	assert.Equal(t, "GRUB_TIMEOUT=5\nGRUB_CMDLINE_LINUX=\"console=ttyS0 quiet\"\n#GRUB_CMDLINE_LINUX=\"\"\n",
+		setGrubCmdline("GRUB_TIMEOUT=5\nGRUB_CMDLINE_LINUX=\"\"\n#GRUB_CMDLINE_LINUX=\"\"\n", "console=ttyS0 quiet"))
+}
+
+func TestIsMountpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grub")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	mounted, err := isMountpoint(dir)
+	assert.Empty(t, err)
+	assert.False(t, mounted)
+
+	mounted, err = isMountpoint("/")
+	assert.Empty(t, err)
+	assert.True(t, mounted)
+
+	_, err = isMountpoint(path.Join(dir, "missing"))
+	assert.Error(t, err)
+}
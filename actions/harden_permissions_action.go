@@ -0,0 +1,233 @@
+/*
+HardenPermissions Action
+
+Enforce strict permissions on the sensitive files of the target rootfs, like
+the password hashes, the sudo configuration and the private keys, which can
+be loosened by mistake by the 'overlay' and 'run' actions. The permissions are
+fixed, then checked, and the action fails if a file can't be fixed.
+
+The modes of the policy are the maximum ones: the permissions of a file which
+aren't part of the mode are removed, so a file can be stricter than its
+policy. The owner and group are set as is.
+
+By default the following policy is applied, for the files which exist:
+
+ /etc/shadow, /etc/shadow-, /etc/gshadow, /etc/gshadow-  0640 root:shadow
+ /etc/sudoers, /etc/sudoers.d/*                          0440 root:root
+ /etc/ssh/ssh_host_*_key                                 0600 root:root
+ /etc/ssl/private                                        0710 root
+ /etc/ssl/private/*                                      0640 root
+ /root                                                   0700 root:root
+
+Yaml syntax:
+ - action: harden-permissions
+   default-policy: true
+   policy:
+     - path: /etc/app/secret.key
+       mode: "0600"
+       owner: app
+       group: app
+
+Optional properties:
+
+- default-policy -- apply the default policy. By default is 'true'.
+
+- policy -- list of additional files, each with the properties below. An entry
+with the same path as one of the default policy replaces it.
+
+Properties of the policy entries:
+
+- path -- absolute path of the files in the target rootfs. Shell glob patterns
+are supported. Mandatory.
+
+- mode -- maximum mode of the files, as an octal string. Mandatory.
+
+- owner -- user owning the files, either a name of the target rootfs or an id.
+
+- group -- group owning the files, either a name of the target rootfs or an id.
+
+Symbolic links are never changed.
+*/
+package actions
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/go-debos/debos"
+)
+
+type PermissionPolicy struct {
+	Path  string
+	Mode  string
+	Owner string
+	Group string
+}
+
+var defaultPermissionPolicy = []PermissionPolicy{
+	{"/etc/shadow", "0640", "root", "shadow"},
+	{"/etc/shadow-", "0640", "root", "shadow"},
+	{"/etc/gshadow", "0640", "root", "shadow"},
+	{"/etc/gshadow-", "0640", "root", "shadow"},
+	{"/etc/sudoers", "0440", "root", "root"},
+	{"/etc/sudoers.d/*", "0440", "root", "root"},
+	{"/etc/ssh/ssh_host_*_key", "0600", "root", "root"},
+	{"/etc/ssl/private", "0710", "root", ""},
+	{"/etc/ssl/private/*", "0640", "root", ""},
+	{"/root", "0700", "root", "root"},
+}
+
+type HardenPermissionsAction struct {
+	debos.BaseAction `yaml:",inline"`
+	DefaultPolicy    bool `yaml:"default-policy"`
+	Policy           []PermissionPolicy
+}
+
+func NewHardenPermissionsAction() *HardenPermissionsAction {
+	return &HardenPermissionsAction{DefaultPolicy: true}
+}
+
+func (h *HardenPermissionsAction) Verify(context *debos.DebosContext) error {
+	if !h.DefaultPolicy && len(h.Policy) == 0 {
+		return errors.New("No policy to apply, 'default-policy' or 'policy' must be set")
+	}
+
+	for _, p := range h.Policy {
+		if !path.IsAbs(p.Path) {
+			return fmt.Errorf("Policy path '%s' must be an absolute path", p.Path)
+		}
+		if _, err := filepath.Match(p.Path, ""); err != nil {
+			return fmt.Errorf("Invalid pattern '%s': %v", p.Path, err)
+		}
+		if len(p.Mode) == 0 {
+			return fmt.Errorf("Policy of '%s' must set 'mode'", p.Path)
+		}
+		if _, err := parseOverlayMode(p.Mode); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Returns the policy to apply, the entries of the recipe replacing the default ones
+func (h *HardenPermissionsAction) policy() []PermissionPolicy {
+	var policy []PermissionPolicy
+
+	if h.DefaultPolicy {
+		for _, d := range defaultPermissionPolicy {
+			replaced := false
+			for _, p := range h.Policy {
+				if p.Path == d.Path {
+					replaced = true
+					break
+				}
+			}
+			if !replaced {
+				policy = append(policy, d)
+			}
+		}
+	}
+
+	return append(policy, h.Policy...)
+}
+
+// Fix the permissions of the file, returns whether they were changed
+func hardenFile(file string, mode os.FileMode, uid, gid int) (bool, error) {
+	info, err := os.Lstat(file)
+	if err != nil {
+		return false, err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		return false, nil
+	}
+
+	changed := false
+	current := info.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	if current&^mode != 0 {
+		if err := os.Chmod(file, current&mode); err != nil {
+			return false, err
+		}
+		changed = true
+	}
+
+	stat := info.Sys().(*syscall.Stat_t)
+	if (uid >= 0 && int(stat.Uid) != uid) || (gid >= 0 && int(stat.Gid) != gid) {
+		if err := os.Lchown(file, uid, gid); err != nil {
+			return false, err
+		}
+		changed = true
+		// Changing the owner drops the setuid and setgid bits
+		if err := os.Chmod(file, current&mode); err != nil {
+			return false, err
+		}
+	}
+
+	// Check the permissions are really the expected ones
+	info, err = os.Lstat(file)
+	if err != nil {
+		return false, err
+	}
+	stat = info.Sys().(*syscall.Stat_t)
+	if info.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)&^mode != 0 ||
+		(uid >= 0 && int(stat.Uid) != uid) || (gid >= 0 && int(stat.Gid) != gid) {
+		return false, fmt.Errorf("permissions are still %v %d:%d", info.Mode(), stat.Uid, stat.Gid)
+	}
+
+	return changed, nil
+}
+
+func (h *HardenPermissionsAction) harden(context *debos.DebosContext) error {
+	var fixed []string
+
+	for _, p := range h.policy() {
+		mode, _ := parseOverlayMode(p.Mode)
+		uid, gid := -1, -1
+
+		matches, err := filepath.Glob(path.Join(context.Rootdir, p.Path))
+		if err != nil {
+			return err
+		}
+		if len(matches) == 0 {
+			continue
+		}
+
+		if len(p.Owner) > 0 {
+			if uid, err = lookupTargetID(context.Rootdir, "passwd", p.Owner); err != nil {
+				return fmt.Errorf("Couldn't fix the owner of %s: %v", p.Path, err)
+			}
+		}
+		if len(p.Group) > 0 {
+			if gid, err = lookupTargetID(context.Rootdir, "group", p.Group); err != nil {
+				return fmt.Errorf("Couldn't fix the group of %s: %v", p.Path, err)
+			}
+		}
+
+		for _, m := range matches {
+			name := "/" + strings.TrimPrefix(m[len(context.Rootdir):], "/")
+			changed, err := hardenFile(m, mode, uid, gid)
+			if err != nil {
+				return fmt.Errorf("Couldn't fix the permissions of %s: %v", name, err)
+			}
+			if changed {
+				fixed = append(fixed, name)
+			}
+		}
+	}
+
+	if len(fixed) > 0 {
+		log.Printf("Fixed the permissions of %s", strings.Join(fixed, ", "))
+	}
+	return nil
+}
+
+func (h *HardenPermissionsAction) Run(context *debos.DebosContext) error {
+	h.LogStart()
+	return h.harden(context)
+}
@@ -0,0 +1,92 @@
+package actions_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+
+	"github.com/go-debos/debos"
+	"github.com/go-debos/debos/actions"
+	"github.com/stretchr/testify/assert"
+)
+
+func assertPermissions(t *testing.T, file string, mode os.FileMode, uid, gid uint32) {
+	info, err := os.Lstat(file)
+	assert.Empty(t, err)
+	assert.Equal(t, mode, info.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky), file)
+	stat := info.Sys().(*syscall.Stat_t)
+	assert.Equal(t, uid, stat.Uid, file)
+	assert.Equal(t, gid, stat.Gid, file)
+}
+
+func TestHardenPermissions(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Changing the owners requires root")
+	}
+
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+	context.Rootdir = dir
+
+	writeRootfsFile(t, dir, "etc/passwd", "root:x:0:0::/root:/bin/sh\napp:x:1000:1000::/srv/app:/bin/sh\n")
+	writeRootfsFile(t, dir, "etc/group", "root:x:0:\nshadow:x:42:\napp:x:1000:\n")
+
+	// Deliberately loosened
+	for file, mode := range map[string]os.FileMode{
+		"etc/shadow":                       0666,
+		"etc/gshadow":                      0644,
+		"etc/sudoers":                      0644,
+		"etc/sudoers.d/admins":             0600,
+		"etc/ssh/ssh_host_ed25519_key":     0644,
+		"etc/ssh/ssh_host_ed25519_key.pub": 0644,
+		"etc/ssl/private/server.key":       0644,
+		"srv/app/secret":                   0755 | os.ModeSetuid,
+	} {
+		writeRootfsFile(t, dir, file, file)
+		assert.Empty(t, os.Chmod(path.Join(dir, file), mode))
+		assert.Empty(t, os.Chown(path.Join(dir, file), 1000, 1000))
+	}
+	assert.Empty(t, os.Chmod(path.Join(dir, "etc/ssl/private"), 0755))
+	assert.Empty(t, os.Symlink("/etc/hostname", path.Join(dir, "etc/sudoers.d/link")))
+
+	h := actions.NewHardenPermissionsAction()
+	h.Policy = []actions.PermissionPolicy{
+		{Path: "/srv/app/*", Mode: "0640", Owner: "app", Group: "app"},
+		// Replaces the default policy
+		{Path: "/etc/ssl/private/*", Mode: "0600", Owner: "0"},
+	}
+	assert.Empty(t, h.Verify(&context))
+	assert.Empty(t, h.Run(&context))
+
+	assertPermissions(t, path.Join(dir, "etc/shadow"), 0640, 0, 42)
+	assertPermissions(t, path.Join(dir, "etc/gshadow"), 0640, 0, 42)
+	assertPermissions(t, path.Join(dir, "etc/sudoers"), 0440, 0, 0)
+	// Stricter than the policy, only the owner changes
+	assertPermissions(t, path.Join(dir, "etc/sudoers.d/admins"), 0400, 0, 0)
+	assertPermissions(t, path.Join(dir, "etc/ssh/ssh_host_ed25519_key"), 0600, 0, 0)
+	assertPermissions(t, path.Join(dir, "etc/ssh/ssh_host_ed25519_key.pub"), 0644, 1000, 1000)
+	assertPermissions(t, path.Join(dir, "etc/ssl/private"), 0710, 0, 0)
+	assertPermissions(t, path.Join(dir, "etc/ssl/private/server.key"), 0600, 0, 1000)
+	assertPermissions(t, path.Join(dir, "srv/app/secret"), 0640, 1000, 1000)
+
+	// Unknown owners can't be fixed
+	h = actions.NewHardenPermissionsAction()
+	h.DefaultPolicy = false
+	h.Policy = []actions.PermissionPolicy{{Path: "/srv/app/secret", Mode: "0600", Owner: "nobody"}}
+	assert.Empty(t, h.Verify(&context))
+	assert.EqualError(t, h.Run(&context), "Couldn't fix the owner of /srv/app/secret: 'nobody' not found in /etc/passwd")
+
+	h.Policy = []actions.PermissionPolicy{{Path: "srv/app/secret", Mode: "0600"}}
+	assert.EqualError(t, h.Verify(&context), "Policy path 'srv/app/secret' must be an absolute path")
+	h.Policy = []actions.PermissionPolicy{{Path: "/srv/app/secret"}}
+	assert.EqualError(t, h.Verify(&context), "Policy of '/srv/app/secret' must set 'mode'")
+	h.Policy = []actions.PermissionPolicy{{Path: "/srv/app/secret", Mode: "0999"}}
+	assert.EqualError(t, h.Verify(&context), "Invalid mode '0999'")
+	h.Policy = nil
+	assert.EqualError(t, h.Verify(&context), "No policy to apply, 'default-policy' or 'policy' must be set")
+}
@@ -5,7 +5,10 @@ This action creates an image file, partitions it and formats the filesystems.
 Mountpoints can be defined so the created partitions can be mounted during the
 build, and optionally (but by-default) mounted at boot in the final system. The
 mountpoints are sorted on their position in the filesystem hierarchy so the
-order in the recipe does not matter.
+order in the recipe does not matter: the parents are mounted before their
+children, like '/' before '/boot' and '/boot' before '/boot/efi'. A warning is
+logged when a mountpoint isn't empty once its parent is mounted, as the
+partition mounted over it hides that content.
 
 Yaml syntax:
  - action: image-partition
@@ -13,6 +16,8 @@ Yaml syntax:
    imagesize: size
    partitiontype: gpt
    gpt_gap: offset
+   layout-from: filename
+   disk-id: identifier
    partitions:
      <list of partitions>
    mountpoints:
@@ -25,7 +30,7 @@ Mandatory properties:
 - imagesize -- generated image size in human-readable form, examples: 100MB, 1GB, etc.
 
 - partitiontype -- partition table type. Currently only 'gpt' and 'msdos'
-partition tables are supported.
+partition tables are supported. Optional with 'layout-from', which sets it.
 
 - gpt_gap -- shifting GPT allow to use this gap for bootloaders, for example if
 U-Boot intersects with original GPT placement.
@@ -37,6 +42,25 @@ Partition properties are described below.
 - mountpoints -- list of mount points for partitions.
 Properties for mount points are described below.
 
+Optional properties:
+
+- layout-from -- file of the recipe directory with the partition table to
+create, either a dump of 'sfdisk --dump' or the JSON of 'sfdisk --json', for
+example to match a layout required by a vendor or generated by another tool.
+The partition table is created as is by sfdisk(8), rather than from the
+'start' and 'end' of the partitions, which can't be set. The partitions of
+the recipe then set the filesystems of the partitions of the layout, looked
+up by their 'number' or by their GPT name, the partitions of the layout
+without any being left unformatted. 'fs-size: auto' and 'gpt_gap' can't be
+used with a layout file.
+
+- disk-id -- identifier of the disk in the partition table, a UUID for 'gpt'
+partition tables and 8 hexadecimal digits like '0x1234abcd' for 'msdos' ones,
+from which the PARTUUIDs of its partitions derive. By default it is random, or
+derived from 'SOURCE_DATE_EPOCH' and 'imagename' when 'SOURCE_DATE_EPOCH' is
+set, like the 'part-uuid' of the partitions, so the same recipe makes the same
+identifiers on every build.
+
 Yaml syntax for partitions:
 
    partitions:
@@ -46,8 +70,17 @@ Yaml syntax for partitions:
 	   start: offset
 	   end: offset
 	   features: list of filesystem features
+	   fs-options: list of extra mkfs arguments
+	   reserved-blocks-percentage: percentage
+	   no-journal: bool
 	   flags: list of flags
 	   fsck: bool
+	   fs-size: auto
+	   slack: size
+	   compression: algorithm
+	   image: filename
+	   number: number
+	   part-uuid: uuid
 
 Mandatory properties:
 
@@ -59,9 +92,21 @@ unique.
 
 'none' fs type should be used for partition without filesystem.
 
+'swap' fs type formats the partition as swap space with mkswap(8). Swap
+partitions can't be used as mount points but are added to '/etc/fstab'.
+
+'erofs' fs type makes a read-only EROFS filesystem. Since EROFS is built from
+its content rather than formatted and then filled, the mount points of the
+partition are bound to a staging directory of the scratch space during the
+build, and the filesystem is built with mkfs.erofs(1) from the staged content
+and written to the partition once all actions have run. The build fails if
+the filesystem doesn't fit in the partition.
+
 - start -- offset from beginning of the disk there the partition starts.
+Not used with 'layout-from'.
 
 - end -- offset from beginning of the disk there the partition ends.
+Not used with 'layout-from'.
 
 For 'start' and 'end' properties offset can be written in human readable
 form -- '32MB', '1GB' or as disk percentage -- '100%'.
@@ -71,12 +116,53 @@ Optional properties:
 - features -- list of additional filesystem features which need to be enabled
 for partition.
 
+- fs-options -- list of additional arguments passed verbatim to the mkfs
+command when formatting the partition.
+
+- reserved-blocks-percentage -- percentage of the filesystem blocks reserved
+for the super-user, as passed to 'mke2fs -m'. Only supported for ext2/ext3/ext4
+filesystems.
+
+- no-journal -- if set to `true` the filesystem is created without a journal.
+Useful for tiny partitions. Only supported for ext2/ext3/ext4 filesystems.
+
 - flags -- list of additional flags for partition compatible with parted(8)
 'set' command.
 
 - fsck -- if set to `false` -- then set fs_passno (man fstab) to 0 meaning no filesystem
 checks in boot time. By default is set to `true` allowing checks on boot.
 
+- fs-size -- if set to `auto` the filesystem is resized to fit its content plus
+'slack' once all actions have run: shrunk, with the partition and image file
+truncated accordingly, or grown along with the partition when it is too small.
+The 'imagesize' property is then the upper bound for the image, the build
+fails if the content plus slack doesn't fit in it. Only supported for the last
+partition and for ext2/ext3/ext4 filesystems, since other filesystems can't be
+shrunk.
+
+- slack -- free space to keep on top of the content for partitions with
+`fs-size: auto`, in human-readable form. By default is set to '64MB'.
+
+- compression -- compression of EROFS filesystems, as passed to 'mkfs.erofs -z',
+for example 'lz4', 'lz4hc,12', 'lzma' or 'zstd'. By default the filesystem is
+not compressed. Only supported for erofs filesystems, whose 'features' are
+passed as extended options to 'mkfs.erofs -E'.
+
+- number -- number of the partition of the 'layout-from' file this partition
+is, by default the one whose GPT name is 'name'.
+
+- part-uuid -- UUID of the partition in a 'gpt' partition table, its PARTUUID,
+for example for the bootloaders of A/B update schemes which refer to the
+partitions by their PARTUUID. By default it is random, or derived from
+'SOURCE_DATE_EPOCH', 'imagename' and 'name' when 'SOURCE_DATE_EPOCH' is set.
+
+- image -- name of a filesystem image in the artifact directory, for example
+made by a 'squashfs' action, to write as is to the partition rather than
+formatting it. The build fails if the image doesn't fit in the partition. 'fs'
+is the filesystem type of the image, used to mount it and in '/etc/fstab',
+and the formatting properties can't be set. Mount points of the partition are
+mounted read-only during the build.
+
 Yaml syntax for mount points:
 
    mountpoints:
@@ -130,17 +216,26 @@ Layout example for Raspberry PI 3:
 package actions
 
 import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
 	"github.com/docker/go-units"
 	"github.com/go-debos/fakemachine"
-	"gopkg.in/freddierice/go-losetup.v1"
 	"log"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
+	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -158,6 +253,17 @@ type Partition struct {
 	Features []string
 	Fsck     bool "fsck"
 	FSUUID   string
+	FSSize   string `yaml:"fs-size"`
+	Slack    string
+	slack    int64
+
+	FSOptions                []string `yaml:"fs-options"`
+	ReservedBlocksPercentage string   `yaml:"reserved-blocks-percentage"`
+	NoJournal                bool     `yaml:"no-journal"`
+	Compression              string
+	Image                    string
+	Number                   int
+	PartUUID                 string `yaml:"part-uuid"`
 }
 
 type Mountpoint struct {
@@ -174,16 +280,18 @@ type ImagePartitionAction struct {
 	ImageSize        string
 	PartitionType    string
 	GptGap           string "gpt_gap"
+	LayoutFrom       string `yaml:"layout-from"`
+	DiskID           string `yaml:"disk-id"`
 	Partitions       []Partition
 	Mountpoints      []Mountpoint
 	size             int64
-	loopDev          losetup.Device
-	usingLoop        bool
+	layout           *partitionLayout
+	loop             *loopDevices
 }
 
 func (p *Partition) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	type rawPartition Partition
-	part := rawPartition{Fsck: true}
+	part := rawPartition{Fsck: true, Slack: "64MB"}
 	if err := unmarshal(&part); err != nil {
 		return err
 	}
@@ -219,6 +327,16 @@ func (i *ImagePartitionAction) generateFSTab(context *debos.DebosContext) error
 			strings.Join(options, ","), fs_passno))
 	}
 
+	for _, p := range i.Partitions {
+		if p.FS != "swap" {
+			continue
+		}
+		if p.FSUUID == "" {
+			return fmt.Errorf("Missing swap UUID for partition %s!?!", p.Name)
+		}
+		context.ImageFSTab.WriteString(fmt.Sprintf("UUID=%s\tnone\tswap\tsw\t0\t0\n", p.FSUUID))
+	}
+
 	return nil
 }
 
@@ -258,7 +376,7 @@ func (i ImagePartitionAction) getPartitionDevice(number int, context debos.Debos
 }
 
 func (i *ImagePartitionAction) triggerDeviceNodes(context *debos.DebosContext) error {
-	err := debos.Command{}.Run("udevadm", "udevadm", "trigger", "--settle", context.Image)
+	err := debos.NewCommandForContext(*context).Run("udevadm", "udevadm", "trigger", "--settle", context.Image)
 	if err != nil {
 		log.Printf("Failed to trigger device nodes")
 		return err
@@ -267,6 +385,59 @@ func (i *ImagePartitionAction) triggerDeviceNodes(context *debos.DebosContext) e
 	return nil
 }
 
+/* Store the offset and size of the created partitions, as laid out by parted */
+func (i *ImagePartitionAction) readGeometry(context *debos.DebosContext) error {
+	out, err := exec.Command("parted", "-m", "-s", context.Image, "unit", "B", "print").Output()
+	if err != nil {
+		return fmt.Errorf("Failed to read partition table: %v", err)
+	}
+
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Split(strings.TrimSuffix(line, ";"), ":")
+		if len(fields) < 4 {
+			continue
+		}
+		number, err := strconv.Atoi(fields[0])
+		if err != nil {
+			/* Not a partition entry */
+			continue
+		}
+		offset, err := strconv.ParseInt(strings.TrimSuffix(fields[1], "B"), 10, 64)
+		if err != nil {
+			return fmt.Errorf("Failed to parse partition offset '%s'", fields[1])
+		}
+		size, err := strconv.ParseInt(strings.TrimSuffix(fields[3], "B"), 10, 64)
+		if err != nil {
+			return fmt.Errorf("Failed to parse partition size '%s'", fields[3])
+		}
+
+		for idx, _ := range context.ImagePartitions {
+			p := &context.ImagePartitions[idx]
+			if p.Number == number {
+				p.Offset = offset
+				p.Size = size
+			}
+		}
+	}
+
+	return nil
+}
+
+// Store the UUIDs of the partitions in the partition table, as used by the
+// root=PARTUUID= argument of the kernel
+func readPartUUIDs(context *debos.DebosContext) error {
+	for idx := range context.ImagePartitions {
+		p := &context.ImagePartitions[idx]
+		uuid, err := exec.Command("blkid", "-o", "value", "-s", "PART_ENTRY_UUID", "-p", "-c", "none", p.DevicePath).Output()
+		if err != nil {
+			return fmt.Errorf("Failed to get the partition uuid of %s: %s", p.Name, err)
+		}
+		p.PartUUID = strings.TrimSpace(string(uuid))
+	}
+
+	return nil
+}
+
 func (i ImagePartitionAction) PreMachine(context *debos.DebosContext, m *fakemachine.Machine,
 	args *[]string) error {
 	image, err := m.CreateImage(i.ImageName, i.size)
@@ -279,7 +450,177 @@ func (i ImagePartitionAction) PreMachine(context *debos.DebosContext, m *fakemac
 	return nil
 }
 
+// Format 16 bytes as a version 4, variant 1 UUID
+func formatUUID(uuid []byte) string {
+	uuid[6] = uuid[6]&0x0f | 0x40
+	uuid[8] = uuid[8]&0x3f | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:16])
+}
+
+// Returns a random UUID, for the filesystems which are built later on
+func newFSUUID() (string, error) {
+	uuid := make([]byte, 16)
+	if _, err := rand.Read(uuid); err != nil {
+		return "", err
+	}
+	return formatUUID(uuid), nil
+}
+
+// Returns a UUID derived from the seed, the same for the same seed
+func derivedUUID(seed string) string {
+	sum := sha256.Sum256([]byte(seed))
+	return formatUUID(sum[:16])
+}
+
+var (
+	uuidPattern  = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	dosIDPattern = regexp.MustCompile(`^(0x)?[0-9a-fA-F]{8}$`)
+)
+
+/* Identifiers of the disk and of the partitions set once they are created:
+ * the ones of the recipe, else the ones derived from SOURCE_DATE_EPOCH if set,
+ * leaving the random ones otherwise */
+func (i ImagePartitionAction) identifiers(context *debos.DebosContext) (string, map[int]string, error) {
+	epoch, reproducible, err := sourceDateEpoch(context)
+	if err != nil {
+		return "", nil, err
+	}
+	seed := fmt.Sprintf("%d/%s", epoch, i.ImageName)
+
+	diskID := i.DiskID
+	if diskID == "" && reproducible {
+		diskID = derivedUUID(seed + "/disk")
+		if i.PartitionType == "msdos" {
+			diskID = "0x" + diskID[:8]
+		}
+	}
+
+	partUUIDs := map[int]string{}
+	if i.PartitionType != "gpt" {
+		return diskID, partUUIDs, nil
+	}
+	for _, p := range i.Partitions {
+		if p.PartUUID != "" {
+			partUUIDs[p.number] = p.PartUUID
+		} else if reproducible {
+			partUUIDs[p.number] = derivedUUID(seed + "/partition/" + p.Name)
+		}
+	}
+
+	return diskID, partUUIDs, nil
+}
+
+// Set the identifiers of the disk and of the partitions in the partition table
+func (i ImagePartitionAction) setIdentifiers(context *debos.DebosContext) error {
+	diskID, partUUIDs, err := i.identifiers(context)
+	if err != nil {
+		return err
+	}
+
+	cmd := debos.NewCommandForContext(*context)
+	sfdisk := []string{"sfdisk", "--no-reread", "--no-tell-kernel"}
+	if diskID != "" {
+		err = cmd.Run("sfdisk", append(sfdisk, "--disk-id", context.Image, diskID)...)
+		if err != nil {
+			return err
+		}
+	}
+	for _, p := range i.Partitions {
+		uuid, found := partUUIDs[p.number]
+		if !found {
+			continue
+		}
+		err = cmd.Run("sfdisk", append(sfdisk, "--part-uuid", context.Image, strconv.Itoa(p.number), uuid)...)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Directory the content of an EROFS partition is assembled in
+func erofsStagingDir(p *Partition, context *debos.DebosContext) string {
+	return path.Join(context.Scratchdir, "erofs", p.Name)
+}
+
+/* Write an image to the device, which must fit in it. The image is written
+ * as is, rather than sparse, so the device doesn't need to be zeroed first */
+func writePartitionImage(image, device string) error {
+	src, err := os.Open(image)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	dst, err := os.OpenFile(device, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	size, err := dst.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if info.Size() > size {
+		return fmt.Errorf("%s takes %d bytes, %d more than the partition size of %d bytes",
+			path.Base(image), info.Size(), info.Size()-size, size)
+	}
+	if _, err = dst.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(dst, src); err != nil {
+		return fmt.Errorf("Failed to write %s to %s: %v", path.Base(image), device, err)
+	}
+
+	return dst.Sync()
+}
+
+// Store the UUID of the filesystem of the partition, if any
+func readFSUUID(p *Partition, device string) error {
+	if p.FS == "none" {
+		return nil
+	}
+
+	uuid, err := exec.Command("blkid", "-o", "value", "-s", "UUID", "-p", "-c", "none", device).Output()
+	if err != nil {
+		return fmt.Errorf("Failed to get uuid: %s", err)
+	}
+	p.FSUUID = strings.TrimSpace(string(uuid[:]))
+
+	return nil
+}
+
 func (i ImagePartitionAction) formatPartition(p *Partition, context debos.DebosContext) error {
+	/* Pre-built filesystem images are written as is rather than formatted */
+	if p.Image != "" {
+		device := i.getPartitionDevice(p.number, context)
+		if err := writePartitionImage(path.Join(context.Artifactdir, p.Image), device); err != nil {
+			return fmt.Errorf("Partition %s: %v", p.Name, err)
+		}
+		log.Printf("Wrote %s to partition %s", p.Image, p.Name)
+		return readFSUUID(p, device)
+	}
+
+	/* EROFS can't be formatted empty, it is built from the staged content
+	 * in buildErofs, with the UUID already written to fstab */
+	if p.FS == "erofs" {
+		uuid, err := newFSUUID()
+		if err != nil {
+			return fmt.Errorf("Failed to generate uuid: %v", err)
+		}
+		p.FSUUID = uuid
+		return os.MkdirAll(erofsStagingDir(p, &context), 0755)
+	}
+
 	label := fmt.Sprintf("Formatting partition %d", p.number)
 	path := i.getPartitionDevice(p.number, context)
 
@@ -301,6 +642,20 @@ func (i ImagePartitionAction) formatPartition(p *Partition, context debos.DebosC
 		cmdline = append(cmdline, "mkfs.hfsplus", "-s", "-v", p.Name)
 		// hfsx is case-insensitive hfs+, should be treated as "normal" hfs+ from now on
 		p.FS = "hfsplus"
+	case "swap":
+		cmdline = append(cmdline, "mkswap", "-L", p.Name)
+	case "ext2", "ext3", "ext4":
+		cmdline = append(cmdline, fmt.Sprintf("mkfs.%s", p.FS), "-L", p.Name)
+		features := append([]string{}, p.Features...)
+		if p.NoJournal {
+			features = append(features, "^has_journal")
+		}
+		if len(features) > 0 {
+			cmdline = append(cmdline, "-O", strings.Join(features, ","))
+		}
+		if p.ReservedBlocksPercentage != "" {
+			cmdline = append(cmdline, "-m", p.ReservedBlocksPercentage)
+		}
 	case "none":
 	default:
 		cmdline = append(cmdline, fmt.Sprintf("mkfs.%s", p.FS), "-L", p.Name)
@@ -310,23 +665,83 @@ func (i ImagePartitionAction) formatPartition(p *Partition, context debos.DebosC
 	}
 
 	if len(cmdline) != 0 {
+		cmdline = append(cmdline, p.FSOptions...)
 		cmdline = append(cmdline, path)
 
-		cmd := debos.Command{}
+		cmd := debos.NewCommandForContext(context)
 		if err := cmd.Run(label, cmdline...); err != nil {
 			return err
 		}
 	}
 
-	if p.FS != "none" {
-		uuid, err := exec.Command("blkid", "-o", "value", "-s", "UUID", "-p", "-c", "none", path).Output()
+	return readFSUUID(p, path)
+}
+
+var losetupCommand = "losetup"
+var loopRetryDelay = time.Second
+
+/* Loop devices attached to image files, tracked so all of them are detached
+ * whichever step of the build failed */
+type loopDevices struct {
+	devices []string
+}
+
+/* Attach the first free loop device to the file, retrying as concurrent
+ * builds may take it first or use all of them for a while */
+func (l *loopDevices) attach(file string, options ...string) (string, error) {
+	args := append([]string{"--find", "--show"}, options...)
+	args = append(args, file)
+
+	var err error
+	for t := 0; t < 10; t++ {
+		var out []byte
+		out, err = exec.Command(losetupCommand, args...).Output()
+		if err == nil {
+			dev := strings.TrimSpace(string(out))
+			l.devices = append(l.devices, dev)
+			log.Printf("Attached loop device %s to %s\n", dev, file)
+			return dev, nil
+		}
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			err = fmt.Errorf("%v: %s", err, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		log.Printf("Failed to attach a loop device to %s, retrying: %v", file, err)
+		time.Sleep(loopRetryDelay)
+	}
+
+	return "", fmt.Errorf("Failed to setup loop device for %s: %v", file, err)
+}
+
+/* Detach the loop devices, the last attached first. The ones failing to
+ * detach are kept to be detached again by a later call */
+func (l *loopDevices) detachAll() error {
+	if l == nil {
+		return nil
+	}
+
+	var failed error
+	for idx := len(l.devices) - 1; idx >= 0; idx-- {
+		dev := l.devices[idx]
+		var err error
+		for t := 0; t < 60; t++ {
+			err = exec.Command(losetupCommand, "--detach", dev).Run()
+			if err == nil {
+				break
+			}
+			log.Printf("Loop dev %s couldn't be detached %s, waiting", dev, err)
+			time.Sleep(loopRetryDelay)
+		}
+
 		if err != nil {
-			return fmt.Errorf("Failed to get uuid: %s", err)
+			log.Printf("WARNING: Failed to detach loop device %s: %s", dev, err)
+			failed = err
+			continue
 		}
-		p.FSUUID = strings.TrimSpace(string(uuid[:]))
+		log.Printf("Detached loop device %s\n", dev)
+		l.devices = append(l.devices[:idx], l.devices[idx+1:]...)
 	}
 
-	return nil
+	return failed
 }
 
 func (i *ImagePartitionAction) PreNoMachine(context *debos.DebosContext) error {
@@ -343,16 +758,40 @@ func (i *ImagePartitionAction) PreNoMachine(context *debos.DebosContext) error {
 
 	img.Close()
 
-	i.loopDev, err = losetup.Attach(i.ImageName, 0, false)
+	i.loop = &loopDevices{}
+	context.Image, err = i.loop.attach(i.ImageName)
 	if err != nil {
-		return fmt.Errorf("Failed to setup loop device")
+		return err
 	}
-	context.Image = i.loopDev.Path()
-	i.usingLoop = true
 
 	return nil
 }
 
+func (i ImagePartitionAction) createPartition(p *Partition, context debos.DebosContext) error {
+	var name string
+	if i.PartitionType == "gpt" {
+		name = p.Name
+	} else {
+		name = "primary"
+	}
+
+	command := []string{"parted", "-a", "none", "-s", "--", context.Image, "mkpart", name}
+	switch p.FS {
+	case "vfat":
+		command = append(command, "fat32")
+	case "hfsplus":
+		command = append(command, "hfs+")
+	case "swap":
+		command = append(command, "linux-swap")
+	case "none", "erofs":
+	default:
+		command = append(command, p.FS)
+	}
+	command = append(command, p.Start, p.End)
+
+	return debos.NewCommandForContext(context).Run("parted", command...)
+}
+
 func (i ImagePartitionAction) Run(context *debos.DebosContext) error {
 	i.LogStart()
 
@@ -375,43 +814,33 @@ func (i ImagePartitionAction) Run(context *debos.DebosContext) error {
 		return err
 	}
 
-	command := []string{"parted", "-s", context.Image, "mklabel", i.PartitionType}
-	if len(i.GptGap) > 0 {
-		command = append(command, i.GptGap)
+	if i.layout != nil {
+		err = i.layout.apply(i, *context)
+	} else {
+		command := []string{"parted", "-s", context.Image, "mklabel", i.PartitionType}
+		if len(i.GptGap) > 0 {
+			command = append(command, i.GptGap)
+		}
+		err = debos.NewCommandForContext(*context).Run("parted", command...)
 	}
-	err = debos.Command{}.Run("parted", command...)
 	if err != nil {
 		return err
 	}
+	progress := debos.NewProgress("Partitioning", len(i.Partitions))
 	for idx, _ := range i.Partitions {
 		p := &i.Partitions[idx]
-		var name string
-		if i.PartitionType == "gpt" {
-			name = p.Name
-		} else {
-			name = "primary"
-		}
-
-		command := []string{"parted", "-a", "none", "-s", "--", context.Image, "mkpart", name}
-		switch p.FS {
-		case "vfat":
-			command = append(command, "fat32")
-		case "hfsplus":
-			command = append(command, "hfs+")
-		case "none":
-		default:
-			command = append(command, p.FS)
-		}
-		command = append(command, p.Start, p.End)
+		progress.Update(idx, p.Name)
 
-		err = debos.Command{}.Run("parted", command...)
-		if err != nil {
-			return err
+		/* The partitions of a layout file are all created already */
+		if i.layout == nil {
+			if err = i.createPartition(p, *context); err != nil {
+				return err
+			}
 		}
 
 		if p.Flags != nil {
 			for _, flag := range p.Flags {
-				err = debos.Command{}.Run("parted", "parted", "-s", context.Image, "set",
+				err = debos.NewCommandForContext(*context).Run("parted", "parted", "-s", context.Image, "set",
 					fmt.Sprintf("%d", p.number), flag, "on")
 				if err != nil {
 					return err
@@ -426,34 +855,52 @@ func (i ImagePartitionAction) Run(context *debos.DebosContext) error {
 			return err
 		}
 
+		var label string
+		if i.layout != nil {
+			label = i.layout.name(p.number)
+		} else if i.PartitionType == "gpt" {
+			label = p.Name
+		}
+
 		context.ImagePartitions = append(context.ImagePartitions,
-			debos.Partition{p.Name, devicePath})
+			debos.Partition{Name: p.Name, DevicePath: devicePath, Number: p.number, FS: p.FS, Label: label})
 	}
+	progress.Update(len(i.Partitions), "done")
 
-	context.ImageMntDir = path.Join(context.Scratchdir, "mnt")
-	os.MkdirAll(context.ImageMntDir, 0755)
+	if err = i.setIdentifiers(context); err != nil {
+		return err
+	}
+
+	err = i.readGeometry(context)
+	if err != nil {
+		return err
+	}
 
-	// sort mountpoints based on position in filesystem hierarchy
-	sort.SliceStable(i.Mountpoints, func(a, b int) bool {
-		mntA := i.Mountpoints[a].Mountpoint
-		mntB := i.Mountpoints[b].Mountpoint
+	if err = readPartUUIDs(context); err != nil {
+		return err
+	}
 
-		// root should always be mounted first
-		if (mntA == "/") {
-			return true
-		}
-		if (mntB == "/") {
-			return false
-		}
+	context.ImageMntDir = path.Join(context.Scratchdir, "mnt")
+	os.MkdirAll(context.ImageMntDir, 0755)
 
-		return strings.Count(mntA, "/") < strings.Count(mntB, "/")
-	})
+	sortMountpoints(i.Mountpoints)
 
 	for _, m := range i.Mountpoints {
 		dev := i.getPartitionDevice(m.part.number, *context)
 		mntpath := path.Join(context.ImageMntDir, m.Mountpoint)
 		os.MkdirAll(mntpath, 0755)
-		err := syscall.Mount(dev, mntpath, m.part.FS, 0, "")
+		if hidden := mountpointContent(mntpath); len(hidden) > 0 {
+			log.Printf("Warning: %s isn't empty, partition %s hides %s",
+				m.Mountpoint, m.part.Name, strings.Join(hidden, ", "))
+		}
+		var err error
+		if m.part.Image != "" {
+			err = syscall.Mount(dev, mntpath, m.part.FS, syscall.MS_RDONLY, "")
+		} else if m.part.FS == "erofs" {
+			err = syscall.Mount(erofsStagingDir(m.part, context), mntpath, "", syscall.MS_BIND, "")
+		} else {
+			err = syscall.Mount(dev, mntpath, m.part.FS, 0, "")
+		}
 		if err != nil {
 			return fmt.Errorf("%s mount failed: %v", m.part.Name, err)
 		}
@@ -472,16 +919,55 @@ func (i ImagePartitionAction) Run(context *debos.DebosContext) error {
 	return nil
 }
 
-func (i ImagePartitionAction) Cleanup(context *debos.DebosContext) error {
+// Depth of the mountpoint in the filesystem hierarchy, 0 for the root
+func mountpointDepth(mountpoint string) int {
+	clean := path.Clean("/" + mountpoint)
+	if clean == "/" {
+		return 0
+	}
+	return strings.Count(clean, "/")
+}
+
+/* Sort the mountpoints on their position in the filesystem hierarchy, so the
+ * parents are mounted before their children */
+func sortMountpoints(mountpoints []Mountpoint) {
+	sort.SliceStable(mountpoints, func(a, b int) bool {
+		return mountpointDepth(mountpoints[a].Mountpoint) < mountpointDepth(mountpoints[b].Mountpoint)
+	})
+}
+
+/* Entries of the mountpoint directory which the partition mounted over it
+ * would hide, for example the content of a pre-built parent partition */
+func mountpointContent(dir string) []string {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+/* Safe to call several times, or when Run failed before mounting everything:
+ * what isn't mounted or attached anymore is skipped */
+func (i *ImagePartitionAction) Cleanup(context *debos.DebosContext) error {
 	for idx := len(i.Mountpoints) - 1; idx >= 0; idx-- {
 		m := i.Mountpoints[idx]
 		mntpath := path.Join(context.ImageMntDir, m.Mountpoint)
 		err := syscall.Unmount(mntpath, 0)
+		if err == syscall.EINVAL || err == syscall.ENOENT {
+			// Not mounted
+			continue
+		}
 		if err != nil {
 			log.Printf("Warning: Failed to get unmount %s: %s", m.Mountpoint, err)
 			log.Printf("Unmount failure can cause images being incomplete!")
 			return err
 		}
+		log.Printf("Unmounted %s\n", mntpath)
 		if m.Buildtime == true {
 			if err = os.Remove(mntpath); err != nil {
 				log.Printf("Failed to remove temporary mount point %s: %s", m.Mountpoint, err)
@@ -495,32 +981,328 @@ func (i ImagePartitionAction) Cleanup(context *debos.DebosContext) error {
 		}
 	}
 
-	if i.usingLoop {
-		err := i.loopDev.Detach()
-		if err != nil {
-			log.Printf("WARNING: Failed to detach loop device: %s", err)
+	if context.State == debos.Success {
+		for idx, _ := range i.Partitions {
+			p := &i.Partitions[idx]
+			if p.FS == "erofs" && p.Image == "" {
+				if err := i.buildErofs(p, context); err != nil {
+					return err
+				}
+			}
+			if p.FSSize != "auto" {
+				continue
+			}
+			if err := i.fitPartition(p, context); err != nil {
+				return err
+			}
+		}
+	}
+
+	return i.loop.detachAll()
+}
+
+/* Build the EROFS filesystem of the content staged for the partition and write
+ * it to the partition, which it must fit in */
+func (i ImagePartitionAction) buildErofs(p *Partition, context *debos.DebosContext) error {
+	staging := erofsStagingDir(p, context)
+	image := staging + ".img"
+	defer os.Remove(image)
+
+	cmdline := []string{"mkfs.erofs", "-L", p.Name, "-U", p.FSUUID}
+	if p.Compression != "" {
+		cmdline = append(cmdline, "-z", p.Compression)
+	}
+	if len(p.Features) > 0 {
+		cmdline = append(cmdline, "-E", strings.Join(p.Features, ","))
+	}
+	cmdline = append(cmdline, p.FSOptions...)
+	cmdline = append(cmdline, image, staging)
+
+	label := fmt.Sprintf("Building EROFS partition %s", p.Name)
+	if err := debos.NewCommandForContext(*context).Run(label, cmdline...); err != nil {
+		return err
+	}
+
+	dev := i.getPartitionDevice(p.number, *context)
+	if err := writePartitionImage(image, dev); err != nil {
+		return fmt.Errorf("EROFS partition %s: %v", p.Name, err)
+	}
+
+	log.Printf("Wrote EROFS filesystem to partition %s", p.Name)
+	return nil
+}
+
+/* Returns the block size, the block count and the estimated minimal block
+ * count of the ext2/ext3/ext4 filesystem of dev */
+func ext4Blocks(dev string) (int64, int64, int64, error) {
+	out, err := exec.Command("dumpe2fs", "-h", dev).Output()
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("Failed to read superblock of %s: %v", dev, err)
+	}
+	var blockSize, blockCount int64
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.SplitN(line, ":", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		switch fields[0] {
+		case "Block size":
+			blockSize, _ = strconv.ParseInt(strings.TrimSpace(fields[1]), 10, 64)
+		case "Block count":
+			blockCount, _ = strconv.ParseInt(strings.TrimSpace(fields[1]), 10, 64)
+		}
+	}
+
+	out, err = exec.Command("resize2fs", "-P", dev).Output()
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("Failed to estimate minimal size of %s: %v", dev, err)
+	}
+	var minBlocks int64
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.HasPrefix(line, "Estimated minimum size of the filesystem:") {
+			fields := strings.Fields(line)
+			minBlocks, _ = strconv.ParseInt(fields[len(fields)-1], 10, 64)
+		}
+	}
+	if blockSize == 0 || blockCount == 0 || minBlocks == 0 {
+		return 0, 0, 0, fmt.Errorf("Failed to determine the size of %s", dev)
+	}
+
+	return blockSize, blockCount, minBlocks, nil
+}
+
+/* Resize an ext filesystem to its minimal size plus slack and the partition to
+ * match, the image file itself is truncated in PostMachine */
+func (i ImagePartitionAction) fitPartition(p *Partition, context *debos.DebosContext) error {
+	dev := i.getPartitionDevice(p.number, *context)
+	label := fmt.Sprintf("Fitting partition %s", p.Name)
+
+	room, err := i.partitionRoom(p, context)
+	if err != nil {
+		return err
+	}
+
+	size, err := fitExtFilesystem(context, label, dev, p.slack, func(size int64) error {
+		if size > room {
+			return fmt.Errorf("Partition %s: content plus slack takes %d bytes, more than the %d bytes left in the image",
+				p.Name, size, room)
+		}
+		if err := resizePartition(context.Image, p.number, size); err != nil {
 			return err
 		}
+		// The kernel must know the new size before the filesystem grows
+		return debos.NewCommandForContext(*context).Run(label, "partx", "--update",
+			"--nr", fmt.Sprintf("%d", p.number), context.Image)
+	})
+	if err != nil || size == 0 {
+		return err
+	}
 
-		for t := 0; t < 60; t++ {
-			err = i.loopDev.Remove()
-			if err == nil {
-				break
+	log.Printf("Resized partition %s to %d bytes", p.Name, size)
+	return nil
+}
+
+/* Bytes from the start of the partition to the end of the image, or to the
+ * backup partition table for GPT */
+func (i ImagePartitionAction) partitionRoom(p *Partition, context *debos.DebosContext) (int64, error) {
+	f, err := os.Open(context.Image)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	end, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, fmt.Errorf("Couldn't get the size of %s: %v", context.Image, err)
+	}
+	if i.PartitionType == "gpt" {
+		// Backup header and entries
+		end -= 33 * 512
+	}
+
+	for _, part := range context.ImagePartitions {
+		if part.Number == p.number {
+			return end - part.Offset, nil
+		}
+	}
+	return 0, fmt.Errorf("Failed to find partition named %s", p.Name)
+}
+
+/* Resize the ext filesystem of dev to its minimal size plus slack, keeping it
+ * MiB aligned. resize changes the size of the underlying partition, before
+ * growing the filesystem or after shrinking it. Returns the new size, or 0
+ * when the filesystem already has the right size */
+func fitExtFilesystem(context *debos.DebosContext, label, dev string, slack int64, resize func(int64) error) (int64, error) {
+	err := debos.NewCommandForContext(*context).Run(label, "e2fsck", "-f", "-y", dev)
+	if err != nil {
+		return 0, err
+	}
+
+	blockSize, blockCount, minBlocks, err := ext4Blocks(dev)
+	if err != nil {
+		return 0, err
+	}
+
+	/* Keep the partition end MiB aligned */
+	size := minBlocks*blockSize + slack
+	size = (size + units.MiB - 1) / units.MiB * units.MiB
+
+	current := blockCount * blockSize
+	if size == current {
+		log.Printf("Content of %s plus slack already takes %d bytes, keeping its size", dev, current)
+		return 0, nil
+	}
+
+	if size > current {
+		if err := resize(size); err != nil {
+			return 0, err
+		}
+	}
+	err = debos.NewCommandForContext(*context).Run(label, "resize2fs", dev, fmt.Sprintf("%dK", size/1024))
+	if err != nil {
+		return 0, err
+	}
+	if size < current {
+		if err := resize(size); err != nil {
+			return 0, err
+		}
+	}
+	return size, nil
+}
+
+// Change the size of the partition of the image, keeping its start
+func resizePartition(image string, number int, size int64) error {
+	sfdisk := exec.Command("sfdisk", "--no-reread", "--no-tell-kernel",
+		"-N", fmt.Sprintf("%d", number), image)
+	sfdisk.Stdin = strings.NewReader(fmt.Sprintf(", %d\n", size/512))
+	if out, err := sfdisk.CombinedOutput(); err != nil {
+		return fmt.Errorf("Failed to resize partition %d: %v\n%s", number, err, out)
+	}
+	return nil
+}
+
+/* Truncate the image file after the last partition. For GPT the backup
+ * partition table is rewritten at the new end of the image */
+func truncateImage(image string) error {
+	const sectorSize = 512
+
+	f, err := os.OpenFile(image, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	mbr := make([]byte, sectorSize)
+	if _, err = f.ReadAt(mbr, 0); err != nil {
+		return err
+	}
+
+	/* A protective MBR partition indicates GPT */
+	if mbr[446+4] != 0xee {
+		var end uint64
+		for n := 0; n < 4; n++ {
+			entry := mbr[446+16*n : 446+16*(n+1)]
+			start := uint64(binary.LittleEndian.Uint32(entry[8:12]))
+			size := uint64(binary.LittleEndian.Uint32(entry[12:16]))
+			if entry[4] != 0 && start+size > end {
+				end = start + size
 			}
-			log.Printf("Loop dev couldn't remove %s, waiting", err)
-			time.Sleep(time.Second)
 		}
+		end = (end + 2047) / 2048 * 2048
+		return f.Truncate(int64(end * sectorSize))
+	}
 
-		if err != nil {
-			log.Printf("WARNING: Failed to remove loop device: %s", err)
-			return err
+	header := make([]byte, sectorSize)
+	if _, err = f.ReadAt(header, sectorSize); err != nil {
+		return err
+	}
+	if string(header[0:8]) != "EFI PART" {
+		return fmt.Errorf("Couldn't find GPT header in %s", image)
+	}
+	headerSize := binary.LittleEndian.Uint32(header[12:16])
+	entriesLBA := binary.LittleEndian.Uint64(header[72:80])
+	numEntries := binary.LittleEndian.Uint32(header[80:84])
+	entrySize := binary.LittleEndian.Uint32(header[84:88])
+
+	entries := make([]byte, numEntries*entrySize)
+	if _, err = f.ReadAt(entries, int64(entriesLBA*sectorSize)); err != nil {
+		return err
+	}
+
+	var end uint64
+	empty := make([]byte, 16)
+	for n := uint32(0); n < numEntries; n++ {
+		entry := entries[n*entrySize : (n+1)*entrySize]
+		if bytes.Equal(entry[0:16], empty) {
+			continue
+		}
+		if last := binary.LittleEndian.Uint64(entry[40:48]); last+1 > end {
+			end = last + 1
 		}
 	}
 
+	entriesSectors := uint64(len(entries)+sectorSize-1) / sectorSize
+	sectors := (end + entriesSectors + 1 + 2047) / 2048 * 2048
+	lastLBA := sectors - 1
+	backupEntriesLBA := lastLBA - entriesSectors
+
+	/* Update the primary header */
+	binary.LittleEndian.PutUint64(header[32:40], lastLBA)
+	binary.LittleEndian.PutUint64(header[48:56], backupEntriesLBA-1)
+	binary.LittleEndian.PutUint32(header[16:20], 0)
+	binary.LittleEndian.PutUint32(header[16:20], crc32.ChecksumIEEE(header[:headerSize]))
+	if _, err = f.WriteAt(header, sectorSize); err != nil {
+		return err
+	}
+
+	/* And write the backup header pointing at the backup entries */
+	backup := make([]byte, sectorSize)
+	copy(backup, header)
+	binary.LittleEndian.PutUint64(backup[24:32], lastLBA)
+	binary.LittleEndian.PutUint64(backup[32:40], 1)
+	binary.LittleEndian.PutUint64(backup[72:80], backupEntriesLBA)
+	binary.LittleEndian.PutUint32(backup[16:20], 0)
+	binary.LittleEndian.PutUint32(backup[16:20], crc32.ChecksumIEEE(backup[:headerSize]))
+
+	if err = f.Truncate(int64(sectors * sectorSize)); err != nil {
+		return err
+	}
+	if _, err = f.WriteAt(entries, int64(backupEntriesLBA*sectorSize)); err != nil {
+		return err
+	}
+	if _, err = f.WriteAt(backup, int64(lastLBA*sectorSize)); err != nil {
+		return err
+	}
+
+	/* The protective MBR partition spans the whole disk */
+	protective := lastLBA
+	if protective > 0xffffffff {
+		protective = 0xffffffff
+	}
+	binary.LittleEndian.PutUint32(mbr[446+12:446+16], uint32(protective))
+	_, err = f.WriteAt(mbr, 0)
+
+	return err
+}
+
+func (i ImagePartitionAction) PostMachine(context *debos.DebosContext) error {
+	for _, p := range i.Partitions {
+		if p.FSSize == "auto" {
+			image := path.Join(context.Artifactdir, i.ImageName)
+			log.Printf("Truncating %s to fit its partitions", i.ImageName)
+			return truncateImage(image)
+		}
+	}
 	return nil
 }
 
 func (i ImagePartitionAction) PostMachineCleanup(context *debos.DebosContext) error {
+	/* Cleanup doesn't run, or stops early, when the build failed before or
+	 * while tearing down the image */
+	if err := i.loop.detachAll(); err != nil {
+		return err
+	}
+
 	image := path.Join(context.Artifactdir, i.ImageName)
 	/* Remove the image in case of any action failure */
 	if context.State != debos.Success {
@@ -533,6 +1315,291 @@ func (i ImagePartitionAction) PostMachineCleanup(context *debos.DebosContext) er
 	return nil
 }
 
+// Partition table of a layout file, created as is by sfdisk
+type partitionLayout struct {
+	label      string
+	sectorSize int64
+	headers    []string // Header lines of the sfdisk script
+	partitions []layoutPartition
+	attached   map[int]string
+}
+
+type layoutPartition struct {
+	number      int
+	start, size int64  // In sectors
+	name        string // GPT name
+	fields      string // Fields of the sfdisk script line
+}
+
+/* Split the comma separated fields of a line of a sfdisk dump, keeping the
+ * commas of quoted values */
+func splitSfdiskFields(line string) []string {
+	var fields []string
+	quoted := false
+	start := 0
+	for n, c := range line {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case c == ',' && !quoted:
+			fields = append(fields, strings.TrimSpace(line[start:n]))
+			start = n + 1
+		}
+	}
+	return append(fields, strings.TrimSpace(line[start:]))
+}
+
+// Number of the partition from its device name, e.g. 2 for /dev/mmcblk0p2
+func partitionNumber(node string) (int, error) {
+	node = strings.TrimSpace(node)
+	digits := len(node)
+	for digits > 0 && node[digits-1] >= '0' && node[digits-1] <= '9' {
+		digits--
+	}
+	number, err := strconv.Atoi(node[digits:])
+	if err != nil || number == 0 {
+		return 0, fmt.Errorf("No partition number in '%s'", node)
+	}
+	return number, nil
+}
+
+// Parse the output of 'sfdisk --dump'
+func parseSfdiskDump(data string) (*partitionLayout, error) {
+	l := partitionLayout{}
+
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		/* Partition lines are '<device> : <fields>', header lines
+		 * '<name>: <value>' */
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("Invalid line '%s'", line)
+		}
+		if !strings.Contains(kv[1], "=") {
+			name := strings.TrimSpace(kv[0])
+			value := strings.TrimSpace(kv[1])
+			switch name {
+			case "device":
+				// The device of the dump, not the image
+				continue
+			case "label":
+				l.label = value
+			case "sector-size":
+				l.sectorSize, _ = strconv.ParseInt(value, 10, 64)
+			}
+			l.headers = append(l.headers, fmt.Sprintf("%s: %s", name, value))
+			continue
+		}
+
+		number, err := partitionNumber(kv[0])
+		if err != nil {
+			return nil, err
+		}
+		p := layoutPartition{number: number, fields: strings.TrimSpace(kv[1])}
+		for _, field := range splitSfdiskFields(kv[1]) {
+			nv := strings.SplitN(field, "=", 2)
+			if len(nv) != 2 {
+				continue
+			}
+			value := strings.TrimSpace(nv[1])
+			switch strings.TrimSpace(nv[0]) {
+			case "start":
+				p.start, err = strconv.ParseInt(value, 10, 64)
+			case "size":
+				p.size, err = strconv.ParseInt(value, 10, 64)
+			case "name":
+				p.name = strings.Trim(value, `"`)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("Invalid field '%s' of partition %d", field, number)
+			}
+		}
+		l.partitions = append(l.partitions, p)
+	}
+
+	return &l, nil
+}
+
+// Parse the output of 'sfdisk --json'
+func parseSfdiskJSON(data []byte) (*partitionLayout, error) {
+	var dump struct {
+		PartitionTable struct {
+			Label      string
+			ID         string
+			Unit       string
+			FirstLBA   int64 `json:"firstlba"`
+			LastLBA    int64 `json:"lastlba"`
+			SectorSize int64 `json:"sectorsize"`
+			Partitions []struct {
+				Node     string
+				Start    int64
+				Size     int64
+				Type     string
+				UUID     string
+				Name     string
+				Attrs    string
+				Bootable bool
+			}
+		} `json:"partitiontable"`
+	}
+	if err := json.Unmarshal(data, &dump); err != nil {
+		return nil, err
+	}
+	table := dump.PartitionTable
+
+	l := partitionLayout{label: table.Label, sectorSize: table.SectorSize}
+	l.headers = append(l.headers, "label: "+table.Label)
+	if table.ID != "" {
+		l.headers = append(l.headers, "label-id: "+table.ID)
+	}
+	if table.Unit != "" {
+		l.headers = append(l.headers, "unit: "+table.Unit)
+	}
+	if table.FirstLBA != 0 {
+		l.headers = append(l.headers, fmt.Sprintf("first-lba: %d", table.FirstLBA))
+	}
+	if table.LastLBA != 0 {
+		l.headers = append(l.headers, fmt.Sprintf("last-lba: %d", table.LastLBA))
+	}
+	if table.SectorSize != 0 {
+		l.headers = append(l.headers, fmt.Sprintf("sector-size: %d", table.SectorSize))
+	}
+
+	for _, jp := range table.Partitions {
+		number, err := partitionNumber(jp.Node)
+		if err != nil {
+			return nil, err
+		}
+		fields := []string{fmt.Sprintf("start=%d", jp.Start), fmt.Sprintf("size=%d", jp.Size)}
+		if jp.Type != "" {
+			fields = append(fields, "type="+jp.Type)
+		}
+		if jp.UUID != "" {
+			fields = append(fields, "uuid="+jp.UUID)
+		}
+		if jp.Name != "" {
+			fields = append(fields, fmt.Sprintf("name=\"%s\"", jp.Name))
+		}
+		if jp.Attrs != "" {
+			fields = append(fields, fmt.Sprintf("attrs=\"%s\"", jp.Attrs))
+		}
+		if jp.Bootable {
+			fields = append(fields, "bootable")
+		}
+		l.partitions = append(l.partitions, layoutPartition{
+			number: number, start: jp.Start, size: jp.Size, name: jp.Name,
+			fields: strings.Join(fields, ", "),
+		})
+	}
+
+	return &l, nil
+}
+
+// Read and check the layout file, which sets the partition table type
+func (i *ImagePartitionAction) readLayout(context *debos.DebosContext) error {
+	if len(i.GptGap) > 0 {
+		return fmt.Errorf("gpt_gap property can't be used with 'layout-from'")
+	}
+
+	file := debos.CleanPathAt(i.LayoutFrom, context.RecipeDir)
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("Couldn't read layout file: %v", err)
+	}
+
+	var l *partitionLayout
+	if strings.HasPrefix(strings.TrimSpace(string(data)), "{") {
+		l, err = parseSfdiskJSON(data)
+	} else {
+		l, err = parseSfdiskDump(string(data))
+	}
+	if err != nil {
+		return fmt.Errorf("Invalid layout file %s: %v", i.LayoutFrom, err)
+	}
+
+	partitionType := map[string]string{"gpt": "gpt", "dos": "msdos"}[l.label]
+	if partitionType == "" {
+		return fmt.Errorf("Unsupported partition table label '%s' in %s", l.label, i.LayoutFrom)
+	}
+	if i.PartitionType != "" && i.PartitionType != partitionType {
+		return fmt.Errorf("partitiontype %s doesn't match the %s label of %s", i.PartitionType, l.label, i.LayoutFrom)
+	}
+	i.PartitionType = partitionType
+
+	if l.sectorSize == 0 {
+		l.sectorSize = 512
+	}
+	seen := map[int]bool{}
+	for _, p := range l.partitions {
+		if seen[p.number] {
+			return fmt.Errorf("Partition %d defined twice in %s", p.number, i.LayoutFrom)
+		}
+		seen[p.number] = true
+		if end := (p.start + p.size) * l.sectorSize; end > i.size {
+			return fmt.Errorf("Partition %d of %s ends at %d bytes, past the end of the %d bytes image",
+				p.number, i.LayoutFrom, end, i.size)
+		}
+	}
+
+	l.attached = map[int]string{}
+	i.layout = l
+	return nil
+}
+
+// Attach the partition of the recipe to the partition of the layout
+func (l *partitionLayout) attach(p *Partition) error {
+	if p.Start != "" || p.End != "" {
+		return fmt.Errorf("Partition %s: start and end can't be set with 'layout-from'", p.Name)
+	}
+
+	for _, lp := range l.partitions {
+		if (p.Number != 0 && lp.number == p.Number) || (p.Number == 0 && lp.name == p.Name) {
+			if other, found := l.attached[lp.number]; found {
+				return fmt.Errorf("Partitions %s and %s are both partition %d of the layout", other, p.Name, lp.number)
+			}
+			l.attached[lp.number] = p.Name
+			p.number = lp.number
+			return nil
+		}
+	}
+
+	if p.Number != 0 {
+		return fmt.Errorf("Partition %s: no partition %d in the layout", p.Name, p.Number)
+	}
+	return fmt.Errorf("Partition %s: no partition named %s in the layout, set its number", p.Name, p.Name)
+}
+
+// GPT name of the partition of the layout, if any
+func (l *partitionLayout) name(number int) string {
+	for _, lp := range l.partitions {
+		if lp.number == number {
+			return lp.name
+		}
+	}
+	return ""
+}
+
+// Create the partition table of the layout on the image
+func (l *partitionLayout) apply(i ImagePartitionAction, context debos.DebosContext) error {
+	script := strings.Join(l.headers, "\n") + "\n\n"
+	for _, p := range l.partitions {
+		script += fmt.Sprintf("%s : %s\n", i.getPartitionDevice(p.number, context), p.fields)
+	}
+
+	log.Printf("Creating the partition table of %s", i.LayoutFrom)
+	sfdisk := exec.Command("sfdisk", "--no-reread", "--no-tell-kernel", context.Image)
+	sfdisk.Stdin = strings.NewReader(script)
+	if out, err := sfdisk.CombinedOutput(); err != nil {
+		return fmt.Errorf("Failed to create the partition table of %s: %v\n%s", i.LayoutFrom, err, out)
+	}
+
+	return nil
+}
+
 func (i *ImagePartitionAction) Verify(context *debos.DebosContext) error {
 	if len(i.GptGap) > 0 {
 		log.Println("WARNING: special version of parted is needed for 'gpt_gap' option")
@@ -546,6 +1613,27 @@ func (i *ImagePartitionAction) Verify(context *debos.DebosContext) error {
 		}
 	}
 
+	size, err := units.FromHumanSize(i.ImageSize)
+	if err != nil {
+		return fmt.Errorf("Failed to parse image size: %s", i.ImageSize)
+	}
+	i.size = size
+
+	if i.LayoutFrom != "" {
+		if err := i.readLayout(context); err != nil {
+			return err
+		}
+	}
+
+	if i.DiskID != "" {
+		if i.PartitionType == "gpt" && !uuidPattern.MatchString(i.DiskID) {
+			return fmt.Errorf("Invalid disk-id '%s', expected a UUID for gpt partition tables", i.DiskID)
+		}
+		if i.PartitionType == "msdos" && !dosIDPattern.MatchString(i.DiskID) {
+			return fmt.Errorf("Invalid disk-id '%s', expected 8 hexadecimal digits for msdos partition tables", i.DiskID)
+		}
+	}
+
 	num := 1
 	for idx, _ := range i.Partitions {
 		p := &i.Partitions[idx]
@@ -555,6 +1643,14 @@ func (i *ImagePartitionAction) Verify(context *debos.DebosContext) error {
 			return fmt.Errorf("Partition without a name")
 		}
 
+		if i.layout != nil {
+			if err := i.layout.attach(p); err != nil {
+				return err
+			}
+		} else if p.Number != 0 {
+			return fmt.Errorf("Partition %s: number can only be set with 'layout-from'", p.Name)
+		}
+
 		// check for duplicate partition names
 		for j := idx + 1; j < len(i.Partitions); j++ {
 			if i.Partitions[j].Name == p.Name {
@@ -562,10 +1658,24 @@ func (i *ImagePartitionAction) Verify(context *debos.DebosContext) error {
 			}
 		}
 
-		if p.Start == "" {
+		if p.PartUUID != "" {
+			if i.PartitionType != "gpt" {
+				return fmt.Errorf("Partition %s: part-uuid is only supported for gpt partition tables", p.Name)
+			}
+			if !uuidPattern.MatchString(p.PartUUID) {
+				return fmt.Errorf("Partition %s: invalid part-uuid '%s'", p.Name, p.PartUUID)
+			}
+			for j := idx + 1; j < len(i.Partitions); j++ {
+				if strings.EqualFold(i.Partitions[j].PartUUID, p.PartUUID) {
+					return fmt.Errorf("Partitions %s and %s have the same part-uuid", p.Name, i.Partitions[j].Name)
+				}
+			}
+		}
+
+		if i.layout == nil && p.Start == "" {
 			return fmt.Errorf("Partition %s missing start", p.Name)
 		}
-		if p.End == "" {
+		if i.layout == nil && p.End == "" {
 			return fmt.Errorf("Partition %s missing end", p.Name)
 		}
 
@@ -575,6 +1685,70 @@ func (i *ImagePartitionAction) Verify(context *debos.DebosContext) error {
 		case "":
 			return fmt.Errorf("Partition %s missing fs type", p.Name)
 		}
+
+		if p.Image != "" {
+			if len(p.FSOptions) > 0 || len(p.Features) > 0 || p.Compression != "" ||
+				p.ReservedBlocksPercentage != "" || p.NoJournal || p.FSSize != "" {
+				return fmt.Errorf("Partition %s: formatting properties can't be used with an image", p.Name)
+			}
+			if strings.HasPrefix(path.Clean(p.Image), "..") || path.IsAbs(p.Image) {
+				return fmt.Errorf("Partition %s: image %s must be relative to the artifact directory", p.Name, p.Image)
+			}
+		}
+
+		if p.Compression != "" {
+			if p.FS != "erofs" {
+				return fmt.Errorf("Partition %s: compression is only supported for erofs, not %s", p.Name, p.FS)
+			}
+			algorithm := strings.FieldsFunc(p.Compression+",", func(r rune) bool { return r == ',' || r == ':' })
+			switch append(algorithm, "")[0] {
+			case "lz4", "lz4hc", "lzma", "deflate", "libdeflate", "zstd":
+			default:
+				return fmt.Errorf("Partition %s: unsupported erofs compression '%s'", p.Name, p.Compression)
+			}
+		}
+
+		switch p.FS {
+		case "ext2", "ext3", "ext4":
+			if p.ReservedBlocksPercentage != "" {
+				percentage, err := strconv.ParseFloat(p.ReservedBlocksPercentage, 64)
+				if err != nil || percentage < 0 || percentage > 50 {
+					return fmt.Errorf("Partition %s: reserved-blocks-percentage must be a number between 0 and 50", p.Name)
+				}
+			}
+		case "none":
+			if len(p.FSOptions) > 0 {
+				return fmt.Errorf("Partition %s: fs-options can't be used without a filesystem", p.Name)
+			}
+			fallthrough
+		default:
+			if p.ReservedBlocksPercentage != "" {
+				return fmt.Errorf("Partition %s: reserved-blocks-percentage is only supported for ext2/ext3/ext4, not %s", p.Name, p.FS)
+			}
+			if p.NoJournal {
+				return fmt.Errorf("Partition %s: no-journal is only supported for ext2/ext3/ext4, not %s", p.Name, p.FS)
+			}
+		}
+
+		switch p.FSSize {
+		case "":
+		case "auto":
+			if idx != len(i.Partitions)-1 || i.layout != nil {
+				return fmt.Errorf("Partition %s: 'fs-size: auto' is only supported for the last partition", p.Name)
+			}
+			switch p.FS {
+			case "ext2", "ext3", "ext4":
+			default:
+				return fmt.Errorf("Partition %s: %s filesystem can't be shrunk, 'fs-size: auto' is only supported for ext2/ext3/ext4", p.Name, p.FS)
+			}
+			slack, err := units.FromHumanSize(p.Slack)
+			if err != nil {
+				return fmt.Errorf("Failed to parse slack for partition %s: %s", p.Name, p.Slack)
+			}
+			p.slack = slack
+		default:
+			return fmt.Errorf("Partition %s: unsupported fs-size '%s'", p.Name, p.FSSize)
+		}
 	}
 
 	for idx, _ := range i.Mountpoints {
@@ -597,13 +1771,10 @@ func (i *ImagePartitionAction) Verify(context *debos.DebosContext) error {
 		if m.part == nil {
 			return fmt.Errorf("Couldn't find partition for %s", m.Mountpoint)
 		}
+		if m.part.FS == "swap" {
+			return fmt.Errorf("Swap partition %s can't be mounted on %s", m.part.Name, m.Mountpoint)
+		}
 	}
 
-	size, err := units.FromHumanSize(i.ImageSize)
-	if err != nil {
-		return fmt.Errorf("Failed to parse image size: %s", i.ImageSize)
-	}
-
-	i.size = size
 	return nil
 }
@@ -0,0 +1,579 @@
+package actions
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+
+	"github.com/docker/go-units"
+	"github.com/go-debos/debos"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWritePartitionImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	device := path.Join(dir, "device")
+	image := path.Join(dir, "rootfs.squashfs")
+	assert.Empty(t, ioutil.WriteFile(device, bytes.Repeat([]byte{0xff}, 4096), 0644))
+
+	assert.Empty(t, ioutil.WriteFile(image, bytes.Repeat([]byte{0x42}, 1024), 0644))
+	assert.Empty(t, writePartitionImage(image, device))
+	content, err := ioutil.ReadFile(device)
+	assert.Empty(t, err)
+	assert.Equal(t, 4096, len(content))
+	assert.Equal(t, bytes.Repeat([]byte{0x42}, 1024), content[:1024])
+	assert.Equal(t, bytes.Repeat([]byte{0xff}, 3072), content[1024:])
+
+	assert.Empty(t, ioutil.WriteFile(image, bytes.Repeat([]byte{0x42}, 5000), 0644))
+	assert.EqualError(t, writePartitionImage(image, device),
+		"rootfs.squashfs takes 5000 bytes, 904 more than the partition size of 4096 bytes")
+}
+
+func TestImagePartitionErofsOverflow(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	// Build a filesystem of the size of the staged content
+	bin := path.Join(dir, "bin")
+	assert.Empty(t, os.MkdirAll(bin, 0755))
+	script := "#!/bin/sh\nwhile [ $# -gt 2 ]; do shift; done\ncat \"$2\"/* > \"$1\"\n"
+	assert.Empty(t, ioutil.WriteFile(path.Join(bin, "mkfs.erofs"), []byte(script), 0755))
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", bin+":"+os.Getenv("PATH"))
+
+	context := debos.DebosContext{&debos.CommonContext{Scratchdir: dir}, "", ""}
+	context.Image = path.Join(dir, "disk")
+	context.State = debos.Success
+	assert.Empty(t, ioutil.WriteFile(context.Image, nil, 0644))
+	device := path.Join(dir, "disk1")
+	assert.Empty(t, ioutil.WriteFile(device, make([]byte, 4096), 0644))
+
+	p := Partition{Name: "root", FS: "erofs", FSUUID: "3f2b9c0e-35e5-4bd4-a1a4-1e8a2d9b5c4d", number: 1}
+	staging := erofsStagingDir(&p, &context)
+	assert.Empty(t, os.MkdirAll(staging, 0755))
+	i := ImagePartitionAction{Partitions: []Partition{p}}
+
+	assert.Empty(t, ioutil.WriteFile(path.Join(staging, "content"), bytes.Repeat([]byte{0x42}, 1024), 0644))
+	assert.Empty(t, i.Cleanup(&context))
+	content, err := ioutil.ReadFile(device)
+	assert.Empty(t, err)
+	assert.Equal(t, bytes.Repeat([]byte{0x42}, 1024), content[:1024])
+
+	// The content doesn't fit in the partition, which fails the build
+	assert.Empty(t, ioutil.WriteFile(path.Join(staging, "content"), make([]byte, 5000), 0644))
+	assert.EqualError(t, i.Cleanup(&context),
+		"EROFS partition root: root.img takes 5000 bytes, 904 more than the partition size of 4096 bytes")
+}
+
+func TestImagePartitionVerifyImage(t *testing.T) {
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+
+	i := ImagePartitionAction{
+		ImageName: "disk.img",
+		ImageSize: "1GB",
+		Partitions: []Partition{
+			{Name: "root", FS: "squashfs", Start: "0%", End: "100%", Image: "rootfs.squashfs", Fsck: true},
+		},
+	}
+	assert.Empty(t, i.Verify(&context))
+
+	i.Partitions[0].Features = []string{"metadata_csum"}
+	assert.EqualError(t, i.Verify(&context), "Partition root: formatting properties can't be used with an image")
+
+	i.Partitions[0].Features = nil
+	i.Partitions[0].Image = "../rootfs.squashfs"
+	assert.EqualError(t, i.Verify(&context), "Partition root: image ../rootfs.squashfs must be relative to the artifact directory")
+}
+
+func TestImagePartitionIdentifiers(t *testing.T) {
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+
+	i := ImagePartitionAction{
+		ImageName:     "disk.img",
+		ImageSize:     "1GB",
+		PartitionType: "gpt",
+		Partitions: []Partition{
+			{Name: "efi", FS: "vfat", Start: "0%", End: "64MB", Fsck: true},
+			{Name: "root", FS: "ext4", Start: "64MB", End: "100%", Fsck: true,
+				PartUUID: "8f2ba3a6-4ac0-4c3e-8d3a-4f1a7c0e9b51"},
+		},
+	}
+	assert.Empty(t, i.Verify(&context))
+
+	// Random identifiers but the ones of the recipe
+	diskID, partUUIDs, err := i.identifiers(&context)
+	assert.Empty(t, err)
+	assert.Equal(t, "", diskID)
+	assert.Equal(t, map[int]string{2: "8f2ba3a6-4ac0-4c3e-8d3a-4f1a7c0e9b51"}, partUUIDs)
+
+	// Derived from SOURCE_DATE_EPOCH, the same on every build
+	context.EnvironVars = map[string]string{"SOURCE_DATE_EPOCH": "1700000000"}
+	diskID, partUUIDs, err = i.identifiers(&context)
+	assert.Empty(t, err)
+	assert.True(t, uuidPattern.MatchString(diskID))
+	assert.True(t, uuidPattern.MatchString(partUUIDs[1]))
+	assert.Equal(t, "8f2ba3a6-4ac0-4c3e-8d3a-4f1a7c0e9b51", partUUIDs[2])
+	again, partUUIDsAgain, err := i.identifiers(&context)
+	assert.Empty(t, err)
+	assert.Equal(t, diskID, again)
+	assert.Equal(t, partUUIDs, partUUIDsAgain)
+
+	i.DiskID = "0x1234abcd"
+	assert.EqualError(t, i.Verify(&context), "Invalid disk-id '0x1234abcd', expected a UUID for gpt partition tables")
+
+	i.PartitionType = "msdos"
+	assert.EqualError(t, i.Verify(&context), "Partition root: part-uuid is only supported for gpt partition tables")
+
+	i.Partitions[1].PartUUID = ""
+	assert.Empty(t, i.Verify(&context))
+	diskID, partUUIDs, err = i.identifiers(&context)
+	assert.Empty(t, err)
+	assert.Equal(t, "0x1234abcd", diskID)
+	assert.Empty(t, partUUIDs)
+
+	i.DiskID = ""
+	diskID, _, err = i.identifiers(&context)
+	assert.Empty(t, err)
+	assert.True(t, dosIDPattern.MatchString(diskID))
+}
+
+const sfdiskDump = `label: gpt
+label-id: 5A9C2D1E-4B3F-4C8E-9A7D-1E2F3A4B5C6D
+device: /dev/sda
+unit: sectors
+first-lba: 34
+sector-size: 512
+
+/dev/sda1 : start=        2048, size=      131072, type=C12A7328-F81F-11D2-BA4B-00A0C93EC93B, name="EFI, System"
+/dev/sda3 : start=      133120, size=      524288, type=0FC63DAF-8483-4772-8E79-3D69D8477DE4, name="rootfs"
+`
+
+const sfdiskJSON = `{
+   "partitiontable": {
+      "label": "gpt",
+      "id": "5A9C2D1E-4B3F-4C8E-9A7D-1E2F3A4B5C6D",
+      "device": "/dev/sda",
+      "unit": "sectors",
+      "firstlba": 34,
+      "sectorsize": 512,
+      "partitions": [
+         {"node": "/dev/sda1", "start": 2048, "size": 131072, "type": "C12A7328-F81F-11D2-BA4B-00A0C93EC93B", "name": "EFI, System"},
+         {"node": "/dev/sda3", "start": 133120, "size": 524288, "type": "0FC63DAF-8483-4772-8E79-3D69D8477DE4", "name": "rootfs"}
+      ]
+   }
+}`
+
+func TestImagePartitionLayoutFrom(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	context := debos.DebosContext{&debos.CommonContext{}, dir, ""}
+	assert.Empty(t, ioutil.WriteFile(path.Join(dir, "layout.dump"), []byte(sfdiskDump), 0644))
+	assert.Empty(t, ioutil.WriteFile(path.Join(dir, "layout.json"), []byte(sfdiskJSON), 0644))
+
+	for _, file := range []string{"layout.dump", "layout.json"} {
+		i := ImagePartitionAction{
+			ImageName:  "disk.img",
+			ImageSize:  "512MB",
+			LayoutFrom: file,
+			Partitions: []Partition{
+				{Name: "efi", FS: "vfat", Number: 1},
+				{Name: "rootfs", FS: "ext4"},
+			},
+		}
+		assert.Empty(t, i.Verify(&context), file)
+		assert.Equal(t, "gpt", i.PartitionType)
+		assert.Equal(t, 1, i.Partitions[0].number)
+		assert.Equal(t, 3, i.Partitions[1].number)
+		assert.Equal(t, "EFI, System", i.layout.partitions[0].name)
+		assert.Equal(t, int64(133120), i.layout.partitions[1].start)
+		assert.NotContains(t, i.layout.headers, "device: /dev/sda")
+		assert.Contains(t, i.layout.partitions[1].fields, "type=0FC63DAF-8483-4772-8E79-3D69D8477DE4")
+
+		i.Partitions[1].Name = "root"
+		assert.EqualError(t, i.Verify(&context),
+			"Partition root: no partition named root in the layout, set its number")
+
+		i.Partitions[1].Number = 1
+		assert.EqualError(t, i.Verify(&context), "Partitions efi and root are both partition 1 of the layout")
+
+		i.Partitions[1].Number = 3
+		i.PartitionType = "msdos"
+		assert.EqualError(t, i.Verify(&context), "partitiontype msdos doesn't match the gpt label of "+file)
+
+		i.PartitionType = ""
+		i.ImageSize = "256MB"
+		assert.EqualError(t, i.Verify(&context),
+			"Partition 3 of "+file+" ends at 336592896 bytes, past the end of the 256000000 bytes image")
+	}
+}
+
+func TestSortMountpoints(t *testing.T) {
+	mountpoints := []Mountpoint{
+		{Mountpoint: "/boot/efi"},
+		{Mountpoint: "/var/lib/"},
+		{Mountpoint: "/boot/"},
+		{Mountpoint: "/"},
+		{Mountpoint: "/var"},
+	}
+	sortMountpoints(mountpoints)
+
+	var sorted []string
+	for _, m := range mountpoints {
+		sorted = append(sorted, m.Mountpoint)
+	}
+	assert.Equal(t, []string{"/", "/boot/", "/var", "/boot/efi", "/var/lib/"}, sorted)
+}
+
+func TestMountpointContent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.Empty(t, mountpointContent(dir))
+	assert.Empty(t, mountpointContent(path.Join(dir, "missing")))
+
+	assert.Empty(t, ioutil.WriteFile(path.Join(dir, "vmlinuz"), []byte{}, 0644))
+	assert.Equal(t, []string{"vmlinuz"}, mountpointContent(dir))
+}
+
+/* Replace losetup by a script tracking the attached devices in dir, failing
+ * to find a free device up to the attempt written in the fail file */
+func fakeLosetup(t *testing.T, dir string) func() string {
+	script := `#!/bin/sh
+state="` + dir + `"
+case "$1" in
+--find)
+	n=$(( $(cat "$state/attempts" 2>/dev/null || echo 0) + 1 ))
+	echo $n > "$state/attempts"
+	if [ $n -le "$(cat "$state/fail" 2>/dev/null || echo 0)" ]; then
+		echo "losetup: cannot find an unused loop device" >&2
+		exit 1
+	fi
+	echo /dev/loop$n >> "$state/attached"
+	echo /dev/loop$n
+	;;
+--detach)
+	grep -v -x "$2" "$state/attached" > "$state/detached"
+	mv "$state/detached" "$state/attached"
+	;;
+esac
+`
+	losetup := path.Join(dir, "losetup")
+	assert.Empty(t, ioutil.WriteFile(losetup, []byte(script), 0755))
+
+	command, delay := losetupCommand, loopRetryDelay
+	losetupCommand, loopRetryDelay = losetup, 0
+	t.Cleanup(func() { losetupCommand, loopRetryDelay = command, delay })
+
+	return func() string {
+		attached, _ := ioutil.ReadFile(path.Join(dir, "attached"))
+		return string(attached)
+	}
+}
+
+func TestLoopDevicesRetry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+	attached := fakeLosetup(t, dir)
+
+	assert.Empty(t, ioutil.WriteFile(path.Join(dir, "fail"), []byte("3"), 0644))
+	loops := loopDevices{}
+	dev, err := loops.attach("disk.img")
+	assert.Empty(t, err)
+	assert.Equal(t, "/dev/loop4", dev)
+	assert.Equal(t, "/dev/loop4\n", attached())
+
+	assert.Empty(t, loops.detachAll())
+	assert.Equal(t, "", attached())
+	assert.Empty(t, loops.devices)
+}
+
+func TestImagePartitionLoopTeardown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+	attached := fakeLosetup(t, dir)
+
+	cwd, err := os.Getwd()
+	assert.Empty(t, err)
+	assert.Empty(t, os.Chdir(dir))
+	defer os.Chdir(cwd)
+
+	context := debos.DebosContext{&debos.CommonContext{Artifactdir: dir}, "", ""}
+	i := ImagePartitionAction{ImageName: "disk.img", size: 4096}
+	assert.Empty(t, i.PreNoMachine(&context))
+	assert.Equal(t, "/dev/loop1", context.Image)
+
+	// A further device can't be allocated and the build fails
+	assert.Empty(t, ioutil.WriteFile(path.Join(dir, "fail"), []byte("1000"), 0644))
+	_, err = i.loop.attach("disk.img")
+	assert.EqualError(t, err, "Failed to setup loop device for disk.img: exit status 1: losetup: cannot find an unused loop device")
+	assert.Equal(t, "/dev/loop1\n", attached())
+	context.State = debos.Failed
+
+	assert.Empty(t, i.PostMachineCleanup(&context))
+	assert.Equal(t, "", attached())
+	_, err = os.Stat(path.Join(dir, "disk.img"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+/* Write a GPT partitioned image of the given size in sectors, with the
+ * partitions given by their first and last sector */
+func writeTestGPT(t *testing.T, image string, sectors uint64, partitions [][2]uint64) []byte {
+	const numEntries, entrySize = 128, 128
+	f, err := os.Create(image)
+	assert.Empty(t, err)
+	defer f.Close()
+	assert.Empty(t, f.Truncate(int64(sectors*512)))
+
+	entries := make([]byte, numEntries*entrySize)
+	for n, p := range partitions {
+		entry := entries[n*entrySize : (n+1)*entrySize]
+		copy(entry[0:16], "linux-filesystem")
+		copy(entry[16:32], fmt.Sprintf("partition-%06d", n))
+		binary.LittleEndian.PutUint64(entry[32:40], p[0])
+		binary.LittleEndian.PutUint64(entry[40:48], p[1])
+	}
+	entriesSectors := uint64(len(entries) / 512)
+	lastLBA := sectors - 1
+
+	header := func(my, alternate, entriesLBA uint64) []byte {
+		h := make([]byte, 512)
+		copy(h[0:8], "EFI PART")
+		binary.LittleEndian.PutUint32(h[8:12], 0x00010000)
+		binary.LittleEndian.PutUint32(h[12:16], 92)
+		binary.LittleEndian.PutUint64(h[24:32], my)
+		binary.LittleEndian.PutUint64(h[32:40], alternate)
+		binary.LittleEndian.PutUint64(h[40:48], 2+entriesSectors)
+		binary.LittleEndian.PutUint64(h[48:56], lastLBA-entriesSectors-1)
+		copy(h[56:72], "debos-disk-guid!")
+		binary.LittleEndian.PutUint64(h[72:80], entriesLBA)
+		binary.LittleEndian.PutUint32(h[80:84], numEntries)
+		binary.LittleEndian.PutUint32(h[84:88], entrySize)
+		binary.LittleEndian.PutUint32(h[88:92], crc32.ChecksumIEEE(entries))
+		binary.LittleEndian.PutUint32(h[16:20], crc32.ChecksumIEEE(h[:92]))
+		return h
+	}
+
+	mbr := make([]byte, 512)
+	mbr[446+4] = 0xee
+	binary.LittleEndian.PutUint32(mbr[446+8:446+12], 1)
+	binary.LittleEndian.PutUint32(mbr[446+12:446+16], uint32(lastLBA))
+	mbr[510], mbr[511] = 0x55, 0xaa
+
+	for offset, data := range map[uint64][]byte{
+		0:                        mbr,
+		1:                        header(1, lastLBA, 2),
+		2:                        entries,
+		lastLBA - entriesSectors: entries,
+		lastLBA:                  header(lastLBA, 1, lastLBA-entriesSectors),
+	} {
+		_, err := f.WriteAt(data, int64(offset*512))
+		assert.Empty(t, err)
+	}
+	return entries
+}
+
+// Read the GPT header at the sector, checking its CRCs
+func readTestGPTHeader(t *testing.T, f *os.File, lba uint64) ([]byte, []byte) {
+	h := make([]byte, 512)
+	_, err := f.ReadAt(h, int64(lba*512))
+	assert.Empty(t, err)
+	assert.Equal(t, "EFI PART", string(h[0:8]))
+
+	crc := binary.LittleEndian.Uint32(h[16:20])
+	check := append([]byte{}, h[:92]...)
+	binary.LittleEndian.PutUint32(check[16:20], 0)
+	assert.Equal(t, crc32.ChecksumIEEE(check), crc, "header CRC at LBA %d", lba)
+
+	entries := make([]byte, binary.LittleEndian.Uint32(h[80:84])*binary.LittleEndian.Uint32(h[84:88]))
+	_, err = f.ReadAt(entries, int64(binary.LittleEndian.Uint64(h[72:80])*512))
+	assert.Empty(t, err)
+	assert.Equal(t, binary.LittleEndian.Uint32(h[88:92]), crc32.ChecksumIEEE(entries), "entries CRC at LBA %d", lba)
+	return h, entries
+}
+
+func TestTruncateImageGPT(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	// 64MiB image whose partitions end at 5MiB
+	image := path.Join(dir, "disk.img")
+	entries := writeTestGPT(t, image, 131072, [][2]uint64{{2048, 4095}, {4096, 10239}})
+	assert.Empty(t, truncateImage(image))
+
+	/* The end of the last partition, then the 32 sectors of the backup entries
+	 * and the backup header, rounded up to the MiB */
+	info, err := os.Stat(image)
+	assert.Empty(t, err)
+	assert.Equal(t, int64(12288*512), info.Size())
+	const lastLBA = 12287
+
+	f, err := os.Open(image)
+	assert.Empty(t, err)
+	defer f.Close()
+
+	primary, primaryEntries := readTestGPTHeader(t, f, 1)
+	assert.Equal(t, entries, primaryEntries)
+	assert.Equal(t, uint64(1), binary.LittleEndian.Uint64(primary[24:32]))
+	assert.Equal(t, uint64(lastLBA), binary.LittleEndian.Uint64(primary[32:40]))
+	assert.Equal(t, uint64(lastLBA-32-1), binary.LittleEndian.Uint64(primary[48:56]))
+
+	// The backup header moved to the new last sector
+	backup, backupEntries := readTestGPTHeader(t, f, lastLBA)
+	assert.Equal(t, entries, backupEntries)
+	assert.Equal(t, uint64(lastLBA), binary.LittleEndian.Uint64(backup[24:32]))
+	assert.Equal(t, uint64(1), binary.LittleEndian.Uint64(backup[32:40]))
+	assert.Equal(t, uint64(lastLBA-32), binary.LittleEndian.Uint64(backup[72:80]))
+	assert.Equal(t, primary[40:72], backup[40:72])
+
+	// The protective MBR partition covers the truncated disk
+	mbr := make([]byte, 512)
+	_, err = f.ReadAt(mbr, 0)
+	assert.Empty(t, err)
+	assert.Equal(t, uint32(lastLBA), binary.LittleEndian.Uint32(mbr[446+12:446+16]))
+}
+
+func TestTruncateImageMBR(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	image := path.Join(dir, "disk.img")
+	mbr := make([]byte, 512)
+	for n, p := range [][2]uint32{{2048, 2048}, {4096, 5000}} {
+		entry := mbr[446+16*n : 446+16*(n+1)]
+		entry[4] = 0x83
+		binary.LittleEndian.PutUint32(entry[8:12], p[0])
+		binary.LittleEndian.PutUint32(entry[12:16], p[1])
+	}
+	mbr[510], mbr[511] = 0x55, 0xaa
+	assert.Empty(t, ioutil.WriteFile(image, mbr, 0644))
+	assert.Empty(t, os.Truncate(image, 64*1024*1024))
+
+	assert.Empty(t, truncateImage(image))
+	// The end of the last partition, at sector 9096, rounded up to the MiB
+	info, err := os.Stat(image)
+	assert.Empty(t, err)
+	assert.Equal(t, int64(10240*512), info.Size())
+
+	table, err := ioutil.ReadFile(image)
+	assert.Empty(t, err)
+	assert.Equal(t, mbr, table[:512])
+}
+
+func TestFitExtFilesystem(t *testing.T) {
+	if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+		t.Skip("e2fsprogs isn't installed")
+	}
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+	dev := path.Join(dir, "root.ext4")
+	out, err := exec.Command("mkfs.ext4", "-q", "-F", dev, "64M").CombinedOutput()
+	assert.Empty(t, err, string(out))
+
+	// The partition is resized after shrinking
+	var resized []int64
+	resize := func(size int64) error {
+		// The filesystem never overflows the partition
+		blockSize, blockCount, _, err := ext4Blocks(dev)
+		assert.Empty(t, err)
+		assert.True(t, blockSize*blockCount <= size)
+		resized = append(resized, size)
+		return os.Truncate(dev, size)
+	}
+	size, err := fitExtFilesystem(&context, "fit", dev, units.MiB, resize)
+	assert.Empty(t, err)
+	assert.True(t, size > 0 && size < 64*units.MiB)
+	assert.Equal(t, int64(0), size%units.MiB)
+	assert.Equal(t, []int64{size}, resized)
+	blockSize, blockCount, _, err := ext4Blocks(dev)
+	assert.Empty(t, err)
+	assert.Equal(t, size, blockSize*blockCount)
+
+	// Too small for the slack, the partition is resized before growing
+	size, err = fitExtFilesystem(&context, "fit", dev, 64*units.MiB, resize)
+	assert.Empty(t, err)
+	assert.True(t, size > 64*units.MiB)
+	assert.Equal(t, int64(0), size%units.MiB)
+	assert.Equal(t, size, resized[1])
+	blockSize, blockCount, _, err = ext4Blocks(dev)
+	assert.Empty(t, err)
+	assert.Equal(t, size, blockSize*blockCount)
+	out, err = exec.Command("e2fsck", "-f", "-n", dev).CombinedOutput()
+	assert.Empty(t, err, string(out))
+
+	// The filesystem is left alone when the partition can't be resized
+	_, err = fitExtFilesystem(&context, "fit", dev, 128*units.MiB, func(size int64) error {
+		return fmt.Errorf("No room for %d bytes", size)
+	})
+	assert.Error(t, err)
+	_, count, _, err := ext4Blocks(dev)
+	assert.Empty(t, err)
+	assert.Equal(t, blockCount, count)
+}
+
+func TestPartitionRoom(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+	context.Image = path.Join(dir, "disk.img")
+	assert.Empty(t, ioutil.WriteFile(context.Image, nil, 0644))
+	assert.Empty(t, os.Truncate(context.Image, 64*units.MiB))
+	context.ImagePartitions = []debos.Partition{{Name: "root", Number: 2, Offset: 8 * units.MiB}}
+
+	p := Partition{Name: "root", number: 2}
+	room, err := ImagePartitionAction{PartitionType: "msdos"}.partitionRoom(&p, &context)
+	assert.Empty(t, err)
+	assert.Equal(t, int64(56*units.MiB), room)
+	// Up to the backup partition table
+	room, err = ImagePartitionAction{PartitionType: "gpt"}.partitionRoom(&p, &context)
+	assert.Empty(t, err)
+	assert.Equal(t, int64(56*units.MiB-33*512), room)
+
+	p = Partition{Name: "home", number: 3}
+	_, err = ImagePartitionAction{PartitionType: "gpt"}.partitionRoom(&p, &context)
+	assert.EqualError(t, err, "Failed to find partition named home")
+}
+
+func TestResizePartition(t *testing.T) {
+	if _, err := exec.LookPath("sfdisk"); err != nil {
+		t.Skip("sfdisk isn't installed")
+	}
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	image := path.Join(dir, "disk.img")
+	writeTestGPT(t, image, 131072, [][2]uint64{{2048, 4095}, {4096, 65535}})
+	assert.Empty(t, resizePartition(image, 2, 2*units.MiB))
+
+	f, err := os.Open(image)
+	assert.Empty(t, err)
+	defer f.Close()
+	for _, lba := range []uint64{1, 131071} {
+		_, entries := readTestGPTHeader(t, f, lba)
+		// The start is kept
+		assert.Equal(t, uint64(4096), binary.LittleEndian.Uint64(entries[128+32:128+40]))
+		assert.Equal(t, uint64(4096+4096-1), binary.LittleEndian.Uint64(entries[128+40:128+48]))
+	}
+}
@@ -0,0 +1,127 @@
+/*
+Include Action
+
+This action splices the actions of another YAML file into the current recipe,
+at the position of the include. Unlike the 'recipe' action, the included
+actions are part of the including recipe: they share its context and
+template variables, and there is no separate architecture check.
+
+The included file uses the same format as a recipe, but the 'architecture'
+property is optional; if set it must match the one of the including recipe.
+Included files can include other files, include cycles are reported as an
+error.
+
+The included actions resolve relative paths against the directory of the
+top-level recipe. To refer to files next to the included file use the origin
+registered by this action.
+
+Yaml syntax:
+ - action: include
+   file: path to file
+   name: common
+
+Mandatory properties:
+
+- file -- path of the file to include, relative to the directory of the
+including file.
+
+Optional properties:
+
+- name -- name of the origin pointing to the directory of the included file,
+which can be used by the included actions via their 'origin' property. By
+default the value of 'file' is used.
+*/
+package actions
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-debos/debos"
+	"github.com/go-debos/fakemachine"
+)
+
+type IncludeAction struct {
+	debos.BaseAction `yaml:",inline"`
+	File             string
+	Name             string
+	dir              string
+}
+
+func (inc *IncludeAction) Verify(context *debos.DebosContext) error {
+	if len(inc.File) == 0 {
+		return errors.New("'file' property can't be empty")
+	}
+
+	name := inc.Name
+	if name == "" {
+		name = inc.File
+	}
+	context.Origins[name] = inc.dir
+
+	return nil
+}
+
+func (inc *IncludeAction) PreMachine(context *debos.DebosContext, m *fakemachine.Machine, args *[]string) error {
+	m.AddVolume(inc.dir)
+	return nil
+}
+
+// Resolve the included file relative to the directory of the including one
+func (inc *IncludeAction) path(dir string) string {
+	file := inc.File
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(dir, file)
+	}
+	file = filepath.Clean(file)
+	inc.dir = filepath.Dir(file)
+
+	return file
+}
+
+/* Replace the include actions by the actions of the included files,
+ * recursively. chain holds the files currently being included */
+func (r *Recipe) expandIncludes(chain []string, printRecipe bool, dump bool, templateVars map[string]string) error {
+	var actions []YamlAction
+
+	for _, a := range r.Actions {
+		actions = append(actions, a)
+
+		inc, ok := a.Action.(*IncludeAction)
+		if !ok {
+			continue
+		}
+		if len(inc.File) == 0 {
+			// Reported by Verify
+			continue
+		}
+
+		file := inc.path(filepath.Dir(chain[len(chain)-1]))
+		for _, f := range chain {
+			if f == file {
+				return fmt.Errorf("Include cycle: %s -> %s", strings.Join(chain, " -> "), file)
+			}
+		}
+
+		included := Recipe{}
+		if err := included.render(file, printRecipe, dump, templateVars); err != nil {
+			return err
+		}
+		if included.Architecture != "" && included.Architecture != r.Architecture {
+			return fmt.Errorf("Expect architecture '%s' but got '%s' in %s",
+				r.Architecture, included.Architecture, file)
+		}
+		included.Architecture = r.Architecture
+
+		if err := included.expandIncludes(append(chain, file), printRecipe, dump, templateVars); err != nil {
+			return err
+		}
+		actions = append(actions, included.Actions...)
+		r.undefined = append(r.undefined, included.undefined...)
+	}
+
+	r.Actions = actions
+	return nil
+}
@@ -0,0 +1,112 @@
+package actions_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/go-debos/debos"
+	"github.com/go-debos/debos/actions"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeRecipe(t *testing.T, file, content string) {
+	assert.Empty(t, os.MkdirAll(path.Dir(file), 0755))
+	assert.Empty(t, ioutil.WriteFile(file, []byte(content), 0644))
+}
+
+func TestInclude(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	writeRecipe(t, path.Join(dir, "main.yaml"), `
+architecture: amd64
+
+actions:
+  - action: run
+    command: first.sh
+  - action: include
+    file: common/base.yaml
+    name: base
+  - action: run
+    command: last.sh
+`)
+	writeRecipe(t, path.Join(dir, "common/base.yaml"), `
+actions:
+  - action: run
+    command: {{ .command }}
+  - action: include
+    file: ../extra.yaml
+`)
+	writeRecipe(t, path.Join(dir, "extra.yaml"), `
+architecture: amd64
+
+actions:
+  - action: run
+    command: extra.sh
+`)
+
+	r := actions.Recipe{}
+	err = r.Parse(path.Join(dir, "main.yaml"), false, false, map[string]string{"command": "templated.sh"})
+	assert.Empty(t, err)
+
+	var commands []string
+	for _, a := range r.Actions {
+		switch action := a.Action.(type) {
+		case *actions.RunAction:
+			commands = append(commands, action.Command)
+		case *actions.IncludeAction:
+			commands = append(commands, "include "+action.File)
+		}
+	}
+	assert.Equal(t, []string{
+		"first.sh",
+		"include common/base.yaml",
+		"templated.sh",
+		"include ../extra.yaml",
+		"extra.sh",
+		"last.sh",
+	}, commands)
+
+	// The directory of included files is registered as origin
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+	context.Origins = map[string]string{}
+	for _, a := range r.Actions {
+		if _, ok := a.Action.(*actions.IncludeAction); ok {
+			assert.Empty(t, a.Verify(&context))
+		}
+	}
+	assert.Equal(t, map[string]string{
+		"base":          path.Join(dir, "common"),
+		"../extra.yaml": dir,
+	}, context.Origins)
+
+	// Include cycles are detected
+	writeRecipe(t, path.Join(dir, "extra.yaml"), `
+actions:
+  - action: include
+    file: common/base.yaml
+`)
+	r = actions.Recipe{}
+	err = r.Parse(path.Join(dir, "main.yaml"), false, false, map[string]string{"command": "templated.sh"})
+	assert.EqualError(t, err, "Include cycle: "+
+		path.Join(dir, "main.yaml")+" -> "+
+		path.Join(dir, "common/base.yaml")+" -> "+
+		path.Join(dir, "extra.yaml")+" -> "+
+		path.Join(dir, "common/base.yaml"))
+
+	// Included files must be for the same architecture
+	writeRecipe(t, path.Join(dir, "extra.yaml"), `
+architecture: armhf
+
+actions:
+  - action: run
+    command: extra.sh
+`)
+	r = actions.Recipe{}
+	err = r.Parse(path.Join(dir, "main.yaml"), false, false, map[string]string{"command": "templated.sh"})
+	assert.EqualError(t, err,
+		"Expect architecture 'amd64' but got 'armhf' in "+path.Join(dir, "extra.yaml"))
+}
@@ -0,0 +1,158 @@
+/*
+JournalForward Action
+
+Configure the target rootfs to forward its logs to a remote endpoint and
+enable the forwarding service, so devices ship their logs from the first boot.
+The packages needed for the selected method are installed with 'apt'.
+
+Yaml syntax:
+ - action: journal-forward
+   method: journal-upload
+   url: https://logs.example.com:19532
+   server-key-file: /etc/ssl/private/journal-upload.pem
+   server-certificate-file: /etc/ssl/certs/journal-upload.pem
+   trusted-certificate-file: /etc/ssl/certs/ca.pem
+
+Mandatory properties:
+
+- url -- remote endpoint to forward the logs to. For the 'journal-upload'
+method the scheme must be 'http' or 'https'. For the 'rsyslog' method the
+scheme must be 'tcp' or 'udp' and a port is required, for example
+'tcp://logs.example.com:514'.
+
+Optional properties:
+
+- method -- forwarding method to use, either 'journal-upload' to use
+systemd-journal-upload or 'rsyslog'. The default value is 'journal-upload'.
+
+- server-key-file -- path in the target rootfs of the SSL key used by
+systemd-journal-upload. Only supported by the 'journal-upload' method.
+
+- server-certificate-file -- path in the target rootfs of the SSL certificate
+used by systemd-journal-upload. Only supported by the 'journal-upload' method.
+
+- trusted-certificate-file -- path in the target rootfs of the SSL CA
+certificate used to verify the remote endpoint. Only supported by the
+'journal-upload' method.
+*/
+package actions
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/go-debos/debos"
+)
+
+type JournalForwardAction struct {
+	debos.BaseAction       `yaml:",inline"`
+	Method                 string
+	Url                    string
+	ServerKeyFile          string `yaml:"server-key-file"`
+	ServerCertificateFile  string `yaml:"server-certificate-file"`
+	TrustedCertificateFile string `yaml:"trusted-certificate-file"`
+}
+
+func NewJournalForwardAction() *JournalForwardAction {
+	jf := JournalForwardAction{}
+	jf.Method = "journal-upload"
+
+	return &jf
+}
+
+func (jf *JournalForwardAction) Verify(context *debos.DebosContext) error {
+	if len(jf.Url) == 0 {
+		return fmt.Errorf("'url' property can't be empty")
+	}
+
+	u, err := url.Parse(jf.Url)
+	if err != nil {
+		return err
+	}
+	if u.Host == "" {
+		return fmt.Errorf("No host in URL '%s'", jf.Url)
+	}
+
+	switch jf.Method {
+	case "journal-upload":
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("Unsupported URL '%s' for journal-upload, expected http or https", jf.Url)
+		}
+	case "rsyslog":
+		if u.Scheme != "tcp" && u.Scheme != "udp" {
+			return fmt.Errorf("Unsupported URL '%s' for rsyslog, expected tcp or udp", jf.Url)
+		}
+		if u.Port() == "" {
+			return fmt.Errorf("No port in URL '%s'", jf.Url)
+		}
+		if jf.ServerKeyFile != "" || jf.ServerCertificateFile != "" || jf.TrustedCertificateFile != "" {
+			return fmt.Errorf("Certificates are only supported by the journal-upload method")
+		}
+	default:
+		return fmt.Errorf("Unsupported forwarding method '%s'", jf.Method)
+	}
+
+	return nil
+}
+
+// Returns the config file in the rootfs, its content and the service to enable
+func (jf *JournalForwardAction) config() (string, string, string) {
+	var lines []string
+
+	if jf.Method == "rsyslog" {
+		u, _ := url.Parse(jf.Url)
+		forward := "@"
+		if u.Scheme == "tcp" {
+			forward = "@@"
+		}
+		lines = append(lines, fmt.Sprintf("*.* %s%s", forward, u.Host))
+		return "/etc/rsyslog.d/90-debos-forward.conf",
+			strings.Join(lines, "\n") + "\n", "rsyslog.service"
+	}
+
+	lines = append(lines, "[Upload]", fmt.Sprintf("URL=%s", jf.Url))
+	if jf.ServerKeyFile != "" {
+		lines = append(lines, fmt.Sprintf("ServerKeyFile=%s", jf.ServerKeyFile))
+	}
+	if jf.ServerCertificateFile != "" {
+		lines = append(lines, fmt.Sprintf("ServerCertificateFile=%s", jf.ServerCertificateFile))
+	}
+	if jf.TrustedCertificateFile != "" {
+		lines = append(lines, fmt.Sprintf("TrustedCertificateFile=%s", jf.TrustedCertificateFile))
+	}
+	return "/etc/systemd/journal-upload.conf.d/90-debos.conf",
+		strings.Join(lines, "\n") + "\n", "systemd-journal-upload.service"
+}
+
+func (jf *JournalForwardAction) configure(context *debos.DebosContext) error {
+	file, content, service := jf.config()
+
+	target := path.Join(context.Rootdir, file)
+	if err := os.MkdirAll(path.Dir(target), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(target, []byte(content), 0644); err != nil {
+		return fmt.Errorf("Couldn't write %s: %v", file, err)
+	}
+
+	services := debos.SystemdHelper{Rootdir: context.Rootdir}
+	return services.Enable(service)
+}
+
+func (jf *JournalForwardAction) Run(context *debos.DebosContext) error {
+	jf.LogStart()
+
+	pkg := "systemd-journal-remote"
+	if jf.Method == "rsyslog" {
+		pkg = "rsyslog"
+	}
+	if err := installPackages(context, pkg); err != nil {
+		return err
+	}
+
+	return jf.configure(context)
+}
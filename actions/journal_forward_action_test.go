@@ -0,0 +1,64 @@
+package actions
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/go-debos/debos"
+	"github.com/stretchr/testify/assert"
+)
+
+func fakeUnit(t *testing.T, rootdir, unit, install string) {
+	dir := path.Join(rootdir, "lib/systemd/system")
+	assert.Empty(t, os.MkdirAll(dir, 0755))
+	content := "[Unit]\nDescription=" + unit + "\n\n[Install]\n" + install + "\n"
+	assert.Empty(t, ioutil.WriteFile(path.Join(dir, unit), []byte(content), 0644))
+}
+
+func TestJournalForward(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+	context.Rootdir = dir
+	fakeUnit(t, dir, "systemd-journal-upload.service", "WantedBy=multi-user.target")
+	fakeUnit(t, dir, "rsyslog.service", "WantedBy=multi-user.target\nAlias=syslog.service")
+
+	jf := NewJournalForwardAction()
+	jf.Url = "https://logs.example.com:19532"
+	jf.TrustedCertificateFile = "/etc/ssl/certs/ca.pem"
+	assert.Empty(t, jf.Verify(&context))
+	assert.Empty(t, jf.configure(&context))
+
+	conf, err := ioutil.ReadFile(path.Join(dir, "etc/systemd/journal-upload.conf.d/90-debos.conf"))
+	assert.Empty(t, err)
+	assert.Equal(t, "[Upload]\nURL=https://logs.example.com:19532\nTrustedCertificateFile=/etc/ssl/certs/ca.pem\n", string(conf))
+
+	link, err := os.Readlink(path.Join(dir, "etc/systemd/system/multi-user.target.wants/systemd-journal-upload.service"))
+	assert.Empty(t, err)
+	assert.Equal(t, "/lib/systemd/system/systemd-journal-upload.service", link)
+
+	jf = NewJournalForwardAction()
+	jf.Method = "rsyslog"
+	jf.Url = "tcp://logs.example.com:514"
+	assert.Empty(t, jf.Verify(&context))
+	assert.Empty(t, jf.configure(&context))
+
+	conf, err = ioutil.ReadFile(path.Join(dir, "etc/rsyslog.d/90-debos-forward.conf"))
+	assert.Empty(t, err)
+	assert.Equal(t, "*.* @@logs.example.com:514\n", string(conf))
+
+	link, err = os.Readlink(path.Join(dir, "etc/systemd/system/syslog.service"))
+	assert.Empty(t, err)
+	assert.Equal(t, "/lib/systemd/system/rsyslog.service", link)
+
+	// Invalid endpoints are refused
+	jf.Url = "udp://logs.example.com"
+	assert.EqualError(t, jf.Verify(&context), "No port in URL 'udp://logs.example.com'")
+	jf.Method = "journal-upload"
+	assert.EqualError(t, jf.Verify(&context),
+		"Unsupported URL 'udp://logs.example.com' for journal-upload, expected http or https")
+}
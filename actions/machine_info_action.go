@@ -0,0 +1,119 @@
+/*
+MachineInfo Action
+
+Write '/etc/machine-info' in the target rootfs, providing the metadata used by
+systemd-hostnamed and 'hostnamectl' to identify the machine in a fleet.
+
+Yaml syntax:
+ - action: machine-info
+   pretty-hostname: "Kitchen display"
+   chassis: embedded
+   deployment: production
+   location: "Building 1, floor 2"
+
+Optional properties (at least one must be set):
+
+- pretty-hostname -- descriptive free-form hostname.
+
+- chassis -- chassis type, one of 'desktop', 'laptop', 'convertible', 'server',
+'tablet', 'handset', 'watch', 'embedded', 'vm' or 'container'.
+
+- deployment -- deployment environment, for example 'development',
+'integration', 'staging' or 'production'.
+
+- location -- free-form description of the machine location.
+*/
+package actions
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/go-debos/debos"
+)
+
+type MachineInfoAction struct {
+	debos.BaseAction `yaml:",inline"`
+	PrettyHostname   string `yaml:"pretty-hostname"`
+	Chassis          string
+	Deployment       string
+	Location         string
+}
+
+var chassisTypes = []string{
+	"desktop", "laptop", "convertible", "server", "tablet",
+	"handset", "watch", "embedded", "vm", "container",
+}
+
+// Quote a value so it can be parsed by both systemd and a shell
+func quoteEnvValue(value string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `\$`, "`", "\\`")
+	return `"` + r.Replace(value) + `"`
+}
+
+func (mi *MachineInfoAction) Verify(context *debos.DebosContext) error {
+	if mi.PrettyHostname == "" && mi.Chassis == "" && mi.Deployment == "" && mi.Location == "" {
+		return errors.New("At least one of 'pretty-hostname', 'chassis', 'deployment' or 'location' must be set")
+	}
+
+	if mi.Chassis != "" {
+		valid := false
+		for _, c := range chassisTypes {
+			if mi.Chassis == c {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return fmt.Errorf("Unknown chassis '%s', expected one of: %s", mi.Chassis, strings.Join(chassisTypes, ", "))
+		}
+	}
+
+	if strings.ContainsAny(mi.Deployment, " \t\n") {
+		return fmt.Errorf("Deployment '%s' can't contain whitespace", mi.Deployment)
+	}
+
+	for _, v := range []string{mi.PrettyHostname, mi.Location} {
+		if strings.Contains(v, "\n") {
+			return fmt.Errorf("Machine info values can't span multiple lines")
+		}
+	}
+
+	return nil
+}
+
+func (mi *MachineInfoAction) Run(context *debos.DebosContext) error {
+	mi.LogStart()
+	var lines []string
+
+	fields := []struct {
+		key   string
+		value string
+	}{
+		{"PRETTY_HOSTNAME", mi.PrettyHostname},
+		{"CHASSIS", mi.Chassis},
+		{"DEPLOYMENT", mi.Deployment},
+		{"LOCATION", mi.Location},
+	}
+	for _, f := range fields {
+		if f.value != "" {
+			lines = append(lines, fmt.Sprintf("%s=%s", f.key, quoteEnvValue(f.value)))
+		}
+	}
+
+	if err := os.MkdirAll(path.Join(context.Rootdir, "etc"), 0755); err != nil {
+		return err
+	}
+
+	content := strings.Join(lines, "\n") + "\n"
+	err := ioutil.WriteFile(path.Join(context.Rootdir, "etc/machine-info"), []byte(content), 0644)
+	if err != nil {
+		return fmt.Errorf("Couldn't write machine-info: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,82 @@
+package actions_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/go-debos/debos"
+	"github.com/go-debos/debos/actions"
+	"github.com/stretchr/testify/assert"
+)
+
+// Parse a KEY="value" file the way a shell would for simple quoting
+func parseEnvFile(t *testing.T, file string) map[string]string {
+	content, err := ioutil.ReadFile(file)
+	assert.Empty(t, err)
+
+	values := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+		kv := strings.SplitN(line, "=", 2)
+		if !assert.Equal(t, 2, len(kv), "Malformed line: %s", line) {
+			continue
+		}
+		value := kv[1]
+		assert.True(t, strings.HasPrefix(value, `"`) && strings.HasSuffix(value, `"`))
+		value = value[1 : len(value)-1]
+
+		var unquoted strings.Builder
+		for i := 0; i < len(value); i++ {
+			if value[i] == '\\' && i+1 < len(value) {
+				i++
+			}
+			unquoted.WriteByte(value[i])
+		}
+		values[kv[0]] = unquoted.String()
+	}
+
+	return values
+}
+
+func TestMachineInfo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+	context.Rootdir = dir
+
+	mi := actions.MachineInfoAction{
+		PrettyHostname: `Lisa's "kitchen" $display`,
+		Chassis:        "embedded",
+		Deployment:     "production",
+		Location:       "Building 1, floor 2",
+	}
+	assert.Empty(t, mi.Verify(&context))
+	assert.Empty(t, mi.Run(&context))
+
+	values := parseEnvFile(t, path.Join(dir, "etc/machine-info"))
+	assert.Equal(t, map[string]string{
+		"PRETTY_HOSTNAME": `Lisa's "kitchen" $display`,
+		"CHASSIS":         "embedded",
+		"DEPLOYMENT":      "production",
+		"LOCATION":        "Building 1, floor 2",
+	}, values)
+
+	// Unset values are not written
+	mi = actions.MachineInfoAction{Chassis: "vm"}
+	assert.Empty(t, mi.Run(&context))
+	values = parseEnvFile(t, path.Join(dir, "etc/machine-info"))
+	assert.Equal(t, map[string]string{"CHASSIS": "vm"}, values)
+
+	// Chassis must be a known type
+	mi = actions.MachineInfoAction{Chassis: "toaster"}
+	assert.EqualError(t, mi.Verify(&context),
+		"Unknown chassis 'toaster', expected one of: desktop, laptop, convertible, server, tablet, handset, watch, embedded, vm, container")
+
+	mi = actions.MachineInfoAction{}
+	assert.EqualError(t, mi.Verify(&context),
+		"At least one of 'pretty-hostname', 'chassis', 'deployment' or 'location' must be set")
+}
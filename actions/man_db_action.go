@@ -0,0 +1,152 @@
+/*
+ManDb Action
+
+Disable the 'man-db' dpkg trigger, which rebuilds the index of the manual
+pages every time a package shipping some is installed and is slow for no
+benefit on minimal images. The existing index caches are removed.
+
+The trigger is disabled the way 'man-db' supports it: the
+'man-db/auto-update' debconf question is preseeded to 'false' and
+'/var/lib/man-db/auto-update' is removed, so the following 'apt' actions and
+the upgrades of 'man-db' don't rebuild the index. The space freed and the
+number of manual pages which are no longer indexed on each install are
+logged.
+
+Yaml syntax:
+ - action: man-db
+   keep-man-pages: true
+
+Optional properties:
+
+- keep-man-pages -- keep the manual pages of the target rootfs. By default is
+'true'. When 'false' they are removed too, and dpkg is configured through
+'/etc/dpkg/dpkg.cfg.d/50debos-no-man' to not install them anymore.
+*/
+package actions
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/docker/go-units"
+	"github.com/go-debos/debos"
+)
+
+const (
+	manDbAutoUpdate = "/var/lib/man-db/auto-update"
+	manDbCache      = "/var/cache/man"
+	manPages        = "/usr/share/man"
+	manDpkgExclude  = "/etc/dpkg/dpkg.cfg.d/50debos-no-man"
+)
+
+type ManDbAction struct {
+	debos.BaseAction `yaml:",inline"`
+	KeepManPages     bool `yaml:"keep-man-pages"`
+}
+
+func NewManDbAction() *ManDbAction {
+	return &ManDbAction{KeepManPages: true}
+}
+
+// Returns the size and the number of the regular files under dir
+func manFilesSize(dir string) (int64, int, error) {
+	var size int64
+	var count int
+
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+			count++
+		}
+		return nil
+	})
+
+	return size, count, err
+}
+
+// Remove the content of dir, keeping dir itself
+func removeDirContent(dir string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := os.RemoveAll(path.Join(dir, e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *ManDbAction) configure(context *debos.DebosContext) error {
+	if err := os.Remove(path.Join(context.Rootdir, manDbAutoUpdate)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	cache := path.Join(context.Rootdir, manDbCache)
+	freed, _, err := manFilesSize(cache)
+	if err != nil {
+		return err
+	}
+	if err := removeDirContent(cache); err != nil {
+		return err
+	}
+
+	pages := path.Join(context.Rootdir, manPages)
+	size, count, err := manFilesSize(pages)
+	if err != nil {
+		return err
+	}
+
+	if m.KeepManPages {
+		log.Printf("man-db trigger disabled, %d manual pages are no longer indexed on each install, %s of caches freed",
+			count, units.BytesSize(float64(freed)))
+		return nil
+	}
+
+	exclude := path.Join(context.Rootdir, manDpkgExclude)
+	if err := os.MkdirAll(path.Dir(exclude), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(exclude, []byte("# Generated by debos\npath-exclude="+manPages+"/*\n"), 0644); err != nil {
+		return fmt.Errorf("Couldn't write %s: %v", manDpkgExclude, err)
+	}
+	if err := removeDirContent(pages); err != nil {
+		return err
+	}
+
+	log.Printf("man-db trigger disabled, %d manual pages removed, %s freed",
+		count, units.BytesSize(float64(freed+size)))
+	return nil
+}
+
+func (m *ManDbAction) Run(context *debos.DebosContext) error {
+	m.LogStart()
+
+	// Applies to the current and the future installs of man-db
+	selections := path.Join(context.Rootdir, "tmp", "debos-man-db")
+	if err := ioutil.WriteFile(selections, []byte("man-db man-db/auto-update boolean false\n"), 0644); err != nil {
+		return err
+	}
+	defer os.Remove(selections)
+
+	c := debos.NewChrootCommandForContext(*context)
+	if err := c.Run("man-db", "debconf-set-selections", "/tmp/debos-man-db"); err != nil {
+		return err
+	}
+
+	return m.configure(context)
+}
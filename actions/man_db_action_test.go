@@ -0,0 +1,64 @@
+package actions
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/go-debos/debos"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeManDbTree(t *testing.T, dir string) {
+	for _, f := range []string{
+		"var/lib/man-db/auto-update",
+		"var/cache/man/index.db",
+		"var/cache/man/fr/index.db",
+		"usr/share/man/man1/ls.1.gz",
+		"usr/share/man/man8/dpkg.8.gz",
+	} {
+		assert.Empty(t, os.MkdirAll(path.Join(dir, path.Dir(f)), 0755))
+		assert.Empty(t, ioutil.WriteFile(path.Join(dir, f), []byte(f), 0644))
+	}
+}
+
+func TestManDb(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+	context.Rootdir = dir
+	writeManDbTree(t, dir)
+
+	m := NewManDbAction()
+	assert.Empty(t, m.configure(&context))
+
+	// The trigger is disabled and the caches are removed
+	_, err = os.Stat(path.Join(dir, "var/lib/man-db/auto-update"))
+	assert.True(t, os.IsNotExist(err))
+	entries, err := ioutil.ReadDir(path.Join(dir, "var/cache/man"))
+	assert.Empty(t, err)
+	assert.Len(t, entries, 0)
+
+	// The manual pages are kept by default
+	_, err = os.Stat(path.Join(dir, "usr/share/man/man1/ls.1.gz"))
+	assert.Empty(t, err)
+	_, err = os.Stat(path.Join(dir, "etc/dpkg/dpkg.cfg.d/50debos-no-man"))
+	assert.True(t, os.IsNotExist(err))
+
+	// Nothing left to do
+	assert.Empty(t, m.configure(&context))
+
+	writeManDbTree(t, dir)
+	m.KeepManPages = false
+	assert.Empty(t, m.configure(&context))
+
+	entries, err = ioutil.ReadDir(path.Join(dir, "usr/share/man"))
+	assert.Empty(t, err)
+	assert.Len(t, entries, 0)
+	conf, err := ioutil.ReadFile(path.Join(dir, "etc/dpkg/dpkg.cfg.d/50debos-no-man"))
+	assert.Empty(t, err)
+	assert.Equal(t, "# Generated by debos\npath-exclude=/usr/share/man/*\n", string(conf))
+}
@@ -0,0 +1,79 @@
+/*
+Multiarch Action
+
+Enable foreign architectures in the target rootfs with 'dpkg
+--add-architecture', then update the package lists, so the following 'apt'
+actions can install their packages, like 'libc6:i386' to run 32-bit binaries
+on an amd64 system. The architectures are recorded by dpkg in the target
+rootfs, so they stay enabled for the rest of the recipe and in the image.
+
+Yaml syntax:
+ - action: multiarch
+   architectures:
+     - i386
+
+Mandatory properties:
+
+- architectures -- list of the dpkg architectures to enable, other than the
+one of the recipe.
+
+The 'apt-proxy' and 'apt-snapshot' recipe properties apply to this action.
+*/
+package actions
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/go-debos/debos"
+)
+
+// Architectures of dpkg, of the official and of the ports ones of Debian
+var dpkgArchitectures = map[string]bool{
+	"alpha": true, "amd64": true, "arm64": true, "armel": true, "armhf": true,
+	"hppa": true, "hurd-amd64": true, "hurd-i386": true, "i386": true,
+	"loong64": true, "m68k": true, "mips64el": true, "mipsel": true,
+	"powerpc": true, "ppc64": true, "ppc64el": true, "riscv64": true,
+	"s390x": true, "sh4": true, "sparc64": true, "x32": true,
+}
+
+type MultiarchAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Architectures    []string
+}
+
+func (m *MultiarchAction) Verify(context *debos.DebosContext) error {
+	if len(m.Architectures) == 0 {
+		return errors.New("'architectures' property can't be empty")
+	}
+
+	for _, a := range m.Architectures {
+		if !dpkgArchitectures[a] {
+			return fmt.Errorf("Unknown dpkg architecture '%s'", a)
+		}
+		if a == context.Architecture {
+			return fmt.Errorf("Architecture '%s' is the one of the recipe", a)
+		}
+	}
+
+	return nil
+}
+
+func (m *MultiarchAction) Run(context *debos.DebosContext) error {
+	m.LogStart()
+
+	c := debos.NewChrootCommandForContext(*context)
+	for _, a := range m.Architectures {
+		if err := c.Run("dpkg", "dpkg", "--add-architecture", a); err != nil {
+			return err
+		}
+	}
+
+	removeConfig, err := setupAptConfig(context)
+	if err != nil {
+		return err
+	}
+	defer removeConfig()
+
+	return c.Run("apt", "apt-get", "update")
+}
@@ -0,0 +1,25 @@
+package actions_test
+
+import (
+	"testing"
+
+	"github.com/go-debos/debos"
+	"github.com/go-debos/debos/actions"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMultiarchVerify(t *testing.T) {
+	context := debos.DebosContext{&debos.CommonContext{}, "", "amd64"}
+
+	m := actions.MultiarchAction{}
+	assert.EqualError(t, m.Verify(&context), "'architectures' property can't be empty")
+
+	m.Architectures = []string{"i386", "arm64"}
+	assert.Empty(t, m.Verify(&context))
+
+	m.Architectures = []string{"x86"}
+	assert.EqualError(t, m.Verify(&context), "Unknown dpkg architecture 'x86'")
+
+	m.Architectures = []string{"amd64"}
+	assert.EqualError(t, m.Verify(&context), "Architecture 'amd64' is the one of the recipe")
+}
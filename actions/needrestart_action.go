@@ -0,0 +1,125 @@
+/*
+Needrestart Action
+
+Install 'needrestart' in the target rootfs and configure it so apt never
+waits for an answer after upgrading packages, which would hang unattended
+upgrades. The configuration is written to
+'/etc/needrestart/conf.d/50debos.conf', overriding the defaults of the
+package.
+
+Yaml syntax:
+ - action: needrestart
+   mode: automatic
+   kernel-hints: false
+   microcode-hints: false
+
+Optional properties:
+
+- mode -- what needrestart does with the services using outdated libraries:
+
+ - automatic -- restart them. This is the default.
+
+ - list -- only list them.
+
+ - interactive -- ask which ones to restart, only for systems which are
+ upgraded by hand.
+
+ - disabled -- remove needrestart from the target rootfs if it is installed
+ rather than configuring it.
+
+- kernel-hints -- notify the pending kernel upgrades interactively. By default
+is 'false': they are only printed.
+
+- microcode-hints -- notify the pending microcode upgrades. By default is
+'false'.
+*/
+package actions
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/go-debos/debos"
+)
+
+const needrestartConf = "/etc/needrestart/conf.d/50debos.conf"
+
+// Values of $nrconf{restart} per mode
+var needrestartModes = map[string]string{
+	"automatic":   "a",
+	"list":        "l",
+	"interactive": "i",
+	"disabled":    "",
+}
+
+type NeedrestartAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Mode             string
+	KernelHints      bool `yaml:"kernel-hints"`
+	MicrocodeHints   bool `yaml:"microcode-hints"`
+}
+
+func NewNeedrestartAction() *NeedrestartAction {
+	return &NeedrestartAction{Mode: "automatic"}
+}
+
+func (n *NeedrestartAction) Verify(context *debos.DebosContext) error {
+	if _, found := needrestartModes[n.Mode]; !found {
+		return fmt.Errorf("Invalid mode '%s', expected automatic, list, interactive or disabled", n.Mode)
+	}
+	if n.Mode == "disabled" && (n.KernelHints || n.MicrocodeHints) {
+		return fmt.Errorf("'kernel-hints' and 'microcode-hints' can't be used with the disabled mode")
+	}
+	return nil
+}
+
+func (n *NeedrestartAction) config() string {
+	// Kernel hints are printed rather than shown in a dialog with -1
+	kernelhints := -1
+	if n.KernelHints {
+		kernelhints = 1
+	}
+	ucodehint := 0
+	if n.MicrocodeHints {
+		ucodehint = 1
+	}
+
+	lines := []string{
+		"# Generated by debos",
+		fmt.Sprintf("$nrconf{restart} = '%s';", needrestartModes[n.Mode]),
+		fmt.Sprintf("$nrconf{kernelhints} = %d;", kernelhints),
+		fmt.Sprintf("$nrconf{ucodehint} = %d;", ucodehint),
+	}
+
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func (n *NeedrestartAction) configure(context *debos.DebosContext) error {
+	conf := path.Join(context.Rootdir, needrestartConf)
+	if err := os.MkdirAll(path.Dir(conf), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(conf, []byte(n.config()), 0644); err != nil {
+		return fmt.Errorf("Couldn't write %s: %v", needrestartConf, err)
+	}
+
+	return nil
+}
+
+func (n *NeedrestartAction) Run(context *debos.DebosContext) error {
+	n.LogStart()
+
+	if n.Mode == "disabled" {
+		cmd := debos.NewChrootCommandForContext(*context)
+		return cmd.Run("needrestart", "dpkg", "--purge", "needrestart")
+	}
+
+	if err := installPackages(context, "needrestart"); err != nil {
+		return err
+	}
+
+	return n.configure(context)
+}
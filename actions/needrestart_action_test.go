@@ -0,0 +1,59 @@
+package actions
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/go-debos/debos"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNeedrestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+	context.Rootdir = dir
+
+	n := NewNeedrestartAction()
+	assert.Empty(t, n.Verify(&context))
+	assert.Empty(t, n.configure(&context))
+
+	conf, err := ioutil.ReadFile(path.Join(dir, "etc/needrestart/conf.d/50debos.conf"))
+	assert.Empty(t, err)
+	assert.Equal(t, `# Generated by debos
+$nrconf{restart} = 'a';
+$nrconf{kernelhints} = -1;
+$nrconf{ucodehint} = 0;
+`, string(conf))
+
+	n.Mode = "list"
+	n.KernelHints = true
+	n.MicrocodeHints = true
+	assert.Empty(t, n.Verify(&context))
+	assert.Empty(t, n.configure(&context))
+
+	conf, err = ioutil.ReadFile(path.Join(dir, "etc/needrestart/conf.d/50debos.conf"))
+	assert.Empty(t, err)
+	assert.Equal(t, `# Generated by debos
+$nrconf{restart} = 'l';
+$nrconf{kernelhints} = 1;
+$nrconf{ucodehint} = 1;
+`, string(conf))
+
+	n.Mode = "interactive"
+	assert.Empty(t, n.Verify(&context))
+	assert.Contains(t, n.config(), "$nrconf{restart} = 'i';\n")
+
+	n.Mode = "disabled"
+	assert.EqualError(t, n.Verify(&context), "'kernel-hints' and 'microcode-hints' can't be used with the disabled mode")
+	n = NewNeedrestartAction()
+	n.Mode = "disabled"
+	assert.Empty(t, n.Verify(&context))
+
+	n.Mode = "auto"
+	assert.EqualError(t, n.Verify(&context), "Invalid mode 'auto', expected automatic, list, interactive or disabled")
+}
@@ -0,0 +1,456 @@
+/*
+Oci Action
+
+Export the target rootfs as a container image, so the same recipe can build
+both a disk image and a container base image. The image has a single layer
+made of the whole rootfs and is written to the artifact directory as a tarball
+of an OCI image layout, or in the format of 'docker save' to be loaded with
+'docker load'.
+
+Yaml syntax:
+ - action: oci
+   file: filename.tar
+   format: oci
+   tag: name:tag
+   entrypoint:
+     - /bin/sh
+     - -c
+   cmd:
+     - command
+   env:
+     - NAME=value
+   working-dir: path
+   user: name
+   labels:
+     name: value
+
+Mandatory properties:
+
+- file -- name of the output tarball, relative to the artifact directory.
+
+Optional properties:
+
+- format -- either 'oci' for a tarball of an OCI image layout, which can be
+imported with 'skopeo copy oci-archive:filename.tar' or 'podman load', or
+'docker' for the format of 'docker save'. By default 'oci'.
+
+- tag -- reference of the image, like 'example/base:latest', set as
+'org.opencontainers.image.ref.name' of the OCI index, or used to tag the
+image loaded by 'docker load'.
+
+- entrypoint -- command run by the containers of the image, as a list of
+arguments.
+
+- cmd -- default arguments of the entry point, or command when there is no
+entry point, as a list of arguments.
+
+- env -- list of environment variables of the containers, in the 'NAME=value'
+form.
+
+- working-dir -- working directory of the containers.
+
+- user -- user the containers run as, by name or id.
+
+- labels -- labels of the image, as a map of names to values.
+
+The layer keeps the owners as numeric ids and the 'security.capability'
+extended attributes, with the entries sorted by name. The creation time of
+the image and the times of the entries of the tarball are the
+'SOURCE_DATE_EPOCH' of the environment when it is set, so identical trees
+give byte identical images. The platform of the image is the architecture of
+the recipe.
+*/
+package actions
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/go-debos/debos"
+)
+
+const (
+	ociManifestType = "application/vnd.oci.image.manifest.v1+json"
+	ociConfigType   = "application/vnd.oci.image.config.v1+json"
+	ociLayerType    = "application/vnd.oci.image.layer.v1.tar+gzip"
+)
+
+// OCI architecture and variant of the Debian architectures
+var ociPlatforms = map[string][2]string{
+	"amd64":    {"amd64", ""},
+	"arm64":    {"arm64", "v8"},
+	"armhf":    {"arm", "v7"},
+	"armel":    {"arm", "v5"},
+	"i386":     {"386", ""},
+	"ppc64el":  {"ppc64le", ""},
+	"s390x":    {"s390x", ""},
+	"riscv64":  {"riscv64", ""},
+	"mips64el": {"mips64le", ""},
+	"mipsel":   {"mipsle", ""},
+}
+
+type OciAction struct {
+	debos.BaseAction `yaml:",inline"`
+	File             string
+	Format           string
+	Tag              string
+	Entrypoint       []string
+	Cmd              []string
+	Env              []string
+	WorkingDir       string `yaml:"working-dir"`
+	User             string
+	Labels           map[string]string
+}
+
+func NewOciAction() *OciAction {
+	return &OciAction{Format: "oci"}
+}
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type ociContainerConfig struct {
+	Entrypoint []string          `json:"Entrypoint,omitempty"`
+	Cmd        []string          `json:"Cmd,omitempty"`
+	Env        []string          `json:"Env,omitempty"`
+	WorkingDir string            `json:"WorkingDir,omitempty"`
+	User       string            `json:"User,omitempty"`
+	Labels     map[string]string `json:"Labels,omitempty"`
+}
+
+type ociHistory struct {
+	Created   string `json:"created"`
+	CreatedBy string `json:"created_by"`
+}
+
+type ociImageConfig struct {
+	Created      string             `json:"created"`
+	Architecture string             `json:"architecture"`
+	Variant      string             `json:"variant,omitempty"`
+	OS           string             `json:"os"`
+	Config       ociContainerConfig `json:"config"`
+	RootFS       struct {
+		Type    string   `json:"type"`
+		DiffIDs []string `json:"diff_ids"`
+	} `json:"rootfs"`
+	History []ociHistory `json:"history"`
+}
+
+type ociManifest struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType"`
+	Config        ociDescriptor   `json:"config"`
+	Layers        []ociDescriptor `json:"layers"`
+}
+
+type ociIndex struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType"`
+	Manifests     []ociDescriptor `json:"manifests"`
+}
+
+type dockerManifest struct {
+	Config   string
+	RepoTags []string `json:",omitempty"`
+	Layers   []string
+}
+
+func (o *OciAction) Verify(context *debos.DebosContext) error {
+	if o.File == "" {
+		return fmt.Errorf("'file' property can't be empty")
+	}
+	if strings.HasPrefix(path.Clean(o.File), "..") || path.IsAbs(o.File) {
+		return fmt.Errorf("Image %s must be relative to the artifact directory", o.File)
+	}
+
+	switch o.Format {
+	case "oci", "docker":
+	default:
+		return fmt.Errorf("Unsupported container image format '%s', expected oci or docker", o.Format)
+	}
+
+	if strings.ContainsAny(o.Tag, " \t\n") {
+		return fmt.Errorf("Invalid tag '%s'", o.Tag)
+	}
+	for _, e := range o.Env {
+		if strings.Index(e, "=") <= 0 {
+			return fmt.Errorf("Invalid environment variable '%s', expected NAME=value", e)
+		}
+	}
+	return nil
+}
+
+// Digest of the content, as a descriptor of the given media type
+func bytesDescriptor(mediaType string, content []byte) ociDescriptor {
+	sum := sha256.Sum256(content)
+	return ociDescriptor{
+		MediaType: mediaType,
+		Digest:    "sha256:" + hex.EncodeToString(sum[:]),
+		Size:      int64(len(content)),
+	}
+}
+
+// Compress the file, without name nor time in the gzip header
+func gzipFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	gz := gzip.NewWriter(out)
+	if _, err := io.Copy(gz, in); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+/* Tarball of the image, with all the entries owned by root and of the same
+ * time */
+type ociArchive struct {
+	tw    *tar.Writer
+	mtime time.Time
+}
+
+func (a *ociArchive) addDir(name string) error {
+	return a.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeDir, Name: name + "/", Mode: 0755, ModTime: a.mtime,
+	})
+}
+
+func (a *ociArchive) addBytes(name string, content []byte) error {
+	err := a.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg, Name: name, Mode: 0644, Size: int64(len(content)), ModTime: a.mtime,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = a.tw.Write(content)
+	return err
+}
+
+func (a *ociArchive) addFile(name, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	err = a.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg, Name: name, Mode: 0644, Size: info.Size(), ModTime: a.mtime,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(a.tw, f)
+	return err
+}
+
+// Configuration of the image, with its single layer
+func (o *OciAction) imageConfig(architecture string, created time.Time, diffID string) (*ociImageConfig, error) {
+	platform, found := ociPlatforms[architecture]
+	if !found {
+		return nil, fmt.Errorf("No container platform for the %s architecture", architecture)
+	}
+
+	config := &ociImageConfig{
+		Created:      created.UTC().Format(time.RFC3339),
+		Architecture: platform[0],
+		Variant:      platform[1],
+		OS:           "linux",
+		Config: ociContainerConfig{
+			Entrypoint: o.Entrypoint,
+			Cmd:        o.Cmd,
+			Env:        o.Env,
+			WorkingDir: o.WorkingDir,
+			User:       o.User,
+			Labels:     o.Labels,
+		},
+		History: []ociHistory{{created.UTC().Format(time.RFC3339), "debos"}},
+	}
+	config.RootFS.Type = "layers"
+	config.RootFS.DiffIDs = []string{diffID}
+	return config, nil
+}
+
+// Write the OCI image layout, with the layer compressed
+func (o *OciAction) writeOci(a *ociArchive, config []byte, layer string) error {
+	compressed := layer + ".gz"
+	if err := gzipFile(layer, compressed); err != nil {
+		return err
+	}
+	defer os.Remove(compressed)
+	digest, err := fileDigest(compressed)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(compressed)
+	if err != nil {
+		return err
+	}
+
+	configDesc := bytesDescriptor(ociConfigType, config)
+	manifest, err := json.Marshal(ociManifest{
+		SchemaVersion: 2,
+		MediaType:     ociManifestType,
+		Config:        configDesc,
+		Layers:        []ociDescriptor{{MediaType: ociLayerType, Digest: "sha256:" + digest, Size: info.Size()}},
+	})
+	if err != nil {
+		return err
+	}
+	manifestDesc := bytesDescriptor(ociManifestType, manifest)
+	if o.Tag != "" {
+		manifestDesc.Annotations = map[string]string{"org.opencontainers.image.ref.name": o.Tag}
+	}
+	index, err := json.Marshal(ociIndex{
+		SchemaVersion: 2,
+		MediaType:     "application/vnd.oci.image.index.v1+json",
+		Manifests:     []ociDescriptor{manifestDesc},
+	})
+	if err != nil {
+		return err
+	}
+
+	blob := func(digest string) string {
+		return path.Join("blobs/sha256", strings.TrimPrefix(digest, "sha256:"))
+	}
+	for _, dir := range []string{"blobs", "blobs/sha256"} {
+		if err := a.addDir(dir); err != nil {
+			return err
+		}
+	}
+	if err := a.addFile(blob("sha256:"+digest), compressed); err != nil {
+		return err
+	}
+	if err := a.addBytes(blob(configDesc.Digest), config); err != nil {
+		return err
+	}
+	if err := a.addBytes(blob(manifestDesc.Digest), manifest); err != nil {
+		return err
+	}
+	if err := a.addBytes("index.json", index); err != nil {
+		return err
+	}
+	return a.addBytes("oci-layout", []byte(`{"imageLayoutVersion":"1.0.0"}`))
+}
+
+// Write the image in the format of 'docker save'
+func (o *OciAction) writeDocker(a *ociArchive, config []byte, layer, diffID string) error {
+	id := strings.TrimPrefix(diffID, "sha256:")
+	configName := strings.TrimPrefix(bytesDescriptor(ociConfigType, config).Digest, "sha256:") + ".json"
+
+	m := dockerManifest{Config: configName, Layers: []string{id + "/layer.tar"}}
+	if o.Tag != "" {
+		tag := o.Tag
+		// docker load requires the tag
+		if !strings.Contains(path.Base(tag), ":") {
+			tag += ":latest"
+		}
+		m.RepoTags = []string{tag}
+	}
+	manifest, err := json.Marshal([]dockerManifest{m})
+	if err != nil {
+		return err
+	}
+
+	if err := a.addDir(id); err != nil {
+		return err
+	}
+	if err := a.addFile(id+"/layer.tar", layer); err != nil {
+		return err
+	}
+	if err := a.addBytes(configName, config); err != nil {
+		return err
+	}
+	return a.addBytes("manifest.json", manifest)
+}
+
+func (o *OciAction) Run(context *debos.DebosContext) error {
+	o.LogStart()
+
+	created := time.Now().Truncate(time.Second)
+	seconds, found, err := sourceDateEpoch(context)
+	if err != nil {
+		return err
+	}
+	if found {
+		created = time.Unix(seconds, 0)
+	}
+
+	layer := path.Join(debos.ScratchDir(context), "oci-layer.tar")
+	defer os.Remove(layer)
+	cmd := debos.NewCommandForContext(*context)
+	err = cmd.Run("Layer", "tar", "cf", layer,
+		"--sort=name", "--numeric-owner", "--format=posix",
+		"--pax-option=exthdr.name=%d/PaxHeaders/%f,delete=atime,delete=ctime",
+		"--xattrs", "--xattrs-include=security.capability",
+		"-C", context.Rootdir, ".")
+	if err != nil {
+		return err
+	}
+	digest, err := fileDigest(layer)
+	if err != nil {
+		return err
+	}
+	diffID := "sha256:" + digest
+
+	imageConfig, err := o.imageConfig(context.Architecture, created, diffID)
+	if err != nil {
+		return err
+	}
+	config, err := json.Marshal(imageConfig)
+	if err != nil {
+		return err
+	}
+
+	outfile := path.Join(context.Artifactdir, o.File)
+	out, err := os.Create(outfile)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	a := &ociArchive{tw: tar.NewWriter(out), mtime: created}
+	if o.Format == "docker" {
+		err = o.writeDocker(a, config, layer, diffID)
+	} else {
+		err = o.writeOci(a, config, layer)
+	}
+	if err != nil {
+		return err
+	}
+	if err := a.tw.Close(); err != nil {
+		return err
+	}
+
+	log.Printf("Container image %s written to %s", bytesDescriptor(ociConfigType, config).Digest, o.File)
+	return out.Close()
+}
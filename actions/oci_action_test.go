@@ -0,0 +1,204 @@
+package actions_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/go-debos/debos"
+	"github.com/go-debos/debos/actions"
+	"github.com/stretchr/testify/assert"
+)
+
+// Content of the files of the tarball, by name
+func readTarball(t *testing.T, file string) map[string][]byte {
+	f, err := os.Open(file)
+	assert.Empty(t, err)
+	defer f.Close()
+
+	entries := map[string][]byte{}
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.Empty(t, err)
+		content, err := ioutil.ReadAll(tr)
+		assert.Empty(t, err)
+		entries[hdr.Name] = content
+	}
+	return entries
+}
+
+func sha256Digest(content []byte) string {
+	sum := sha256.Sum256(content)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func blobName(digest string) string {
+	return "blobs/sha256/" + strings.TrimPrefix(digest, "sha256:")
+}
+
+func TestOciVerify(t *testing.T) {
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+
+	o := actions.NewOciAction()
+	assert.EqualError(t, o.Verify(&context), "'file' property can't be empty")
+	o.File = "../image.tar"
+	assert.EqualError(t, o.Verify(&context), "Image ../image.tar must be relative to the artifact directory")
+	o.File = "image.tar"
+	o.Format = "rkt"
+	assert.EqualError(t, o.Verify(&context), "Unsupported container image format 'rkt', expected oci or docker")
+	o.Format = "docker"
+	o.Env = []string{"=value"}
+	assert.EqualError(t, o.Verify(&context), "Invalid environment variable '=value', expected NAME=value")
+	o.Env = []string{"LANG=C.UTF-8"}
+	assert.Empty(t, o.Verify(&context))
+}
+
+func TestOciLayout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	files := []string{"etc/hostname", "etc/default/locale", "usr/bin/tool"}
+	reversed := []string{"usr/bin/tool", "etc/default/locale", "etc/hostname"}
+
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+	context.Artifactdir = dir
+	context.Scratchdir = dir
+	context.Architecture = "armhf"
+	context.EnvironVars = map[string]string{"SOURCE_DATE_EPOCH": "1600000000"}
+
+	var images [][]byte
+	for i, order := range [][]string{files, reversed} {
+		context.Rootdir = path.Join(dir, fmt.Sprintf("root%d", i))
+		writePackTree(t, context.Rootdir, order)
+
+		o := actions.NewOciAction()
+		o.File = "image.tar"
+		o.Tag = "example/base:latest"
+		o.Entrypoint = []string{"/usr/bin/tool"}
+		o.Env = []string{"LANG=C.UTF-8"}
+		o.Labels = map[string]string{"org.opencontainers.image.title": "base"}
+		assert.Empty(t, o.Verify(&context))
+		assert.Empty(t, o.Run(&context))
+
+		image, err := ioutil.ReadFile(path.Join(dir, "image.tar"))
+		assert.Empty(t, err)
+		images = append(images, image)
+	}
+	// Identical trees give identical images
+	assert.True(t, bytes.Equal(images[0], images[1]))
+
+	entries := readTarball(t, path.Join(dir, "image.tar"))
+	assert.Equal(t, `{"imageLayoutVersion":"1.0.0"}`, string(entries["oci-layout"]))
+
+	var index struct {
+		Manifests []struct {
+			Digest      string
+			Size        int
+			Annotations map[string]string
+		}
+	}
+	assert.Empty(t, json.Unmarshal(entries["index.json"], &index))
+	assert.Equal(t, 1, len(index.Manifests))
+	assert.Equal(t, "example/base:latest", index.Manifests[0].Annotations["org.opencontainers.image.ref.name"])
+
+	manifest := entries[blobName(index.Manifests[0].Digest)]
+	assert.Equal(t, index.Manifests[0].Digest, sha256Digest(manifest))
+	var m struct {
+		Config struct{ Digest string }
+		Layers []struct{ Digest string }
+	}
+	assert.Empty(t, json.Unmarshal(manifest, &m))
+
+	config := entries[blobName(m.Config.Digest)]
+	assert.Equal(t, m.Config.Digest, sha256Digest(config))
+	var c struct {
+		Created      string
+		Architecture string
+		Variant      string
+		Config       struct {
+			Entrypoint []string
+			Env        []string
+			Labels     map[string]string
+		}
+		RootFS struct {
+			DiffIDs []string `json:"diff_ids"`
+		}
+	}
+	assert.Empty(t, json.Unmarshal(config, &c))
+	assert.Equal(t, "2020-09-13T12:26:40Z", c.Created)
+	assert.Equal(t, "arm", c.Architecture)
+	assert.Equal(t, "v7", c.Variant)
+	assert.Equal(t, []string{"/usr/bin/tool"}, c.Config.Entrypoint)
+	assert.Equal(t, []string{"LANG=C.UTF-8"}, c.Config.Env)
+	assert.Equal(t, "base", c.Config.Labels["org.opencontainers.image.title"])
+
+	// The diff id is the digest of the uncompressed layer
+	assert.Equal(t, 1, len(m.Layers))
+	layer := entries[blobName(m.Layers[0].Digest)]
+	assert.Equal(t, m.Layers[0].Digest, sha256Digest(layer))
+	gz, err := gzip.NewReader(bytes.NewReader(layer))
+	assert.Empty(t, err)
+	uncompressed, err := ioutil.ReadAll(gz)
+	assert.Empty(t, err)
+	assert.Equal(t, []string{sha256Digest(uncompressed)}, c.RootFS.DiffIDs)
+	assert.True(t, bytes.Contains(uncompressed, []byte("./etc/default/locale")))
+}
+
+func TestOciDocker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+	context.Artifactdir = dir
+	context.Scratchdir = dir
+	context.Architecture = "amd64"
+	context.Rootdir = path.Join(dir, "root")
+	writePackTree(t, context.Rootdir, []string{"etc/hostname", "etc/default/locale", "usr/bin/tool"})
+
+	o := actions.NewOciAction()
+	o.File = "image.tar"
+	o.Format = "docker"
+	o.Tag = "example/base"
+	assert.Empty(t, o.Verify(&context))
+	assert.Empty(t, o.Run(&context))
+
+	entries := readTarball(t, path.Join(dir, "image.tar"))
+	var manifest []struct {
+		Config   string
+		RepoTags []string
+		Layers   []string
+	}
+	assert.Empty(t, json.Unmarshal(entries["manifest.json"], &manifest))
+	assert.Equal(t, 1, len(manifest))
+	assert.Equal(t, []string{"example/base:latest"}, manifest[0].RepoTags)
+
+	var c struct {
+		Architecture string
+		RootFS       struct {
+			DiffIDs []string `json:"diff_ids"`
+		}
+	}
+	assert.Empty(t, json.Unmarshal(entries[manifest[0].Config], &c))
+	assert.Equal(t, "amd64", c.Architecture)
+	assert.Equal(t, 1, len(manifest[0].Layers))
+	assert.Equal(t, []string{sha256Digest(entries[manifest[0].Layers[0]])}, c.RootFS.DiffIDs)
+
+	context.Architecture = "sparc"
+	assert.EqualError(t, o.Run(&context), "No container platform for the sparc architecture")
+}
@@ -15,6 +15,9 @@ Yaml syntax:
    metadata:
      key: value
      vendor.key: somevalue
+   gpg-sign: key id
+   gpg-homedir: path to GnuPG home directory
+   commit-variable: name
 
 Mandatory properties:
 
@@ -36,6 +39,16 @@ Optional properties:
   If 'collection-id' is set and 'ref-binding' is empty, will default to the branch name.
 
 - metadata -- key-value pairs of meta information to be added into commit.
+
+- gpg-sign -- GPG key ID used to sign the commit. The action fails before
+committing if the secret key can't be found.
+
+- gpg-homedir -- GnuPG home directory containing the signing key, relative to
+the recipe directory. If unset, the one of the key generated by a previous
+'gpg-ephemeral-key' action is used, or else the default GnuPG home directory.
+
+- commit-variable -- name of the template variable the commit checksum is
+stored in, so later actions can reference it. By default is 'ostree_commit'.
 */
 package actions
 
@@ -43,9 +56,12 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"os/exec"
 	"path"
+	"regexp"
 
 	"github.com/go-debos/debos"
+	"github.com/go-debos/fakemachine"
 	"github.com/sjoerdsimons/ostree-go/pkg/otbuiltin"
 )
 
@@ -58,6 +74,16 @@ type OstreeCommitAction struct {
 	CollectionID     string   `yaml:"collection-id"`
 	RefBinding       []string `yaml:"ref-binding"`
 	Metadata         map[string]string
+	GpgSign          string `yaml:"gpg-sign"`
+	GpgHomedir       string `yaml:"gpg-homedir"`
+	CommitVariable   string `yaml:"commit-variable"`
+}
+
+var variableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func NewOstreeCommitAction() *OstreeCommitAction {
+	ot := &OstreeCommitAction{CommitVariable: "ostree_commit"}
+	return ot
 }
 
 func emptyDir(dir string) {
@@ -77,10 +103,57 @@ func emptyDir(dir string) {
 	}
 }
 
+func (ot *OstreeCommitAction) Verify(context *debos.DebosContext) error {
+	if !variableName.MatchString(ot.CommitVariable) {
+		return fmt.Errorf("Invalid commit-variable name '%s'", ot.CommitVariable)
+	}
+
+	if ot.GpgHomedir != "" {
+		if ot.GpgSign == "" {
+			return fmt.Errorf("'gpg-homedir' requires 'gpg-sign' to be set")
+		}
+		ot.GpgHomedir = debos.CleanPathAt(ot.GpgHomedir, context.RecipeDir)
+	}
+
+	return nil
+}
+
+func (ot *OstreeCommitAction) PreMachine(context *debos.DebosContext, m *fakemachine.Machine,
+	args *[]string) error {
+	if ot.GpgHomedir != "" {
+		m.AddVolume(ot.GpgHomedir)
+	}
+	return nil
+}
+
+// Make sure the GPG signing key is available before doing any work
+func checkGpgKey(homedir, key string) error {
+	cmdline := []string{"--batch", "--list-secret-keys"}
+	if homedir != "" {
+		cmdline = append([]string{"--homedir", homedir}, cmdline...)
+	}
+	cmdline = append(cmdline, key)
+
+	if out, err := exec.Command("gpg", cmdline...).CombinedOutput(); err != nil {
+		return fmt.Errorf("GPG key '%s' not found: %v\n%s", key, err, out)
+	}
+
+	return nil
+}
+
 func (ot *OstreeCommitAction) Run(context *debos.DebosContext) error {
 	ot.LogStart()
 	repoPath := path.Join(context.Artifactdir, ot.Repository)
 
+	if ot.GpgSign != "" {
+		if ot.GpgHomedir == "" {
+			ot.GpgHomedir = context.GpgHomedir
+		}
+		if err := checkGpgKey(ot.GpgHomedir, ot.GpgSign); err != nil {
+			return err
+		}
+	}
+
 	emptyDir(path.Join(context.Rootdir, "dev"))
 
 	repo, err := otbuiltin.OpenRepo(repoPath)
@@ -111,12 +184,18 @@ func (ot *OstreeCommitAction) Run(context *debos.DebosContext) error {
 	// Add values from 'ref-binding' if any
 	opts.RefBinding = append(opts.RefBinding, ot.RefBinding...)
 
+	if ot.GpgSign != "" {
+		opts.GpgSign = []string{ot.GpgSign}
+		opts.GpgHomedir = ot.GpgHomedir
+	}
+
 	ret, err := repo.Commit(context.Rootdir, ot.Branch, opts)
 	if err != nil {
 		return err
 	} else {
 		log.Printf("Commit: %s\n", ret)
 	}
+	context.Variables[ot.CommitVariable] = ret
 	_, err = repo.CommitTransaction()
 	if err != nil {
 		return err
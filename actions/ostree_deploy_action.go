@@ -5,36 +5,69 @@ Deploy the OSTree branch to the image.
 If any preparation has been done for rootfs, it can be overwritten
 during this step.
 
+The branch is pulled either from a local repository of the artifact directory,
+for example the one of an 'ostree-commit' action, or from a remote repository
+given by its URL, so an image can be built from the commits published for the
+updates.
+
 Action 'image-partition' must be called prior to OSTree deploy.
 
 Yaml syntax:
  - action: ostree-deploy
    repository: repository name
+   url: URL
+   remote: remote name
    remote_repository: URL
-   branch: branch name
+   ref: branch name
+   commit: checksum
+   gpg-verify: bool
+   gpg-keyring: path to keyring
    os: os name
    tls-client-cert-path: path to client certificate
    tls-client-key-path: path to client certificate key
    setup-fstab: bool
    setup-kernel-cmdline: bool
    appendkernelcmdline: arguments
+   kernel-args:
+     - console=ttyS0,115200
+   kernel-args-append:
+     - quiet
    collection-id: org.apertis.example
 
 Mandatory properties:
 
-- remote_repository -- URL to remote OSTree repository for pulling stateroot branch.
-Currently not implemented, please prepare local repository instead.
-
 - repository -- path to repository with OSTree structure.
 This path is relative to 'artifact' directory.
 
+- url -- URL of the remote repository to pull the branch from, instead of a
+local 'repository'. One of 'repository' and 'url' has to be set.
+
 - os -- os deployment name, as explained in:
 https://ostree.readthedocs.io/en/latest/manual/deployment/
 
-- branch -- branch of the repository to use for populating the image.
+- ref -- branch of the repository to use for populating the image. 'branch'
+is accepted as well.
 
 Optional properties:
 
+- remote -- name of the remote configured in the repository of the image, the
+deployment follows the ref of this remote for its updates. By default 'origin'.
+
+- remote_repository -- URL of the remote configured in the repository of the
+image. By default the 'url' the branch was pulled from, if any.
+
+- commit -- checksum of the commit to pull and deploy instead of the head of
+the ref, to build the image of a given update. The ref is still the one the
+deployment follows.
+
+- gpg-verify -- check the pulled commit is signed by a key of 'gpg-keyring'
+and keep the verification enabled for the remote. The action fails if
+'gpg-keyring' isn't set.
+
+- gpg-keyring -- GnuPG keyring with the public keys trusted for the remote,
+relative to the recipe directory. It is installed as the keyring of the remote
+in the repository of the image.
+
 - setup-fstab -- create '/etc/fstab' file for image
 
 - setup-kernel-cmdline -- add the information from the 'image-partition'
@@ -42,6 +75,17 @@ action to the configured commandline.
 
 - append-kernel-cmdline -- additional kernel command line arguments passed to kernel.
 
+- kernel-args -- list of kernel arguments for the deployment, the equivalent of
+'--karg' for 'ostree admin deploy'. If one of them sets 'root=', the one from
+the 'image-partition' action is not added even if 'setup-kernel-cmdline' is
+enabled.
+
+- kernel-args-append -- list of kernel arguments appended after all the others,
+the equivalent of '--karg-append' for 'ostree admin deploy'.
+
+Arguments such as 'root', 'rootflags', 'rootfstype', 'console' and 'init'
+must be given a value in the 'key=value' form.
+
 - tls-client-cert-path -- path to client certificate to use for the remote repository
 
 - tls-client-key-path -- path to client certificate key to use for the remote repository
@@ -53,8 +97,10 @@ package actions
 import (
 	"fmt"
 	"io"
+	"log"
 	"os"
 	"path"
+	"regexp"
 	"strings"
 
 	"github.com/go-debos/debos"
@@ -64,23 +110,121 @@ import (
 type OstreeDeployAction struct {
 	debos.BaseAction    `yaml:",inline"`
 	Repository          string
+	URL                 string
+	Remote              string
 	RemoteRepository    string "remote_repository"
 	Branch              string
+	Ref                 string
+	Commit              string
+	GpgVerify           bool   `yaml:"gpg-verify"`
+	GpgKeyring          string `yaml:"gpg-keyring"`
 	Os                  string
-	SetupFSTab          bool   `yaml:"setup-fstab"`
-	SetupKernelCmdline  bool   `yaml:"setup-kernel-cmdline"`
-	AppendKernelCmdline string `yaml:"append-kernel-cmdline"`
-	TlsClientCertPath   string `yaml:"tls-client-cert-path"`
-	TlsClientKeyPath    string `yaml:"tls-client-key-path"`
-	CollectionID        string `yaml:"collection-id"`
+	SetupFSTab          bool     `yaml:"setup-fstab"`
+	SetupKernelCmdline  bool     `yaml:"setup-kernel-cmdline"`
+	AppendKernelCmdline string   `yaml:"append-kernel-cmdline"`
+	TlsClientCertPath   string   `yaml:"tls-client-cert-path"`
+	TlsClientKeyPath    string   `yaml:"tls-client-key-path"`
+	CollectionID        string   `yaml:"collection-id"`
+	KernelArgs          []string `yaml:"kernel-args"`
+	KernelArgsAppend    []string `yaml:"kernel-args-append"`
 }
 
+// Commit checksum, as given to 'ostree pull'
+var ostreeChecksum = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// Kernel arguments which are meaningless without a value
+var kernelArgsWithValue = []string{"root", "rootflags", "rootfstype", "console", "init"}
+
 func NewOstreeDeployAction() *OstreeDeployAction {
-	ot := &OstreeDeployAction{SetupFSTab: true, SetupKernelCmdline: true}
+	ot := &OstreeDeployAction{Remote: "origin", SetupFSTab: true, SetupKernelCmdline: true}
 	ot.Description = "Deploying from ostree"
 	return ot
 }
 
+func verifyKernelArg(arg string) error {
+	if arg == "" || strings.ContainsAny(arg, " \t\n") {
+		return fmt.Errorf("Invalid kernel argument '%s'", arg)
+	}
+
+	kv := strings.SplitN(arg, "=", 2)
+	for _, k := range kernelArgsWithValue {
+		if kv[0] == k && (len(kv) != 2 || kv[1] == "") {
+			return fmt.Errorf("Kernel argument '%s' requires a value, expected '%s=value'", arg, k)
+		}
+	}
+
+	return nil
+}
+
+func (ot *OstreeDeployAction) Verify(context *debos.DebosContext) error {
+	if ot.Ref != "" {
+		if ot.Branch != "" && ot.Branch != ot.Ref {
+			return fmt.Errorf("'ref' and 'branch' properties are different, only set one of them")
+		}
+		ot.Branch = ot.Ref
+	}
+	if ot.Branch == "" {
+		return fmt.Errorf("'ref' property can't be empty")
+	}
+
+	if (ot.Repository == "") == (ot.URL == "") {
+		return fmt.Errorf("One of 'repository' and 'url' properties has to be set")
+	}
+	if ot.Remote == "" || strings.ContainsAny(ot.Remote, "/: \t\n") {
+		return fmt.Errorf("Invalid remote name '%s'", ot.Remote)
+	}
+	if ot.Commit != "" && !ostreeChecksum.MatchString(ot.Commit) {
+		return fmt.Errorf("Invalid commit '%s', expected a sha256 checksum", ot.Commit)
+	}
+
+	if ot.GpgVerify {
+		if ot.GpgKeyring == "" {
+			return fmt.Errorf("GPG verification of remote '%s' requested but no 'gpg-keyring' is configured", ot.Remote)
+		}
+		ot.GpgKeyring = debos.CleanPathAt(ot.GpgKeyring, context.RecipeDir)
+		if _, err := os.Stat(ot.GpgKeyring); err != nil {
+			return fmt.Errorf("Can't use keyring of remote '%s': %v", ot.Remote, err)
+		}
+	} else if ot.GpgKeyring != "" {
+		return fmt.Errorf("'gpg-keyring' requires 'gpg-verify' to be set")
+	}
+
+	for _, args := range [][]string{ot.KernelArgs, ot.KernelArgsAppend} {
+		for _, arg := range args {
+			if err := verifyKernelArg(arg); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+/* Kernel arguments of the deployment, the root= of the image first unless set
+ * by 'kernel-args', and the ones of 'kernel-args-append' last */
+func (ot *OstreeDeployAction) kernelArgs(context *debos.DebosContext) []string {
+	var kargs []string
+
+	hasRoot := false
+	for _, arg := range ot.KernelArgs {
+		if strings.HasPrefix(arg, "root=") {
+			hasRoot = true
+		}
+	}
+
+	if ot.SetupKernelCmdline && !hasRoot {
+		kargs = append(kargs, context.ImageKernelRoot)
+	}
+	kargs = append(kargs, ot.KernelArgs...)
+
+	if ot.AppendKernelCmdline != "" {
+		s := strings.Split(ot.AppendKernelCmdline, " ")
+		kargs = append(kargs, s...)
+	}
+
+	return append(kargs, ot.KernelArgsAppend...)
+}
+
 func (ot *OstreeDeployAction) setupFSTab(deployment *ostree.Deployment, context *debos.DebosContext) error {
 	deploymentDir := fmt.Sprintf("ostree/deploy/%s/deploy/%s.%d",
 		deployment.Osname(), deployment.Csum(), deployment.Deployserial())
@@ -110,7 +254,7 @@ func (ot *OstreeDeployAction) Run(context *debos.DebosContext) error {
 	if len(context.ImageMntDir) != 0 {
 		/* First deploy the current rootdir to the image so it can seed e.g.
 		 * bootloader configuration */
-		err := debos.Command{}.Run("Deploy to image", "cp", "-a", context.Rootdir+"/.", context.ImageMntDir)
+		err := debos.NewCommandForContext(*context).Run("Deploy to image", "cp", "-a", context.Rootdir+"/.", context.ImageMntDir)
 		if err != nil {
 			return fmt.Errorf("rootfs deploy failed: %v", err)
 		}
@@ -118,7 +262,14 @@ func (ot *OstreeDeployAction) Run(context *debos.DebosContext) error {
 		context.Origins["filesystem"] = context.ImageMntDir
 	}
 
-	repoPath := "file://" + path.Join(context.Artifactdir, ot.Repository)
+	repoPath := ot.URL
+	if repoPath == "" {
+		repoPath = "file://" + path.Join(context.Artifactdir, ot.Repository)
+	}
+	remoteURL := ot.RemoteRepository
+	if remoteURL == "" {
+		remoteURL = ot.URL
+	}
 
 	sysroot := ostree.NewSysroot(context.Rootdir)
 	err := sysroot.InitializeFS()
@@ -140,46 +291,68 @@ func (ot *OstreeDeployAction) Run(context *debos.DebosContext) error {
 		return err
 	}
 
-	/* FIXME: add support for gpg signing commits so this is no longer needed */
-	opts := ostree.RemoteOptions{NoGpgVerify: true,
+	opts := ostree.RemoteOptions{NoGpgVerify: !ot.GpgVerify,
 		TlsClientCertPath: ot.TlsClientCertPath,
 		TlsClientKeyPath:  ot.TlsClientKeyPath,
 		CollectionId:      ot.CollectionID,
 	}
 
-	err = dstRepo.RemoteAdd("origin", ot.RemoteRepository, opts, nil)
+	err = dstRepo.RemoteAdd(ot.Remote, remoteURL, opts, nil)
 	if err != nil {
 		return err
 	}
 
+	/* The pull checks the signatures against the keyring of the remote in
+	 * the repository, ostree picks it up by its name */
+	if ot.GpgVerify {
+		keyring := path.Join(context.Rootdir, "ostree/repo", ot.Remote+".trustedkeys.gpg")
+		err = debos.CopyFile(ot.GpgKeyring, keyring, 0644)
+		if err != nil {
+			return fmt.Errorf("Failed to install keyring of remote '%s': %v", ot.Remote, err)
+		}
+	}
+
+	/* A checksum is pulled as is rather than the head of the ref */
 	var options ostree.PullOptions
-	options.OverrideRemoteName = "origin"
+	options.OverrideRemoteName = ot.Remote
 	options.Refs = []string{ot.Branch}
+	if ot.Commit != "" {
+		options.Refs = []string{ot.Commit}
+	}
 
+	log.Printf("Pulling %s from %s", options.Refs[0], repoPath)
 	err = dstRepo.PullWithOptions(repoPath, options, nil, nil)
 	if err != nil {
-		return err
+		return fmt.Errorf("Failed to pull %s from %s: %v", options.Refs[0], repoPath, err)
 	}
 
 	/* Required by ostree to make sure a bunch of information was pulled in  */
 	sysroot.Load(nil)
 
-	revision, err := dstRepo.ResolveRev(ot.Branch, false)
-	if err != nil {
-		return err
+	revision := ot.Commit
+	if revision == "" {
+		revision, err = dstRepo.ResolveRev(ot.Branch, false)
+		if err != nil {
+			return err
+		}
 	}
 
-	var kargs []string
-	if ot.SetupKernelCmdline {
-		kargs = append(kargs, context.ImageKernelRoot)
-	}
+	kargs := ot.kernelArgs(context)
 
-	if ot.AppendKernelCmdline != "" {
-		s := strings.Split(ot.AppendKernelCmdline, " ")
-		kargs = append(kargs, s...)
+	cmdline := []string{"ostree", "admin", "deploy", "--os=" + ot.Os}
+	appended := len(kargs) - len(ot.KernelArgsAppend)
+	for i, arg := range kargs {
+		if i >= appended {
+			cmdline = append(cmdline, "--karg-append="+arg)
+		} else {
+			cmdline = append(cmdline, "--karg="+arg)
+		}
 	}
+	refspec := ot.Remote + ":" + ot.Branch
+	cmdline = append(cmdline, refspec)
+	log.Printf("Deploying %s: %s", revision, strings.Join(cmdline, " "))
 
-	origin := sysroot.OriginNewFromRefspec("origin:" + ot.Branch)
+	origin := sysroot.OriginNewFromRefspec(refspec)
 	deployment, err := sysroot.DeployTree(ot.Os, revision, origin, nil, kargs, nil)
 	if err != nil {
 		return err
@@ -0,0 +1,98 @@
+package actions
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/go-debos/debos"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOstreeDeployKernelArgs(t *testing.T) {
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+
+	ot := NewOstreeDeployAction()
+	ot.Repository = "repo"
+	ot.Branch = "main"
+	ot.KernelArgs = []string{"root=/dev/mmcblk0p2", "rootflags=discard", "console=ttyS0,115200", "ro"}
+	ot.KernelArgsAppend = []string{"quiet", "systemd.log_level=debug"}
+	assert.Empty(t, ot.Verify(&context))
+
+	ot.KernelArgs = []string{"console"}
+	assert.EqualError(t, ot.Verify(&context),
+		"Kernel argument 'console' requires a value, expected 'console=value'")
+
+	ot.KernelArgs = nil
+	ot.KernelArgsAppend = []string{"root="}
+	assert.EqualError(t, ot.Verify(&context),
+		"Kernel argument 'root=' requires a value, expected 'root=value'")
+
+	ot.KernelArgsAppend = []string{"quiet splash"}
+	assert.EqualError(t, ot.Verify(&context), "Invalid kernel argument 'quiet splash'")
+}
+
+func TestOstreeDeployKernelArgsOrder(t *testing.T) {
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+	context.ImageKernelRoot = "root=PARTUUID=1234"
+
+	ot := NewOstreeDeployAction()
+	ot.SetupKernelCmdline = true
+	ot.AppendKernelCmdline = "rw rootwait"
+	ot.KernelArgs = []string{"console=ttyS0,115200"}
+	ot.KernelArgsAppend = []string{"quiet"}
+	assert.Equal(t, []string{"root=PARTUUID=1234", "console=ttyS0,115200", "rw", "rootwait", "quiet"},
+		ot.kernelArgs(&context))
+
+	// A root= of the recipe replaces the one of the image
+	ot.KernelArgs = []string{"root=/dev/mmcblk0p2", "console=ttyS0,115200"}
+	assert.Equal(t, []string{"root=/dev/mmcblk0p2", "console=ttyS0,115200", "rw", "rootwait", "quiet"},
+		ot.kernelArgs(&context))
+
+	ot.SetupKernelCmdline = false
+	ot.AppendKernelCmdline = ""
+	ot.KernelArgs = nil
+	assert.Equal(t, []string{"quiet"}, ot.kernelArgs(&context))
+}
+
+func TestOstreeDeployRemote(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+	assert.Empty(t, ioutil.WriteFile(path.Join(dir, "updates.gpg"), []byte("keys"), 0644))
+
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+	context.RecipeDir = dir
+
+	ot := NewOstreeDeployAction()
+	ot.Repository = "repo"
+	assert.EqualError(t, ot.Verify(&context), "'ref' property can't be empty")
+	ot.Branch = "example/x86_64/main"
+	ot.Ref = "example/x86_64/next"
+	assert.EqualError(t, ot.Verify(&context), "'ref' and 'branch' properties are different, only set one of them")
+	ot.Branch = ""
+	assert.Empty(t, ot.Verify(&context))
+	assert.Equal(t, "example/x86_64/next", ot.Branch)
+
+	ot.URL = "https://updates.example.com/repo"
+	assert.EqualError(t, ot.Verify(&context), "One of 'repository' and 'url' properties has to be set")
+	ot.Repository = ""
+	ot.Remote = "updates:main"
+	assert.EqualError(t, ot.Verify(&context), "Invalid remote name 'updates:main'")
+	ot.Remote = "updates"
+	ot.Commit = "1234abcd"
+	assert.EqualError(t, ot.Verify(&context), "Invalid commit '1234abcd', expected a sha256 checksum")
+	ot.Commit = "8a6b5f2c4b1e6a50ee7c1f9bb7e5cdf1b9b2b6c2b8e1d0a7c3f4e5d6a7b8c9d0"
+	assert.Empty(t, ot.Verify(&context))
+
+	ot.GpgKeyring = "updates.gpg"
+	assert.EqualError(t, ot.Verify(&context), "'gpg-keyring' requires 'gpg-verify' to be set")
+	ot.GpgKeyring = ""
+	ot.GpgVerify = true
+	assert.EqualError(t, ot.Verify(&context),
+		"GPG verification of remote 'updates' requested but no 'gpg-keyring' is configured")
+	ot.GpgKeyring = "updates.gpg"
+	assert.Empty(t, ot.Verify(&context))
+	assert.Equal(t, path.Join(dir, "updates.gpg"), ot.GpgKeyring)
+}
@@ -8,11 +8,24 @@ Yaml syntax:
    origin: name
    source: directory
    destination: directory
+   owner: root
+   group: root
+   mode: 0644
+   preserve-owner: false
+   no-xattrs: false
+   paths:
+     - path: root/.ssh/*
+       mode: 0600
 
 Mandatory properties:
 
 - source -- relative path to the directory or file located in path referenced by `origin`.
 In case if this property is absent then pure path referenced by 'origin' will be used.
+A tar archive, possibly compressed with gz, bzip2, xz or zstd, is detected by its
+extension ('.tar', '.tar.gz', '.tgz', '.tar.bz2', '.tar.xz', '.txz' or '.tar.zst')
+and extracted to 'destination' instead, keeping the ownership, permissions and
+symlinks of its entries. Entries escaping 'destination' make the action fail as
+with the unpack action.
 
 Optional properties:
 
@@ -21,12 +34,49 @@ Optional properties:
 - destination -- absolute path in the target rootfs where 'source' will be copied.
 All existing files will be overwritten.
 If destination isn't set '/' of the rootfs will be used.
+
+- owner -- user owning the copied files and directories, as a name of the
+target '/etc/passwd' or a numeric id. By default is root.
+
+- group -- group owning the copied files and directories, as a name of the
+target '/etc/group' or a numeric id. By default is root.
+
+- mode -- octal permissions of the copied files, directories keep the ones of
+the source. By default the files keep the permissions of the source.
+
+- preserve-owner -- keep the owner and group of the source files rather than
+using 'owner' and 'group'. False by default.
+
+- no-xattrs -- don't copy the extended attributes of the source entries, like
+the file capabilities of 'security.capability', which are copied by default.
+
+- paths -- list of ownership and permissions of some of the copied entries,
+overriding the ones above. Later entries of the list override the earlier ones.
+
+Ownership and permissions can't be changed for archives, their entries keep the
+ones recorded in the archive.
+
+Properties for 'paths':
+
+- path -- shell pattern matching the paths of the entries relative to 'source'.
+
+- owner -- user owning the matching entries.
+
+- group -- group owning the matching entries.
+
+- mode -- octal permissions of the matching entries, directories included.
 */
 package actions
 
 import (
+	"bufio"
 	"fmt"
+	"os"
 	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
 
 	"github.com/go-debos/debos"
 )
@@ -36,15 +86,128 @@ type OverlayAction struct {
 	Origin           string // origin of overlay, here the export from other action may be used
 	Source           string // external path there overlay is
 	Destination      string // path inside of rootfs
+	Owner            string
+	Group            string
+	Mode             string
+	PreserveOwner    bool `yaml:"preserve-owner"`
+	NoXattrs         bool `yaml:"no-xattrs"`
+	Paths            []OverlayPath
+}
+
+type OverlayPath struct {
+	Path  string
+	Owner string
+	Group string
+	Mode  string
+}
+
+// Ownership and permissions of a copied entry, mode is 0 to keep the source one
+type overlayOwnership struct {
+	uid  int
+	gid  int
+	mode os.FileMode
+}
+
+// Extensions of the sources extracted rather than copied
+var overlayArchives = []string{".tar", ".tar.gz", ".tgz", ".tar.bz2", ".tar.xz", ".txz", ".tar.zst"}
+
+func isOverlayArchive(source string) bool {
+	for _, ext := range overlayArchives {
+		if strings.HasSuffix(strings.ToLower(source), ext) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseOverlayMode(mode string) (os.FileMode, error) {
+	if len(mode) == 0 {
+		return 0, nil
+	}
+	m, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || m == 0 || m > 07777 {
+		return 0, fmt.Errorf("Invalid mode '%s'", mode)
+	}
+
+	fileMode := os.FileMode(m).Perm()
+	for bit, special := range map[uint64]os.FileMode{04000: os.ModeSetuid, 02000: os.ModeSetgid, 01000: os.ModeSticky} {
+		if m&bit != 0 {
+			fileMode |= special
+		}
+	}
+	return fileMode, nil
+}
+
+// Look up the id of a user or group name in the passwd or group file of the target
+func lookupTargetID(rootdir, db, name string) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+
+	f, err := os.Open(path.Join(rootdir, "etc", db))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) > 2 && fields[0] == name {
+			return strconv.Atoi(fields[2])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+
+	return 0, fmt.Errorf("'%s' not found in /etc/%s", name, db)
+}
+
+func (overlay *OverlayAction) changesOwnership() bool {
+	return len(overlay.Owner) > 0 || len(overlay.Group) > 0 || len(overlay.Mode) > 0 ||
+		overlay.PreserveOwner || len(overlay.Paths) > 0
 }
 
 func (overlay *OverlayAction) Verify(context *debos.DebosContext) error {
+	if isOverlayArchive(overlay.Source) && overlay.changesOwnership() {
+		return fmt.Errorf("Ownership and permissions of archive '%s' can't be changed", overlay.Source)
+	}
+	if overlay.PreserveOwner && (len(overlay.Owner) > 0 || len(overlay.Group) > 0) {
+		return fmt.Errorf("'preserve-owner' can't be used with 'owner' or 'group'")
+	}
+	if _, err := parseOverlayMode(overlay.Mode); err != nil {
+		return err
+	}
+	for _, p := range overlay.Paths {
+		if len(p.Path) == 0 {
+			return fmt.Errorf("'path' property of 'paths' can't be empty")
+		}
+		if _, err := path.Match(p.Path, ""); err != nil {
+			return fmt.Errorf("Invalid pattern '%s': %v", p.Path, err)
+		}
+		if _, err := parseOverlayMode(p.Mode); err != nil {
+			return err
+		}
+	}
+
 	if _, err := debos.RestrictedPath(context.Rootdir, overlay.Destination); err != nil {
 		return err
 	}
 	return nil
 }
 
+func (overlay *OverlayAction) DryRun(context *debos.DebosContext) error {
+	if len(overlay.Origin) > 0 {
+		return debos.CheckOrigin(context, overlay.Origin, overlay.Source)
+	}
+
+	if _, err := os.Stat(path.Join(context.RecipeDir, overlay.Source)); err != nil {
+		return fmt.Errorf("Overlay source not found: %v", err)
+	}
+	return nil
+}
+
 func (overlay *OverlayAction) Run(context *debos.DebosContext) error {
 	overlay.LogStart()
 	origin := context.RecipeDir
@@ -63,5 +226,156 @@ func (overlay *OverlayAction) Run(context *debos.DebosContext) error {
 		return err
 	}
 
-	return debos.CopyTree(sourcedir, destination)
+	if isOverlayArchive(overlay.Source) {
+		archive, err := debos.NewArchive(sourcedir, debos.Tar)
+		if err != nil {
+			return err
+		}
+		if overlay.NoXattrs {
+			if err := archive.AddOption("xattrs", false); err != nil {
+				return err
+			}
+		}
+		archive.SetContext(context)
+		return archive.Unpack(destination)
+	}
+
+	existing, err := existingDirectories(sourcedir, destination)
+	if err != nil {
+		return err
+	}
+	if err := debos.CopyTree(sourcedir, destination); err != nil {
+		return err
+	}
+
+	if err := overlay.setOwnership(context, sourcedir, destination, existing); err != nil {
+		return err
+	}
+	if overlay.NoXattrs {
+		return nil
+	}
+
+	// Once owned, changing the owner clears the file capabilities
+	return copyOverlayXattrs(sourcedir, destination)
+}
+
+// Copy the extended attributes of the copied entries
+func copyOverlayXattrs(sourcedir, destination string) error {
+	return filepath.Walk(sourcedir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		suffix, _ := filepath.Rel(sourcedir, p)
+		if suffix == "." && info.IsDir() {
+			// The destination itself isn't copied from a directory
+			return nil
+		}
+		return debos.CopyXattrs(p, path.Join(destination, suffix))
+	})
+}
+
+// Directories of the source already in the target, which keep their ownership
+func existingDirectories(sourcedir, destination string) (map[string]bool, error) {
+	existing := map[string]bool{}
+	err := filepath.Walk(sourcedir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return err
+		}
+		suffix, _ := filepath.Rel(sourcedir, p)
+		target := path.Join(destination, suffix)
+		if t, err := os.Lstat(target); err == nil && t.IsDir() {
+			existing[target] = true
+		}
+		return nil
+	})
+	return existing, err
+}
+
+// Override the ownership of an entry with the set properties
+func (overlay *OverlayAction) ownership(context *debos.DebosContext, owner, group, mode string, o *overlayOwnership) error {
+	var err error
+	if len(owner) > 0 {
+		if o.uid, err = lookupTargetID(context.Rootdir, "passwd", owner); err != nil {
+			return err
+		}
+	}
+	if len(group) > 0 {
+		if o.gid, err = lookupTargetID(context.Rootdir, "group", group); err != nil {
+			return err
+		}
+	}
+	if len(mode) > 0 {
+		if o.mode, err = parseOverlayMode(mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* Give the copied entries the requested ownership and permissions, the ones of
+ * root by default rather than the ones of the user running debos. Directories
+ * which already existed are only changed by the matching 'paths' */
+func (overlay *OverlayAction) setOwnership(context *debos.DebosContext, sourcedir, destination string, existing map[string]bool) error {
+	defaults := overlayOwnership{}
+	if err := overlay.ownership(context, overlay.Owner, overlay.Group, "", &defaults); err != nil {
+		return err
+	}
+	fileMode, err := parseOverlayMode(overlay.Mode)
+	if err != nil {
+		return err
+	}
+
+	return filepath.Walk(sourcedir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		suffix, _ := filepath.Rel(sourcedir, p)
+		target := path.Join(destination, suffix)
+		rel := suffix
+		if rel == "." {
+			// The destination itself isn't copied from a directory
+			if info.IsDir() {
+				return nil
+			}
+			rel = path.Base(p)
+		}
+
+		o := defaults
+		if overlay.PreserveOwner {
+			if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+				o.uid, o.gid = int(stat.Uid), int(stat.Gid)
+			}
+		}
+		if info.Mode().IsRegular() {
+			o.mode = fileMode
+		}
+		matched := false
+		for _, m := range overlay.Paths {
+			if match, _ := path.Match(m.Path, rel); match {
+				if err := overlay.ownership(context, m.Owner, m.Group, m.Mode, &o); err != nil {
+					return err
+				}
+				matched = true
+			}
+		}
+		if existing[target] && !matched {
+			return nil
+		}
+
+		// Changing the owner clears the setuid and setgid bits, even as root
+		if o.mode == 0 {
+			if t, err := os.Lstat(target); err == nil && t.Mode()&(os.ModeSetuid|os.ModeSetgid) != 0 {
+				o.mode = t.Mode()
+			}
+		}
+		if err := os.Lchown(target, o.uid, o.gid); err != nil {
+			return err
+		}
+		if o.mode != 0 && info.Mode()&os.ModeSymlink == 0 {
+			return os.Chmod(target, o.mode)
+		}
+		return nil
+	})
 }
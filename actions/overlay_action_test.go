@@ -0,0 +1,254 @@
+package actions_test
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/go-debos/debos"
+	"github.com/go-debos/debos/actions"
+	"github.com/stretchr/testify/assert"
+)
+
+// Write a tar.gz archive of the entries
+func writeOverlayArchive(t *testing.T, file string, entries []tar.Header) {
+	f, err := os.Create(file)
+	assert.Empty(t, err)
+	defer f.Close()
+
+	z := gzip.NewWriter(f)
+	defer z.Close()
+	w := tar.NewWriter(z)
+	defer w.Close()
+
+	for _, h := range entries {
+		content := h.Name
+		if h.Typeflag == tar.TypeReg {
+			h.Size = int64(len(content))
+		}
+		assert.Empty(t, w.WriteHeader(&h))
+		if h.Typeflag == tar.TypeReg {
+			_, err := io.WriteString(w, content)
+			assert.Empty(t, err)
+		}
+	}
+}
+
+func TestOverlayArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	context := debos.DebosContext{&debos.CommonContext{}, path.Join(dir, "recipe"), ""}
+	context.Rootdir = path.Join(dir, "root")
+	assert.Empty(t, os.MkdirAll(context.RecipeDir, 0755))
+	assert.Empty(t, os.MkdirAll(context.Rootdir, 0755))
+
+	writeOverlayArchive(t, path.Join(context.RecipeDir, "overlay.tar.gz"), []tar.Header{
+		{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "etc/motd", Typeflag: tar.TypeReg, Mode: 0600},
+		{Name: "etc/issue", Typeflag: tar.TypeSymlink, Linkname: "motd"},
+	})
+
+	o := actions.OverlayAction{Source: "overlay.tar.gz", Destination: "/opt"}
+	assert.Empty(t, o.Verify(&context))
+	assert.Empty(t, o.DryRun(&context))
+	assert.Empty(t, o.Run(&context))
+
+	content, err := ioutil.ReadFile(path.Join(context.Rootdir, "opt/etc/motd"))
+	assert.Empty(t, err)
+	assert.Equal(t, "etc/motd", string(content))
+	info, err := os.Stat(path.Join(context.Rootdir, "opt/etc/motd"))
+	assert.Empty(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	link, err := os.Readlink(path.Join(context.Rootdir, "opt/etc/issue"))
+	assert.Empty(t, err)
+	assert.Equal(t, "motd", link)
+
+	// Entries escaping the destination are rejected
+	writeOverlayArchive(t, path.Join(context.RecipeDir, "escape.tgz"), []tar.Header{
+		{Name: "../../escaped", Typeflag: tar.TypeReg, Mode: 0644},
+	})
+	o = actions.OverlayAction{Source: "escape.tgz", Destination: "/opt"}
+	assert.Error(t, o.Run(&context))
+	_, err = os.Stat(path.Join(dir, "escaped"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+// Owner, group and permissions of a file of the rootfs
+func overlayOwnership(t *testing.T, file string) (uint32, uint32, os.FileMode) {
+	info, err := os.Lstat(file)
+	assert.Empty(t, err)
+	stat := info.Sys().(*syscall.Stat_t)
+	return stat.Uid, stat.Gid, info.Mode()
+}
+
+func TestOverlayOwnership(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Changing the ownership requires root")
+	}
+
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	context := debos.DebosContext{&debos.CommonContext{}, path.Join(dir, "recipe"), ""}
+	context.Rootdir = path.Join(dir, "root")
+	assert.Empty(t, os.MkdirAll(path.Join(context.Rootdir, "etc"), 0755))
+	assert.Empty(t, ioutil.WriteFile(path.Join(context.Rootdir, "etc/passwd"), []byte("root:x:0:0::/root:/bin/sh\nuser:x:1000:1000::/home/user:/bin/sh\n"), 0644))
+	assert.Empty(t, ioutil.WriteFile(path.Join(context.Rootdir, "etc/group"), []byte("root:x:0:\nusers:x:100:\n"), 0644))
+
+	// Owned by the user running the build
+	source := path.Join(context.RecipeDir, "overlay")
+	for file, mode := range map[string]os.FileMode{"etc/motd": 0664, "home/user/.ssh/id_ed25519": 0644, "home/user/.profile": 0755} {
+		assert.Empty(t, os.MkdirAll(path.Join(source, path.Dir(file)), 0755))
+		assert.Empty(t, ioutil.WriteFile(path.Join(source, file), []byte(file), mode))
+	}
+	assert.Empty(t, os.Symlink(".profile", path.Join(source, "home/user/.bashrc")))
+	assert.Empty(t, filepath.Walk(source, func(p string, info os.FileInfo, err error) error {
+		return os.Lchown(p, 4242, 4242)
+	}))
+
+	// Owned by root by default
+	o := actions.OverlayAction{Source: "overlay"}
+	assert.Empty(t, o.Verify(&context))
+	assert.Empty(t, o.Run(&context))
+	uid, gid, mode := overlayOwnership(t, path.Join(context.Rootdir, "home/user/.ssh/id_ed25519"))
+	assert.Equal(t, []uint32{0, 0}, []uint32{uid, gid})
+	assert.Equal(t, os.FileMode(0644), mode)
+	uid, gid, _ = overlayOwnership(t, path.Join(context.Rootdir, "home/user/.bashrc"))
+	assert.Equal(t, []uint32{0, 0}, []uint32{uid, gid})
+
+	o = actions.OverlayAction{Source: "overlay", PreserveOwner: true}
+	assert.Empty(t, o.Verify(&context))
+	assert.Empty(t, o.Run(&context))
+	uid, gid, _ = overlayOwnership(t, path.Join(context.Rootdir, "home/user/.profile"))
+	assert.Equal(t, []uint32{4242, 4242}, []uint32{uid, gid})
+
+	// Names are those of the target
+	o = actions.OverlayAction{Source: "overlay/home", Destination: "/srv", Owner: "user", Group: "users", Mode: "0640",
+		Paths: []actions.OverlayPath{
+			{Path: "user/.ssh/*", Mode: "0600"},
+			{Path: "user/.profile", Mode: "0755"},
+			{Path: "user/.ssh", Mode: "0700"},
+		}}
+	assert.Empty(t, o.Verify(&context))
+	assert.Empty(t, o.Run(&context))
+	for file, expected := range map[string]os.FileMode{
+		"srv/user":                 os.ModeDir | 0755,
+		"srv/user/.ssh":            os.ModeDir | 0700,
+		"srv/user/.ssh/id_ed25519": 0600,
+		"srv/user/.profile":        0755,
+		"srv/user/.bashrc":         os.ModeSymlink | 0777,
+	} {
+		uid, gid, mode := overlayOwnership(t, path.Join(context.Rootdir, file))
+		assert.Equal(t, []uint32{1000, 100}, []uint32{uid, gid}, file)
+		assert.Equal(t, expected, mode, file)
+	}
+	uid, gid, _ = overlayOwnership(t, path.Join(context.Rootdir, "srv"))
+	assert.Equal(t, []uint32{0, 0}, []uint32{uid, gid})
+
+	// Existing directories are left alone
+	o = actions.OverlayAction{Source: "overlay", Owner: "user"}
+	assert.Empty(t, o.Run(&context))
+	uid, gid, _ = overlayOwnership(t, path.Join(context.Rootdir, "etc/motd"))
+	assert.Equal(t, []uint32{1000, 0}, []uint32{uid, gid})
+	uid, gid, _ = overlayOwnership(t, path.Join(context.Rootdir, "etc"))
+	assert.Equal(t, []uint32{0, 0}, []uint32{uid, gid})
+
+	o = actions.OverlayAction{Source: "overlay", Owner: "nobody"}
+	assert.EqualError(t, o.Run(&context), "'nobody' not found in /etc/passwd")
+
+	o = actions.OverlayAction{Source: "overlay.tar.gz", Owner: "user"}
+	assert.EqualError(t, o.Verify(&context), "Ownership and permissions of archive 'overlay.tar.gz' can't be changed")
+	o = actions.OverlayAction{Source: "overlay", Owner: "user", PreserveOwner: true}
+	assert.EqualError(t, o.Verify(&context), "'preserve-owner' can't be used with 'owner' or 'group'")
+	o = actions.OverlayAction{Source: "overlay", Mode: "0999"}
+	assert.EqualError(t, o.Verify(&context), "Invalid mode '0999'")
+	o = actions.OverlayAction{Source: "overlay", Paths: []actions.OverlayPath{{Path: "[", Mode: "0600"}}}
+	assert.EqualError(t, o.Verify(&context), "Invalid pattern '[': syntax error in pattern")
+}
+
+func TestOverlaySetuid(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Changing the ownership requires root")
+	}
+
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	context := debos.DebosContext{&debos.CommonContext{}, path.Join(dir, "recipe"), ""}
+	context.Rootdir = path.Join(dir, "root")
+	assert.Empty(t, os.MkdirAll(path.Join(context.Rootdir, "etc"), 0755))
+	assert.Empty(t, ioutil.WriteFile(path.Join(context.Rootdir, "etc/passwd"), []byte("root:x:0:0::/root:/bin/sh\nuser:x:1000:1000::/home/user:/bin/sh\n"), 0644))
+
+	source := path.Join(context.RecipeDir, "overlay")
+	assert.Empty(t, os.MkdirAll(path.Join(source, "usr/bin"), 0755))
+	assert.Empty(t, ioutil.WriteFile(path.Join(source, "usr/bin/su"), []byte("su"), 0755))
+	assert.Empty(t, ioutil.WriteFile(path.Join(source, "usr/bin/wall"), []byte("wall"), 0755))
+	assert.Empty(t, filepath.Walk(source, func(p string, info os.FileInfo, err error) error {
+		return os.Lchown(p, 4242, 4242)
+	}))
+	assert.Empty(t, os.Chmod(path.Join(source, "usr/bin/su"), 0755|os.ModeSetuid))
+	assert.Empty(t, os.Chmod(path.Join(source, "usr/bin/wall"), 0755|os.ModeSetgid))
+
+	// The setuid and setgid bits are kept along the ownership change
+	for _, o := range []actions.OverlayAction{
+		{Source: "overlay"},
+		{Source: "overlay", Owner: "user"},
+	} {
+		assert.Empty(t, o.Verify(&context))
+		assert.Empty(t, o.Run(&context))
+		_, _, mode := overlayOwnership(t, path.Join(context.Rootdir, "usr/bin/su"))
+		assert.Equal(t, 0755|os.ModeSetuid, mode)
+		_, _, mode = overlayOwnership(t, path.Join(context.Rootdir, "usr/bin/wall"))
+		assert.Equal(t, 0755|os.ModeSetgid, mode)
+	}
+
+	// Unless the mode is set
+	o := actions.OverlayAction{Source: "overlay", Paths: []actions.OverlayPath{{Path: "usr/bin/su", Mode: "0755"}}}
+	assert.Empty(t, o.Verify(&context))
+	assert.Empty(t, o.Run(&context))
+	_, _, mode := overlayOwnership(t, path.Join(context.Rootdir, "usr/bin/su"))
+	assert.Equal(t, os.FileMode(0755), mode)
+}
+
+func TestOverlayCapabilities(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Setting file capabilities requires root")
+	}
+
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	context := debos.DebosContext{&debos.CommonContext{}, path.Join(dir, "recipe"), ""}
+	context.Rootdir = path.Join(dir, "root")
+	source := path.Join(context.RecipeDir, "overlay/usr/bin")
+	assert.Empty(t, os.MkdirAll(source, 0755))
+	assert.Empty(t, os.MkdirAll(context.Rootdir, 0755))
+	assert.Empty(t, ioutil.WriteFile(path.Join(source, "ping"), []byte("ping"), 0755))
+	if err := syscall.Setxattr(path.Join(source, "ping"), "security.capability", capNetRaw, 0); err != nil {
+		t.Skipf("File capabilities not supported: %v", err)
+	}
+	assert.Empty(t, os.Lchown(path.Join(source, "ping"), 4242, 4242))
+	assert.Empty(t, syscall.Setxattr(path.Join(source, "ping"), "security.capability", capNetRaw, 0))
+
+	// Kept though the owner changes
+	o := actions.OverlayAction{Source: "overlay"}
+	assert.Empty(t, o.Verify(&context))
+	assert.Empty(t, o.Run(&context))
+	assert.Equal(t, capNetRaw, fileCapability(t, path.Join(context.Rootdir, "usr/bin/ping")))
+
+	assert.Empty(t, os.RemoveAll(path.Join(context.Rootdir, "usr")))
+	o = actions.OverlayAction{Source: "overlay", NoXattrs: true}
+	assert.Empty(t, o.Run(&context))
+	assert.Empty(t, fileCapability(t, path.Join(context.Rootdir, "usr/bin/ping")))
+}
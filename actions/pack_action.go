@@ -7,19 +7,48 @@ Yaml syntax:
  - action: pack
    file: filename.ext
    compression: gz
+   threads: 4
+   deterministic: bool
+   preserve-xattrs:
+     - user.*
+   no-xattrs: bool
 
 Mandatory properties:
 
 - file -- name of the output tarball, relative to the artifact directory.
 
-- compression -- compression type to use. Only 'gz' is supported at the moment.
+Optional properties:
 
+- compression -- compression type to use, either 'gz', 'xz' or 'zstd'. By
+default is 'gz'.
+
+- threads -- number of threads used for the compression. By default the
+number of CPUs. The 'gz' compression uses 'pigz' when it is installed, and
+falls back to a single threaded 'gzip' otherwise.
+
+- deterministic -- boolean to produce byte identical tarballs from identical
+trees: the entries are sorted by name, owners are stored as numeric ids only,
+the access and change times as well as the other host specific metadata are
+left out, and only the 'security.capability' extended attributes are kept.
+The modification times are kept, so the files must have the same ones in both
+trees. By default is 'false'.
+
+- preserve-xattrs -- list of patterns of extended attributes to keep in
+addition to 'security.capability' when 'deterministic' is set, for example
+'user.*'.
+
+- no-xattrs -- boolean to leave all the extended attributes out of the
+tarball, the file capabilities included. By default is 'false', so the
+capabilities set by the packages, like 'cap_net_raw' of 'ping', are kept.
 */
 package actions
 
 import (
+	"fmt"
 	"log"
+	"os/exec"
 	"path"
+	"runtime"
 
 	"github.com/go-debos/debos"
 )
@@ -28,14 +57,89 @@ type PackAction struct {
 	debos.BaseAction `yaml:",inline"`
 	Compression      string
 	File             string
+	Threads          int
+	Deterministic    bool
+	PreserveXattrs   []string `yaml:"preserve-xattrs"`
+	NoXattrs         bool     `yaml:"no-xattrs"`
+}
+
+func (pf *PackAction) Verify(context *debos.DebosContext) error {
+	switch pf.Compression {
+	case "":
+		pf.Compression = "gz"
+	case "gz", "xz", "zstd":
+	default:
+		return fmt.Errorf("Unsupported compression '%s'", pf.Compression)
+	}
+
+	if pf.Threads < 0 {
+		return fmt.Errorf("Invalid number of threads %d", pf.Threads)
+	}
+
+	if len(pf.PreserveXattrs) > 0 && !pf.Deterministic {
+		return fmt.Errorf("'preserve-xattrs' property requires 'deterministic'")
+	}
+	if len(pf.PreserveXattrs) > 0 && pf.NoXattrs {
+		return fmt.Errorf("'preserve-xattrs' and 'no-xattrs' properties can't be used together")
+	}
+
+	return nil
+}
+
+// Returns the command compressing its input with the given threads
+func compressorCommand(compression string, threads int) string {
+	switch compression {
+	case "xz":
+		return fmt.Sprintf("xz -T%d", threads)
+	case "zstd":
+		return fmt.Sprintf("zstd -T%d", threads)
+	}
+
+	// Without the name and the time of the input in the gzip header
+	gzip := "gzip -n"
+	if _, err := exec.LookPath("pigz"); err == nil {
+		gzip = fmt.Sprintf("pigz -n -p %d", threads)
+	} else if threads > 1 {
+		log.Printf("pigz not found, compressing with a single thread")
+	}
+
+	return gzip
+}
+
+func (pf *PackAction) tarOptions(outfile string, rootdir string, threads int) []string {
+	options := []string{"tar", "cf", outfile, "--use-compress-program=" + compressorCommand(pf.Compression, threads)}
+
+	if !pf.Deterministic {
+		if pf.NoXattrs {
+			return append(options, "--no-xattrs", "-C", rootdir, ".")
+		}
+		return append(options, "--xattrs", "--xattrs-include=*.*", "-C", rootdir, ".")
+	}
+
+	options = append(options,
+		"--sort=name", "--numeric-owner", "--format=posix",
+		// The default name of the extended headers includes the pid of tar
+		"--pax-option=exthdr.name=%d/PaxHeaders/%f,delete=atime,delete=ctime")
+	if pf.NoXattrs {
+		return append(options, "--no-xattrs", "-C", rootdir, ".")
+	}
+	options = append(options, "--xattrs", "--xattrs-include=security.capability")
+	for _, x := range pf.PreserveXattrs {
+		options = append(options, "--xattrs-include="+x)
+	}
+
+	return append(options, "-C", rootdir, ".")
 }
 
 func (pf *PackAction) Run(context *debos.DebosContext) error {
 	pf.LogStart()
 	outfile := path.Join(context.Artifactdir, pf.File)
 
+	threads := pf.Threads
+	if threads == 0 {
+		threads = runtime.NumCPU()
+	}
+
 	log.Printf("Compressing to %s\n", outfile)
-	return debos.Command{}.Run("Packing", "tar", "czf", outfile,
-		"--xattrs", "--xattrs-include=*.*",
-		"-C", context.Rootdir, ".")
+	return debos.NewCommandForContext(*context).Run("Packing", pf.tarOptions(outfile, context.Rootdir, threads)...)
 }
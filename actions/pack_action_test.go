@@ -0,0 +1,179 @@
+package actions_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/go-debos/debos"
+	"github.com/go-debos/debos/actions"
+	"github.com/stretchr/testify/assert"
+)
+
+// Create the same tree, with the entries created in the given order
+func writePackTree(t *testing.T, rootdir string, files []string) {
+	mtime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for _, f := range files {
+		p := path.Join(rootdir, f)
+		assert.Empty(t, os.MkdirAll(path.Dir(p), 0755))
+		assert.Empty(t, ioutil.WriteFile(p, []byte(f), 0644))
+	}
+	for _, d := range []string{"etc/default", "etc", "usr/bin", "usr", "."} {
+		assert.Empty(t, os.Chmod(path.Join(rootdir, d), 0755))
+	}
+	for _, f := range append(files, "etc/default", "etc", "usr/bin", "usr", ".") {
+		assert.Empty(t, os.Chtimes(path.Join(rootdir, f), mtime, mtime))
+	}
+}
+
+func TestPackDeterministic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	files := []string{"etc/hostname", "etc/default/locale", "usr/bin/tool", "etc/hosts"}
+	reversed := []string{"etc/hosts", "usr/bin/tool", "etc/default/locale", "etc/hostname"}
+
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+	context.Artifactdir = dir
+
+	var tarballs [][]byte
+	for i, order := range [][]string{files, reversed} {
+		context.Rootdir = path.Join(dir, fmt.Sprintf("root%d", i))
+		writePackTree(t, context.Rootdir, order)
+
+		// Only kept when asked to
+		syscall.Setxattr(path.Join(context.Rootdir, order[0]), "user.debos", []byte(order[0]), 0)
+
+		// Packed at different times
+		time.Sleep(time.Second)
+
+		p := actions.PackAction{File: "rootfs.tar.gz", Compression: "gz", Deterministic: true}
+		assert.Empty(t, p.Verify(&context))
+		assert.Empty(t, p.Run(&context))
+
+		tarball, err := ioutil.ReadFile(path.Join(dir, "rootfs.tar.gz"))
+		assert.Empty(t, err)
+		tarballs = append(tarballs, tarball)
+	}
+
+	assert.True(t, bytes.Equal(tarballs[0], tarballs[1]), "Tarballs of identical trees differ")
+
+	p := actions.PackAction{File: "rootfs.tar.gz", PreserveXattrs: []string{"user.*"}}
+	assert.EqualError(t, p.Verify(&context), "'preserve-xattrs' property requires 'deterministic'")
+}
+
+func TestPackCompression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+	context.Artifactdir = dir
+	context.Rootdir = path.Join(dir, "root")
+	writePackTree(t, context.Rootdir, []string{"etc/hostname", "etc/default/locale", "usr/bin/tool"})
+
+	for compression, option := range map[string]string{"gz": "-z", "xz": "-J", "zstd": "--zstd"} {
+		tool := map[string]string{"gz": "gzip", "xz": "xz", "zstd": "zstd"}[compression]
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Logf("%s not installed, skipping", tool)
+			continue
+		}
+
+		for _, threads := range []int{0, 1, 4} {
+			p := actions.PackAction{File: "rootfs.tar." + compression, Compression: compression, Threads: threads}
+			assert.Empty(t, p.Verify(&context))
+			assert.Empty(t, p.Run(&context))
+
+			// Decompressed by the usual single threaded tools
+			unpacked := path.Join(dir, "unpacked")
+			assert.Empty(t, os.MkdirAll(unpacked, 0755))
+			out, err := exec.Command("tar", "-x", option, "-f", path.Join(dir, p.File), "-C", unpacked).CombinedOutput()
+			assert.Empty(t, err, string(out))
+
+			content, err := ioutil.ReadFile(path.Join(unpacked, "usr/bin/tool"))
+			assert.Empty(t, err)
+			assert.Equal(t, "usr/bin/tool", string(content))
+			os.RemoveAll(unpacked)
+		}
+	}
+
+	p := actions.PackAction{File: "rootfs.tar.gz"}
+	assert.Empty(t, p.Verify(&context))
+	assert.Equal(t, "gz", p.Compression)
+
+	p.Compression = "lzma"
+	assert.EqualError(t, p.Verify(&context), "Unsupported compression 'lzma'")
+	p.Compression = "gz"
+	p.Threads = -1
+	assert.EqualError(t, p.Verify(&context), "Invalid number of threads -1")
+}
+
+// 'cap_net_raw=ep', as set by 'setcap' on ping
+var capNetRaw = []byte{0x01, 0x00, 0x00, 0x02, 0x00, 0x20, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+
+func fileCapability(t *testing.T, file string) []byte {
+	value := make([]byte, 64)
+	size, err := syscall.Getxattr(file, "security.capability", value)
+	if err != nil {
+		return nil
+	}
+	return value[:size]
+}
+
+func TestPackUnpackCapabilities(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Setting file capabilities requires root")
+	}
+
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+	context.Artifactdir = dir
+	context.Rootdir = path.Join(dir, "root")
+	writePackTree(t, context.Rootdir, []string{"usr/bin/ping", "etc/default/locale"})
+	ping := path.Join(context.Rootdir, "usr/bin/ping")
+	if err := syscall.Setxattr(ping, "security.capability", capNetRaw, 0); err != nil {
+		t.Skipf("File capabilities not supported: %v", err)
+	}
+
+	for _, p := range []actions.PackAction{
+		{File: "rootfs.tar.gz"},
+		{File: "rootfs.tar.gz", Deterministic: true},
+		{File: "rootfs.tar.gz", NoXattrs: true},
+	} {
+		assert.Empty(t, p.Verify(&context))
+		assert.Empty(t, p.Run(&context))
+
+		for _, noXattrs := range []bool{false, true} {
+			unpacked := debos.DebosContext{&debos.CommonContext{}, "", ""}
+			unpacked.Artifactdir = dir
+			unpacked.Rootdir = path.Join(dir, "unpacked")
+
+			u := actions.UnpackAction{File: "rootfs.tar.gz", NoXattrs: noXattrs}
+			assert.Empty(t, u.Verify(&unpacked))
+			assert.Empty(t, u.Run(&unpacked))
+
+			capability := fileCapability(t, path.Join(unpacked.Rootdir, "usr/bin/ping"))
+			if p.NoXattrs || noXattrs {
+				assert.Empty(t, capability)
+			} else {
+				assert.Equal(t, capNetRaw, capability)
+			}
+			os.RemoveAll(unpacked.Rootdir)
+		}
+	}
+
+	p := actions.PackAction{File: "rootfs.tar.gz", Deterministic: true, NoXattrs: true, PreserveXattrs: []string{"user.*"}}
+	assert.EqualError(t, p.Verify(&context), "'preserve-xattrs' and 'no-xattrs' properties can't be used together")
+}
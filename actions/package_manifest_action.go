@@ -0,0 +1,178 @@
+/*
+PackageManifest Action
+
+Write the list of the packages of the target rootfs to the artifact
+directory, so the packages of two builds can be compared with 'diff'.
+
+The list is a canonical subset of the dpkg database: one line per package
+with its name, architecture, version and status, sorted by name and
+architecture. The fields which change between builds of the same packages,
+like the list of conffiles and their checksums, are left out, so identical
+builds produce identical lists. The packages which were removed without being
+purged are listed with the 'config-files' status, the purged ones are not
+listed.
+
+For example:
+
+ base-files:amd64 12.4+deb12u5 install ok installed
+ libc6:amd64 2.36-9+deb12u4 install ok installed
+
+Yaml syntax:
+ - action: package-manifest
+   file: packages.manifest
+
+Optional properties:
+
+- file -- name of the list, relative to the artifact directory. By default is
+'packages.manifest'.
+*/
+package actions
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/go-debos/debos"
+)
+
+type PackageManifestAction struct {
+	debos.BaseAction `yaml:",inline"`
+	File             string
+}
+
+func NewPackageManifestAction() *PackageManifestAction {
+	return &PackageManifestAction{File: "packages.manifest"}
+}
+
+func (pm *PackageManifestAction) Verify(context *debos.DebosContext) error {
+	if len(pm.File) == 0 {
+		return fmt.Errorf("'file' property can't be empty")
+	}
+	return nil
+}
+
+type dpkgPackage struct {
+	name, arch, version, status string
+	source, sourceVersion       string
+}
+
+/* Returns the packages of the dpkg status file which aren't purged, sorted by
+ * name and architecture */
+func readDpkgStatus(status string) ([]dpkgPackage, error) {
+	f, err := os.Open(status)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var packages []dpkgPackage
+	var current dpkgPackage
+
+	flush := func() {
+		fields := strings.Fields(current.status)
+		if current.name != "" && len(fields) == 3 && fields[2] != "not-installed" {
+			current.status = strings.Join(fields, " ")
+			// Source: name (version) is only set when they differ
+			if current.source == "" {
+				current.source = current.name
+			}
+			if current.sourceVersion == "" {
+				current.sourceVersion = current.version
+			}
+			packages = append(packages, current)
+		}
+		current = dpkgPackage{}
+	}
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			flush()
+			continue
+		}
+		// Continuation of a multiline field
+		if line[0] == ' ' || line[0] == '\t' {
+			continue
+		}
+
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(kv[1])
+		switch kv[0] {
+		case "Package":
+			current.name = value
+		case "Architecture":
+			current.arch = value
+		case "Version":
+			current.version = value
+		case "Status":
+			current.status = value
+		case "Source":
+			fields := strings.Fields(value)
+			if len(fields) > 0 {
+				current.source = fields[0]
+			}
+			if len(fields) > 1 {
+				current.sourceVersion = strings.Trim(fields[1], "()")
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	flush()
+
+	sort.Slice(packages, func(i, j int) bool {
+		if packages[i].name != packages[j].name {
+			return packages[i].name < packages[j].name
+		}
+		return packages[i].arch < packages[j].arch
+	})
+
+	return packages, nil
+}
+
+// Returns the canonical lines of the packages of the dpkg status file
+func packageManifest(status string) ([]string, error) {
+	packages, err := readDpkgStatus(status)
+	if err != nil {
+		return nil, err
+	}
+
+	var lines []string
+	for _, p := range packages {
+		lines = append(lines, fmt.Sprintf("%s:%s %s %s", p.name, p.arch, p.version, p.status))
+	}
+
+	return lines, nil
+}
+
+func (pm *PackageManifestAction) Run(context *debos.DebosContext) error {
+	pm.LogStart()
+
+	lines, err := packageManifest(path.Join(context.Rootdir, "var/lib/dpkg/status"))
+	if err != nil {
+		return err
+	}
+
+	file := path.Join(context.Artifactdir, pm.File)
+	if err := os.MkdirAll(path.Dir(file), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(file, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		return fmt.Errorf("Couldn't write %s: %v", pm.File, err)
+	}
+
+	log.Printf("Wrote the list of %d packages to %s", len(lines), pm.File)
+	return nil
+}
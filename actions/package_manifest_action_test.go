@@ -0,0 +1,83 @@
+package actions_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/go-debos/debos"
+	"github.com/go-debos/debos/actions"
+	"github.com/stretchr/testify/assert"
+)
+
+const manifestStatus = `Package: libc6
+Status: install ok installed
+Priority: optional
+Architecture: amd64
+Multi-Arch: same
+Version: 2.36-9+deb12u4
+Description: GNU C Library: Shared libraries
+ Contains the standard libraries that are used by nearly all programs on
+ the system.
+
+Package: base-files
+Essential: yes
+Status: install ok installed
+Architecture: amd64
+Version: 12.4+deb12u5
+Conffiles:
+ /etc/debian_version %s
+ /etc/issue 9a3d4fba2d0f1b0b1f2e0ec7f87a1d15
+
+Package: libc6
+Status: install ok installed
+Architecture: i386
+Version: 2.36-9+deb12u4
+
+Package: old-tool
+Status: deinstall ok config-files
+Architecture: all
+Version: 1.0-1
+
+Package: purged-tool
+Status: purge ok not-installed
+Architecture: all
+`
+
+func buildManifest(t *testing.T, dir, status string) string {
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+	context.Rootdir = path.Join(dir, "root")
+	context.Artifactdir = path.Join(dir, "artifacts")
+	writeRootfsFile(t, context.Rootdir, "var/lib/dpkg/status", status)
+
+	pm := actions.NewPackageManifestAction()
+	assert.Empty(t, pm.Verify(&context))
+	assert.Empty(t, pm.Run(&context))
+
+	manifest, err := ioutil.ReadFile(path.Join(context.Artifactdir, "packages.manifest"))
+	assert.Empty(t, err)
+	return string(manifest)
+}
+
+func TestPackageManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	// Identical builds with different conffile checksums
+	first := buildManifest(t, path.Join(dir, "first"), strings.Replace(manifestStatus, "%s", "0123", 1))
+	second := buildManifest(t, path.Join(dir, "second"), strings.Replace(manifestStatus, "%s", "4567", 1))
+	assert.Equal(t, first, second)
+	assert.Equal(t, "base-files:amd64 12.4+deb12u5 install ok installed\n"+
+		"libc6:amd64 2.36-9+deb12u4 install ok installed\n"+
+		"libc6:i386 2.36-9+deb12u4 install ok installed\n"+
+		"old-tool:all 1.0-1 deinstall ok config-files\n", first)
+
+	// An upgraded package
+	upgraded := strings.Replace(manifestStatus, "Version: 12.4+deb12u5", "Version: 12.4+deb12u6", 1)
+	third := buildManifest(t, path.Join(dir, "third"), strings.Replace(upgraded, "%s", "0123", 1))
+	assert.NotEqual(t, first, third)
+	assert.Contains(t, third, "base-files:amd64 12.4+deb12u6 install ok installed\n")
+}
@@ -0,0 +1,66 @@
+/*
+Pacman Action
+
+Install packages and their dependencies to the target rootfs with 'pacman',
+the counterpart of the 'apt' action for Arch Linux based systems.
+
+Yaml syntax:
+ - action: pacman
+   packages:
+     - package1
+     - package2
+   clean: bool
+
+Mandatory properties:
+
+- packages -- list of packages to install.
+
+Optional properties:
+
+- clean -- boolean indicating if the downloaded packages are removed from the
+cache of pacman once installed. By default is 'true'.
+
+The packages of the target rootfs are upgraded along with the installation,
+as partial upgrades aren't supported by Arch Linux.
+*/
+package actions
+
+import (
+	"fmt"
+
+	"github.com/go-debos/debos"
+)
+
+type PacmanAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Packages         []string
+	Clean            bool
+}
+
+func NewPacmanAction() *PacmanAction {
+	return &PacmanAction{Clean: true}
+}
+
+func (p *PacmanAction) Verify(context *debos.DebosContext) error {
+	if len(p.Packages) == 0 {
+		return fmt.Errorf("'packages' property can't be empty")
+	}
+	return nil
+}
+
+func (p *PacmanAction) Run(context *debos.DebosContext) error {
+	p.LogStart()
+
+	c := debos.NewChrootCommandForContext(*context)
+	cmdline := []string{"pacman", "-Syu", "--noconfirm", "--needed"}
+	cmdline = append(cmdline, p.Packages...)
+	if err := c.Run("pacman", cmdline...); err != nil {
+		return err
+	}
+
+	if !p.Clean {
+		return nil
+	}
+
+	return c.Run("pacman", "pacman", "-Scc", "--noconfirm")
+}
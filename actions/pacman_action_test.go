@@ -0,0 +1,20 @@
+package actions_test
+
+import (
+	"testing"
+
+	"github.com/go-debos/debos"
+	"github.com/go-debos/debos/actions"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPacmanVerify(t *testing.T) {
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+
+	p := actions.NewPacmanAction()
+	assert.True(t, p.Clean)
+	assert.EqualError(t, p.Verify(&context), "'packages' property can't be empty")
+
+	p.Packages = []string{"linux", "openssh"}
+	assert.Empty(t, p.Verify(&context))
+}
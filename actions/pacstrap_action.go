@@ -0,0 +1,203 @@
+/*
+Pacstrap Action
+
+Construct the target rootfs of an Arch Linux based system with pacstrap, the
+counterpart of the 'debootstrap' action. 'pacstrap' and 'pacman-key' have to
+be installed in the build environment.
+
+Yaml syntax:
+ - action: pacstrap
+   mirrorlist:
+     - https://geo.mirror.pkgbuild.com/$repo/os/$arch
+   repositories: <list of repositories>
+   packages: <list of packages>
+   keyring-init: bool
+   keyring: name
+   check-gpg: bool
+
+Mandatory properties:
+
+- mirrorlist -- list of the servers of the repositories, written as 'Server'
+entries of the '/etc/pacman.d/mirrorlist' of the target rootfs. '$repo' and
+'$arch' are replaced by pacman.
+
+Optional properties:
+
+- repositories -- list of repositories to install the packages from. By
+default 'core' and 'extra'.
+
+- packages -- list of packages to install. By default 'base'.
+
+- keyring-init -- initialize the pacman keyring of the target rootfs and
+populate it with the keys of 'keyring' before installing the packages, true by
+default. Set it to 'false' for a target rootfs which has its keyring set up
+by other means.
+
+- keyring -- keyring to populate the pacman keyring with, as found in
+'/usr/share/pacman/keyrings' of the build environment. By default
+'archlinux'.
+
+- check-gpg -- verify the signatures of the packages, true by default.
+
+The architecture of the recipe is mapped to the one of pacman: 'amd64' to
+'x86_64', 'arm64' to 'aarch64' and 'armhf' to 'armv7h'.
+*/
+package actions
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/go-debos/debos"
+)
+
+// Architectures of pacman per architecture of the recipe
+var pacmanArchitectures = map[string]string{
+	"amd64": "x86_64",
+	"arm64": "aarch64",
+	"armhf": "armv7h",
+}
+
+const pacmanMirrorlist = "/etc/pacman.d/mirrorlist"
+
+type PacstrapAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Mirrorlist       []string
+	Repositories     []string
+	Packages         []string
+	KeyringInit      bool `yaml:"keyring-init"`
+	Keyring          string
+	CheckGpg         bool `yaml:"check-gpg"`
+}
+
+func NewPacstrapAction() *PacstrapAction {
+	return &PacstrapAction{
+		Repositories: []string{"core", "extra"},
+		Packages:     []string{"base"},
+		KeyringInit:  true,
+		Keyring:      "archlinux",
+		CheckGpg:     true,
+	}
+}
+
+func (p *PacstrapAction) Verify(context *debos.DebosContext) error {
+	if len(p.Mirrorlist) == 0 {
+		return fmt.Errorf("'mirrorlist' property can't be empty")
+	}
+	if len(p.Repositories) == 0 {
+		return fmt.Errorf("'repositories' property can't be empty")
+	}
+	if len(p.Packages) == 0 {
+		return fmt.Errorf("'packages' property can't be empty")
+	}
+	if p.KeyringInit && p.Keyring == "" {
+		return fmt.Errorf("'keyring' property can't be empty when 'keyring-init' is set")
+	}
+	if _, found := pacmanArchitectures[context.Architecture]; !found {
+		return fmt.Errorf("Architecture %s isn't supported by pacstrap", context.Architecture)
+	}
+
+	for _, r := range p.Repositories {
+		if r == "" || strings.ContainsAny(r, "[] \t") {
+			return fmt.Errorf("Invalid repository name '%s'", r)
+		}
+	}
+
+	return nil
+}
+
+// Mirrorlist of pacman with the servers
+func pacmanMirrorlistFile(servers []string) string {
+	var b strings.Builder
+	for _, s := range servers {
+		fmt.Fprintf(&b, "Server = %s\n", s)
+	}
+	return b.String()
+}
+
+// Configuration of pacman installing from the repositories of the mirrorlist
+func pacmanConf(architecture, mirrorlist string, repositories []string, checkGpg bool) string {
+	sigLevel := "Required DatabaseOptional"
+	if !checkGpg {
+		sigLevel = "Never"
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "[options]\nArchitecture = %s\nSigLevel = %s\n", architecture, sigLevel)
+	for _, r := range repositories {
+		fmt.Fprintf(&b, "\n[%s]\nInclude = %s\n", r, mirrorlist)
+	}
+	return b.String()
+}
+
+func (p *PacstrapAction) Run(context *debos.DebosContext) error {
+	p.LogStart()
+
+	dir, err := ioutil.TempDir(debos.ScratchDir(context), "pacstrap-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	mirrorlist := path.Join(dir, "mirrorlist")
+	err = ioutil.WriteFile(mirrorlist, []byte(pacmanMirrorlistFile(p.Mirrorlist)), 0644)
+	if err != nil {
+		return err
+	}
+
+	conf := path.Join(dir, "pacman.conf")
+	architecture := pacmanArchitectures[context.Architecture]
+	err = ioutil.WriteFile(conf, []byte(pacmanConf(architecture, mirrorlist, p.Repositories, p.CheckGpg)), 0644)
+	if err != nil {
+		return err
+	}
+
+	/* Keyring initialisation if asked, pacstrap, then the mirrorlist of the
+	 * target rootfs */
+	stages := 2
+	if p.KeyringInit {
+		stages = 3
+	}
+	progress := debos.NewProgress("Pacstrap", stages)
+	cmd := debos.NewCommandForContext(*context)
+
+	// Don't let pacstrap copy the configuration of the build environment
+	cmdline := []string{"pacstrap", "-C", conf, "-M", "-G"}
+	cmdline = append(cmdline, context.Rootdir)
+	cmdline = append(cmdline, p.Packages...)
+
+	if p.KeyringInit {
+		progress.Update(0, "keyring")
+		gpgdir := path.Join(context.Rootdir, "etc/pacman.d/gnupg")
+		if err := os.MkdirAll(gpgdir, 0755); err != nil {
+			return err
+		}
+		err = cmd.Run("pacman-key", "pacman-key", "--gpgdir", gpgdir, "--init")
+		if err != nil {
+			return err
+		}
+		err = cmd.Run("pacman-key", "pacman-key", "--gpgdir", gpgdir, "--populate", p.Keyring)
+		if err != nil {
+			return err
+		}
+		// Passed on to pacman
+		cmdline = append(cmdline, "--gpgdir", gpgdir)
+	}
+
+	progress.Update(stages-2, "pacstrap")
+	if err = cmd.Run("Pacstrap", cmdline...); err != nil {
+		return err
+	}
+
+	progress.Update(stages-1, "mirrorlist")
+	err = ioutil.WriteFile(path.Join(context.Rootdir, pacmanMirrorlist), []byte(pacmanMirrorlistFile(p.Mirrorlist)), 0644)
+	if err != nil {
+		return err
+	}
+
+	progress.Update(stages, "done")
+	return nil
+}
@@ -0,0 +1,49 @@
+package actions
+
+import (
+	"testing"
+
+	"github.com/go-debos/debos"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPacstrapVerify(t *testing.T) {
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+	context.Architecture = "amd64"
+
+	p := NewPacstrapAction()
+	assert.EqualError(t, p.Verify(&context), "'mirrorlist' property can't be empty")
+
+	p.Mirrorlist = []string{"https://geo.mirror.pkgbuild.com/$repo/os/$arch"}
+	assert.Empty(t, p.Verify(&context))
+
+	p.Repositories = []string{"core", "[extra]"}
+	assert.EqualError(t, p.Verify(&context), "Invalid repository name '[extra]'")
+	p.Repositories = []string{"core"}
+
+	p.Keyring = ""
+	assert.Error(t, p.Verify(&context))
+	p.KeyringInit = false
+	assert.Empty(t, p.Verify(&context))
+
+	context.Architecture = "riscv64"
+	assert.EqualError(t, p.Verify(&context), "Architecture riscv64 isn't supported by pacstrap")
+}
+
+func TestPacmanConf(t *testing.T) {
+	assert.Equal(t, "Server = https://one/$repo/os/$arch\nServer = https://two/$repo/os/$arch\n",
+		pacmanMirrorlistFile([]string{"https://one/$repo/os/$arch", "https://two/$repo/os/$arch"}))
+
+	assert.Equal(t, `[options]
+Architecture = aarch64
+SigLevel = Required DatabaseOptional
+
+[core]
+Include = /scratch/mirrorlist
+
+[extra]
+Include = /scratch/mirrorlist
+`, pacmanConf("aarch64", "/scratch/mirrorlist", []string{"core", "extra"}, true))
+
+	assert.Contains(t, pacmanConf("x86_64", "/scratch/mirrorlist", []string{"core"}, false), "SigLevel = Never\n")
+}
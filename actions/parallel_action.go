@@ -0,0 +1,202 @@
+/*
+Parallel Action
+
+Run a group of independent actions at the same time, for example several
+downloads which would otherwise dominate the build time.
+
+Only the actions which don't change the target rootfs can be run in
+parallel: 'download' and 'checksum' actions. The actions of the group must
+not depend on each other, each one only sees the downloads of the actions
+before the group, and the downloads of the group are available to the
+actions after it. The 'checksum' actions still run on the host once all the
+other actions have run, in parallel with each other.
+
+All the actions of the group run to completion even if some of them fail,
+the group then fails with the errors of all the failed actions.
+
+Yaml syntax:
+ - action: parallel
+   max-parallel: 4
+   actions:
+     - action: download
+       url: https://example.com/firmware.tar.gz
+       name: firmware
+     - action: download
+       url: https://example.com/bootloader.bin
+       name: bootloader
+
+Mandatory properties:
+
+- actions -- list of actions to run in parallel.
+
+Optional properties:
+
+- max-parallel -- maximum number of actions run at the same time. The value of
+the '--max-parallel' option, or the number of CPUs when it isn't set, is both
+the default and the upper bound.
+*/
+package actions
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/go-debos/debos"
+	"github.com/go-debos/fakemachine"
+)
+
+type ParallelAction struct {
+	debos.BaseAction `yaml:",inline"`
+	MaxParallel      int `yaml:"max-parallel"`
+	Actions          []YamlAction
+}
+
+func (p *ParallelAction) Verify(context *debos.DebosContext) error {
+	if len(p.Actions) == 0 {
+		return errors.New("'actions' property can't be empty")
+	}
+	if p.MaxParallel < 0 {
+		return fmt.Errorf("Invalid max-parallel %d", p.MaxParallel)
+	}
+
+	for _, a := range p.Actions {
+		switch a.Action.(type) {
+		case *DownloadAction, *ChecksumAction:
+		default:
+			return fmt.Errorf("Action '%s' can't run in parallel, only download and checksum actions can", a)
+		}
+		if err := a.Verify(context); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *ParallelAction) PreMachine(context *debos.DebosContext, m *fakemachine.Machine, args *[]string) error {
+	for _, a := range p.Actions {
+		if err := a.PreMachine(context, m, args); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *ParallelAction) PreNoMachine(context *debos.DebosContext) error {
+	for _, a := range p.Actions {
+		if err := a.PreNoMachine(context); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *ParallelAction) DryRun(context *debos.DebosContext) error {
+	for _, a := range p.Actions {
+		if err := a.DryRun(context); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Number of actions run at the same time
+func (p *ParallelAction) limit(context *debos.DebosContext) int {
+	limit := runtime.NumCPU()
+	if context.MaxParallel > 0 {
+		limit = context.MaxParallel
+	}
+	if p.MaxParallel > 0 && p.MaxParallel < limit {
+		limit = p.MaxParallel
+	}
+
+	return limit
+}
+
+/* Call the function for each action at the same time, with a copy of the
+ * context each. The origins and variables set by the actions are then merged
+ * into the context, in the order of the actions. */
+func (p *ParallelAction) each(context *debos.DebosContext, f func(context *debos.DebosContext, a debos.Action) error) error {
+	contexts := make([]*debos.DebosContext, len(p.Actions))
+	errs := make([]error, len(p.Actions))
+
+	slots := make(chan struct{}, p.limit(context))
+	var wg sync.WaitGroup
+	for idx, a := range p.Actions {
+		common := *context.CommonContext
+		common.Origins = map[string]string{}
+		for k, v := range context.Origins {
+			common.Origins[k] = v
+		}
+		common.Variables = map[string]string{}
+		for k, v := range context.Variables {
+			common.Variables[k] = v
+		}
+		contexts[idx] = &debos.DebosContext{&common, context.RecipeDir, context.Architecture}
+
+		wg.Add(1)
+		go func(idx int, a debos.Action) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			errs[idx] = f(contexts[idx], a)
+		}(idx, a.Action)
+	}
+	wg.Wait()
+
+	var failures []string
+	for idx, c := range contexts {
+		if errs[idx] != nil {
+			failures = append(failures, fmt.Sprintf("  %s: %v", p.Actions[idx], errs[idx]))
+			continue
+		}
+		for k, v := range c.Origins {
+			context.Origins[k] = v
+		}
+		for k, v := range c.Variables {
+			context.Variables[k] = v
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("%d of %d actions failed:\n%s", len(failures), len(p.Actions), strings.Join(failures, "\n"))
+	}
+
+	return nil
+}
+
+func (p *ParallelAction) Run(context *debos.DebosContext) error {
+	p.LogStart()
+	return p.each(context, debos.RunConcurrentAction)
+}
+
+func (p *ParallelAction) Cleanup(context *debos.DebosContext) error {
+	for _, a := range p.Actions {
+		if err := a.Cleanup(context); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *ParallelAction) PostMachine(context *debos.DebosContext) error {
+	return p.each(context, func(context *debos.DebosContext, a debos.Action) error {
+		return a.PostMachine(context)
+	})
+}
+
+func (p *ParallelAction) PostMachineCleanup(context *debos.DebosContext) error {
+	for _, a := range p.Actions {
+		if err := a.PostMachineCleanup(context); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,74 @@
+package actions_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/go-debos/debos"
+	"github.com/go-debos/debos/actions"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParallelDownloads(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing.bin" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer server.Close()
+
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+	context.Scratchdir = dir
+	context.Origins = map[string]string{"recipe": dir}
+	context.Variables = map[string]string{}
+
+	p := actions.ParallelAction{MaxParallel: 2}
+	for _, name := range []string{"firmware", "bootloader", "kernel"} {
+		p.Actions = append(p.Actions, actions.YamlAction{&actions.DownloadAction{
+			Name: name, Url: server.URL + "/" + name + ".bin"}})
+	}
+	assert.Empty(t, p.Verify(&context))
+	assert.Empty(t, p.Run(&context))
+
+	// The downloads of the group are available after it
+	for _, name := range []string{"firmware", "bootloader", "kernel"} {
+		assert.Equal(t, path.Join(dir, name+".bin"), context.Origins[name])
+		content, err := ioutil.ReadFile(context.Origins[name])
+		assert.Empty(t, err)
+		assert.Equal(t, "/"+name+".bin", string(content))
+	}
+	assert.Equal(t, dir, context.Origins["recipe"])
+
+	// All the failures are reported
+	p.Actions = append(p.Actions,
+		actions.YamlAction{&actions.DownloadAction{Name: "missing", Url: server.URL + "/missing.bin"}},
+		actions.YamlAction{&actions.DownloadAction{Name: "other", Url: server.URL + "/missing.bin", Filename: "other.bin"}})
+	err = p.Run(&context)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "2 of 5 actions failed")
+	_, found := context.Origins["missing"]
+	assert.False(t, found)
+}
+
+func TestParallelVerify(t *testing.T) {
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+
+	p := actions.ParallelAction{}
+	assert.EqualError(t, p.Verify(&context), "'actions' property can't be empty")
+
+	apt := actions.NewAptAction()
+	apt.Packages = []string{"vim"}
+	apt.Action = "apt"
+	p.Actions = []actions.YamlAction{{apt}}
+	assert.EqualError(t, p.Verify(&context), "Action 'apt' can't run in parallel, only download and checksum actions can")
+}
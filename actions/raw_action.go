@@ -21,21 +21,31 @@ Optional properties:
 - offset -- offset in bytes for output image file.
 It is possible to use internal templating mechanism of debos to calculate offset
 with sectors (512 bytes) instead of bytes, for instance: '{{ sector 256 }}'.
+Sizes with binary units are accepted as well, for instance '8KiB' or '1MiB',
+'KB' and 'MB' being the same as 'KiB' and 'MiB'.
 The default value is zero.
 
-- partition -- named partition to write to
+- partition -- partition created by an 'image-partition' action to write to,
+rather than the whole image, given by its name or by its GPT name. A value
+matching several partitions is refused. The offset is then relative to the
+start of the partition, resolved from the partition layout of the image.
+
+The action fails if the content would be written past the end of the image or
+of the partition.
 */
 package actions
 
 import (
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"path"
 	"strconv"
 
+	"github.com/docker/go-units"
 	"github.com/go-debos/debos"
 )
 
@@ -46,6 +56,25 @@ type RawAction struct {
 	Source           string // relative path inside of origin
 	Path             string // deprecated option (for backward compatibility)
 	Partition        string // Partition to write otherwise full image
+	offset           int64
+}
+
+// Parse an offset either in bytes, as accepted by Go, or with binary units
+func parseRawOffset(offset string) (int64, error) {
+	if offset == "" {
+		return 0, nil
+	}
+	if o, err := strconv.ParseInt(offset, 0, 64); err == nil {
+		if o < 0 {
+			return 0, fmt.Errorf("Invalid negative offset %s", offset)
+		}
+		return o, nil
+	}
+	o, err := units.RAMInBytes(offset)
+	if err != nil {
+		return 0, fmt.Errorf("Couldn't parse offset %s", offset)
+	}
+	return o, nil
 }
 
 func (raw *RawAction) checkDeprecatedSyntax() error {
@@ -80,7 +109,13 @@ func (raw *RawAction) Verify(context *debos.DebosContext) error {
 		return errors.New("'origin' and 'source' properties can't be empty")
 	}
 
-	return nil
+	var err error
+	raw.offset, err = parseRawOffset(raw.Offset)
+	return err
+}
+
+func (raw *RawAction) DryRun(context *debos.DebosContext) error {
+	return debos.CheckOrigin(context, raw.Origin, raw.Source)
 }
 
 func (raw *RawAction) Run(context *debos.DebosContext) error {
@@ -98,16 +133,24 @@ func (raw *RawAction) Run(context *debos.DebosContext) error {
 
 	var devicePath string
 	if raw.Partition != "" {
-		for _, p := range context.ImagePartitions {
-			if p.Name == raw.Partition {
-				devicePath = p.DevicePath
-				break
+		var partition *debos.Partition
+		for i, p := range context.ImagePartitions {
+			if p.Name != raw.Partition && p.Label != raw.Partition {
+				continue
 			}
+			if partition != nil {
+				return fmt.Errorf("Partition %s is ambiguous, matching partitions %s and %s",
+					raw.Partition, partition.Name, p.Name)
+			}
+			partition = &context.ImagePartitions[i]
 		}
 
-		if devicePath == "" {
+		if partition == nil {
 			return fmt.Errorf("Failed to find partition named %s", raw.Partition)
 		}
+		devicePath = partition.DevicePath
+		log.Printf("Writing %s at offset %d of partition %s, offset %d of the image",
+			raw.Source, raw.offset, partition.Name, partition.Offset+raw.offset)
 	} else {
 		devicePath = context.Image
 	}
@@ -118,11 +161,17 @@ func (raw *RawAction) Run(context *debos.DebosContext) error {
 	}
 	defer target.Close()
 
-	offset, err := strconv.ParseInt(raw.Offset, 0, 64)
+	// Works for both the image files and the block devices
+	size, err := target.Seek(0, io.SeekEnd)
 	if err != nil {
-		return fmt.Errorf("Couldn't parse offset %v", err)
+		return fmt.Errorf("Couldn't get the size of %s: %v", devicePath, err)
+	}
+	if end := raw.offset + int64(len(content)); end > size {
+		return fmt.Errorf("Writing %d bytes at offset %d overflows %s by %d bytes",
+			len(content), raw.offset, devicePath, end-size)
 	}
-	bytes, err := target.WriteAt(content, offset)
+
+	bytes, err := target.WriteAt(content, raw.offset)
 	if bytes != len(content) {
 		return fmt.Errorf("Couldn't write complete data %v", err)
 	}
@@ -0,0 +1,88 @@
+package actions_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/go-debos/debos"
+	"github.com/go-debos/debos/actions"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRawOffset(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+	context.Origins = map[string]string{"recipe": dir}
+	context.Image = path.Join(dir, "image.img")
+	assert.Empty(t, ioutil.WriteFile(context.Image, make([]byte, 16*1024), 0644))
+	partition := path.Join(dir, "partition.img")
+	assert.Empty(t, ioutil.WriteFile(partition, make([]byte, 4*1024), 0644))
+	context.ImagePartitions = []debos.Partition{
+		{Name: "boot", DevicePath: partition, Number: 1, Offset: 8 * 1024, Size: 4 * 1024, Label: "loader"},
+		{Name: "root", DevicePath: path.Join(dir, "missing.img"), Number: 2, Label: "rootfs"},
+		{Name: "data", DevicePath: path.Join(dir, "missing.img"), Number: 3, Label: "root"},
+	}
+	assert.Empty(t, ioutil.WriteFile(path.Join(dir, "loader.bin"), []byte("loader"), 0644))
+
+	for offset, expected := range map[string]int{
+		"":       0,
+		"0x200":  512,
+		"1024":   1024,
+		"8KiB":   8 * 1024,
+		"2 KiB":  2 * 1024,
+		"1.5KiB": 1536,
+	} {
+		r := actions.RawAction{Origin: "recipe", Source: "loader.bin", Offset: offset}
+		assert.Empty(t, r.Verify(&context))
+		assert.Empty(t, r.Run(&context))
+
+		image, err := ioutil.ReadFile(context.Image)
+		assert.Empty(t, err)
+		assert.Equal(t, "loader", string(image[expected:expected+6]))
+	}
+
+	// The offset is relative to the partition
+	r := actions.RawAction{Origin: "recipe", Source: "loader.bin", Offset: "1KiB", Partition: "boot"}
+	assert.Empty(t, r.Verify(&context))
+	assert.Empty(t, r.Run(&context))
+	content, err := ioutil.ReadFile(partition)
+	assert.Empty(t, err)
+	assert.Equal(t, "loader", string(content[1024:1030]))
+
+	// Overflows
+	r = actions.RawAction{Origin: "recipe", Source: "loader.bin", Offset: "4092", Partition: "boot"}
+	assert.Empty(t, r.Verify(&context))
+	assert.EqualError(t, r.Run(&context), "Writing 6 bytes at offset 4092 overflows "+partition+" by 2 bytes")
+	r = actions.RawAction{Origin: "recipe", Source: "loader.bin", Offset: "16KiB"}
+	assert.Empty(t, r.Verify(&context))
+	assert.EqualError(t, r.Run(&context), "Writing 6 bytes at offset 16384 overflows "+context.Image+" by 6 bytes")
+	image, err := os.Stat(context.Image)
+	assert.Empty(t, err)
+	assert.Equal(t, int64(16*1024), image.Size())
+
+	// Partitions are found by their GPT label as well
+	r = actions.RawAction{Origin: "recipe", Source: "loader.bin", Offset: "2KiB", Partition: "loader"}
+	assert.Empty(t, r.Verify(&context))
+	assert.Empty(t, r.Run(&context))
+	content, err = ioutil.ReadFile(partition)
+	assert.Empty(t, err)
+	assert.Equal(t, "loader", string(content[2048:2054]))
+
+	r = actions.RawAction{Origin: "recipe", Source: "loader.bin", Partition: "root"}
+	assert.Empty(t, r.Verify(&context))
+	assert.EqualError(t, r.Run(&context), "Partition root is ambiguous, matching partitions root and data")
+
+	r = actions.RawAction{Origin: "recipe", Source: "loader.bin", Partition: "home"}
+	assert.Empty(t, r.Verify(&context))
+	assert.EqualError(t, r.Run(&context), "Failed to find partition named home")
+
+	r = actions.RawAction{Origin: "recipe", Source: "loader.bin", Offset: "eight"}
+	assert.EqualError(t, r.Verify(&context), "Couldn't parse offset eight")
+	r = actions.RawAction{Origin: "recipe", Source: "loader.bin", Offset: "-1"}
+	assert.EqualError(t, r.Verify(&context), "Invalid negative offset -1")
+}
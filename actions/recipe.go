@@ -35,18 +35,209 @@ Mandatory properties for receipt:
 
 - actions -- at least one action should be listed
 
+Optional properties for receipt:
+
+- pass-env -- list of host environment variables forwarded to the commands
+run by the actions, including the ones run in the target filesystem. Only the
+listed variables are forwarded, and only when they are set on the host. A
+value given with '--environ-var' takes precedence over the host value, and the
+'env' property of the 'run' action takes precedence over both. Only the
+top-level recipe is taken into account.
+
+- path-prepend -- list of directories of the target filesystem prepended to
+'PATH' for all the commands run in it, by the 'run' actions as well as by the
+other actions like 'apt'. For example a host toolchain bind mounted by the
+'mounts' of 'run' actions, or wrapped compilers installed with an 'overlay',
+can then be used by all the build steps. The 'ccache' directory comes first
+when it is set.
+
+- env -- map of environment variables set for all the commands run in the
+target filesystem. They take precedence over the variables of 'pass-env' and
+'--environ-var', and the 'env' property of the 'run' action takes precedence
+over them. 'PATH' is set with 'path-prepend' instead.
+
+- apt-proxy -- HTTP proxy used by apt to download packages, for example
+'http://localhost:3142' for a local apt-cacher-ng. The proxy is configured in
+the target filesystem only while apt runs.
+
+- apt-cache -- host directory, relative to the recipe directory, mounted on
+'/var/cache/apt/archives' while apt runs so downloaded packages are kept
+across builds.
+
+- apt-cache-clean -- let 'apt-get clean' empty the 'apt-cache' directory. By
+default is 'false': the directory is unmounted before cleaning up, and only
+the packages which are part of the target filesystem are removed.
+
+- apt-snapshot -- date or time of snapshot.debian.org to install the packages
+from, for example '2024-01-31' or '20240131T120000Z', so the same packages are
+installed whenever the recipe is built. While the actions using apt run, the
+Debian archives of the apt sources of the target filesystem, like
+'deb.debian.org/debian' or 'security.debian.org/debian-security', point to
+their snapshot, the other repositories are left alone, and apt doesn't check
+how old the archives are. The sources are restored afterwards. The 'debootstrap'
+actions download the base system from the snapshot of their mirror too. The
+snapshot is fetched with http, so it goes through the 'apt-proxy' like the
+mirrors; the 'apt-cache' can be shared with builds not using the snapshot, as
+apt only picks the cached packages of the versions of the snapshot.
+
+- ccache -- host directory, relative to the recipe directory, used as
+persistent ccache by the 'run' actions. When running in the target filesystem
+it is mounted on '/var/cache/ccache'. 'CCACHE_DIR' is set accordingly and
+'/usr/lib/ccache' is prepended to 'PATH', so compilers go through ccache if it
+is installed. If unset, ccache is left alone.
+
+- defaults -- map of default properties per action type, used by the actions
+of that type of the recipe file which don't set them. The properties are
+replaced as a whole, maps and lists are not merged. For example:
+
+ defaults:
+   apt:
+     unauthenticated: true
+   overlay:
+     origin: files
+
+Included files and sub-recipes have their own defaults.
+
+- variables -- map of the template variables of the recipe, given with
+'-t name:value', to document them and check them before the build. Each one
+can have a 'description', a 'default' value used when it isn't given, or be
+'required': the recipe then fails to load, listing all the missing ones,
+unless they are given. For example:
+
+ variables:
+   suite:
+     description: Debian suite to build
+     default: bookworm
+   hostname:
+     description: Host name of the image
+     required: true
+
+The declarations are read from the recipe rendered with the given variables
+only, so they can't use the defaults themselves. '--dry-run' lists the
+declared variables with their values. The variables of included files aren't
+taken into account, sub-recipes declare their own.
+
+- memory -- amount of memory of the fakemachine build VM, for example '8GB'.
+The default is '2GB', and at least '256MB' is required.
+
+- cpus -- number of CPUs of the fakemachine build VM. The default is 2.
+
+The '--memory' and '--cpus' command line options take precedence over 'memory'
+and 'cpus', which are ignored when debos runs without fakemachine.
+
+Only the top-level recipe is taken into account for these properties.
+
+Common action properties
+
+All actions support the following optional properties:
+
+- description -- text used instead of the action name in the logs.
+
+- timeout -- maximum duration of the action, for example '30m' or '1h30m'.
+Once it expires the commands run by the action are sent SIGTERM, then SIGKILL
+if they are still running 10 seconds later, and the build fails. Only the
+main stage of the action, run in the fake machine if one is used, is
+accounted. By default there is no timeout.
+
+- quiet -- keep the output of the commands run by the action out of the log
+unless one of them fails, to keep chatty commands like apt from flooding it.
+
+- verbose -- log each command run by the action before its output, to debug
+the action. It can't be set along with 'quiet'.
+
+By default the output of the commands is logged as they run.
+
+- retries -- number of times the action is run again when it fails, for
+example for a script depending on a flaky network service. By default 0. Only
+the main stage of the action, run in the fake machine if one is used, is run
+again, and each attempt has its own timeout. An interrupted build isn't
+retried. As the failed attempt may have left changes behind, for example in
+the target filesystem, only actions which can safely run again over them
+should be retried.
+
+- retry-delay -- time to wait before running the action again, for example
+'30s'. By default the action runs again right away.
+
 Supported actions
 
+- accept-licenses -- https://godoc.org/github.com/go-debos/debos/actions#hdr-AcceptLicenses_Action
+
 - apt -- https://godoc.org/github.com/go-debos/debos/actions#hdr-Apt_Action
 
+- apt-kernel-cleanup -- https://godoc.org/github.com/go-debos/debos/actions#hdr-AptKernelCleanup_Action
+
+- apt-repository -- https://godoc.org/github.com/go-debos/debos/actions#hdr-AptRepository_Action
+
+- apt-update-timer -- https://godoc.org/github.com/go-debos/debos/actions#hdr-AptUpdateTimer_Action
+
+- bootloader -- https://godoc.org/github.com/go-debos/debos/actions#hdr-Bootloader_Action
+
+- ca-certificates -- https://godoc.org/github.com/go-debos/debos/actions#hdr-CaCertificates_Action
+
+- cgroup -- https://godoc.org/github.com/go-debos/debos/actions#hdr-Cgroup_Action
+
+- check-boot-size -- https://godoc.org/github.com/go-debos/debos/actions#hdr-CheckBootSize_Action
+
+- check-efi -- https://godoc.org/github.com/go-debos/debos/actions#hdr-CheckEfi_Action
+
+- check-symlinks -- https://godoc.org/github.com/go-debos/debos/actions#hdr-CheckSymlinks_Action
+
+- checksum -- https://godoc.org/github.com/go-debos/debos/actions#hdr-Checksum_Action
+
+- collect -- https://godoc.org/github.com/go-debos/debos/actions#hdr-Collect_Action
+
+- compress -- https://godoc.org/github.com/go-debos/debos/actions#hdr-Compress_Action
+
+- content-digest -- https://godoc.org/github.com/go-debos/debos/actions#hdr-ContentDigest_Action
+
+- debconf -- https://godoc.org/github.com/go-debos/debos/actions#hdr-Debconf_Action
+
 - debootstrap -- https://godoc.org/github.com/go-debos/debos/actions#hdr-Debootstrap_Action
 
+- debug-shell -- https://godoc.org/github.com/go-debos/debos/actions#hdr-DebugShell_Action
+
+- defragment -- https://godoc.org/github.com/go-debos/debos/actions#hdr-Defragment_Action
+
 - download -- https://godoc.org/github.com/go-debos/debos/actions#hdr-Download_Action
 
+- dpkg-triggers -- https://godoc.org/github.com/go-debos/debos/actions#hdr-DpkgTriggers_Action
+
+- extension-release -- https://godoc.org/github.com/go-debos/debos/actions#hdr-ExtensionRelease_Action
+
+- factory-etc -- https://godoc.org/github.com/go-debos/debos/actions#hdr-FactoryEtc_Action
+
+- fail2ban -- https://godoc.org/github.com/go-debos/debos/actions#hdr-Fail2ban_Action
+
 - filesystem-deploy -- https://godoc.org/github.com/go-debos/debos/actions#hdr-FilesystemDeploy_Action
 
+- firewall -- https://godoc.org/github.com/go-debos/debos/actions#hdr-Firewall_Action
+
+- flash-script -- https://godoc.org/github.com/go-debos/debos/actions#hdr-FlashScript_Action
+
+- foreach -- https://godoc.org/github.com/go-debos/debos/actions#hdr-Foreach_Action
+
+- gpg-ephemeral-key -- https://godoc.org/github.com/go-debos/debos/actions#hdr-GpgEphemeralKey_Action
+
+- grub -- https://godoc.org/github.com/go-debos/debos/actions#hdr-Grub_Action
+
+- harden-permissions -- https://godoc.org/github.com/go-debos/debos/actions#hdr-HardenPermissions_Action
+
 - image-partition -- https://godoc.org/github.com/go-debos/debos/actions#hdr-ImagePartition_Action
 
+- include -- https://godoc.org/github.com/go-debos/debos/actions#hdr-Include_Action
+
+- journal-forward -- https://godoc.org/github.com/go-debos/debos/actions#hdr-JournalForward_Action
+
+- machine-info -- https://godoc.org/github.com/go-debos/debos/actions#hdr-MachineInfo_Action
+
+- man-db -- https://godoc.org/github.com/go-debos/debos/actions#hdr-ManDb_Action
+
+- multiarch -- https://godoc.org/github.com/go-debos/debos/actions#hdr-Multiarch_Action
+
+- needrestart -- https://godoc.org/github.com/go-debos/debos/actions#hdr-Needrestart_Action
+
+- oci -- https://godoc.org/github.com/go-debos/debos/actions#hdr-Oci_Action
+
 - ostree-commit -- https://godoc.org/github.com/go-debos/debos/actions#hdr-OstreeCommit_Action
 
 - ostree-deploy -- https://godoc.org/github.com/go-debos/debos/actions#hdr-OstreeDeploy_Action
@@ -55,26 +246,74 @@ Supported actions
 
 - pack -- https://godoc.org/github.com/go-debos/debos/actions#hdr-Pack_Action
 
+- package-manifest -- https://godoc.org/github.com/go-debos/debos/actions#hdr-PackageManifest_Action
+
+- pacman -- https://godoc.org/github.com/go-debos/debos/actions#hdr-Pacman_Action
+
+- pacstrap -- https://godoc.org/github.com/go-debos/debos/actions#hdr-Pacstrap_Action
+
+- parallel -- https://godoc.org/github.com/go-debos/debos/actions#hdr-Parallel_Action
+
 - raw -- https://godoc.org/github.com/go-debos/debos/actions#hdr-Raw_Action
 
 - recipe -- https://godoc.org/github.com/go-debos/debos/actions#hdr-Recipe_Action
 
+- repositories -- https://godoc.org/github.com/go-debos/debos/actions#hdr-Repositories_Action
+
+- root-hash -- https://godoc.org/github.com/go-debos/debos/actions#hdr-RootHash_Action
+
 - run -- https://godoc.org/github.com/go-debos/debos/actions#hdr-Run_Action
 
+- sbom -- https://godoc.org/github.com/go-debos/debos/actions#hdr-Sbom_Action
+
+- selinux-relabel -- https://godoc.org/github.com/go-debos/debos/actions#hdr-SelinuxRelabel_Action
+
+- shrink -- https://godoc.org/github.com/go-debos/debos/actions#hdr-Shrink_Action
+
+- sign -- https://godoc.org/github.com/go-debos/debos/actions#hdr-Sign_Action
+
+- slim -- https://godoc.org/github.com/go-debos/debos/actions#hdr-Slim_Action
+
+- smartd -- https://godoc.org/github.com/go-debos/debos/actions#hdr-Smartd_Action
+
+- squashfs -- https://godoc.org/github.com/go-debos/debos/actions#hdr-Squashfs_Action
+
+- swap -- https://godoc.org/github.com/go-debos/debos/actions#hdr-Swap_Action
+
+- systemd -- https://godoc.org/github.com/go-debos/debos/actions#hdr-Systemd_Action
+
+- template-file -- https://godoc.org/github.com/go-debos/debos/actions#hdr-TemplateFile_Action
+
+- test-boot -- https://godoc.org/github.com/go-debos/debos/actions#hdr-TestBoot_Action
+
 - unpack -- https://godoc.org/github.com/go-debos/debos/actions#hdr-Unpack_Action
+
+- update-initramfs -- https://godoc.org/github.com/go-debos/debos/actions#hdr-UpdateInitramfs_Action
+
+- usr-merge -- https://godoc.org/github.com/go-debos/debos/actions#hdr-UsrMerge_Action
+
+- verify-image -- https://godoc.org/github.com/go-debos/debos/actions#hdr-VerifyImage_Action
+
+- wifi-regdom -- https://godoc.org/github.com/go-debos/debos/actions#hdr-WifiRegdom_Action
+
+- write-file -- https://godoc.org/github.com/go-debos/debos/actions#hdr-WriteFile_Action
 */
 package actions
 
 import (
 	"bytes"
 	"fmt"
+	"github.com/docker/go-units"
 	"github.com/go-debos/debos"
 	"gopkg.in/yaml.v2"
 	"path"
+	"path/filepath"
 	"text/template"
 	"log"
+	"net/url"
 	"strings"
 	"reflect"
+	"time"
 )
 
 /* the YamlAction just embed the Action interface and implements the
@@ -85,8 +324,58 @@ type YamlAction struct {
 }
 
 type Recipe struct {
-	Architecture string
-	Actions      []YamlAction
+	Architecture  string
+	PassEnv       []string `yaml:"pass-env"`
+	PathPrepend   []string `yaml:"path-prepend"`
+	Env           map[string]string
+	AptProxy      string   `yaml:"apt-proxy"`
+	AptCache      string   `yaml:"apt-cache"`
+	AptCacheClean bool     `yaml:"apt-cache-clean"`
+	AptSnapshot   string   `yaml:"apt-snapshot"`
+	Ccache        string
+	Memory        string
+	Cpus          int
+	Defaults      map[string]yaml.MapSlice
+	Variables     RecipeVariables
+	Actions       []YamlAction
+	undefined     []string          // Files using undefined template variables
+	templateVars  map[string]string // Values of the template variables, defaults included
+}
+
+// Template variable declared in the 'variables' block of a recipe
+type RecipeVariable struct {
+	Name        string `yaml:"-"`
+	Default     *string
+	Required    bool
+	Description string
+}
+
+// Declared template variables, in the order of the recipe
+type RecipeVariables []RecipeVariable
+
+func (v *RecipeVariables) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var declarations yaml.MapSlice
+	if err := unmarshal(&declarations); err != nil {
+		return err
+	}
+
+	for _, d := range declarations {
+		variable := RecipeVariable{}
+		data, err := yaml.Marshal(d.Value)
+		if err != nil {
+			return err
+		}
+		if err := yaml.Unmarshal(data, &variable); err != nil {
+			return fmt.Errorf("Invalid declaration of variable '%v': %v", d.Key, err)
+		}
+		variable.Name = fmt.Sprint(d.Key)
+		if variable.Required && variable.Default != nil {
+			return fmt.Errorf("Variable '%s' can't be both required and have a default", variable.Name)
+		}
+		*v = append(*v, variable)
+	}
+
+	return nil
 }
 
 func (y *YamlAction) UnmarshalYAML(unmarshal func(interface{}) error) error {
@@ -97,6 +386,18 @@ func (y *YamlAction) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		return err
 	}
 
+	if aux.Timeout < 0 {
+		return fmt.Errorf("Invalid timeout '%s' for action '%s'", aux.Timeout, aux.Action)
+	}
+
+	if aux.Retries < 0 || aux.RetryDelay < 0 {
+		return fmt.Errorf("Invalid retries for action '%s'", aux.Action)
+	}
+
+	if aux.Quiet && aux.Verbose {
+		return fmt.Errorf("Action '%s' can't be both quiet and verbose", aux.Action)
+	}
+
 	switch aux.Action {
 	case "debootstrap":
 		y.Action = NewDebootstrapAction()
@@ -107,9 +408,9 @@ func (y *YamlAction) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	case "run":
 		y.Action = &RunAction{}
 	case "apt":
-		y.Action = &AptAction{}
+		y.Action = NewAptAction()
 	case "ostree-commit":
-		y.Action = &OstreeCommitAction{}
+		y.Action = NewOstreeCommitAction()
 	case "ostree-deploy":
 		y.Action = NewOstreeDeployAction()
 	case "overlay":
@@ -124,6 +425,118 @@ func (y *YamlAction) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		y.Action = &DownloadAction{}
 	case "recipe":
 		y.Action = &RecipeAction{}
+	case "root-hash":
+		y.Action = NewRootHashAction()
+	case "journal-forward":
+		y.Action = NewJournalForwardAction()
+	case "swap":
+		y.Action = NewSwapAction()
+	case "machine-info":
+		y.Action = &MachineInfoAction{}
+	case "flash-script":
+		y.Action = NewFlashScriptAction()
+	case "content-digest":
+		y.Action = NewContentDigestAction()
+	case "apt-update-timer":
+		y.Action = NewAptUpdateTimerAction()
+	case "include":
+		y.Action = &IncludeAction{}
+	case "collect":
+		y.Action = &CollectAction{}
+	case "usr-merge":
+		y.Action = &UsrMergeAction{}
+	case "cgroup":
+		y.Action = NewCgroupAction()
+	case "dpkg-triggers":
+		y.Action = &DpkgTriggersAction{}
+	case "check-symlinks":
+		y.Action = &CheckSymlinksAction{}
+	case "factory-etc":
+		y.Action = NewFactoryEtcAction()
+	case "apt-repository":
+		y.Action = NewAptRepositoryAction()
+	case "fail2ban":
+		y.Action = NewFail2banAction()
+	case "firewall":
+		y.Action = NewFirewallAction()
+	case "accept-licenses":
+		y.Action = &AcceptLicensesAction{}
+	case "apt-kernel-cleanup":
+		y.Action = NewAptKernelCleanupAction()
+	case "repositories":
+		y.Action = &RepositoriesAction{}
+	case "check-boot-size":
+		y.Action = NewCheckBootSizeAction()
+	case "smartd":
+		y.Action = &SmartdAction{}
+	case "ca-certificates":
+		y.Action = &CaCertificatesAction{}
+	case "defragment":
+		y.Action = NewDefragmentAction()
+	case "check-efi":
+		y.Action = &CheckEfiAction{}
+	case "gpg-ephemeral-key":
+		y.Action = NewGpgEphemeralKeyAction()
+	case "needrestart":
+		y.Action = NewNeedrestartAction()
+	case "compress":
+		y.Action = NewCompressAction()
+	case "man-db":
+		y.Action = NewManDbAction()
+	case "wifi-regdom":
+		y.Action = NewWifiRegdomAction()
+	case "extension-release":
+		y.Action = &ExtensionReleaseAction{}
+	case "checksum":
+		y.Action = NewChecksumAction()
+	case "harden-permissions":
+		y.Action = NewHardenPermissionsAction()
+	case "sign":
+		y.Action = NewSignAction()
+	case "package-manifest":
+		y.Action = NewPackageManifestAction()
+	case "sbom":
+		y.Action = NewSbomAction()
+	case "squashfs":
+		y.Action = NewSquashfsAction()
+	case "parallel":
+		y.Action = &ParallelAction{}
+	case "pacstrap":
+		y.Action = NewPacstrapAction()
+	case "pacman":
+		y.Action = NewPacmanAction()
+	case "template-file":
+		y.Action = NewTemplateFileAction()
+	case "foreach":
+		y.Action = NewForeachAction()
+	case "debug-shell":
+		y.Action = &DebugShellAction{}
+	case "multiarch":
+		y.Action = &MultiarchAction{}
+	case "update-initramfs":
+		y.Action = NewUpdateInitramfsAction()
+	case "bootloader":
+		y.Action = NewBootloaderAction()
+	case "grub":
+		y.Action = NewGrubAction()
+	case "debconf":
+		y.Action = NewDebconfAction()
+	case "systemd":
+		y.Action = &SystemdAction{}
+	case "slim":
+		y.Action = &SlimAction{}
+	case "verify-image":
+		y.Action = &VerifyImageAction{}
+	case "shrink":
+		y.Action = &ShrinkAction{}
+	case "selinux-relabel":
+		y.Action = &SelinuxRelabelAction{}
+	case "oci":
+		y.Action = NewOciAction()
+	case "test-boot":
+		y.Action = NewTestBootAction()
+	case "write-file":
+		y.Action = &WriteFileAction{}
 	default:
 		return fmt.Errorf("Unknown action: %v", aux.Action)
 	}
@@ -211,6 +624,45 @@ func DumpActionFields(iface interface{}, depth int) {
 	}
 }
 
+// Smallest memory the build VM boots with
+const minMachineMemory = 256 * 1024 * 1024
+
+/* Returns the snapshot.debian.org timestamp of a date, a RFC 3339 time or a
+ * timestamp */
+func parseAptSnapshot(snapshot string) (string, error) {
+	for _, layout := range []string{"20060102T150405Z", time.RFC3339, "2006-01-02"} {
+		if t, err := time.Parse(layout, snapshot); err == nil {
+			return t.UTC().Format("20060102T150405Z"), nil
+		}
+	}
+	return "", fmt.Errorf("Invalid apt snapshot '%s', expected a date like '2024-01-31' or a timestamp like '20240131T120000Z'", snapshot)
+}
+
+/* Returns the memory in MB and the number of CPUs of the build VM, using the
+ * defaults for the unset values */
+func MachineResources(memory string, cpus int) (int, int, error) {
+	if memory == "" {
+		memory = "2GB"
+	}
+	size, err := units.RAMInBytes(memory)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Couldn't parse memory size: %v", err)
+	}
+	if size < minMachineMemory {
+		return 0, 0, fmt.Errorf("Memory of the build VM must be at least %s, got '%s'",
+			units.BytesSize(minMachineMemory), memory)
+	}
+
+	if cpus < 0 {
+		return 0, 0, fmt.Errorf("Invalid number of CPUs %d", cpus)
+	}
+	if cpus == 0 {
+		cpus = 2
+	}
+
+	return int(size / 1024 / 1024), cpus, nil
+}
+
 /*
 Parse method reads YAML recipe file and map all steps to appropriate actions.
 
@@ -220,6 +672,172 @@ Parse method reads YAML recipe file and map all steps to appropriate actions.
 engine. Multiple template maps have no effect; only first map will be used.
 */
 func (r *Recipe) Parse(file string, printRecipe bool, dump bool, templateVars ...map[string]string) error {
+	if len(templateVars) == 0 || templateVars[0] == nil {
+		templateVars = []map[string]string{make(map[string]string)}
+	}
+
+	if err := r.declareVariables(file, templateVars[0]); err != nil {
+		return err
+	}
+	r.templateVars = templateVars[0]
+
+	if err := r.render(file, printRecipe, dump, templateVars[0]); err != nil {
+		return err
+	}
+
+	if len(r.Architecture) == 0 {
+		return fmt.Errorf("Recipe file must have 'architecture' property")
+	}
+
+	if len(r.Actions) == 0 {
+		return fmt.Errorf("Recipe file must have at least one action")
+	}
+
+	for _, e := range r.PassEnv {
+		if !variableName.MatchString(e) {
+			return fmt.Errorf("Invalid environment variable name '%s'", e)
+		}
+	}
+
+	for _, p := range r.PathPrepend {
+		if !path.IsAbs(p) || strings.Contains(p, ":") {
+			return fmt.Errorf("Invalid path-prepend directory '%s', expected an absolute path without ':'", p)
+		}
+	}
+	for k := range r.Env {
+		if !variableName.MatchString(k) {
+			return fmt.Errorf("Invalid environment variable name '%s'", k)
+		}
+		if k == "PATH" {
+			return fmt.Errorf("'env' can't set PATH, use 'path-prepend' instead")
+		}
+	}
+
+	if r.AptProxy != "" {
+		u, err := url.Parse(r.AptProxy)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("Invalid apt proxy '%s', expected an http or https URL", r.AptProxy)
+		}
+	}
+
+	if r.AptSnapshot != "" {
+		timestamp, err := parseAptSnapshot(r.AptSnapshot)
+		if err != nil {
+			return err
+		}
+		r.AptSnapshot = timestamp
+	}
+
+	if _, _, err := MachineResources(r.Memory, r.Cpus); err != nil {
+		return err
+	}
+
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return err
+	}
+	if err := r.expandIncludes([]string{abs}, printRecipe, dump, templateVars[0]); err != nil {
+		return err
+	}
+
+	if dump {
+		DumpActions(reflect.ValueOf(*r).Interface(), 0)
+	}
+
+	/* Let included recipes pass down the variables of this recipe, and
+	 * template-file and foreach actions render them */
+	for _, a := range r.Actions {
+		switch action := a.Action.(type) {
+		case *RecipeAction:
+			action.parentVars = templateVars[0]
+		case *TemplateFileAction:
+			action.templateVars = templateVars[0]
+		case *ForeachAction:
+			action.templateVars = templateVars[0]
+		}
+	}
+
+	return nil
+}
+
+/* Files of the recipe using undefined template variables, including the
+ * included files and the sub-recipes once verified */
+func (r *Recipe) UndefinedVariables() []string {
+	files := append([]string{}, r.undefined...)
+	for _, a := range r.Actions {
+		if recipe, ok := a.Action.(*RecipeAction); ok {
+			files = append(files, recipe.Actions.UndefinedVariables()...)
+		}
+	}
+
+	return files
+}
+
+/* Lines describing the variables declared by the recipe, with their value
+ * once the defaults are applied */
+func (r *Recipe) DescribeVariables() []string {
+	var lines []string
+	for _, v := range r.Variables {
+		line := v.Name + ": unset"
+		if value, found := r.templateVars[v.Name]; found {
+			line = fmt.Sprintf("%s: %q", v.Name, value)
+		}
+		if v.Required {
+			line += " (required)"
+		}
+		if v.Description != "" {
+			line += " -- " + v.Description
+		}
+		lines = append(lines, line)
+	}
+
+	return lines
+}
+
+/* Set the defaults of the variables declared by the recipe file which aren't
+ * given, and check the required ones are. The declarations are read from the
+ * file rendered with the given variables */
+func (r *Recipe) declareVariables(file string, templateVars map[string]string) error {
+	data, err := execute(file, templateVars)
+	if err != nil {
+		return err
+	}
+
+	var declared struct {
+		Variables RecipeVariables
+	}
+	if err := yaml.Unmarshal(data.Bytes(), &declared); err != nil {
+		// Reported by render, unless the variables are the issue
+		var variables struct {
+			Variables yaml.MapSlice
+		}
+		if yaml.Unmarshal(data.Bytes(), &variables) != nil {
+			return nil
+		}
+		return err
+	}
+
+	var missing []string
+	for _, v := range declared.Variables {
+		if _, found := templateVars[v.Name]; found {
+			continue
+		}
+		if v.Default != nil {
+			templateVars[v.Name] = *v.Default
+		} else if v.Required {
+			missing = append(missing, v.Name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("Missing required template variables: %s, set them with '-t name:value'",
+			strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+// Execute the template of the recipe file
+func execute(file string, templateVars map[string]string) (*bytes.Buffer, error) {
 	t := template.New(path.Base(file))
 	funcs := template.FuncMap{
 		"sector": sector,
@@ -227,18 +845,30 @@ func (r *Recipe) Parse(file string, printRecipe bool, dump bool, templateVars ..
 	t.Funcs(funcs)
 
 	if _, err := t.ParseFiles(file); err != nil {
-		return err
+		return nil, err
 	}
 
-	if len(templateVars) == 0 {
-		templateVars = append(templateVars, make(map[string]string))
+	data := new(bytes.Buffer)
+	if err := t.Execute(data, templateVars); err != nil {
+		return nil, err
 	}
 
-	data := new(bytes.Buffer)
-	if err := t.Execute(data, templateVars[0]); err != nil {
+	return data, nil
+}
+
+// Execute the template of the recipe file and unmarshal the result
+func (r *Recipe) render(file string, printRecipe bool, dump bool, templateVars map[string]string) error {
+	data, err := execute(file, templateVars)
+	if err != nil {
 		return err
 	}
 
+	// What text/template outputs for missing keys
+	if bytes.Contains(data.Bytes(), []byte("<no value>")) {
+		log.Printf("Warning: %s uses undefined template variables", file)
+		r.undefined = append(r.undefined, file)
+	}
+
 	if printRecipe || dump {
 		log.Printf("Recipe '%s':", file)
 	}
@@ -251,16 +881,69 @@ func (r *Recipe) Parse(file string, printRecipe bool, dump bool, templateVars ..
 		return err
 	}
 
-	if dump {
-		DumpActions(reflect.ValueOf(*r).Interface(), 0)
+	return r.applyDefaults(data.Bytes())
+}
+
+/* Load again the actions with defaults from the recipe, with the properties
+ * of the actions on top of the defaults of their type */
+func (r *Recipe) applyDefaults(data []byte) error {
+	if len(r.Defaults) == 0 {
+		return nil
 	}
 
-	if len(r.Architecture) == 0 {
-		return fmt.Errorf("Recipe file must have 'architecture' property")
+	for name, defaults := range r.Defaults {
+		for _, d := range defaults {
+			if d.Key == "action" {
+				return fmt.Errorf("Defaults of '%s' can't set the action", name)
+			}
+		}
+		probe, err := yaml.Marshal(yaml.MapSlice{{Key: "action", Value: name}})
+		if err != nil {
+			return err
+		}
+		if err := yaml.Unmarshal(probe, &YamlAction{}); err != nil {
+			return fmt.Errorf("Invalid defaults: %v", err)
+		}
 	}
 
-	if len(r.Actions) == 0 {
-		return fmt.Errorf("Recipe file must have at least one action")
+	var raw struct {
+		Actions []yaml.MapSlice
+	}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	for i, properties := range raw.Actions {
+		var name interface{}
+		for _, p := range properties {
+			if p.Key == "action" {
+				name = p.Value
+			}
+		}
+		defaults, found := r.Defaults[fmt.Sprint(name)]
+		if !found {
+			continue
+		}
+
+		var merged yaml.MapSlice
+		for _, d := range defaults {
+			overridden := false
+			for _, p := range properties {
+				overridden = overridden || p.Key == d.Key
+			}
+			if !overridden {
+				merged = append(merged, d)
+			}
+		}
+		merged = append(merged, properties...)
+
+		action, err := yaml.Marshal(merged)
+		if err != nil {
+			return err
+		}
+		if err := yaml.Unmarshal(action, &r.Actions[i]); err != nil {
+			return err
+		}
 	}
 
 	return nil
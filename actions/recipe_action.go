@@ -16,6 +16,8 @@ Yaml syntax:
    recipe: path to recipe
    variables:
      key: value
+   pass-variables:
+     - name
 
 Mandatory properties:
 
@@ -25,6 +27,28 @@ Optional properties:
 
 - variables -- overrides or adds new template variables.
 
+- pass-variables -- list of template variables of the parent recipe to pass
+down to the included recipe. It is an error if the parent recipe doesn't
+define one of them. Values given in 'variables' take precedence.
+
+Template variables only apply to the included recipe, changes are never
+visible to the parent recipe. This allows including the same recipe several
+times with different variables, for example:
+
+ - action: recipe
+   recipe: image.yaml
+   pass-variables:
+     - suite
+   variables:
+     flavour: minimal
+
+ - action: recipe
+   recipe: image.yaml
+   pass-variables:
+     - suite
+   variables:
+     flavour: full
+
 */
 package actions
 
@@ -41,8 +65,10 @@ type RecipeAction struct {
 	debos.BaseAction `yaml:",inline"`
 	Recipe           string
 	Variables        map[string]string
-	Actions          Recipe `yaml:"-"`
+	PassVariables    []string `yaml:"pass-variables"`
+	Actions          Recipe   `yaml:"-"`
 	templateVars     map[string]string
+	parentVars       map[string]string
 	context          debos.DebosContext
 }
 
@@ -67,6 +93,15 @@ func (recipe *RecipeAction) Verify(context *debos.DebosContext) error {
 	recipe.templateVars = make(map[string]string)
 	recipe.templateVars["architecture"] = context.Architecture
 
+	// Add the variables passed through from the parent recipe
+	for _, k := range recipe.PassVariables {
+		v, ok := recipe.parentVars[k]
+		if !ok {
+			return fmt.Errorf("Variable '%s' is not defined in the parent recipe", k)
+		}
+		recipe.templateVars[k] = v
+	}
+
 	// Add Variables to template vars
 	for k, v := range recipe.Variables {
 		recipe.templateVars[k] = v
@@ -113,11 +148,21 @@ func (recipe *RecipeAction) PreNoMachine(context *debos.DebosContext) error {
 	return nil
 }
 
+func (recipe *RecipeAction) DryRun(context *debos.DebosContext) error {
+	for _, a := range recipe.Actions.Actions {
+		if err := a.DryRun(&recipe.context); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func (recipe *RecipeAction) Run(context *debos.DebosContext) error {
 	recipe.LogStart()
 
 	for _, a := range recipe.Actions.Actions {
-		if err := a.Run(&recipe.context); err != nil {
+		if err := debos.RunAction(&recipe.context, a.Action); err != nil {
 			return err
 		}
 	}
@@ -6,8 +6,10 @@ import (
 	"github.com/stretchr/testify/assert"
 	"io/ioutil"
 	"os"
+	"path"
 	"testing"
 	"strings"
+	"time"
 )
 
 type testRecipe struct {
@@ -62,6 +64,62 @@ actions:
   - action: run
   - action: unpack
   - action: recipe
+  - action: root-hash
+  - action: journal-forward
+  - action: swap
+  - action: machine-info
+  - action: flash-script
+  - action: content-digest
+  - action: apt-update-timer
+  - action: include
+  - action: collect
+  - action: usr-merge
+  - action: cgroup
+  - action: dpkg-triggers
+  - action: check-symlinks
+  - action: factory-etc
+  - action: apt-repository
+  - action: fail2ban
+  - action: firewall
+  - action: accept-licenses
+  - action: apt-kernel-cleanup
+  - action: repositories
+  - action: check-boot-size
+  - action: smartd
+  - action: ca-certificates
+  - action: defragment
+  - action: check-efi
+  - action: gpg-ephemeral-key
+  - action: needrestart
+  - action: compress
+  - action: man-db
+  - action: wifi-regdom
+  - action: extension-release
+  - action: checksum
+  - action: harden-permissions
+  - action: sign
+  - action: package-manifest
+  - action: sbom
+  - action: squashfs
+  - action: parallel
+  - action: pacstrap
+  - action: pacman
+  - action: template-file
+  - action: foreach
+  - action: debug-shell
+  - action: multiarch
+  - action: update-initramfs
+  - action: bootloader
+  - action: grub
+  - action: debconf
+  - action: systemd
+  - action: slim
+  - action: verify-image
+  - action: shrink
+  - action: selinux-relabel
+  - action: oci
+  - action: test-boot
+  - action: write-file
 `,
 			"", // Do not expect failure
 		},
@@ -137,6 +195,339 @@ actions:
 	}
 }
 
+// Check the declared template variables
+func TestParse_variables(t *testing.T) {
+	recipe := `
+variables:
+  action:
+    description: Action to run
+    default: download
+  suite:
+    required: true
+  hostname:
+    description: Host name of the image
+    required: true
+  extra:
+architecture: arm64
+actions:
+  - action: {{ .action }}
+`
+	runTest(t, testRecipe{recipe,
+		"Missing required template variables: suite, hostname, set them with '-t name:value'"})
+
+	templateVars := map[string]string{"suite": "bookworm", "hostname": "debian"}
+	r := runTest(t, testRecipe{recipe, ""}, templateVars)
+	assert.Equal(t, "download", r.Actions[0].String())
+	assert.Equal(t, "download", templateVars["action"])
+	assert.Empty(t, r.UndefinedVariables())
+	assert.Equal(t, []string{
+		`action: "download" -- Action to run`,
+		`suite: "bookworm" (required)`,
+		`hostname: "debian" (required) -- Host name of the image`,
+		`extra: unset`,
+	}, r.DescribeVariables())
+
+	templateVars = map[string]string{"suite": "bookworm", "hostname": "debian", "action": "pack"}
+	r = runTest(t, testRecipe{recipe, ""}, templateVars)
+	assert.Equal(t, "pack", r.Actions[0].String())
+
+	runTest(t, testRecipe{`
+variables:
+  suite:
+    required: true
+    default: bookworm
+architecture: arm64
+actions:
+  - action: pack
+`, "Variable 'suite' can't be both required and have a default"})
+}
+
+// Check host environment variables forwarded by the recipe
+func TestParse_passEnv(t *testing.T) {
+	var test = testRecipe{
+		`
+architecture: arm64
+pass-env:
+  - HTTP_PROXY
+  - DEB_BUILD_OPTIONS
+actions:
+  - action: run
+    command: make
+    env:
+      DEB_BUILD_OPTIONS: nocheck
+`,
+		"", // Do not expect failure
+	}
+
+	r := runTest(t, test)
+	assert.Equal(t, []string{"HTTP_PROXY", "DEB_BUILD_OPTIONS"}, r.PassEnv)
+	run := r.Actions[0].Action.(*actions.RunAction)
+	assert.Equal(t, map[string]string{"DEB_BUILD_OPTIONS": "nocheck"}, run.Env)
+
+	test = testRecipe{
+		`
+architecture: arm64
+pass-env:
+  - HTTP PROXY
+actions:
+  - action: run
+    command: make
+`,
+		"Invalid environment variable name 'HTTP PROXY'",
+	}
+	runTest(t, test)
+}
+
+// Check the environment of the commands run in the target filesystem
+func TestParse_chrootEnv(t *testing.T) {
+	var test = testRecipe{
+		`
+architecture: arm64
+path-prepend:
+  - /opt/toolchain/bin
+  - /usr/lib/wrappers
+env:
+  CROSS_COMPILE: aarch64-linux-gnu-
+actions:
+  - action: run
+    chroot: true
+    command: make
+`,
+		"", // Do not expect failure
+	}
+
+	r := runTest(t, test)
+	assert.Equal(t, []string{"/opt/toolchain/bin", "/usr/lib/wrappers"}, r.PathPrepend)
+	assert.Equal(t, map[string]string{"CROSS_COMPILE": "aarch64-linux-gnu-"}, r.Env)
+
+	for recipe, err := range map[string]string{
+		"path-prepend: [ opt/bin ]":   "Invalid path-prepend directory 'opt/bin', expected an absolute path without ':'",
+		"path-prepend: [ /opt:/bin ]": "Invalid path-prepend directory '/opt:/bin', expected an absolute path without ':'",
+		"env: { CROSS COMPILE: gcc }": "Invalid environment variable name 'CROSS COMPILE'",
+		"env: { PATH: /opt/bin }":     "'env' can't set PATH, use 'path-prepend' instead",
+	} {
+		runTest(t, testRecipe{"architecture: arm64\n" + recipe + "\nactions:\n  - action: run\n    command: make\n", err})
+	}
+}
+
+// Check apt proxy and cache settings
+func TestParse_aptCache(t *testing.T) {
+	var test = testRecipe{
+		`
+architecture: arm64
+apt-proxy: http://localhost:3142
+apt-cache: cache/apt
+actions:
+  - action: apt
+    packages: [ hello ]
+`,
+		"", // Do not expect failure
+	}
+
+	r := runTest(t, test)
+	assert.Equal(t, "http://localhost:3142", r.AptProxy)
+	assert.Equal(t, "cache/apt", r.AptCache)
+	assert.False(t, r.AptCacheClean)
+
+	test = testRecipe{
+		`
+architecture: arm64
+apt-proxy: localhost:3142
+actions:
+  - action: apt
+    packages: [ hello ]
+`,
+		"Invalid apt proxy 'localhost:3142', expected an http or https URL",
+	}
+	runTest(t, test)
+
+	for snapshot, timestamp := range map[string]string{
+		"2024-01-31":                "20240131T000000Z",
+		"20240131T120000Z":          "20240131T120000Z",
+		"2024-01-31T13:00:00+01:00": "20240131T120000Z",
+	} {
+		r = runTest(t, testRecipe{`
+architecture: arm64
+apt-snapshot: ` + snapshot + `
+actions:
+  - action: apt
+    packages: [ hello ]
+`, ""})
+		assert.Equal(t, timestamp, r.AptSnapshot)
+	}
+
+	runTest(t, testRecipe{`
+architecture: arm64
+apt-snapshot: last week
+actions:
+  - action: apt
+    packages: [ hello ]
+`, "Invalid apt snapshot 'last week', expected a date like '2024-01-31' or a timestamp like '20240131T120000Z'"})
+}
+
+// Check the resources of the build VM
+func TestParse_machine(t *testing.T) {
+	var test = testRecipe{
+		`
+architecture: arm64
+memory: 8GB
+cpus: 8
+actions:
+  - action: run
+    command: make
+`,
+		"", // Do not expect failure
+	}
+
+	r := runTest(t, test)
+	memory, cpus, err := actions.MachineResources(r.Memory, r.Cpus)
+	assert.Empty(t, err)
+	assert.Equal(t, 8192, memory)
+	assert.Equal(t, 8, cpus)
+
+	// Defaults
+	memory, cpus, err = actions.MachineResources("", 0)
+	assert.Empty(t, err)
+	assert.Equal(t, 2048, memory)
+	assert.Equal(t, 2, cpus)
+
+	test = testRecipe{
+		`
+architecture: arm64
+memory: 128MB
+actions:
+  - action: run
+    command: make
+`,
+		"Memory of the build VM must be at least 256MiB, got '128MB'",
+	}
+	runTest(t, test)
+
+	test = testRecipe{
+		`
+architecture: arm64
+memory: lots
+actions:
+  - action: run
+    command: make
+`,
+		"Couldn't parse memory size: invalid size: 'lots'",
+	}
+	runTest(t, test)
+
+	test = testRecipe{
+		`
+architecture: arm64
+cpus: -1
+actions:
+  - action: run
+    command: make
+`,
+		"Invalid number of CPUs -1",
+	}
+	runTest(t, test)
+}
+
+// Check the timeout property of actions
+func TestParse_timeout(t *testing.T) {
+	var test = testRecipe{
+		`
+architecture: arm64
+actions:
+  - action: run
+    command: make
+    timeout: 1h30m
+`,
+		"", // Do not expect failure
+	}
+
+	r := runTest(t, test)
+	run := r.Actions[0].Action.(*actions.RunAction)
+	assert.Equal(t, 90*time.Minute, run.Timeout)
+
+	test = testRecipe{
+		`
+architecture: arm64
+actions:
+  - action: run
+    command: make
+    timeout: -5m
+`,
+		"Invalid timeout '-5m0s' for action 'run'",
+	}
+	runTest(t, test)
+}
+
+func TestParse_defaults(t *testing.T) {
+	var test = testRecipe{
+		`
+architecture: arm64
+defaults:
+  apt:
+    unauthenticated: true
+    recommends: true
+  overlay:
+    origin: files
+actions:
+  - action: apt
+    packages: [ vim ]
+  - action: apt
+    recommends: false
+    packages: [ git ]
+  - action: overlay
+    source: etc
+  - action: run
+    command: make
+`,
+		"", // Do not expect failure
+	}
+
+	r := runTest(t, test)
+	apt := r.Actions[0].Action.(*actions.AptAction)
+	assert.True(t, apt.Unauthenticated)
+	assert.True(t, apt.Recommends)
+	// The defaults of the constructor are kept
+	assert.True(t, apt.Clean)
+	assert.Equal(t, []string{"vim"}, apt.Packages)
+
+	apt = r.Actions[1].Action.(*actions.AptAction)
+	assert.True(t, apt.Unauthenticated)
+	assert.False(t, apt.Recommends)
+	assert.Equal(t, []string{"git"}, apt.Packages)
+
+	overlay := r.Actions[2].Action.(*actions.OverlayAction)
+	assert.Equal(t, "files", overlay.Origin)
+	assert.Equal(t, "etc", overlay.Source)
+
+	test = testRecipe{
+		`
+architecture: arm64
+defaults:
+  unknown:
+    origin: files
+actions:
+  - action: run
+    command: make
+`,
+		"Invalid defaults: Unknown action: unknown",
+	}
+	runTest(t, test)
+
+	test = testRecipe{
+		`
+architecture: arm64
+defaults:
+  apt:
+    action: run
+actions:
+  - action: run
+    command: make
+`,
+		"Defaults of 'apt' can't set the action",
+	}
+	runTest(t, test)
+}
+
 // Test of 'sector' function embedded to recipe package
 func TestParse_sector(t *testing.T) {
 	var testSector = testRecipe{
@@ -286,6 +677,81 @@ actions:
 	}
 }
 
+func TestSubRecipePassVariables(t *testing.T) {
+	var recipeVariables = subRecipe {
+		"variables.yaml",
+		`
+architecture: {{ .arch }}
+
+actions:
+  - action: run
+    command: {{ .command }}
+`,
+	}
+
+	templateVars := map[string]string{
+		"arch": "amd64",
+		"command": "parent.sh",
+	}
+
+	var tests = []testSubRecipe {
+		{
+		// Test passing variables from the parent OK
+		`
+architecture: amd64
+
+actions:
+  - action: recipe
+    recipe: variables.yaml
+    pass-variables:
+      - arch
+      - command
+`,
+		recipeVariables,
+		"", // Do not expect failure
+		},
+		{
+		// Test variables take precedence over passed variables
+		`
+architecture: amd64
+
+actions:
+  - action: recipe
+    recipe: variables.yaml
+    pass-variables:
+      - arch
+      - command
+    variables:
+      arch: armhf
+`,
+		recipeVariables,
+		"Expect architecture 'amd64' but got 'armhf'",
+		},
+		{
+		// Fail with variable not defined in the parent
+		`
+architecture: amd64
+
+actions:
+  - action: recipe
+    recipe: variables.yaml
+    pass-variables:
+      - arch
+      - suite
+`,
+		recipeVariables,
+		"Variable 'suite' is not defined in the parent recipe",
+		},
+	}
+
+	for _, test := range tests {
+		runTestWithSubRecipes(t, test, templateVars)
+	}
+
+	// Variables of the included recipe don't leak into the parent
+	assert.Equal(t, map[string]string{"arch": "amd64", "command": "parent.sh"}, templateVars)
+}
+
 func runTestWithSubRecipes(t *testing.T, test testSubRecipe, templateVars ...map[string]string) actions.Recipe {
 	context := debos.DebosContext { &debos.CommonContext{}, "", "" }
 	dir, err := ioutil.TempDir("", "go-debos")
@@ -341,3 +807,86 @@ func runTestWithSubRecipes(t *testing.T, test testSubRecipe, templateVars ...map
 
 	return r
 }
+
+func TestDryRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	writeRecipe(t, path.Join(dir, "main.yaml"), `
+architecture: amd64
+
+actions:
+  - action: download
+    url: https://example.com/firmware.tar.gz
+    name: firmware
+  - action: overlay
+    origin: firmware
+    source: .
+  - action: overlay
+    source: overlays/etc
+  - action: recipe
+    recipe: sub/sub.yaml
+`)
+	writeRecipe(t, path.Join(dir, "sub/sub.yaml"), `
+architecture: amd64
+
+actions:
+  - action: overlay
+    source: files
+  - action: raw
+    origin: recipe
+    source: u-boot.bin
+    offset: 8192
+  - action: run
+    script: scripts/setup.sh
+`)
+	for _, d := range []string{"overlays/etc", "sub/files"} {
+		assert.Empty(t, os.MkdirAll(path.Join(dir, d), 0755))
+	}
+	writeRecipe(t, path.Join(dir, "u-boot.bin"), "u-boot")
+	writeRecipe(t, path.Join(dir, "sub/scripts/setup.sh"), "#!/bin/sh\n")
+
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+	context.RecipeDir = dir
+	context.Scratchdir = dir
+	context.Architecture = "amd64"
+	context.Origins = map[string]string{
+		"artifacts":  dir,
+		"filesystem": path.Join(dir, "root"),
+		"recipe":     dir,
+	}
+
+	r := actions.Recipe{}
+	assert.Empty(t, r.Parse(path.Join(dir, "main.yaml"), false, false))
+	for _, a := range r.Actions {
+		assert.Empty(t, a.Verify(&context))
+	}
+	for _, a := range r.Actions {
+		assert.Empty(t, a.DryRun(&context))
+	}
+	assert.Empty(t, r.UndefinedVariables())
+
+	// Missing files are reported
+	assert.Empty(t, os.Remove(path.Join(dir, "u-boot.bin")))
+	assert.EqualError(t, r.Actions[3].DryRun(&context), "'u-boot.bin' not found in origin 'recipe'")
+	assert.Empty(t, os.Remove(path.Join(dir, "sub/scripts/setup.sh")))
+	sub := r.Actions[3].Action.(*actions.RecipeAction)
+	assert.Contains(t, sub.Actions.Actions[2].DryRun(&context).Error(), "Script not found")
+
+	// Origins must be defined by a previous action
+	overlay := actions.OverlayAction{Origin: "kernel"}
+	assert.EqualError(t, overlay.DryRun(&context), "Origin not found 'kernel'")
+
+	// Undefined template variables
+	writeRecipe(t, path.Join(dir, "main.yaml"), `
+architecture: amd64
+
+actions:
+  - action: run
+    command: make {{ .target }}
+`)
+	r = actions.Recipe{}
+	assert.Empty(t, r.Parse(path.Join(dir, "main.yaml"), false, false))
+	assert.Equal(t, []string{path.Join(dir, "main.yaml")}, r.UndefinedVariables())
+}
@@ -0,0 +1,287 @@
+/*
+Repositories Action
+
+Add apt repositories to the target rootfs, each in its own deb822 style
+'/etc/apt/sources.list.d/<name>.sources' file, along with the key used to
+verify it, then update the package lists with 'apt-get update'. The keys are
+installed to '/etc/apt/keyrings' and only used for their repository.
+
+The 'apt-proxy' and 'apt-snapshot' recipe properties apply to this action.
+
+Yaml syntax:
+ - action: repositories
+   repositories:
+     - name: vendor
+       uri: https://apt.example.com/debian
+       suites:
+         - bookworm
+       components:
+         - main
+       key-url: https://apt.example.com/key.asc
+     - name: local
+       uri: file:///srv/repo
+       suites:
+         - ./
+       trusted: true
+
+Mandatory properties:
+
+- repositories -- list of repositories to add.
+
+Each repository has the following properties:
+
+- name -- name of the repository, used to name its '.sources' file and its
+key. Mandatory.
+
+- uri -- URI of the repository. Mandatory.
+
+- suites -- list of suites of the repository, such as 'bookworm' or
+'bookworm-updates'. A suite ending with '/' is the path of a flat repository,
+which has no components. Mandatory.
+
+- components -- list of components of the suites, mandatory unless the
+repository is flat.
+
+- types -- list of types of the repository, 'deb' and/or 'deb-src'. By default
+is 'deb'.
+
+- key-url -- URL of the key verifying the repository, downloaded at build
+time.
+
+- key-file -- path of the key verifying the repository, relative to the
+recipe directory.
+
+- signed-by -- absolute path of a keyring already in the target rootfs, for
+example one installed by a package, verifying the repository.
+
+- trusted -- boolean allowing the repository to be used without any
+verification. A key is mandatory unless the repository is trusted.
+
+Keys can be either binary or ASCII armored OpenPGP keys.
+*/
+package actions
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/go-debos/debos"
+)
+
+const aptKeyrings = "/etc/apt/keyrings"
+
+var repositoryName = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+type Repository struct {
+	Name       string
+	URI        string
+	Suites     []string
+	Components []string
+	Types      []string
+	KeyURL     string `yaml:"key-url"`
+	KeyFile    string `yaml:"key-file"`
+	SignedBy   string `yaml:"signed-by"`
+	Trusted    bool
+}
+
+type RepositoriesAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Repositories     []Repository
+}
+
+func (r *Repository) verify() error {
+	if r.URI == "" {
+		return errors.New("'uri' property can't be empty")
+	}
+	if u, err := url.Parse(r.URI); err != nil || u.Scheme == "" {
+		return fmt.Errorf("Invalid uri '%s'", r.URI)
+	}
+
+	if len(r.Suites) == 0 {
+		return errors.New("'suites' property can't be empty")
+	}
+	flat := false
+	for _, s := range r.Suites {
+		flat = flat || strings.HasSuffix(s, "/")
+	}
+	if flat && len(r.Components) > 0 {
+		return errors.New("A flat repository can't have components")
+	}
+	if !flat && len(r.Components) == 0 {
+		return errors.New("'components' property can't be empty")
+	}
+
+	if len(r.Types) == 0 {
+		r.Types = []string{"deb"}
+	}
+	for _, t := range r.Types {
+		if t != "deb" && t != "deb-src" {
+			return fmt.Errorf("Unsupported type '%s', expected deb or deb-src", t)
+		}
+	}
+
+	keys := 0
+	for _, k := range []string{r.KeyURL, r.KeyFile, r.SignedBy} {
+		if k != "" {
+			keys++
+		}
+	}
+	if keys > 1 {
+		return errors.New("Only one of 'key-url', 'key-file' and 'signed-by' can be used")
+	}
+	if keys == 0 && !r.Trusted {
+		return errors.New("A key is needed unless the repository is trusted")
+	}
+
+	if r.KeyURL != "" {
+		u, err := url.Parse(r.KeyURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("Unsupported key-url '%s'", r.KeyURL)
+		}
+	}
+	if r.SignedBy != "" && !path.IsAbs(r.SignedBy) {
+		return fmt.Errorf("signed-by '%s' must be absolute", r.SignedBy)
+	}
+
+	return nil
+}
+
+func (a *RepositoriesAction) Verify(context *debos.DebosContext) error {
+	if len(a.Repositories) == 0 {
+		return errors.New("'repositories' property can't be empty")
+	}
+
+	names := map[string]bool{}
+	for idx := range a.Repositories {
+		r := &a.Repositories[idx]
+		if !repositoryName.MatchString(r.Name) {
+			return fmt.Errorf("Invalid repository name '%s'", r.Name)
+		}
+		if names[r.Name] {
+			return fmt.Errorf("Repository %s already exists", r.Name)
+		}
+		names[r.Name] = true
+
+		if err := r.verify(); err != nil {
+			return fmt.Errorf("Repository %s: %v", r.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func (a *RepositoriesAction) DryRun(context *debos.DebosContext) error {
+	for _, r := range a.Repositories {
+		if r.KeyFile == "" {
+			continue
+		}
+		if _, err := os.Stat(debos.CleanPathAt(r.KeyFile, context.RecipeDir)); err != nil {
+			return fmt.Errorf("Repository %s: key not found: %v", r.Name, err)
+		}
+	}
+
+	return nil
+}
+
+/* Install the key of the repository, returns its path in the rootfs or an
+ * empty string if the repository has none */
+func (r *Repository) installKey(context *debos.DebosContext) (string, error) {
+	if r.SignedBy != "" || (r.KeyURL == "" && r.KeyFile == "") {
+		return r.SignedBy, nil
+	}
+
+	keyrings := path.Join(context.Rootdir, aptKeyrings)
+	if err := os.MkdirAll(keyrings, 0755); err != nil {
+		return "", err
+	}
+
+	source := debos.CleanPathAt(r.KeyFile, context.RecipeDir)
+	if r.KeyURL != "" {
+		source = path.Join(keyrings, r.Name+".download")
+		defer os.Remove(source)
+		if err := debos.DownloadHttpUrl(context.Ctx, r.KeyURL, source); err != nil {
+			return "", err
+		}
+	}
+
+	key, err := ioutil.ReadFile(source)
+	if err != nil {
+		return "", err
+	}
+
+	// Apt relies on the extension to know the format of the key
+	name := r.Name + ".gpg"
+	if bytes.HasPrefix(bytes.TrimSpace(key), []byte("-----BEGIN PGP PUBLIC KEY BLOCK-----")) {
+		name = r.Name + ".asc"
+	}
+	if err := ioutil.WriteFile(path.Join(keyrings, name), key, 0644); err != nil {
+		return "", err
+	}
+
+	return path.Join(aptKeyrings, name), nil
+}
+
+func (r *Repository) sources(key string) string {
+	lines := []string{
+		"# Generated by debos",
+		"Types: " + strings.Join(r.Types, " "),
+		"URIs: " + r.URI,
+		"Suites: " + strings.Join(r.Suites, " "),
+	}
+	if len(r.Components) > 0 {
+		lines = append(lines, "Components: "+strings.Join(r.Components, " "))
+	}
+	if key != "" {
+		lines = append(lines, "Signed-By: "+key)
+	}
+	if r.Trusted {
+		lines = append(lines, "Trusted: yes")
+	}
+
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func (a *RepositoriesAction) configure(context *debos.DebosContext) error {
+	dir := path.Join(context.Rootdir, "etc/apt/sources.list.d")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	for _, r := range a.Repositories {
+		key, err := r.installKey(context)
+		if err != nil {
+			return fmt.Errorf("Couldn't install the key of repository %s: %v", r.Name, err)
+		}
+
+		sources := path.Join(dir, r.Name+".sources")
+		if err := ioutil.WriteFile(sources, []byte(r.sources(key)), 0644); err != nil {
+			return fmt.Errorf("Couldn't write %s.sources: %v", r.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func (a *RepositoriesAction) Run(context *debos.DebosContext) error {
+	a.LogStart()
+
+	if err := a.configure(context); err != nil {
+		return err
+	}
+
+	removeConfig, err := setupAptConfig(context)
+	if err != nil {
+		return err
+	}
+	defer removeConfig()
+
+	c := debos.NewChrootCommandForContext(*context)
+	return c.Run("apt", "apt-get", "update")
+}
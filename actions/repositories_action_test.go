@@ -0,0 +1,185 @@
+package actions
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/go-debos/debos"
+	"github.com/stretchr/testify/assert"
+)
+
+const testArmoredKey = `-----BEGIN PGP PUBLIC KEY BLOCK-----
+
+mDMEZQAAABYJKwYBBAHaRw8BAQdA
+-----END PGP PUBLIC KEY BLOCK-----
+`
+
+func TestRepositories(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	rootdir := path.Join(dir, "rootfs")
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+	context.Rootdir = rootdir
+	context.RecipeDir = dir
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testArmoredKey))
+	}))
+	defer server.Close()
+
+	binaryKey := []byte{0x99, 0x01, 0x0d, 0x04}
+	assert.Empty(t, ioutil.WriteFile(path.Join(dir, "vendor.gpg"), binaryKey, 0644))
+
+	a := RepositoriesAction{Repositories: []Repository{
+		{Name: "vendor", URI: "https://apt.example.com/debian", Suites: []string{"bookworm"},
+			Components: []string{"main", "non-free"}, KeyFile: "vendor.gpg"},
+		{Name: "remote", URI: "https://apt.example.org", Suites: []string{"stable", "testing"},
+			Components: []string{"main"}, Types: []string{"deb", "deb-src"}, KeyURL: server.URL + "/key.asc"},
+		{Name: "archive", URI: "http://deb.debian.org/debian", Suites: []string{"bookworm-backports"},
+			Components: []string{"main"}, SignedBy: "/usr/share/keyrings/debian-archive-keyring.gpg"},
+		{Name: "local", URI: "file:///srv/repo", Suites: []string{"./"}, Trusted: true},
+	}}
+	assert.Empty(t, a.Verify(&context))
+	assert.Empty(t, a.DryRun(&context))
+	assert.Empty(t, a.configure(&context))
+
+	for name, expected := range map[string]string{
+		"vendor": `# Generated by debos
+Types: deb
+URIs: https://apt.example.com/debian
+Suites: bookworm
+Components: main non-free
+Signed-By: /etc/apt/keyrings/vendor.gpg
+`,
+		"remote": `# Generated by debos
+Types: deb deb-src
+URIs: https://apt.example.org
+Suites: stable testing
+Components: main
+Signed-By: /etc/apt/keyrings/remote.asc
+`,
+		"archive": `# Generated by debos
+Types: deb
+URIs: http://deb.debian.org/debian
+Suites: bookworm-backports
+Components: main
+Signed-By: /usr/share/keyrings/debian-archive-keyring.gpg
+`,
+		"local": `# Generated by debos
+Types: deb
+URIs: file:///srv/repo
+Suites: ./
+Trusted: yes
+`,
+	} {
+		sources, err := ioutil.ReadFile(path.Join(rootdir, "etc/apt/sources.list.d", name+".sources"))
+		assert.Empty(t, err)
+		assert.Equal(t, expected, string(sources))
+	}
+
+	key, err := ioutil.ReadFile(path.Join(rootdir, "etc/apt/keyrings/vendor.gpg"))
+	assert.Empty(t, err)
+	assert.Equal(t, binaryKey, key)
+	key, err = ioutil.ReadFile(path.Join(rootdir, "etc/apt/keyrings/remote.asc"))
+	assert.Empty(t, err)
+	assert.Equal(t, testArmoredKey, string(key))
+
+	// Only the keys are left in the keyrings directory
+	keys, err := ioutil.ReadDir(path.Join(rootdir, "etc/apt/keyrings"))
+	assert.Empty(t, err)
+	assert.Len(t, keys, 2)
+
+	a.Repositories[0].KeyFile = "missing.gpg"
+	assert.Error(t, a.DryRun(&context))
+
+	valid := Repository{Name: "r", URI: "http://example.com", Suites: []string{"stable"},
+		Components: []string{"main"}, KeyFile: "r.gpg"}
+	for msg, change := range map[string]func(r *Repository){
+		"Invalid repository name 'a b'":                                  func(r *Repository) { r.Name = "a b" },
+		"Repository r: 'uri' property can't be empty":                    func(r *Repository) { r.URI = "" },
+		"Repository r: Invalid uri 'example.com'":                        func(r *Repository) { r.URI = "example.com" },
+		"Repository r: 'suites' property can't be empty":                 func(r *Repository) { r.Suites = nil },
+		"Repository r: 'components' property can't be empty":             func(r *Repository) { r.Components = nil },
+		"Repository r: A flat repository can't have components":          func(r *Repository) { r.Suites = []string{"dists/"} },
+		"Repository r: Unsupported type 'rpm', expected deb or deb-src":  func(r *Repository) { r.Types = []string{"rpm"} },
+		"Repository r: A key is needed unless the repository is trusted": func(r *Repository) { r.KeyFile = "" },
+		"Repository r: Only one of 'key-url', 'key-file' and 'signed-by' can be used": func(r *Repository) {
+			r.SignedBy = "/usr/share/keyrings/r.gpg"
+		},
+		"Repository r: Unsupported key-url 'ftp://example.com/key'": func(r *Repository) {
+			r.KeyFile = ""
+			r.KeyURL = "ftp://example.com/key"
+		},
+		"Repository r: signed-by 'r.gpg' must be absolute": func(r *Repository) {
+			r.KeyFile = ""
+			r.SignedBy = "r.gpg"
+		},
+	} {
+		r := valid
+		change(&r)
+		a = RepositoriesAction{Repositories: []Repository{r}}
+		assert.EqualError(t, a.Verify(&context), msg)
+	}
+
+	a = RepositoriesAction{Repositories: []Repository{valid, valid}}
+	assert.EqualError(t, a.Verify(&context), "Repository r already exists")
+
+	a = RepositoriesAction{}
+	assert.EqualError(t, a.Verify(&context), "'repositories' property can't be empty")
+}
+
+func TestAptSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	list := `deb http://deb.debian.org/debian bookworm main
+deb [signed-by=/usr/share/keyrings/debian.gpg] https://security.debian.org/debian-security bookworm-security main
+deb https://repo.example.com/debian bookworm main
+`
+	sources := `Types: deb
+URIs: http://ftp.fr.debian.org/debian/
+Suites: bookworm-updates
+Components: main
+`
+	assert.Empty(t, os.MkdirAll(path.Join(dir, "etc/apt/sources.list.d"), 0755))
+	assert.Empty(t, os.MkdirAll(path.Join(dir, "etc/apt/apt.conf.d"), 0755))
+	assert.Empty(t, ioutil.WriteFile(path.Join(dir, "etc/apt/sources.list"), []byte(list), 0644))
+	assert.Empty(t, ioutil.WriteFile(path.Join(dir, "etc/apt/sources.list.d/updates.sources"), []byte(sources), 0644))
+
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+	context.Rootdir = dir
+	context.AptSnapshot = "20240131T120000Z"
+
+	restore, err := setupAptSnapshot(&context)
+	assert.Empty(t, err)
+
+	content, err := ioutil.ReadFile(path.Join(dir, "etc/apt/sources.list"))
+	assert.Empty(t, err)
+	assert.Equal(t, `deb http://snapshot.debian.org/archive/debian/20240131T120000Z/ bookworm main
+deb [signed-by=/usr/share/keyrings/debian.gpg] http://snapshot.debian.org/archive/debian-security/20240131T120000Z/ bookworm-security main
+deb https://repo.example.com/debian bookworm main
+`, string(content))
+	content, err = ioutil.ReadFile(path.Join(dir, "etc/apt/sources.list.d/updates.sources"))
+	assert.Empty(t, err)
+	assert.Contains(t, string(content), "URIs: http://snapshot.debian.org/archive/debian/20240131T120000Z/\n")
+	content, err = ioutil.ReadFile(path.Join(dir, aptSnapshotConf))
+	assert.Empty(t, err)
+	assert.Equal(t, "Acquire::Check-Valid-Until \"false\";\n", string(content))
+
+	restore()
+	content, err = ioutil.ReadFile(path.Join(dir, "etc/apt/sources.list"))
+	assert.Empty(t, err)
+	assert.Equal(t, list, string(content))
+	content, err = ioutil.ReadFile(path.Join(dir, "etc/apt/sources.list.d/updates.sources"))
+	assert.Empty(t, err)
+	assert.Equal(t, sources, string(content))
+	_, err = os.Stat(path.Join(dir, aptSnapshotConf))
+	assert.True(t, os.IsNotExist(err))
+}
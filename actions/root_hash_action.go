@@ -0,0 +1,214 @@
+/*
+RootHash Action
+
+Compute a hash over a filesystem image produced by an earlier action and record
+it so the content can be checked for integrity at boot or application time.
+This is meant for read-only images which are not protected by dm-verity, for
+example a squashfs root filesystem with a recorded hash.
+
+The hash is written both into the target filesystem at a known path and into
+a manifest file in the artifact directory.
+
+Yaml syntax:
+ - action: root-hash
+   origin: name
+   file: filename
+   filesystem: squashfs
+   algorithm: sha256
+   path: /usr/share/debos/root-hash
+   manifest: root-hash.manifest
+
+Mandatory properties:
+
+- file -- name of the filesystem image to hash, relative to 'origin'.
+
+Optional properties:
+
+- origin -- reference to named file or directory. The default value is the
+'artifacts' directory.
+
+- filesystem -- expected filesystem type of the image. Supported types are
+'squashfs', 'erofs' and 'ext4'. If set, the action fails if the image does not
+contain a filesystem of that type. In any case the image must contain one of
+the supported filesystems.
+
+- algorithm -- hash algorithm to use, either 'sha256' or 'sha512'. The default
+value is 'sha256'.
+
+- path -- absolute path in the target rootfs where the hash is written. The
+default value is '/usr/share/debos/root-hash'.
+
+- manifest -- name of the manifest file in the artifact directory. A line in
+the '<hash>  <file>' format is appended for every hashed image. The default
+value is 'root-hash.manifest'.
+*/
+package actions
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+
+	"github.com/go-debos/debos"
+)
+
+type RootHashAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Origin           string
+	File             string
+	Filesystem       string
+	Algorithm        string
+	Path             string
+	Manifest         string
+}
+
+func NewRootHashAction() *RootHashAction {
+	rh := RootHashAction{}
+	rh.Algorithm = "sha256"
+	rh.Path = "/usr/share/debos/root-hash"
+	rh.Manifest = "root-hash.manifest"
+
+	return &rh
+}
+
+// Returns a new hash of the algorithm, either 'sha256' or 'sha512'
+func newHashAlgorithm(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case "sha256":
+		return sha256.New(), nil
+	case "sha512":
+		return sha512.New(), nil
+	}
+	return nil, fmt.Errorf("Unsupported hash algorithm '%s'", algorithm)
+}
+
+func (rh *RootHashAction) newHash() (hash.Hash, error) {
+	return newHashAlgorithm(rh.Algorithm)
+}
+
+// detectFilesystem guesses the filesystem of an image by its superblock magic
+func detectFilesystem(f *os.File) (string, error) {
+	magic := make([]byte, 4)
+
+	if _, err := f.ReadAt(magic, 0); err != nil {
+		return "", err
+	}
+	if bytes.Equal(magic, []byte("hsqs")) {
+		return "squashfs", nil
+	}
+
+	if _, err := f.ReadAt(magic, 1024); err == nil {
+		if binary.LittleEndian.Uint32(magic) == 0xe0f5e1e2 {
+			return "erofs", nil
+		}
+	}
+
+	if _, err := f.ReadAt(magic[:2], 1080); err == nil {
+		if binary.LittleEndian.Uint16(magic[:2]) == 0xef53 {
+			return "ext4", nil
+		}
+	}
+
+	return "", fmt.Errorf("No supported filesystem found in '%s'", f.Name())
+}
+
+func (rh *RootHashAction) Verify(context *debos.DebosContext) error {
+	if len(rh.File) == 0 {
+		return fmt.Errorf("'file' property can't be empty")
+	}
+
+	switch rh.Filesystem {
+	case "", "squashfs", "erofs", "ext4":
+	default:
+		return fmt.Errorf("Unsupported filesystem '%s'", rh.Filesystem)
+	}
+
+	if _, err := rh.newHash(); err != nil {
+		return err
+	}
+
+	if !path.IsAbs(rh.Path) {
+		return fmt.Errorf("'path' must be an absolute path")
+	}
+
+	return nil
+}
+
+func (rh *RootHashAction) DryRun(context *debos.DebosContext) error {
+	if len(rh.Origin) > 0 {
+		return debos.CheckOrigin(context, rh.Origin, rh.File)
+	}
+	return nil
+}
+
+func (rh *RootHashAction) Run(context *debos.DebosContext) error {
+	rh.LogStart()
+	origin := context.Artifactdir
+
+	if len(rh.Origin) > 0 {
+		var found bool
+		if origin, found = context.Origins[rh.Origin]; !found {
+			return fmt.Errorf("Origin not found '%s'", rh.Origin)
+		}
+	}
+
+	image, err := debos.RestrictedPath(origin, rh.File)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(image)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fs, err := detectFilesystem(f)
+	if err != nil {
+		return err
+	}
+	if rh.Filesystem != "" && rh.Filesystem != fs {
+		return fmt.Errorf("Expected %s filesystem in '%s' but found %s", rh.Filesystem, rh.File, fs)
+	}
+
+	h, _ := rh.newHash()
+	if _, err = io.Copy(h, f); err != nil {
+		return err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	log.Printf("%s root hash of %s: %s", rh.Algorithm, rh.File, sum)
+
+	target, err := debos.RestrictedPath(context.Rootdir, rh.Path)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(path.Dir(target), 0755); err != nil {
+		return err
+	}
+	content := fmt.Sprintf("%s:%s\n", rh.Algorithm, sum)
+	if err = ioutil.WriteFile(target, []byte(content), 0644); err != nil {
+		return fmt.Errorf("Couldn't write root hash: %v", err)
+	}
+
+	manifest, err := os.OpenFile(path.Join(context.Artifactdir, rh.Manifest),
+		os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("Couldn't open manifest: %v", err)
+	}
+	defer manifest.Close()
+
+	if _, err = fmt.Fprintf(manifest, "%s  %s\n", sum, path.Base(image)); err != nil {
+		return fmt.Errorf("Couldn't write manifest: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,62 @@
+package actions_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/go-debos/debos"
+	"github.com/go-debos/debos/actions"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRootHash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+	context.Rootdir = path.Join(dir, "root")
+	context.Artifactdir = path.Join(dir, "artifacts")
+	os.Mkdir(context.Rootdir, 0755)
+	os.Mkdir(context.Artifactdir, 0755)
+
+	// Fake squashfs image: only the superblock magic matters
+	image := append([]byte("hsqs"), make([]byte, 4096)...)
+	err = ioutil.WriteFile(path.Join(context.Artifactdir, "root.img"), image, 0644)
+	assert.Empty(t, err)
+
+	rh := actions.NewRootHashAction()
+	rh.File = "root.img"
+	rh.Filesystem = "squashfs"
+	assert.Empty(t, rh.Verify(&context))
+	assert.Empty(t, rh.Run(&context))
+
+	// Recorded hashes must match a recomputation
+	sum := sha256.Sum256(image)
+	expected := hex.EncodeToString(sum[:])
+
+	recorded, err := ioutil.ReadFile(path.Join(context.Rootdir, rh.Path))
+	assert.Empty(t, err)
+	assert.Equal(t, fmt.Sprintf("sha256:%s\n", expected), string(recorded))
+
+	manifest, err := ioutil.ReadFile(path.Join(context.Artifactdir, rh.Manifest))
+	assert.Empty(t, err)
+	assert.Equal(t, fmt.Sprintf("%s  root.img\n", expected), string(manifest))
+
+	// Filesystem mismatch is detected
+	rh.Filesystem = "erofs"
+	assert.EqualError(t, rh.Run(&context), "Expected erofs filesystem in 'root.img' but found squashfs")
+
+	// Unknown filesystems are refused
+	err = ioutil.WriteFile(path.Join(context.Artifactdir, "garbage.img"), make([]byte, 4096), 0644)
+	assert.Empty(t, err)
+	rh.File = "garbage.img"
+	rh.Filesystem = ""
+	assert.EqualError(t, rh.Run(&context),
+		fmt.Sprintf("No supported filesystem found in '%s'", path.Join(context.Artifactdir, "garbage.img")))
+}
@@ -12,6 +12,17 @@ Yaml syntax:
    script: script name
    command: command line
    label: string
+   capture: NAME
+   capture-stderr: NAME
+   expected-exit-code: int
+   expect-output: regexp
+   refute-output: regexp
+   env:
+     KEY: value
+   mounts:
+     - source: host directory
+       target: /path/in/chroot
+       readonly: bool
 
 Properties 'command' and 'script' are mutually exclusive.
 
@@ -36,20 +47,75 @@ a label is derived from the command or script.
 - postprocess -- if set script or command is executed after all other commands and
 has access to the image file.
 
+- capture -- name of a template variable set to the standard output of the
+command or script, without its leading and trailing white space. Like the
+variables set by the other actions, it is passed to the commands and scripts
+of the following 'run' actions and to the 'template-file' actions. The
+variable is only set once the command or script exits as expected.
+
+- capture-stderr -- same as 'capture' for the standard error.
+
+- expected-exit-code -- exit code the command or script is expected to exit
+with, so a failure can be checked, for example in the recipes testing an image.
+The action fails if the command or script exits with another code, including 0.
+By default 0.
+
+- expect-output -- regular expression, in the syntax of Go, which has to match
+the standard output and error of the command or script. Use '(?m)' for '^' and
+'$' to match at the start and end of each line.
+
+- refute-output -- regular expression which must not match the standard output
+and error of the command or script.
+
+- env -- environment variables to set for the command or script. They take
+precedence over the variables forwarded from the host with the 'pass-env'
+recipe property or set with '--environ-var', and over the 'env' recipe
+property.
+
+- mounts -- list of host files or directories bind mounted in the target
+filesystem while the command or script runs; only supported with 'chroot'.
+Each entry has a 'source', the host path which must exist, relative to the
+recipe directory; a 'target', the absolute path in the target filesystem
+which can't contain '..'; and an optional 'readonly' boolean. The mounts only
+exist in the namespace of the chroot, so they go away with it even if the
+command fails.
+
+If the 'ccache' recipe property is set, the command or script is set up to use
+that directory as ccache.
+
+The 'path-prepend' and 'env' recipe properties apply to the commands and
+scripts run in the target filesystem, like to the ones of the other actions.
+
+Template variables set by previous actions at build time (for example the commit
+checksum stored by 'ostree-commit') are passed to the command or script as
+environment variables.
+
 
 Properties 'chroot' and 'postprocess' are mutually exclusive.
 */
 package actions
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
 	"github.com/go-debos/fakemachine"
+	"io"
+	"os"
+	"os/exec"
 	"path"
+	"regexp"
 	"strings"
+	"sync"
 
 	"github.com/go-debos/debos"
 )
 
+const (
+	ccacheChrootDir = "/var/cache/ccache"
+	ccacheBinDir    = "/usr/lib/ccache"
+)
+
 type RunAction struct {
 	debos.BaseAction `yaml:",inline"`
 	Chroot           bool
@@ -57,18 +123,96 @@ type RunAction struct {
 	Script           string
 	Command          string
 	Label            string
+	Env              map[string]string
+	Mounts           []RunMount
+	Capture          string
+	CaptureStderr    string `yaml:"capture-stderr"`
+	ExpectedExitCode int    `yaml:"expected-exit-code"`
+	ExpectOutput     string `yaml:"expect-output"`
+	RefuteOutput     string `yaml:"refute-output"`
+	expectOutput     *regexp.Regexp
+	refuteOutput     *regexp.Regexp
+}
+
+// Output of both streams of the command, which are written concurrently
+type runOutput struct {
+	sync.Mutex
+	bytes.Buffer
+}
+
+func (o *runOutput) Write(p []byte) (int, error) {
+	o.Lock()
+	defer o.Unlock()
+	return o.Buffer.Write(p)
+}
+
+type RunMount struct {
+	Source   string
+	Target   string
+	Readonly bool
 }
 
 func (run *RunAction) Verify(context *debos.DebosContext) error {
 	if run.PostProcess && run.Chroot {
 		return errors.New("Cannot run postprocessing in the chroot")
 	}
+	for k := range run.Env {
+		if !variableName.MatchString(k) {
+			return fmt.Errorf("Invalid environment variable name '%s'", k)
+		}
+	}
+
+	for _, v := range []string{run.Capture, run.CaptureStderr} {
+		if v != "" && !variableName.MatchString(v) {
+			return fmt.Errorf("Invalid variable name '%s'", v)
+		}
+	}
+	if run.Capture != "" && run.Capture == run.CaptureStderr {
+		return fmt.Errorf("Properties 'capture' and 'capture-stderr' can't name the same variable")
+	}
+
+	if run.ExpectedExitCode < 0 || run.ExpectedExitCode > 255 {
+		return fmt.Errorf("Invalid expected-exit-code %d, expected a value from 0 to 255", run.ExpectedExitCode)
+	}
+	var err error
+	if run.ExpectOutput != "" {
+		if run.expectOutput, err = regexp.Compile(run.ExpectOutput); err != nil {
+			return fmt.Errorf("Invalid expect-output: %v", err)
+		}
+	}
+	if run.RefuteOutput != "" {
+		if run.refuteOutput, err = regexp.Compile(run.RefuteOutput); err != nil {
+			return fmt.Errorf("Invalid refute-output: %v", err)
+		}
+	}
+
+	if len(run.Mounts) > 0 && !run.Chroot {
+		return errors.New("Mounts are only supported when running in the chroot")
+	}
+	for _, m := range run.Mounts {
+		source := debos.CleanPathAt(m.Source, context.RecipeDir)
+		if _, err := os.Stat(source); err != nil {
+			return fmt.Errorf("Invalid mount source: %v", err)
+		}
+		if !path.IsAbs(m.Target) || path.Clean(m.Target) == "/" {
+			return fmt.Errorf("Mount target '%s' must be an absolute path below '/'", m.Target)
+		}
+		for _, c := range strings.Split(m.Target, "/") {
+			if c == ".." {
+				return fmt.Errorf("Mount target '%s' can't contain '..'", m.Target)
+			}
+		}
+	}
 	return nil
 }
 
 func (run *RunAction) PreMachine(context *debos.DebosContext, m *fakemachine.Machine,
 	args *[]string) error {
 
+	for _, mount := range run.Mounts {
+		m.AddVolume(debos.CleanPathAt(mount.Source, context.RecipeDir))
+	}
+
 	if run.Script == "" {
 		return nil
 	}
@@ -92,8 +236,16 @@ func (run *RunAction) doRun(context debos.DebosContext) error {
 
 	if run.Chroot {
 		cmd = debos.NewChrootCommandForContext(context)
+		for _, m := range run.Mounts {
+			source := debos.CleanPathAt(m.Source, context.RecipeDir)
+			if m.Readonly {
+				cmd.AddBindMountReadOnly(source, path.Clean(m.Target))
+			} else {
+				cmd.AddBindMount(source, path.Clean(m.Target))
+			}
+		}
 	} else {
-		cmd = debos.Command{}
+		cmd = debos.NewCommandForContext(context)
 	}
 
 	if run.Script != "" {
@@ -118,6 +270,24 @@ func (run *RunAction) doRun(context debos.DebosContext) error {
 	// Command/script with options passed as single string
 	cmdline = append([]string{"sh", "-c"}, cmdline...)
 
+	if context.CcacheDir != "" {
+		if run.Chroot {
+			cmd.AddBindMount(context.CcacheDir, ccacheChrootDir)
+			cmd.AddEnvKey("CCACHE_DIR", ccacheChrootDir)
+			cmd.AddEnvKey("PATH", ccacheBinDir+":"+debos.ChrootPathForContext(context))
+		} else {
+			cmd.AddEnvKey("CCACHE_DIR", context.CcacheDir)
+			cmd.AddEnvKey("PATH", ccacheBinDir+":"+os.Getenv("PATH"))
+		}
+	}
+
+	for k, v := range context.Variables {
+		cmd.AddEnvKey(k, v)
+	}
+	for k, v := range run.Env {
+		cmd.AddEnvKey(k, v)
+	}
+
 	if !run.PostProcess {
 		if !run.Chroot {
 			cmd.AddEnvKey("ROOTDIR", context.Rootdir)
@@ -132,7 +302,89 @@ func (run *RunAction) doRun(context debos.DebosContext) error {
 		}
 	}
 
-	return cmd.Run(label, cmdline...)
+	var stdout, stderr bytes.Buffer
+	var output runOutput
+	if run.Capture != "" {
+		cmd.Stdout = &stdout
+	}
+	if run.CaptureStderr != "" {
+		cmd.Stderr = &stderr
+	}
+	if run.expectOutput != nil || run.refuteOutput != nil {
+		cmd.Stdout = addWriter(cmd.Stdout, &output)
+		cmd.Stderr = addWriter(cmd.Stderr, &output)
+	}
+
+	if err := run.checkExitCode(cmd.Run(label, cmdline...)); err != nil {
+		return err
+	}
+	if err := run.checkOutput(output.String()); err != nil {
+		return err
+	}
+
+	if context.Variables == nil {
+		context.Variables = map[string]string{}
+	}
+	if run.Capture != "" {
+		context.Variables[run.Capture] = strings.TrimSpace(stdout.String())
+	}
+	if run.CaptureStderr != "" {
+		context.Variables[run.CaptureStderr] = strings.TrimSpace(stderr.String())
+	}
+
+	return nil
+}
+
+func addWriter(w, extra io.Writer) io.Writer {
+	if w == nil {
+		return extra
+	}
+	return io.MultiWriter(w, extra)
+}
+
+// Compare the result of the command with the expected exit code
+func (run *RunAction) checkExitCode(err error) error {
+	code := 0
+	if err != nil {
+		exit, ok := err.(*exec.ExitError)
+		if !ok || exit.ExitCode() < 0 || run.ExpectedExitCode == 0 {
+			return err
+		}
+		code = exit.ExitCode()
+	}
+
+	if code != run.ExpectedExitCode {
+		if code == 0 {
+			return fmt.Errorf("Command succeeded, expected exit code %d", run.ExpectedExitCode)
+		}
+		return fmt.Errorf("Command exited with code %d, expected %d", code, run.ExpectedExitCode)
+	}
+	return nil
+}
+
+func (run *RunAction) checkOutput(output string) error {
+	if run.expectOutput != nil && !run.expectOutput.MatchString(output) {
+		return fmt.Errorf("Output doesn't match '%s'", run.ExpectOutput)
+	}
+	if run.refuteOutput != nil {
+		if m := run.refuteOutput.FindStringIndex(output); m != nil {
+			return fmt.Errorf("Output matches '%s': '%s'", run.RefuteOutput, output[m[0]:m[1]])
+		}
+	}
+	return nil
+}
+
+func (run *RunAction) DryRun(context *debos.DebosContext) error {
+	if run.Script == "" {
+		return nil
+	}
+
+	script := debos.CleanPathAt(strings.Split(run.Script, " ")[0], context.RecipeDir)
+	if _, err := os.Stat(script); err != nil {
+		return fmt.Errorf("Script not found: %v", err)
+	}
+
+	return nil
 }
 
 func (run *RunAction) Run(context *debos.DebosContext) error {
@@ -0,0 +1,135 @@
+package actions_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/go-debos/debos"
+	"github.com/go-debos/debos/actions"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunMounts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+	assert.Empty(t, os.Mkdir(dir+"/toolchain", 0755))
+
+	context := debos.DebosContext{&debos.CommonContext{}, dir, ""}
+
+	run := actions.RunAction{
+		Chroot:  true,
+		Command: "make",
+		Mounts: []actions.RunMount{
+			{Source: "toolchain", Target: "/opt/toolchain", Readonly: true},
+			{Source: dir, Target: "/src"},
+		},
+	}
+	assert.Empty(t, run.Verify(&context))
+
+	run.Mounts = []actions.RunMount{{Source: "missing", Target: "/opt/missing"}}
+	assert.EqualError(t, run.Verify(&context),
+		"Invalid mount source: stat "+dir+"/missing: no such file or directory")
+
+	run.Mounts = []actions.RunMount{{Source: "toolchain", Target: "/opt/../../toolchain"}}
+	assert.EqualError(t, run.Verify(&context), "Mount target '/opt/../../toolchain' can't contain '..'")
+
+	run.Mounts = []actions.RunMount{{Source: "toolchain", Target: "opt/toolchain"}}
+	assert.EqualError(t, run.Verify(&context), "Mount target 'opt/toolchain' must be an absolute path below '/'")
+
+	run.Mounts = []actions.RunMount{{Source: "toolchain", Target: "/"}}
+	assert.EqualError(t, run.Verify(&context), "Mount target '/' must be an absolute path below '/'")
+
+	run.Chroot = false
+	run.Mounts = []actions.RunMount{{Source: "toolchain", Target: "/opt/toolchain"}}
+	assert.EqualError(t, run.Verify(&context), "Mounts are only supported when running in the chroot")
+}
+
+func TestRunCcache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	context := debos.DebosContext{&debos.CommonContext{}, dir, ""}
+	context.Artifactdir = dir
+
+	run := actions.RunAction{
+		Command: `echo "$CCACHE_DIR $PATH" > "$ARTIFACTDIR/env"`,
+	}
+
+	// No-op without a ccache directory
+	assert.Empty(t, run.Run(&context))
+	env, err := ioutil.ReadFile(dir + "/env")
+	assert.Empty(t, err)
+	assert.Equal(t, " "+os.Getenv("PATH")+"\n", string(env))
+
+	context.CcacheDir = dir + "/ccache"
+	assert.Empty(t, run.Run(&context))
+	env, err = ioutil.ReadFile(dir + "/env")
+	assert.Empty(t, err)
+	assert.Equal(t, dir+"/ccache /usr/lib/ccache:"+os.Getenv("PATH")+"\n", string(env))
+}
+
+func TestRunCapture(t *testing.T) {
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+
+	run := actions.RunAction{
+		Command:       "echo ' 1.2.3 '; echo warning >&2",
+		Capture:       "version",
+		CaptureStderr: "warnings",
+	}
+	assert.Empty(t, run.Verify(&context))
+	assert.Empty(t, run.Run(&context))
+	assert.Equal(t, map[string]string{"version": "1.2.3", "warnings": "warning"}, context.Variables)
+
+	// Passed on to the following commands
+	run = actions.RunAction{Command: `echo "v$version"`, Capture: "tag"}
+	assert.Empty(t, run.Run(&context))
+	assert.Equal(t, "v1.2.3", context.Variables["tag"])
+
+	// Only set on success
+	run = actions.RunAction{Command: "echo 2.0; false", Capture: "failed"}
+	assert.Error(t, run.Run(&context))
+	_, found := context.Variables["failed"]
+	assert.False(t, found)
+
+	run.Capture = "not-a-name"
+	assert.EqualError(t, run.Verify(&context), "Invalid variable name 'not-a-name'")
+	run.Capture = "version"
+	run.CaptureStderr = "version"
+	assert.Error(t, run.Verify(&context))
+}
+
+func TestRunExpectations(t *testing.T) {
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+
+	run := actions.RunAction{
+		Command:          "echo 'E: Unable to locate package nope' >&2; exit 100",
+		Capture:          "stdout",
+		ExpectedExitCode: 100,
+		ExpectOutput:     "(?m)^E: Unable to locate",
+		RefuteOutput:     "Segmentation fault",
+	}
+	assert.Empty(t, run.Verify(&context))
+	assert.Empty(t, run.Run(&context))
+	// Set as the command exited as expected
+	assert.Equal(t, "", context.Variables["stdout"])
+
+	run.ExpectedExitCode = 1
+	assert.EqualError(t, run.Run(&context), "Command exited with code 100, expected 1")
+	run = actions.RunAction{Command: "true", ExpectedExitCode: 2}
+	assert.EqualError(t, run.Run(&context), "Command succeeded, expected exit code 2")
+
+	run = actions.RunAction{Command: "echo ready", ExpectOutput: "^done"}
+	assert.Empty(t, run.Verify(&context))
+	assert.EqualError(t, run.Run(&context), "Output doesn't match '^done'")
+	run = actions.RunAction{Command: "echo 'kernel: oops' >&2", RefuteOutput: "oops|panic"}
+	assert.Empty(t, run.Verify(&context))
+	assert.EqualError(t, run.Run(&context), "Output matches 'oops|panic': 'oops'")
+
+	run = actions.RunAction{Command: "true", ExpectedExitCode: 256}
+	assert.EqualError(t, run.Verify(&context), "Invalid expected-exit-code 256, expected a value from 0 to 255")
+	run = actions.RunAction{Command: "true", ExpectOutput: "("}
+	assert.Error(t, run.Verify(&context))
+}
@@ -0,0 +1,302 @@
+/*
+Sbom Action
+
+Write a software bill of materials (SBOM) of the target rootfs to the artifact
+directory, listing the installed packages of the dpkg database with their
+name, version, architecture and source package, in either the CycloneDX or
+the SPDX JSON format.
+
+Each package is identified by its package URL, for example
+'pkg:deb/debian/libc6@2.36-9?arch=amd64&upstream=glibc', the namespace being
+the 'ID' of '/etc/os-release' in the target rootfs. The time of the document
+is the one of 'SOURCE_DATE_EPOCH' when set in the environment, for example with
+'--environ-var', so identical builds can produce identical documents.
+
+Yaml syntax:
+ - action: sbom
+   format: cyclonedx
+   file: sbom.cdx.json
+   name: my-image
+
+Optional properties:
+
+- format -- format of the document, either 'cyclonedx' (CycloneDX 1.5) or
+'spdx' (SPDX 2.3). By default is 'cyclonedx'.
+
+- file -- name of the document, relative to the artifact directory. By
+default is 'sbom.cdx.json' for CycloneDX and 'sbom.spdx.json' for SPDX.
+
+- name -- name of the image described by the document. By default is
+'debos-image'.
+*/
+package actions
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-debos/debos"
+)
+
+type SbomAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Format           string
+	File             string
+	Name             string
+}
+
+func NewSbomAction() *SbomAction {
+	return &SbomAction{Format: "cyclonedx", Name: "debos-image"}
+}
+
+func (s *SbomAction) Verify(context *debos.DebosContext) error {
+	switch s.Format {
+	case "cyclonedx":
+		if s.File == "" {
+			s.File = "sbom.cdx.json"
+		}
+	case "spdx":
+		if s.File == "" {
+			s.File = "sbom.spdx.json"
+		}
+	default:
+		return fmt.Errorf("Unsupported SBOM format '%s', expected cyclonedx or spdx", s.Format)
+	}
+	if s.Name == "" {
+		return fmt.Errorf("'name' property can't be empty")
+	}
+	return nil
+}
+
+// Percent-encode everything but the unreserved characters, as package URLs require
+func purlEscape(s string) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9',
+			c == '.', c == '-', c == '_', c == '~':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func (p *dpkgPackage) purl(vendor string) string {
+	purl := fmt.Sprintf("pkg:deb/%s/%s@%s?arch=%s", vendor, purlEscape(p.name), purlEscape(p.version), p.arch)
+	if p.source != p.name {
+		purl += "&upstream=" + purlEscape(p.source)
+	}
+	return purl
+}
+
+// ID of the distribution of the rootfs, 'debian' if unknown
+func osReleaseID(rootdir string) string {
+	for _, f := range []string{"etc/os-release", "usr/lib/os-release"} {
+		file, err := os.Open(path.Join(rootdir, f))
+		if err != nil {
+			continue
+		}
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			if id := strings.TrimPrefix(scanner.Text(), "ID="); id != scanner.Text() {
+				return strings.Trim(id, `"'`)
+			}
+		}
+	}
+	return "debian"
+}
+
+/* Returns the SOURCE_DATE_EPOCH of the environment variables of the build or
+ * of the host, and whether it is set */
+func sourceDateEpoch(context *debos.DebosContext) (int64, bool, error) {
+	epoch, found := context.EnvironVars["SOURCE_DATE_EPOCH"]
+	if !found {
+		epoch = os.Getenv("SOURCE_DATE_EPOCH")
+	}
+	if epoch == "" {
+		return 0, false, nil
+	}
+	seconds, err := strconv.ParseInt(epoch, 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("Invalid SOURCE_DATE_EPOCH '%s'", epoch)
+	}
+	return seconds, true, nil
+}
+
+// Time of the document, SOURCE_DATE_EPOCH for reproducible builds
+func sbomTimestamp(context *debos.DebosContext) (string, error) {
+	now := time.Now()
+	seconds, found, err := sourceDateEpoch(context)
+	if err != nil {
+		return "", err
+	}
+	if found {
+		now = time.Unix(seconds, 0)
+	}
+	return now.UTC().Format(time.RFC3339), nil
+}
+
+func (s *SbomAction) cyclonedx(packages []dpkgPackage, vendor, timestamp string) interface{} {
+	type property struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	}
+	type component struct {
+		Type       string     `json:"type"`
+		BomRef     string     `json:"bom-ref,omitempty"`
+		Name       string     `json:"name"`
+		Version    string     `json:"version,omitempty"`
+		Purl       string     `json:"purl,omitempty"`
+		Properties []property `json:"properties,omitempty"`
+	}
+
+	components := []component{}
+	for _, p := range packages {
+		purl := p.purl(vendor)
+		components = append(components, component{
+			Type:    "library",
+			BomRef:  purl,
+			Name:    p.name,
+			Version: p.version,
+			Purl:    purl,
+			Properties: []property{
+				{"debian:architecture", p.arch},
+				{"debian:source", p.source},
+				{"debian:source-version", p.sourceVersion},
+			},
+		})
+	}
+
+	return map[string]interface{}{
+		"bomFormat":   "CycloneDX",
+		"specVersion": "1.5",
+		"version":     1,
+		"metadata": map[string]interface{}{
+			"timestamp": timestamp,
+			"tools": map[string]interface{}{
+				"components": []component{{Type: "application", Name: "debos"}},
+			},
+			"component": component{Type: "operating-system", Name: s.Name},
+		},
+		"components": components,
+	}
+}
+
+var spdxIDInvalid = regexp.MustCompile(`[^a-zA-Z0-9.-]`)
+
+func (s *SbomAction) spdx(packages []dpkgPackage, vendor, timestamp string) interface{} {
+	type externalRef struct {
+		Category string `json:"referenceCategory"`
+		Type     string `json:"referenceType"`
+		Locator  string `json:"referenceLocator"`
+	}
+	type spdxPackage struct {
+		SPDXID           string        `json:"SPDXID"`
+		Name             string        `json:"name"`
+		VersionInfo      string        `json:"versionInfo"`
+		DownloadLocation string        `json:"downloadLocation"`
+		FilesAnalyzed    bool          `json:"filesAnalyzed"`
+		LicenseConcluded string        `json:"licenseConcluded"`
+		LicenseDeclared  string        `json:"licenseDeclared"`
+		CopyrightText    string        `json:"copyrightText"`
+		SourceInfo       string        `json:"sourceInfo"`
+		ExternalRefs     []externalRef `json:"externalRefs"`
+	}
+	type relationship struct {
+		Element string `json:"spdxElementId"`
+		Type    string `json:"relationshipType"`
+		Related string `json:"relatedSpdxElement"`
+	}
+
+	spdxPackages := []spdxPackage{}
+	relationships := []relationship{}
+	// The namespace must be unique per document, the same for the same packages
+	h := sha256.New()
+	for _, p := range packages {
+		id := "SPDXRef-Package-" + spdxIDInvalid.ReplaceAllString(p.name+"-"+p.arch, "-")
+		spdxPackages = append(spdxPackages, spdxPackage{
+			SPDXID:           id,
+			Name:             p.name,
+			VersionInfo:      p.version,
+			DownloadLocation: "NOASSERTION",
+			LicenseConcluded: "NOASSERTION",
+			LicenseDeclared:  "NOASSERTION",
+			CopyrightText:    "NOASSERTION",
+			SourceInfo:       fmt.Sprintf("built package from: %s %s", p.source, p.sourceVersion),
+			ExternalRefs:     []externalRef{{"PACKAGE-MANAGER", "purl", p.purl(vendor)}},
+		})
+		relationships = append(relationships, relationship{"SPDXRef-DOCUMENT", "DESCRIBES", id})
+		fmt.Fprintf(h, "%s\n", p.purl(vendor))
+	}
+
+	return map[string]interface{}{
+		"spdxVersion":       "SPDX-2.3",
+		"dataLicense":       "CC0-1.0",
+		"SPDXID":            "SPDXRef-DOCUMENT",
+		"name":              s.Name,
+		"documentNamespace": fmt.Sprintf("https://spdx.org/spdxdocs/%s-%s", purlEscape(s.Name), hex.EncodeToString(h.Sum(nil))),
+		"creationInfo": map[string]interface{}{
+			"created":  timestamp,
+			"creators": []string{"Tool: debos"},
+		},
+		"packages":      spdxPackages,
+		"relationships": relationships,
+	}
+}
+
+func (s *SbomAction) Run(context *debos.DebosContext) error {
+	s.LogStart()
+
+	all, err := readDpkgStatus(path.Join(context.Rootdir, "var/lib/dpkg/status"))
+	if err != nil {
+		return err
+	}
+	var packages []dpkgPackage
+	for _, p := range all {
+		if strings.HasSuffix(p.status, " installed") {
+			packages = append(packages, p)
+		}
+	}
+
+	timestamp, err := sbomTimestamp(context)
+	if err != nil {
+		return err
+	}
+	vendor := osReleaseID(context.Rootdir)
+
+	var document interface{}
+	if s.Format == "spdx" {
+		document = s.spdx(packages, vendor, timestamp)
+	} else {
+		document = s.cyclonedx(packages, vendor, timestamp)
+	}
+
+	content, err := json.MarshalIndent(document, "", "  ")
+	if err != nil {
+		return err
+	}
+	file := path.Join(context.Artifactdir, s.File)
+	if err := os.MkdirAll(path.Dir(file), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(file, append(content, '\n'), 0644); err != nil {
+		return fmt.Errorf("Couldn't write %s: %v", s.File, err)
+	}
+
+	log.Printf("Wrote the %s SBOM of %d packages to %s", s.Format, len(packages), s.File)
+	return nil
+}
@@ -0,0 +1,114 @@
+package actions_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/go-debos/debos"
+	"github.com/go-debos/debos/actions"
+	"github.com/stretchr/testify/assert"
+)
+
+const sbomStatus = `Package: libc6
+Status: install ok installed
+Architecture: amd64
+Source: glibc
+Version: 2.36-9+deb12u4
+
+Package: libgcc-s1
+Status: install ok installed
+Architecture: amd64
+Source: gcc-12 (12.2.0-14)
+Version: 1:12.2.0-14
+
+Package: old-tool
+Status: deinstall ok config-files
+Architecture: all
+Version: 1.0-1
+`
+
+func TestSbom(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+	context.Rootdir = path.Join(dir, "root")
+	context.Artifactdir = path.Join(dir, "artifacts")
+	context.EnvironVars = map[string]string{"SOURCE_DATE_EPOCH": "1700000000"}
+	writeRootfsFile(t, context.Rootdir, "var/lib/dpkg/status", sbomStatus)
+	writeRootfsFile(t, context.Rootdir, "etc/os-release", "NAME=\"Debian GNU/Linux\"\nID=debian\n")
+
+	s := actions.NewSbomAction()
+	assert.Empty(t, s.Verify(&context))
+	assert.Empty(t, s.Run(&context))
+
+	var cdx struct {
+		BomFormat  string
+		Metadata   struct{ Timestamp string }
+		Components []struct {
+			Name       string
+			Version    string
+			Purl       string
+			Properties []struct{ Name, Value string }
+		}
+	}
+	content, err := ioutil.ReadFile(path.Join(context.Artifactdir, "sbom.cdx.json"))
+	assert.Empty(t, err)
+	assert.Empty(t, json.Unmarshal(content, &cdx))
+	assert.Equal(t, "CycloneDX", cdx.BomFormat)
+	assert.Equal(t, "2023-11-14T22:13:20Z", cdx.Metadata.Timestamp)
+	assert.Len(t, cdx.Components, 2)
+	assert.Equal(t, "libc6", cdx.Components[0].Name)
+	assert.Equal(t, "pkg:deb/debian/libc6@2.36-9%2Bdeb12u4?arch=amd64&upstream=glibc", cdx.Components[0].Purl)
+	assert.Equal(t, "1:12.2.0-14", cdx.Components[1].Version)
+	assert.Equal(t, "pkg:deb/debian/libgcc-s1@1%3A12.2.0-14?arch=amd64&upstream=gcc-12", cdx.Components[1].Purl)
+	assert.Equal(t, "gcc-12", cdx.Components[1].Properties[1].Value)
+	assert.Equal(t, "12.2.0-14", cdx.Components[1].Properties[2].Value)
+
+	s = actions.NewSbomAction()
+	s.Format = "spdx"
+	s.Name = "test-image"
+	assert.Empty(t, s.Verify(&context))
+	assert.Empty(t, s.Run(&context))
+
+	var spdx struct {
+		SpdxVersion  string
+		Name         string
+		CreationInfo struct{ Created string }
+		Packages     []struct {
+			SPDXID       string
+			Name         string
+			VersionInfo  string
+			SourceInfo   string
+			ExternalRefs []struct{ ReferenceLocator string }
+		}
+		Relationships []struct{ RelatedSpdxElement string }
+	}
+	content, err = ioutil.ReadFile(path.Join(context.Artifactdir, "sbom.spdx.json"))
+	assert.Empty(t, err)
+	assert.Empty(t, json.Unmarshal(content, &spdx))
+	assert.Equal(t, "SPDX-2.3", spdx.SpdxVersion)
+	assert.Equal(t, "test-image", spdx.Name)
+	assert.Equal(t, "2023-11-14T22:13:20Z", spdx.CreationInfo.Created)
+	assert.Len(t, spdx.Packages, 2)
+	assert.Equal(t, "SPDXRef-Package-libgcc-s1-amd64", spdx.Packages[1].SPDXID)
+	assert.Equal(t, "built package from: gcc-12 12.2.0-14", spdx.Packages[1].SourceInfo)
+	assert.Equal(t, "pkg:deb/debian/libc6@2.36-9%2Bdeb12u4?arch=amd64&upstream=glibc",
+		spdx.Packages[0].ExternalRefs[0].ReferenceLocator)
+	assert.Len(t, spdx.Relationships, 2)
+
+	// Identical builds give identical documents
+	previous := content
+	assert.Empty(t, s.Run(&context))
+	content, err = ioutil.ReadFile(path.Join(context.Artifactdir, "sbom.spdx.json"))
+	assert.Empty(t, err)
+	assert.Equal(t, previous, content)
+
+	s = actions.NewSbomAction()
+	s.Format = "swid"
+	assert.EqualError(t, s.Verify(&context), "Unsupported SBOM format 'swid', expected cyclonedx or spdx")
+}
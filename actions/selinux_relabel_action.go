@@ -0,0 +1,146 @@
+/*
+SelinuxRelabel Action
+
+Label the files of the target rootfs with the SELinux security contexts of the
+'file_contexts' of its policy, with 'setfiles' of the build environment run
+against the rootfs, so SELinux enabled images boot with the files correctly
+labelled and without a relabel on first boot.
+
+Yaml syntax:
+ - action: selinux-relabel
+   policy: name
+   file-contexts: path
+   required: bool
+
+Optional properties:
+
+- policy -- name of the SELinux policy of the target rootfs, like 'targeted' or
+'default'. By default the 'SELINUXTYPE' of '/etc/selinux/config' of the target
+rootfs.
+
+- file-contexts -- path of the 'file_contexts' file in the target rootfs. By
+default '/etc/selinux/<policy>/contexts/files/file_contexts'.
+
+- required -- fail instead of doing nothing when 'setfiles' isn't installed in
+the build environment or the target rootfs has no policy. By default 'false'.
+
+The number of relabelled files is logged. The files added or changed by the
+following actions aren't labelled, so the action is usually one of the last
+ones of the recipe working on the rootfs.
+*/
+package actions
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	"github.com/go-debos/debos"
+)
+
+type SelinuxRelabelAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Policy           string
+	FileContexts     string `yaml:"file-contexts"`
+	Required         bool
+}
+
+// SELINUXTYPE of the content of /etc/selinux/config
+func parseSelinuxType(config string) string {
+	scanner := bufio.NewScanner(strings.NewReader(config))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "SELINUXTYPE=") {
+			return strings.Trim(strings.TrimPrefix(line, "SELINUXTYPE="), `"'`)
+		}
+	}
+	return ""
+}
+
+// Number of files setfiles reports as relabelled in its verbose output
+func countRelabelled(output string) int {
+	count := 0
+	for _, line := range strings.Split(output, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "Relabeled ") {
+			count++
+		}
+	}
+	return count
+}
+
+func (s *SelinuxRelabelAction) Verify(context *debos.DebosContext) error {
+	if strings.ContainsAny(s.Policy, "/ \t") {
+		return fmt.Errorf("Invalid SELinux policy name '%s'", s.Policy)
+	}
+	return nil
+}
+
+// Path of the file_contexts in the rootfs, or "" without policy
+func (s *SelinuxRelabelAction) fileContexts(rootdir string) (string, error) {
+	fc := s.FileContexts
+	if fc == "" {
+		policy := s.Policy
+		if policy == "" {
+			config, err := ioutil.ReadFile(path.Join(rootdir, "etc/selinux/config"))
+			if os.IsNotExist(err) {
+				return "", nil
+			}
+			if err != nil {
+				return "", err
+			}
+			if policy = parseSelinuxType(string(config)); policy == "" {
+				return "", nil
+			}
+		}
+		fc = path.Join("/etc/selinux", policy, "contexts/files/file_contexts")
+	}
+
+	p, err := debos.RestrictedPath(rootdir, fc)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(p); os.IsNotExist(err) {
+		return "", nil
+	}
+	return p, nil
+}
+
+func (s *SelinuxRelabelAction) Run(context *debos.DebosContext) error {
+	s.LogStart()
+
+	fc, err := s.fileContexts(context.Rootdir)
+	if err != nil {
+		return err
+	}
+	if fc == "" {
+		if s.Required {
+			return errors.New("No SELinux policy file_contexts found in the target rootfs")
+		}
+		log.Printf("No SELinux policy in the target rootfs, skipping relabelling")
+		return nil
+	}
+
+	setfiles, err := exec.LookPath("setfiles")
+	if err != nil {
+		if s.Required {
+			return fmt.Errorf("setfiles isn't installed: %v", err)
+		}
+		log.Printf("setfiles isn't installed, skipping relabelling")
+		return nil
+	}
+
+	out, err := exec.Command(setfiles, "-F", "-v", "-r", context.Rootdir, fc, context.Rootdir).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Failed to relabel the target rootfs: %v\n%s", err, out)
+	}
+	log.Printf("%d files relabelled with %s", countRelabelled(string(out)),
+		strings.TrimPrefix(fc, context.Rootdir))
+
+	return nil
+}
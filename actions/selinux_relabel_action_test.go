@@ -0,0 +1,59 @@
+package actions
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/go-debos/debos"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSelinuxType(t *testing.T) {
+	config := `# This file controls the state of SELinux on the system.
+SELINUX=enforcing
+SELINUXTYPE="targeted"
+`
+	assert.Equal(t, "targeted", parseSelinuxType(config))
+	assert.Equal(t, "", parseSelinuxType("SELINUX=disabled\n"))
+}
+
+func TestCountRelabelled(t *testing.T) {
+	output := `Relabeled /scratch/root/etc from unlabeled to system_u:object_r:etc_t:s0
+Relabeled /scratch/root/etc/hostname from unlabeled to system_u:object_r:etc_t:s0
+setfiles: conflicting specifications
+`
+	assert.Equal(t, 2, countRelabelled(output))
+	assert.Equal(t, 0, countRelabelled(""))
+}
+
+func TestSelinuxFileContexts(t *testing.T) {
+	rootdir, err := ioutil.TempDir("", "selinux-")
+	assert.Empty(t, err)
+	defer os.RemoveAll(rootdir)
+
+	s := SelinuxRelabelAction{}
+	fc, err := s.fileContexts(rootdir)
+	assert.Empty(t, err)
+	assert.Equal(t, "", fc)
+
+	files := path.Join(rootdir, "etc/selinux/targeted/contexts/files")
+	assert.Empty(t, os.MkdirAll(files, 0755))
+	assert.Empty(t, ioutil.WriteFile(path.Join(files, "file_contexts"), []byte{}, 0644))
+	assert.Empty(t, ioutil.WriteFile(path.Join(rootdir, "etc/selinux/config"), []byte("SELINUXTYPE=targeted\n"), 0644))
+
+	fc, err = s.fileContexts(rootdir)
+	assert.Empty(t, err)
+	assert.Equal(t, path.Join(files, "file_contexts"), fc)
+
+	s = SelinuxRelabelAction{Policy: "mls"}
+	fc, err = s.fileContexts(rootdir)
+	assert.Empty(t, err)
+	assert.Equal(t, "", fc)
+
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+	assert.Empty(t, s.Verify(&context))
+	s = SelinuxRelabelAction{Policy: "../targeted"}
+	assert.EqualError(t, s.Verify(&context), "Invalid SELinux policy name '../targeted'")
+}
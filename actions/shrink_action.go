@@ -0,0 +1,235 @@
+/*
+Shrink Action
+
+Shrink the last filesystem of a disk image of the artifact directory to the
+size of its content, then its partition, and truncate the image after it, so
+a mostly empty image doesn't waste space and bandwidth once distributed. For
+GPT partition tables the backup partition table is moved to the new end of
+the image. The image can be one of an 'image-partition' action of the recipe
+or any other one.
+
+The image is shrunk once the build is done, after the fake machine exits.
+
+Yaml syntax:
+ - action: shrink
+   image: filename
+   slack: size
+
+Mandatory properties:
+
+- image -- name of the image file, relative to the artifact directory.
+
+Optional properties:
+
+- slack -- free space to keep on top of the content of the filesystem, in
+human-readable form like '64MB'. By default none.
+
+Only 'ext2', 'ext3', 'ext4' and 'btrfs' filesystems can be shrunk. The 'ext'
+ones are shrunk in the image file with 'resize2fs', the 'btrfs' ones have to
+be mounted to be shrunk, which needs debos to run as root with
+'--disable-fakemachine'. The filesystem is never shrunk below the size of its
+content, and is checked once shrunk; the action fails if it isn't clean.
+*/
+package actions
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/docker/go-units"
+	"github.com/go-debos/debos"
+)
+
+var btrfsMinDevSize = regexp.MustCompile(`^(\d+) bytes`)
+
+type ShrinkAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Image            string
+	Slack            string
+	slack            int64
+}
+
+func (s *ShrinkAction) Verify(context *debos.DebosContext) error {
+	if s.Image == "" {
+		return errors.New("'image' property can't be empty")
+	}
+	if strings.HasPrefix(path.Clean(s.Image), "..") || path.IsAbs(s.Image) {
+		return fmt.Errorf("Image %s must be relative to the artifact directory", s.Image)
+	}
+	if s.Slack != "" {
+		slack, err := units.FromHumanSize(s.Slack)
+		if err != nil {
+			return fmt.Errorf("Failed to parse slack: %s", s.Slack)
+		}
+		s.slack = slack
+	}
+	return nil
+}
+
+// Size of the shrunk filesystem, MiB aligned, or 0 if it can't be shrunk
+func shrunkSize(minimum, slack, current int64) int64 {
+	size := minimum + slack
+	size = (size + units.MiB - 1) / units.MiB * units.MiB
+	if size >= current {
+		return 0
+	}
+	return size
+}
+
+// Shrink the ext2/ext3/ext4 filesystem at the offset of the image
+func (s *ShrinkAction) shrinkExt(context *debos.DebosContext, image string, offset int64) (int64, error) {
+	dev := fmt.Sprintf("%s?offset=%d", image, offset)
+	cmd := debos.NewCommandForContext(*context)
+
+	if err := cmd.Run("Shrink", "e2fsck", "-f", "-y", dev); err != nil {
+		return 0, err
+	}
+	blockSize, blockCount, minBlocks, err := ext4Blocks(dev)
+	if err != nil {
+		return 0, err
+	}
+
+	size := shrunkSize(minBlocks*blockSize, s.slack, blockCount*blockSize)
+	if size == 0 {
+		return 0, nil
+	}
+	if err := cmd.Run("Shrink", "resize2fs", dev, fmt.Sprintf("%dK", size/1024)); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// Shrink the btrfs filesystem of the partition of the image, once mounted
+func (s *ShrinkAction) shrinkBtrfs(context *debos.DebosContext, image string, offset, current int64) (int64, error) {
+	if os.Getuid() != 0 {
+		return 0, errors.New("Shrinking btrfs filesystems requires root to mount them, run with --disable-fakemachine")
+	}
+
+	loops := loopDevices{}
+	loop, err := loops.attach(image, "--offset", strconv.FormatInt(offset, 10),
+		"--sizelimit", strconv.FormatInt(current, 10))
+	if err != nil {
+		return 0, err
+	}
+	defer loops.detachAll()
+
+	mnt, err := ioutil.TempDir(debos.ScratchDir(context), "shrink-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(mnt)
+	if err := syscall.Mount(loop, mnt, "btrfs", 0, ""); err != nil {
+		return 0, fmt.Errorf("Failed to mount %s: %v", image, err)
+	}
+	defer syscall.Unmount(mnt, 0)
+
+	out, err := exec.Command("btrfs", "inspect-internal", "min-dev-size", mnt).Output()
+	if err != nil {
+		return 0, fmt.Errorf("Failed to estimate minimal size of %s: %v", image, err)
+	}
+	m := btrfsMinDevSize.FindStringSubmatch(strings.TrimSpace(string(out)))
+	if m == nil {
+		return 0, fmt.Errorf("Failed to determine the size of %s", image)
+	}
+	minimum, _ := strconv.ParseInt(m[1], 10, 64)
+
+	size := shrunkSize(minimum, s.slack, current)
+	if size == 0 {
+		return 0, nil
+	}
+	cmd := debos.NewCommandForContext(*context)
+	if err := cmd.Run("Shrink", "btrfs", "filesystem", "resize", strconv.FormatInt(size, 10), mnt); err != nil {
+		return 0, err
+	}
+	if err := syscall.Unmount(mnt, 0); err != nil {
+		return 0, err
+	}
+
+	return size, cmd.Run("Shrink", "btrfs", "check", "--readonly", loop)
+}
+
+func (s *ShrinkAction) PostMachine(context *debos.DebosContext) error {
+	s.LogStart()
+	image := path.Join(context.Artifactdir, s.Image)
+
+	out, err := exec.Command("sfdisk", "--json", image).Output()
+	if err != nil {
+		return fmt.Errorf("Failed to read the partition table of %s: %v", s.Image, err)
+	}
+	layout, err := parseSfdiskJSON(out)
+	if err != nil {
+		return fmt.Errorf("Failed to parse the partition table of %s: %v", s.Image, err)
+	}
+	if len(layout.partitions) == 0 {
+		return fmt.Errorf("No partition in %s", s.Image)
+	}
+	last := layout.partitions[0]
+	for _, p := range layout.partitions {
+		if p.start > last.start {
+			last = p
+		}
+	}
+	sectorSize := layout.sectorSize
+	if sectorSize == 0 {
+		sectorSize = 512
+	}
+	offset := last.start * sectorSize
+
+	out, err = exec.Command("blkid", "-p", "-O", strconv.FormatInt(offset, 10), "-o", "value", "-s", "TYPE", image).Output()
+	if err != nil {
+		return fmt.Errorf("No filesystem found in partition %d of %s", last.number, s.Image)
+	}
+	fs := strings.TrimSpace(string(out))
+
+	var size int64
+	switch fs {
+	case "ext2", "ext3", "ext4":
+		size, err = s.shrinkExt(context, image, offset)
+	case "btrfs":
+		size, err = s.shrinkBtrfs(context, image, offset, last.size*sectorSize)
+	default:
+		return fmt.Errorf("Can't shrink the %s filesystem of partition %d of %s", fs, last.number, s.Image)
+	}
+	if err != nil {
+		return err
+	}
+	if size == 0 {
+		log.Printf("Filesystem of partition %d of %s plus slack doesn't fit in less than %d bytes, keeping its size",
+			last.number, s.Image, last.size*sectorSize)
+		return nil
+	}
+
+	log.Printf("Shrinking partition %d of %s to %d bytes", last.number, s.Image, size)
+	sfdisk := exec.Command("sfdisk", "--no-reread", "--no-tell-kernel", "-N", strconv.Itoa(last.number), image)
+	sfdisk.Stdin = strings.NewReader(fmt.Sprintf(", %d\n", size/sectorSize))
+	if out, err = sfdisk.CombinedOutput(); err != nil {
+		return fmt.Errorf("Failed to resize partition %d: %v\n%s", last.number, err, out)
+	}
+
+	if err := truncateImage(image); err != nil {
+		return err
+	}
+
+	if fs != "btrfs" {
+		dev := fmt.Sprintf("%s?offset=%d", image, offset)
+		if err := debos.NewCommandForContext(*context).Run("Shrink", "e2fsck", "-f", "-n", dev); err != nil {
+			return fmt.Errorf("Filesystem of %s isn't clean once shrunk: %v", s.Image, err)
+		}
+	}
+
+	info, err := os.Stat(image)
+	if err != nil {
+		return err
+	}
+	log.Printf("%s shrunk to %s", s.Image, units.BytesSize(float64(info.Size())))
+	return nil
+}
@@ -0,0 +1,33 @@
+package actions
+
+import (
+	"testing"
+
+	"github.com/docker/go-units"
+	"github.com/go-debos/debos"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShrunkSize(t *testing.T) {
+	// Rounded up to the next MiB
+	assert.Equal(t, int64(3*units.MiB), shrunkSize(2*units.MiB+1, 0, 8*units.MiB))
+	assert.Equal(t, int64(4*units.MiB), shrunkSize(2*units.MiB, 2*units.MiB, 8*units.MiB))
+	// Never grown, nor kept at the same size
+	assert.Equal(t, int64(0), shrunkSize(7*units.MiB+1, 0, 8*units.MiB))
+	assert.Equal(t, int64(0), shrunkSize(6*units.MiB, 4*units.MiB, 8*units.MiB))
+}
+
+func TestShrinkVerify(t *testing.T) {
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+
+	s := ShrinkAction{Image: "disk.img", Slack: "64MB"}
+	assert.Empty(t, s.Verify(&context))
+	assert.Equal(t, int64(64*units.MB), s.slack)
+
+	s = ShrinkAction{}
+	assert.EqualError(t, s.Verify(&context), "'image' property can't be empty")
+	s = ShrinkAction{Image: "../disk.img"}
+	assert.EqualError(t, s.Verify(&context), "Image ../disk.img must be relative to the artifact directory")
+	s = ShrinkAction{Image: "disk.img", Slack: "lots"}
+	assert.EqualError(t, s.Verify(&context), "Failed to parse slack: lots")
+}
@@ -0,0 +1,153 @@
+/*
+Sign Action
+
+Write detached GnuPG signatures of artifacts of the build, for example of the
+images or of the 'SHA256SUMS' file written by a 'checksum' action, to
+distribute signed releases. Each signature is verified once written.
+
+Like the 'run' actions with 'postprocess' set, the artifacts are signed on the
+host once all the other actions have run, so the signing key doesn't need to
+be available to the build VM and the artifacts are complete. The key is
+looked up before the build starts, so the action fails before anything is
+written if it can't be used.
+
+Yaml syntax:
+ - action: sign
+   files:
+     - SHA256SUMS
+     - "*.img.gz"
+   gpg-sign: key id
+   gpg-homedir: path to GnuPG home directory
+   armor: true
+
+Mandatory properties:
+
+- files -- list of names of the artifacts to sign, relative to the artifact
+directory. Shell glob patterns are supported, each one must match at least a
+file. The signatures are never matched.
+
+- gpg-sign -- GPG key ID used to sign the artifacts.
+
+Optional properties:
+
+- gpg-homedir -- GnuPG home directory containing the signing key, relative to
+the recipe directory. By default the default GnuPG home directory. The key of
+a 'gpg-ephemeral-key' action can't be used, it is only available to the
+build.
+
+- armor -- write ASCII armored signatures to '<name>.asc' rather than binary
+ones to '<name>.sig'. By default is 'true'.
+*/
+package actions
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"path"
+	"strings"
+
+	"github.com/go-debos/debos"
+	"github.com/go-debos/fakemachine"
+)
+
+type SignAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Files            []string
+	GpgSign          string `yaml:"gpg-sign"`
+	GpgHomedir       string `yaml:"gpg-homedir"`
+	Armor            bool
+}
+
+func NewSignAction() *SignAction {
+	return &SignAction{Armor: true}
+}
+
+func (s *SignAction) Verify(context *debos.DebosContext) error {
+	if len(s.Files) == 0 {
+		return errors.New("'files' property can't be empty")
+	}
+	for _, f := range s.Files {
+		if _, err := path.Match(f, ""); err != nil {
+			return fmt.Errorf("Invalid pattern '%s': %v", f, err)
+		}
+	}
+
+	if s.GpgSign == "" {
+		return errors.New("'gpg-sign' property can't be empty")
+	}
+	if s.GpgHomedir != "" {
+		s.GpgHomedir = debos.CleanPathAt(s.GpgHomedir, context.RecipeDir)
+	}
+
+	return nil
+}
+
+func (s *SignAction) PreMachine(context *debos.DebosContext, m *fakemachine.Machine,
+	args *[]string) error {
+	return checkGpgKey(s.GpgHomedir, s.GpgSign)
+}
+
+func (s *SignAction) PreNoMachine(context *debos.DebosContext) error {
+	return checkGpgKey(s.GpgHomedir, s.GpgSign)
+}
+
+func (s *SignAction) extension() string {
+	if s.Armor {
+		return ".asc"
+	}
+	return ".sig"
+}
+
+func (s *SignAction) gpg(args ...string) error {
+	cmdline := []string{"--batch", "--yes"}
+	if s.GpgHomedir != "" {
+		cmdline = append(cmdline, "--homedir", s.GpgHomedir)
+	}
+	cmdline = append(cmdline, args...)
+
+	if out, err := exec.Command("gpg", cmdline...).CombinedOutput(); err != nil {
+		return fmt.Errorf("gpg failed: %v\n%s", err, out)
+	}
+
+	return nil
+}
+
+func (s *SignAction) doSign(context *debos.DebosContext) error {
+	artifacts, err := matchArtifacts(context.Artifactdir, s.Files, func(name string) bool {
+		return strings.HasSuffix(name, ".asc") || strings.HasSuffix(name, ".sig")
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, a := range artifacts {
+		file := path.Join(context.Artifactdir, a)
+		signature := file + s.extension()
+
+		args := []string{"--local-user", s.GpgSign, "--detach-sign", "--output", signature}
+		if s.Armor {
+			args = append(args, "--armor")
+		}
+		if err := s.gpg(append(args, file)...); err != nil {
+			return err
+		}
+		if err := s.gpg("--verify", signature, file); err != nil {
+			return fmt.Errorf("Couldn't verify the signature of %s: %v", a, err)
+		}
+		log.Printf("Signed %s\n", a)
+	}
+
+	return nil
+}
+
+func (s *SignAction) Run(context *debos.DebosContext) error {
+	s.LogStart()
+	/* The artifacts are signed in postprocessing, once they are complete */
+	return nil
+}
+
+func (s *SignAction) PostMachine(context *debos.DebosContext) error {
+	return s.doSign(context)
+}
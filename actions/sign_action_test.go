@@ -0,0 +1,85 @@
+package actions_test
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/go-debos/debos"
+	"github.com/go-debos/debos/actions"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSign(t *testing.T) {
+	if _, err := exec.LookPath("gpg"); err != nil {
+		t.Skip("gpg not available")
+	}
+
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	gnupg := path.Join(dir, "gnupg")
+	assert.Empty(t, os.Mkdir(gnupg, 0700))
+	defer exec.Command("gpgconf", "--homedir", gnupg, "--kill", "all").Run()
+	runTool(t, "gpg", "--batch", "--homedir", gnupg, "--passphrase", "",
+		"--quick-generate-key", "debos test <debos@example.com>", "ed25519", "sign", "never")
+
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+	context.Artifactdir = path.Join(dir, "artifacts")
+	context.RecipeDir = dir
+	assert.Empty(t, os.Mkdir(context.Artifactdir, 0755))
+	for _, f := range []string{"SHA256SUMS", "image.img.gz", "rootfs.tar.gz"} {
+		assert.Empty(t, ioutil.WriteFile(path.Join(context.Artifactdir, f), []byte(f), 0644))
+	}
+
+	s := actions.NewSignAction()
+	s.Files = []string{"SHA256SUMS", "*.gz"}
+	s.GpgSign = "debos@example.com"
+	s.GpgHomedir = "gnupg"
+	assert.Empty(t, s.Verify(&context))
+	assert.Empty(t, s.PreNoMachine(&context))
+	assert.Empty(t, s.Run(&context))
+	assert.Empty(t, s.PostMachine(&context))
+
+	for _, f := range []string{"SHA256SUMS", "image.img.gz", "rootfs.tar.gz"} {
+		signature, err := ioutil.ReadFile(path.Join(context.Artifactdir, f+".asc"))
+		assert.Empty(t, err)
+		assert.True(t, strings.HasPrefix(string(signature), "-----BEGIN PGP SIGNATURE-----"))
+		runTool(t, "gpg", "--batch", "--homedir", gnupg, "--verify",
+			path.Join(context.Artifactdir, f+".asc"), path.Join(context.Artifactdir, f))
+	}
+
+	// Binary signatures, the existing signatures aren't signed
+	s = actions.NewSignAction()
+	s.Files = []string{"*"}
+	s.GpgSign = "debos@example.com"
+	s.GpgHomedir = "gnupg"
+	s.Armor = false
+	assert.Empty(t, s.Verify(&context))
+	assert.Empty(t, s.PostMachine(&context))
+	_, err = os.Stat(path.Join(context.Artifactdir, "image.img.gz.sig"))
+	assert.Empty(t, err)
+	_, err = os.Stat(path.Join(context.Artifactdir, "image.img.gz.asc.sig"))
+	assert.True(t, os.IsNotExist(err))
+	runTool(t, "gpg", "--batch", "--homedir", gnupg, "--verify",
+		path.Join(context.Artifactdir, "SHA256SUMS.sig"), path.Join(context.Artifactdir, "SHA256SUMS"))
+
+	// An unknown key fails before the build
+	s = actions.NewSignAction()
+	s.Files = []string{"SHA256SUMS"}
+	s.GpgSign = "unknown@example.com"
+	s.GpgHomedir = "gnupg"
+	assert.Empty(t, s.Verify(&context))
+	err = s.PreNoMachine(&context)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "GPG key 'unknown@example.com' not found")
+
+	s = actions.NewSignAction()
+	assert.EqualError(t, s.Verify(&context), "'files' property can't be empty")
+	s.Files = []string{"SHA256SUMS"}
+	assert.EqualError(t, s.Verify(&context), "'gpg-sign' property can't be empty")
+}
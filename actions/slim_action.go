@@ -0,0 +1,217 @@
+/*
+Slim Action
+
+Remove the content of the target rootfs which is unneeded on minimal images,
+like the documentation, the manual pages, the translations of unused
+languages and the package lists of apt. The space reclaimed is logged.
+
+Yaml syntax:
+ - action: slim
+   remove-docs: bool
+   remove-man: bool
+   keep-locales:
+     - en
+     - en_US
+   clean-apt-lists: bool
+
+Optional properties:
+
+- remove-docs -- remove the documentation of '/usr/share/doc', except the
+'copyright' files of the packages, and of '/usr/share/info'.
+
+- remove-man -- remove the manual pages of '/usr/share/man'. See the 'man-db'
+action to also stop installing them.
+
+- keep-locales -- list of the translations of '/usr/share/locale' to keep, like
+'en' or 'de_DE', the others being removed. Each name is matched as is, so
+both 'de' and 'de_DE' have to be listed to keep both.
+
+- clean-apt-lists -- remove the package lists of '/var/lib/apt/lists', which
+are downloaded again by 'apt-get update'.
+
+At least one property has to be set. The files are only removed once: the
+packages installed or upgraded later on install theirs again.
+*/
+package actions
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/go-units"
+	"github.com/go-debos/debos"
+)
+
+type SlimAction struct {
+	debos.BaseAction `yaml:",inline"`
+	RemoveDocs       bool     `yaml:"remove-docs"`
+	RemoveMan        bool     `yaml:"remove-man"`
+	KeepLocales      []string `yaml:"keep-locales"`
+	CleanAptLists    bool     `yaml:"clean-apt-lists"`
+}
+
+func (s *SlimAction) Verify(context *debos.DebosContext) error {
+	if !s.RemoveDocs && !s.RemoveMan && len(s.KeepLocales) == 0 && !s.CleanAptLists {
+		return errors.New("At least one of 'remove-docs', 'remove-man', 'keep-locales' or 'clean-apt-lists' properties is mandatory")
+	}
+	for _, l := range s.KeepLocales {
+		if l == "" || strings.ContainsAny(l, "/ \t") {
+			return fmt.Errorf("Invalid locale name '%s'", l)
+		}
+	}
+	return nil
+}
+
+// Path of the directory of the rootfs, refusing the ones leading out of it
+// through symbolic links
+func slimDir(rootdir, dir string) (string, error) {
+	p, err := debos.RestrictedPath(rootdir, dir)
+	if err != nil {
+		return "", err
+	}
+	real, err := filepath.EvalSymlinks(p)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	root, err := filepath.EvalSymlinks(rootdir)
+	if err != nil {
+		return "", err
+	}
+	if real != root && !strings.HasPrefix(real, root+"/") {
+		return "", fmt.Errorf("%s points outside of the target rootfs", dir)
+	}
+	return real, nil
+}
+
+// Remove the entries of dir the keep function doesn't keep, returning the size
+// of the removed files
+func removeDirEntries(dir string, keep func(os.FileInfo) bool) (int64, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var freed int64
+	for _, e := range entries {
+		if keep(e) {
+			continue
+		}
+		p := path.Join(dir, e.Name())
+		size, _, err := manFilesSize(p)
+		if err != nil {
+			return freed, err
+		}
+		if err := os.RemoveAll(p); err != nil {
+			return freed, err
+		}
+		freed += size
+	}
+	return freed, nil
+}
+
+func keepNothing(os.FileInfo) bool { return false }
+
+func (s *SlimAction) removeDocs(rootdir string) (int64, error) {
+	var freed int64
+
+	doc, err := slimDir(rootdir, "/usr/share/doc")
+	if err != nil || doc == "" {
+		return 0, err
+	}
+	// The files of the top directory, then the ones of the packages
+	freed, err = removeDirEntries(doc, func(f os.FileInfo) bool { return f.IsDir() })
+	if err != nil {
+		return freed, err
+	}
+	entries, err := ioutil.ReadDir(doc)
+	if err != nil {
+		return freed, err
+	}
+	for _, e := range entries {
+		size, err := removeDirEntries(path.Join(doc, e.Name()), func(f os.FileInfo) bool {
+			return f.Name() == "copyright"
+		})
+		freed += size
+		if err != nil {
+			return freed, err
+		}
+	}
+
+	info, err := slimDir(rootdir, "/usr/share/info")
+	if err != nil || info == "" {
+		return freed, err
+	}
+	size, err := removeDirEntries(info, keepNothing)
+	return freed + size, err
+}
+
+func (s *SlimAction) Run(context *debos.DebosContext) error {
+	s.LogStart()
+
+	type step struct {
+		name  string
+		dir   string
+		keep  func(os.FileInfo) bool
+		apply bool
+	}
+	steps := []step{
+		{"Manual pages", "/usr/share/man", keepNothing, s.RemoveMan},
+		{"Translations", "/usr/share/locale", func(f os.FileInfo) bool {
+			if !f.IsDir() {
+				return true
+			}
+			for _, l := range s.KeepLocales {
+				if f.Name() == l {
+					return true
+				}
+			}
+			return false
+		}, len(s.KeepLocales) > 0},
+		{"Apt lists", "/var/lib/apt/lists", func(f os.FileInfo) bool {
+			return f.Name() == "lock" || f.Name() == "partial"
+		}, s.CleanAptLists},
+	}
+
+	var total int64
+	if s.RemoveDocs {
+		freed, err := s.removeDocs(context.Rootdir)
+		if err != nil {
+			return err
+		}
+		log.Printf("Documentation removed, %s reclaimed", units.BytesSize(float64(freed)))
+		total += freed
+	}
+
+	for _, st := range steps {
+		if !st.apply {
+			continue
+		}
+		dir, err := slimDir(context.Rootdir, st.dir)
+		if err != nil {
+			return err
+		}
+		var freed int64
+		if dir != "" {
+			if freed, err = removeDirEntries(dir, st.keep); err != nil {
+				return err
+			}
+		}
+		log.Printf("%s removed, %s reclaimed", st.name, units.BytesSize(float64(freed)))
+		total += freed
+	}
+
+	log.Printf("%s reclaimed in total", units.BytesSize(float64(total)))
+	return nil
+}
@@ -0,0 +1,85 @@
+package actions
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/go-debos/debos"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSlim(t *testing.T) {
+	rootdir, err := ioutil.TempDir("", "slim")
+	assert.Empty(t, err)
+	defer os.RemoveAll(rootdir)
+
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+	context.Rootdir = rootdir
+
+	s := SlimAction{}
+	assert.EqualError(t, s.Verify(&context),
+		"At least one of 'remove-docs', 'remove-man', 'keep-locales' or 'clean-apt-lists' properties is mandatory")
+
+	for file, content := range map[string]string{
+		"usr/share/doc/README":                     "1",
+		"usr/share/doc/bash/copyright":             "22",
+		"usr/share/doc/bash/changelog.Debian.gz":   "333",
+		"usr/share/doc/bash/examples/bashrc":       "4444",
+		"usr/share/info/bash.info.gz":              "55555",
+		"usr/share/locale/locale.alias":            "a",
+		"usr/share/locale/de/LC_MESSAGES/bash.mo":  "bb",
+		"usr/share/locale/en/LC_MESSAGES/bash.mo":  "cc",
+		"var/lib/apt/lists/lock":                   "",
+		"var/lib/apt/lists/deb.debian.org_Release": "ddd",
+		"usr/share/man/man1/bash.1.gz":             "eeee",
+	} {
+		p := path.Join(rootdir, file)
+		assert.Empty(t, os.MkdirAll(path.Dir(p), 0755))
+		assert.Empty(t, ioutil.WriteFile(p, []byte(content), 0644))
+	}
+	assert.Empty(t, os.MkdirAll(path.Join(rootdir, "var/lib/apt/lists/partial"), 0755))
+
+	s = SlimAction{RemoveDocs: true, KeepLocales: []string{"en"}, CleanAptLists: true}
+	assert.Empty(t, s.Verify(&context))
+	assert.Empty(t, s.Run(&context))
+
+	for file, exists := range map[string]bool{
+		"usr/share/doc/README":                     false,
+		"usr/share/doc/bash/copyright":             true,
+		"usr/share/doc/bash/changelog.Debian.gz":   false,
+		"usr/share/doc/bash/examples":              false,
+		"usr/share/info/bash.info.gz":              false,
+		"usr/share/locale/locale.alias":            true,
+		"usr/share/locale/de":                      false,
+		"usr/share/locale/en/LC_MESSAGES/bash.mo":  true,
+		"var/lib/apt/lists/lock":                   true,
+		"var/lib/apt/lists/partial":                true,
+		"var/lib/apt/lists/deb.debian.org_Release": false,
+		"usr/share/man/man1/bash.1.gz":             true,
+	} {
+		_, err := os.Stat(path.Join(rootdir, file))
+		assert.Equal(t, exists, err == nil, file)
+	}
+
+	freed, err := s.removeDocs(rootdir)
+	assert.Empty(t, err)
+	assert.Equal(t, int64(0), freed)
+}
+
+func TestSlimDir(t *testing.T) {
+	rootdir, err := ioutil.TempDir("", "slim")
+	assert.Empty(t, err)
+	defer os.RemoveAll(rootdir)
+
+	assert.Empty(t, os.MkdirAll(path.Join(rootdir, "usr/share"), 0755))
+	assert.Empty(t, os.Symlink("/usr/share/doc", path.Join(rootdir, "usr/share/doc")))
+
+	_, err = slimDir(rootdir, "/usr/share/doc")
+	assert.EqualError(t, err, "/usr/share/doc points outside of the target rootfs")
+
+	dir, err := slimDir(rootdir, "/usr/share/man")
+	assert.Empty(t, err)
+	assert.Equal(t, "", dir)
+}
@@ -0,0 +1,162 @@
+/*
+Smartd Action
+
+Install 'smartmontools' in the target rootfs, configure the disks monitored by
+smartd in '/etc/smartd.conf' and enable the service, so the health of the
+disks is monitored from the first boot.
+
+Each device is monitored for all its SMART attributes and errors, with
+automatic offline tests and attribute autosave enabled, and disks in standby
+are not woken up for the checks.
+
+Yaml syntax:
+ - action: smartd
+   devices:
+     - device: /dev/sda
+     - device: /dev/sdb
+       type: sat
+     - device: /dev/bus/0
+       type: megaraid,0
+   email: admin@example.com
+   schedule: (S/../.././02|L/../../6/03)
+
+Optional properties:
+
+- devices -- list of devices to monitor. By default all the devices found at
+boot are monitored, as with the 'DEVICESCAN' directive. Each device has the
+following properties:
+
+  - device -- absolute path of the device, or 'DEVICESCAN' to monitor all the
+  devices found at boot, in which case it must be the last device as smartd
+  ignores the following ones. Mandatory.
+
+  - type -- type of the device, such as 'ata', 'scsi', 'nvme', 'sat' or
+  'megaraid,N' for a disk behind a RAID controller. By default smartd guesses
+  the type.
+
+- email -- comma separated list of addresses to send warnings to. A mail
+transfer agent must be installed in the image for the mails to be sent.
+
+- schedule -- regular expression, in the smartd '-s' format, of the self tests
+to run. For example '(S/../.././02|L/../../6/03)' runs a short test every day
+at 2am and a long test every Saturday at 3am. By default no self test is
+scheduled.
+*/
+package actions
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/go-debos/debos"
+)
+
+const smartdConf = "/etc/smartd.conf"
+
+var smartdType = regexp.MustCompile(`^(auto|ata|scsi|nvme|sat|sat,(auto|12|16)|usbcypress|usbjmicron|usbprolific|usbsunplus|(megaraid|areca|3ware|cciss|aacraid),[0-9/,]+)$`)
+var smartdTest = regexp.MustCompile(`[SLCOcnr]/`)
+var smartdUser = regexp.MustCompile(`^[a-z_][a-z0-9_-]*$`)
+
+type SmartdDevice struct {
+	Device string
+	Type   string
+}
+
+type SmartdAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Devices          []SmartdDevice
+	Email            string
+	Schedule         string
+}
+
+func (s *SmartdAction) Verify(context *debos.DebosContext) error {
+	if len(s.Devices) == 0 {
+		s.Devices = []SmartdDevice{{Device: "DEVICESCAN"}}
+	}
+
+	for idx, d := range s.Devices {
+		if d.Device == "" {
+			return errors.New("Device without a path")
+		}
+		if d.Device == "DEVICESCAN" {
+			if idx != len(s.Devices)-1 {
+				return errors.New("DEVICESCAN must be the last device")
+			}
+		} else if !path.IsAbs(d.Device) || strings.ContainsAny(d.Device, " \t") {
+			return fmt.Errorf("Invalid device '%s'", d.Device)
+		}
+		if d.Type != "" && !smartdType.MatchString(d.Type) {
+			return fmt.Errorf("Unsupported type '%s' for device %s", d.Type, d.Device)
+		}
+	}
+
+	if s.Email != "" {
+		for _, address := range strings.Split(s.Email, ",") {
+			if smartdUser.MatchString(address) {
+				continue
+			}
+			if a, err := mail.ParseAddress(address); err != nil || a.Address != address {
+				return fmt.Errorf("Invalid email address '%s'", address)
+			}
+		}
+	}
+
+	if s.Schedule != "" {
+		_, err := regexp.CompilePOSIX(s.Schedule)
+		if err != nil || !smartdTest.MatchString(s.Schedule) || strings.ContainsAny(s.Schedule, " \t") {
+			return fmt.Errorf("Invalid schedule '%s'", s.Schedule)
+		}
+	}
+
+	return nil
+}
+
+func (s *SmartdAction) config() string {
+	directives := "-a -o on -S on -n standby,q"
+	if s.Schedule != "" {
+		directives += " -s " + s.Schedule
+	}
+	if s.Email != "" {
+		directives += " -m " + s.Email + " -M exec /usr/share/smartmontools/smartd-runner"
+	}
+
+	lines := []string{"# Generated by debos"}
+	for _, d := range s.Devices {
+		line := d.Device
+		if d.Type != "" {
+			line += " -d " + d.Type
+		}
+		lines = append(lines, line+" "+directives)
+	}
+
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func (s *SmartdAction) configure(context *debos.DebosContext) error {
+	conf := path.Join(context.Rootdir, smartdConf)
+	if err := os.MkdirAll(path.Dir(conf), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(conf, []byte(s.config()), 0644); err != nil {
+		return fmt.Errorf("Couldn't write %s: %v", smartdConf, err)
+	}
+
+	services := debos.SystemdHelper{Rootdir: context.Rootdir}
+	return services.Enable("smartmontools.service")
+}
+
+func (s *SmartdAction) Run(context *debos.DebosContext) error {
+	s.LogStart()
+
+	if err := installPackages(context, "smartmontools"); err != nil {
+		return err
+	}
+
+	return s.configure(context)
+}
@@ -0,0 +1,70 @@
+package actions
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/go-debos/debos"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSmartd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+	context.Rootdir = dir
+	fakeUnit(t, dir, "smartmontools.service", "WantedBy=multi-user.target\nAlias=smartd.service")
+
+	// All the devices by default
+	s := SmartdAction{}
+	assert.Empty(t, s.Verify(&context))
+	assert.Empty(t, s.configure(&context))
+
+	conf, err := ioutil.ReadFile(path.Join(dir, "etc/smartd.conf"))
+	assert.Empty(t, err)
+	assert.Equal(t, "# Generated by debos\nDEVICESCAN -a -o on -S on -n standby,q\n", string(conf))
+
+	link, err := os.Readlink(path.Join(dir, "etc/systemd/system/multi-user.target.wants/smartmontools.service"))
+	assert.Empty(t, err)
+	assert.Equal(t, "/lib/systemd/system/smartmontools.service", link)
+	_, err = os.Lstat(path.Join(dir, "etc/systemd/system/smartd.service"))
+	assert.Empty(t, err)
+
+	s = SmartdAction{
+		Devices: []SmartdDevice{
+			{Device: "/dev/sda"},
+			{Device: "/dev/sdb", Type: "sat"},
+			{Device: "/dev/bus/0", Type: "megaraid,0"},
+		},
+		Email:    "admin@example.com,root",
+		Schedule: "(S/../.././02|L/../../6/03)",
+	}
+	assert.Empty(t, s.Verify(&context))
+	assert.Empty(t, s.configure(&context))
+
+	conf, err = ioutil.ReadFile(path.Join(dir, "etc/smartd.conf"))
+	assert.Empty(t, err)
+	directives := " -a -o on -S on -n standby,q -s (S/../.././02|L/../../6/03) -m admin@example.com,root -M exec /usr/share/smartmontools/smartd-runner\n"
+	assert.Equal(t, "# Generated by debos\n"+
+		"/dev/sda"+directives+
+		"/dev/sdb -d sat"+directives+
+		"/dev/bus/0 -d megaraid,0"+directives, string(conf))
+
+	for msg, change := range map[string]func(s *SmartdAction){
+		"Device without a path":                       func(s *SmartdAction) { s.Devices[0].Device = "" },
+		"Invalid device 'sda'":                        func(s *SmartdAction) { s.Devices[0].Device = "sda" },
+		"DEVICESCAN must be the last device":          func(s *SmartdAction) { s.Devices[0].Device = "DEVICESCAN" },
+		"Unsupported type 'raid' for device /dev/sda": func(s *SmartdAction) { s.Devices[0].Type = "raid" },
+		"Invalid email address 'admin@'":              func(s *SmartdAction) { s.Email = "admin@" },
+		"Invalid schedule 'daily'":                    func(s *SmartdAction) { s.Schedule = "daily" },
+		"Invalid schedule '(S/../.././02'":            func(s *SmartdAction) { s.Schedule = "(S/../.././02" },
+	} {
+		s := SmartdAction{Devices: []SmartdDevice{{Device: "/dev/sda"}, {Device: "/dev/sdb"}}}
+		change(&s)
+		assert.EqualError(t, s.Verify(&context), msg)
+	}
+}
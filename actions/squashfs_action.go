@@ -0,0 +1,175 @@
+/*
+Squashfs Action
+
+Create a squashfs image of the filesystem, or of a directory of it, with
+mksquashfs(1), for example for the root filesystem of a live or embedded
+system.
+
+The image is written to the artifact directory, so it can be the 'image' of a
+partition of an 'image-partition' action, or be written to a partition by a
+'raw' action with the 'artifacts' origin:
+
+ - action: squashfs
+   file: rootfs.squashfs
+
+ - action: raw
+   origin: artifacts
+   source: rootfs.squashfs
+   partition: root
+
+Yaml syntax:
+ - action: squashfs
+   file: filename.squashfs
+   source: directory
+   compression: xz
+   block-size: 1MiB
+   exclude:
+     - "boot/*"
+   threads: 4
+   deterministic: bool
+
+Mandatory properties:
+
+- file -- name of the squashfs image, relative to the artifact directory.
+
+Optional properties:
+
+- source -- directory of the filesystem to make the image of. By default is
+the whole filesystem.
+
+- compression -- compression type to use, either 'gzip', 'xz', 'zstd' or
+'lz4'. By default is 'xz'.
+
+- block-size -- size of the data blocks, a power of two between 4KiB and
+1MiB in human-readable form. By default is the one of mksquashfs, '128KiB'.
+
+- exclude -- list of shell glob patterns of the files and directories to leave
+out of the image, relative to 'source', for example 'var/cache/apt/*'.
+
+- threads -- number of threads used for the compression. By default the
+number of CPUs.
+
+- deterministic -- boolean to produce byte identical images from identical
+trees: the files are added in the same order whatever the number of threads
+and the creation time of the image is the 'SOURCE_DATE_EPOCH' of the
+environment, or zero when it isn't set. The modification times of the files
+are kept, so they must be the same in both trees. By default is 'false'.
+*/
+package actions
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+
+	"github.com/docker/go-units"
+	"github.com/go-debos/debos"
+)
+
+type SquashfsAction struct {
+	debos.BaseAction `yaml:",inline"`
+	File             string
+	Source           string
+	Compression      string
+	BlockSize        string `yaml:"block-size"`
+	Exclude          []string
+	Threads          int
+	Deterministic    bool
+	blockSize        int64
+}
+
+func NewSquashfsAction() *SquashfsAction {
+	return &SquashfsAction{Compression: "xz"}
+}
+
+func (s *SquashfsAction) Verify(context *debos.DebosContext) error {
+	if len(s.File) == 0 {
+		return fmt.Errorf("'file' property can't be empty")
+	}
+
+	switch s.Compression {
+	case "gzip", "xz", "zstd", "lz4":
+	default:
+		return fmt.Errorf("Unsupported compression '%s'", s.Compression)
+	}
+
+	if s.BlockSize != "" {
+		size, err := units.RAMInBytes(s.BlockSize)
+		if err != nil || size < 4*units.KiB || size > units.MiB || size&(size-1) != 0 {
+			return fmt.Errorf("Invalid block size '%s', expected a power of two between 4KiB and 1MiB", s.BlockSize)
+		}
+		s.blockSize = size
+	}
+
+	for _, e := range s.Exclude {
+		if _, err := filepath.Match(e, ""); err != nil {
+			return fmt.Errorf("Invalid exclude pattern '%s': %v", e, err)
+		}
+	}
+
+	if s.Threads < 0 {
+		return fmt.Errorf("Invalid number of threads %d", s.Threads)
+	}
+
+	return nil
+}
+
+func (s *SquashfsAction) mksquashfsOptions(source, outfile string, threads int, mkfsTime int64) []string {
+	options := []string{"mksquashfs", source, outfile, "-noappend",
+		"-comp", s.Compression, "-processors", strconv.Itoa(threads)}
+
+	if s.blockSize != 0 {
+		options = append(options, "-b", strconv.FormatInt(s.blockSize, 10))
+	}
+
+	if s.Deterministic {
+		options = append(options, "-reproducible", "-mkfs-time", strconv.FormatInt(mkfsTime, 10))
+	}
+
+	// The exclusions come last, everything after -e is excluded
+	if len(s.Exclude) > 0 {
+		options = append(options, "-wildcards", "-e")
+		options = append(options, s.Exclude...)
+	}
+
+	return options
+}
+
+func (s *SquashfsAction) Run(context *debos.DebosContext) error {
+	s.LogStart()
+
+	source := context.Rootdir
+	if s.Source != "" {
+		source = debos.CleanPathAt(s.Source, context.Rootdir)
+	}
+	if info, err := os.Stat(source); err != nil || !info.IsDir() {
+		return fmt.Errorf("Source directory '%s' not found in the filesystem", s.Source)
+	}
+
+	threads := s.Threads
+	if threads == 0 {
+		threads = runtime.NumCPU()
+	}
+
+	var mkfsTime int64
+	if s.Deterministic {
+		epoch, _, err := sourceDateEpoch(context)
+		if err != nil {
+			return err
+		}
+		mkfsTime = epoch
+	}
+
+	outfile := path.Join(context.Artifactdir, s.File)
+	if err := os.MkdirAll(path.Dir(outfile), 0755); err != nil {
+		return err
+	}
+
+	log.Printf("Creating squashfs image %s\n", outfile)
+	return debos.NewCommandForContext(*context).Run("Squashfs",
+		s.mksquashfsOptions(source, outfile, threads, mkfsTime)...)
+}
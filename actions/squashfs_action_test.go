@@ -0,0 +1,51 @@
+package actions
+
+import (
+	"testing"
+
+	"github.com/go-debos/debos"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSquashfsVerify(t *testing.T) {
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+
+	s := NewSquashfsAction()
+	assert.EqualError(t, s.Verify(&context), "'file' property can't be empty")
+
+	s.File = "rootfs.squashfs"
+	s.Compression = "bzip2"
+	assert.EqualError(t, s.Verify(&context), "Unsupported compression 'bzip2'")
+
+	s.Compression = "zstd"
+	for _, size := range []string{"2KiB", "2MiB", "100KiB", "big"} {
+		s.BlockSize = size
+		assert.Error(t, s.Verify(&context), size)
+	}
+
+	s.BlockSize = "256KiB"
+	assert.Empty(t, s.Verify(&context))
+	assert.Equal(t, int64(262144), s.blockSize)
+}
+
+func TestSquashfsOptions(t *testing.T) {
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+
+	s := NewSquashfsAction()
+	s.File = "rootfs.squashfs"
+	assert.Empty(t, s.Verify(&context))
+	assert.Equal(t, []string{"mksquashfs", "/root", "/out.squashfs", "-noappend",
+		"-comp", "xz", "-processors", "2"},
+		s.mksquashfsOptions("/root", "/out.squashfs", 2, 0))
+
+	// The exclusions are last as they take the remaining arguments
+	s.BlockSize = "1MiB"
+	s.Exclude = []string{"boot/*", "var/cache/apt/*"}
+	s.Deterministic = true
+	assert.Empty(t, s.Verify(&context))
+	assert.Equal(t, []string{"mksquashfs", "/root", "/out.squashfs", "-noappend",
+		"-comp", "xz", "-processors", "4", "-b", "1048576",
+		"-reproducible", "-mkfs-time", "1700000000",
+		"-wildcards", "-e", "boot/*", "var/cache/apt/*"},
+		s.mksquashfsOptions("/root", "/out.squashfs", 4, 1700000000))
+}
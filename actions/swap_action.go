@@ -0,0 +1,168 @@
+/*
+Swap Action
+
+Create a swapfile inside the target rootfs and optionally add it to
+'/etc/fstab'. For swap partitions use the 'swap' fs type of the
+'image-partition' action instead.
+
+On btrfs the 'nocow' attribute is set on the swapfile before allocating it,
+as required for btrfs swapfiles.
+
+Yaml syntax:
+ - action: swap
+   file: /swapfile
+   size: 1GB
+   setup-fstab: bool
+
+Mandatory properties:
+
+- size -- size of the swapfile in human-readable form, examples: 512MB, 1GB, etc.
+
+Optional properties:
+
+- file -- absolute path of the swapfile in the target rootfs. By default is
+'/swapfile'.
+
+- setup-fstab -- append an entry for the swapfile to '/etc/fstab' in the target
+rootfs. By default is 'true'. When used together with 'filesystem-deploy' the
+swap action must run after it, otherwise the entry is lost when the fstab is
+generated.
+*/
+package actions
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+
+	"github.com/docker/go-units"
+	"github.com/go-debos/debos"
+)
+
+const btrfsSuperMagic = 0x9123683e
+
+// Set the nocow attribute of the btrfs swapfiles with
+var chattrCommand = "chattr"
+
+// Type of the filesystem holding the file, its superblock magic
+var filesystemType = func(f *os.File) (int64, error) {
+	var fs syscall.Statfs_t
+	if err := syscall.Fstatfs(int(f.Fd()), &fs); err != nil {
+		return 0, err
+	}
+	return int64(fs.Type), nil
+}
+
+type SwapAction struct {
+	debos.BaseAction `yaml:",inline"`
+	File             string
+	Size             string
+	SetupFSTab       bool `yaml:"setup-fstab"`
+	size             int64
+}
+
+func NewSwapAction() *SwapAction {
+	s := SwapAction{}
+	s.File = "/swapfile"
+	s.SetupFSTab = true
+
+	return &s
+}
+
+func (s *SwapAction) Verify(context *debos.DebosContext) error {
+	if len(s.Size) == 0 {
+		return fmt.Errorf("'size' property can't be empty")
+	}
+
+	size, err := units.FromHumanSize(s.Size)
+	if err != nil {
+		return fmt.Errorf("Failed to parse swap size: %s", s.Size)
+	}
+	s.size = size
+
+	if !path.IsAbs(s.File) {
+		return fmt.Errorf("'file' must be an absolute path")
+	}
+
+	return nil
+}
+
+func (s *SwapAction) setupFSTab(context *debos.DebosContext) error {
+	fstab := path.Join(context.Rootdir, "etc/fstab")
+	current, _ := ioutil.ReadFile(fstab)
+
+	for _, line := range strings.Split(string(current), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 0 && fields[0] == s.File {
+			log.Printf("%s already in fstab", s.File)
+			return nil
+		}
+	}
+
+	if err := os.MkdirAll(path.Dir(fstab), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(fstab, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("Couldn't open fstab: %v", err)
+	}
+	defer f.Close()
+
+	_, err = f.WriteString(fmt.Sprintf("%s\tnone\tswap\tsw\t0\t0\n", s.File))
+	if err != nil {
+		return fmt.Errorf("Couldn't write fstab: %v", err)
+	}
+
+	return nil
+}
+
+func (s *SwapAction) Run(context *debos.DebosContext) error {
+	s.LogStart()
+
+	swapfile, err := debos.RestrictedPath(context.Rootdir, s.File)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(swapfile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("Couldn't create swapfile: %v", err)
+	}
+	defer f.Close()
+
+	fsType, err := filesystemType(f)
+	if err != nil {
+		return err
+	}
+
+	/* btrfs swapfiles must not be copy-on-write, which can only be set
+	 * while the file is still empty */
+	if uint32(fsType) == btrfsSuperMagic {
+		err = debos.NewCommandForContext(*context).Run("swap", chattrCommand, "+C", swapfile)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err = syscall.Fallocate(int(f.Fd()), 0, 0, s.size); err != nil {
+		return fmt.Errorf("Couldn't allocate swapfile: %v", err)
+	}
+	if err = f.Chmod(0600); err != nil {
+		return err
+	}
+
+	err = debos.NewCommandForContext(*context).Run("swap", "mkswap", swapfile)
+	if err != nil {
+		return err
+	}
+
+	if s.SetupFSTab {
+		return s.setupFSTab(context)
+	}
+
+	return nil
+}
@@ -0,0 +1,113 @@
+package actions
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/go-debos/debos"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSwapVerify(t *testing.T) {
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+
+	s := NewSwapAction()
+	assert.EqualError(t, s.Verify(&context), "'size' property can't be empty")
+	s.Size = "lots"
+	assert.EqualError(t, s.Verify(&context), "Failed to parse swap size: lots")
+	s.Size = "64MB"
+	s.File = "var/swap"
+	assert.EqualError(t, s.Verify(&context), "'file' must be an absolute path")
+	s.File = "/var/swap"
+	assert.Empty(t, s.Verify(&context))
+	assert.Equal(t, int64(64000000), s.size)
+}
+
+// Record the arguments of chattr and report the filesystem as btrfs or not
+func fakeSwapFilesystem(t *testing.T, dir string, btrfs bool) func() string {
+	chattr := path.Join(dir, "chattr")
+	calls := path.Join(dir, "chattr.calls")
+	script := "#!/bin/sh\necho \"$@\" >> " + calls + "\n"
+	assert.Empty(t, ioutil.WriteFile(chattr, []byte(script), 0755))
+
+	command, fsType := chattrCommand, filesystemType
+	chattrCommand = chattr
+	filesystemType = func(f *os.File) (int64, error) {
+		// Still empty when the attribute is set
+		info, err := f.Stat()
+		assert.Empty(t, err)
+		assert.Equal(t, int64(0), info.Size())
+		if btrfs {
+			return btrfsSuperMagic, nil
+		}
+		return fsType(f)
+	}
+	t.Cleanup(func() { chattrCommand, filesystemType = command, fsType })
+
+	return func() string {
+		c, _ := ioutil.ReadFile(calls)
+		return string(c)
+	}
+}
+
+func TestSwap(t *testing.T) {
+	for _, btrfs := range []bool{false, true} {
+		dir, err := ioutil.TempDir("", "go-debos")
+		assert.Empty(t, err)
+		defer os.RemoveAll(dir)
+
+		context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+		context.Rootdir = path.Join(dir, "root")
+		assert.Empty(t, os.MkdirAll(path.Join(context.Rootdir, "etc"), 0755))
+		fstab := "/dev/sda1\t/\text4\tdefaults\t0\t1\n"
+		assert.Empty(t, ioutil.WriteFile(path.Join(context.Rootdir, "etc/fstab"), []byte(fstab), 0644))
+		chattr := fakeSwapFilesystem(t, dir, btrfs)
+
+		s := NewSwapAction()
+		s.Size = "4MB"
+		assert.Empty(t, s.Verify(&context))
+		// Running again doesn't add the entry twice
+		for i := 0; i < 2; i++ {
+			assert.Empty(t, s.Run(&context))
+		}
+
+		info, err := os.Stat(path.Join(context.Rootdir, "swapfile"))
+		assert.Empty(t, err)
+		assert.Equal(t, int64(4000000), info.Size())
+		assert.Equal(t, os.FileMode(0600), info.Mode())
+
+		content, err := ioutil.ReadFile(path.Join(context.Rootdir, "etc/fstab"))
+		assert.Empty(t, err)
+		assert.Equal(t, fstab+"/swapfile\tnone\tswap\tsw\t0\t0\n", string(content))
+
+		// Only btrfs swapfiles get the nocow attribute
+		if btrfs {
+			swapfile := path.Join(context.Rootdir, "swapfile")
+			assert.Equal(t, "+C "+swapfile+"\n+C "+swapfile+"\n", chattr())
+		} else {
+			assert.Equal(t, "", chattr())
+		}
+	}
+}
+
+func TestSwapNoFSTab(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+	context.Rootdir = dir
+	fakeSwapFilesystem(t, dir, false)
+
+	s := NewSwapAction()
+	s.File = "/var/swap"
+	s.Size = "1MB"
+	s.SetupFSTab = false
+	assert.Empty(t, os.MkdirAll(path.Join(dir, "var"), 0755))
+	assert.Empty(t, s.Verify(&context))
+	assert.Empty(t, s.Run(&context))
+	_, err = os.Stat(path.Join(dir, "etc/fstab"))
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,120 @@
+/*
+Systemd Action
+
+Enable, disable or mask systemd units of the target rootfs, without a running
+systemd, by creating and removing the links of the units as systemctl does.
+
+Yaml syntax:
+ - action: systemd
+   preset: bool
+   enable:
+     - unit
+   disable:
+     - unit
+   mask:
+     - unit
+
+Optional properties:
+
+- preset -- reset all the units to their preset state, as set by the
+'*.preset' files of the target rootfs, before the changes of the other
+properties. Units without a matching preset are enabled, templates only for
+the instances listed by their preset. By default 'false'.
+
+- enable -- list of units to enable.
+
+- disable -- list of units to disable.
+
+- mask -- list of units to mask.
+
+At least one property has to be set. Units without a type suffix are
+services. Each unit has to be installed in the target rootfs, in
+'/etc/systemd/system', '/usr/lib/systemd/system' or '/lib/systemd/system';
+the instances of a template unit, like 'getty@tty2.service', are found by the
+template.
+*/
+package actions
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/go-debos/debos"
+)
+
+type SystemdAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Preset           bool
+	Enable           []string
+	Disable          []string
+	Mask             []string
+}
+
+// Full name of the unit, as completed by systemctl
+func systemdUnitName(unit string) string {
+	for _, t := range []string{".service", ".socket", ".target", ".timer", ".mount",
+		".automount", ".swap", ".path", ".slice", ".scope", ".device"} {
+		if strings.HasSuffix(unit, t) {
+			return unit
+		}
+	}
+	return unit + ".service"
+}
+
+// Check the unit is installed in the rootfs
+func systemdUnitExists(rootdir, unit string) error {
+	services := debos.SystemdHelper{Rootdir: rootdir}
+	if _, err := services.UnitPath(systemdUnitName(unit)); err != nil {
+		return fmt.Errorf("Unit %s isn't installed in the target rootfs", systemdUnitName(unit))
+	}
+	return nil
+}
+
+func (s *SystemdAction) Verify(context *debos.DebosContext) error {
+	if !s.Preset && len(s.Enable) == 0 && len(s.Disable) == 0 && len(s.Mask) == 0 {
+		return errors.New("At least one of 'preset', 'enable', 'disable' or 'mask' properties is mandatory")
+	}
+
+	for _, units := range [][]string{s.Enable, s.Disable, s.Mask} {
+		for _, u := range units {
+			if u == "" || strings.ContainsAny(u, "/ \t") {
+				return fmt.Errorf("Invalid unit name '%s'", u)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *SystemdAction) Run(context *debos.DebosContext) error {
+	s.LogStart()
+
+	for _, units := range [][]string{s.Enable, s.Disable, s.Mask} {
+		for _, u := range units {
+			if err := systemdUnitExists(context.Rootdir, u); err != nil {
+				return err
+			}
+		}
+	}
+
+	services := debos.SystemdHelper{Rootdir: context.Rootdir}
+	if s.Preset {
+		if err := services.PresetAll(); err != nil {
+			return err
+		}
+	}
+
+	for _, step := range []struct {
+		apply func(string) error
+		units []string
+	}{{services.Enable, s.Enable}, {services.Disable, s.Disable}, {services.Mask, s.Mask}} {
+		for _, u := range step.units {
+			if err := step.apply(systemdUnitName(u)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
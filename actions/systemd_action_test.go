@@ -0,0 +1,106 @@
+package actions
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/go-debos/debos"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSystemdVerify(t *testing.T) {
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+
+	s := SystemdAction{}
+	assert.EqualError(t, s.Verify(&context),
+		"At least one of 'preset', 'enable', 'disable' or 'mask' properties is mandatory")
+
+	s.Enable = []string{"ssh", "systemd-networkd.socket"}
+	assert.Empty(t, s.Verify(&context))
+
+	s.Mask = []string{"../ssh.service"}
+	assert.EqualError(t, s.Verify(&context), "Invalid unit name '../ssh.service'")
+}
+
+func TestSystemdUnitExists(t *testing.T) {
+	rootdir, err := ioutil.TempDir("", "systemd")
+	assert.Empty(t, err)
+	defer os.RemoveAll(rootdir)
+
+	units := path.Join(rootdir, "lib/systemd/system")
+	assert.Empty(t, os.MkdirAll(units, 0755))
+	for _, u := range []string{"ssh.service", "getty@.service", "fstrim.timer"} {
+		assert.Empty(t, ioutil.WriteFile(path.Join(units, u), []byte{}, 0644))
+	}
+
+	assert.Empty(t, systemdUnitExists(rootdir, "ssh"))
+	assert.Empty(t, systemdUnitExists(rootdir, "fstrim.timer"))
+	assert.Empty(t, systemdUnitExists(rootdir, "getty@tty2.service"))
+	assert.EqualError(t, systemdUnitExists(rootdir, "fstrim"),
+		"Unit fstrim.service isn't installed in the target rootfs")
+	assert.EqualError(t, systemdUnitExists(rootdir, "serial-getty@ttyS0"),
+		"Unit serial-getty@ttyS0.service isn't installed in the target rootfs")
+}
+
+func TestSystemd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+	context.Rootdir = dir
+	for file, content := range map[string]string{
+		"lib/systemd/system/ssh.service":                   "[Install]\nWantedBy=multi-user.target\nAlias=sshd.service\n",
+		"lib/systemd/system/cron.service":                  "[Install]\nWantedBy=multi-user.target\n",
+		"lib/systemd/system/fstrim.timer":                  "[Install]\nWantedBy=timers.target\n",
+		"lib/systemd/system/getty@.service":                "[Install]\nWantedBy=getty.target\n",
+		"lib/systemd/system/apt-daily.service":             "[Unit]\nDescription=Static\n",
+		"lib/systemd/system-preset/90-debian.preset":       "disable cron.service\nenable getty@.service tty1\n",
+		"etc/systemd/system/local.service":                 "[Install]\nWantedBy=multi-user.target\n",
+		"etc/systemd/system-preset/10-local.preset":        "# Local\ndisable fstrim.timer\n",
+		"usr/lib/systemd/system-preset/90-debian.preset":   "enable *\n",
+		"etc/systemd/system/timers.target.wants/.keep":     "",
+		"etc/systemd/system/multi-user.target.wants/.keep": "",
+	} {
+		assert.Empty(t, os.MkdirAll(path.Join(dir, path.Dir(file)), 0755))
+		assert.Empty(t, ioutil.WriteFile(path.Join(dir, file), []byte(content), 0644))
+	}
+	assert.Empty(t, os.Symlink("/lib/systemd/system/fstrim.timer",
+		path.Join(dir, "etc/systemd/system/timers.target.wants/fstrim.timer")))
+
+	link := func(name string) string {
+		target, _ := os.Readlink(path.Join(dir, "etc/systemd/system", name))
+		return target
+	}
+
+	s := SystemdAction{Preset: true}
+	assert.Empty(t, s.Verify(&context))
+	assert.Empty(t, s.Run(&context))
+	assert.Equal(t, "/lib/systemd/system/ssh.service", link("multi-user.target.wants/ssh.service"))
+	assert.Equal(t, "/lib/systemd/system/ssh.service", link("sshd.service"))
+	assert.Equal(t, "/etc/systemd/system/local.service", link("multi-user.target.wants/local.service"))
+	assert.Equal(t, "/lib/systemd/system/getty@.service", link("getty.target.wants/getty@tty1.service"))
+	assert.Equal(t, "", link("multi-user.target.wants/cron.service"))
+	assert.Equal(t, "", link("timers.target.wants/fstrim.timer"))
+
+	s = SystemdAction{Enable: []string{"cron"}, Disable: []string{"ssh", "fstrim.timer"}, Mask: []string{"fstrim.timer"}}
+	assert.Empty(t, s.Verify(&context))
+	assert.Empty(t, s.Run(&context))
+	assert.Equal(t, "/lib/systemd/system/cron.service", link("multi-user.target.wants/cron.service"))
+	assert.Equal(t, "", link("multi-user.target.wants/ssh.service"))
+	assert.Equal(t, "", link("sshd.service"))
+	assert.Equal(t, "/dev/null", link("fstrim.timer"))
+
+	// Disabling keeps the mask
+	s = SystemdAction{Disable: []string{"fstrim.timer"}}
+	assert.Empty(t, s.Run(&context))
+	assert.Equal(t, "/dev/null", link("fstrim.timer"))
+
+	s = SystemdAction{Mask: []string{"local"}}
+	assert.EqualError(t, s.Run(&context),
+		"Unit 'local.service' is a file of /etc/systemd/system, it can't be masked")
+	s = SystemdAction{Enable: []string{"cron", "missing"}}
+	assert.EqualError(t, s.Run(&context), "Unit missing.service isn't installed in the target rootfs")
+}
@@ -0,0 +1,191 @@
+/*
+TemplateFile Action
+
+Render a Go template and write the result to a file of the target rootfs, for
+example a bootloader configuration or a kernel command line using values only
+known at build time.
+
+Yaml syntax:
+ - action: template-file
+   origin: name
+   source: path
+   template: text
+   destination: path
+   mode: octal
+   variables:
+     name: value
+
+Mandatory properties:
+
+- destination -- absolute path in the target rootfs of the rendered file. The
+missing parent directories are created.
+
+- source -- path to the template, relative to 'origin'. Mandatory unless
+'template' is set.
+
+- template -- the template itself, instead of 'source'. As the recipe is a
+template too, the actions of the inline template have to be quoted to be left
+to this action, like '{{`{{ .root_hash }}`}}'.
+
+Optional properties:
+
+- origin -- reference to named file or directory. The default value is the
+'recipe' directory.
+
+- mode -- octal permissions of the file. By default '0644'.
+
+- variables -- map of additional variables of the template.
+
+The template can use the template variables of the recipe, the variables set
+by the previous actions, like the fingerprint of a 'gpg-ephemeral-key' action,
+and the following ones:
+
+ - architecture -- the architecture of the recipe
+ - kernel_root -- the 'root=' argument of the kernel command line set by the
+   'image-partition' action, if any
+
+The variables set by the actions take precedence over the template variables
+of the recipe, and the 'variables' property over both. Using a variable which
+isn't defined makes the action fail. The 'sector' function of the recipes is
+available as well.
+
+Example:
+
+ - action: template-file
+   source: extlinux.conf.tmpl
+   destination: /boot/extlinux/extlinux.conf
+*/
+package actions
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"text/template"
+
+	"github.com/go-debos/debos"
+)
+
+type TemplateFileAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Origin           string
+	Source           string
+	Template         string
+	Destination      string
+	Mode             string
+	Variables        map[string]string
+	templateVars     map[string]string
+}
+
+func NewTemplateFileAction() *TemplateFileAction {
+	return &TemplateFileAction{Origin: "recipe", Mode: "0644"}
+}
+
+func (t *TemplateFileAction) Verify(context *debos.DebosContext) error {
+	if len(t.Source) == 0 && len(t.Template) == 0 {
+		return fmt.Errorf("'source' or 'template' property is mandatory")
+	}
+	if len(t.Source) > 0 && len(t.Template) > 0 {
+		return fmt.Errorf("'source' and 'template' properties can't be used together")
+	}
+	if !path.IsAbs(t.Destination) {
+		return fmt.Errorf("'destination' property must be an absolute path")
+	}
+	if _, err := parseOverlayMode(t.Mode); err != nil {
+		return err
+	}
+
+	// Catch the syntax errors of inline templates early
+	if len(t.Template) > 0 {
+		if _, err := t.parse(t.Template); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (t *TemplateFileAction) parse(text string) (*template.Template, error) {
+	name := t.Source
+	if len(name) == 0 {
+		name = "template"
+	}
+	return template.New(name).
+		Funcs(template.FuncMap{"sector": sector}).
+		Option("missingkey=error").
+		Parse(text)
+}
+
+// Variables of the template, by increasing precedence
+func (t *TemplateFileAction) data(context *debos.DebosContext) map[string]string {
+	data := map[string]string{
+		"architecture": context.Architecture,
+		"kernel_root":  context.ImageKernelRoot,
+	}
+	for _, vars := range []map[string]string{t.templateVars, context.Variables, t.Variables} {
+		for k, v := range vars {
+			data[k] = v
+		}
+	}
+	return data
+}
+
+// Render the template with the variables of the build
+func (t *TemplateFileAction) render(context *debos.DebosContext) ([]byte, error) {
+	text := t.Template
+	if len(t.Source) > 0 {
+		if err := debos.CheckOrigin(context, t.Origin, t.Source); err != nil {
+			return nil, err
+		}
+		source, err := debos.RestrictedPath(context.Origins[t.Origin], t.Source)
+		if err != nil {
+			return nil, err
+		}
+		content, err := ioutil.ReadFile(source)
+		if err != nil {
+			return nil, err
+		}
+		text = string(content)
+	}
+
+	tmpl, err := t.parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, t.data(context)); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func (t *TemplateFileAction) Run(context *debos.DebosContext) error {
+	t.LogStart()
+
+	content, err := t.render(context)
+	if err != nil {
+		return err
+	}
+
+	destination, err := debos.RestrictedPath(context.Rootdir, t.Destination)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path.Dir(destination), 0755); err != nil {
+		return err
+	}
+
+	mode, err := parseOverlayMode(t.Mode)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(destination, content, mode); err != nil {
+		return err
+	}
+
+	// Regardless of the umask or of an existing file
+	return os.Chmod(destination, mode)
+}
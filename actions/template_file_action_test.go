@@ -0,0 +1,66 @@
+package actions
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/go-debos/debos"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTemplateFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+	context.Rootdir = path.Join(dir, "root")
+	context.RecipeDir = path.Join(dir, "recipe")
+	context.Origins = map[string]string{"recipe": context.RecipeDir}
+	context.Architecture = "arm64"
+	context.ImageKernelRoot = "root=UUID=1234"
+	context.Variables = map[string]string{"root_hash": "abcd", "suite": "trixie"}
+	assert.Empty(t, os.MkdirAll(context.Rootdir, 0755))
+	assert.Empty(t, os.MkdirAll(context.RecipeDir, 0755))
+
+	tmpl := "{{ .architecture }} {{ .kernel_root }} roothash={{ .root_hash }} {{ .suite }} {{ .image }}\n"
+	assert.Empty(t, ioutil.WriteFile(path.Join(context.RecipeDir, "cmdline.tmpl"), []byte(tmpl), 0644))
+
+	a := NewTemplateFileAction()
+	a.Source = "cmdline.tmpl"
+	a.Destination = "/boot/cmdline.txt"
+	a.Mode = "0600"
+	a.Variables = map[string]string{"suite": "sid"}
+	a.templateVars = map[string]string{"image": "debian.img", "suite": "bookworm"}
+	assert.Empty(t, a.Verify(&context))
+	assert.Empty(t, a.Run(&context))
+
+	content, err := ioutil.ReadFile(path.Join(context.Rootdir, "boot/cmdline.txt"))
+	assert.Empty(t, err)
+	assert.Equal(t, "arm64 root=UUID=1234 roothash=abcd sid debian.img\n", string(content))
+	info, err := os.Stat(path.Join(context.Rootdir, "boot/cmdline.txt"))
+	assert.Empty(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// Inline templates, undefined variables are errors
+	a = NewTemplateFileAction()
+	a.Template = "{{ .missing }}"
+	a.Destination = "/etc/kernel/cmdline"
+	assert.Empty(t, a.Verify(&context))
+	err = a.Run(&context)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "missing")
+
+	a.Template = "{{ .missing"
+	assert.Error(t, a.Verify(&context))
+
+	a.Source = "cmdline.tmpl"
+	a.Template = "text"
+	assert.EqualError(t, a.Verify(&context), "'source' and 'template' properties can't be used together")
+
+	a.Template = ""
+	a.Destination = "etc/kernel/cmdline"
+	assert.EqualError(t, a.Verify(&context), "'destination' property must be an absolute path")
+}
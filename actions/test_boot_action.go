@@ -0,0 +1,265 @@
+/*
+TestBoot Action
+
+Smoke test a disk image of the artifact directory by booting it in qemu: the
+build fails unless the marker, by default the login prompt, shows up on the
+serial console of the image before the timeout. Once the marker is seen, a
+command can be typed on the console and has to succeed too.
+
+The image is booted once the build is done, after the fake machine exits, so
+it has to come after the action creating the image in the recipe. The image
+isn't changed, the writes of the boot are discarded.
+
+Yaml syntax:
+ - action: test-boot
+   image: filename
+   machine: type
+   firmware: path
+   memory: size
+   marker: string
+   command: command
+   timeout: duration
+
+Mandatory properties:
+
+- image -- name of the image file, relative to the artifact directory.
+
+Optional properties:
+
+- machine -- qemu machine type, see 'qemu-system-<arch> -machine help'. By
+default 'q35' for 'amd64' and 'i386', 'virt' for 'arm64', 'armhf', 'armel' and
+'riscv64', 'pseries' for 'ppc64el' and 's390-ccw-virtio' for 's390x'.
+
+- firmware -- path of the firmware to boot the image with on the host, for
+example '/usr/share/ovmf/OVMF.fd' for EFI images. By default the one of qemu.
+
+- memory -- memory of the machine, in human-readable form. By default '1GB'.
+
+- marker -- text to wait for on the serial console. By default 'login:'.
+
+- command -- shell command to type on the console once the marker is seen,
+which then has to be a shell prompt, for example the one of a root autologin.
+The build fails if the command fails.
+
+- timeout -- maximum time to wait for the marker and the command to exit, for
+example '10m'. By default '5m'.
+
+The image has to log to its serial console, for example with
+'console=ttyS0' on the kernel command line of 'amd64' images or
+'console=ttyAMA0' for 'arm64' ones. The machine has no network. KVM is used
+when it's available and the image is of the architecture of the host,
+otherwise the image is booted with the slower software emulation.
+*/
+package actions
+
+import (
+	"bufio"
+	"bytes"
+	gocontext "context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"path"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/go-units"
+	"github.com/go-debos/debos"
+)
+
+// Printed on the console with the exit status of the command
+const testBootExitTag = "debos-test-boot-exit"
+
+var testBootExit = regexp.MustCompile(`^` + testBootExitTag + `=(\d+)`)
+
+// qemu binary and default machine type of the architectures
+var testBootMachines = map[string][2]string{
+	"amd64":   {"qemu-system-x86_64", "q35"},
+	"i386":    {"qemu-system-i386", "q35"},
+	"arm64":   {"qemu-system-aarch64", "virt"},
+	"armhf":   {"qemu-system-arm", "virt"},
+	"armel":   {"qemu-system-arm", "virt"},
+	"riscv64": {"qemu-system-riscv64", "virt"},
+	"ppc64el": {"qemu-system-ppc64", "pseries"},
+	"s390x":   {"qemu-system-s390x", "s390-ccw-virtio"},
+}
+
+type TestBootAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Image            string
+	Machine          string
+	Firmware         string
+	Memory           string
+	Marker           string
+	Command          string
+	memory           int64
+}
+
+func NewTestBootAction() *TestBootAction {
+	return &TestBootAction{Memory: "1GB", Marker: "login:"}
+}
+
+func (t *TestBootAction) Verify(context *debos.DebosContext) error {
+	if t.Image == "" {
+		return errors.New("'image' property can't be empty")
+	}
+	if strings.HasPrefix(path.Clean(t.Image), "..") || path.IsAbs(t.Image) {
+		return fmt.Errorf("Image %s must be relative to the artifact directory", t.Image)
+	}
+
+	memory, err := units.RAMInBytes(t.Memory)
+	if err != nil || memory < units.MiB {
+		return fmt.Errorf("Invalid memory size '%s'", t.Memory)
+	}
+	t.memory = memory
+
+	if t.Marker == "" {
+		return errors.New("'marker' property can't be empty")
+	}
+	if strings.ContainsAny(t.Command, "\r\n") {
+		return errors.New("'command' property must be a single line")
+	}
+	if t.Timeout == 0 {
+		t.Timeout = 5 * time.Minute
+	}
+	return nil
+}
+
+// The qemu command line booting the image
+func (t *TestBootAction) qemuCommand(architecture, image string, kvm bool) ([]string, error) {
+	machine, found := testBootMachines[architecture]
+	if !found {
+		return nil, fmt.Errorf("Booting %s images isn't supported", architecture)
+	}
+	if t.Machine != "" {
+		machine[1] = t.Machine
+	}
+
+	cmdline := []string{machine[0],
+		"-machine", machine[1],
+		"-m", strconv.FormatInt(t.memory/units.MiB, 10),
+		"-display", "none", "-monitor", "none", "-serial", "stdio",
+		"-no-reboot", "-nic", "none",
+		// Commas of the file name are doubled to be escaped
+		"-drive", fmt.Sprintf("file=%s,format=raw,if=virtio,snapshot=on", strings.Replace(image, ",", ",,", -1)),
+	}
+	if t.Firmware != "" {
+		cmdline = append(cmdline, "-bios", t.Firmware)
+	}
+
+	if kvm {
+		return append(cmdline, "-accel", "kvm", "-cpu", "host"), nil
+	}
+	accel, err := debos.QemuAccelArgs("off", nil)
+	if err != nil {
+		return nil, err
+	}
+	return append(cmdline, accel...), nil
+}
+
+/* Log the console until the marker shows up, then type the command if any
+ * and wait for its exit status */
+func (t *TestBootAction) watchConsole(console io.Reader, input io.Writer) error {
+	reader := bufio.NewReader(console)
+	var line []byte
+	marker := []byte(t.Marker)
+	seen := false
+
+	for {
+		c, err := reader.ReadByte()
+		if err == io.EOF {
+			if !seen {
+				return fmt.Errorf("Console closed before '%s' showed up", t.Marker)
+			}
+			return fmt.Errorf("Console closed before command '%s' exited", t.Command)
+		}
+		if err != nil {
+			return err
+		}
+
+		if c == '\n' {
+			text := strings.TrimRight(string(line), "\r")
+			log.Printf("console | %s", text)
+			line = line[:0]
+			if m := testBootExit.FindStringSubmatch(text); seen && m != nil {
+				if m[1] != "0" {
+					return fmt.Errorf("Command '%s' failed with exit status %s", t.Command, m[1])
+				}
+				return nil
+			}
+			continue
+		}
+		line = append(line, c)
+
+		// The prompts don't end with a new line
+		if !seen && bytes.Contains(line, marker) {
+			seen = true
+			log.Printf("console | %s", strings.TrimRight(string(line), "\r"))
+			line = line[:0]
+			if t.Command == "" {
+				return nil
+			}
+			_, err := fmt.Fprintf(input, "%s; echo %s=$?\n", t.Command, testBootExitTag)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (t *TestBootAction) PostMachine(context *debos.DebosContext) error {
+	t.LogStart()
+	image := path.Join(context.Artifactdir, t.Image)
+
+	platform := ociPlatforms[context.Architecture]
+	kvm := platform[0] == runtime.GOARCH && debos.CheckKVM() == nil
+	cmdline, err := t.qemuCommand(context.Architecture, image, kvm)
+	if err != nil {
+		return err
+	}
+
+	parent := context.Ctx
+	if parent == nil {
+		parent = gocontext.Background()
+	}
+	ctx, cancel := gocontext.WithTimeout(parent, t.Timeout)
+	defer cancel()
+
+	qemu := exec.CommandContext(ctx, cmdline[0], cmdline[1:]...)
+	var stderr bytes.Buffer
+	qemu.Stderr = &stderr
+	input, err := qemu.StdinPipe()
+	if err != nil {
+		return err
+	}
+	console, err := qemu.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := qemu.Start(); err != nil {
+		return fmt.Errorf("Failed to run %s: %v", cmdline[0], err)
+	}
+
+	err = t.watchConsole(console, input)
+	// Done with the machine either way
+	cancel()
+	qemu.Wait()
+
+	if err != nil {
+		if ctx.Err() == gocontext.DeadlineExceeded {
+			return fmt.Errorf("Timed out after %s: %v", t.Timeout, err)
+		}
+		if stderr.Len() > 0 {
+			return fmt.Errorf("%v\n%s", err, stderr.String())
+		}
+		return err
+	}
+
+	log.Printf("%s booted", t.Image)
+	return nil
+}
@@ -0,0 +1,74 @@
+package actions
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-debos/debos"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTestBootVerify(t *testing.T) {
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+
+	tb := NewTestBootAction()
+	assert.EqualError(t, tb.Verify(&context), "'image' property can't be empty")
+	tb.Image = "disk.img"
+	tb.Memory = "lots"
+	assert.EqualError(t, tb.Verify(&context), "Invalid memory size 'lots'")
+	tb.Memory = "2GB"
+	tb.Command = "systemctl is-system-running\ntrue"
+	assert.EqualError(t, tb.Verify(&context), "'command' property must be a single line")
+	tb.Command = "systemctl is-system-running --wait"
+	assert.Empty(t, tb.Verify(&context))
+	assert.Equal(t, 5*time.Minute, tb.Timeout)
+}
+
+func TestTestBootQemuCommand(t *testing.T) {
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+	tb := NewTestBootAction()
+	tb.Image = "disk.img"
+	assert.Empty(t, tb.Verify(&context))
+
+	cmdline, err := tb.qemuCommand("arm64", "/artifacts/a,b.img", false)
+	assert.Empty(t, err)
+	assert.Equal(t, "qemu-system-aarch64 -machine virt -m 1024 -display none -monitor none -serial stdio "+
+		"-no-reboot -nic none -drive file=/artifacts/a,,b.img,format=raw,if=virtio,snapshot=on "+
+		"-accel tcg -cpu max", strings.Join(cmdline, " "))
+
+	tb.Machine = "pc"
+	tb.Firmware = "/usr/share/ovmf/OVMF.fd"
+	cmdline, err = tb.qemuCommand("amd64", "disk.img", true)
+	assert.Empty(t, err)
+	assert.Equal(t, "qemu-system-x86_64 -machine pc -m 1024 -display none -monitor none -serial stdio "+
+		"-no-reboot -nic none -drive file=disk.img,format=raw,if=virtio,snapshot=on "+
+		"-bios /usr/share/ovmf/OVMF.fd -accel kvm -cpu host", strings.Join(cmdline, " "))
+
+	_, err = tb.qemuCommand("sparc", "disk.img", false)
+	assert.EqualError(t, err, "Booting sparc images isn't supported")
+}
+
+func TestTestBootWatchConsole(t *testing.T) {
+	tb := NewTestBootAction()
+	var input bytes.Buffer
+
+	assert.Empty(t, tb.watchConsole(strings.NewReader("Booting\r\n\r\ndebian login: "), &input))
+	assert.Equal(t, "", input.String())
+	assert.EqualError(t, tb.watchConsole(strings.NewReader("Booting\r\nKernel panic\r\n"), &input),
+		"Console closed before 'login:' showed up")
+
+	tb.Marker = "root@debian:~#"
+	tb.Command = "systemctl is-system-running"
+	console := "root@debian:~# systemctl is-system-running; echo debos-test-boot-exit=$?\r\n" +
+		"running\r\ndebos-test-boot-exit=0\r\n"
+	assert.Empty(t, tb.watchConsole(strings.NewReader(console), &input))
+	assert.Equal(t, "systemctl is-system-running; echo debos-test-boot-exit=$?\n", input.String())
+
+	console = strings.Replace(console, "running\r\ndebos-test-boot-exit=0", "degraded\r\ndebos-test-boot-exit=1", 1)
+	assert.EqualError(t, tb.watchConsole(strings.NewReader(console), &input),
+		"Command 'systemctl is-system-running' failed with exit status 1")
+	assert.EqualError(t, tb.watchConsole(strings.NewReader("root@debian:~# "), &input),
+		"Console closed before command 'systemctl is-system-running' exited")
+}
@@ -11,6 +11,7 @@ Yaml syntax:
    origin: name
    file: file.ext
    compression: gz
+   no-xattrs: bool
 
 Mandatory properties:
 
@@ -27,8 +28,18 @@ The default value is 'artifacts' directory in case if this property is omitted.
 
 - compression -- optional hint for unpack allowing to use proper compression method.
 
-Currently only 'gz', bzip2' and 'xz' compression types are supported.
+Currently only 'gz', bzip2', 'xz' and 'zstd' compression types are supported.
 If not provided an attempt to autodetect the compression type will be done.
+
+Large tarballs are decompressed with several threads when a parallel
+decompressor is installed on the host: 'pigz' for 'gz', 'lbzip2' or 'pbzip2'
+for 'bzip2', 'pixz' or 'xz' itself for 'xz' and 'pzstd' for 'zstd'. The 'xz'
+and 'zstd' ones only use several threads for the files compressed with them or
+with threads. Otherwise 'tar' decompresses the tarball with a single thread.
+
+- no-xattrs -- boolean to not extract the extended attributes of the entries
+of a tar archive. By default is 'false': they are extracted, like the file
+capabilities of 'security.capability'.
 */
 package actions
 
@@ -42,6 +53,7 @@ type UnpackAction struct {
 	Compression      string
 	Origin           string
 	File             string
+	NoXattrs         bool `yaml:"no-xattrs"`
 }
 
 func (pf *UnpackAction) Verify(context *debos.DebosContext) error {
@@ -66,6 +78,13 @@ func (pf *UnpackAction) Verify(context *debos.DebosContext) error {
 	return nil
 }
 
+func (pf *UnpackAction) DryRun(context *debos.DebosContext) error {
+	if len(pf.Origin) > 0 {
+		return debos.CheckOrigin(context, pf.Origin, pf.File)
+	}
+	return nil
+}
+
 func (pf *UnpackAction) Run(context *debos.DebosContext) error {
 	pf.LogStart()
 	var origin string
@@ -96,5 +115,12 @@ func (pf *UnpackAction) Run(context *debos.DebosContext) error {
 		}
 	}
 
+	if pf.NoXattrs && archive.Type() == debos.Tar {
+		if err := archive.AddOption("xattrs", false); err != nil {
+			return err
+		}
+	}
+
+	archive.SetContext(context)
 	return archive.Unpack(context.Rootdir)
 }
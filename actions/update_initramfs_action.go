@@ -0,0 +1,170 @@
+/*
+UpdateInitramfs Action
+
+Regenerate the initramfs of the kernels installed in the target rootfs with
+'update-initramfs' of initramfs-tools, for example once the modules or the
+hooks needed to mount the root file system are configured.
+
+Yaml syntax:
+ - action: update-initramfs
+   kernel: version
+   modules:
+     - dm-verity
+   hooks:
+     - path
+
+Optional properties:
+
+- kernel -- version of the kernel to generate the initramfs of, as found in
+'/lib/modules' of the target rootfs. By default 'all' the installed kernels.
+
+- modules -- list of kernel modules to include in the initramfs, added to
+'/etc/initramfs-tools/modules' of the target rootfs unless already listed.
+
+- hooks -- list of initramfs-tools hook scripts to install in
+'/etc/initramfs-tools/hooks' of the target rootfs, relative to the recipe
+directory.
+
+The action fails if no kernel, or not the requested one, is installed in the
+target rootfs, or if 'update-initramfs' isn't installed.
+*/
+package actions
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/go-debos/debos"
+)
+
+const initramfsToolsDir = "/etc/initramfs-tools"
+
+type UpdateInitramfsAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Kernel           string
+	Modules          []string
+	Hooks            []string
+}
+
+func NewUpdateInitramfsAction() *UpdateInitramfsAction {
+	return &UpdateInitramfsAction{Kernel: "all"}
+}
+
+func (u *UpdateInitramfsAction) Verify(context *debos.DebosContext) error {
+	if u.Kernel == "" || strings.ContainsAny(u.Kernel, "/ \t") {
+		return fmt.Errorf("Invalid kernel version '%s'", u.Kernel)
+	}
+	for _, m := range u.Modules {
+		if m == "" || strings.ContainsAny(m, "/ \t\n") {
+			return fmt.Errorf("Invalid module name '%s'", m)
+		}
+	}
+	for _, h := range u.Hooks {
+		if h == "" {
+			return errors.New("'hooks' property can't have empty paths")
+		}
+	}
+
+	return nil
+}
+
+// Check the kernels to generate the initramfs of are installed
+func installedKernels(rootdir, kernel string) error {
+	entries, err := ioutil.ReadDir(path.Join(rootdir, "lib/modules"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	var found []string
+	for _, e := range entries {
+		if e.IsDir() {
+			found = append(found, e.Name())
+		}
+	}
+
+	if len(found) == 0 {
+		return errors.New("No kernel installed in the target rootfs")
+	}
+	if kernel == "all" {
+		return nil
+	}
+	for _, f := range found {
+		if f == kernel {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("Kernel '%s' isn't installed in the target rootfs, found: %s",
+		kernel, strings.Join(found, ", "))
+}
+
+// Add the modules missing from the modules file of initramfs-tools
+func addInitramfsModules(file string, modules []string) error {
+	content, err := ioutil.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	listed := map[string]bool{}
+	for _, l := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(l)
+		if len(fields) > 0 && !strings.HasPrefix(fields[0], "#") {
+			listed[fields[0]] = true
+		}
+	}
+
+	text := string(content)
+	if len(text) > 0 && !strings.HasSuffix(text, "\n") {
+		text += "\n"
+	}
+	for _, m := range modules {
+		if !listed[m] {
+			text += m + "\n"
+			listed[m] = true
+		}
+	}
+
+	if err := os.MkdirAll(path.Dir(file), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, []byte(text), 0644)
+}
+
+func (u *UpdateInitramfsAction) Run(context *debos.DebosContext) error {
+	u.LogStart()
+
+	if _, err := os.Stat(path.Join(context.Rootdir, "usr/sbin/update-initramfs")); err != nil {
+		return errors.New("update-initramfs isn't installed in the target rootfs, install initramfs-tools")
+	}
+	if err := installedKernels(context.Rootdir, u.Kernel); err != nil {
+		return err
+	}
+
+	if len(u.Modules) > 0 {
+		modules := path.Join(context.Rootdir, initramfsToolsDir, "modules")
+		if err := addInitramfsModules(modules, u.Modules); err != nil {
+			return err
+		}
+	}
+
+	for _, h := range u.Hooks {
+		source, err := debos.RestrictedPath(context.RecipeDir, h)
+		if err != nil {
+			return err
+		}
+		hooks := path.Join(context.Rootdir, initramfsToolsDir, "hooks")
+		if err := os.MkdirAll(hooks, 0755); err != nil {
+			return err
+		}
+		if err := debos.CopyFile(source, path.Join(hooks, path.Base(h)), 0755); err != nil {
+			return err
+		}
+	}
+
+	c := debos.NewChrootCommandForContext(*context)
+	return c.Run("update-initramfs", "update-initramfs", "-u", "-k", u.Kernel)
+}
@@ -0,0 +1,54 @@
+package actions
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/go-debos/debos"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpdateInitramfsVerify(t *testing.T) {
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+
+	u := NewUpdateInitramfsAction()
+	assert.Empty(t, u.Verify(&context))
+
+	u.Kernel = "../6.1.0"
+	assert.EqualError(t, u.Verify(&context), "Invalid kernel version '../6.1.0'")
+
+	u.Kernel = "6.1.0-18-amd64"
+	u.Modules = []string{"dm-verity", "dm crypt"}
+	assert.EqualError(t, u.Verify(&context), "Invalid module name 'dm crypt'")
+}
+
+func TestInstalledKernels(t *testing.T) {
+	rootdir, err := ioutil.TempDir("", "initramfs")
+	assert.Empty(t, err)
+	defer os.RemoveAll(rootdir)
+
+	assert.EqualError(t, installedKernels(rootdir, "all"), "No kernel installed in the target rootfs")
+
+	assert.Empty(t, os.MkdirAll(path.Join(rootdir, "lib/modules/6.1.0-18-amd64"), 0755))
+	assert.Empty(t, installedKernels(rootdir, "all"))
+	assert.Empty(t, installedKernels(rootdir, "6.1.0-18-amd64"))
+	assert.EqualError(t, installedKernels(rootdir, "6.1.0-17-amd64"),
+		"Kernel '6.1.0-17-amd64' isn't installed in the target rootfs, found: 6.1.0-18-amd64")
+}
+
+func TestAddInitramfsModules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "initramfs")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	file := path.Join(dir, "etc/initramfs-tools/modules")
+	assert.Empty(t, addInitramfsModules(file, []string{"dm-verity"}))
+	assert.Empty(t, ioutil.WriteFile(file, []byte("# comment\ndm-verity"), 0644))
+	assert.Empty(t, addInitramfsModules(file, []string{"dm-verity", "dm-crypt", "dm-crypt"}))
+
+	content, err := ioutil.ReadFile(file)
+	assert.Empty(t, err)
+	assert.Equal(t, "# comment\ndm-verity\ndm-crypt\n", string(content))
+}
@@ -0,0 +1,200 @@
+/*
+UsrMerge Action
+
+Convert the target rootfs to the merged /usr layout, where '/bin', '/sbin' and
+'/lib*' are symlinks into '/usr'. Layouts that keep the whole OS in '/usr',
+such as OSTree based or otherwise immutable systems, rely on it.
+
+Files found in the top-level directories are moved to their counterpart in
+'/usr'. When a file exists in both places it is kept only in '/usr' if both
+copies are identical or one is a symlink to the other; otherwise it can't be
+relocated and is reported. A top-level directory is only replaced by a symlink
+once all of its content has been relocated.
+
+Trees which are already merged are left untouched.
+
+Yaml syntax:
+ - action: usr-merge
+   ignore-conflicts: false
+
+Optional properties:
+
+- ignore-conflicts -- don't fail if some files couldn't be relocated. They are
+still reported, and the directories holding them are not converted. By
+default is 'false'.
+*/
+package actions
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/go-debos/debos"
+)
+
+var usrMergeDirs = []string{"bin", "sbin", "lib", "lib32", "lib64", "libx32"}
+
+type UsrMergeAction struct {
+	debos.BaseAction `yaml:",inline"`
+	IgnoreConflicts  bool `yaml:"ignore-conflicts"`
+}
+
+// Check whether the files are the same, so one of them can be dropped
+func sameFile(a, b string) bool {
+	ia, err := os.Lstat(a)
+	if err != nil {
+		return false
+	}
+	ib, err := os.Lstat(b)
+	if err != nil {
+		return false
+	}
+
+	if ia.Mode() != ib.Mode() {
+		return false
+	}
+
+	switch {
+	case ia.Mode()&os.ModeSymlink != 0:
+		la, _ := os.Readlink(a)
+		lb, _ := os.Readlink(b)
+		return la == lb
+	case ia.Mode().IsRegular():
+		if ia.Size() != ib.Size() {
+			return false
+		}
+		ca, err := ioutil.ReadFile(a)
+		if err != nil {
+			return false
+		}
+		cb, err := ioutil.ReadFile(b)
+		if err != nil {
+			return false
+		}
+		return bytes.Equal(ca, cb)
+	}
+
+	return false
+}
+
+// Check whether link is a symlink resolving to target inside the rootfs
+func linksTo(rootdir, link, target string) bool {
+	dest, err := os.Readlink(path.Join(rootdir, link))
+	if err != nil {
+		return false
+	}
+	if !path.IsAbs(dest) {
+		dest = path.Join(path.Dir(link), dest)
+	}
+
+	return path.Clean(dest) == target
+}
+
+/* Move the content of the rootfs directory src into dst, returning the
+ * rootfs paths which couldn't be moved */
+func usrMergeDir(rootdir, src, dst string) ([]string, error) {
+	var conflicts []string
+
+	entries, err := ioutil.ReadDir(path.Join(rootdir, src))
+	if err != nil {
+		return nil, err
+	}
+
+	if err = os.MkdirAll(path.Join(rootdir, dst), 0755); err != nil {
+		return nil, err
+	}
+
+	for _, e := range entries {
+		s := path.Join(src, e.Name())
+		d := path.Join(dst, e.Name())
+		target, err := os.Lstat(path.Join(rootdir, d))
+
+		switch {
+		case os.IsNotExist(err):
+			err = os.Rename(path.Join(rootdir, s), path.Join(rootdir, d))
+		case err != nil:
+		case e.IsDir() && target.IsDir():
+			var c []string
+			c, err = usrMergeDir(rootdir, s, d)
+			conflicts = append(conflicts, c...)
+			if err == nil && len(c) == 0 {
+				err = os.Remove(path.Join(rootdir, s))
+			}
+		case sameFile(path.Join(rootdir, s), path.Join(rootdir, d)) || linksTo(rootdir, s, d):
+			err = os.RemoveAll(path.Join(rootdir, s))
+		case linksTo(rootdir, d, s):
+			if err = os.Remove(path.Join(rootdir, d)); err == nil {
+				err = os.Rename(path.Join(rootdir, s), path.Join(rootdir, d))
+			}
+		default:
+			conflicts = append(conflicts, s)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return conflicts, nil
+}
+
+func (um *UsrMergeAction) Run(context *debos.DebosContext) error {
+	um.LogStart()
+	var conflicts []string
+
+	for _, dir := range usrMergeDirs {
+		top := path.Join("/", dir)
+		usr := path.Join("/usr", dir)
+
+		info, err := os.Lstat(path.Join(context.Rootdir, top))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			if !linksTo(context.Rootdir, top, usr) {
+				conflicts = append(conflicts, top)
+			}
+			continue
+		}
+		if !info.IsDir() {
+			conflicts = append(conflicts, top)
+			continue
+		}
+
+		c, err := usrMergeDir(context.Rootdir, top, usr)
+		if err != nil {
+			return fmt.Errorf("Failed to merge %s into %s: %v", top, usr, err)
+		}
+		if len(c) > 0 {
+			conflicts = append(conflicts, c...)
+			continue
+		}
+
+		if err = os.Remove(path.Join(context.Rootdir, top)); err != nil {
+			return err
+		}
+		if err = os.Symlink(path.Join("usr", dir), path.Join(context.Rootdir, top)); err != nil {
+			return err
+		}
+		log.Printf("Merged %s into %s\n", top, usr)
+	}
+
+	if len(conflicts) == 0 {
+		return nil
+	}
+
+	log.Printf("Couldn't relocate into /usr:\n  %s\n", strings.Join(conflicts, "\n  "))
+	if um.IgnoreConflicts {
+		return nil
+	}
+
+	return fmt.Errorf("Couldn't relocate into /usr: %s", strings.Join(conflicts, ", "))
+}
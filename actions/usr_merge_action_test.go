@@ -0,0 +1,81 @@
+package actions_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/go-debos/debos"
+	"github.com/go-debos/debos/actions"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeRootfsFile(t *testing.T, rootdir, file, content string) {
+	assert.Empty(t, os.MkdirAll(path.Join(rootdir, path.Dir(file)), 0755))
+	assert.Empty(t, ioutil.WriteFile(path.Join(rootdir, file), []byte(content), 0755))
+}
+
+func TestUsrMerge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+	context.Rootdir = dir
+
+	writeRootfsFile(t, dir, "bin/sh", "shell")
+	writeRootfsFile(t, dir, "usr/bin/ls", "ls")
+	writeRootfsFile(t, dir, "sbin/init", "init")
+	writeRootfsFile(t, dir, "usr/sbin/init", "init")
+	writeRootfsFile(t, dir, "lib/modules/5.10/modules.dep", "deps")
+	writeRootfsFile(t, dir, "usr/lib/modules/5.10/extra.ko", "module")
+	writeRootfsFile(t, dir, "lib/systemd/systemd", "systemd")
+	assert.Empty(t, os.MkdirAll(path.Join(dir, "usr/lib/systemd"), 0755))
+	assert.Empty(t, os.Symlink("/lib/systemd/systemd", path.Join(dir, "usr/lib/systemd/systemd")))
+	assert.Empty(t, os.Symlink("usr/lib64", path.Join(dir, "lib64")))
+
+	um := actions.UsrMergeAction{}
+	assert.Empty(t, um.Run(&context))
+
+	for _, d := range []string{"bin", "sbin", "lib", "lib64"} {
+		link, err := os.Readlink(path.Join(dir, d))
+		assert.Empty(t, err)
+		assert.Equal(t, "usr/"+d, link)
+	}
+
+	for file, content := range map[string]string{
+		"usr/bin/sh":                       "shell",
+		"usr/bin/ls":                       "ls",
+		"usr/sbin/init":                    "init",
+		"usr/lib/modules/5.10/modules.dep": "deps",
+		"usr/lib/modules/5.10/extra.ko":    "module",
+		"usr/lib/systemd/systemd":          "systemd",
+		"bin/sh":                           "shell",
+	} {
+		c, err := ioutil.ReadFile(path.Join(dir, file))
+		assert.Empty(t, err, file)
+		assert.Equal(t, content, string(c), file)
+	}
+	info, err := os.Lstat(path.Join(dir, "usr/lib/systemd/systemd"))
+	assert.Empty(t, err)
+	assert.True(t, info.Mode().IsRegular())
+
+	// Merging a merged tree is a no-op
+	assert.Empty(t, um.Run(&context))
+
+	// Conflicting files are reported and their directory is left alone
+	assert.Empty(t, os.Remove(path.Join(dir, "sbin")))
+	writeRootfsFile(t, dir, "sbin/init", "other init")
+	writeRootfsFile(t, dir, "sbin/fsck", "fsck")
+	assert.EqualError(t, um.Run(&context), "Couldn't relocate into /usr: /sbin/init")
+
+	info, err = os.Lstat(path.Join(dir, "sbin"))
+	assert.Empty(t, err)
+	assert.True(t, info.IsDir())
+	_, err = os.Stat(path.Join(dir, "usr/sbin/fsck"))
+	assert.Empty(t, err)
+
+	um.IgnoreConflicts = true
+	assert.Empty(t, um.Run(&context))
+}
@@ -0,0 +1,199 @@
+/*
+VerifyImage Action
+
+Check the image created by an 'image-partition' action against the partitions
+of the recipe, to catch the layout changes which didn't take effect: the
+partition table of the image is read again with 'sfdisk', each partition has
+to be at the offset and of the size it was created with and to have its name
+of the recipe in a GPT partition table, and the type of its file system as
+detected by 'blkid' has to be the one of the recipe. Each file system then has
+to mount and to be clean for its checker, run with 'fsck -n' or the like.
+
+Yaml syntax:
+ - action: verify-image
+
+The action fails at the first mismatch. It is meant to run once the content
+of the image is written, usually as the last action of the recipe.
+
+The mounted file systems are remounted read-only while they are checked. The
+file systems are checked with 'e2fsck' for 'ext2', 'ext3' and 'ext4',
+'fsck.vfat' for 'vfat', 'btrfs check' for 'btrfs' and 'xfs_repair' for 'xfs';
+the other ones are only mounted. The 'erofs' partitions, which are built once
+the recipe is done, and the ones without file system aren't checked.
+*/
+package actions
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+
+	"github.com/go-debos/debos"
+)
+
+// Checkers of the file systems, run without modifying them
+var fsCheckers = map[string][]string{
+	"ext2":  {"e2fsck", "-n", "-f"},
+	"ext3":  {"e2fsck", "-n", "-f"},
+	"ext4":  {"e2fsck", "-n", "-f"},
+	"vfat":  {"fsck.vfat", "-n"},
+	"btrfs": {"btrfs", "check", "--readonly", "--force"},
+	"xfs":   {"xfs_repair", "-n"},
+}
+
+type VerifyImageAction struct {
+	debos.BaseAction `yaml:",inline"`
+}
+
+// Mount points of the device, and whether they are mounted read-write, from
+// the content of /proc/self/mountinfo
+func deviceMountpoints(mountinfo, device string) map[string]bool {
+	mountpoints := map[string]bool{}
+	for _, line := range strings.Split(mountinfo, "\n") {
+		parts := strings.SplitN(line, " - ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		fields := strings.Fields(parts[0])
+		fs := strings.Fields(parts[1])
+		if len(fields) < 6 || len(fs) < 2 || fs[1] != device {
+			continue
+		}
+		rw := false
+		for _, o := range strings.Split(fields[5], ",") {
+			rw = rw || o == "rw"
+		}
+		mountpoints[fields[4]] = rw
+	}
+	return mountpoints
+}
+
+// Check the partitions of the image against the partition table
+func checkPartitionTable(layout *partitionLayout, partitions []debos.Partition) error {
+	sectorSize := layout.sectorSize
+	if sectorSize == 0 {
+		sectorSize = 512
+	}
+
+	for _, p := range partitions {
+		var found *layoutPartition
+		for idx := range layout.partitions {
+			if layout.partitions[idx].number == p.Number {
+				found = &layout.partitions[idx]
+			}
+		}
+		if found == nil {
+			return fmt.Errorf("Partition %s: no partition %d in the image", p.Name, p.Number)
+		}
+		if start := found.start * sectorSize; start != p.Offset {
+			return fmt.Errorf("Partition %s: starts at %d bytes instead of %d", p.Name, start, p.Offset)
+		}
+		if size := found.size * sectorSize; size != p.Size {
+			return fmt.Errorf("Partition %s: %d bytes instead of %d", p.Name, size, p.Size)
+		}
+		if layout.label == "gpt" && found.name != p.Label {
+			return fmt.Errorf("Partition %s: named '%s' instead of '%s'", p.Name, found.name, p.Label)
+		}
+	}
+
+	return nil
+}
+
+func (v *VerifyImageAction) checkFileSystem(context *debos.DebosContext, p debos.Partition) error {
+	device, err := debos.RealPath(p.DevicePath)
+	if err != nil {
+		return err
+	}
+
+	fsType, err := exec.Command("blkid", "-o", "value", "-s", "TYPE", "-p", "-c", "none", device).Output()
+	if err != nil {
+		return fmt.Errorf("Partition %s: no file system found", p.Name)
+	}
+	if t := strings.TrimSpace(string(fsType)); t != p.FS {
+		return fmt.Errorf("Partition %s: %s file system instead of %s", p.Name, t, p.FS)
+	}
+	if p.FS == "swap" {
+		return nil
+	}
+
+	mountinfo, err := ioutil.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return err
+	}
+	mountpoints := deviceMountpoints(string(mountinfo), device)
+
+	if len(mountpoints) == 0 {
+		// Check it mounts
+		dir, err := ioutil.TempDir(debos.ScratchDir(context), "verify-")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(dir)
+		if err := syscall.Mount(device, dir, p.FS, syscall.MS_RDONLY, ""); err != nil {
+			return fmt.Errorf("Partition %s: failed to mount: %v", p.Name, err)
+		}
+		if err := syscall.Unmount(dir, 0); err != nil {
+			return err
+		}
+	}
+
+	checker, found := fsCheckers[p.FS]
+	if !found {
+		log.Printf("Partition %s: no checker for %s, only mounted", p.Name, p.FS)
+		return nil
+	}
+
+	for m, rw := range mountpoints {
+		if !rw {
+			continue
+		}
+		if err := syscall.Mount("", m, "", syscall.MS_REMOUNT|syscall.MS_RDONLY, ""); err != nil {
+			return fmt.Errorf("Partition %s: failed to remount %s read-only: %v", p.Name, m, err)
+		}
+		defer syscall.Mount("", m, "", syscall.MS_REMOUNT, "")
+	}
+
+	cmd := debos.NewCommandForContext(*context)
+	if err := cmd.Run("fsck", append(checker, device)...); err != nil {
+		return fmt.Errorf("Partition %s: file system isn't clean: %v", p.Name, err)
+	}
+
+	return nil
+}
+
+func (v *VerifyImageAction) Run(context *debos.DebosContext) error {
+	v.LogStart()
+
+	if context.Image == "" || len(context.ImagePartitions) == 0 {
+		return errors.New("No image to verify, run an 'image-partition' action first")
+	}
+
+	dump, err := exec.Command("sfdisk", "--dump", context.Image).Output()
+	if err != nil {
+		return fmt.Errorf("Failed to read the partition table: %v", err)
+	}
+	layout, err := parseSfdiskDump(string(dump))
+	if err != nil {
+		return fmt.Errorf("Failed to parse the partition table: %v", err)
+	}
+	if err := checkPartitionTable(layout, context.ImagePartitions); err != nil {
+		return err
+	}
+
+	for _, p := range context.ImagePartitions {
+		if p.FS == "none" || p.FS == "erofs" {
+			continue
+		}
+		if err := v.checkFileSystem(context, p); err != nil {
+			return err
+		}
+		log.Printf("Partition %s verified", p.Name)
+	}
+
+	return nil
+}
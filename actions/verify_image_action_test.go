@@ -0,0 +1,53 @@
+package actions
+
+import (
+	"testing"
+
+	"github.com/go-debos/debos"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeviceMountpoints(t *testing.T) {
+	mountinfo := `22 1 254:0 / / rw,relatime shared:1 - ext4 /dev/vda1 rw
+23 22 254:1 / /scratch/mnt rw,relatime shared:2 - ext4 /dev/vdb1 rw
+24 23 254:2 / /scratch/mnt/boot ro,relatime shared:3 - vfat /dev/vdb2 ro
+25 22 0:5 / /proc rw,nosuid - proc proc rw`
+
+	assert.Equal(t, map[string]bool{"/scratch/mnt": true}, deviceMountpoints(mountinfo, "/dev/vdb1"))
+	assert.Equal(t, map[string]bool{"/scratch/mnt/boot": false}, deviceMountpoints(mountinfo, "/dev/vdb2"))
+	assert.Empty(t, deviceMountpoints(mountinfo, "/dev/vdb3"))
+}
+
+func TestCheckPartitionTable(t *testing.T) {
+	layout, err := parseSfdiskDump(`label: gpt
+label-id: 5C3B1D7E-4B5A-4B8F-9A4F-2E7D4C1A0B9E
+device: /dev/vdb
+unit: sectors
+sector-size: 512
+
+/dev/vdb1 : start=2048, size=524288, type=C12A7328-F81F-11D2-BA4B-00A0C93EC93B, name="efi"
+/dev/vdb2 : start=526336, size=3667935, type=0FC63DAF-8483-4772-8E79-3D69D8477DE4, name="root"
+`)
+	assert.Empty(t, err)
+
+	partitions := []debos.Partition{
+		{Name: "efi", Number: 1, Offset: 2048 * 512, Size: 524288 * 512, Label: "efi"},
+		{Name: "root", Number: 2, Offset: 526336 * 512, Size: 3667935 * 512, Label: "root"},
+	}
+	assert.Empty(t, checkPartitionTable(layout, partitions))
+
+	partitions[1].Label = "rootfs"
+	assert.EqualError(t, checkPartitionTable(layout, partitions), "Partition root: named 'root' instead of 'rootfs'")
+
+	partitions[1].Label = "root"
+	partitions[1].Size = 4096 * 512
+	assert.EqualError(t, checkPartitionTable(layout, partitions),
+		"Partition root: 1877982720 bytes instead of 2097152")
+
+	partitions[1].Offset = 0
+	assert.EqualError(t, checkPartitionTable(layout, partitions),
+		"Partition root: starts at 269484032 bytes instead of 0")
+
+	partitions = append(partitions, debos.Partition{Name: "data", Number: 3})
+	assert.EqualError(t, checkPartitionTable(layout, partitions[2:]), "Partition data: no partition 3 in the image")
+}
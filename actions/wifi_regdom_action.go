@@ -0,0 +1,114 @@
+/*
+WifiRegdom Action
+
+Set the wireless regulatory domain the target system boots with, required for
+the wireless devices to use the channels and transmit powers allowed in the
+country they are operated in. 'wireless-regdb' is installed in the target
+rootfs, providing the regulatory database the kernel loads the domain from.
+
+Yaml syntax:
+ - action: wifi-regdom
+   country: FR
+   method: cmdline
+
+Mandatory properties:
+
+- country -- ISO 3166-1 alpha-2 code of the country, for example 'FR' or
+'US', or '00' for the world domain, which only allows the channels usable
+everywhere.
+
+Optional properties:
+
+- method -- how the domain is set: 'cmdline' adds
+'cfg80211.ieee80211_regdom' to '/etc/kernel/cmdline' in the target rootfs,
+which is extended by the 'filesystem-deploy' action, and 'modprobe' sets the
+option of the 'cfg80211' module in
+'/etc/modprobe.d/debos-wifi-regdom.conf', for systems whose bootloader isn't
+configured from '/etc/kernel/cmdline'. By default is 'cmdline'. The domain set
+by the other method is removed.
+*/
+package actions
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/go-debos/debos"
+)
+
+const (
+	wifiRegdomArg      = "cfg80211.ieee80211_regdom"
+	wifiRegdomModprobe = "/etc/modprobe.d/debos-wifi-regdom.conf"
+)
+
+var wifiCountry = regexp.MustCompile(`^([A-Z]{2}|00)$`)
+
+type WifiRegdomAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Country          string
+	Method           string
+}
+
+func NewWifiRegdomAction() *WifiRegdomAction {
+	return &WifiRegdomAction{Method: "cmdline"}
+}
+
+func (w *WifiRegdomAction) Verify(context *debos.DebosContext) error {
+	if len(w.Country) == 0 {
+		return fmt.Errorf("'country' property can't be empty")
+	}
+	if !wifiCountry.MatchString(w.Country) {
+		return fmt.Errorf("Invalid country '%s', expected an ISO 3166-1 alpha-2 code like '%s' or '00'",
+			w.Country, strings.ToUpper(w.Country))
+	}
+	if w.Method != "cmdline" && w.Method != "modprobe" {
+		return fmt.Errorf("Invalid method '%s', expected cmdline or modprobe", w.Method)
+	}
+	return nil
+}
+
+func (w *WifiRegdomAction) configure(context *debos.DebosContext) error {
+	var args []string
+	if w.Method == "cmdline" {
+		args = append(args, fmt.Sprintf("%s=%s", wifiRegdomArg, w.Country))
+	}
+	// kernel-install falls back to /proc/cmdline without it, don't create it
+	_, err := os.Stat(path.Join(context.Rootdir, "etc/kernel/cmdline"))
+	if len(args) > 0 || err == nil {
+		if err := setKernelCmdlineArgs(context.Rootdir, []string{wifiRegdomArg}, args); err != nil {
+			return err
+		}
+	}
+
+	conf := path.Join(context.Rootdir, wifiRegdomModprobe)
+	if w.Method == "cmdline" {
+		if err := os.Remove(conf); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	if err := os.MkdirAll(path.Dir(conf), 0755); err != nil {
+		return err
+	}
+	options := fmt.Sprintf("# Generated by debos\noptions cfg80211 ieee80211_regdom=%s\n", w.Country)
+	if err := ioutil.WriteFile(conf, []byte(options), 0644); err != nil {
+		return fmt.Errorf("Couldn't write %s: %v", wifiRegdomModprobe, err)
+	}
+
+	return nil
+}
+
+func (w *WifiRegdomAction) Run(context *debos.DebosContext) error {
+	w.LogStart()
+
+	if err := installPackages(context, "wireless-regdb"); err != nil {
+		return err
+	}
+
+	return w.configure(context)
+}
@@ -0,0 +1,64 @@
+package actions
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/go-debos/debos"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWifiRegdom(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+	context.Rootdir = dir
+
+	assert.Empty(t, os.MkdirAll(path.Join(dir, "etc/kernel"), 0755))
+	cmdline := path.Join(dir, "etc/kernel/cmdline")
+	assert.Empty(t, ioutil.WriteFile(cmdline, []byte("quiet cfg80211.ieee80211_regdom=US\n"), 0644))
+
+	w := NewWifiRegdomAction()
+	w.Country = "FR"
+	assert.Empty(t, w.Verify(&context))
+	assert.Empty(t, w.configure(&context))
+
+	content, err := ioutil.ReadFile(cmdline)
+	assert.Empty(t, err)
+	assert.Equal(t, "quiet cfg80211.ieee80211_regdom=FR\n", string(content))
+	_, err = os.Stat(path.Join(dir, "etc/modprobe.d/debos-wifi-regdom.conf"))
+	assert.True(t, os.IsNotExist(err))
+
+	// Switching to the module option removes the kernel argument
+	w.Country = "00"
+	w.Method = "modprobe"
+	assert.Empty(t, w.Verify(&context))
+	assert.Empty(t, w.configure(&context))
+
+	content, err = ioutil.ReadFile(cmdline)
+	assert.Empty(t, err)
+	assert.Equal(t, "quiet\n", string(content))
+	content, err = ioutil.ReadFile(path.Join(dir, "etc/modprobe.d/debos-wifi-regdom.conf"))
+	assert.Empty(t, err)
+	assert.Equal(t, "# Generated by debos\noptions cfg80211 ieee80211_regdom=00\n", string(content))
+
+	// The kernel command line isn't created for the module option
+	assert.Empty(t, os.Remove(cmdline))
+	assert.Empty(t, w.configure(&context))
+	_, err = os.Stat(cmdline)
+	assert.True(t, os.IsNotExist(err))
+
+	w = NewWifiRegdomAction()
+	assert.EqualError(t, w.Verify(&context), "'country' property can't be empty")
+	w.Country = "fr"
+	assert.EqualError(t, w.Verify(&context), "Invalid country 'fr', expected an ISO 3166-1 alpha-2 code like 'FR' or '00'")
+	w.Country = "FRA"
+	assert.Error(t, w.Verify(&context))
+	w.Country = "DE"
+	w.Method = "iw"
+	assert.EqualError(t, w.Verify(&context), "Invalid method 'iw', expected cmdline or modprobe")
+}
@@ -0,0 +1,144 @@
+/*
+WriteFile Action
+
+Write a file of the target rootfs with the content given in the recipe, the
+simplest way to add a small configuration file without an overlay directory
+or a 'run' action.
+
+Yaml syntax:
+ - action: write-file
+   path: path
+   content: text
+   mode: octal
+   owner: user
+   group: group
+   append: bool
+
+Mandatory properties:
+
+- path -- path of the file in the target rootfs. Paths going above the root of
+the rootfs are refused, and the symlinks of the rootfs are followed within it.
+The missing parent directories are created.
+
+Optional properties:
+
+- content -- text written to the file, as is: a YAML block like '|' keeps the
+final new line. As the rest of the recipe, it can use the template variables.
+By default the file is empty.
+
+- mode -- octal permissions of the file. By default a new file gets '0644' and
+an existing one keeps its permissions.
+
+- owner -- user owning the file, as a name of the target '/etc/passwd' or a
+numeric id. By default a new file is owned by root and an existing one keeps
+its owner.
+
+- group -- group owning the file, as a name of the target '/etc/group' or a
+numeric id. By default a new file belongs to root and an existing one keeps
+its group.
+
+- append -- add the content at the end of the file instead of replacing it,
+for example to add a line to '/etc/fstab'. False by default. Unlike the
+replacement, appending twice adds the content twice.
+
+Example:
+
+ - action: write-file
+   path: /etc/sysctl.d/50-forward.conf
+   content: |
+     net.ipv4.ip_forward = 1
+*/
+package actions
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/go-debos/debos"
+)
+
+type WriteFileAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Path             string
+	Content          string
+	Mode             string
+	Owner            string
+	Group            string
+	Append           bool
+}
+
+func (w *WriteFileAction) Verify(context *debos.DebosContext) error {
+	if len(w.Path) == 0 {
+		return fmt.Errorf("'path' property can't be empty")
+	}
+	if strings.HasPrefix(path.Clean(w.Path), "..") {
+		return fmt.Errorf("Path %s points outside of the rootfs", w.Path)
+	}
+	if _, err := parseOverlayMode(w.Mode); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Path of the file on the host, following the symlinks of the rootfs
+func (w *WriteFileAction) file(context *debos.DebosContext) (string, error) {
+	name, _, err := resolveInRoot(context.Rootdir, w.Path)
+	if err != nil {
+		return "", err
+	}
+	return debos.RestrictedPath(context.Rootdir, name)
+}
+
+func (w *WriteFileAction) Run(context *debos.DebosContext) error {
+	w.LogStart()
+
+	file, err := w.file(context)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path.Dir(file), 0755); err != nil {
+		return err
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if w.Append {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	f, err := os.OpenFile(file, flags, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(w.Content)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to write %s: %v", w.Path, err)
+	}
+
+	uid, gid := -1, -1
+	if len(w.Owner) > 0 {
+		if uid, err = lookupTargetID(context.Rootdir, "passwd", w.Owner); err != nil {
+			return fmt.Errorf("Couldn't set the owner of %s: %v", w.Path, err)
+		}
+	}
+	if len(w.Group) > 0 {
+		if gid, err = lookupTargetID(context.Rootdir, "group", w.Group); err != nil {
+			return fmt.Errorf("Couldn't set the group of %s: %v", w.Path, err)
+		}
+	}
+	if uid >= 0 || gid >= 0 {
+		if err := os.Chown(file, uid, gid); err != nil {
+			return err
+		}
+	}
+
+	// Last, as changing the owner drops the setuid and setgid bits
+	if len(w.Mode) > 0 {
+		mode, _ := parseOverlayMode(w.Mode)
+		return os.Chmod(file, mode)
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package actions
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+
+	"github.com/go-debos/debos"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteFileVerify(t *testing.T) {
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+
+	w := &WriteFileAction{}
+	assert.EqualError(t, w.Verify(&context), "'path' property can't be empty")
+	w.Path = "etc/../../host/passwd"
+	assert.EqualError(t, w.Verify(&context), "Path etc/../../host/passwd points outside of the rootfs")
+	w.Path = "/etc/hostname"
+	w.Mode = "0999"
+	assert.EqualError(t, w.Verify(&context), "Invalid mode '0999'")
+	w.Mode = "0600"
+	assert.Empty(t, w.Verify(&context))
+}
+
+func TestWriteFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	context := debos.DebosContext{&debos.CommonContext{}, "", ""}
+	context.Rootdir = path.Join(dir, "root")
+	assert.Empty(t, os.MkdirAll(path.Join(context.Rootdir, "etc"), 0755))
+	passwd := fmt.Sprintf("root:x:0:0::/root:/bin/sh\napp:x:%d:%d::/srv:/bin/sh\n", os.Getuid(), os.Getgid())
+	assert.Empty(t, ioutil.WriteFile(path.Join(context.Rootdir, "etc/passwd"), []byte(passwd), 0644))
+	// Absolute symlinks are resolved within the rootfs
+	assert.Empty(t, os.Symlink("/srv/data", path.Join(context.Rootdir, "data")))
+
+	w := &WriteFileAction{Path: "/data/app/app.conf", Content: "debug = false\n", Mode: "0640", Owner: "app"}
+	assert.Empty(t, w.Verify(&context))
+	// Replacing the content is idempotent
+	for i := 0; i < 2; i++ {
+		assert.Empty(t, w.Run(&context))
+	}
+
+	file := path.Join(context.Rootdir, "srv/data/app/app.conf")
+	content, err := ioutil.ReadFile(file)
+	assert.Empty(t, err)
+	assert.Equal(t, "debug = false\n", string(content))
+	info, err := os.Stat(file)
+	assert.Empty(t, err)
+	assert.Equal(t, os.FileMode(0640), info.Mode())
+	assert.Equal(t, uint32(os.Getuid()), info.Sys().(*syscall.Stat_t).Uid)
+
+	// Appending keeps the permissions of the file
+	w = &WriteFileAction{Path: "data/app/app.conf", Content: "port = 8080\n", Append: true}
+	assert.Empty(t, w.Verify(&context))
+	assert.Empty(t, w.Run(&context))
+	content, err = ioutil.ReadFile(file)
+	assert.Empty(t, err)
+	assert.Equal(t, "debug = false\nport = 8080\n", string(content))
+	info, err = os.Stat(file)
+	assert.Empty(t, err)
+	assert.Equal(t, os.FileMode(0640), info.Mode())
+
+	w = &WriteFileAction{Path: "/etc/app.conf", Owner: "nobody"}
+	assert.EqualError(t, w.Run(&context), "Couldn't set the owner of /etc/app.conf: 'nobody' not found in /etc/passwd")
+}
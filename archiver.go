@@ -1,8 +1,11 @@
 package debos
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"strings"
 )
@@ -21,6 +24,7 @@ type ArchiveBase struct {
 	file    string // Path to archive file
 	atype   ArchiveType
 	options map[interface{}]interface{} // Archiver-depending map with additional hints
+	context *DebosContext               // Context of the action unpacking the archive, if any
 }
 type ArchiveTar struct {
 	ArchiveBase
@@ -40,6 +44,7 @@ type Unpacker interface {
 type Archiver interface {
 	Type() ArchiveType
 	AddOption(key, value interface{}) error
+	SetContext(context *DebosContext)
 	Unpacker
 }
 
@@ -70,12 +75,22 @@ func (arc *ArchiveBase) AddOption(key, value interface{}) error {
 
 func (arc *ArchiveBase) Type() ArchiveType { return arc.atype }
 
+/* Unpack as part of the action of the context, so the unpacking tool is
+ * terminated when the action times out and logs as the action asks */
+func (arc *ArchiveBase) SetContext(context *DebosContext) {
+	arc.context = context
+}
+
 // Helper function for unpacking with external tool
-func unpack(command []string, destination string) error {
+func (arc *ArchiveBase) unpack(command []string, destination string) error {
 	if err := os.MkdirAll(destination, 0755); err != nil {
 		return err
 	}
-	return Command{}.Run("unpack", command...)
+	cmd := Command{}
+	if arc.context != nil {
+		cmd = NewCommandForContext(*arc.context)
+	}
+	return cmd.Run("unpack", command...)
 }
 
 // Helper function for checking allowed compression types
@@ -85,11 +100,63 @@ func tarOptions(compression string) string {
 		"gz":    "-z",
 		"bzip2": "-j",
 		"xz":    "-J",
+		"zstd":  "--zstd",
 	} // Trying to guess all other supported compression types
 
 	return unpackTarOpts[compression]
 }
 
+/* Decompressors using several threads, by order of preference. tar adds '-d'
+ * to the command line. xz only decompresses in parallel the files made of
+ * several blocks, like the ones compressed with threads, and falls back to a
+ * single thread otherwise */
+var parallelDecompressors = map[string][]string{
+	"gz":    {"pigz"},
+	"bzip2": {"lbzip2", "pbzip2"},
+	"xz":    {"pixz", "xz -T0"},
+	"zstd":  {"pzstd"},
+}
+
+// Magic numbers at the start of the compressed files
+var compressionMagics = map[string][]byte{
+	"gz":    {0x1f, 0x8b},
+	"bzip2": []byte("BZh"),
+	"xz":    {0xfd, '7', 'z', 'X', 'Z', 0x00},
+	"zstd":  {0x28, 0xb5, 0x2f, 0xfd},
+}
+
+// Guess the compression of the file from its content, empty if unknown
+func detectCompression(file string) string {
+	// Reading from a pipe would leave nothing to tar
+	if info, err := os.Stat(file); err != nil || !info.Mode().IsRegular() {
+		return ""
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	header := make([]byte, 6)
+	n, _ := io.ReadFull(f, header)
+	for compression, magic := range compressionMagics {
+		if bytes.HasPrefix(header[:n], magic) {
+			return compression
+		}
+	}
+	return ""
+}
+
+// Returns the first parallel decompressor installed for the compression
+func parallelDecompressor(compression string) string {
+	for _, command := range parallelDecompressors[compression] {
+		if _, err := exec.LookPath(strings.Fields(command)[0]); err == nil {
+			return command
+		}
+	}
+	return ""
+}
+
 func (tar *ArchiveTar) Unpack(destination string) error {
 	command := []string{"tar"}
 	if options, ok := tar.options["taroptions"].([]string); ok {
@@ -99,17 +166,31 @@ func (tar *ArchiveTar) Unpack(destination string) error {
 	}
 	command = append(command, "-C", destination)
 	command = append(command, "-x")
-	command = append(command, "--xattrs")
-	command = append(command, "--xattrs-include=*.*")
+	if xattrs, ok := tar.options["xattrs"].(bool); ok && !xattrs {
+		command = append(command, "--no-xattrs")
+	} else {
+		command = append(command, "--xattrs")
+		command = append(command, "--xattrs-include=*.*")
+	}
 
-	if compression, ok := tar.options["tarcompression"]; ok {
-		if unpackTarOpt := tarOptions(compression.(string)); len(unpackTarOpt) > 0 {
-			command = append(command, unpackTarOpt)
+	/* The archive is streamed through a parallel decompressor when one is
+	 * installed, tar decompresses it itself otherwise */
+	compression, _ := tar.options["tarcompression"].(string)
+	if parallel, ok := tar.options["parallel"].(bool); !ok || parallel {
+		if compression == "" {
+			compression = detectCompression(tar.file)
+		}
+		if decompressor := parallelDecompressor(compression); decompressor != "" {
+			command = append(command, "--use-compress-program="+decompressor)
+			compression = ""
 		}
 	}
+	if unpackTarOpt := tarOptions(compression); len(unpackTarOpt) > 0 {
+		command = append(command, unpackTarOpt)
+	}
 	command = append(command, "-f", tar.file)
 
-	return unpack(command, destination)
+	return tar.unpack(command, destination)
 }
 
 func (tar *ArchiveTar) RelaxedUnpack(destination string) error {
@@ -150,6 +231,22 @@ func (tar *ArchiveTar) AddOption(key, value interface{}) error {
 		}
 		tar.options["tarcompression"] = compression
 
+	case "xattrs":
+		// whether the extended attributes are extracted, true by default
+		xattrs, ok := value.(bool)
+		if !ok {
+			return fmt.Errorf("Wrong type for value")
+		}
+		tar.options["xattrs"] = xattrs
+
+	case "parallel":
+		// whether a parallel decompressor is used if installed, true by default
+		parallel, ok := value.(bool)
+		if !ok {
+			return fmt.Errorf("Wrong type for value")
+		}
+		tar.options["parallel"] = parallel
+
 	default:
 		return fmt.Errorf("Option '%v' is not supported for tar archive type", key)
 	}
@@ -158,7 +255,7 @@ func (tar *ArchiveTar) AddOption(key, value interface{}) error {
 
 func (zip *ArchiveZip) Unpack(destination string) error {
 	command := []string{"unzip", zip.file, "-d", destination}
-	return unpack(command, destination)
+	return zip.unpack(command, destination)
 }
 
 func (zip *ArchiveZip) RelaxedUnpack(destination string) error {
@@ -167,7 +264,7 @@ func (zip *ArchiveZip) RelaxedUnpack(destination string) error {
 
 func (deb *ArchiveDeb) Unpack(destination string) error {
 	command := []string{"dpkg", "-x", deb.file, destination}
-	return unpack(command, destination)
+	return deb.unpack(command, destination)
 }
 
 func (deb *ArchiveDeb) RelaxedUnpack(destination string) error {
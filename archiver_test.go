@@ -1,11 +1,18 @@
 package debos_test
 
 import (
-	_ "fmt"
+	"bytes"
+	"fmt"
 	"github.com/go-debos/debos"
 	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
 	_ "reflect"
-	_ "strings"
+	"strings"
 	"testing"
 )
 
@@ -73,6 +80,7 @@ func TestTar_compression(t *testing.T) {
 		"gz":    "tar -C test -x -z -f test.tar.gz",
 		"bzip2": "tar -C test -x -j -f test.tar.gz",
 		"xz":    "tar -C test -x -J -f test.tar.gz",
+		"zstd":  "tar -C test -x --zstd -f test.tar.gz",
 	}
 
 	// Force type
@@ -155,3 +163,109 @@ func TestZip(t *testing.T) {
 	err = archive.RelaxedUnpack("/tmp/test")
 	assert.EqualError(t, err, "exit status 9")
 }
+
+// Make a tarball of a tree of compressible files with the compressor
+func makeTarball(t testing.TB, dir, compressor string, size int) string {
+	src := path.Join(dir, "src")
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 16; i++ {
+		sub := path.Join(src, fmt.Sprintf("dir%d", i%4))
+		assert.Empty(t, os.MkdirAll(sub, 0755))
+		var content bytes.Buffer
+		for content.Len() < size/16 {
+			fmt.Fprintf(&content, "line %d of file %d: %d\n", content.Len(), i, r.Intn(1000))
+		}
+		assert.Empty(t, ioutil.WriteFile(path.Join(sub, fmt.Sprintf("file%d", i)), content.Bytes(), 0644))
+	}
+	assert.Empty(t, os.Symlink("dir0/file0", path.Join(src, "link")))
+
+	tarball := path.Join(dir, "test.tar."+strings.Fields(compressor)[0])
+	out, err := exec.Command("sh", "-c",
+		fmt.Sprintf("tar -C %s -cf - . | %s > %s", src, compressor, tarball)).CombinedOutput()
+	assert.Empty(t, err, string(out))
+	return tarball
+}
+
+// List the entries of the tree with their type and content
+func treeContent(t testing.TB, root string) map[string]string {
+	tree := map[string]string{}
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name := strings.TrimPrefix(p, root)
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(p)
+			tree[name] = "link " + target
+			return err
+		case info.IsDir():
+			tree[name] = "dir"
+		default:
+			content, err := ioutil.ReadFile(p)
+			tree[name] = fmt.Sprintf("%v %s", info.Mode(), content)
+			return err
+		}
+		return nil
+	})
+	assert.Empty(t, err)
+	return tree
+}
+
+// The parallel and serial decompressions extract the same tree
+func TestTar_parallel(t *testing.T) {
+	for _, compressor := range []string{"gzip", "bzip2", "xz -T0 --block-size=64KiB", "zstd"} {
+		if _, err := exec.LookPath(strings.Fields(compressor)[0]); err != nil {
+			continue
+		}
+		dir, err := ioutil.TempDir("", "go-debos")
+		assert.Empty(t, err)
+		defer os.RemoveAll(dir)
+
+		tarball := makeTarball(t, dir, compressor, 1024*1024)
+		src := treeContent(t, path.Join(dir, "src"))
+
+		for _, parallel := range []bool{false, true} {
+			// With and without the compression hint
+			for _, hint := range []bool{false, true} {
+				dest := path.Join(dir, fmt.Sprintf("dest-%v-%v", parallel, hint))
+				archive, err := debos.NewArchive(tarball, debos.Tar)
+				assert.Empty(t, err)
+				assert.Empty(t, archive.AddOption("parallel", parallel))
+				if hint {
+					compression := map[string]string{"gzip": "gz", "bzip2": "bzip2", "xz": "xz", "zstd": "zstd"}
+					assert.Empty(t, archive.AddOption("tarcompression", compression[strings.Fields(compressor)[0]]))
+				}
+				assert.Empty(t, archive.Unpack(dest))
+				assert.Equal(t, src, treeContent(t, dest), compressor)
+			}
+		}
+	}
+}
+
+/* Compare the wall time of the serial and parallel decompressions of a large
+ * xz tarball, compressed with threads so it's made of several blocks:
+ * go test -run - -bench TarUnpack
+ * Since xz 5.6 the serial one uses threads as well, xz defaulting to them */
+func BenchmarkTarUnpack(b *testing.B) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(b, err)
+	defer os.RemoveAll(dir)
+	tarball := makeTarball(b, dir, "xz -T0", 64*1024*1024)
+
+	for _, parallel := range []bool{false, true} {
+		name := map[bool]string{false: "serial", true: "parallel"}[parallel]
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				dest := path.Join(dir, fmt.Sprintf("%s-%d", name, i))
+				archive, err := debos.NewArchive(tarball, debos.Tar)
+				assert.Empty(b, err)
+				assert.Empty(b, archive.AddOption("parallel", parallel))
+				assert.Empty(b, archive.Unpack(dest))
+				b.StopTimer()
+				os.RemoveAll(dest)
+				b.StartTimer()
+			}
+		})
+	}
+}
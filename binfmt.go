@@ -0,0 +1,167 @@
+package debos
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+	"syscall"
+)
+
+// Mount point of binfmt_misc, where the handlers are registered
+var binfmtDir = "/proc/sys/fs/binfmt_misc"
+
+// Directory of the qemu-user binaries copied in the chroots
+var qemuUserDir = "/usr/bin"
+
+type binfmtHandler struct {
+	qemu  string // name of qemu-user for the architecture
+	magic string // ELF header of its binaries, in the binfmt_misc format
+	mask  string
+}
+
+// Masks ignoring the ABI version and the type of the ELF binaries
+const (
+	binfmtMaskLE = `\xff\xff\xff\xff\xff\xff\xff\x00\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff\xff`
+	binfmtMaskBE = `\xff\xff\xff\xff\xff\xff\xff\x00\xff\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff`
+)
+
+// Handlers of the foreign architectures, as registered by qemu-user-static
+var binfmtHandlers = map[string]binfmtHandler{
+	"armhf":    {"arm", `\x7fELF\x01\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x28\x00`, binfmtMaskLE},
+	"armel":    {"arm", `\x7fELF\x01\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x28\x00`, binfmtMaskLE},
+	"arm":      {"arm", `\x7fELF\x01\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x28\x00`, binfmtMaskLE},
+	"arm64":    {"aarch64", `\x7fELF\x02\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\xb7\x00`, binfmtMaskLE},
+	"mips":     {"mips", `\x7fELF\x01\x02\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x08`, binfmtMaskBE},
+	"mipsel":   {"mipsel", `\x7fELF\x01\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x08\x00`, binfmtMaskLE},
+	"mips64el": {"mips64el", `\x7fELF\x02\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x08\x00`, binfmtMaskLE},
+	"riscv64":  {"riscv64", `\x7fELF\x02\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\xf3\x00`, binfmtMaskLE},
+}
+
+// Architectures the host runs natively, per Go architecture
+var nativeArchitectures = map[string][]string{
+	"amd64":    {"amd64", "i386"},
+	"386":      {"i386"},
+	"arm64":    {"arm64", "armhf", "armel", "arm"},
+	"arm":      {"armhf", "armel", "arm"},
+	"mips":     {"mips"},
+	"mipsle":   {"mipsel"},
+	"mips64le": {"mips64el"},
+	"riscv64":  {"riscv64"},
+}
+
+func isNativeArchitecture(architecture string) bool {
+	for _, a := range nativeArchitectures[runtime.GOARCH] {
+		if a == architecture {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether an enabled binfmt_misc handler runs the binaries with the qemu-user
+func binfmtRegistered(qemu string) bool {
+	entries, err := ioutil.ReadDir(binfmtDir)
+	if err != nil {
+		return false
+	}
+
+	for _, e := range entries {
+		if e.Name() == "register" || e.Name() == "status" {
+			continue
+		}
+		content, err := ioutil.ReadFile(path.Join(binfmtDir, e.Name()))
+		if err != nil {
+			continue
+		}
+		enabled := false
+		interpreter := ""
+		for _, line := range strings.Split(string(content), "\n") {
+			if line == "enabled" {
+				enabled = true
+			}
+			if strings.HasPrefix(line, "interpreter ") {
+				interpreter = path.Base(strings.TrimPrefix(line, "interpreter "))
+			}
+		}
+		// Both qemu-aarch64 and qemu-aarch64-static
+		if enabled && strings.TrimSuffix(interpreter, "-static") == "qemu-"+qemu {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+CheckBinfmt() returns nil if the commands of the architecture can run in a
+chroot, either natively or through a qemu-user binfmt_misc handler, or an
+error explaining how to make it possible otherwise.
+*/
+func CheckBinfmt(architecture string) error {
+	if architecture == "" || isNativeArchitecture(architecture) {
+		return nil
+	}
+	handler, found := binfmtHandlers[architecture]
+	if !found {
+		return fmt.Errorf("Architecture '%s' can't be emulated on %s", architecture, runtime.GOARCH)
+	}
+
+	qemu := path.Join(qemuUserDir, fmt.Sprintf("qemu-%s-static", handler.qemu))
+	if _, err := os.Stat(qemu); err != nil {
+		return fmt.Errorf("%s is needed to build for %s on %s, install the qemu-user-static package",
+			qemu, architecture, runtime.GOARCH)
+	}
+
+	if status, err := ioutil.ReadFile(path.Join(binfmtDir, "status")); err != nil {
+		return fmt.Errorf("binfmt_misc isn't mounted on %s, needed to build for %s on %s, "+
+			"mount it or use --setup-binfmt", binfmtDir, architecture, runtime.GOARCH)
+	} else if strings.TrimSpace(string(status)) != "enabled" {
+		return fmt.Errorf("binfmt_misc is disabled, needed to build for %s on %s, "+
+			"enable it with 'echo 1 > %s/status'", architecture, runtime.GOARCH, binfmtDir)
+	}
+
+	if !binfmtRegistered(handler.qemu) {
+		return fmt.Errorf("No binfmt_misc handler for qemu-%s, needed to build for %s on %s, "+
+			"install the binfmt-support package, restart systemd-binfmt or use --setup-binfmt",
+			handler.qemu, architecture, runtime.GOARCH)
+	}
+
+	return nil
+}
+
+/*
+SetupBinfmt() registers the qemu-user binfmt_misc handler of the architecture
+unless it already is, mounting and enabling binfmt_misc if needed. It requires
+to be root.
+*/
+func SetupBinfmt(architecture string) error {
+	handler, found := binfmtHandlers[architecture]
+	if !found || isNativeArchitecture(architecture) {
+		return nil
+	}
+
+	if _, err := os.Stat(path.Join(binfmtDir, "register")); os.IsNotExist(err) {
+		if err := syscall.Mount("binfmt_misc", binfmtDir, "binfmt_misc", 0, ""); err != nil {
+			return fmt.Errorf("Couldn't mount binfmt_misc: %v", err)
+		}
+	}
+
+	if err := ioutil.WriteFile(path.Join(binfmtDir, "status"), []byte("1"), 0200); err != nil {
+		return fmt.Errorf("Couldn't enable binfmt_misc: %v", err)
+	}
+	if binfmtRegistered(handler.qemu) {
+		return nil
+	}
+
+	// The interpreter is opened on registration with F, chroots don't need it
+	qemu := path.Join(qemuUserDir, fmt.Sprintf("qemu-%s-static", handler.qemu))
+	rule := fmt.Sprintf(":qemu-%s:M::%s:%s:%s:F", handler.qemu, handler.magic, handler.mask, qemu)
+	if err := ioutil.WriteFile(path.Join(binfmtDir, "register"), []byte(rule), 0200); err != nil {
+		return fmt.Errorf("Couldn't register the binfmt_misc handler for qemu-%s: %v", handler.qemu, err)
+	}
+
+	return nil
+}
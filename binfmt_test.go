@@ -0,0 +1,55 @@
+package debos
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckBinfmt(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("The foreign architectures are only known on amd64")
+	}
+
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	defer func(b, q string) { binfmtDir, qemuUserDir = b, q }(binfmtDir, qemuUserDir)
+	binfmtDir = path.Join(dir, "binfmt_misc")
+	qemuUserDir = path.Join(dir, "bin")
+
+	// Native architectures
+	assert.Empty(t, CheckBinfmt("amd64"))
+	assert.Empty(t, CheckBinfmt("i386"))
+	assert.EqualError(t, CheckBinfmt("s390x"), "Architecture 's390x' can't be emulated on amd64")
+
+	assert.EqualError(t, CheckBinfmt("arm64"), qemuUserDir+"/qemu-aarch64-static is needed to build "+
+		"for arm64 on amd64, install the qemu-user-static package")
+
+	assert.Empty(t, os.MkdirAll(qemuUserDir, 0755))
+	assert.Empty(t, ioutil.WriteFile(path.Join(qemuUserDir, "qemu-aarch64-static"), []byte{}, 0755))
+	assert.EqualError(t, CheckBinfmt("arm64"), "binfmt_misc isn't mounted on "+binfmtDir+", needed to build "+
+		"for arm64 on amd64, mount it or use --setup-binfmt")
+
+	assert.Empty(t, os.MkdirAll(binfmtDir, 0755))
+	assert.Empty(t, ioutil.WriteFile(path.Join(binfmtDir, "status"), []byte("disabled\n"), 0644))
+	assert.Contains(t, CheckBinfmt("arm64").Error(), "binfmt_misc is disabled")
+
+	assert.Empty(t, ioutil.WriteFile(path.Join(binfmtDir, "status"), []byte("enabled\n"), 0644))
+	assert.EqualError(t, CheckBinfmt("arm64"), "No binfmt_misc handler for qemu-aarch64, needed to build "+
+		"for arm64 on amd64, install the binfmt-support package, restart systemd-binfmt or use --setup-binfmt")
+
+	// A disabled handler doesn't count
+	handler := "interpreter /usr/bin/qemu-aarch64\nflags: OCF\noffset 0\nmagic 7f454c460201010000000000000000000200b700\n"
+	assert.Empty(t, ioutil.WriteFile(path.Join(binfmtDir, "qemu-aarch64"), []byte("disabled\n"+handler), 0644))
+	assert.Error(t, CheckBinfmt("arm64"))
+
+	assert.Empty(t, ioutil.WriteFile(path.Join(binfmtDir, "qemu-aarch64"), []byte("enabled\n"+handler), 0644))
+	assert.Empty(t, CheckBinfmt("arm64"))
+	assert.Error(t, CheckBinfmt("armhf"))
+}
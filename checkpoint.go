@@ -0,0 +1,212 @@
+package debos
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// State of the context saved along with the rootfs
+type checkpointState struct {
+	Variables map[string]string
+}
+
+/* Returns the key of the checkpoint taken after the action, derived from the
+ * key of the previous action, the properties of the action and the content of
+ * the files of the recipe directory it refers to. Any change to an action
+ * thus changes the keys of all the following ones */
+func CheckpointKey(previous string, context *DebosContext, action Action) (string, error) {
+	properties, err := yaml.Marshal(action)
+	if err != nil {
+		return "", fmt.Errorf("Couldn't serialize action '%s': %v", action, err)
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n", previous, context.Architecture)
+	h.Write(properties)
+
+	var values interface{}
+	if err := yaml.Unmarshal(properties, &values); err != nil {
+		return "", err
+	}
+	for _, file := range referencedFiles(context.RecipeDir, values) {
+		fmt.Fprintf(h, "%s\n", file)
+		if err := hashTree(h, path.Join(context.RecipeDir, file)); err != nil {
+			return "", err
+		}
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Returns the files of the recipe directory named by the strings of values
+func referencedFiles(recipedir string, values interface{}) []string {
+	found := map[string]bool{}
+
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch t := v.(type) {
+		case string:
+			file := CleanPathAt(t, recipedir)
+			rel, err := filepath.Rel(recipedir, file)
+			if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+				return
+			}
+			if _, err := os.Lstat(file); err == nil {
+				found[rel] = true
+			}
+		case []interface{}:
+			for _, e := range t {
+				walk(e)
+			}
+		case map[interface{}]interface{}:
+			for _, e := range t {
+				walk(e)
+			}
+		}
+	}
+	walk(values)
+
+	var files []string
+	for f := range found {
+		files = append(files, f)
+	}
+	sort.Strings(files)
+
+	return files
+}
+
+// Hash the names, modes and contents of a file or directory tree
+func hashTree(h io.Writer, root string) error {
+	return filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, _ := filepath.Rel(root, p)
+		fmt.Fprintf(h, "%s %o\n", rel, info.Mode())
+
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, "%s\n", target)
+		case info.Mode().IsRegular():
+			f, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			if _, err := io.Copy(h, f); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func checkpointFile(dir, key string) string {
+	return path.Join(dir, key+".tar")
+}
+
+// Whether the checkpoint of the key was saved in the directory
+func HasCheckpoint(dir, key string) bool {
+	_, err := os.Stat(checkpointFile(dir, key))
+	return err == nil
+}
+
+/* Save the rootfs and the build time variables in the directory. Only the
+ * rootfs is saved, so other build results such as a partitioned image or the
+ * files of a download can't be in use at this point. The scratch directory is
+ * fine as the intermediate files it holds only matter to the current build */
+func SaveCheckpoint(context *DebosContext, dir, key string) error {
+	if len(context.ImagePartitions) > 0 {
+		return fmt.Errorf("Can't save a checkpoint once the image is partitioned")
+	}
+	for name, origin := range context.Origins {
+		switch name {
+		case "artifacts", "filesystem", "recipe", "scratch":
+		default:
+			return fmt.Errorf("Can't save a checkpoint with origin '%s' (%s) in use", name, origin)
+		}
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	state, err := json.Marshal(checkpointState{Variables: context.Variables})
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path.Join(dir, key+".json"), state, 0644); err != nil {
+		return err
+	}
+
+	// Write to a temporary file so an interrupted save isn't used
+	tarball := checkpointFile(dir, key)
+	err = NewCommandForContext(*context).Run("Checkpoint", "tar", "cf", tarball+".tmp",
+		"--xattrs", "--xattrs-include=*.*", "--numeric-owner",
+		"-C", context.Rootdir, ".")
+	if err != nil {
+		os.Remove(tarball + ".tmp")
+		return err
+	}
+
+	if err := os.Rename(tarball+".tmp", tarball); err != nil {
+		return err
+	}
+
+	log.Printf("Saved checkpoint %s", key)
+	return nil
+}
+
+// Replace the rootfs and the build time variables by the saved ones
+func RestoreCheckpoint(context *DebosContext, dir, key string) error {
+	state := checkpointState{}
+	data, err := ioutil.ReadFile(path.Join(dir, key+".json"))
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("Invalid checkpoint %s: %v", key, err)
+	}
+
+	if err := os.RemoveAll(context.Rootdir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(context.Rootdir, 0755); err != nil {
+		return err
+	}
+
+	err = NewCommandForContext(*context).Run("Checkpoint", "tar", "xf", checkpointFile(dir, key),
+		"--xattrs", "--xattrs-include=*.*", "--numeric-owner",
+		"-C", context.Rootdir)
+	if err != nil {
+		return err
+	}
+
+	if context.Variables == nil {
+		context.Variables = map[string]string{}
+	}
+	for k, v := range state.Variables {
+		context.Variables[k] = v
+	}
+
+	log.Printf("Restored checkpoint %s", key)
+	return nil
+}
@@ -0,0 +1,103 @@
+package debos
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type overlayAction struct {
+	BaseAction `yaml:",inline"`
+	Source     string
+}
+
+func TestCheckpointKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	context := DebosContext{&CommonContext{}, dir, "amd64"}
+	assert.Empty(t, os.MkdirAll(path.Join(dir, "overlay/etc"), 0755))
+	assert.Empty(t, ioutil.WriteFile(path.Join(dir, "overlay/etc/hostname"), []byte("debos\n"), 0644))
+
+	a := &overlayAction{BaseAction: BaseAction{Action: "overlay"}, Source: "overlay"}
+	key, err := CheckpointKey("", &context, a)
+	assert.Empty(t, err)
+	same, err := CheckpointKey("", &context, a)
+	assert.Empty(t, err)
+	assert.Equal(t, key, same)
+
+	// Files the action doesn't refer to don't matter
+	assert.Empty(t, ioutil.WriteFile(path.Join(dir, "recipe.yaml"), []byte("actions:\n"), 0644))
+	same, err = CheckpointKey("", &context, a)
+	assert.Empty(t, err)
+	assert.Equal(t, key, same)
+
+	// The content of the files it refers to does
+	assert.Empty(t, ioutil.WriteFile(path.Join(dir, "overlay/etc/hostname"), []byte("other\n"), 0644))
+	changed, err := CheckpointKey("", &context, a)
+	assert.Empty(t, err)
+	assert.NotEqual(t, key, changed)
+
+	// So do its properties and the previous actions
+	a.Description = "Configure the hostname"
+	described, err := CheckpointKey("", &context, a)
+	assert.Empty(t, err)
+	assert.NotEqual(t, changed, described)
+
+	chained, err := CheckpointKey(key, &context, a)
+	assert.Empty(t, err)
+	assert.NotEqual(t, described, chained)
+}
+
+func TestCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	checkpoints := path.Join(dir, "checkpoints")
+	context := DebosContext{&CommonContext{}, dir, ""}
+	context.Rootdir = path.Join(dir, "root")
+	context.Artifactdir = dir
+	context.Scratchdir = path.Join(dir, "scratch")
+	context.Variables = map[string]string{"version": "1.0"}
+	// As the build sets them up
+	context.Origins = DefaultOrigins(&context)
+
+	assert.Empty(t, os.MkdirAll(path.Join(context.Rootdir, "etc"), 0755))
+	assert.Empty(t, ioutil.WriteFile(path.Join(context.Rootdir, "etc/hostname"), []byte("debos\n"), 0644))
+	assert.Empty(t, os.Symlink("hostname", path.Join(context.Rootdir, "etc/link")))
+
+	assert.False(t, HasCheckpoint(checkpoints, "key"))
+	assert.Empty(t, SaveCheckpoint(&context, checkpoints, "key"))
+	assert.True(t, HasCheckpoint(checkpoints, "key"))
+
+	// Changes after the checkpoint are reverted
+	assert.Empty(t, ioutil.WriteFile(path.Join(context.Rootdir, "etc/hostname"), []byte("other\n"), 0644))
+	assert.Empty(t, ioutil.WriteFile(path.Join(context.Rootdir, "etc/added"), []byte{}, 0644))
+	context.Variables = map[string]string{}
+
+	assert.Empty(t, RestoreCheckpoint(&context, checkpoints, "key"))
+	hostname, err := ioutil.ReadFile(path.Join(context.Rootdir, "etc/hostname"))
+	assert.Empty(t, err)
+	assert.Equal(t, "debos\n", string(hostname))
+	link, err := os.Readlink(path.Join(context.Rootdir, "etc/link"))
+	assert.Empty(t, err)
+	assert.Equal(t, "hostname", link)
+	_, err = os.Stat(path.Join(context.Rootdir, "etc/added"))
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, map[string]string{"version": "1.0"}, context.Variables)
+
+	context.Origins["firmware"] = path.Join(dir, "firmware")
+	assert.EqualError(t, SaveCheckpoint(&context, checkpoints, "other"),
+		"Can't save a checkpoint with origin 'firmware' ("+path.Join(dir, "firmware")+") in use")
+	delete(context.Origins, "firmware")
+
+	context.ImagePartitions = []Partition{{Name: "root"}}
+	assert.EqualError(t, SaveCheckpoint(&context, checkpoints, "other"),
+		"Can't save a checkpoint once the image is partitioned")
+	assert.False(t, HasCheckpoint(checkpoints, "other"))
+}
@@ -1,12 +1,18 @@
 package main
 
 import (
+	gocontext "context"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
 	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
+	"syscall"
 
 	"github.com/docker/go-units"
 	"github.com/go-debos/debos"
@@ -21,28 +27,288 @@ func checkError(context *debos.DebosContext, err error, a debos.Action, stage st
 	}
 
 	context.State = debos.Failed
-	log.Printf("Action `%s` failed at stage %s, error: %s", a, stage, err)
-	debos.DebugShell(*context)
+	debos.LogError("Action `%s` failed at stage %s, error: %s", a, stage, err)
+	// Don't hold the teardown once interrupted
+	if !interrupted(context) {
+		if context.KeepOnFailure {
+			keepBuildState(context)
+		}
+		if context.ShellOnFailure != "" {
+			debos.ChrootShell(*context, context.ShellOnFailure)
+		}
+		debos.DebugShell(*context)
+	}
 	return 1
 }
 
-func do_run(r actions.Recipe, context *debos.DebosContext) int {
+func interrupted(context *debos.DebosContext) bool {
+	return context.Ctx != nil && context.Ctx.Err() != nil
+}
+
+/* Actions going on with the build once interrupted would still change the
+ * rootfs and artifacts, fail the next one to tear down the build instead */
+func checkInterrupted(context *debos.DebosContext, a debos.Action, stage string) int {
+	if !interrupted(context) {
+		return 0
+	}
+	return checkError(context, fmt.Errorf("Build interrupted"), a, stage)
+}
+
+/* Whether the teardown is skipped to inspect the failed build, the fake
+ * machine still tears down the build as its state goes away with it */
+func keep(context *debos.DebosContext) bool {
+	return context.KeepOnFailure && context.State == debos.Failed && !fakemachine.InMachine()
+}
+
+/* Some actions finish their work at cleanup, like building the EROFS
+ * partitions once all actions have run, so a failure fails the build when it
+ * hasn't failed already */
+func cleanup(context *debos.DebosContext, a debos.Action, exitcode *int) {
+	if keep(context) {
+		return
+	}
+	err := a.Cleanup(context)
+	if *exitcode != 0 {
+		if err != nil {
+			log.Printf("Action `%s` failed to clean up: %s", a, err)
+		}
+		return
+	}
+	*exitcode = checkError(context, err, a, "Cleanup")
+}
+
+func postMachineCleanup(context *debos.DebosContext, a debos.Action) {
+	if !keep(context) {
+		a.PostMachineCleanup(context)
+	}
+}
+
+func removeAll(context *debos.DebosContext, dir string) {
+	if !keep(context) {
+		os.RemoveAll(dir)
+	}
+}
+
+/* Log where the state of the failed build is, the fake machine goes away with
+ * its scratch directory so the rootfs is archived to the artifact directory */
+func keepBuildState(context *debos.DebosContext) {
+	if fakemachine.InMachine() {
+		archive := path.Join(context.Artifactdir, "debos-failed-rootfs.tar")
+		err := debos.NewCommandForContext(*context).Run("Keep rootfs", "tar", "--xattrs", "--xattrs-include=*.*",
+			"-C", context.Rootdir, "-cf", archive, ".")
+		if err != nil {
+			log.Printf("Couldn't archive the rootfs: %v", err)
+			return
+		}
+		log.Printf("The rootfs of the failed build is archived to %s", archive)
+		return
+	}
+
+	debos.LogBuildState(*context)
+}
+
+// Send the signal to the direct children of debos, like the fake machine,
+// which don't get it when it is only sent to debos
+func signalChildren(sig syscall.Signal) {
+	tasks, _ := filepath.Glob("/proc/self/task/*/children")
+	for _, t := range tasks {
+		children, err := ioutil.ReadFile(t)
+		if err != nil {
+			continue
+		}
+		for _, c := range strings.Fields(string(children)) {
+			pid, err := strconv.Atoi(c)
+			if err != nil {
+				continue
+			}
+			log.Printf("Sending %s to process %d", sig, pid)
+			syscall.Kill(pid, sig)
+		}
+	}
+}
+
+/* On SIGINT or SIGTERM terminate the running commands and the fake machine,
+ * the running action then fails and the usual teardown unmounts filesystems
+ * and detaches loop devices before debos exits */
+func handleSignals(context *debos.DebosContext) {
+	ctx, cancel := gocontext.WithCancel(gocontext.Background())
+	context.Ctx = ctx
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		s := <-signals
+		log.Printf("Received %s, cleaning up", s)
+		cancel()
+		signalChildren(syscall.SIGTERM)
+
+		for s = range signals {
+			log.Printf("Received %s, cleanup already in progress", s)
+		}
+	}()
+}
+
+// Checkpoints of the rootfs saved or used by the build
+type checkpoints struct {
+	dir  string
+	keys []string     // Key of the checkpoint after each action
+	save map[int]bool // Actions to save a checkpoint after
+	from int          // Action to start at, -1 to start at the last checkpoint
+}
+
+// Returns the index of the action with the description or name
+func findAction(r actions.Recipe, label string) (int, error) {
+	found := -1
+	for i, a := range r.Actions {
+		if a.String() != label {
+			continue
+		}
+		if found >= 0 {
+			return -1, fmt.Errorf("Several actions are named '%s'", label)
+		}
+		found = i
+	}
+	if found < 0 {
+		return -1, fmt.Errorf("Action '%s' not found", label)
+	}
+
+	return found, nil
+}
+
+func planCheckpoints(r actions.Recipe, context *debos.DebosContext, labels []string, from string) (*checkpoints, error) {
+	c := checkpoints{
+		dir:  path.Join(context.Artifactdir, ".debos-checkpoints"),
+		save: map[int]bool{},
+		from: -1,
+	}
+
+	for _, l := range labels {
+		i, err := findAction(r, l)
+		if err != nil {
+			return nil, err
+		}
+		c.save[i] = true
+	}
+	if from != "" {
+		i, err := findAction(r, from)
+		if err != nil {
+			return nil, err
+		}
+		c.from = i
+	}
+
+	key := ""
 	for _, a := range r.Actions {
-		err := a.Run(context)
+		var err error
+		if key, err = debos.CheckpointKey(key, context, a.Action); err != nil {
+			return nil, err
+		}
+		c.keys = append(c.keys, key)
+	}
+
+	return &c, nil
+}
+
+/* Restore the checkpoint the build starts from, either the one of the action
+ * before --from or the last valid one, returns the first action to run. A nil
+ * plan builds without checkpoints */
+func (c *checkpoints) resume(r actions.Recipe, context *debos.DebosContext) (int, error) {
+	if c == nil {
+		return 0, nil
+	}
+
+	start := 0
+	if c.from > 0 {
+		if !debos.HasCheckpoint(c.dir, c.keys[c.from-1]) {
+			return 0, fmt.Errorf("No up to date checkpoint of action '%s' to start from, run with --checkpoint '%s' first",
+				r.Actions[c.from-1], r.Actions[c.from-1])
+		}
+		start = c.from
+	} else if c.from < 0 {
+		for i := len(r.Actions) - 1; i >= 0; i-- {
+			if c.save[i] && debos.HasCheckpoint(c.dir, c.keys[i]) {
+				start = i + 1
+				break
+			}
+		}
+	}
+	if start == 0 {
+		return 0, nil
+	}
+
+	log.Printf("Resuming after action '%s'", r.Actions[start-1])
+	return start, debos.RestoreCheckpoint(context, c.dir, c.keys[start-1])
+}
+
+func do_run(r actions.Recipe, context *debos.DebosContext, c *checkpoints) (exitcode int) {
+	start, err := c.resume(r, context)
+	if err != nil {
+		debos.LogError("Couldn't resume from checkpoint: %v", err)
+		return 1
+	}
+
+	for i, a := range r.Actions {
+		if i < start {
+			log.Printf("Skipping action '%s'", a)
+			continue
+		}
+
+		if exitcode = checkInterrupted(context, a, "Run"); exitcode != 0 {
+			return exitcode
+		}
+		err := debos.RunAction(context, a.Action)
 
 		// This does not stop the call of stacked Cleanup methods for other Actions
 		// Stack Cleanup methods
-		defer a.Cleanup(context)
+		defer cleanup(context, a.Action, &exitcode)
 
 		// Check the state of Run method
-		if exitcode := checkError(context, err, a, "Run"); exitcode != 0 {
+		if exitcode = checkError(context, err, a, "Run"); exitcode != 0 {
 			return exitcode
 		}
+
+		if c != nil && c.save[i] && !debos.HasCheckpoint(c.dir, c.keys[i]) {
+			err = debos.SaveCheckpoint(context, c.dir, c.keys[i])
+			if exitcode = checkError(context, err, a, "Checkpoint"); exitcode != 0 {
+				return exitcode
+			}
+		}
 	}
 
 	return 0
 }
 
+// Log the actions of the recipe in order, including the ones of sub-recipes
+func logActions(r actions.Recipe, indent string) {
+	for _, a := range r.Actions {
+		log.Printf("%s- %s", indent, a)
+		if recipe, ok := a.Action.(*actions.RecipeAction); ok {
+			logActions(recipe.Actions, indent+"  ")
+		}
+	}
+}
+
+// The netrc file of download actions, empty if there is none
+func netrcFile(file string) string {
+	if file == "" {
+		file = os.Getenv("NETRC")
+	}
+	if file == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		file = path.Join(home, ".netrc")
+	}
+
+	file = debos.CleanPath(file)
+	if _, err := os.Stat(file); err != nil {
+		return ""
+	}
+	return file
+}
+
 func warnLocalhost(variable string, value string) {
 	message := `WARNING: Environment variable %[1]s contains a reference to
 		    localhost. This may not work when running from fakemachine.
@@ -63,15 +329,29 @@ func main() {
 		InternalImage string            `long:"internal-image" hidden:"true"`
 		TemplateVars  map[string]string `short:"t" long:"template-var" description:"Template variables (use -t VARIABLE:VALUE syntax)"`
 		DebugShell    bool              `long:"debug-shell" description:"Fall into interactive shell on error"`
+		KeepOnFailure bool              `long:"keep-on-failure" description:"Skip the teardown once an action failed and print where the rootfs, scratch directory and image are, the rootfs is archived to the artifact directory with fakemachine"`
+		ShellOnFailure bool             `long:"shell-on-failure" description:"Fall into an interactive shell in the target rootfs on error, the teardown carries on once it exits"`
+		Interactive   bool              `long:"interactive" description:"Start the shells of the debug-shell actions, which are skipped otherwise"`
 		Shell         string            `short:"s" long:"shell" description:"Redefine interactive shell binary (default: bash)" optionsl:"" default:"/bin/bash"`
 		ScratchSize   string            `long:"scratchsize" description:"Size of disk backed scratch space"`
-		CPUs          int               `short:"c" long:"cpus" description:"Number of CPUs to use for build VM (default: 2)"`
-		Memory        string            `short:"m" long:"memory" description:"Amount of memory for build VM (default: 2048MB)"`
+		CPUs          int               `short:"c" long:"cpus" description:"Number of CPUs to use for build VM, overrides the recipe (default: 2)"`
+		Memory        string            `short:"m" long:"memory" description:"Amount of memory for build VM, overrides the recipe (default: 2048MB)"`
 		ShowBoot      bool              `long:"show-boot" description:"Show boot/console messages from the fake machine"`
+		QemuArgs      []string          `long:"qemu-arg" description:"Extra arguments for the build VM, can be repeated (e.g. --qemu-arg='-machine q35')"`
 		EnvironVars   map[string]string `short:"e" long:"environ-var" description:"Environment variables (use -e VARIABLE:VALUE syntax)"`
 		Verbose       bool              `short:"v" long:"verbose" description:"Verbose output"`
 		PrintRecipe   bool              `long:"print-recipe" description:"Print final recipe"`
-		DryRun        bool              `long:"dry-run" description:"Compose final recipe to build but without any real work started"`
+		DryRun        bool              `long:"dry-run" description:"Check the recipe and list its actions without doing any real work"`
+		LogFormat     string            `long:"log-format" description:"Format of the log, text or json (one object per line)" default:"text"`
+		Checkpoints   []string          `long:"checkpoint" description:"Save the rootfs after the action with this description or name, the next builds start from there while the recipe up to it is unchanged, can be repeated"`
+		From          string            `long:"from" description:"Start at the action with this description or name, from the checkpoint of the action before it"`
+		KVM           string            `long:"kvm" description:"Use KVM for the build VM: auto, on or off to use the slow software emulation" default:"auto"`
+		NoKVM         bool              `long:"no-kvm" description:"Don't use KVM for the build VM, same as --kvm=off"`
+		DebootstrapCache string         `long:"debootstrap-cache" description:"Directory to save the base systems of debootstrap actions in and extract them from on the next builds"`
+		DebootstrapCacheRefresh bool    `long:"debootstrap-cache-refresh" description:"Run debootstrap actions even if their base system is cached, replacing it"`
+		MaxParallel   int               `long:"max-parallel" description:"Maximum number of actions run at the same time by parallel actions (default: number of CPUs)"`
+		Netrc         string            `long:"netrc" description:"File with the credentials of the servers of download actions (default: $NETRC or ~/.netrc)"`
+		SetupBinfmt   bool              `long:"setup-binfmt" description:"Register the qemu-user binfmt_misc handler of the recipe architecture if needed, requires root"`
 		DisableFakeMachine bool         `long:"disable-fakemachine" description:"Do not use fakemachine."`
 	}
 
@@ -90,6 +370,9 @@ func main() {
 	var exitcode int = 0
 	// Allow to run all deferred calls prior to os.Exit()
 	defer func() {
+		if exitcode == 0 && interrupted(&context) {
+			exitcode = 1
+		}
 		os.Exit(exitcode)
 	}()
 
@@ -107,16 +390,52 @@ func main() {
 		}
 	}
 
+	if err := debos.SetLogFormat(options.LogFormat); err != nil {
+		log.Println(err)
+		exitcode = 1
+		return
+	}
+
 	if len(args) != 1 {
 		log.Println("No recipe given!")
 		exitcode = 1
 		return
 	}
 
+	qemuArgs, err := debos.ParseQemuArgs(options.QemuArgs)
+	if err != nil {
+		log.Println(err)
+		exitcode = 1
+		return
+	}
+
+	// Software emulation of the build VM when KVM isn't used
+	var accelArgs []string
+	kvm := debos.CheckKVM()
+	if !options.DisableFakeMachine && !fakemachine.InMachine() {
+		mode := options.KVM
+		if options.NoKVM {
+			mode = "off"
+		}
+		if accelArgs, err = debos.QemuAccelArgs(mode, kvm); err != nil {
+			log.Println(err)
+			exitcode = 1
+			return
+		}
+	}
+	useMachine := !options.DisableFakeMachine &&
+		(fakemachine.InMachine() || fakemachine.Supported() || len(accelArgs) > 0)
+
 	// Set interactive shell binary only if '--debug-shell' options passed
 	if options.DebugShell {
 		context.DebugShell = options.Shell
 	}
+	if options.ShellOnFailure {
+		context.ShellOnFailure = options.Shell
+	}
+	context.KeepOnFailure = options.KeepOnFailure
+	context.Interactive = options.Interactive
+	context.Shell = options.Shell
 
 	if options.PrintRecipe {
 		context.PrintRecipe = options.PrintRecipe
@@ -141,16 +460,34 @@ func main() {
 		return
 	}
 
+	// The command line takes precedence over the recipe
+	memory, cpus := r.Memory, r.Cpus
+	if options.Memory != "" {
+		memory = options.Memory
+	}
+	if options.CPUs != 0 {
+		cpus = options.CPUs
+	}
+	memsize, numcpus, err := actions.MachineResources(memory, cpus)
+	if err != nil {
+		log.Println(err)
+		exitcode = 1
+		return
+	}
+
 	/* If fakemachine is supported the outer fake machine will never use the
 	 * scratchdir, so just set it to /scratch as a dummy to prevent the
 	 * outer debos creating a temporary direction */
-	if !options.DisableFakeMachine && (fakemachine.InMachine() || fakemachine.Supported()) {
+	if useMachine {
 		context.Scratchdir = "/scratch"
 	} else {
 		log.Printf("fakemachine not supported, running on the host!")
+		if memory != "" || cpus != 0 {
+			log.Printf("Warning: the memory and CPUs of the build VM are ignored without fakemachine")
+		}
 		cwd, _ := os.Getwd()
 		context.Scratchdir, err = ioutil.TempDir(cwd, ".debos-")
-		defer os.RemoveAll(context.Scratchdir)
+		defer removeAll(&context, context.Scratchdir)
 	}
 
 	context.Rootdir = path.Join(context.Scratchdir, "root")
@@ -164,15 +501,66 @@ func main() {
 	context.Artifactdir = debos.CleanPath(context.Artifactdir)
 
 	// Initialise origins map
-	context.Origins = make(map[string]string)
-	context.Origins["artifacts"] = context.Artifactdir
-	context.Origins["filesystem"] = context.Rootdir
-	context.Origins["recipe"] = context.RecipeDir
+	context.Origins = debos.DefaultOrigins(&context)
 
 	context.Architecture = r.Architecture
 
 	context.State = debos.Success
 
+	// Initialize build time variables map
+	context.Variables = make(map[string]string)
+
+	context.AptProxy = r.AptProxy
+	context.AptCacheClean = r.AptCacheClean
+	context.AptSnapshot = r.AptSnapshot
+	context.ChrootPath = r.PathPrepend
+	context.ChrootEnv = r.Env
+	if r.AptCache != "" {
+		context.AptCache = debos.CleanPathAt(r.AptCache, context.RecipeDir)
+	}
+	if r.Ccache != "" {
+		context.CcacheDir = debos.CleanPathAt(r.Ccache, context.RecipeDir)
+	}
+	if options.DebootstrapCache != "" {
+		context.DebootstrapCache = debos.CleanPath(options.DebootstrapCache)
+	}
+	context.DebootstrapCacheRefresh = options.DebootstrapCacheRefresh
+	if options.MaxParallel < 0 {
+		log.Printf("Invalid --max-parallel %d", options.MaxParallel)
+		exitcode = 1
+		return
+	}
+	context.MaxParallel = options.MaxParallel
+	context.Netrc = netrcFile(options.Netrc)
+	if options.Netrc != "" && context.Netrc == "" {
+		log.Printf("Couldn't read netrc file %s", options.Netrc)
+		exitcode = 1
+		return
+	}
+
+	// A dry run leaves the host untouched
+	if context.AptCache != "" && !options.DryRun {
+		if err := os.MkdirAll(path.Join(context.AptCache, "partial"), 0755); err != nil {
+			log.Printf("Couldn't create apt cache: %v", err)
+			exitcode = 1
+			return
+		}
+	}
+	if context.CcacheDir != "" && !options.DryRun {
+		if err := os.MkdirAll(context.CcacheDir, 0755); err != nil {
+			log.Printf("Couldn't create ccache directory: %v", err)
+			exitcode = 1
+			return
+		}
+	}
+	if context.DebootstrapCache != "" && !options.DryRun {
+		if err := os.MkdirAll(context.DebootstrapCache, 0755); err != nil {
+			log.Printf("Couldn't create debootstrap cache: %v", err)
+			exitcode = 1
+			return
+		}
+	}
+
 	// Initialize environment variables map
 	context.EnvironVars = make(map[string]string)
 
@@ -191,6 +579,13 @@ func main() {
 		}
 	}
 
+	// Then the variables the recipe asks to forward from the host
+	for _, e := range r.PassEnv {
+		if v, ok := os.LookupEnv(e); ok {
+			context.EnvironVars[e] = v
+		}
+	}
+
 	// Then add/overwrite with variables from command line
 	for k, v := range options.EnvironVars {
 		// Allows the user to unset environ variables with -e
@@ -208,32 +603,64 @@ func main() {
 		}
 	}
 
+	// Keys hash the inputs of the actions, only worth it with checkpoints
+	var plan *checkpoints
+	if len(options.Checkpoints) > 0 || options.From != "" {
+		plan, err = planCheckpoints(r, &context, options.Checkpoints, options.From)
+		if err != nil {
+			log.Println(err)
+			exitcode = 1
+			return
+		}
+	}
+
 	if options.DryRun {
+		for _, a := range r.Actions {
+			err = a.DryRun(&context)
+			if exitcode = checkError(&context, err, a, "DryRun"); exitcode != 0 {
+				return
+			}
+		}
+
+		if files := r.UndefinedVariables(); len(files) > 0 {
+			log.Printf("Undefined template variables used in: %s", strings.Join(files, ", "))
+			exitcode = 1
+			return
+		}
+
+		if variables := r.DescribeVariables(); len(variables) > 0 {
+			log.Printf("Template variables:")
+			for _, v := range variables {
+				log.Printf("  %s", v)
+			}
+		}
+
+		log.Printf("Actions to run:")
+		logActions(r, "  ")
 		log.Printf("==== Recipe done (Dry run) ====")
 		return
 	}
 
-	if !options.DisableFakeMachine && !fakemachine.InMachine() && fakemachine.Supported() {
+	handleSignals(&context)
+
+	if useMachine && !fakemachine.InMachine() {
 		m := fakemachine.NewMachine()
 		var args []string
 
-		if options.Memory == "" {
-			// Set default memory size for fakemachine
-			options.Memory = "2Gb"
-		}
-		memsize, err := units.RAMInBytes(options.Memory)
-		if err != nil {
-			fmt.Printf("Couldn't parse memory size: %v\n", err)
-			exitcode = 1
-			return
+		if len(accelArgs) > 0 {
+			reason := "KVM is disabled"
+			if kvm != nil {
+				reason = fmt.Sprintf("KVM isn't available (%v)", kvm)
+			}
+			log.Printf("==== Warning: %s, the build VM uses software emulation and will be much slower ====", reason)
+			m.AppendQemuArgs(accelArgs...)
 		}
-		m.SetMemory(int(memsize / 1024 / 1024))
-
-		if options.CPUs == 0 {
-			// Set default CPU count for fakemachine
-			options.CPUs = 2
+		if numcpus > runtime.NumCPU() {
+			log.Printf("Warning: the build VM has %d CPUs but the host only %d", numcpus, runtime.NumCPU())
 		}
-		m.SetNumCPUs(options.CPUs)
+		log.Printf("Build VM with %dMB of memory and %d CPUs", memsize, numcpus)
+		m.SetMemory(memsize)
+		m.SetNumCPUs(numcpus)
 
 		if options.ScratchSize != "" {
 			size, err := units.FromHumanSize(options.ScratchSize)
@@ -247,6 +674,11 @@ func main() {
 
 		m.SetShowBoot(options.ShowBoot)
 
+		if len(qemuArgs) > 0 {
+			log.Printf("Extra qemu arguments: %s", strings.Join(qemuArgs, " "))
+			m.AppendQemuArgs(qemuArgs...)
+		}
+
 		// Puts in a format that is compatible with output of os.Environ()
 		if context.EnvironVars != nil {
 			EnvironString := []string{}
@@ -269,16 +701,57 @@ func main() {
 		}
 
 		m.AddVolume(context.RecipeDir)
+		if context.AptCache != "" {
+			m.AddVolume(context.AptCache)
+		}
+		if context.CcacheDir != "" {
+			m.AddVolume(context.CcacheDir)
+		}
+		if context.DebootstrapCache != "" {
+			m.AddVolume(context.DebootstrapCache)
+			args = append(args, "--debootstrap-cache", context.DebootstrapCache)
+		}
+		if context.DebootstrapCacheRefresh {
+			args = append(args, "--debootstrap-cache-refresh")
+		}
+		if context.MaxParallel > 0 {
+			args = append(args, "--max-parallel", fmt.Sprintf("%d", context.MaxParallel))
+		}
+		if context.Netrc != "" {
+			m.AddVolume(path.Dir(context.Netrc))
+			args = append(args, "--netrc", context.Netrc)
+		}
 		args = append(args, file)
+		args = append(args, "--log-format", options.LogFormat)
+		if options.SetupBinfmt {
+			args = append(args, "--setup-binfmt")
+		}
+		for _, c := range options.Checkpoints {
+			args = append(args, "--checkpoint", fmt.Sprintf("\"%s\"", c))
+		}
+		if options.From != "" {
+			args = append(args, "--from", fmt.Sprintf("\"%s\"", options.From))
+		}
 
 		if options.DebugShell {
 			args = append(args, "--debug-shell")
+		}
+		if options.ShellOnFailure {
+			args = append(args, "--shell-on-failure")
+		}
+		if options.Interactive {
+			args = append(args, "--interactive")
+		}
+		if options.DebugShell || options.ShellOnFailure || options.Interactive {
 			args = append(args, "--shell", fmt.Sprintf("%s", options.Shell))
 		}
+		if options.KeepOnFailure {
+			args = append(args, "--keep-on-failure")
+		}
 
 		for _, a := range r.Actions {
 			// Stack PostMachineCleanup methods
-			defer a.PostMachineCleanup(&context)
+			defer postMachineCleanup(&context, a.Action)
 
 			err = a.PreMachine(&context, m, &args)
 			if exitcode = checkError(&context, err, a, "PreMachine"); exitcode != 0 {
@@ -298,6 +771,9 @@ func main() {
 		}
 
 		for _, a := range r.Actions {
+			if exitcode = checkInterrupted(&context, a, "PostMachine"); exitcode != 0 {
+				return
+			}
 			err = a.PostMachine(&context)
 			if exitcode = checkError(&context, err, a, "Postmachine"); exitcode != 0 {
 				return
@@ -308,10 +784,24 @@ func main() {
 		return
 	}
 
+	// Foreign chroots need qemu-user, fail before running anything without it
+	if err = debos.CheckBinfmt(context.Architecture); err != nil && options.SetupBinfmt {
+		if os.Getuid() != 0 {
+			err = fmt.Errorf("%v\n--setup-binfmt requires to be root", err)
+		} else if err = debos.SetupBinfmt(context.Architecture); err == nil {
+			err = debos.CheckBinfmt(context.Architecture)
+		}
+	}
+	if err != nil {
+		log.Println(err)
+		exitcode = 1
+		return
+	}
+
 	if !fakemachine.InMachine() {
 		for _, a := range r.Actions {
 			// Stack PostMachineCleanup methods
-			defer a.PostMachineCleanup(&context)
+			defer postMachineCleanup(&context, a.Action)
 
 			err = a.PreNoMachine(&context)
 			if exitcode = checkError(&context, err, a, "PreNoMachine"); exitcode != 0 {
@@ -329,13 +819,24 @@ func main() {
 		}
 	}
 
-	exitcode = do_run(r, &context)
+	// The intermediate files of the actions only last for the build
+	if err = os.MkdirAll(context.Origins["scratch"], 0755); err != nil {
+		log.Printf("Couldn't create scratch directory: %v", err)
+		exitcode = 1
+		return
+	}
+	defer removeAll(&context, context.Origins["scratch"])
+
+	exitcode = do_run(r, &context, plan)
 	if exitcode != 0 {
 		return
 	}
 
 	if !fakemachine.InMachine() {
 		for _, a := range r.Actions {
+			if exitcode = checkInterrupted(&context, a, "PostMachine"); exitcode != 0 {
+				return
+			}
 			err = a.PostMachine(&context)
 			if exitcode = checkError(&context, err, a, "PostMachine"); exitcode != 0 {
 				return
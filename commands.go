@@ -2,6 +2,7 @@ package debos
 
 import (
 	"bytes"
+	gocontext "context"
 	"crypto/sha256"
 	"fmt"
 	"io"
@@ -10,6 +11,9 @@ import (
 	"os"
 	"os/exec"
 	"path"
+	"strings"
+	"syscall"
+	"time"
 )
 
 type ChrootEnterMethod int
@@ -20,35 +24,57 @@ const (
 	CHROOT_METHOD_CHROOT        // use chroot to create the chroot environment
 )
 
+// How the output of the commands is logged
+type CommandOutput int
+
+const (
+	OUTPUT_DEFAULT = iota // Log the output as it comes
+	OUTPUT_QUIET          // Only log the output of failed commands
+	OUTPUT_VERBOSE        // Log the command line before the output
+)
+
 type Command struct {
 	Architecture string            // Architecture of the chroot, nil if same as host
 	Dir          string            // Working dir to run command in
 	Chroot       string            // Run in the chroot at path
 	ChrootMethod ChrootEnterMethod // Method to enter the chroot
-
-	bindMounts []string /// Items to bind mount
-	extraEnv   []string // Extra environment variables to set
+	Context      gocontext.Context // Terminate the command when done, nil if never
+	Output       CommandOutput     // How the output is logged
+	Stdout       io.Writer         // Also gets the standard output when set
+	Stderr       io.Writer         // Also gets the standard error when set
+	Interactive  bool              // Attached to the terminal of debos, its output isn't logged
+
+	bindMounts         []string /// Items to bind mount
+	bindMountsReadOnly []string // Items to bind mount read-only
+	extraEnv           []string // Extra environment variables to set
 }
 
+// Default PATH of the commands run in the target rootfs
+const ChrootDefaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// Time given to a cancelled command to exit after SIGTERM before SIGKILL
+var killDelay = 10 * time.Second
+
 type commandWrapper struct {
 	label  string
 	buffer *bytes.Buffer
+	quiet  bool // Hold the output until the command is done
 }
 
-func newCommandWrapper(label string) *commandWrapper {
+func newCommandWrapper(label string, quiet bool) *commandWrapper {
 	b := bytes.Buffer{}
-	return &commandWrapper{label, &b}
+	return &commandWrapper{label, &b, quiet}
 }
 
 func (w commandWrapper) out(atEOF bool) {
 	for {
 		s, err := w.buffer.ReadString('\n')
 		if err == nil {
-			log.Printf("%s | %v", w.label, s)
+			logCommandOutput(w.label, s)
 		} else {
 			if len(s) > 0 {
 				if atEOF && err == io.EOF {
-					log.Printf("%s | %v\n", w.label, s)
+					logCommandOutput(w.label, s+"\n")
 				} else {
 					w.buffer.WriteString(s)
 				}
@@ -60,16 +86,36 @@ func (w commandWrapper) out(atEOF bool) {
 
 func (w commandWrapper) Write(p []byte) (n int, err error) {
 	n, err = w.buffer.Write(p)
-	w.out(false)
+	if !w.quiet {
+		w.out(false)
+	}
 	return
 }
 
-func (w *commandWrapper) flush() {
+// Log the rest of the output, the held output of a quiet command only if it failed
+func (w *commandWrapper) flush(failed bool) {
+	if w.quiet && !failed {
+		w.buffer.Reset()
+		return
+	}
 	w.out(true)
 }
 
+/* Command on the host terminated when the running action times out, logging
+ * its output as the action asks */
+func NewCommandForContext(context DebosContext) Command {
+	return Command{Context: context.Ctx, Output: context.CommandOutput}
+}
+
+// PATH of the commands run in the target rootfs, with the directories of the recipe first
+func ChrootPathForContext(context DebosContext) string {
+	return strings.Join(append(append([]string{}, context.ChrootPath...), ChrootDefaultPath), ":")
+}
+
 func NewChrootCommandForContext(context DebosContext) Command {
 	c := Command{Architecture: context.Architecture, Chroot: context.Rootdir, ChrootMethod: CHROOT_METHOD_NSPAWN}
+	c.Context = context.Ctx
+	c.Output = context.CommandOutput
 
 	if context.EnvironVars != nil {
 		for k, v := range context.EnvironVars {
@@ -77,6 +123,14 @@ func NewChrootCommandForContext(context DebosContext) Command {
 		}
 	}
 
+	// Set after the forwarded variables to take precedence over them
+	for k, v := range context.ChrootEnv {
+		c.AddEnvKey(k, v)
+	}
+	if len(context.ChrootPath) > 0 {
+		c.AddEnvKey("PATH", ChrootPathForContext(context))
+	}
+
 	if context.Image != "" {
 		path, err := RealPath(context.Image)
 		if err == nil {
@@ -117,6 +171,17 @@ func (cmd *Command) AddBindMount(source, target string) {
 	cmd.bindMounts = append(cmd.bindMounts, mount)
 }
 
+func (cmd *Command) AddBindMountReadOnly(source, target string) {
+	var mount string
+	if target != "" {
+		mount = fmt.Sprintf("%s:%s", source, target)
+	} else {
+		mount = source
+	}
+
+	cmd.bindMountsReadOnly = append(cmd.bindMountsReadOnly, mount)
+}
+
 func (cmd *Command) saveResolvConf() (*[sha256.Size]byte, error) {
 	hostconf := "/etc/resolv.conf"
 	chrootedconf := path.Join(cmd.Chroot, hostconf)
@@ -209,6 +274,17 @@ func (cmd *Command) restoreResolvConf(sum *[sha256.Size]byte) error {
 }
 
 func (cmd Command) Run(label string, cmdline ...string) error {
+	w := newCommandWrapper(label, cmd.Output == OUTPUT_QUIET)
+	if cmd.Output == OUTPUT_VERBOSE {
+		logCommandOutput(label, fmt.Sprintf("+ %s\n", strings.Join(cmdline, " ")))
+	}
+
+	err := cmd.run(w, cmdline)
+	w.flush(err != nil)
+	return err
+}
+
+func (cmd Command) run(w *commandWrapper, cmdline []string) error {
 	q := newQemuHelper(cmd)
 	q.Setup()
 	defer q.Cleanup()
@@ -234,18 +310,29 @@ func (cmd Command) Run(label string, cmdline ...string) error {
 			options = append(options, "--bind", b)
 
 		}
+		for _, b := range cmd.bindMountsReadOnly {
+			options = append(options, "--bind-ro", b)
+		}
 		options = append(options, "-D", cmd.Chroot)
 		options = append(options, cmdline...)
 	}
 
 	exe := exec.Command(options[0], options[1:]...)
-	w := newCommandWrapper(label)
 
 	exe.Stdin = nil
 	exe.Stdout = w
 	exe.Stderr = w
-
-	defer w.flush()
+	if cmd.Stdout != nil {
+		exe.Stdout = io.MultiWriter(w, cmd.Stdout)
+	}
+	if cmd.Stderr != nil {
+		exe.Stderr = io.MultiWriter(w, cmd.Stderr)
+	}
+	if cmd.Interactive {
+		exe.Stdin = os.Stdin
+		exe.Stdout = os.Stdout
+		exe.Stderr = os.Stderr
+	}
 
 	if len(cmd.extraEnv) > 0 && cmd.ChrootMethod != CHROOT_METHOD_NSPAWN {
 		exe.Env = append(os.Environ(), cmd.extraEnv...)
@@ -264,16 +351,50 @@ func (cmd Command) Run(label string, cmdline ...string) error {
 		return err
 	}
 
-	if err = exe.Run(); err != nil {
+	if cmd.Context != nil {
+		// Own process group, so the whole tree can be terminated
+		exe.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	}
+
+	if err = exe.Start(); err != nil {
 		return err
 	}
 
-	// Restore the original resolv.conf if not changed
-	if err = cmd.restoreResolvConf(resolvsum); err != nil {
+	// Restore the original resolv.conf if not changed, even when the
+	// command failed as the caller may expect it to
+	err = cmd.wait(exe)
+	if rerr := cmd.restoreResolvConf(resolvsum); err == nil {
+		err = rerr
+	}
+
+	return err
+}
+
+// Wait for the command, sending SIGTERM then SIGKILL once its context is done
+func (cmd Command) wait(exe *exec.Cmd) error {
+	if cmd.Context == nil {
+		return exe.Wait()
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- exe.Wait() }()
+
+	select {
+	case err := <-done:
 		return err
+	case <-cmd.Context.Done():
 	}
 
-	return nil
+	pgid := -exe.Process.Pid
+	syscall.Kill(pgid, syscall.SIGTERM)
+	select {
+	case <-done:
+	case <-time.After(killDelay):
+		syscall.Kill(pgid, syscall.SIGKILL)
+		<-done
+	}
+
+	return cmd.Context.Err()
 }
 
 type qemuHelper struct {
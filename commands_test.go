@@ -1,9 +1,85 @@
 package debos
 
 import (
+	"bytes"
+	"context"
+	"log"
+	"os"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestBasicCommand(t *testing.T) {
 	Command{}.Run("out", "ls", "-l")
 }
+
+func TestCommandContext(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err := Command{Context: ctx}.Run("sleep", "sh", "-c", "sleep 60; true")
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.True(t, time.Since(start) < 10*time.Second)
+
+	// Commands ignoring SIGTERM get killed
+	saved := killDelay
+	killDelay = 100 * time.Millisecond
+	defer func() { killDelay = saved }()
+
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	err = Command{Context: ctx}.Run("trap", "sh", "-c", "trap '' TERM; sleep 60; true")
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.True(t, time.Since(start) < 10*time.Second)
+
+	assert.Empty(t, Command{Context: context.Background()}.Run("true", "true"))
+}
+
+func TestCommandOutput(t *testing.T) {
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+
+	assert.Empty(t, Command{}.Run("echo", "echo", "hello"))
+	assert.Contains(t, out.String(), "echo | hello")
+
+	// Quiet commands only log their output when they fail
+	out.Reset()
+	assert.Empty(t, Command{Output: OUTPUT_QUIET}.Run("echo", "echo", "hello"))
+	assert.Empty(t, out.String())
+	assert.Error(t, Command{Output: OUTPUT_QUIET}.Run("fail", "sh", "-c", "echo failing; false"))
+	assert.Contains(t, out.String(), "fail | failing")
+
+	out.Reset()
+	assert.Empty(t, Command{Output: OUTPUT_VERBOSE}.Run("echo", "echo", "hello"))
+	assert.Contains(t, out.String(), "echo | + echo hello\n")
+	assert.Contains(t, out.String(), "echo | hello")
+
+	// Actions set the output of the commands they run
+	out.Reset()
+	context := DebosContext{&CommonContext{}, "", ""}
+	assert.Empty(t, RunAction(&context, &echoAction{BaseAction: BaseAction{Action: "echo", Quiet: true}}))
+	assert.NotContains(t, out.String(), "hello")
+	assert.Equal(t, CommandOutput(OUTPUT_DEFAULT), context.CommandOutput)
+}
+
+func TestChrootCommandEnv(t *testing.T) {
+	context := DebosContext{&CommonContext{}, "", ""}
+	context.EnvironVars = map[string]string{"CC": "gcc"}
+
+	cmd := NewChrootCommandForContext(context)
+	assert.Equal(t, []string{"CC=gcc"}, cmd.extraEnv)
+
+	context.ChrootEnv = map[string]string{"CC": "clang"}
+	context.ChrootPath = []string{"/opt/toolchain/bin", "/usr/lib/wrappers"}
+	assert.Equal(t, "/opt/toolchain/bin:/usr/lib/wrappers:"+ChrootDefaultPath, ChrootPathForContext(context))
+
+	// The recipe variables come last so they take precedence
+	cmd = NewChrootCommandForContext(context)
+	assert.Equal(t, []string{"CC=gcc", "CC=clang",
+		"PATH=/opt/toolchain/bin:/usr/lib/wrappers:" + ChrootDefaultPath}, cmd.extraEnv)
+}
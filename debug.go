@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path"
 )
 
 /*
@@ -29,3 +30,36 @@ func DebugShell(context DebosContext) {
 		proc.Wait()
 	}
 }
+
+/* Start an interactive shell in the target rootfs, falling back to '/bin/sh'
+ * when the shell isn't installed there */
+func ChrootShell(context DebosContext, shell string) {
+	if _, err := os.Stat(path.Join(context.Rootdir, shell)); err != nil {
+		shell = "/bin/sh"
+	}
+
+	log.Printf(">>> Starting a shell in %s, exit it to carry on", context.Rootdir)
+	cmd := NewChrootCommandForContext(context)
+	// Not cancelled, the user is in charge
+	cmd.Context = nil
+	cmd.Interactive = true
+	if err := cmd.Run("shell", shell); err != nil {
+		log.Printf("Shell exited: %v", err)
+	}
+}
+
+// Log where the state of the failed build is kept
+func LogBuildState(context DebosContext) {
+	log.Printf("Keeping the state of the failed build:")
+	log.Printf("  rootfs: %s", context.Rootdir)
+	log.Printf("  scratch directory: %s", context.Scratchdir)
+	if context.Image != "" {
+		log.Printf("  image: %s", context.Image)
+	}
+	if context.ImageMntDir != "" {
+		log.Printf("  image mounted on: %s", context.ImageMntDir)
+	}
+	for _, p := range context.ImagePartitions {
+		log.Printf("  partition %s: %s", p.Name, p.DevicePath)
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"syscall"
 )
 
 func CleanPathAt(path, at string) string {
@@ -57,6 +58,46 @@ func CopyFile(src, dst string, mode os.FileMode) error {
 	return nil
 }
 
+// Copy the extended attributes of src to dst, like the file capabilities in
+// 'security.capability', but the SELinux label which is the one of the host.
+// Symbolic links are left alone.
+func CopyXattrs(src, dst string) error {
+	if info, err := os.Lstat(src); err != nil || info.Mode()&os.ModeSymlink != 0 {
+		return err
+	}
+
+	size, err := syscall.Listxattr(src, nil)
+	if err == syscall.ENOTSUP || size == 0 {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	list := make([]byte, size)
+	if size, err = syscall.Listxattr(src, list); err != nil {
+		return err
+	}
+
+	for _, name := range strings.Split(strings.TrimRight(string(list[:size]), "\x00"), "\x00") {
+		if name == "security.selinux" {
+			continue
+		}
+		size, err := syscall.Getxattr(src, name, nil)
+		if err != nil {
+			return fmt.Errorf("Couldn't read %s of %s: %v", name, src, err)
+		}
+		value := make([]byte, size)
+		if size, err = syscall.Getxattr(src, name, value); err != nil {
+			return fmt.Errorf("Couldn't read %s of %s: %v", name, src, err)
+		}
+		if err := syscall.Setxattr(dst, name, value[:size], 0); err != nil {
+			return fmt.Errorf("Couldn't set %s of %s: %v", name, dst, err)
+		}
+	}
+
+	return nil
+}
+
 func CopyTree(sourcetree, desttree string) error {
 	fmt.Printf("Overlaying %s on %s\n", sourcetree, desttree)
 	walker := func(p string, info os.FileInfo, err error) error {
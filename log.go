@@ -0,0 +1,140 @@
+package debos
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Record of the json log format, one per line
+type logRecord struct {
+	Timestamp string  `json:"timestamp"`
+	Level     string  `json:"level"`
+	Action    string  `json:"action,omitempty"`
+	Command   string  `json:"command,omitempty"`
+	Phase     string  `json:"phase,omitempty"`
+	Duration  float64 `json:"duration,omitempty"` // In seconds
+	Percent   *int    `json:"percent,omitempty"`
+	Done      int64   `json:"done,omitempty"`
+	Total     int64   `json:"total,omitempty"`
+	Message   string  `json:"message"`
+}
+
+var logger struct {
+	sync.Mutex
+	out    io.Writer
+	json   bool
+	action string // Action being run, tags the records
+}
+
+// Turns each message of the standard logger into a record
+type jsonLogWriter struct{}
+
+func (w jsonLogWriter) Write(p []byte) (int, error) {
+	message := strings.TrimSuffix(string(p), "\n")
+
+	level := "info"
+	if strings.HasPrefix(strings.ToLower(message), "warning") {
+		level = "warning"
+	}
+
+	writeLogRecord(logRecord{Level: level, Message: message})
+	return len(p), nil
+}
+
+func writeLogRecord(r logRecord) {
+	logger.Lock()
+	defer logger.Unlock()
+
+	r.Timestamp = time.Now().UTC().Format(time.RFC3339Nano)
+	if r.Action == "" {
+		r.Action = logger.action
+	}
+
+	line, err := json.Marshal(r)
+	if err != nil {
+		// Can't happen with strings and numbers only
+		panic(err)
+	}
+	logger.out.Write(append(line, '\n'))
+}
+
+/* Set the format of the log, either 'text', the default human readable
+ * format, or 'json' to get one JSON object per line */
+func SetLogFormat(format string) error {
+	switch format {
+	case "text":
+		logger.json = false
+		log.SetOutput(os.Stderr)
+		log.SetFlags(log.LstdFlags)
+	case "json":
+		logger.out = os.Stderr
+		logger.json = true
+		log.SetOutput(jsonLogWriter{})
+		log.SetFlags(0)
+	default:
+		return fmt.Errorf("Unsupported log format '%s', expected text or json", format)
+	}
+
+	return nil
+}
+
+// Log a message with the error level
+func LogError(format string, v ...interface{}) {
+	if !logger.json {
+		log.Printf(format, v...)
+		return
+	}
+
+	writeLogRecord(logRecord{Level: "error", Message: fmt.Sprintf(format, v...)})
+}
+
+// Log a line of the output of a command run for the current action
+func logCommandOutput(label, line string) {
+	if !logger.json {
+		log.Printf("%s | %v", label, line)
+		return
+	}
+
+	writeLogRecord(logRecord{Level: "info", Command: label,
+		Message: strings.TrimSuffix(line, "\n")})
+}
+
+// Tag the records with the action, returns the previous one
+func setLogAction(action string) string {
+	logger.Lock()
+	defer logger.Unlock()
+
+	previous := logger.action
+	logger.action = action
+	return previous
+}
+
+func logActionStart(action string) {
+	if !logger.json {
+		log.Printf("==== %s ====\n", action)
+		return
+	}
+
+	writeLogRecord(logRecord{Level: "info", Phase: "start", Message: "Started " + action})
+}
+
+// Only logged in the json format, the text format has no end marker
+func logActionEnd(action string, duration time.Duration, err error) {
+	if !logger.json {
+		return
+	}
+
+	r := logRecord{Level: "info", Phase: "end", Duration: duration.Seconds(),
+		Message: "Finished " + action}
+	if err != nil {
+		r.Level = "error"
+		r.Message = fmt.Sprintf("Failed %s: %v", action, err)
+	}
+	writeLogRecord(r)
+}
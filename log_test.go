@@ -0,0 +1,80 @@
+package debos
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type echoAction struct {
+	BaseAction
+	fail bool
+}
+
+func (e *echoAction) Run(context *DebosContext) error {
+	e.LogStart()
+	if err := NewCommandForContext(*context).Run("echo", "echo", "hello"); err != nil {
+		return err
+	}
+	if e.fail {
+		return errors.New("failed on purpose")
+	}
+	return nil
+}
+
+func readLogRecords(t *testing.T, out *bytes.Buffer) []logRecord {
+	var records []logRecord
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var r logRecord
+		assert.Empty(t, json.Unmarshal([]byte(line), &r))
+		assert.NotEmpty(t, r.Timestamp)
+		records = append(records, r)
+	}
+	out.Reset()
+	return records
+}
+
+func TestJsonLog(t *testing.T) {
+	var out bytes.Buffer
+
+	assert.Empty(t, SetLogFormat("json"))
+	defer SetLogFormat("text")
+	logger.out = &out
+
+	context := DebosContext{&CommonContext{}, "", ""}
+	a := &echoAction{BaseAction: BaseAction{Action: "echo", Description: "say hello"}}
+	assert.Empty(t, RunAction(&context, a))
+
+	records := readLogRecords(t, &out)
+	assert.Len(t, records, 3)
+	assert.Equal(t, "start", records[0].Phase)
+	assert.Equal(t, "say hello", records[0].Action)
+	assert.Equal(t, "echo", records[1].Command)
+	assert.Equal(t, "hello", records[1].Message)
+	assert.Equal(t, "say hello", records[1].Action)
+	assert.Equal(t, "end", records[2].Phase)
+	assert.Equal(t, "info", records[2].Level)
+
+	a.fail = true
+	assert.Error(t, RunAction(&context, a))
+	records = readLogRecords(t, &out)
+	assert.Equal(t, "error", records[2].Level)
+	assert.Equal(t, "Failed say hello: failed on purpose", records[2].Message)
+
+	// Outside of actions, standard log messages are turned into records too
+	log.Printf("Warning: something odd")
+	LogError("Something failed")
+	records = readLogRecords(t, &out)
+	assert.Len(t, records, 2)
+	assert.Equal(t, "warning", records[0].Level)
+	assert.Equal(t, "", records[0].Action)
+	assert.Equal(t, "error", records[1].Level)
+	assert.Equal(t, "Something failed", records[1].Message)
+
+	assert.EqualError(t, SetLogFormat("xml"), "Unsupported log format 'xml', expected text or json")
+}
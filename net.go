@@ -1,16 +1,56 @@
 package debos
 
 import (
+	gocontext "context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
+	neturl "net/url"
 	"os"
+	"path"
+	"strings"
 )
 
-// Function for downloading single file object with http(s) protocol
-func DownloadHttpUrl(url, filename string) error {
-	log.Printf("Download started: '%s' -> '%s'\n", url, filename)
+// Attempts of a download interrupted by a network error, each one resuming it
+var downloadAttempts = 3
+
+// Error status returned by the server, retrying the download won't help
+type httpStatusError struct {
+	url  string
+	code int
+}
+
+func (e httpStatusError) Error() string {
+	return fmt.Sprintf("Url '%s' returned status code %d (%s)\n", e.url, e.code, http.StatusText(e.code))
+}
+
+// Options of a download
+type DownloadOptions struct {
+	Sha256  string            // Checksum of the file, not checked if empty
+	Headers map[string]string // Headers of the requests, their values are never logged
+	Netrc   string            // File with the credentials of the servers, if any
+}
+
+// Function for downloading single file object with http(s) protocol, the
+// download is aborted once ctx is done if not nil
+func DownloadHttpUrl(ctx gocontext.Context, url, filename string) error {
+	return DownloadHttpUrlWithOptions(ctx, url, filename, DownloadOptions{})
+}
+
+/* Download a single file object with http(s) protocol. The file is downloaded
+ * to '<filename>.part' and only renamed once complete, interrupted downloads
+ * are resumed with range requests when the server supports them. A resumed
+ * download which doesn't match the checksum is downloaded again from the
+ * start, as the partial file might have been corrupted.
+ *
+ * Unless the headers have an 'Authorization' one, the credentials of the
+ * server in the netrc file are used. */
+func DownloadHttpUrlWithOptions(ctx gocontext.Context, url, filename string, options DownloadOptions) error {
+	log.Printf("Download started: '%s' -> '%s'\n", redactURL(url), filename)
 
 	// TODO: Proxy support?
 
@@ -20,26 +60,251 @@ func DownloadHttpUrl(url, filename string) error {
 		return fmt.Errorf("Failed to download '%s': '%s' exists and it is not a regular file\n", url, filename)
 	}
 
-	resp, err := http.Get(url)
+	header, err := downloadHeader(url, options)
 	if err != nil {
 		return err
 	}
+
+	sum := options.Sha256
+	part := filename + ".part"
+	for restarted := false; ; restarted = true {
+		resumed, err := downloadRetrying(ctx, url, part, header)
+		if err != nil {
+			return err
+		}
+		if sum == "" {
+			break
+		}
+
+		actual, err := fileSha256(part)
+		if err != nil {
+			return err
+		}
+		if actual == sum {
+			break
+		}
+		os.Remove(part)
+		if !resumed || restarted {
+			return fmt.Errorf("Checksum of '%s' is %s instead of %s", redactURL(url), actual, sum)
+		}
+		log.Printf("Checksum of resumed download of '%s' doesn't match, downloading it again", redactURL(url))
+	}
+
+	return os.Rename(part, filename)
+}
+
+/* Download to the partial file, resuming on network errors. Returns whether
+ * any part was resumed rather than downloaded from the start */
+func downloadRetrying(ctx gocontext.Context, url, part string, header http.Header) (bool, error) {
+	resumed := false
+	for attempt := 1; ; attempt++ {
+		r, err := downloadPart(ctx, url, part, header)
+		resumed = resumed || r
+		if err == nil {
+			return resumed, nil
+		}
+
+		if _, status := err.(httpStatusError); status || attempt == downloadAttempts ||
+			(ctx != nil && ctx.Err() != nil) {
+			return resumed, err
+		}
+		log.Printf("Download of '%s' interrupted: %v, resuming", redactURL(url), err)
+	}
+}
+
+/* Download to the partial file, from its current size when the server supports
+ * range requests. Returns whether the download was resumed */
+func downloadPart(ctx gocontext.Context, url, part string, header http.Header) (bool, error) {
+	var offset int64
+	if fi, err := os.Stat(part); err == nil {
+		offset = fi.Size()
+	}
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return false, err
+	}
+	if ctx != nil {
+		req = req.WithContext(ctx)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false, err
+	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("Url '%s' returned status code %d (%s)\n", url, resp.StatusCode, http.StatusText(resp.StatusCode))
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		if offset == 0 || !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)) {
+			return false, fmt.Errorf("Url '%s' returned unexpected range '%s'", redactURL(url), resp.Header.Get("Content-Range"))
+		}
+		flags = os.O_WRONLY | os.O_APPEND
+	case http.StatusOK:
+		if offset > 0 {
+			log.Printf("Server of '%s' doesn't support resuming, downloading it from the start", redactURL(url))
+			offset = 0
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		// The partial file is bigger than the file, start over
+		if offset > 0 {
+			if err := os.Remove(part); err != nil {
+				return false, err
+			}
+			return downloadPart(ctx, url, part, header)
+		}
+		fallthrough
+	default:
+		return false, httpStatusError{redactURL(url), resp.StatusCode}
 	}
 
 	// Output file
-	output, err := os.Create(filename)
+	output, err := os.OpenFile(part, flags, 0644)
 	if err != nil {
-		return err
+		return false, err
 	}
 	defer output.Close()
 
-	if _, err := io.Copy(output, resp.Body); err != nil {
-		return err
+	var total int64
+	if resp.ContentLength >= 0 {
+		total = offset + resp.ContentLength
+	}
+	progress := NewBytesProgress("Download "+path.Base(strings.TrimSuffix(part, ".part")), total)
+	progress.done = offset
+	if _, err := io.Copy(io.MultiWriter(output, progress), resp.Body); err != nil {
+		return offset > 0, err
+	}
+	progress.Finish()
+
+	return offset > 0, nil
+}
+
+// The url without the password it may have
+func redactURL(rawurl string) string {
+	u, err := neturl.Parse(rawurl)
+	if err != nil {
+		return rawurl
+	}
+	return u.Redacted()
+}
+
+// Headers of the requests of a download, with the credentials of the netrc file
+func downloadHeader(rawurl string, options DownloadOptions) (http.Header, error) {
+	header := http.Header{}
+	for k, v := range options.Headers {
+		header.Set(k, v)
+	}
+
+	u, err := neturl.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if header.Get("Authorization") != "" || u.User != nil || options.Netrc == "" {
+		return header, nil
+	}
+
+	login, password, found, err := netrcCredentials(options.Netrc, u.Hostname())
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		req := http.Request{Header: header}
+		req.SetBasicAuth(login, password)
+		log.Printf("Using the credentials of %s from %s", u.Hostname(), options.Netrc)
+	}
+
+	return header, nil
+}
+
+/* Returns the login and password of the machine in the netrc file, or of its
+ * default entry, see netrc(5) */
+func netrcCredentials(netrc, machine string) (string, string, bool, error) {
+	data, err := ioutil.ReadFile(netrc)
+	if os.IsNotExist(err) {
+		return "", "", false, nil
+	}
+	if err != nil {
+		return "", "", false, err
+	}
+
+	type entry struct{ login, password string }
+	var matched, fallback *entry
+	var current *entry
+
+	lines := strings.Split(string(data), "\n")
+	for n := 0; n < len(lines); n++ {
+		tokens := strings.Fields(lines[n])
+		for t := 0; t < len(tokens); t++ {
+			next := func() string {
+				if t+1 < len(tokens) {
+					t++
+					return tokens[t]
+				}
+				return ""
+			}
+			switch tokens[t] {
+			case "machine":
+				current = &entry{}
+				if next() == machine && matched == nil {
+					matched = current
+				}
+			case "default":
+				current = &entry{}
+				if fallback == nil {
+					fallback = current
+				}
+			case "login":
+				if current != nil {
+					current.login = next()
+				} else {
+					next()
+				}
+			case "password":
+				if current != nil {
+					current.password = next()
+				} else {
+					next()
+				}
+			case "account":
+				next()
+			case "macdef":
+				// The macro runs up to the next empty line
+				for n+1 < len(lines) && strings.TrimSpace(lines[n+1]) != "" {
+					n++
+				}
+				t = len(tokens)
+			}
+		}
+	}
+
+	if matched == nil {
+		matched = fallback
+	}
+	if matched == nil {
+		return "", "", false, nil
+	}
+
+	return matched.login, matched.password, true, nil
+}
+
+func fileSha256(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
 	}
 
-	return nil
+	return hex.EncodeToString(h.Sum(nil)), nil
 }
@@ -0,0 +1,110 @@
+package debos
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/docker/go-units"
+)
+
+// Minimal time between two reports of a streaming copy
+var progressInterval = 5 * time.Second
+
+/* Progress of a long running step of an action, such as a download. Each
+ * report is logged as a line in the text log format, and as a record of the
+ * 'progress' phase with a percentage in the json log format */
+type Progress struct {
+	name     string
+	total    int64 // 0 when unknown
+	done     int64
+	bytes    bool
+	percent  int
+	reported time.Time
+}
+
+// Progress counted in steps, such as stages or partitions
+func NewProgress(name string, total int) *Progress {
+	return &Progress{name: name, total: int64(total), percent: -1}
+}
+
+/* Progress counted in bytes, total is 0 when unknown. It's an io.Writer so it
+ * can be driven by a streaming copy through an io.MultiWriter */
+func NewBytesProgress(name string, total int64) *Progress {
+	if total < 0 {
+		total = 0
+	}
+	return &Progress{name: name, total: total, bytes: true, percent: -1}
+}
+
+func (p *Progress) currentPercent() int {
+	if p.total == 0 {
+		return -1
+	}
+	return int(p.done * 100 / p.total)
+}
+
+func (p *Progress) report(detail string) {
+	p.percent = p.currentPercent()
+	p.reported = time.Now()
+
+	var count string
+	if p.bytes {
+		count = units.HumanSize(float64(p.done))
+		if p.total > 0 {
+			count += "/" + units.HumanSize(float64(p.total))
+		}
+	} else {
+		count = fmt.Sprintf("%d/%d", p.done, p.total)
+	}
+	if detail != "" {
+		count = detail + ", " + count
+	}
+
+	message := fmt.Sprintf("%s: %s", p.name, count)
+	if p.percent >= 0 {
+		message = fmt.Sprintf("%s: %d%% (%s)", p.name, p.percent, count)
+	}
+
+	if !logger.json {
+		log.Println(message)
+		return
+	}
+
+	r := logRecord{Level: "info", Phase: "progress", Message: message,
+		Done: p.done, Total: p.total}
+	if p.percent >= 0 {
+		percent := p.percent
+		r.Percent = &percent
+	}
+	writeLogRecord(r)
+}
+
+// Report the steps done so far, detail is the step being run, if any
+func (p *Progress) Update(done int, detail string) {
+	p.done = int64(done)
+	p.report(detail)
+}
+
+/* Count the bytes written, reporting them once the percentage changed and
+ * enough time passed since the last report */
+func (p *Progress) Write(b []byte) (int, error) {
+	p.done += int64(len(b))
+
+	changed := p.total == 0 || p.currentPercent() != p.percent
+	if changed && time.Since(p.reported) >= progressInterval {
+		p.report("")
+	}
+
+	return len(b), nil
+}
+
+// Report the completion, unless it was already reported
+func (p *Progress) Finish() {
+	if p.total == 0 || p.total < p.done {
+		p.total = p.done
+	}
+	if p.percent != 100 {
+		p.report("")
+	}
+}
@@ -0,0 +1,89 @@
+package debos
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProgress(t *testing.T) {
+	var out bytes.Buffer
+
+	assert.Empty(t, SetLogFormat("json"))
+	defer SetLogFormat("text")
+	logger.out = &out
+
+	p := NewProgress("Partitioning", 2)
+	p.Update(0, "root")
+	p.Update(2, "done")
+
+	records := readLogRecords(t, &out)
+	assert.Len(t, records, 2)
+	assert.Equal(t, "progress", records[0].Phase)
+	assert.Equal(t, "Partitioning: 0% (root, 0/2)", records[0].Message)
+	assert.Equal(t, 0, *records[0].Percent)
+	assert.Equal(t, 100, *records[1].Percent)
+	assert.Equal(t, int64(2), records[1].Done)
+	assert.Equal(t, int64(2), records[1].Total)
+
+	// Unknown size, only the byte counts are reported
+	p = NewBytesProgress("Download", -1)
+	p.Write(make([]byte, 10))
+	p.Finish()
+	records = readLogRecords(t, &out)
+	assert.Len(t, records, 2)
+	assert.Nil(t, records[0].Percent)
+	assert.Equal(t, int64(10), records[0].Done)
+	assert.Equal(t, 100, *records[1].Percent)
+}
+
+func TestDownloadProgress(t *testing.T) {
+	var out bytes.Buffer
+
+	assert.Empty(t, SetLogFormat("json"))
+	defer SetLogFormat("text")
+	logger.out = &out
+
+	interval := progressInterval
+	progressInterval = 0
+	defer func() { progressInterval = interval }()
+
+	content := strings.Repeat("debos", 64*1024)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.Write([]byte(content))
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	filename := path.Join(dir, "file")
+	assert.Empty(t, DownloadHttpUrl(nil, server.URL, filename))
+	downloaded, err := ioutil.ReadFile(filename)
+	assert.Empty(t, err)
+	assert.Equal(t, content, string(downloaded))
+
+	var last logRecord
+	percent := -1
+	for _, r := range readLogRecords(t, &out) {
+		if r.Phase != "progress" {
+			continue
+		}
+		assert.Equal(t, int64(len(content)), r.Total)
+		assert.True(t, *r.Percent > percent, "Percentage going backwards")
+		percent = *r.Percent
+		last = r
+	}
+	assert.Equal(t, 100, percent)
+	assert.Equal(t, int64(len(content)), last.Done)
+}
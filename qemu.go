@@ -0,0 +1,88 @@
+package debos
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Options of the VM command line which are managed by debos and fakemachine,
+// with a hint on how to change them instead where applicable
+var managedQemuArgs = map[string]string{
+	"-m":          "use --memory instead",
+	"-smp":        "use --cpus instead",
+	"-cpu":        "",
+	"-kernel":     "",
+	"-initrd":     "",
+	"-append":     "",
+	"-display":    "",
+	"-nographic":  "",
+	"-no-reboot":  "",
+	"-enable-kvm": "use --kvm instead",
+	"-accel":      "use --kvm instead",
+}
+
+// Device giving access to KVM
+var kvmDevice = "/dev/kvm"
+
+// Software emulation, qemu falls back to the accelerators given last
+var tcgQemuArgs = []string{"-accel", "tcg", "-cpu", "max"}
+
+// CheckKVM() returns nil if the build VM can use KVM, the reason otherwise.
+func CheckKVM() error {
+	kvm, err := os.OpenFile(kvmDevice, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	return kvm.Close()
+}
+
+/*
+QemuAccelArgs() returns the extra VM arguments to run it with software
+emulation (TCG) rather than KVM, if any. The mode is 'on' to require KVM, 'off'
+to never use it, or 'auto' to fall back to TCG when KVM isn't available.
+*/
+func QemuAccelArgs(mode string, kvm error) ([]string, error) {
+	switch mode {
+	case "on":
+		if kvm != nil {
+			return nil, fmt.Errorf("KVM is required by --kvm=on but isn't available: %v", kvm)
+		}
+		return nil, nil
+	case "off":
+		return tcgQemuArgs, nil
+	case "auto":
+		if kvm != nil {
+			return tcgQemuArgs, nil
+		}
+		return nil, nil
+	}
+
+	return nil, fmt.Errorf("Invalid KVM mode '%s', expected auto, on or off", mode)
+}
+
+/*
+ParseQemuArgs() splits the extra VM arguments given by the user on whitespace
+and checks they don't override any of the arguments managed by debos.
+*/
+func ParseQemuArgs(values []string) ([]string, error) {
+	var args []string
+
+	for _, v := range values {
+		for _, arg := range strings.Fields(v) {
+			// qemu accepts both -option and --option
+			option := "-" + strings.TrimLeft(arg, "-")
+			if strings.HasPrefix(arg, "-") {
+				if hint, ok := managedQemuArgs[option]; ok {
+					if hint != "" {
+						return nil, fmt.Errorf("qemu argument '%s' is managed by debos, %s", arg, hint)
+					}
+					return nil, fmt.Errorf("qemu argument '%s' is managed by debos", arg)
+				}
+			}
+			args = append(args, arg)
+		}
+	}
+
+	return args, nil
+}
@@ -0,0 +1,66 @@
+package debos_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/go-debos/debos"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseQemuArgs(t *testing.T) {
+	args, err := debos.ParseQemuArgs([]string{
+		"-machine q35",
+		"-device usb-host,vendorid=0x1234,productid=0x5678",
+		"-rtc",
+		"base=utc",
+	})
+	assert.Empty(t, err)
+	assert.Equal(t, []string{
+		"-machine", "q35",
+		"-device", "usb-host,vendorid=0x1234,productid=0x5678",
+		"-rtc", "base=utc",
+	}, args)
+
+	args, err = debos.ParseQemuArgs(nil)
+	assert.Empty(t, err)
+	assert.Empty(t, args)
+
+	_, err = debos.ParseQemuArgs([]string{"-m 4G"})
+	assert.EqualError(t, err, "qemu argument '-m' is managed by debos, use --memory instead")
+
+	_, err = debos.ParseQemuArgs([]string{"-machine q35", "--kernel", "/boot/vmlinuz"})
+	assert.EqualError(t, err, "qemu argument '--kernel' is managed by debos")
+
+	// Values which look like managed options are fine
+	_, err = debos.ParseQemuArgs([]string{"-name", "m"})
+	assert.Empty(t, err)
+}
+
+func TestQemuAccelArgs(t *testing.T) {
+	missing := errors.New("open /dev/kvm: no such file or directory")
+	tcg := []string{"-accel", "tcg", "-cpu", "max"}
+
+	args, err := debos.QemuAccelArgs("auto", nil)
+	assert.Empty(t, err)
+	assert.Empty(t, args)
+	args, err = debos.QemuAccelArgs("auto", missing)
+	assert.Empty(t, err)
+	assert.Equal(t, tcg, args)
+
+	args, err = debos.QemuAccelArgs("off", nil)
+	assert.Empty(t, err)
+	assert.Equal(t, tcg, args)
+
+	args, err = debos.QemuAccelArgs("on", nil)
+	assert.Empty(t, err)
+	assert.Empty(t, args)
+	_, err = debos.QemuAccelArgs("on", missing)
+	assert.EqualError(t, err, "KVM is required by --kvm=on but isn't available: open /dev/kvm: no such file or directory")
+
+	_, err = debos.QemuAccelArgs("tcg", nil)
+	assert.EqualError(t, err, "Invalid KVM mode 'tcg', expected auto, on or off")
+
+	_, err = debos.ParseQemuArgs([]string{"-accel kvm"})
+	assert.EqualError(t, err, "qemu argument '-accel' is managed by debos, use --kvm instead")
+}
@@ -0,0 +1,347 @@
+package debos
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+/*
+SystemdHelper is used to manage systemd units in a root filesystem without
+a running systemd, by manipulating the unit symlinks directly.
+*/
+type SystemdHelper struct {
+	Rootdir string
+}
+
+var systemdUnitDirs = []string{
+	"/etc/systemd/system",
+	"/lib/systemd/system",
+	"/usr/lib/systemd/system",
+}
+
+const systemdConfigDir = "/etc/systemd/system"
+
+// Directories of the preset files, the first ones overriding the files of the same name
+var systemdPresetDirs = []string{
+	"/etc/systemd/system-preset",
+	"/lib/systemd/system-preset",
+	"/usr/lib/systemd/system-preset",
+}
+
+/*
+UnitPath() returns the path of the unit file inside the root filesystem. The
+instances of a template unit, like 'getty@tty2.service', are found by the
+template.
+*/
+func (s *SystemdHelper) UnitPath(unit string) (string, error) {
+	names := []string{unit}
+	if template := systemdTemplate(unit); template != unit {
+		names = append(names, template)
+	}
+
+	for _, dir := range systemdUnitDirs {
+		for _, name := range names {
+			p := path.Join(dir, name)
+			if _, err := os.Lstat(path.Join(s.Rootdir, p)); err == nil {
+				return p, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("Unit '%s' not found", unit)
+}
+
+// Template of an instance unit, the unit itself otherwise
+func systemdTemplate(unit string) string {
+	at := strings.Index(unit, "@")
+	dot := strings.LastIndex(unit, ".")
+	if at < 0 || dot < at {
+		return unit
+	}
+	return unit[:at+1] + unit[dot:]
+}
+
+// Parse the [Install] section of a unit file
+func (s *SystemdHelper) installSection(unitpath string) (map[string][]string, error) {
+	f, err := os.Open(path.Join(s.Rootdir, unitpath))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	install := make(map[string][]string)
+	section := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if line[0] == '[' {
+			section = line
+			continue
+		}
+		if section != "[Install]" {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key := strings.TrimSpace(kv[0])
+		install[key] = append(install[key], strings.Fields(kv[1])...)
+	}
+
+	return install, scanner.Err()
+}
+
+func (s *SystemdHelper) link(target, link string) error {
+	link = path.Join(s.Rootdir, link)
+	if err := os.MkdirAll(path.Dir(link), 0755); err != nil {
+		return err
+	}
+	if current, err := os.Readlink(link); err == nil && current == target {
+		return nil
+	}
+	os.Remove(link)
+	return os.Symlink(target, link)
+}
+
+/*
+Enable() enables the unit as 'systemctl enable' does, following the
+WantedBy=, RequiredBy=, Alias= and Also= directives of its [Install] section.
+*/
+func (s *SystemdHelper) Enable(unit string) error {
+	return s.enable(unit, map[string]bool{})
+}
+
+func (s *SystemdHelper) enable(unit string, seen map[string]bool) error {
+	if seen[unit] {
+		return nil
+	}
+	seen[unit] = true
+
+	unitpath, err := s.UnitPath(unit)
+	if err != nil {
+		return err
+	}
+
+	install, err := s.installSection(unitpath)
+	if err != nil {
+		return err
+	}
+
+	for _, target := range install["WantedBy"] {
+		link := path.Join(systemdConfigDir, target+".wants", unit)
+		if err := s.link(unitpath, link); err != nil {
+			return err
+		}
+	}
+	for _, target := range install["RequiredBy"] {
+		link := path.Join(systemdConfigDir, target+".requires", unit)
+		if err := s.link(unitpath, link); err != nil {
+			return err
+		}
+	}
+	for _, alias := range install["Alias"] {
+		if err := s.link(unitpath, path.Join(systemdConfigDir, alias)); err != nil {
+			return err
+		}
+	}
+	for _, also := range install["Also"] {
+		if err := s.enable(also, seen); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/*
+Disable() disables the unit as 'systemctl disable' does, removing the links
+of the configuration directory to the unit and its aliases, and disabling the
+units of its Also= directive. A masked unit stays masked.
+*/
+func (s *SystemdHelper) Disable(unit string) error {
+	return s.disable(unit, map[string]bool{})
+}
+
+func (s *SystemdHelper) disable(unit string, seen map[string]bool) error {
+	if seen[unit] {
+		return nil
+	}
+	seen[unit] = true
+
+	unitpath, err := s.UnitPath(unit)
+	if err != nil {
+		return err
+	}
+
+	install, err := s.installSection(unitpath)
+	if err != nil {
+		return err
+	}
+
+	names := map[string]bool{unit: true}
+	for _, alias := range install["Alias"] {
+		names[alias] = true
+	}
+
+	config := path.Join(s.Rootdir, systemdConfigDir)
+	err = filepath.Walk(config, func(p string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// The unit itself, or its mask
+		if info.Mode()&os.ModeSymlink == 0 || !names[info.Name()] || p == path.Join(config, unit) {
+			return nil
+		}
+		return os.Remove(p)
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, also := range install["Also"] {
+		if err := s.disable(also, seen); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/*
+Mask() masks the unit as 'systemctl mask' does, linking it to /dev/null in the
+configuration directory.
+*/
+func (s *SystemdHelper) Mask(unit string) error {
+	link := path.Join(systemdConfigDir, unit)
+	if info, err := os.Lstat(path.Join(s.Rootdir, link)); err == nil && info.Mode()&os.ModeSymlink == 0 {
+		return fmt.Errorf("Unit '%s' is a file of %s, it can't be masked", unit, systemdConfigDir)
+	}
+	return s.link("/dev/null", link)
+}
+
+// Rule of a preset file
+type systemdPreset struct {
+	enable    bool
+	pattern   string
+	instances []string
+}
+
+// Rules of the preset files, in the order they apply
+func (s *SystemdHelper) presets() ([]systemdPreset, error) {
+	files := map[string]string{}
+	var names []string
+	for _, dir := range systemdPresetDirs {
+		entries, err := ioutil.ReadDir(path.Join(s.Rootdir, dir))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		for _, e := range entries {
+			if !strings.HasSuffix(e.Name(), ".preset") || files[e.Name()] != "" {
+				continue
+			}
+			files[e.Name()] = path.Join(s.Rootdir, dir, e.Name())
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+
+	var presets []systemdPreset
+	for _, name := range names {
+		content, err := ioutil.ReadFile(files[name])
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range strings.Split(string(content), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) < 2 || fields[0][0] == '#' || fields[0][0] == ';' {
+				continue
+			}
+			switch fields[0] {
+			case "enable":
+				presets = append(presets, systemdPreset{true, fields[1], fields[2:]})
+			case "disable":
+				presets = append(presets, systemdPreset{false, fields[1], nil})
+			}
+		}
+	}
+
+	return presets, nil
+}
+
+/*
+PresetAll() enables or disables all the installed units as their preset
+says, as 'systemctl preset-all' does. The first matching rule of the preset
+files applies, units without any are enabled. Templates are only enabled for
+the instances given by their rule.
+*/
+func (s *SystemdHelper) PresetAll() error {
+	presets, err := s.presets()
+	if err != nil {
+		return err
+	}
+
+	seen := map[string]bool{}
+	for _, dir := range systemdUnitDirs {
+		entries, err := ioutil.ReadDir(path.Join(s.Rootdir, dir))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		for _, e := range entries {
+			// Aliases are handled with their unit
+			if seen[e.Name()] || !e.Mode().IsRegular() {
+				continue
+			}
+			seen[e.Name()] = true
+
+			install, err := s.installSection(path.Join(dir, e.Name()))
+			if err != nil {
+				return err
+			}
+			if len(install) == 0 {
+				// Static unit
+				continue
+			}
+
+			preset := systemdPreset{enable: true}
+			for _, p := range presets {
+				if match, _ := path.Match(p.pattern, e.Name()); match {
+					preset = p
+					break
+				}
+			}
+
+			if strings.Contains(e.Name(), "@.") {
+				if !preset.enable {
+					continue
+				}
+				for _, instance := range preset.instances {
+					at := strings.Index(e.Name(), "@")
+					if err := s.Enable(e.Name()[:at+1] + instance + e.Name()[at+1:]); err != nil {
+						return err
+					}
+				}
+			} else if preset.enable {
+				err = s.Enable(e.Name())
+			} else {
+				err = s.Disable(e.Name())
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}